@@ -0,0 +1,98 @@
+"""Helpers for the parts of the IsoBox API that generated clients don't cover: the
+Server-Sent Events stream of execution events, and waiting for async jobs."""
+
+import json
+import time
+from dataclasses import dataclass
+from typing import Callable, Iterable, Iterator, Optional
+
+import urllib3
+
+from isobox_client.api.jobs_api import JobsApi
+from isobox_client.models.job_status import JobStatus
+
+
+@dataclass
+class Event:
+    """One execution event, e.g. ``started`` or ``finished``"""
+
+    event: str
+    data: dict
+
+
+class StreamError(Exception):
+    def __init__(self, status: int, body: bytes):
+        super().__init__(f"Event stream failed with HTTP {status}: {body[:200]!r}")
+        self.status = status
+        self.body = body
+
+
+def parse_events(
+    lines: Iterable[bytes], on_dropped: Optional[Callable[[int], None]] = None
+) -> Iterator[Event]:
+    """Parses Server-Sent Events lines into events. Keepalive comments are skipped;
+    ``on_dropped`` is called with the count when the server reports dropped events."""
+    event, data = "message", []
+    for raw in lines:
+        line = raw.decode("utf-8").rstrip("\r\n")
+        if not line:
+            if data:
+                yield Event(event, json.loads("\n".join(data)))
+            event, data = "message", []
+        elif line.startswith(":"):
+            words = line[1:].split()
+            if on_dropped and len(words) == 3 and words[1:] == ["events", "dropped"]:
+                on_dropped(int(words[0]))
+        else:
+            field, _, value = line.partition(":")
+            value = value[1:] if value.startswith(" ") else value
+            if field == "event":
+                event = value
+            elif field == "data":
+                data.append(value)
+
+
+def stream_events(
+    base_url: str,
+    api_key: Optional[str] = None,
+    on_dropped: Optional[Callable[[int], None]] = None,
+) -> Iterator[Event]:
+    """Yields the caller's execution events as they happen, until the connection
+    closes. Only events that happen while the stream is open are delivered."""
+    headers = {"Accept": "text/event-stream"}
+    if api_key:
+        headers["X-API-Key"] = api_key
+    response = urllib3.PoolManager().request(
+        "GET",
+        f"{base_url.rstrip('/')}/v1/events",
+        headers=headers,
+        preload_content=False,
+        # Idle streams get a keepalive every 15 seconds
+        timeout=urllib3.Timeout(connect=10, read=60),
+    )
+    try:
+        if response.status != 200:
+            raise StreamError(response.status, response.read())
+        yield from parse_events(response, on_dropped)
+    finally:
+        response.release_conn()
+
+
+def wait_for_job(
+    jobs: JobsApi,
+    job_id: str,
+    timeout: Optional[float] = None,
+    poll_interval: float = 0.5,
+    max_poll_interval: float = 5.0,
+) -> JobStatus:
+    """Polls a job submitted with ``JobsApi.submit_job`` until it completes or fails,
+    backing off between polls. Raises ``TimeoutError`` after ``timeout`` seconds."""
+    deadline = None if timeout is None else time.monotonic() + timeout
+    while True:
+        status = jobs.get_job(job_id)
+        if status.state in ("completed", "failed"):
+            return status
+        if deadline is not None and time.monotonic() + poll_interval > deadline:
+            raise TimeoutError(f"Job {job_id} is still {status.state}")
+        time.sleep(poll_interval)
+        poll_interval = min(poll_interval * 2, max_poll_interval)
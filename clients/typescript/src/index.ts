@@ -0,0 +1,3 @@
+// API classes and models are generated into ./generated by `make sdk-typescript`
+export * from "./generated";
+export * from "./streaming";
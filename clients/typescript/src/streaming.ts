@@ -0,0 +1,101 @@
+// Helpers for the parts of the IsoBox API that generated clients don't cover: the
+// Server-Sent Events stream of execution events, and waiting for async jobs.
+
+import { ExecutionEvent, ExecutionEventFromJSON, JobStatus, JobsApi } from "./generated";
+
+export interface StreamEventsOptions {
+  basePath: string;
+  apiKey?: string;
+  signal?: AbortSignal;
+  // Called with the count when the server reports events dropped for a slow reader
+  onDropped?: (count: number) => void;
+}
+
+export class StreamError extends Error {
+  constructor(
+    public readonly status: number,
+    public readonly body: string,
+  ) {
+    super(`Event stream failed with HTTP ${status}: ${body.slice(0, 200)}`);
+  }
+}
+
+// Parses Server-Sent Events lines into events. Keepalive comments are skipped.
+export function* parseEvents(
+  lines: Iterable<string>,
+  onDropped?: (count: number) => void,
+): Generator<ExecutionEvent> {
+  let data: string[] = [];
+  for (const raw of lines) {
+    const line = raw.replace(/\r$/, "");
+    if (line === "") {
+      if (data.length > 0) yield ExecutionEventFromJSON(JSON.parse(data.join("\n")));
+      data = [];
+    } else if (line.startsWith(":")) {
+      const dropped = /^: (\d+) events dropped$/.exec(line);
+      if (dropped && onDropped) onDropped(Number(dropped[1]));
+    } else if (line.startsWith("data:")) {
+      data.push(line.slice(5).replace(/^ /, ""));
+    }
+    // The event name is repeated in the data as `event`, so `event:` lines aren't needed
+  }
+}
+
+// Yields the caller's execution events as they happen, until the connection closes or
+// `signal` aborts. Unlike the browser's EventSource, this can send the API key header.
+export async function* streamEvents(options: StreamEventsOptions): AsyncGenerator<ExecutionEvent> {
+  const headers: Record<string, string> = { Accept: "text/event-stream" };
+  if (options.apiKey) headers["X-API-Key"] = options.apiKey;
+  const response = await fetch(`${options.basePath.replace(/\/$/, "")}/v1/events`, {
+    headers,
+    signal: options.signal,
+  });
+  if (!response.ok || !response.body) {
+    throw new StreamError(response.status, await response.text());
+  }
+
+  const reader = response.body.getReader();
+  const decoder = new TextDecoder();
+  let buffered = "";
+  try {
+    for (;;) {
+      const { done, value } = await reader.read();
+      if (done) return;
+      buffered += decoder.decode(value, { stream: true });
+      // Only parse up to the last complete event; the rest waits for more data
+      const end = buffered.lastIndexOf("\n\n");
+      if (end < 0) continue;
+      const complete = buffered.slice(0, end + 2);
+      buffered = buffered.slice(end + 2);
+      yield* parseEvents(complete.split("\n"), options.onDropped);
+    }
+  } finally {
+    reader.releaseLock();
+  }
+}
+
+export interface WaitForJobOptions {
+  timeoutMs?: number;
+  pollIntervalMs?: number;
+  maxPollIntervalMs?: number;
+}
+
+// Polls a job submitted with `JobsApi.submitJob` until it completes or fails, backing
+// off between polls. Rejects once `timeoutMs` has passed.
+export async function waitForJob(
+  jobs: JobsApi,
+  id: string,
+  options: WaitForJobOptions = {},
+): Promise<JobStatus> {
+  const deadline = options.timeoutMs === undefined ? undefined : Date.now() + options.timeoutMs;
+  let interval = options.pollIntervalMs ?? 500;
+  for (;;) {
+    const status = await jobs.getJob({ id });
+    if (status.state === "completed" || status.state === "failed") return status;
+    if (deadline !== undefined && Date.now() + interval > deadline) {
+      throw new Error(`Job ${id} is still ${status.state}`);
+    }
+    await new Promise((resolve) => setTimeout(resolve, interval));
+    interval = Math.min(interval * 2, options.maxPollIntervalMs ?? 5000);
+  }
+}
@@ -19,7 +19,7 @@ echo "========================================"
 echo -e "\n1️⃣  Testing HTTP API without authentication..."
 if curl -s -X POST "$HTTP_URL/api/v1/execute" \
   -H "Content-Type: application/json" \
-  -d '{"language": "python", "code": "print(\"Hello World!\")"}' | grep -q "API Key not provided"; then
+  -d '{"language": "python", "code": "print(\"Hello World!\")"}' | grep -q "X-API-Key header"; then
   echo "✅ Correctly rejected request without API key"
 else
   echo "❌ Unexpected response for request without API key"
@@ -30,7 +30,7 @@ echo -e "\n2️⃣  Testing HTTP API with invalid API key..."
 if curl -s -X POST "$HTTP_URL/api/v1/execute" \
   -H "Content-Type: application/json" \
   -H "X-API-Key: $INVALID_API_KEY" \
-  -d '{"language": "python", "code": "print(\"Hello World!\")"}' | grep -q "Invalid API Key"; then
+  -d '{"language": "python", "code": "print(\"Hello World!\")"}' | grep -q "API key is not valid"; then
   echo "✅ Correctly rejected request with invalid API key"
 else
   echo "❌ Unexpected response for request with invalid API key"
@@ -0,0 +1,414 @@
+use crate::config::{AbuseConfig, RateLimit};
+use crate::executor::ExecuteResponse;
+use crate::store::unix_timestamp;
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::sync::Mutex;
+
+// Flags kept for review; the oldest reviewed ones go first, then the oldest
+const MAX_FLAGS: usize = 10_000;
+
+// The stratum protocol miners speak, and pools popular with hijacked machines
+const POOL_MARKERS: &[&str] = &[
+    "stratum+tcp://",
+    "stratum+ssl://",
+    "stratum2+tcp://",
+    "mining.subscribe",
+    "mining.authorize",
+    "minexmr",
+    "supportxmr",
+    "moneroocean",
+    "nanopool.org",
+    "2miners.com",
+    "f2pool",
+    "hashvault.pro",
+    "herominers",
+    "unmineable",
+    "nicehash",
+];
+
+const MINER_MARKERS: &[&str] = &[
+    "xmrig", "xmr-stak", "cpuminer", "minerd", "cgminer", "bfgminer", "ethminer", "nbminer",
+    "lolminer",
+];
+
+// Flooding tools and attacks, which botnets rent playgrounds for
+const BOTNET_MARKERS: &[&str] = &[
+    "udpflood",
+    "synflood",
+    "tcpflood",
+    "httpflood",
+    "slowloris",
+    "hping3",
+];
+
+/// A pattern of abuse an execution matched
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum Signal {
+    /// Ran at its CPU limit until killed, printing nothing. Infinite loops look the
+    /// same, so this doesn't count as a strike on its own.
+    SustainedCpu,
+    /// Mentions or speaks to a mining pool
+    MiningPool,
+    /// Mentions or runs a known miner
+    MinerBinary,
+    /// Mentions or runs a flooding tool
+    Botnet,
+}
+
+impl Signal {
+    fn strike(self) -> bool {
+        self != Signal::SustainedCpu
+    }
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct Finding {
+    pub signal: Signal,
+    /// The line of code or trace it was found in
+    pub evidence: String,
+}
+
+/// What a tenant may still do after being flagged
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum Restriction {
+    /// Requests are limited to the `abuse.throttle` rate
+    Throttle,
+    /// Every request is refused
+    Ban,
+}
+
+impl Restriction {
+    pub fn as_str(self) -> &'static str {
+        match self {
+            Restriction::Throttle => "throttle",
+            Restriction::Ban => "ban",
+        }
+    }
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum FlagStatus {
+    Pending,
+    /// Reviewed and found harmless
+    Dismissed,
+    /// Reviewed and found abusive
+    Confirmed,
+}
+
+/// A reviewer's verdict on a flag
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum Decision {
+    /// Harmless: lifts the tenant's restriction
+    Dismiss,
+    Throttle,
+    Ban,
+}
+
+/// An execution waiting for, or past, review
+#[derive(Debug, Clone, Serialize)]
+pub struct AbuseFlag {
+    pub id: String,
+    pub execution_id: String,
+    pub tenant: String,
+    pub language: String,
+    pub timestamp: u64,
+    pub findings: Vec<Finding>,
+    pub status: FlagStatus,
+    /// Restriction the flag put on the tenant, automatically or by review
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub restriction: Option<Restriction>,
+}
+
+#[derive(Default)]
+struct State {
+    flags: Vec<AbuseFlag>,
+    restrictions: HashMap<String, Restriction>,
+}
+
+/// Flags executions that look like cryptomining or botnets and restricts tenants
+/// that keep getting flagged. Flags and restrictions are kept in memory.
+pub struct AbuseMonitor {
+    config: AbuseConfig,
+    state: Mutex<State>,
+}
+
+impl AbuseMonitor {
+    pub fn new(config: AbuseConfig) -> Self {
+        Self {
+            config,
+            state: Mutex::new(State::default()),
+        }
+    }
+
+    /// Request limit of throttled tenants
+    pub fn throttle(&self) -> RateLimit {
+        self.config.throttle
+    }
+
+    pub fn restriction(&self, tenant: &str) -> Option<Restriction> {
+        self.state.lock().unwrap().restrictions.get(tenant).copied()
+    }
+
+    /// Restricted tenants, by tenant
+    pub fn restrictions(&self) -> HashMap<String, Restriction> {
+        self.state.lock().unwrap().restrictions.clone()
+    }
+
+    /// Flags the execution if it matches a pattern of abuse. Once a tenant has
+    /// `strikes` pending flags that count as strikes, `action` is applied to it.
+    pub fn inspect(
+        &self,
+        execution_id: &str,
+        tenant: &str,
+        language: &str,
+        code: &str,
+        response: Option<&ExecuteResponse>,
+        trace: Option<&str>,
+    ) -> Option<AbuseFlag> {
+        let mut findings = scan(code);
+        for finding in trace.map(scan).into_iter().flatten() {
+            push(&mut findings, finding);
+        }
+        if let Some(evidence) =
+            response.and_then(|response| sustained_cpu(response, self.config.sustained_cpu_seconds))
+        {
+            push(
+                &mut findings,
+                Finding {
+                    signal: Signal::SustainedCpu,
+                    evidence,
+                },
+            );
+        }
+        if findings.is_empty() {
+            return None;
+        }
+
+        let mut state = self.state.lock().unwrap();
+        let mut flag = AbuseFlag {
+            id: uuid::Uuid::new_v4().to_string(),
+            execution_id: execution_id.to_string(),
+            tenant: tenant.to_string(),
+            language: language.to_string(),
+            timestamp: unix_timestamp(),
+            findings,
+            status: FlagStatus::Pending,
+            restriction: None,
+        };
+        let strikes = state
+            .flags
+            .iter()
+            .chain(std::iter::once(&flag))
+            .filter(|flag| flag.tenant == tenant && flag.status == FlagStatus::Pending)
+            .filter(|flag| flag.findings.iter().any(|finding| finding.signal.strike()))
+            .count();
+        if let Some(action) = self.config.action {
+            let exempt = self.config.exempt_tenants.iter().any(|t| t == tenant);
+            let restricted = state.restrictions.get(tenant).copied();
+            if !exempt
+                && strikes >= self.config.strikes as usize
+                && restricted != Some(Restriction::Ban)
+                && restricted != Some(action)
+            {
+                log::warn!(
+                    "Tenant '{tenant}' restricted to {} after {strikes} flagged executions",
+                    action.as_str()
+                );
+                state.restrictions.insert(tenant.to_string(), action);
+                flag.restriction = Some(action);
+            }
+        }
+        log::warn!(
+            "Execution {execution_id} of tenant '{tenant}' flagged for abuse: {}",
+            serde_json::to_string(&flag.findings).unwrap_or_default()
+        );
+        state.flags.push(flag.clone());
+        if state.flags.len() > MAX_FLAGS {
+            let oldest = state
+                .flags
+                .iter()
+                .position(|flag| flag.status != FlagStatus::Pending)
+                .unwrap_or(0);
+            state.flags.remove(oldest);
+        }
+        Some(flag)
+    }
+
+    /// Flags with the given status, or all of them, newest first
+    pub fn flags(&self, status: Option<FlagStatus>) -> Vec<AbuseFlag> {
+        let state = self.state.lock().unwrap();
+        state
+            .flags
+            .iter()
+            .rev()
+            .filter(|flag| status.map_or(true, |status| flag.status == status))
+            .cloned()
+            .collect()
+    }
+
+    /// Records a reviewer's decision on a flag and applies it to the flag's
+    /// tenant. None when there is no such flag.
+    pub fn review(&self, id: &str, decision: Decision) -> Option<AbuseFlag> {
+        let mut state = self.state.lock().unwrap();
+        let flag = state.flags.iter_mut().find(|flag| flag.id == id)?;
+        let restriction = match decision {
+            Decision::Dismiss => None,
+            Decision::Throttle => Some(Restriction::Throttle),
+            Decision::Ban => Some(Restriction::Ban),
+        };
+        flag.status = match restriction {
+            Some(_) => FlagStatus::Confirmed,
+            None => FlagStatus::Dismissed,
+        };
+        flag.restriction = restriction;
+        let flag = flag.clone();
+        match restriction {
+            Some(restriction) => state.restrictions.insert(flag.tenant.clone(), restriction),
+            None => state.restrictions.remove(&flag.tenant),
+        };
+        log::info!(
+            "Abuse flag {id} of tenant '{}' reviewed: {}",
+            flag.tenant,
+            restriction.map_or("dismissed", Restriction::as_str)
+        );
+        Some(flag)
+    }
+}
+
+/// Mining and botnet patterns in code or an strace log, at most one per signal
+pub fn scan(text: &str) -> Vec<Finding> {
+    let mut findings = Vec::new();
+    let signals = [
+        (Signal::MiningPool, POOL_MARKERS),
+        (Signal::MinerBinary, MINER_MARKERS),
+        (Signal::Botnet, BOTNET_MARKERS),
+    ];
+    for line in text.lines() {
+        let lowercase = line.to_lowercase();
+        for (signal, markers) in signals {
+            if markers.iter().any(|marker| lowercase.contains(marker)) {
+                push(
+                    &mut findings,
+                    Finding {
+                        signal,
+                        evidence: truncate(line.trim()),
+                    },
+                );
+            }
+        }
+    }
+    findings
+}
+
+// A run killed at its CPU time limit after at least `min_seconds`, with nothing on
+// stdout
+fn sustained_cpu(response: &ExecuteResponse, min_seconds: f64) -> Option<String> {
+    let seconds = response.time_taken?;
+    (response.term_reason.as_deref() == Some("killed by CPU time limit")
+        && seconds >= min_seconds
+        && response.stdout.trim().is_empty())
+    .then(|| format!("killed by CPU time limit after {seconds:.1}s without output"))
+}
+
+fn push(findings: &mut Vec<Finding>, finding: Finding) {
+    if !findings.iter().any(|seen| seen.signal == finding.signal) {
+        findings.push(finding);
+    }
+}
+
+fn truncate(evidence: &str) -> String {
+    const MAX_CHARS: usize = 200;
+    match evidence.char_indices().nth(MAX_CHARS) {
+        Some((end, _)) => format!("{}...", &evidence[..end]),
+        None => evidence.to_string(),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const MINER: &str = "import subprocess\n\
+        subprocess.run(['./xmrig', '-o', 'stratum+tcp://pool.supportxmr.com:3333'])\n";
+
+    fn monitor(config: &str) -> AbuseMonitor {
+        AbuseMonitor::new(serde_json::from_str(config).unwrap())
+    }
+
+    #[test]
+    fn test_scan() {
+        let signals: Vec<Signal> = scan(MINER).iter().map(|finding| finding.signal).collect();
+        assert_eq!(signals, [Signal::MiningPool, Signal::MinerBinary]);
+        assert_eq!(
+            scan("os.system('hping3 --flood 10.0.0.1')")[0].signal,
+            Signal::Botnet
+        );
+        assert!(scan("print(sum(map(int, input().split())))").is_empty());
+
+        let spinning = ExecuteResponse {
+            time_taken: Some(5.2),
+            term_reason: Some("killed by CPU time limit".to_string()),
+            ..Default::default()
+        };
+        assert!(sustained_cpu(&spinning, 5.0).is_some());
+        assert!(sustained_cpu(&spinning, 10.0).is_none());
+    }
+
+    #[test]
+    fn test_strikes_restrict_tenant() {
+        let abuse = monitor(r#"{"action": "ban", "strikes": 2}"#);
+        let spinning = ExecuteResponse {
+            time_taken: Some(10.0),
+            term_reason: Some("killed by CPU time limit".to_string()),
+            ..Default::default()
+        };
+        // Infinite loops are flagged, but aren't strikes
+        for id in ["1", "2"] {
+            assert!(abuse
+                .inspect(
+                    id,
+                    "playground",
+                    "python",
+                    "while True: pass",
+                    Some(&spinning),
+                    None
+                )
+                .is_some());
+        }
+        assert_eq!(abuse.restriction("playground"), None);
+
+        let first = abuse
+            .inspect("3", "playground", "python", MINER, None, None)
+            .unwrap();
+        assert_eq!(first.restriction, None);
+        let second = abuse
+            .inspect("4", "playground", "python", MINER, None, None)
+            .unwrap();
+        assert_eq!(second.restriction, Some(Restriction::Ban));
+        assert_eq!(abuse.restriction("playground"), Some(Restriction::Ban));
+        assert_eq!(abuse.flags(Some(FlagStatus::Pending)).len(), 4);
+
+        let dismissed = abuse.review(&second.id, Decision::Dismiss).unwrap();
+        assert_eq!(dismissed.status, FlagStatus::Dismissed);
+        assert_eq!(abuse.restriction("playground"), None);
+        assert!(abuse.review("unknown", Decision::Ban).is_none());
+    }
+
+    #[test]
+    fn test_exempt_tenants_are_only_flagged() {
+        let abuse = monitor(
+            r#"{"action": "throttle", "strikes": 1, "exempt_tenants": ["security-course"]}"#,
+        );
+        assert!(abuse
+            .inspect("1", "security-course", "python", MINER, None, None)
+            .is_some());
+        assert_eq!(abuse.restriction("security-course"), None);
+        abuse.inspect("2", "playground", "python", MINER, None, None);
+        assert_eq!(abuse.restriction("playground"), Some(Restriction::Throttle));
+    }
+}
@@ -0,0 +1,192 @@
+use crate::events::{EventKind, EventSink, ExecutionEvent};
+use serde::Serialize;
+use std::collections::{BTreeMap, HashMap, VecDeque};
+use std::sync::Mutex;
+
+// Failures kept for the dashboard's "recent failures" list
+const RECENT_FAILURES: usize = 50;
+
+#[derive(Debug, Clone, Serialize)]
+pub struct RunningExecution {
+    pub id: String,
+    pub tenant: String,
+    pub language: String,
+    pub started_at: u64,
+}
+
+#[derive(Debug, Clone, Default, Serialize)]
+pub struct LanguageStats {
+    pub executions: u64,
+    pub failures: u64,
+    // Mean wall-clock time of executions that reported one
+    pub average_seconds: Option<f64>,
+    #[serde(skip)]
+    timed: u64,
+    #[serde(skip)]
+    total_seconds: f64,
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct FailedExecution {
+    pub id: String,
+    pub tenant: String,
+    pub language: String,
+    pub finished_at: u64,
+    pub exit_code: Option<i32>,
+    pub error: Option<String>,
+}
+
+/// What this instance is doing right now and has done since it started
+#[derive(Debug, Clone, Serialize)]
+pub struct ActivitySnapshot {
+    pub running: Vec<RunningExecution>,
+    pub languages: BTreeMap<String, LanguageStats>,
+    pub recent_failures: Vec<FailedExecution>,
+}
+
+#[derive(Default)]
+struct Activity {
+    running: HashMap<String, RunningExecution>,
+    languages: BTreeMap<String, LanguageStats>,
+    // Newest first
+    recent_failures: VecDeque<FailedExecution>,
+}
+
+/// Builds live execution statistics from this instance's execution events
+#[derive(Default)]
+pub struct ActivityTracker {
+    activity: Mutex<Activity>,
+}
+
+impl ActivityTracker {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    pub fn snapshot(&self) -> ActivitySnapshot {
+        let activity = self.activity.lock().unwrap();
+        let mut running: Vec<RunningExecution> = activity.running.values().cloned().collect();
+        running.sort_by_key(|execution| execution.started_at);
+        ActivitySnapshot {
+            running,
+            languages: activity.languages.clone(),
+            recent_failures: activity.recent_failures.iter().cloned().collect(),
+        }
+    }
+}
+
+impl EventSink for ActivityTracker {
+    fn publish(&self, event: &ExecutionEvent) {
+        let mut activity = self.activity.lock().unwrap();
+        match event.event {
+            EventKind::Queued
+            | EventKind::SessionExpiring
+            | EventKind::SessionClosed
+            | EventKind::SecurityAlert => {}
+            EventKind::Started => {
+                activity.running.insert(
+                    event.id.clone(),
+                    RunningExecution {
+                        id: event.id.clone(),
+                        tenant: event.tenant.clone(),
+                        language: event.language.clone(),
+                        started_at: event.timestamp,
+                    },
+                );
+            }
+            EventKind::Finished => {
+                activity.running.remove(&event.id);
+
+                // Non-zero exits and failed test cases count as failures too
+                let failed = match &event.result {
+                    Some(result) => {
+                        result.exit_code != 0 || result.tests_passed != result.tests_total
+                    }
+                    None => true,
+                };
+                let stats = activity
+                    .languages
+                    .entry(event.language.clone())
+                    .or_default();
+                stats.executions += 1;
+                if failed {
+                    stats.failures += 1;
+                }
+                if let Some(seconds) = event.result.as_ref().and_then(|r| r.time_taken) {
+                    stats.timed += 1;
+                    stats.total_seconds += seconds;
+                    stats.average_seconds = Some(stats.total_seconds / stats.timed as f64);
+                }
+
+                if failed {
+                    activity.recent_failures.push_front(FailedExecution {
+                        id: event.id.clone(),
+                        tenant: event.tenant.clone(),
+                        language: event.language.clone(),
+                        finished_at: event.timestamp,
+                        exit_code: event.result.as_ref().map(|r| r.exit_code),
+                        error: event.error.clone(),
+                    });
+                    activity.recent_failures.truncate(RECENT_FAILURES);
+                }
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::executor::{ExecuteResponse, ExecutionError};
+
+    #[test]
+    fn test_tracks_running_and_finished_executions() {
+        let tracker = ActivityTracker::new();
+        tracker.publish(&ExecutionEvent::started("a", "cs101", "python"));
+        tracker.publish(&ExecutionEvent::started("b", "cs101", "python"));
+        tracker.publish(&ExecutionEvent::started("c", "cs102", "rust"));
+        assert_eq!(tracker.snapshot().running.len(), 3);
+
+        let ok = |exit_code, time_taken| {
+            Ok(ExecuteResponse {
+                exit_code,
+                time_taken: Some(time_taken),
+                ..Default::default()
+            })
+        };
+        tracker.publish(&ExecutionEvent::finished(
+            "a",
+            "cs101",
+            "python",
+            &ok(0, 1.0),
+        ));
+        tracker.publish(&ExecutionEvent::finished(
+            "b",
+            "cs101",
+            "python",
+            &ok(1, 3.0),
+        ));
+        tracker.publish(&ExecutionEvent::finished(
+            "c",
+            "cs102",
+            "rust",
+            &Err(ExecutionError::Timeout(5.0)),
+        ));
+
+        let snapshot = tracker.snapshot();
+        assert!(snapshot.running.is_empty());
+        let python = &snapshot.languages["python"];
+        assert_eq!(python.executions, 2);
+        assert_eq!(python.failures, 1);
+        assert_eq!(python.average_seconds, Some(2.0));
+        assert_eq!(snapshot.languages["rust"].average_seconds, None);
+
+        let failures: Vec<&str> = snapshot
+            .recent_failures
+            .iter()
+            .map(|f| f.id.as_str())
+            .collect();
+        assert_eq!(failures, ["c", "b"]);
+        assert!(snapshot.recent_failures[0].error.is_some());
+    }
+}
@@ -0,0 +1,213 @@
+// Remote worker agent: connects out to a coordinator over mutual TLS, advertises
+// what this machine can run, and executes the jobs it is sent.
+
+use isobox::config::IsoboxConfig;
+use isobox::proto::worker_service_client::WorkerServiceClient;
+use isobox::proto::{
+    agent_message, coordinator_message, AgentMessage, Job, JobResult, RegisterAgent,
+};
+use isobox::{CodeExecutor, ExecuteRequest};
+use std::collections::HashMap;
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, SystemTime};
+use tokio::sync::mpsc;
+use tokio::task::AbortHandle;
+use tokio_stream::wrappers::ReceiverStream;
+use tonic::transport::{Certificate, Channel, ClientTlsConfig, Identity};
+
+struct AgentSettings {
+    coordinator_url: String,
+    tls: ClientTlsConfig,
+    name: String,
+    capacity: u32,
+}
+
+impl AgentSettings {
+    fn from_env() -> Result<Self, String> {
+        let coordinator_url =
+            std::env::var("COORDINATOR_URL").map_err(|_| "COORDINATOR_URL is not set")?;
+        let read = |var: &str| {
+            let path = std::env::var(var).map_err(|_| format!("{var} is not set"))?;
+            std::fs::read_to_string(&path).map_err(|e| format!("Failed to read {path}: {e}"))
+        };
+
+        let mut tls = ClientTlsConfig::new()
+            .ca_certificate(Certificate::from_pem(read("AGENT_CA_CERT")?))
+            .identity(Identity::from_pem(
+                read("AGENT_TLS_CERT")?,
+                read("AGENT_TLS_KEY")?,
+            ));
+        if let Ok(domain) = std::env::var("COORDINATOR_DOMAIN") {
+            tls = tls.domain_name(domain);
+        }
+
+        let name = std::env::var("AGENT_NAME")
+            .or_else(|_| std::env::var("HOSTNAME"))
+            .unwrap_or_else(|_| "isobox-agent".to_string());
+        let capacity = std::env::var("AGENT_CAPACITY")
+            .ok()
+            .and_then(|s| s.parse::<u32>().ok())
+            .unwrap_or(4);
+
+        Ok(Self {
+            coordinator_url,
+            tls,
+            name,
+            capacity,
+        })
+    }
+}
+
+#[tokio::main]
+async fn main() {
+    env_logger::init_from_env(env_logger::Env::new().default_filter_or("info"));
+
+    let settings = match AgentSettings::from_env() {
+        Ok(settings) => settings,
+        Err(e) => {
+            log::error!("Invalid agent configuration: {e}");
+            std::process::exit(1);
+        }
+    };
+    let config = match IsoboxConfig::load() {
+        Ok(config) => config,
+        Err(e) => {
+            log::error!("Invalid configuration: {e}");
+            std::process::exit(1);
+        }
+    };
+    let executor = Arc::new(CodeExecutor::with_config(&config));
+    if let Err(e) = executor
+        .verify_embedded_runtimes()
+        .and_then(|_| executor.verify_user_mapping())
+        .and_then(|_| executor.verify_cgroups())
+        .and_then(|_| executor.verify_cpu_pinning())
+        .and_then(|_| executor.verify_air_gapped())
+        .and_then(|_| executor.verify_pinned_images())
+        .and_then(|_| executor.prepare_datasets())
+    {
+        log::error!("{e}");
+        std::process::exit(1);
+    }
+    tokio::spawn(executor.clone().scan_images_periodically());
+
+    // Reconnect with capped exponential backoff whenever the stream drops
+    let mut backoff = Duration::from_secs(1);
+    loop {
+        match run(&settings, executor.clone()).await {
+            Ok(()) => {
+                log::warn!("Coordinator closed the connection");
+                backoff = Duration::from_secs(1);
+            }
+            Err(e) => log::error!("Connection to coordinator failed: {e}"),
+        }
+        tokio::time::sleep(backoff).await;
+        backoff = (backoff * 2).min(Duration::from_secs(60));
+    }
+}
+
+async fn run(
+    settings: &AgentSettings,
+    executor: Arc<CodeExecutor>,
+) -> Result<(), Box<dyn std::error::Error>> {
+    let channel = Channel::from_shared(settings.coordinator_url.clone())?
+        .tls_config(settings.tls.clone())?
+        .connect()
+        .await?;
+    let mut client = WorkerServiceClient::new(channel);
+
+    let (outbound, outbound_rx) = mpsc::channel(64);
+    outbound
+        .send(AgentMessage {
+            message: Some(agent_message::Message::Register(RegisterAgent {
+                name: settings.name.clone(),
+                languages: executor.languages(),
+                capacity: settings.capacity,
+                arch: executor.host_arch().to_string(),
+                gpu: executor.gpu_available(),
+                language_limits: executor
+                    .language_slots()
+                    .limits()
+                    .into_iter()
+                    .map(|(language, limit)| (language, limit as u32))
+                    .collect(),
+            })),
+        })
+        .await?;
+
+    let mut inbound = client
+        .connect(ReceiverStream::new(outbound_rx))
+        .await?
+        .into_inner();
+    log::info!("Connected to coordinator at {}", settings.coordinator_url);
+
+    // Jobs still running, so a preempted one can be stopped
+    let running: Arc<Mutex<HashMap<String, AbortHandle>>> = Arc::default();
+    while let Some(message) = inbound.message().await? {
+        match message.message {
+            Some(coordinator_message::Message::Job(job)) => {
+                let executor = executor.clone();
+                let outbound = outbound.clone();
+                let job_id = job.job_id.clone();
+                // Held until the job is registered, so it can't finish first
+                let mut jobs = running.lock().unwrap();
+                let task = tokio::spawn({
+                    let running = running.clone();
+                    async move {
+                        let result = run_job(&executor, job).await;
+                        running.lock().unwrap().remove(&result.job_id);
+                        if outbound
+                            .send(AgentMessage {
+                                message: Some(agent_message::Message::Result(result)),
+                            })
+                            .await
+                            .is_err()
+                        {
+                            log::warn!("Connection closed before a job result could be sent");
+                        }
+                    }
+                });
+                jobs.insert(job_id, task.abort_handle());
+            }
+            Some(coordinator_message::Message::Stop(stop)) => {
+                // Dropping the execution kills its sandbox
+                if let Some(task) = running.lock().unwrap().remove(&stop.job_id) {
+                    log::info!("Stopping job {}", stop.job_id);
+                    task.abort();
+                }
+            }
+            None => {}
+        }
+    }
+    Ok(())
+}
+
+async fn run_job(executor: &CodeExecutor, job: Job) -> JobResult {
+    let mut result = JobResult {
+        job_id: job.job_id,
+        ..Default::default()
+    };
+
+    let mut request: ExecuteRequest = match serde_json::from_str(&job.request_json) {
+        Ok(request) => request,
+        Err(e) => {
+            result.error = format!("Invalid job request: {e}");
+            return result;
+        }
+    };
+    request.tenant = Some(job.tenant);
+    // Labels the job's containers with the coordinator's ID
+    request.execution_id = Some(result.job_id.clone());
+    if job.timeout_ms > 0 {
+        request.deadline = Some(SystemTime::now() + Duration::from_millis(job.timeout_ms));
+    }
+
+    match executor.execute(request).await {
+        Ok(response) => match serde_json::to_string(&response) {
+            Ok(json) => result.response_json = json,
+            Err(e) => result.error = e.to_string(),
+        },
+        Err(e) => result.error = e.to_string(),
+    }
+    result
+}
@@ -0,0 +1,92 @@
+use crate::executor::ExecuteResponse;
+use regex::Regex;
+use serde::{Deserialize, Serialize};
+use std::borrow::Cow;
+use std::sync::OnceLock;
+
+// CSI sequences such as colors and cursor movement, OSC sequences such as window
+// titles and hyperlinks, character set selection, and the other two-byte escapes
+const ESCAPE_PATTERN: &str =
+    r"\x1b(?:\[[0-?]*[ -/]*[@-~]|\][^\x07\x1b]*(?:\x07|\x1b\\)|[()][0-9A-Za-z]|[@-_])";
+
+/// What happens to ANSI escape sequences in a program's output
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Deserialize, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum AnsiMode {
+    /// Removed, so colored compiler output reads as plain text
+    Strip,
+    /// Passed through for a terminal to render
+    Keep,
+}
+
+impl AnsiMode {
+    /// Terminals render escape sequences, so requests that describe one keep them
+    pub fn for_request(mode: Option<AnsiMode>, terminal: bool) -> Self {
+        mode.unwrap_or(if terminal {
+            AnsiMode::Keep
+        } else {
+            AnsiMode::Strip
+        })
+    }
+
+    /// Applies the mode to the output of the response and its test results
+    pub fn apply(self, response: &mut ExecuteResponse) {
+        if self == AnsiMode::Keep {
+            return;
+        }
+        strip_in_place(&mut response.stdout);
+        strip_in_place(&mut response.stderr);
+        for result in response.test_results.iter_mut().flatten() {
+            strip_in_place(&mut result.stdout);
+            strip_in_place(&mut result.stderr);
+            strip_in_place(&mut result.actual_output);
+        }
+    }
+}
+
+pub fn strip(text: &str) -> Cow<'_, str> {
+    static ESCAPES: OnceLock<Regex> = OnceLock::new();
+    ESCAPES
+        .get_or_init(|| Regex::new(ESCAPE_PATTERN).unwrap())
+        .replace_all(text, "")
+}
+
+fn strip_in_place(text: &mut String) {
+    if let Cow::Owned(stripped) = strip(text) {
+        *text = stripped;
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_strip_removes_escape_sequences() {
+        assert_eq!(
+            strip("\x1b[1m\x1b[31merror\x1b[0m: expected `;`"),
+            "error: expected `;`"
+        );
+        assert_eq!(strip("\x1b]0;title\x07done\x1b[2K\x1b(B"), "done");
+        assert!(matches!(strip("plain text"), Cow::Borrowed(_)));
+    }
+
+    #[test]
+    fn test_mode_defaults_to_keep_for_terminals() {
+        assert_eq!(AnsiMode::for_request(None, false), AnsiMode::Strip);
+        assert_eq!(AnsiMode::for_request(None, true), AnsiMode::Keep);
+        assert_eq!(
+            AnsiMode::for_request(Some(AnsiMode::Strip), true),
+            AnsiMode::Strip
+        );
+
+        let mut response = ExecuteResponse {
+            stdout: "\x1b[32mok\x1b[0m\n".to_string(),
+            ..Default::default()
+        };
+        AnsiMode::Keep.apply(&mut response);
+        assert_eq!(response.stdout, "\x1b[32mok\x1b[0m\n");
+        AnsiMode::Strip.apply(&mut response);
+        assert_eq!(response.stdout, "ok\n");
+    }
+}
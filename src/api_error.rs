@@ -0,0 +1,256 @@
+use crate::executor::ExecutionError;
+use actix_web::http::{header, StatusCode};
+use actix_web::HttpResponse;
+use serde::Serialize;
+use std::future::Future;
+use std::time::Duration;
+
+tokio::task_local! {
+    // Id of the HTTP request being handled, set by the request id middleware
+    static REQUEST_ID: String;
+}
+
+/// Runs a request's handler with its id available to `ApiError::new`
+pub async fn with_request_id<F: Future>(request_id: String, handler: F) -> F::Output {
+    REQUEST_ID.scope(request_id, handler).await
+}
+
+fn current_request_id() -> Option<String> {
+    REQUEST_ID.try_with(|id| id.clone()).ok()
+}
+
+/// Stable, machine-readable error codes. Messages may change between releases;
+/// codes don't.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "SCREAMING_SNAKE_CASE")]
+pub enum ErrorCode {
+    /// Missing or invalid credentials
+    Unauthenticated,
+    /// The caller may not access the resource, e.g. another tenant's data
+    Forbidden,
+    /// The request breaks a tenant policy, e.g. a command outside the allow-list
+    PolicyViolation,
+    InvalidRequest,
+    UnsupportedLanguage,
+    UnsupportedVersion,
+    /// The path names an API version this server doesn't serve
+    UnsupportedApiVersion,
+    NotFound,
+    /// The body or one of its fields is over its size limit
+    PayloadTooLarge,
+    /// The source code or a workspace file is over its size limit;
+    /// `details.limit` says what the limit is
+    CodeTooLarge,
+    /// The request headers are over their size limit
+    HeadersTooLarge,
+    /// Too many requests; `details.retry_after` says when to try again
+    RateLimited,
+    /// A quota other than the request rate is used up, e.g. a session's disk quota
+    LimitExceeded,
+    /// No sandbox could run the code right now, e.g. no worker has capacity
+    SandboxUnavailable,
+    /// A backing service such as the job queue can't be reached
+    BackendUnavailable,
+    /// Downloading a resource named in the request failed
+    UpstreamFailed,
+    Timeout,
+    Internal,
+}
+
+impl ErrorCode {
+    pub fn status(self) -> StatusCode {
+        match self {
+            ErrorCode::Unauthenticated => StatusCode::UNAUTHORIZED,
+            ErrorCode::Forbidden | ErrorCode::PolicyViolation => StatusCode::FORBIDDEN,
+            ErrorCode::InvalidRequest
+            | ErrorCode::UnsupportedLanguage
+            | ErrorCode::UnsupportedVersion => StatusCode::BAD_REQUEST,
+            ErrorCode::NotFound | ErrorCode::UnsupportedApiVersion => StatusCode::NOT_FOUND,
+            ErrorCode::PayloadTooLarge | ErrorCode::CodeTooLarge => StatusCode::PAYLOAD_TOO_LARGE,
+            ErrorCode::HeadersTooLarge => StatusCode::REQUEST_HEADER_FIELDS_TOO_LARGE,
+            ErrorCode::RateLimited | ErrorCode::LimitExceeded => StatusCode::TOO_MANY_REQUESTS,
+            ErrorCode::SandboxUnavailable | ErrorCode::BackendUnavailable => {
+                StatusCode::SERVICE_UNAVAILABLE
+            }
+            ErrorCode::UpstreamFailed => StatusCode::BAD_GATEWAY,
+            ErrorCode::Timeout => StatusCode::GATEWAY_TIMEOUT,
+            ErrorCode::Internal => StatusCode::INTERNAL_SERVER_ERROR,
+        }
+    }
+}
+
+/// The body of every error response
+#[derive(Debug, Serialize)]
+pub struct ApiError {
+    pub code: ErrorCode,
+    pub message: String,
+    /// Code-specific data, e.g. the field that was too large; null when there is none
+    pub details: Option<serde_json::Value>,
+    pub request_id: Option<String>,
+    // Sent as the Retry-After header rather than in the body
+    #[serde(skip)]
+    pub retry_after: Option<Duration>,
+}
+
+impl ApiError {
+    pub fn new(code: ErrorCode, message: impl Into<String>) -> Self {
+        Self {
+            code,
+            message: message.into(),
+            details: None,
+            request_id: current_request_id(),
+            retry_after: None,
+        }
+    }
+
+    pub fn with_details(mut self, details: serde_json::Value) -> Self {
+        self.details = Some(details);
+        self
+    }
+
+    /// Tells the caller when to try again, in a Retry-After header and
+    /// `details.retry_after`
+    pub fn with_retry_after(mut self, retry_after: Duration) -> Self {
+        let seconds = serde_json::json!(retry_after.as_secs_f64());
+        match &mut self.details {
+            Some(serde_json::Value::Object(details)) => {
+                details.insert("retry_after".to_string(), seconds);
+            }
+            _ => self.details = Some(serde_json::json!({ "retry_after": seconds })),
+        }
+        self.retry_after = Some(retry_after);
+        self
+    }
+
+    pub fn response(&self) -> HttpResponse {
+        let mut response = HttpResponse::build(self.code.status());
+        if let Some(retry_after) = self.retry_after {
+            // Whole seconds, rounded up so a retry is never early
+            response.insert_header((
+                header::RETRY_AFTER,
+                retry_after.as_secs_f64().ceil().to_string(),
+            ));
+        }
+        response.json(self)
+    }
+}
+
+impl From<ApiError> for HttpResponse {
+    fn from(error: ApiError) -> Self {
+        error.response()
+    }
+}
+
+impl From<&ExecutionError> for ApiError {
+    fn from(error: &ExecutionError) -> Self {
+        let code = match error {
+            ExecutionError::UnsupportedLanguage(_) => ErrorCode::UnsupportedLanguage,
+            ExecutionError::UnsupportedVersion(..) => ErrorCode::UnsupportedVersion,
+            ExecutionError::PolicyViolation(_) => ErrorCode::PolicyViolation,
+            ExecutionError::InvalidRequest(_) | ExecutionError::DependencyInstall(_) => {
+                ErrorCode::InvalidRequest
+            }
+            ExecutionError::PayloadTooLarge(field, message) => {
+                return ApiError::new(ErrorCode::PayloadTooLarge, message.clone())
+                    .with_details(serde_json::json!({ "field": field }));
+            }
+            ExecutionError::CodeTooLarge(field, size, limit) => {
+                return ApiError::new(ErrorCode::CodeTooLarge, error.to_string()).with_details(
+                    serde_json::json!({ "field": field, "size": size, "limit": limit }),
+                );
+            }
+            ExecutionError::Busy(_, retry_after) | ExecutionError::Preempted(retry_after) => {
+                return ApiError::new(ErrorCode::SandboxUnavailable, error.to_string())
+                    .with_retry_after(*retry_after);
+            }
+            ExecutionError::Unavailable(_)
+            | ExecutionError::ImageBlocked(..)
+            | ExecutionError::ImageResolution(..)
+            | ExecutionError::MissingImages(_)
+            | ExecutionError::MissingInterpreters(_)
+            | ExecutionError::UserMapping(_)
+            | ExecutionError::Cgroup(_)
+            | ExecutionError::CpuPinning(_)
+            | ExecutionError::Execution(_) => ErrorCode::SandboxUnavailable,
+            ExecutionError::Timeout(_) | ExecutionError::DeadlineExceeded => ErrorCode::Timeout,
+            ExecutionError::Hook(_) => ErrorCode::UpstreamFailed,
+            ExecutionError::TempDirectoryCreation(_)
+            | ExecutionError::CacheMount(..)
+            | ExecutionError::DatasetSync(..)
+            | ExecutionError::FileWrite(_)
+            | ExecutionError::TaskJoin(_)
+            // Never sent, since nobody is left to receive it
+            | ExecutionError::Cancelled => ErrorCode::Internal,
+        };
+        ApiError::new(code, error.to_string())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[tokio::test]
+    async fn test_error_shape() {
+        let error = with_request_id("req-1".to_string(), async {
+            ApiError::from(&ExecutionError::PayloadTooLarge(
+                "files".to_string(),
+                "files is 20 bytes, the limit is 10 bytes".to_string(),
+            ))
+        })
+        .await;
+        assert_eq!(error.code.status(), StatusCode::PAYLOAD_TOO_LARGE);
+        assert_eq!(
+            serde_json::to_value(&error).unwrap(),
+            serde_json::json!({
+                "code": "PAYLOAD_TOO_LARGE",
+                "message": "files is 20 bytes, the limit is 10 bytes",
+                "details": { "field": "files" },
+                "request_id": "req-1"
+            })
+        );
+
+        let code = ApiError::from(&ExecutionError::CodeTooLarge("code".to_string(), 20, 10));
+        assert_eq!(code.code.status(), StatusCode::PAYLOAD_TOO_LARGE);
+        assert_eq!(
+            serde_json::to_value(&code).unwrap()["details"],
+            serde_json::json!({ "field": "code", "size": 20, "limit": 10 })
+        );
+
+        let outside = ApiError::new(
+            ErrorCode::UnsupportedLanguage,
+            "Unsupported language: cobol",
+        );
+        assert!(outside.request_id.is_none());
+        assert_eq!(
+            serde_json::to_value(&outside).unwrap()["code"],
+            "UNSUPPORTED_LANGUAGE"
+        );
+    }
+
+    #[test]
+    fn test_busy_sets_retry_after() {
+        let error = ApiError::from(&ExecutionError::Busy(
+            "no worker for python has free capacity".to_string(),
+            Duration::from_millis(2500),
+        ));
+        assert_eq!(error.code, ErrorCode::SandboxUnavailable);
+        assert_eq!(
+            error.details,
+            Some(serde_json::json!({ "retry_after": 2.5 }))
+        );
+
+        let response = error.response();
+        assert_eq!(response.status(), StatusCode::SERVICE_UNAVAILABLE);
+        assert_eq!(response.headers().get(header::RETRY_AFTER).unwrap(), "3");
+
+        // Keeps details that were already set
+        let error = ApiError::new(ErrorCode::LimitExceeded, "busy")
+            .with_details(serde_json::json!({ "max_concurrent": 2 }))
+            .with_retry_after(Duration::from_secs(4));
+        assert_eq!(
+            error.details,
+            Some(serde_json::json!({ "max_concurrent": 2, "retry_after": 4.0 }))
+        );
+    }
+}
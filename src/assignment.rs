@@ -0,0 +1,629 @@
+use crate::config::data_dir;
+use crate::executor::{ExecuteRequest, ExecuteResponse, TestCase};
+use crate::labels;
+use crate::store::unix_timestamp;
+use serde::{Deserialize, Serialize};
+use std::collections::{HashMap, HashSet};
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::RwLock;
+use thiserror::Error;
+
+#[derive(Debug, Error)]
+pub enum AssignmentError {
+    #[error("{0}")]
+    Invalid(String),
+    #[error("No assignment named {0}")]
+    NotFound(String),
+}
+
+/// Limits of test cases that don't set their own
+#[derive(Debug, Clone, Copy, Default, Serialize, Deserialize)]
+pub struct AssignmentLimits {
+    pub timeout_seconds: Option<u32>,
+    pub memory_limit_mb: Option<u64>,
+}
+
+/// An assignment as created through the API
+#[derive(Debug, Clone, Deserialize)]
+pub struct AssignmentSpec {
+    #[serde(default)]
+    pub title: String,
+    /// Problem statement shown to students, in whatever markup the LMS renders
+    #[serde(default)]
+    pub statement: String,
+    pub language: String,
+    pub version: Option<String>,
+    pub preset: Option<String>,
+    pub harness: Option<String>,
+    pub harness_params: Option<HashMap<String, String>>,
+    pub test_cases: Vec<TestCase>,
+    #[serde(default)]
+    pub limits: AssignmentLimits,
+}
+
+/// A problem submissions are run against: its test cases, and how the code runs
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct Assignment {
+    pub name: String,
+    pub tenant: String,
+    pub title: String,
+    pub statement: String,
+    pub language: String,
+    pub version: Option<String>,
+    pub preset: Option<String>,
+    pub harness: Option<String>,
+    pub harness_params: Option<HashMap<String, String>>,
+    pub test_cases: Vec<TestCase>,
+    pub limits: AssignmentLimits,
+    pub created_at: u64,
+    pub updated_at: u64,
+}
+
+impl Assignment {
+    pub fn new(tenant: &str, name: &str, spec: AssignmentSpec) -> Result<Self, AssignmentError> {
+        validate(name, &spec)?;
+        let now = unix_timestamp();
+        Ok(Self {
+            name: name.to_string(),
+            tenant: tenant.to_string(),
+            title: spec.title,
+            statement: spec.statement,
+            language: spec.language,
+            version: spec.version,
+            preset: spec.preset,
+            harness: spec.harness,
+            harness_params: spec.harness_params,
+            test_cases: spec.test_cases,
+            limits: spec.limits,
+            created_at: now,
+            updated_at: now,
+        })
+    }
+
+    /// The request running submitted code against the assignment's test cases
+    pub fn request(&self, code: String) -> ExecuteRequest {
+        let test_cases = self
+            .test_cases
+            .iter()
+            .cloned()
+            .map(|mut case| {
+                case.timeout_seconds = case.timeout_seconds.or(self.limits.timeout_seconds);
+                case.memory_limit_mb = case.memory_limit_mb.or(self.limits.memory_limit_mb);
+                case
+            })
+            .collect();
+        ExecuteRequest {
+            language: self.language.clone(),
+            code,
+            test_cases: Some(test_cases),
+            version: self.version.clone(),
+            preset: self.preset.clone(),
+            harness: self.harness.clone(),
+            harness_params: self.harness_params.clone(),
+            tenant: Some(self.tenant.clone()),
+            ..Default::default()
+        }
+    }
+
+    /// Scores a submission's result by the share of test cases it passed. Code that
+    /// doesn't compile has no test results and fails them all.
+    pub fn grade(
+        &self,
+        student: Option<String>,
+        labels: Vec<String>,
+        response: &ExecuteResponse,
+    ) -> Submission {
+        let passed: HashSet<&str> = response
+            .test_results
+            .iter()
+            .flatten()
+            .filter(|result| result.passed)
+            .map(|result| result.name.as_str())
+            .collect();
+        let failed: Vec<String> = self
+            .test_cases
+            .iter()
+            .filter(|case| !passed.contains(case.name.as_str()))
+            .map(|case| case.name.clone())
+            .collect();
+        let total = self.test_cases.len();
+        Submission {
+            execution_id: response.execution_id.clone(),
+            student,
+            labels,
+            passed: total - failed.len(),
+            total,
+            score: (total - failed.len()) as f64 / total.max(1) as f64,
+            failed,
+            submitted_at: unix_timestamp(),
+        }
+    }
+}
+
+/// Code a student submits for an assignment
+#[derive(Debug, Clone, Deserialize)]
+pub struct SubmissionRequest {
+    pub code: String,
+    /// Identifies the student in the LMS; submissions without one are anonymous
+    pub student: Option<String>,
+    /// Added to the execution's labels, after `assignment:<name>` and
+    /// `student:<student>`
+    #[serde(default, deserialize_with = "labels::deserialize")]
+    pub labels: Option<Vec<String>>,
+}
+
+/// A graded submission
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct Submission {
+    /// The stored execution, unless the execution history is disabled
+    pub execution_id: Option<String>,
+    pub student: Option<String>,
+    pub labels: Vec<String>,
+    /// Test cases passed, out of `total`
+    pub passed: usize,
+    pub total: usize,
+    pub score: f64,
+    /// Names of the test cases that didn't pass
+    pub failed: Vec<String>,
+    pub submitted_at: u64,
+}
+
+/// How often a test case passed across an assignment's submissions
+#[derive(Debug, Clone, Serialize)]
+pub struct TestCaseStats {
+    pub name: String,
+    pub passed: usize,
+    pub submissions: usize,
+}
+
+/// Aggregate results of an assignment's submissions
+#[derive(Debug, Clone, Serialize)]
+pub struct AssignmentResults {
+    pub assignment: String,
+    pub submissions: usize,
+    /// Distinct students; each anonymous submission counts as a student of its own
+    pub students: usize,
+    /// Students with a submission passing every test case
+    pub solved: usize,
+    /// Mean of each student's best score
+    pub average_score: f64,
+    pub test_cases: Vec<TestCaseStats>,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+struct StoredAssignment {
+    assignment: Assignment,
+    submissions: Vec<Submission>,
+}
+
+impl StoredAssignment {
+    fn results(&self) -> AssignmentResults {
+        // Best score per student, keyed by position for anonymous submissions
+        let mut best: HashMap<String, f64> = HashMap::new();
+        for (i, submission) in self.submissions.iter().enumerate() {
+            let student = match &submission.student {
+                Some(student) => format!("student:{student}"),
+                None => format!("anonymous:{i}"),
+            };
+            let score = best.entry(student).or_default();
+            *score = score.max(submission.score);
+        }
+        // Submissions made before the assignment last changed may have run against
+        // other test cases, so only later ones count per test case
+        let current: Vec<&Submission> = self
+            .submissions
+            .iter()
+            .filter(|s| s.submitted_at >= self.assignment.updated_at)
+            .collect();
+        let test_cases = self
+            .assignment
+            .test_cases
+            .iter()
+            .map(|case| {
+                let passed = current
+                    .iter()
+                    .filter(|s| !s.failed.contains(&case.name))
+                    .count();
+                TestCaseStats {
+                    name: case.name.clone(),
+                    passed,
+                    submissions: current.len(),
+                }
+            })
+            .collect();
+        AssignmentResults {
+            assignment: self.assignment.name.clone(),
+            submissions: self.submissions.len(),
+            students: best.len(),
+            solved: best.values().filter(|score| **score >= 1.0).count(),
+            average_score: best.values().sum::<f64>() / best.len().max(1) as f64,
+            test_cases,
+        }
+    }
+}
+
+/// Assignments and their submissions, per tenant. They're kept under
+/// `ASSIGNMENTS_DIR/<tenant>/<name>.json` across restarts.
+pub struct AssignmentRegistry {
+    root: PathBuf,
+    assignments: RwLock<HashMap<(String, String), StoredAssignment>>,
+}
+
+impl AssignmentRegistry {
+    pub fn new(root: PathBuf) -> Self {
+        let assignments = load_assignments(&root);
+        Self {
+            root,
+            assignments: RwLock::new(assignments),
+        }
+    }
+
+    pub fn from_env() -> Self {
+        let root = std::env::var("ASSIGNMENTS_DIR")
+            .map(PathBuf::from)
+            .unwrap_or_else(|_| data_dir().join("assignments"));
+        Self::new(root)
+    }
+
+    /// Creates an assignment or replaces its definition. Submissions made so far are
+    /// kept.
+    pub fn put(&self, mut assignment: Assignment) -> Assignment {
+        let mut assignments = self.assignments.write().unwrap();
+        let key = key(&assignment.tenant, &assignment.name);
+        if let Some(previous) = assignments.get(&key) {
+            assignment.created_at = previous.assignment.created_at;
+        }
+        let stored = StoredAssignment {
+            assignment: assignment.clone(),
+            submissions: assignments
+                .remove(&key)
+                .map(|stored| stored.submissions)
+                .unwrap_or_default(),
+        };
+        self.save(&stored);
+        assignments.insert(key, stored);
+        assignment
+    }
+
+    pub fn get(&self, tenant: &str, name: &str) -> Option<Assignment> {
+        self.assignments
+            .read()
+            .unwrap()
+            .get(&key(tenant, name))
+            .map(|stored| stored.assignment.clone())
+    }
+
+    /// The tenant's assignments, sorted by name
+    pub fn list(&self, tenant: &str) -> Vec<Assignment> {
+        let mut assignments: Vec<Assignment> = self
+            .assignments
+            .read()
+            .unwrap()
+            .values()
+            .filter(|stored| stored.assignment.tenant == tenant)
+            .map(|stored| stored.assignment.clone())
+            .collect();
+        assignments.sort_by(|a, b| a.name.cmp(&b.name));
+        assignments
+    }
+
+    /// Deletes an assignment with its submissions. Their executions stay in the
+    /// history.
+    pub fn remove(&self, tenant: &str, name: &str) -> bool {
+        if self
+            .assignments
+            .write()
+            .unwrap()
+            .remove(&key(tenant, name))
+            .is_none()
+        {
+            return false;
+        }
+        if let Err(e) = fs::remove_file(self.path(tenant, name)) {
+            log::warn!("Failed to remove assignment {name} of tenant {tenant}: {e}");
+        }
+        true
+    }
+
+    pub fn record(
+        &self,
+        tenant: &str,
+        name: &str,
+        submission: Submission,
+    ) -> Result<(), AssignmentError> {
+        let mut assignments = self.assignments.write().unwrap();
+        let stored = assignments
+            .get_mut(&key(tenant, name))
+            .ok_or_else(|| AssignmentError::NotFound(name.to_string()))?;
+        stored.submissions.push(submission);
+        self.save(stored);
+        Ok(())
+    }
+
+    /// An assignment's submissions in the order they were made, optionally only
+    /// one student's
+    pub fn submissions(
+        &self,
+        tenant: &str,
+        name: &str,
+        student: Option<&str>,
+    ) -> Result<Vec<Submission>, AssignmentError> {
+        let assignments = self.assignments.read().unwrap();
+        let stored = assignments
+            .get(&key(tenant, name))
+            .ok_or_else(|| AssignmentError::NotFound(name.to_string()))?;
+        Ok(stored
+            .submissions
+            .iter()
+            .filter(|s| student.map_or(true, |student| s.student.as_deref() == Some(student)))
+            .cloned()
+            .collect())
+    }
+
+    pub fn results(&self, tenant: &str, name: &str) -> Result<AssignmentResults, AssignmentError> {
+        self.assignments
+            .read()
+            .unwrap()
+            .get(&key(tenant, name))
+            .map(StoredAssignment::results)
+            .ok_or_else(|| AssignmentError::NotFound(name.to_string()))
+    }
+
+    /// Removes every assignment of a tenant, returning how many there were
+    pub fn remove_tenant(&self, tenant: &str) -> usize {
+        let mut assignments = self.assignments.write().unwrap();
+        let before = assignments.len();
+        assignments.retain(|(owner, _), _| owner != tenant);
+        if let Err(e) = fs::remove_dir_all(self.root.join(tenant)) {
+            if e.kind() != std::io::ErrorKind::NotFound {
+                log::warn!("Failed to remove assignments of tenant {tenant}: {e}");
+            }
+        }
+        before - assignments.len()
+    }
+
+    /// Removes the tenant's submissions carrying a label, e.g. `student:1234`,
+    /// returning how many there were
+    pub fn remove_submissions(&self, tenant: &str, label: &str) -> usize {
+        let mut assignments = self.assignments.write().unwrap();
+        let mut removed = 0;
+        for ((owner, _), stored) in assignments.iter_mut() {
+            if owner != tenant {
+                continue;
+            }
+            let before = stored.submissions.len();
+            stored
+                .submissions
+                .retain(|submission| !submission.labels.iter().any(|l| l == label));
+            if stored.submissions.len() != before {
+                removed += before - stored.submissions.len();
+                self.save(stored);
+            }
+        }
+        removed
+    }
+
+    fn path(&self, tenant: &str, name: &str) -> PathBuf {
+        self.root.join(tenant).join(format!("{name}.json"))
+    }
+
+    fn save(&self, stored: &StoredAssignment) {
+        let assignment = &stored.assignment;
+        let path = self.path(&assignment.tenant, &assignment.name);
+        let result = fs::create_dir_all(self.root.join(&assignment.tenant)).and_then(|_| {
+            let data = serde_json::to_vec(stored).map_err(std::io::Error::other)?;
+            fs::write(&path, data)
+        });
+        if let Err(e) = result {
+            log::warn!("Failed to save assignment {}: {e}", assignment.name);
+        }
+    }
+}
+
+fn key(tenant: &str, name: &str) -> (String, String) {
+    (tenant.to_string(), name.to_string())
+}
+
+// Names appear in URLs, labels and file names
+fn validate(name: &str, spec: &AssignmentSpec) -> Result<(), AssignmentError> {
+    let valid_name = !name.is_empty()
+        && name.len() <= 64
+        && name
+            .chars()
+            .all(|c| c.is_ascii_alphanumeric() || c == '-' || c == '_');
+    if !valid_name {
+        return Err(AssignmentError::Invalid(format!(
+            "Invalid assignment name '{name}'"
+        )));
+    }
+    if spec.test_cases.is_empty() {
+        return Err(AssignmentError::Invalid(
+            "An assignment needs at least one test case".to_string(),
+        ));
+    }
+    let mut names = HashSet::new();
+    if let Some(case) = spec
+        .test_cases
+        .iter()
+        .find(|case| !names.insert(&case.name))
+    {
+        return Err(AssignmentError::Invalid(format!(
+            "Test case name '{}' is used more than once",
+            case.name
+        )));
+    }
+    Ok(())
+}
+
+fn load_assignments(root: &Path) -> HashMap<(String, String), StoredAssignment> {
+    let Ok(tenants) = fs::read_dir(root) else {
+        return HashMap::new();
+    };
+    let files = tenants
+        .flatten()
+        .filter_map(|tenant| fs::read_dir(tenant.path()).ok())
+        .flat_map(|entries| entries.flatten())
+        .filter(|entry| entry.path().extension().is_some_and(|ext| ext == "json"));
+    let mut assignments = HashMap::new();
+    for entry in files {
+        let Ok(data) = fs::read(entry.path()) else {
+            continue;
+        };
+        match serde_json::from_slice::<StoredAssignment>(&data) {
+            Ok(stored) => {
+                let key = key(&stored.assignment.tenant, &stored.assignment.name);
+                assignments.insert(key, stored);
+            }
+            Err(e) => log::warn!("Ignoring assignment {}: {e}", entry.path().display()),
+        }
+    }
+    assignments
+}
+
+/// Labels of a submission's execution
+pub fn submission_labels(name: &str, request: &SubmissionRequest) -> Vec<String> {
+    let mut labels = vec![format!("assignment{}{name}", labels::SEPARATOR)];
+    if let Some(student) = &request.student {
+        labels.push(format!("student{}{student}", labels::SEPARATOR));
+    }
+    labels.extend(request.labels.iter().flatten().cloned());
+    labels
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::executor::TestCaseResult;
+    use uuid::Uuid;
+
+    fn test_case(name: &str) -> TestCase {
+        TestCase {
+            name: name.to_string(),
+            input: "1 2".to_string(),
+            expected_output: Some("3".to_string()),
+            ..Default::default()
+        }
+    }
+
+    fn spec() -> AssignmentSpec {
+        AssignmentSpec {
+            title: "Sum".to_string(),
+            statement: "Print the sum of two numbers".to_string(),
+            language: "python".to_string(),
+            version: None,
+            preset: None,
+            harness: None,
+            harness_params: None,
+            test_cases: vec![test_case("small"), test_case("large")],
+            limits: AssignmentLimits {
+                timeout_seconds: Some(2),
+                memory_limit_mb: None,
+            },
+        }
+    }
+
+    fn response(passed: &[&str]) -> ExecuteResponse {
+        let results = ["small", "large"]
+            .into_iter()
+            .map(|name| TestCaseResult {
+                name: name.to_string(),
+                passed: passed.contains(&name),
+                stdout: String::new(),
+                stderr: String::new(),
+                exit_code: 0,
+                time_taken: None,
+                memory_used: None,
+                swap_used: None,
+                error_message: None,
+                input: String::new(),
+                expected_output: None,
+                actual_output: String::new(),
+                term_signal: None,
+                term_reason: None,
+                group: None,
+                hidden: None,
+                skipped: None,
+                judge_message: None,
+                verdict: None,
+                cpu_contention: None,
+            })
+            .collect();
+        ExecuteResponse {
+            test_results: Some(results),
+            ..Default::default()
+        }
+    }
+
+    fn registry(root: &Path) -> AssignmentRegistry {
+        AssignmentRegistry::new(root.to_path_buf())
+    }
+
+    #[test]
+    fn test_submissions_are_graded_and_aggregated() {
+        let root = std::env::temp_dir().join(format!("isobox-assignment-test-{}", Uuid::new_v4()));
+        let assignments = registry(&root);
+        let assignment = assignments.put(Assignment::new("cs101", "sum", spec()).unwrap());
+        let request = assignment.request("print(3)".to_string());
+        let cases = request.test_cases.unwrap();
+        assert_eq!(cases[0].timeout_seconds, Some(2));
+
+        let graded = [
+            (Some("ada"), vec!["small"]),
+            (Some("ada"), vec!["small", "large"]),
+            (Some("bob"), vec![]),
+            (None, vec!["large"]),
+        ];
+        for (student, passed) in graded {
+            let submission = assignment.grade(
+                student.map(str::to_string),
+                vec![format!("student:{}", student.unwrap_or("-"))],
+                &response(&passed),
+            );
+            assignments.record("cs101", "sum", submission).unwrap();
+        }
+        let failed = assignment.grade(None, Vec::new(), &ExecuteResponse::default());
+        assert_eq!((failed.passed, failed.score), (0, 0.0));
+
+        let results = assignments.results("cs101", "sum").unwrap();
+        assert_eq!(
+            (results.submissions, results.students, results.solved),
+            (4, 3, 1)
+        );
+        assert_eq!(results.average_score, 0.5);
+        assert_eq!(
+            (results.test_cases[0].passed, results.test_cases[1].passed),
+            (2, 2)
+        );
+        assert_eq!(
+            assignments
+                .submissions("cs101", "sum", Some("ada"))
+                .unwrap()
+                .len(),
+            2
+        );
+        assert!(assignments.results("cs102", "sum").is_err());
+
+        // Submissions survive a restart, and can be erased per student
+        let reloaded = registry(&root);
+        assert_eq!(reloaded.list("cs101").len(), 1);
+        assert_eq!(reloaded.remove_submissions("cs101", "student:ada"), 2);
+        assert_eq!(reloaded.submissions("cs101", "sum", None).unwrap().len(), 2);
+        assert_eq!(reloaded.remove_tenant("cs101"), 1);
+        assert!(registry(&root).list("cs101").is_empty());
+        fs::remove_dir_all(&root).ok();
+    }
+
+    #[test]
+    fn test_invalid_assignments() {
+        assert!(Assignment::new("cs101", "../sum", spec()).is_err());
+        let mut duplicate = spec();
+        duplicate.test_cases.push(test_case("small"));
+        assert!(Assignment::new("cs101", "sum", duplicate).is_err());
+        let empty = AssignmentSpec {
+            test_cases: Vec::new(),
+            ..spec()
+        };
+        assert!(Assignment::new("cs101", "sum", empty).is_err());
+    }
+}
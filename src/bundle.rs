@@ -0,0 +1,355 @@
+use crate::config::data_dir;
+use crate::store::unix_timestamp;
+use futures::{Stream, StreamExt};
+use serde::{Deserialize, Serialize};
+use std::fs;
+use std::io;
+use std::path::{Component, Path, PathBuf};
+use thiserror::Error;
+use tokio::io::AsyncWriteExt;
+use uuid::Uuid;
+
+// Where bundles of languages that don't keep them in the workspace are mounted
+pub const BUNDLE_MOUNT: &str = "/isobox-bundle";
+
+// Unpacked bundles may be this many times their upload, which is compressed
+const UNPACKED_RATIO: u64 = 10;
+
+const METADATA_FILE: &str = "bundle.json";
+
+#[derive(Debug, Error)]
+pub enum BundleError {
+    #[error("No bundle for preset {0}")]
+    NotFound(String),
+    #[error("Bundle exceeds the limit of {0} bytes")]
+    TooLarge(u64),
+    #[error("Invalid bundle: {0}")]
+    Invalid(String),
+    #[error("Failed to store the bundle: {0}")]
+    Io(String),
+}
+
+/// A tenant's bundle for a preset
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct BundleInfo {
+    pub preset: String,
+    /// Changes with every upload
+    pub id: String,
+    /// Size of the unpacked files
+    pub bytes: u64,
+    pub files: u64,
+    pub uploaded_at: u64,
+}
+
+/// Where a language's bundle is mounted in the sandbox and the environment that
+/// makes its package manager or runtime use it
+pub struct BundleLayout {
+    pub path: String,
+    pub env: Vec<(String, String)>,
+}
+
+impl BundleLayout {
+    /// None for languages bundles aren't supported for
+    pub fn for_language(language: &str, work_dir: &str) -> Option<Self> {
+        let env = |pairs: &[(&str, &str)]| {
+            pairs
+                .iter()
+                .map(|(key, value)| (key.to_string(), value.to_string()))
+                .collect()
+        };
+        match language {
+            // A wheelhouse pip installs from instead of an index; unpacked packages
+            // are importable as they are
+            "python" | "python2" => Some(Self {
+                path: BUNDLE_MOUNT.to_string(),
+                env: env(&[
+                    ("PIP_NO_INDEX", "1"),
+                    ("PIP_FIND_LINKS", BUNDLE_MOUNT),
+                    ("PYTHONPATH", BUNDLE_MOUNT),
+                ]),
+            }),
+            "node" | "typescript" => Some(Self {
+                path: BUNDLE_MOUNT.to_string(),
+                env: env(&[("NODE_PATH", &format!("{BUNDLE_MOUNT}/node_modules"))]),
+            }),
+            // The module's vendor directory, next to the go.mod sent with the code
+            "go" => Some(Self {
+                path: format!("{}/vendor", work_dir.trim_end_matches('/')),
+                env: env(&[("GOFLAGS", "-mod=vendor")]),
+            }),
+            _ => None,
+        }
+    }
+}
+
+/// Vendored dependencies tenants upload for presets, so sandboxes that can't reach a
+/// package index can still use third-party libraries. Each tenant has its own
+/// bundle per preset, unpacked under `BUNDLES_DIR/<tenant>/<preset>/<id>`.
+pub struct BundleStore {
+    root: PathBuf,
+    max_bytes: u64,
+}
+
+impl BundleStore {
+    pub fn new(root: PathBuf, max_bytes: u64) -> Self {
+        Self { root, max_bytes }
+    }
+
+    pub fn from_env() -> Self {
+        let root = std::env::var("BUNDLES_DIR")
+            .map(PathBuf::from)
+            .unwrap_or_else(|_| data_dir().join("bundles"));
+        let max_bytes = std::env::var("BUNDLE_MAX_BYTES")
+            .ok()
+            .and_then(|value| value.parse().ok())
+            .unwrap_or(1024 * 1024 * 1024);
+        Self::new(root, max_bytes)
+    }
+
+    fn preset_dir(&self, tenant: &str, preset: &str) -> PathBuf {
+        self.root.join(tenant).join(preset)
+    }
+
+    pub fn info(&self, tenant: &str, preset: &str) -> Option<BundleInfo> {
+        let metadata = fs::read(self.preset_dir(tenant, preset).join(METADATA_FILE)).ok()?;
+        serde_json::from_slice(&metadata).ok()
+    }
+
+    /// Host directory of a tenant's bundle for a preset
+    pub fn path(&self, tenant: &str, preset: &str) -> Option<PathBuf> {
+        let info = self.info(tenant, preset)?;
+        Some(self.preset_dir(tenant, preset).join(info.id))
+    }
+
+    /// Stores a gzipped tarball as the tenant's bundle for a preset, replacing the
+    /// previous one. The upload is streamed to disk and unpacked before it replaces
+    /// anything, so a failed upload leaves the previous bundle in place.
+    pub async fn store<S, B, E>(
+        &self,
+        tenant: &str,
+        preset: &str,
+        mut stream: S,
+    ) -> Result<BundleInfo, BundleError>
+    where
+        S: Stream<Item = Result<B, E>> + Unpin,
+        B: AsRef<[u8]>,
+        E: std::fmt::Display,
+    {
+        let dir = self.preset_dir(tenant, preset);
+        fs::create_dir_all(&dir).map_err(|e| BundleError::Io(e.to_string()))?;
+        let id = Uuid::new_v4().to_string();
+        let upload = dir.join(format!(".{id}.tar.gz"));
+        let result = async {
+            let mut file = tokio::fs::File::create(&upload)
+                .await
+                .map_err(|e| BundleError::Io(e.to_string()))?;
+            let mut received = 0u64;
+            while let Some(chunk) = stream.next().await {
+                let chunk = chunk.map_err(|e| BundleError::Io(e.to_string()))?;
+                received += chunk.as_ref().len() as u64;
+                if received > self.max_bytes {
+                    return Err(BundleError::TooLarge(self.max_bytes));
+                }
+                file.write_all(chunk.as_ref())
+                    .await
+                    .map_err(|e| BundleError::Io(e.to_string()))?;
+            }
+            file.flush()
+                .await
+                .map_err(|e| BundleError::Io(e.to_string()))?;
+
+            let (archive, target) = (upload.clone(), dir.join(&id));
+            let limit = self.max_bytes.saturating_mul(UNPACKED_RATIO);
+            tokio::task::spawn_blocking(move || unpack(&archive, &target, limit))
+                .await
+                .map_err(|e| BundleError::Io(e.to_string()))?
+        }
+        .await;
+        fs::remove_file(&upload).ok();
+        let (bytes, files) = match result {
+            Ok(unpacked) => unpacked,
+            Err(e) => {
+                fs::remove_dir_all(dir.join(&id)).ok();
+                return Err(e);
+            }
+        };
+
+        let previous = self.path(tenant, preset);
+        let info = BundleInfo {
+            preset: preset.to_string(),
+            id,
+            bytes,
+            files,
+            uploaded_at: unix_timestamp(),
+        };
+        let metadata = serde_json::to_vec(&info).map_err(|e| BundleError::Io(e.to_string()))?;
+        fs::write(dir.join(METADATA_FILE), metadata).map_err(|e| BundleError::Io(e.to_string()))?;
+        if let Some(previous) = previous {
+            fs::remove_dir_all(previous).ok();
+        }
+        Ok(info)
+    }
+
+    pub fn remove(&self, tenant: &str, preset: &str) -> Result<(), BundleError> {
+        if self.info(tenant, preset).is_none() {
+            return Err(BundleError::NotFound(preset.to_string()));
+        }
+        fs::remove_dir_all(self.preset_dir(tenant, preset))
+            .map_err(|e| BundleError::Io(e.to_string()))
+    }
+
+    /// Removes every bundle of a tenant, returning how many there were
+    pub fn remove_tenant(&self, tenant: &str) -> usize {
+        let dir = self.root.join(tenant);
+        let count = fs::read_dir(&dir).map(|dirs| dirs.count()).unwrap_or(0);
+        fs::remove_dir_all(&dir).ok();
+        count
+    }
+}
+
+// Unpacks a gzipped tarball into `target`, returning its size and file count.
+// Links are only allowed to point within the bundle, and anything but files,
+// directories and links is rejected.
+fn unpack(archive: &Path, target: &Path, limit: u64) -> Result<(u64, u64), BundleError> {
+    let invalid = |e: io::Error| BundleError::Invalid(e.to_string());
+    let file = fs::File::open(archive).map_err(|e| BundleError::Io(e.to_string()))?;
+    let mut tarball = tar::Archive::new(flate2::read::GzDecoder::new(file));
+    fs::create_dir_all(target).map_err(|e| BundleError::Io(e.to_string()))?;
+    let (mut bytes, mut files) = (0u64, 0u64);
+    for entry in tarball.entries().map_err(invalid)? {
+        let mut entry = entry.map_err(invalid)?;
+        let path = entry.path().map_err(invalid)?.into_owned();
+        match entry.header().entry_type() {
+            tar::EntryType::Regular | tar::EntryType::Directory => {}
+            tar::EntryType::Symlink => {
+                let link = entry.link_name().map_err(invalid)?.unwrap_or_default();
+                let escapes =
+                    link.is_absolute() || link.components().any(|c| c == Component::ParentDir);
+                if escapes {
+                    return Err(BundleError::Invalid(format!(
+                        "{} links outside the bundle",
+                        path.display()
+                    )));
+                }
+            }
+            other => {
+                return Err(BundleError::Invalid(format!(
+                "{} is a {other:?} entry; bundles may only hold files, directories and symlinks",
+                path.display()
+            )))
+            }
+        }
+        bytes += entry.header().size().map_err(invalid)?;
+        if bytes > limit {
+            return Err(BundleError::TooLarge(limit));
+        }
+        // Refuses paths that would end up outside `target`
+        if !entry.unpack_in(target).map_err(invalid)? {
+            return Err(BundleError::Invalid(format!(
+                "{} is outside the bundle",
+                path.display()
+            )));
+        }
+        if entry.header().entry_type() == tar::EntryType::Regular {
+            files += 1;
+        }
+    }
+    Ok((bytes, files))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use flate2::write::GzEncoder;
+
+    fn tarball(entries: &[(&str, &[u8])]) -> Vec<u8> {
+        let mut builder = tar::Builder::new(GzEncoder::new(Vec::new(), Default::default()));
+        for (path, content) in entries {
+            let mut header = tar::Header::new_gnu();
+            header.set_size(content.len() as u64);
+            header.set_mode(0o644);
+            header.set_cksum();
+            builder.append_data(&mut header, path, *content).unwrap();
+        }
+        builder.into_inner().unwrap().finish().unwrap()
+    }
+
+    fn chunks(data: Vec<u8>) -> impl Stream<Item = Result<Vec<u8>, String>> + Unpin {
+        futures::stream::iter(
+            data.chunks(7)
+                .map(|chunk| Ok(chunk.to_vec()))
+                .collect::<Vec<_>>(),
+        )
+    }
+
+    fn temp_root() -> PathBuf {
+        std::env::temp_dir().join(format!("isobox-bundle-test-{}", Uuid::new_v4()))
+    }
+
+    #[tokio::test]
+    async fn test_upload_replaces_previous_bundle() {
+        let store = BundleStore::new(temp_root(), 1024 * 1024);
+        let wheel = tarball(&[("requests-2.32.3-py3-none-any.whl", b"wheel")]);
+        let first = store
+            .store("cs101", "python-datasci", chunks(wheel))
+            .await
+            .unwrap();
+        assert_eq!((first.files, first.bytes), (1, 5));
+        let path = store.path("cs101", "python-datasci").unwrap();
+        assert!(path.join("requests-2.32.3-py3-none-any.whl").is_file());
+
+        let second = store
+            .store(
+                "cs101",
+                "python-datasci",
+                chunks(tarball(&[("numpy.whl", b"np")])),
+            )
+            .await
+            .unwrap();
+        assert_ne!(first.id, second.id);
+        assert!(!path.exists());
+        assert!(store.path("cs102", "python-datasci").is_none());
+
+        store.remove("cs101", "python-datasci").unwrap();
+        assert!(store.info("cs101", "python-datasci").is_none());
+        fs::remove_dir_all(&store.root).ok();
+    }
+
+    #[tokio::test]
+    async fn test_invalid_uploads_keep_previous_bundle() {
+        let store = BundleStore::new(temp_root(), 64);
+        store
+            .store(
+                "cs101",
+                "node-web",
+                chunks(tarball(&[("node_modules/a.js", b"1")])),
+            )
+            .await
+            .unwrap();
+
+        let too_large = store
+            .store("cs101", "node-web", chunks(vec![0u8; 100]))
+            .await;
+        assert!(matches!(too_large, Err(BundleError::TooLarge(64))));
+        let not_a_tarball = store
+            .store("cs101", "node-web", chunks(b"plain text".to_vec()))
+            .await;
+        assert!(matches!(not_a_tarball, Err(BundleError::Invalid(_))));
+
+        let path = store.path("cs101", "node-web").unwrap();
+        assert!(path.join("node_modules/a.js").is_file());
+        assert_eq!(fs::read_dir(path.parent().unwrap()).unwrap().count(), 2);
+        fs::remove_dir_all(&store.root).ok();
+    }
+
+    #[test]
+    fn test_layout_per_language() {
+        let go = BundleLayout::for_language("go", "/workspace").unwrap();
+        assert_eq!(go.path, "/workspace/vendor");
+        let python = BundleLayout::for_language("python", "/workspace").unwrap();
+        assert!(python
+            .env
+            .contains(&("PIP_FIND_LINKS".to_string(), BUNDLE_MOUNT.to_string())));
+        assert!(BundleLayout::for_language("cpp", "/workspace").is_none());
+    }
+}
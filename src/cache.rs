@@ -0,0 +1,80 @@
+use crate::config::data_dir;
+use std::collections::HashMap;
+use std::fs;
+use std::io;
+use std::path::PathBuf;
+use std::sync::{Arc, Mutex};
+use tokio::sync::{Mutex as AsyncMutex, OwnedMutexGuard};
+
+/// Host directories backing the shared caches, one per tenant and cache name,
+/// and the locks that serialize executions writing to the same cache
+pub struct CacheManager {
+    root: PathBuf,
+    locks: Mutex<HashMap<String, Arc<AsyncMutex<()>>>>,
+}
+
+impl CacheManager {
+    pub fn new(root: PathBuf) -> Self {
+        Self {
+            root,
+            locks: Mutex::new(HashMap::new()),
+        }
+    }
+
+    pub fn from_env() -> Self {
+        let root = std::env::var("CACHES_DIR")
+            .map(PathBuf::from)
+            .unwrap_or_else(|_| data_dir().join("caches"));
+        Self::new(root)
+    }
+
+    /// Returns the host directory of a tenant's cache, creating it on first use
+    pub fn host_path(&self, tenant: &str, name: &str) -> io::Result<PathBuf> {
+        let path = self.root.join(tenant).join(name);
+        fs::create_dir_all(&path)?;
+        Ok(path)
+    }
+
+    /// Locks the named caches of a tenant until the returned guards are dropped.
+    /// Names must be sorted so that concurrent executions acquire locks in the same order.
+    pub async fn lock(&self, tenant: &str, names: &[&str]) -> Vec<OwnedMutexGuard<()>> {
+        let mut guards = Vec::with_capacity(names.len());
+        for name in names {
+            let lock = self
+                .locks
+                .lock()
+                .unwrap()
+                .entry(format!("{tenant}/{name}"))
+                .or_default()
+                .clone();
+            guards.push(lock.lock_owned().await);
+        }
+        guards
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::time::Duration;
+
+    #[tokio::test]
+    async fn test_cache_lock_is_per_tenant() {
+        let root = std::env::temp_dir().join(format!("isobox-cache-test-{}", uuid::Uuid::new_v4()));
+        let manager = CacheManager::new(root.clone());
+        assert!(manager.host_path("cs101", "pip").unwrap().is_dir());
+
+        let guards = manager.lock("cs101", &["pip"]).await;
+        let other_tenant =
+            tokio::time::timeout(Duration::from_millis(50), manager.lock("cs102", &["pip"])).await;
+        assert!(other_tenant.is_ok());
+
+        let same_tenant =
+            tokio::time::timeout(Duration::from_millis(50), manager.lock("cs101", &["pip"])).await;
+        assert!(same_tenant.is_err());
+
+        drop(guards);
+        assert_eq!(manager.lock("cs101", &["pip"]).await.len(), 1);
+        fs::remove_dir_all(&root).ok();
+    }
+}
@@ -0,0 +1,437 @@
+use crate::executor::ResourceLimits;
+use crate::priority::Scheduling;
+use std::fs;
+use std::io::Write;
+use std::path::{Path, PathBuf};
+use std::process::Command;
+use uuid::Uuid;
+
+/// Where the cgroup v2 hierarchy is mounted
+pub const CGROUP_MOUNT: &str = "/sys/fs/cgroup";
+
+// Controllers the groups of executions are limited by
+const CONTROLLERS: [&str; 4] = ["cpu", "io", "memory", "pids"];
+
+// Period of `cpu.max`, in microseconds
+const CPU_PERIOD_US: u64 = 100_000;
+
+/// Creates a cgroup v2 group for every sandbox step under `CGROUP_PARENT`, with
+/// the step's limits written to its controller files, so they're enforced and
+/// measured by the kernel rather than left to the container runtime. Containers
+/// are started in the group with `--cgroup-parent`; embedded runtimes move into
+/// it before they exec.
+#[derive(Debug, Clone)]
+pub struct CgroupManager {
+    mount: PathBuf,
+    // Group, relative to the mount, that steps' groups are created in; None leaves
+    // limits to the container runtime
+    parent: Option<String>,
+    // CPUs a step may use at once, written to `cpu.max`
+    cpus: f64,
+    // `io.max` lines, e.g. "8:0 rbps=10485760 wbps=10485760"
+    io_max: Vec<String>,
+    // Executions are pinned to cores, which needs the cpuset controller too
+    cpuset: bool,
+}
+
+impl Default for CgroupManager {
+    fn default() -> Self {
+        Self::new(PathBuf::from(CGROUP_MOUNT), None, 1.0, Vec::new())
+    }
+}
+
+impl CgroupManager {
+    pub fn new(mount: PathBuf, parent: Option<String>, cpus: f64, io_max: Vec<String>) -> Self {
+        Self {
+            mount,
+            parent: parent.map(|parent| parent.trim_matches('/').to_string()),
+            cpus,
+            io_max,
+            cpuset: false,
+        }
+    }
+
+    /// Also limits groups to the core their execution is pinned to
+    pub fn with_cpuset(mut self, cpuset: bool) -> Self {
+        self.cpuset = cpuset;
+        self
+    }
+
+    fn controllers(&self) -> Vec<&'static str> {
+        let mut controllers = CONTROLLERS.to_vec();
+        if self.cpuset {
+            controllers.push("cpuset");
+        }
+        controllers
+    }
+
+    /// Reads `CGROUP_PARENT`, `CGROUP_CPUS` and `CGROUP_IO_MAX`; groups are only
+    /// managed with a parent
+    pub fn from_env() -> Self {
+        Self::new(
+            PathBuf::from(CGROUP_MOUNT),
+            std::env::var("CGROUP_PARENT")
+                .ok()
+                .filter(|parent| !parent.trim_matches('/').is_empty()),
+            std::env::var("CGROUP_CPUS")
+                .ok()
+                .and_then(|s| s.parse::<f64>().ok())
+                .filter(|cpus| *cpus > 0.0)
+                .unwrap_or(1.0),
+            std::env::var("CGROUP_IO_MAX")
+                .map(|lines| {
+                    lines
+                        .split(';')
+                        .map(str::trim)
+                        .filter(|line| !line.is_empty())
+                        .map(str::to_string)
+                        .collect()
+                })
+                .unwrap_or_default(),
+        )
+    }
+
+    pub fn enabled(&self) -> bool {
+        self.parent.is_some()
+    }
+
+    fn parent_dir(&self) -> Option<PathBuf> {
+        self.parent.as_ref().map(|parent| self.mount.join(parent))
+    }
+
+    /// Checks that the host uses cgroup v2 and that the parent group can hold
+    /// limited groups. Containers also need Docker's cgroupfs driver, since the
+    /// systemd driver only accepts slices as `--cgroup-parent`.
+    pub fn verify(&self, embedded: bool) -> Result<(), String> {
+        let (Some(parent), Some(dir)) = (&self.parent, self.parent_dir()) else {
+            return Ok(());
+        };
+        if !self.mount.join("cgroup.controllers").exists() {
+            return Err(format!(
+                "CGROUP_PARENT needs the cgroup v2 hierarchy mounted at {}",
+                self.mount.display()
+            ));
+        }
+        if let Some(line) = self.io_max.iter().find(|line| !is_io_max_line(line)) {
+            return Err(format!(
+                "CGROUP_IO_MAX has '{line}', expected e.g. '8:0 rbps=10485760 wbps=10485760'"
+            ));
+        }
+        fs::create_dir_all(&dir)
+            .map_err(|e| format!("Failed to create the {parent} cgroup: {e}"))?;
+        let available = fs::read_to_string(dir.join("cgroup.controllers"))
+            .map_err(|e| format!("Failed to read the controllers of the {parent} cgroup: {e}"))?;
+        let available: Vec<&str> = available.split_whitespace().collect();
+        let controllers = self.controllers();
+        if let Some(missing) = controllers.iter().find(|c| !available.contains(c)) {
+            return Err(format!(
+                "The {parent} cgroup has no {missing} controller; enable it in cgroup.subtree_control of the groups above it"
+            ));
+        }
+        let enable: Vec<String> = controllers.iter().map(|c| format!("+{c}")).collect();
+        fs::write(dir.join("cgroup.subtree_control"), enable.join(" ")).map_err(|e| {
+            format!("Failed to enable controllers for groups in the {parent} cgroup: {e}")
+        })?;
+        if embedded {
+            return Ok(());
+        }
+        let output = Command::new("docker")
+            .args(["info", "--format", "{{.CgroupDriver}} {{.CgroupVersion}}"])
+            .output()
+            .map_err(|e| format!("Failed to run docker info: {e}"))?;
+        match String::from_utf8_lossy(&output.stdout).trim() {
+            "cgroupfs 2" => Ok(()),
+            other => Err(format!(
+                "CGROUP_PARENT needs Docker's cgroupfs driver on cgroup v2, but docker info reports '{other}'"
+            )),
+        }
+    }
+
+    /// Creates the group a sandbox step runs in, named after its execution, with
+    /// `limits`, any batch `scheduling` and the core it's pinned to written to it.
+    /// None when groups aren't managed.
+    pub fn create(
+        &self,
+        job_id: Option<&str>,
+        limits: &ResourceLimits,
+        scheduling: Option<&Scheduling>,
+        cpu: Option<usize>,
+    ) -> std::io::Result<Option<ExecutionCgroup>> {
+        let (Some(parent), Some(dir)) = (&self.parent, self.parent_dir()) else {
+            return Ok(None);
+        };
+        // Steps of one execution each get their own group, so the run's peak
+        // isn't its compiler's
+        let name = format!("{}-{}", job_id.unwrap_or("step"), Uuid::new_v4());
+        let cgroup = ExecutionCgroup {
+            path: dir.join(&name),
+            docker_parent: format!("/{parent}/{name}"),
+        };
+        fs::create_dir(&cgroup.path)?;
+        let mut files = vec![
+            ("memory.max", limits.memory_limit.to_string()),
+            ("pids.max", limits.max_processes.to_string()),
+            ("cpu.max", self.cpu_max()),
+        ];
+        files.extend(self.io_max.iter().map(|line| ("io.max", line.clone())));
+        files.extend(cpu.map(|cpu| ("cpuset.cpus", cpu.to_string())));
+        for (file, value) in files {
+            cgroup.write(file, &value)?;
+        }
+        // Without swap accounting, e.g. booted with swapaccount=0, the kernel can't
+        // cap swap per group, so swap is only limited by what the host has
+        if cgroup.path.join("memory.swap.max").exists() {
+            cgroup.write("memory.swap.max", &limits.swap_limit.to_string())?;
+        }
+        // Weights are only honoured by some I/O schedulers
+        if let Some(scheduling) = scheduling {
+            let _ = cgroup.write("cpu.weight", &cpu_weight(scheduling.cpu_shares).to_string());
+            let _ = cgroup.write(
+                "io.weight",
+                &format!("default {}", io_weight(scheduling.blkio_weight)),
+            );
+        }
+        Ok(Some(cgroup))
+    }
+
+    fn cpu_max(&self) -> String {
+        let quota = (self.cpus * CPU_PERIOD_US as f64).round().max(1000.0) as u64;
+        format!("{quota} {CPU_PERIOD_US}")
+    }
+}
+
+/// Most a sandbox step used at once, in bytes, read from its cgroup
+#[derive(Debug, Clone, Copy, Default, PartialEq)]
+pub struct PeakUsage {
+    /// Needs Linux 5.19
+    pub memory: Option<u64>,
+    /// Needs Linux 6.5
+    pub swap: Option<u64>,
+}
+
+/// How often a sandbox step used up its `cpu.max` quota, read from its cgroup
+#[derive(Debug, Clone, Copy, Default, PartialEq)]
+pub struct Throttling {
+    /// Scheduler periods the step had runnable threads in
+    pub periods: u64,
+    /// Periods it ran out of quota in
+    pub throttled_periods: u64,
+    /// Time its threads waited for the next period
+    pub throttled_usec: u64,
+}
+
+/// The cgroup of one sandbox step. Dropping it kills whatever is still running
+/// in it, e.g. after a timeout, and removes it.
+#[derive(Debug)]
+pub struct ExecutionCgroup {
+    path: PathBuf,
+    docker_parent: String,
+}
+
+impl ExecutionCgroup {
+    /// Value for `docker run --cgroup-parent`
+    pub fn docker_parent(&self) -> &str {
+        &self.docker_parent
+    }
+
+    /// File a process writes "0" to in order to move itself into the group
+    pub fn procs_path(&self) -> PathBuf {
+        self.path.join("cgroup.procs")
+    }
+
+    /// Most memory and swap the step used at once
+    pub fn peak_usage(&self) -> PeakUsage {
+        PeakUsage {
+            memory: read_value(&self.path.join("memory.peak")),
+            swap: read_value(&self.path.join("memory.swap.peak")),
+        }
+    }
+
+    /// How often the step was throttled, from `cpu.stat`
+    pub fn throttling(&self) -> Option<Throttling> {
+        parse_cpu_stat(&fs::read_to_string(self.path.join("cpu.stat")).ok()?)
+    }
+
+    fn write(&self, file: &str, value: &str) -> std::io::Result<()> {
+        fs::write(self.path.join(file), value).map_err(|e| {
+            std::io::Error::new(e.kind(), format!("{file} of {}: {e}", self.path.display()))
+        })
+    }
+}
+
+impl Drop for ExecutionCgroup {
+    fn drop(&mut self) {
+        // Linux 5.14 and later; older kernels leave stragglers to the runtime
+        if let Ok(mut kill) = fs::OpenOptions::new()
+            .write(true)
+            .open(self.path.join("cgroup.kill"))
+        {
+            let _ = kill.write_all(b"1");
+        }
+        // A killed step's processes, or its container's group, can take a moment
+        // to go away
+        for attempt in 0..20 {
+            match fs::remove_dir(&self.path) {
+                Ok(()) => return,
+                Err(e) if e.kind() == std::io::ErrorKind::NotFound => return,
+                Err(e) if attempt == 19 => {
+                    log::warn!("Failed to remove cgroup {}: {e}", self.path.display())
+                }
+                Err(_) => std::thread::sleep(std::time::Duration::from_millis(25)),
+            }
+        }
+    }
+}
+
+fn read_value(path: &Path) -> Option<u64> {
+    fs::read_to_string(path).ok()?.trim().parse().ok()
+}
+
+// `cpu.stat` has a "key value" line per counter; the throttling ones are only
+// there with the cpu controller enabled
+fn parse_cpu_stat(stat: &str) -> Option<Throttling> {
+    let value = |key: &str| {
+        stat.lines()
+            .filter_map(|line| line.split_once(' '))
+            .find(|(name, _)| *name == key)
+            .and_then(|(_, value)| value.trim().parse().ok())
+    };
+    Some(Throttling {
+        periods: value("nr_periods")?,
+        throttled_periods: value("nr_throttled")?,
+        throttled_usec: value("throttled_usec")?,
+    })
+}
+
+// `io.max` lines are a device's "major:minor" followed by key=value limits
+fn is_io_max_line(line: &str) -> bool {
+    let mut fields = line.split_whitespace();
+    let device = fields.next().and_then(|device| device.split_once(':'));
+    let numeric = |s: &str| !s.is_empty() && s.chars().all(|c| c.is_ascii_digit());
+    let limits: Vec<&str> = fields.collect();
+    device.is_some_and(|(major, minor)| numeric(major) && numeric(minor))
+        && !limits.is_empty()
+        && limits.iter().all(|limit| {
+            limit.split_once('=').is_some_and(|(key, value)| {
+                ["rbps", "wbps", "riops", "wiops"].contains(&key)
+                    && (numeric(value) || value == "max")
+            })
+        })
+}
+
+// Docker's CPU shares (2 to 262144) as a cgroup v2 weight (1 to 10000), the
+// conversion runc uses
+fn cpu_weight(shares: u32) -> u64 {
+    1 + (u64::from(shares.max(2)) - 2) * 9999 / 262_142
+}
+
+// Docker's block I/O weight (10 to 1000) as a cgroup v2 weight
+fn io_weight(weight: u16) -> u64 {
+    1 + (u64::from(weight.max(10)) - 10) * 9999 / 990
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn fake_mount() -> PathBuf {
+        let mount = std::env::temp_dir().join(format!("isobox-cgroup-{}", Uuid::new_v4()));
+        fs::create_dir_all(&mount).unwrap();
+        mount
+    }
+
+    #[test]
+    fn test_disabled_without_parent() {
+        let cgroups = CgroupManager::default();
+        assert!(!cgroups.enabled());
+        assert!(cgroups.verify(false).is_ok());
+        assert!(cgroups
+            .create(Some("job"), &ResourceLimits::default(), None, None)
+            .unwrap()
+            .is_none());
+    }
+
+    #[test]
+    fn test_create_writes_limits() {
+        let mount = fake_mount();
+        fs::create_dir_all(mount.join("isobox")).unwrap();
+        let limits = ResourceLimits {
+            swap_limit: 64 * 1024 * 1024,
+            ..ResourceLimits::default()
+        };
+        let cgroups = CgroupManager::new(
+            mount.clone(),
+            Some("/isobox/".to_string()),
+            1.5,
+            vec!["8:0 wbps=1048576".to_string()],
+        );
+        let cgroup = cgroups
+            .create(
+                Some("job-1"),
+                &limits,
+                Some(&Scheduling::default()),
+                Some(3),
+            )
+            .unwrap()
+            .unwrap();
+        assert!(cgroup.docker_parent().starts_with("/isobox/job-1-"));
+        let path = cgroup.path.clone();
+        let read = |file: &str| fs::read_to_string(path.join(file)).unwrap();
+        assert_eq!(read("memory.max"), (128 * 1024 * 1024).to_string());
+        assert_eq!(read("pids.max"), "50");
+        assert_eq!(read("cpu.max"), "150000 100000");
+        assert_eq!(read("io.max"), "8:0 wbps=1048576");
+        assert_eq!(read("cpuset.cpus"), "3");
+        assert_eq!(read("cpu.weight"), cpu_weight(256).to_string());
+        assert_eq!(cgroup.peak_usage(), PeakUsage::default());
+
+        // A real group's files disappear with it; these are regular files
+        for file in fs::read_dir(&path).unwrap() {
+            fs::remove_file(file.unwrap().path()).unwrap();
+        }
+        drop(cgroup);
+        assert!(!path.exists());
+        fs::remove_dir_all(&mount).unwrap();
+    }
+
+    #[test]
+    fn test_verify_needs_cgroup_v2() {
+        let mount = fake_mount();
+        let cgroups =
+            CgroupManager::new(mount.clone(), Some("isobox".to_string()), 1.0, Vec::new());
+        assert!(cgroups.verify(true).is_err());
+        fs::remove_dir_all(&mount).unwrap();
+    }
+
+    #[test]
+    fn test_io_max_lines() {
+        assert!(is_io_max_line("8:0 rbps=10485760 wbps=max"));
+        assert!(is_io_max_line("259:0 riops=1000"));
+        assert!(!is_io_max_line("8:0"));
+        assert!(!is_io_max_line("sda rbps=1"));
+        assert!(!is_io_max_line("8:0 speed=1"));
+    }
+
+    #[test]
+    fn test_parse_cpu_stat() {
+        let stat = "usage_usec 2012345\nuser_usec 1900000\nsystem_usec 112345\n\
+            nr_periods 25\nnr_throttled 12\nthrottled_usec 840000\n";
+        assert_eq!(
+            parse_cpu_stat(stat),
+            Some(Throttling {
+                periods: 25,
+                throttled_periods: 12,
+                throttled_usec: 840_000,
+            })
+        );
+        assert_eq!(parse_cpu_stat("usage_usec 10\n"), None);
+    }
+
+    #[test]
+    fn test_weights() {
+        assert_eq!(cpu_weight(2), 1);
+        assert_eq!(cpu_weight(262_144), 10_000);
+        assert_eq!(io_weight(10), 1);
+        assert_eq!(io_weight(1000), 10_000);
+    }
+}
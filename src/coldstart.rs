@@ -0,0 +1,259 @@
+use serde::Serialize;
+use std::collections::BTreeMap;
+use std::sync::Mutex;
+use std::time::Duration;
+
+/// Upper bounds of the latency histogram buckets, in seconds. Warm hits land in
+/// the low buckets and cold starts, which include starting a container and
+/// compiling, in the high ones.
+pub const LATENCY_BUCKETS: &[f64] = &[
+    0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1.0, 2.5, 5.0, 10.0, 30.0,
+];
+
+#[derive(Debug, Clone)]
+struct Histogram {
+    // Observations per bucket, with one more for those above the last bound
+    counts: Vec<u64>,
+    sum_seconds: f64,
+}
+
+impl Default for Histogram {
+    fn default() -> Self {
+        Self {
+            counts: vec![0; LATENCY_BUCKETS.len() + 1],
+            sum_seconds: 0.0,
+        }
+    }
+}
+
+impl Histogram {
+    fn observe(&mut self, latency: Duration) {
+        let seconds = latency.as_secs_f64();
+        let bucket = LATENCY_BUCKETS
+            .iter()
+            .position(|bound| seconds <= *bound)
+            .unwrap_or(LATENCY_BUCKETS.len());
+        self.counts[bucket] += 1;
+        self.sum_seconds += seconds;
+    }
+
+    fn snapshot(&self) -> LatencyHistogram {
+        let mut cumulative = 0;
+        let buckets = self
+            .counts
+            .iter()
+            .enumerate()
+            .map(|(i, count)| {
+                cumulative += count;
+                Bucket {
+                    le: LATENCY_BUCKETS.get(i).copied(),
+                    count: cumulative,
+                }
+            })
+            .collect();
+        LatencyHistogram {
+            count: cumulative,
+            sum_seconds: self.sum_seconds,
+            buckets,
+        }
+    }
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct Bucket {
+    /// Upper bound in seconds; null for the bucket that holds everything
+    pub le: Option<f64>,
+    /// Observations at or below the bound, like a Prometheus histogram
+    pub count: u64,
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct LatencyHistogram {
+    pub count: u64,
+    pub sum_seconds: f64,
+    pub buckets: Vec<Bucket>,
+}
+
+#[derive(Debug, Clone, Default)]
+struct Starts {
+    warm: Histogram,
+    cold: Histogram,
+}
+
+impl Starts {
+    fn observe(&mut self, cold: bool, latency: Duration) {
+        if cold {
+            self.cold.observe(latency);
+        } else {
+            self.warm.observe(latency);
+        }
+    }
+
+    fn snapshot(&self) -> StartStats {
+        let warm = self.warm.snapshot();
+        let cold = self.cold.snapshot();
+        let total = warm.count + cold.count;
+        StartStats {
+            warm_hits: warm.count,
+            cold_starts: cold.count,
+            warm_hit_rate: (total > 0).then(|| warm.count as f64 / total as f64),
+            warm_latency: warm,
+            cold_latency: cold,
+        }
+    }
+}
+
+/// How many invocations found a warm instance and how many paid for a cold start,
+/// with the latency of each
+#[derive(Debug, Clone, Serialize)]
+pub struct StartStats {
+    pub warm_hits: u64,
+    pub cold_starts: u64,
+    /// None until there has been an invocation
+    pub warm_hit_rate: Option<f64>,
+    pub warm_latency: LatencyHistogram,
+    pub cold_latency: LatencyHistogram,
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct FunctionStartStats {
+    pub tenant: String,
+    pub name: String,
+    pub language: String,
+    #[serde(flatten)]
+    pub stats: StartStats,
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct ColdStartSnapshot {
+    pub languages: BTreeMap<String, StartStats>,
+    pub functions: Vec<FunctionStartStats>,
+}
+
+#[derive(Default)]
+struct Metrics {
+    languages: BTreeMap<String, Starts>,
+    // Keyed by tenant and function name, with the function's language
+    functions: BTreeMap<(String, String), (String, Starts)>,
+}
+
+/// Warm hits and cold starts of function invocations since the server started,
+/// per language and per function, for sizing the functions' instance pools
+#[derive(Default)]
+pub struct ColdStartMetrics {
+    metrics: Mutex<Metrics>,
+}
+
+impl ColdStartMetrics {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    pub fn observe(&self, tenant: &str, name: &str, language: &str, cold: bool, latency: Duration) {
+        let mut metrics = self.metrics.lock().unwrap();
+        metrics
+            .languages
+            .entry(language.to_string())
+            .or_default()
+            .observe(cold, latency);
+        let (function_language, starts) = metrics
+            .functions
+            .entry((tenant.to_string(), name.to_string()))
+            .or_insert_with(|| (language.to_string(), Starts::default()));
+        // A redeploy may change the language; the function's history goes with it
+        *function_language = language.to_string();
+        starts.observe(cold, latency);
+    }
+
+    /// Stats of one function, empty before its first invocation
+    pub fn function(&self, tenant: &str, name: &str) -> StartStats {
+        self.metrics
+            .lock()
+            .unwrap()
+            .functions
+            .get(&(tenant.to_string(), name.to_string()))
+            .map_or_else(
+                || Starts::default().snapshot(),
+                |(_, starts)| starts.snapshot(),
+            )
+    }
+
+    /// Forgets a deleted function. Its invocations still count for its language.
+    pub fn remove_function(&self, tenant: &str, name: &str) {
+        self.metrics
+            .lock()
+            .unwrap()
+            .functions
+            .remove(&(tenant.to_string(), name.to_string()));
+    }
+
+    pub fn remove_tenant(&self, tenant: &str) {
+        self.metrics
+            .lock()
+            .unwrap()
+            .functions
+            .retain(|(owner, _), _| owner != tenant);
+    }
+
+    pub fn snapshot(&self) -> ColdStartSnapshot {
+        let metrics = self.metrics.lock().unwrap();
+        ColdStartSnapshot {
+            languages: metrics
+                .languages
+                .iter()
+                .map(|(language, starts)| (language.clone(), starts.snapshot()))
+                .collect(),
+            functions: metrics
+                .functions
+                .iter()
+                .map(|((tenant, name), (language, starts))| FunctionStartStats {
+                    tenant: tenant.clone(),
+                    name: name.clone(),
+                    language: language.clone(),
+                    stats: starts.snapshot(),
+                })
+                .collect(),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_warm_and_cold_starts() {
+        let metrics = ColdStartMetrics::new();
+        metrics.observe("cs101", "add", "python", true, Duration::from_millis(1800));
+        metrics.observe("cs101", "add", "python", false, Duration::from_millis(20));
+        metrics.observe("cs101", "add", "python", false, Duration::from_millis(40));
+        metrics.observe("cs101", "sum", "node", false, Duration::from_secs(60));
+
+        let add = metrics.function("cs101", "add");
+        assert_eq!((add.warm_hits, add.cold_starts), (2, 1));
+        assert_eq!(add.warm_hit_rate, Some(2.0 / 3.0));
+        // Buckets are cumulative
+        let le = |histogram: &LatencyHistogram, bound: f64| {
+            histogram
+                .buckets
+                .iter()
+                .find(|bucket| bucket.le == Some(bound))
+                .unwrap()
+                .count
+        };
+        assert_eq!(le(&add.warm_latency, 0.025), 1);
+        assert_eq!(le(&add.warm_latency, 0.05), 2);
+        assert_eq!(le(&add.cold_latency, 1.0), 0);
+        assert_eq!(le(&add.cold_latency, 2.5), 1);
+
+        // Latencies above the last bound only land in the open bucket
+        let node = &metrics.snapshot().languages["node"];
+        assert_eq!(le(&node.warm_latency, 30.0), 0);
+        assert_eq!(node.warm_latency.buckets.last().unwrap().count, 1);
+
+        metrics.remove_tenant("cs101");
+        assert_eq!(metrics.function("cs101", "add").warm_hit_rate, None);
+        assert!(metrics.snapshot().functions.is_empty());
+        assert_eq!(metrics.snapshot().languages["python"].warm_hits, 2);
+    }
+}
@@ -0,0 +1,138 @@
+use crate::config::IsoboxConfig;
+use serde::Serialize;
+use std::collections::{BTreeMap, HashMap};
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::sync::Arc;
+use tokio::sync::{OwnedSemaphorePermit, Semaphore};
+
+/// How busy a language with a concurrency cap is on this host
+#[derive(Debug, Clone, Default, PartialEq, Serialize)]
+pub struct SlotUsage {
+    pub limit: usize,
+    pub running: usize,
+    /// Executions waiting in line for a slot
+    pub waiting: usize,
+}
+
+struct Slots {
+    limit: usize,
+    // Fair, so executions of the language start in the order they arrived
+    semaphore: Arc<Semaphore>,
+    waiting: AtomicUsize,
+}
+
+// Counts an execution as waiting until it gets its slot or gives up
+struct Waiting<'a>(&'a AtomicUsize);
+
+impl Drop for Waiting<'_> {
+    fn drop(&mut self) {
+        self.0.fetch_sub(1, Ordering::Relaxed);
+    }
+}
+
+/// Caps on how many executions of a language this host runs at once. Each capped
+/// language queues on its own, so a heavy one filling its slots doesn't hold up the
+/// others; languages without a cap never wait.
+#[derive(Default)]
+pub struct LanguageSlots {
+    languages: HashMap<String, Slots>,
+}
+
+impl LanguageSlots {
+    pub fn new(limits: HashMap<String, usize>) -> Self {
+        let languages = limits
+            .into_iter()
+            .map(|(language, limit)| {
+                let limit = limit.max(1);
+                let slots = Slots {
+                    limit,
+                    semaphore: Arc::new(Semaphore::new(limit)),
+                    waiting: AtomicUsize::new(0),
+                };
+                (language, slots)
+            })
+            .collect();
+        Self { languages }
+    }
+
+    /// The `max_concurrent` of each configured language that has one
+    pub fn from_config(config: &IsoboxConfig) -> Self {
+        Self::new(
+            config
+                .languages
+                .iter()
+                .filter_map(|(language, overrides)| {
+                    Some((language.clone(), overrides.max_concurrent?))
+                })
+                .collect(),
+        )
+    }
+
+    pub fn limits(&self) -> HashMap<String, usize> {
+        self.languages
+            .iter()
+            .map(|(language, slots)| (language.clone(), slots.limit))
+            .collect()
+    }
+
+    /// Waits for a free slot of the language, which is held until the permit is
+    /// dropped. None for languages without a cap.
+    pub async fn acquire(&self, language: &str) -> Option<OwnedSemaphorePermit> {
+        let slots = self.languages.get(language)?;
+        slots.waiting.fetch_add(1, Ordering::Relaxed);
+        let _waiting = Waiting(&slots.waiting);
+        // The semaphore is never closed
+        slots.semaphore.clone().acquire_owned().await.ok()
+    }
+
+    /// Running and waiting executions of the capped languages
+    pub fn usage(&self) -> BTreeMap<String, SlotUsage> {
+        self.languages
+            .iter()
+            .map(|(language, slots)| {
+                let usage = SlotUsage {
+                    limit: slots.limit,
+                    running: slots.limit - slots.semaphore.available_permits(),
+                    waiting: slots.waiting.load(Ordering::Relaxed),
+                };
+                (language.clone(), usage)
+            })
+            .collect()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::time::Duration;
+
+    #[tokio::test]
+    async fn test_languages_queue_separately() {
+        let slots = LanguageSlots::new(HashMap::from([
+            ("java".to_string(), 1),
+            ("python".to_string(), 2),
+        ]));
+        assert!(slots.acquire("rust").await.is_none());
+
+        let java = slots.acquire("java").await.unwrap();
+        let waiting = tokio::time::timeout(Duration::from_millis(50), slots.acquire("java")).await;
+        assert!(waiting.is_err());
+
+        // A full Java queue doesn't hold up Python
+        let _python = slots.acquire("python").await.unwrap();
+        let usage = slots.usage();
+        assert_eq!(
+            usage["java"],
+            SlotUsage {
+                limit: 1,
+                running: 1,
+                waiting: 0,
+            }
+        );
+        assert_eq!(usage["python"].running, 1);
+
+        drop(java);
+        assert!(slots.acquire("java").await.is_some());
+        assert_eq!(slots.usage()["java"].running, 0);
+    }
+}
@@ -0,0 +1,2225 @@
+use crate::abuse::Restriction;
+use crate::cpuset::CpuPolicy;
+use crate::events::EventKind;
+use crate::hooks::HookPhase;
+use crate::labels;
+use crate::ratelimit::IpRange;
+use crate::redact::Redactor;
+use crate::scan::{ScannerKind, Severity};
+use crate::seccomp::SyscallPolicy;
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::fs;
+use std::path::PathBuf;
+use thiserror::Error;
+
+#[derive(Debug, Error)]
+pub enum ConfigError {
+    #[error("Failed to read configuration file {0}: {1}")]
+    Read(String, String),
+    #[error("Failed to parse configuration file {0}: {1}")]
+    Parse(String, String),
+    #[error("Invalid configuration value: {0}")]
+    InvalidValue(String),
+}
+
+/// Tenant used for requests that don't authenticate as a configured tenant
+pub const DEFAULT_TENANT: &str = "default";
+
+/// Server configuration loaded from the JSON file named by `ISOBOX_CONFIG`.
+/// Every section is optional so an empty file (or no file) keeps the built-in defaults.
+#[derive(Debug, Clone, Default, Deserialize)]
+pub struct IsoboxConfig {
+    #[serde(default)]
+    pub languages: HashMap<String, LanguageOverride>,
+    #[serde(default)]
+    pub tenants: HashMap<String, TenantConfig>,
+    #[serde(default)]
+    pub caches: HashMap<String, CacheMount>,
+    #[serde(default)]
+    pub datasets: HashMap<String, DatasetConfig>,
+    #[serde(default)]
+    pub redaction: RedactionConfig,
+    /// Request limits applied to every tenant without its own
+    #[serde(default)]
+    pub rate_limits: RateLimitConfig,
+    #[serde(default)]
+    pub client_limits: ClientLimitConfig,
+    /// Routing between replicas; a single server needs none
+    #[serde(default)]
+    pub replicas: ReplicaConfig,
+    /// External hooks called around every execution, in order
+    #[serde(default)]
+    pub hooks: Vec<HookConfig>,
+    /// Code templates requests can wrap their code in, keyed by name
+    #[serde(default)]
+    pub harnesses: HashMap<String, HarnessConfig>,
+    /// Vulnerability scanning of the language images; off when unset
+    pub image_scan: Option<ImageScanConfig>,
+    /// Interpreters run on the host instead of in containers when
+    /// `EXECUTION_BACKEND` is `embedded`, keyed by language
+    #[serde(default)]
+    pub embedded_runtimes: HashMap<String, EmbeddedRuntimeConfig>,
+    /// Seccomp preset for sandboxes whose language and tenant don't set one
+    #[serde(default)]
+    pub syscall_policy: SyscallPolicy,
+    /// Root filesystem of sandboxes whose language doesn't set its own
+    #[serde(default)]
+    pub filesystem: FilesystemConfig,
+    /// How executions are spread over the cores of `PINNED_CPUS`
+    #[serde(default)]
+    pub cpu_policy: CpuPolicy,
+    /// Named environments with packages preinstalled that requests can select,
+    /// e.g. `python-datasci`
+    #[serde(default)]
+    pub presets: HashMap<String, PresetConfig>,
+    /// How each language's dependencies are installed from a lockfile in the
+    /// workspace, once per distinct lockfile
+    #[serde(default)]
+    pub dependencies: HashMap<String, DependencyConfig>,
+    /// Package indexes installs use instead of the public ones
+    #[serde(default)]
+    pub package_mirrors: PackageMirrorConfig,
+    /// Request label keys broken out in the execution metrics
+    #[serde(default)]
+    pub metric_labels: MetricLabelsConfig,
+    /// Prices of the resources executions reserve, for cost estimates; estimates
+    /// only report the reservation when unset
+    pub metering: Option<MeteringConfig>,
+    /// Where signs of sandbox escape attempts are reported besides the log
+    #[serde(default)]
+    pub security_alerts: SecurityAlertsConfig,
+    /// How executions that look like cryptomining or botnets are dealt with
+    #[serde(default)]
+    pub abuse: AbuseConfig,
+    /// Log stores execution events are shipped to; none when unset
+    #[serde(default)]
+    pub log_export: LogExportConfig,
+}
+
+/// Size of the tmpfs mounted at `/tmp` when no size is configured for it
+pub const DEFAULT_TMPFS_MB: u64 = 64;
+
+/// Directory the server keeps its data in by default: stored executions,
+/// assignments, caches and the like, each in a directory of its own. `DATA_DIR`
+/// sets it. It's outside `/tmp` so nothing in it is reachable from a sandbox unless
+/// it's mounted there on purpose.
+pub fn data_dir() -> PathBuf {
+    std::env::var("DATA_DIR")
+        .map(PathBuf::from)
+        .unwrap_or_else(|_| PathBuf::from("/var/lib/isobox"))
+}
+
+/// How a sandbox's root filesystem is mounted
+#[derive(Debug, Clone, Default, Deserialize, PartialEq)]
+pub struct FilesystemConfig {
+    /// Mount the image read-only, so nothing outside the workspace and the
+    /// tmpfs mounts can be changed
+    #[serde(default)]
+    pub read_only: bool,
+    /// Size in MB of a tmpfs mounted at each path, e.g. `{"/tmp": 64}`. A
+    /// read-only root always gets one at `/tmp`.
+    #[serde(default)]
+    pub tmpfs: HashMap<String, u64>,
+}
+
+impl FilesystemConfig {
+    /// Paths and sizes in bytes of the tmpfs mounts, sorted by path
+    pub fn tmpfs_mounts(&self) -> Vec<(String, u64)> {
+        let mut mounts: Vec<(String, u64)> = self
+            .tmpfs
+            .iter()
+            .map(|(path, mb)| (path.clone(), mb * 1024 * 1024))
+            .collect();
+        if self.read_only && !self.tmpfs.contains_key("/tmp") {
+            mounts.push(("/tmp".to_string(), DEFAULT_TMPFS_MB * 1024 * 1024));
+        }
+        mounts.sort();
+        mounts
+    }
+
+    fn validate(&self, scope: &str) -> Result<(), String> {
+        for (path, mb) in &self.tmpfs {
+            let valid = path.starts_with('/')
+                && path != "/"
+                && !path.split('/').any(|part| part == "..")
+                && !path.contains([',', ':']);
+            if !valid {
+                return Err(format!("Invalid tmpfs path '{path}' for {scope}"));
+            }
+            if *mb == 0 {
+                return Err(format!("The tmpfs at {path} for {scope} needs a size"));
+            }
+        }
+        Ok(())
+    }
+}
+
+/// A statically-linked interpreter or toolchain shipped next to isobox, e.g. a
+/// standalone Python build, QuickJS or Wasmtime
+#[derive(Debug, Clone, Deserialize)]
+pub struct EmbeddedRuntimeConfig {
+    /// Extension of the source file, which is written as `main.<extension>`
+    pub extension: String,
+    /// Compile command template, run once before the program. `{file}` and `{stem}`
+    /// are replaced like in language overrides.
+    pub compile: Option<Vec<String>>,
+    /// Run command template; the first element is the interpreter binary
+    pub run: Vec<String>,
+    /// Syntax check command template, like `check` in language overrides
+    pub check: Option<Vec<String>>,
+    /// Resource limits replacing the server defaults for this language
+    pub limits: Option<LanguageLimits>,
+}
+
+/// Scans every language image with an external scanner at startup and then
+/// periodically, so newly published CVEs are picked up
+#[derive(Debug, Clone, Deserialize)]
+pub struct ImageScanConfig {
+    pub scanner: ScannerKind,
+    /// Languages whose image has a finding of at least this severity are refused.
+    /// Without it findings are only reported.
+    pub block_severity: Option<Severity>,
+    /// Seconds between scans; 0 scans only at startup
+    #[serde(default = "default_rescan_seconds")]
+    pub rescan_seconds: u64,
+}
+
+fn default_rescan_seconds() -> u64 {
+    86_400
+}
+
+/// Source template that wraps a request's code, e.g. a `main` that calls the
+/// submitted function with test input and prints the result as JSON
+#[derive(Debug, Clone, Deserialize)]
+pub struct HarnessConfig {
+    /// Language the harness is written in; requests for other languages can't use it
+    pub language: String,
+    /// Source with `{{code}}` where the request's code goes and `{{name}}` for each
+    /// parameter
+    pub template: Option<String>,
+    /// File the template is read from when the configuration is loaded, instead of
+    /// giving it inline
+    pub template_file: Option<String>,
+    /// Parameters the template uses, with their default values. Parameters without
+    /// a default must be given by every request.
+    #[serde(default)]
+    pub params: HashMap<String, Option<String>>,
+}
+
+impl HarnessConfig {
+    /// Fills in the template with the request's code and parameters. Everything is
+    /// substituted in a single pass, so placeholders inside the code are left alone.
+    pub fn render(&self, code: &str, params: &HashMap<String, String>) -> Result<String, String> {
+        if let Some(unknown) = params.keys().find(|name| !self.params.contains_key(*name)) {
+            return Err(format!("Unknown harness parameter '{unknown}'"));
+        }
+        let mut rendered = String::new();
+        let mut rest = self.template.as_deref().unwrap_or_default();
+        while let Some((before, name, after)) = next_placeholder(rest) {
+            rendered.push_str(before);
+            if name == "code" {
+                rendered.push_str(code);
+            } else {
+                let value = params
+                    .get(name)
+                    .or_else(|| self.params.get(name).and_then(Option::as_ref))
+                    .ok_or_else(|| format!("Missing harness parameter '{name}'"))?;
+                rendered.push_str(value);
+            }
+            rest = after;
+        }
+        rendered.push_str(rest);
+        Ok(rendered)
+    }
+
+    fn validate(&self, harness: &str) -> Result<(), String> {
+        let template = self.template.as_deref().unwrap_or_default();
+        let mut has_code = false;
+        let mut rest = template;
+        while let Some((_, name, after)) = next_placeholder(rest) {
+            if name == "code" {
+                has_code = true;
+            } else if !self.params.contains_key(name) {
+                return Err(format!(
+                    "Harness '{harness}' uses undeclared parameter '{name}'"
+                ));
+            }
+            rest = after;
+        }
+        if !has_code {
+            return Err(format!(
+                "Harness '{harness}' has no {{{{code}}}} placeholder"
+            ));
+        }
+        Ok(())
+    }
+}
+
+// Splits a template around its first `{{name}}` placeholder
+fn next_placeholder(template: &str) -> Option<(&str, &str, &str)> {
+    let start = template.find("{{")?;
+    let end = template[start..].find("}}")? + start;
+    let name = template[start + 2..end].trim();
+    Some((&template[..start], name, &template[end + 2..]))
+}
+
+/// An environment built on a language, with its dependencies baked into an image so
+/// requests don't install them on every run
+#[derive(Debug, Clone, Deserialize, Serialize, PartialEq)]
+pub struct PresetConfig {
+    /// Language the preset runs; requests selecting it must be for this language
+    pub language: String,
+    /// Image with the packages installed, based on the language's image
+    pub image: String,
+    /// The packages the image has installed, for clients to see what's available
+    #[serde(default)]
+    pub packages: Vec<String>,
+    /// Environment variables set in the sandbox
+    #[serde(default)]
+    pub env: HashMap<String, String>,
+    /// Resource limits replacing the language's, e.g. more memory for data science
+    pub limits: Option<LanguageLimits>,
+}
+
+impl PresetConfig {
+    pub fn validate(&self, preset: &str) -> Result<(), String> {
+        if !is_valid_name(preset) {
+            return Err(format!("Invalid preset name '{preset}'"));
+        }
+        if self.image.trim().is_empty() {
+            return Err(format!("Preset '{preset}' has no image"));
+        }
+        if let Some(name) = self
+            .env
+            .keys()
+            .find(|name| name.is_empty() || name.contains('='))
+        {
+            return Err(format!(
+                "Invalid environment variable '{name}' in preset '{preset}'"
+            ));
+        }
+        if let Some(limits) = &self.limits {
+            limits.validate(&self.language)?;
+        }
+        Ok(())
+    }
+}
+
+/// An HTTP endpoint called before and after executions. It can rewrite or veto the
+/// request and rewrite the result.
+#[derive(Debug, Clone, Deserialize)]
+pub struct HookConfig {
+    pub url: String,
+    /// Signs calls the same way as webhook deliveries when set
+    pub secret: Option<String>,
+    /// Phases the hook is called in; empty means both
+    #[serde(default)]
+    pub phases: Vec<HookPhase>,
+    #[serde(default = "default_hook_timeout_ms")]
+    pub timeout_ms: u64,
+    /// Lets executions go ahead when the hook can't be reached or answers with an
+    /// error, instead of failing them
+    #[serde(default)]
+    pub fail_open: bool,
+}
+
+fn default_hook_timeout_ms() -> u64 {
+    2000
+}
+
+impl HookConfig {
+    pub fn applies_to(&self, phase: HookPhase) -> bool {
+        self.phases.is_empty() || self.phases.contains(&phase)
+    }
+}
+
+/// Token-bucket limits for API requests
+#[derive(Debug, Clone, Default, Deserialize)]
+pub struct RateLimitConfig {
+    /// Limit shared by every endpoint without an override
+    pub default: Option<RateLimit>,
+    /// Overrides keyed by route, e.g. `/v1/execute`. Each gets its own bucket. Routes
+    /// may also be written with the `/api` prefix, which names the same endpoint.
+    #[serde(default)]
+    pub endpoints: HashMap<String, RateLimit>,
+}
+
+/// Limits applied to each client IP address, for public deployments where requests
+/// don't authenticate as distinct tenants
+#[derive(Debug, Clone, Default, Deserialize)]
+pub struct ClientLimitConfig {
+    pub rate: Option<RateLimit>,
+    /// Requests a client may have in progress at once
+    pub max_concurrent: Option<usize>,
+    /// Proxy addresses or CIDR ranges whose `X-Forwarded-For` header is trusted
+    #[serde(default)]
+    pub trusted_proxies: Vec<String>,
+}
+
+/// This server's routing token and the other replicas calls about their sessions
+/// and function deployments are forwarded to, when it runs as one of several
+#[derive(Debug, Clone, Default, Deserialize)]
+pub struct ReplicaConfig {
+    /// Routing token of this replica
+    pub id: Option<String>,
+    /// Base URLs of the other replicas, keyed by their routing token
+    #[serde(default)]
+    pub peers: HashMap<String, String>,
+}
+
+impl ReplicaConfig {
+    fn validate(&self) -> Result<(), String> {
+        if self.id.as_deref().is_some_and(|id| id.trim().is_empty()) {
+            return Err("replicas.id must not be empty".to_string());
+        }
+        if !self.peers.is_empty() && self.id.is_none() {
+            return Err(
+                "replicas.peers needs replicas.id, the token peers know this replica by"
+                    .to_string(),
+            );
+        }
+        for (token, url) in &self.peers {
+            if token.trim().is_empty() {
+                return Err(format!("Replica peer '{url}' needs a routing token"));
+            }
+            if !url.starts_with("https://") && !url.starts_with("http://") {
+                return Err(format!("Replica peer URL '{url}' must be http(s)"));
+            }
+        }
+        Ok(())
+    }
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Deserialize)]
+pub struct RateLimit {
+    /// Requests per second the bucket refills at
+    pub rate: f64,
+    /// Requests that can be made back to back when the bucket is full
+    pub burst: u32,
+}
+
+/// Patterns masked in program output before it is logged or stored
+#[derive(Debug, Clone, Default, Deserialize)]
+pub struct RedactionConfig {
+    /// Built-in rule sets: `aws_keys`, `emails`, `tokens`
+    #[serde(default)]
+    pub presets: Vec<String>,
+    #[serde(default)]
+    pub rules: Vec<RedactionRule>,
+}
+
+#[derive(Debug, Clone, Deserialize)]
+pub struct RedactionRule {
+    /// Shown in place of each match as `[REDACTED:<name>]`
+    pub name: String,
+    /// Regular expression matched against the output
+    pub pattern: String,
+}
+
+/// Placeholders a language's command templates may use
+pub const COMMAND_PLACEHOLDERS: &[&str] = &["{file}", "{stem}", "{work_dir}"];
+
+/// Linux capabilities a language can be granted, without the `CAP_` prefix
+pub const CAPABILITIES: &[&str] = &[
+    "AUDIT_CONTROL",
+    "AUDIT_READ",
+    "AUDIT_WRITE",
+    "BLOCK_SUSPEND",
+    "BPF",
+    "CHECKPOINT_RESTORE",
+    "CHOWN",
+    "DAC_OVERRIDE",
+    "DAC_READ_SEARCH",
+    "FOWNER",
+    "FSETID",
+    "IPC_LOCK",
+    "IPC_OWNER",
+    "KILL",
+    "LEASE",
+    "LINUX_IMMUTABLE",
+    "MAC_ADMIN",
+    "MAC_OVERRIDE",
+    "MKNOD",
+    "NET_ADMIN",
+    "NET_BIND_SERVICE",
+    "NET_BROADCAST",
+    "NET_RAW",
+    "PERFMON",
+    "SETFCAP",
+    "SETGID",
+    "SETPCAP",
+    "SETUID",
+    "SYSLOG",
+    "SYS_ADMIN",
+    "SYS_BOOT",
+    "SYS_CHROOT",
+    "SYS_MODULE",
+    "SYS_NICE",
+    "SYS_PACCT",
+    "SYS_PTRACE",
+    "SYS_RAWIO",
+    "SYS_RESOURCE",
+    "SYS_TIME",
+    "SYS_TTY_CONFIG",
+    "WAKE_ALARM",
+];
+
+/// Per-language runtime overrides. An entry with an `extension` defines a language
+/// isobox doesn't ship, and must also give an `image` and a `run` command.
+#[derive(Debug, Clone, Default, Deserialize)]
+pub struct LanguageOverride {
+    /// Image used when the request does not ask for a specific version,
+    /// e.g. `python:3.11@sha256:...`
+    pub image: Option<String>,
+    /// Images keyed by the version a request can select, e.g. `"3.12": "python:3.12@sha256:..."`
+    #[serde(default)]
+    pub versions: HashMap<String, String>,
+    /// Extension of the source file, which is written as `main.<extension>`
+    pub extension: Option<String>,
+    /// Compile command template, run once before the program. `{file}`, `{stem}` and
+    /// `{work_dir}` are replaced with the source file name, its name without the
+    /// extension, and the directory the workspace is mounted at.
+    pub compile: Option<Vec<String>>,
+    /// Run command template, with the same placeholders as `compile`
+    pub run: Option<Vec<String>>,
+    /// Syntax check command template, with the same placeholders as `compile`. It
+    /// should only parse the source and report problems as `file:line:column: error:
+    /// message` lines.
+    pub check: Option<Vec<String>>,
+    /// Resource limits replacing the server defaults for this language
+    pub limits: Option<LanguageLimits>,
+    /// Ulimits replacing the server defaults for this language, applied after
+    /// `limits`. Requests can lower them but not raise them.
+    pub ulimits: Option<Ulimits>,
+    /// Runtime staged to replace `image`, used by part of the requests
+    pub next: Option<ChannelConfig>,
+    /// Seccomp preset for the language's sandboxes
+    pub syscall_policy: Option<SyscallPolicy>,
+    /// AppArmor profile the language's containers are confined by; it has to be
+    /// loaded on the host
+    pub apparmor_profile: Option<String>,
+    /// SELinux label of the language's containers
+    pub selinux_label: Option<SelinuxLabel>,
+    /// Root filesystem of the language's sandboxes, replacing the top-level one
+    pub filesystem: Option<FilesystemConfig>,
+    /// Linux capabilities granted to the language's sandboxes, e.g. `["SYS_PTRACE"]`.
+    /// Sandboxes otherwise run with none.
+    #[serde(default)]
+    pub capabilities: Vec<String>,
+    /// Most executions of the language a server or agent runs at once, e.g. 4 for
+    /// a JVM that needs a lot of memory. Further ones wait in the language's own
+    /// queue, so they don't hold up other languages.
+    pub max_concurrent: Option<usize>,
+}
+
+/// SELinux label for `docker run --security-opt label=...`. Unset parts keep the
+/// label Docker would give the container.
+#[derive(Debug, Clone, Default, Deserialize, PartialEq)]
+pub struct SelinuxLabel {
+    pub user: Option<String>,
+    pub role: Option<String>,
+    #[serde(rename = "type")]
+    pub kind: Option<String>,
+    pub level: Option<String>,
+}
+
+impl SelinuxLabel {
+    fn parts(&self) -> Vec<(&'static str, &str)> {
+        [
+            ("user", &self.user),
+            ("role", &self.role),
+            ("type", &self.kind),
+            ("level", &self.level),
+        ]
+        .into_iter()
+        .filter_map(|(part, value)| Some((part, value.as_deref()?)))
+        .collect()
+    }
+}
+
+/// The runtime a request ran on when its language has a `next` channel
+#[derive(Debug, Clone, Copy, PartialEq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum Channel {
+    /// The language's default image
+    Stable,
+    /// The staged runtime
+    Next,
+}
+
+impl Channel {
+    pub fn as_str(self) -> &'static str {
+        match self {
+            Channel::Stable => "stable",
+            Channel::Next => "next",
+        }
+    }
+}
+
+/// A runtime staged next to a language's default image, e.g. a release candidate,
+/// so an upgrade can be validated on real traffic before it becomes the default
+#[derive(Debug, Clone, Deserialize)]
+pub struct ChannelConfig {
+    pub image: String,
+    /// Percentage of requests, 0 to 100, that use the channel
+    #[serde(default)]
+    pub percent: f64,
+    /// Tenants whose requests always use the channel
+    #[serde(default)]
+    pub tenants: Vec<String>,
+}
+
+/// Per-language resource limits. Unset fields keep the server default.
+#[derive(Debug, Clone, Copy, Default, Deserialize, Serialize, PartialEq)]
+pub struct LanguageLimits {
+    pub cpu_time_seconds: Option<u64>,
+    pub wall_time_seconds: Option<u64>,
+    pub memory_mb: Option<u64>,
+    pub max_processes: Option<u32>,
+    pub max_files: Option<u32>,
+    /// Swap the sandbox may use on top of `memory_mb`; 0 disables swap
+    pub swap_mb: Option<u64>,
+}
+
+impl LanguageLimits {
+    fn validate(&self, language: &str) -> Result<(), String> {
+        let values = [
+            self.cpu_time_seconds,
+            self.wall_time_seconds,
+            self.memory_mb,
+            self.max_processes.map(u64::from),
+            self.max_files.map(u64::from),
+        ];
+        if values.contains(&Some(0)) {
+            return Err(format!(
+                "Resource limits for language '{language}' must be positive"
+            ));
+        }
+        Ok(())
+    }
+}
+
+/// Per-process limits set with `setrlimit` in the sandbox, named after the
+/// `ulimit` resources. Sizes are in bytes; unset fields keep the language's limit.
+#[derive(Debug, Clone, Copy, Default, Deserialize, Serialize, PartialEq)]
+pub struct Ulimits {
+    /// Open file descriptors, the same limit as `max_files`
+    pub nofile: Option<u32>,
+    /// Largest file the program may write; writing past it raises SIGXFSZ
+    pub fsize: Option<u64>,
+    /// Largest core dump a `debug` run may write
+    pub core: Option<u64>,
+    pub stack: Option<u64>,
+}
+
+impl Ulimits {
+    /// A program can't even start without a descriptor or a stack, so those can't
+    /// be zero. `fsize` and `core` can, to forbid writing files or dumping core.
+    pub fn validate(&self, scope: &str) -> Result<(), String> {
+        if self.nofile == Some(0) || self.stack == Some(0) {
+            return Err(format!(
+                "The nofile and stack ulimits of {scope} must be positive"
+            ));
+        }
+        Ok(())
+    }
+}
+
+impl EmbeddedRuntimeConfig {
+    fn validate(&self, language: &str) -> Result<(), String> {
+        if self.extension.is_empty() || !self.extension.chars().all(|c| c.is_ascii_alphanumeric()) {
+            return Err(format!(
+                "Invalid file extension '{}' for embedded runtime '{language}'",
+                self.extension
+            ));
+        }
+        if self.run.first().map_or(true, |program| program.is_empty()) {
+            return Err(format!("Embedded runtime '{language}' needs a run command"));
+        }
+        if self
+            .compile
+            .as_ref()
+            .is_some_and(|compile| compile.is_empty())
+        {
+            return Err(format!(
+                "Empty compile command for embedded runtime '{language}'"
+            ));
+        }
+        if self.check.as_ref().is_some_and(|check| check.is_empty()) {
+            return Err(format!(
+                "Empty check command for embedded runtime '{language}'"
+            ));
+        }
+        let args = self
+            .compile
+            .iter()
+            .chain(self.check.iter())
+            .flatten()
+            .chain(self.run.iter());
+        for arg in args {
+            if let Some(placeholder) = unknown_placeholder(arg) {
+                return Err(format!(
+                    "Unknown placeholder '{placeholder}' in command for embedded runtime '{language}', expected one of {}",
+                    COMMAND_PLACEHOLDERS.join(", ")
+                ));
+            }
+        }
+        if let Some(limits) = &self.limits {
+            limits.validate(language)?;
+        }
+        Ok(())
+    }
+}
+
+impl LanguageOverride {
+    /// Whether the entry defines a new language rather than adjusting a built-in one
+    pub fn is_definition(&self) -> bool {
+        self.extension.is_some()
+    }
+
+    /// `docker run --security-opt` values for the language's AppArmor profile and
+    /// SELinux label
+    pub fn security_options(&self) -> Vec<String> {
+        let apparmor = self
+            .apparmor_profile
+            .iter()
+            .map(|profile| format!("apparmor={profile}"));
+        let label = self
+            .selinux_label
+            .iter()
+            .flat_map(SelinuxLabel::parts)
+            .map(|(part, value)| format!("label={part}:{value}"));
+        apparmor.chain(label).collect()
+    }
+
+    /// Granted capabilities as Docker names them, e.g. `SYS_PTRACE` for
+    /// `cap_sys_ptrace`, sorted and without duplicates
+    pub fn capabilities(&self) -> Vec<String> {
+        let mut capabilities: Vec<String> = self
+            .capabilities
+            .iter()
+            .map(|capability| {
+                let capability = capability.to_ascii_uppercase();
+                capability
+                    .strip_prefix("CAP_")
+                    .map(str::to_string)
+                    .unwrap_or(capability)
+            })
+            .collect();
+        capabilities.sort();
+        capabilities.dedup();
+        capabilities
+    }
+
+    fn validate(&self, language: &str) -> Result<(), String> {
+        if let Some(extension) = &self.extension {
+            if extension.is_empty() || !extension.chars().all(|c| c.is_ascii_alphanumeric()) {
+                return Err(format!(
+                    "Invalid file extension '{extension}' for language '{language}'"
+                ));
+            }
+            if self.image.is_none() || self.run.is_none() {
+                return Err(format!(
+                    "Language '{language}' needs an image and a run command"
+                ));
+            }
+        }
+        if self.run.as_ref().is_some_and(|run| run.is_empty()) {
+            return Err(format!("Empty run command for language '{language}'"));
+        }
+        if self
+            .compile
+            .as_ref()
+            .is_some_and(|compile| compile.is_empty())
+        {
+            return Err(format!("Empty compile command for language '{language}'"));
+        }
+        if self.check.as_ref().is_some_and(|check| check.is_empty()) {
+            return Err(format!("Empty check command for language '{language}'"));
+        }
+        let args = self
+            .compile
+            .iter()
+            .chain(self.check.iter())
+            .chain(self.run.iter())
+            .flatten();
+        for arg in args {
+            if let Some(placeholder) = unknown_placeholder(arg) {
+                return Err(format!(
+                    "Unknown placeholder '{placeholder}' in command for language '{language}', expected one of {}",
+                    COMMAND_PLACEHOLDERS.join(", ")
+                ));
+            }
+        }
+        if let Some(limits) = &self.limits {
+            limits.validate(language)?;
+        }
+        if let Some(ulimits) = &self.ulimits {
+            ulimits.validate(&format!("language '{language}'"))?;
+        }
+        let invalid = |value: &str| value.is_empty() || value.contains(char::is_whitespace);
+        if let Some(profile) = self.apparmor_profile.as_deref().filter(|p| invalid(p)) {
+            return Err(format!(
+                "Invalid AppArmor profile '{profile}' for language '{language}'"
+            ));
+        }
+        if let Some(label) = &self.selinux_label {
+            if label.parts().is_empty() {
+                return Err(format!(
+                    "The SELinux label of language '{language}' needs a user, role, type or level"
+                ));
+            }
+            if let Some((part, value)) = label.parts().into_iter().find(|(_, v)| invalid(v)) {
+                return Err(format!(
+                    "Invalid SELinux {part} '{value}' for language '{language}'"
+                ));
+            }
+        }
+        if let Some(filesystem) = &self.filesystem {
+            filesystem.validate(&format!("language '{language}'"))?;
+        }
+        if self.max_concurrent == Some(0) {
+            return Err(format!(
+                "max_concurrent of language '{language}' must be at least 1"
+            ));
+        }
+        // `ALL` isn't in the list, so capabilities can only be granted one by one
+        if let Some(capability) = self
+            .capabilities()
+            .into_iter()
+            .find(|c| !CAPABILITIES.contains(&c.as_str()))
+        {
+            return Err(format!(
+                "Unknown capability '{capability}' for language '{language}', grant capabilities one by one"
+            ));
+        }
+        if let Some(next) = &self.next {
+            if next.image.is_empty() {
+                return Err(format!(
+                    "The next channel of language '{language}' needs an image"
+                ));
+            }
+            if !(0.0..=100.0).contains(&next.percent) {
+                return Err(format!(
+                    "The next channel of language '{language}' has percent {}, expected 0 to 100",
+                    next.percent
+                ));
+            }
+        }
+        Ok(())
+    }
+}
+
+// Returns the first `{...}` in a template argument that isn't a known placeholder,
+// including an unterminated one
+fn unknown_placeholder(arg: &str) -> Option<&str> {
+    let mut rest = arg;
+    while let Some(start) = rest.find('{') {
+        let placeholder = match rest[start..].find('}') {
+            Some(end) => &rest[start..=start + end],
+            None => return Some(&rest[start..]),
+        };
+        if !COMMAND_PLACEHOLDERS.contains(&placeholder) {
+            return Some(placeholder);
+        }
+        rest = &rest[start + placeholder.len()..];
+    }
+    None
+}
+
+/// Per-tenant credentials and policy
+#[derive(Debug, Clone, Default, Deserialize)]
+pub struct TenantConfig {
+    /// API keys that authenticate as this tenant
+    #[serde(default)]
+    pub api_keys: Vec<String>,
+    /// Command prefixes the tenant may use to replace a language's run command,
+    /// e.g. `"python -m"` allows `["python", "-m", "mypackage"]`
+    #[serde(default)]
+    pub allowed_commands: Vec<String>,
+    /// GPU seconds the tenant may use per UTC day; unlimited when unset
+    pub gpu_seconds_per_day: Option<u64>,
+    /// Seconds the tenant's executions are kept, overriding `EXECUTION_RETENTION_SECONDS`;
+    /// 0 keeps them until purged
+    pub retention_seconds: Option<u64>,
+    /// Admins can read every tenant's execution history and search it by code
+    #[serde(default)]
+    pub admin: bool,
+    /// Endpoints that receive the tenant's execution events
+    #[serde(default)]
+    pub webhooks: Vec<WebhookConfig>,
+    /// Request limits replacing the top-level `rate_limits` for this tenant
+    pub rate_limits: Option<RateLimitConfig>,
+    /// Seccomp preset for the tenant's sandboxes, in place of its languages' presets
+    pub syscall_policy: Option<SyscallPolicy>,
+    /// Share of the job consumers the tenant gets while other tenants also have
+    /// jobs queued, relative to their weights; 1 when unset
+    pub queue_weight: Option<u32>,
+    /// Session limits replacing the server-wide defaults for this tenant
+    pub sessions: Option<SessionLimits>,
+}
+
+/// Limits on a tenant's sessions. Unset fields keep the server-wide defaults.
+#[derive(Debug, Clone, Copy, Default, Deserialize)]
+pub struct SessionLimits {
+    /// Open sessions; creating one more evicts the least recently used. 0 is
+    /// unlimited.
+    pub max_sessions: Option<usize>,
+    /// Seconds a session lives after its last exec call
+    pub idle_seconds: Option<u64>,
+    /// Seconds a session lives at most, however busy; 0 is unlimited
+    pub max_lifetime_seconds: Option<u64>,
+}
+
+/// Operator endpoints that receive the security alerts of every tenant. Tenant
+/// webhooks only receive their own alerts when they list `security_alert`.
+#[derive(Debug, Clone, Default, Deserialize)]
+pub struct SecurityAlertsConfig {
+    #[serde(default)]
+    pub webhooks: Vec<WebhookConfig>,
+}
+
+/// Executions matching a pattern of abuse are always flagged for review. Tenants
+/// are only restricted when an `action` is set.
+#[derive(Debug, Clone, Deserialize)]
+pub struct AbuseConfig {
+    /// Restriction put on a tenant once it has `strikes` flags pending review
+    pub action: Option<Restriction>,
+    #[serde(default = "default_abuse_strikes")]
+    pub strikes: u32,
+    /// Request limit of throttled tenants
+    #[serde(default = "default_abuse_throttle")]
+    pub throttle: RateLimit,
+    /// Seconds a run must spin at its CPU limit without output to be flagged
+    #[serde(default = "default_sustained_cpu_seconds")]
+    pub sustained_cpu_seconds: f64,
+    /// Tenants that are flagged but never restricted
+    #[serde(default)]
+    pub exempt_tenants: Vec<String>,
+}
+
+impl Default for AbuseConfig {
+    fn default() -> Self {
+        Self {
+            action: None,
+            strikes: default_abuse_strikes(),
+            throttle: default_abuse_throttle(),
+            sustained_cpu_seconds: default_sustained_cpu_seconds(),
+            exempt_tenants: Vec::new(),
+        }
+    }
+}
+
+fn default_abuse_strikes() -> u32 {
+    3
+}
+
+fn default_abuse_throttle() -> RateLimit {
+    RateLimit {
+        rate: 0.1,
+        burst: 1,
+    }
+}
+
+fn default_sustained_cpu_seconds() -> f64 {
+    5.0
+}
+
+/// Log stores every execution event is written to as a log entry, including
+/// security alerts. Entries wait in a buffer of their own for each store while
+/// it's slow or down.
+#[derive(Debug, Clone, Deserialize)]
+pub struct LogExportConfig {
+    pub loki: Option<LokiConfig>,
+    pub elasticsearch: Option<ElasticsearchConfig>,
+    /// Entries each store's buffer holds; once full, the oldest are dropped
+    #[serde(default = "default_log_export_buffer")]
+    pub buffer: usize,
+    /// Entries sent in one request at most
+    #[serde(default = "default_log_export_batch_size")]
+    pub batch_size: usize,
+    /// Milliseconds an entry waits for a batch to fill before it's sent anyway
+    #[serde(default = "default_log_export_flush_ms")]
+    pub flush_interval_ms: u64,
+}
+
+impl Default for LogExportConfig {
+    fn default() -> Self {
+        Self {
+            loki: None,
+            elasticsearch: None,
+            buffer: default_log_export_buffer(),
+            batch_size: default_log_export_batch_size(),
+            flush_interval_ms: default_log_export_flush_ms(),
+        }
+    }
+}
+
+fn default_log_export_buffer() -> usize {
+    10_000
+}
+
+fn default_log_export_batch_size() -> usize {
+    500
+}
+
+fn default_log_export_flush_ms() -> u64 {
+    1000
+}
+
+impl LogExportConfig {
+    fn validate(&self) -> Result<(), String> {
+        let urls = self.loki.iter().map(|loki| ("Loki", &loki.url)).chain(
+            self.elasticsearch
+                .iter()
+                .map(|es| ("Elasticsearch", &es.url)),
+        );
+        for (store, url) in urls {
+            if !url.starts_with("https://") && !url.starts_with("http://") {
+                return Err(format!("{store} URL '{url}' must be http(s)"));
+            }
+        }
+        if self.buffer == 0 || self.batch_size == 0 || self.flush_interval_ms == 0 {
+            return Err(
+                "log_export needs a positive buffer, batch_size and flush_interval_ms".to_string(),
+            );
+        }
+        // A batch never fills otherwise, so entries would only go out on the interval
+        if self.buffer < self.batch_size {
+            return Err(format!(
+                "log_export buffer ({}) must hold at least a batch ({})",
+                self.buffer, self.batch_size
+            ));
+        }
+        Ok(())
+    }
+}
+
+/// A Loki server entries are pushed to. Each entry is labeled with `job="isobox"`,
+/// its `event`, `tenant` and `language`, and the configured labels.
+#[derive(Debug, Clone, Deserialize)]
+pub struct LokiConfig {
+    /// Base URL, e.g. `http://loki:3100`
+    pub url: String,
+    #[serde(default)]
+    pub labels: HashMap<String, String>,
+    /// Headers sent with each push, e.g. `X-Scope-OrgID` or `Authorization`
+    #[serde(default)]
+    pub headers: HashMap<String, String>,
+}
+
+/// An Elasticsearch cluster entries are indexed in with the bulk API
+#[derive(Debug, Clone, Deserialize)]
+pub struct ElasticsearchConfig {
+    /// Base URL, e.g. `https://es.example.com:9200`
+    pub url: String,
+    /// Index or data stream written to
+    #[serde(default = "default_elasticsearch_index")]
+    pub index: String,
+    /// Headers sent with each request, e.g. `Authorization: ApiKey ...`
+    #[serde(default)]
+    pub headers: HashMap<String, String>,
+}
+
+fn default_elasticsearch_index() -> String {
+    "isobox-events".to_string()
+}
+
+/// A webhook endpoint. Deliveries are signed with the endpoint's own secret.
+#[derive(Debug, Clone, Deserialize)]
+pub struct WebhookConfig {
+    pub url: String,
+    pub secret: String,
+    /// Events delivered to the endpoint; empty means every event but security
+    /// alerts
+    #[serde(default)]
+    pub events: Vec<EventKind>,
+}
+
+impl WebhookConfig {
+    fn validate(&self, owner: &str) -> Result<(), String> {
+        if !self.url.starts_with("https://") && !self.url.starts_with("http://") {
+            return Err(format!(
+                "Webhook URL '{}' for {owner} must be http(s)",
+                self.url
+            ));
+        }
+        if self.secret.is_empty() {
+            return Err(format!("Webhook '{}' for {owner} has no secret", self.url));
+        }
+        Ok(())
+    }
+
+    /// Whether the endpoint subscribed to the event
+    pub fn wants(&self, event: EventKind) -> bool {
+        if self.events.is_empty() {
+            return event != EventKind::SecurityAlert;
+        }
+        self.events.contains(&event)
+    }
+}
+
+/// A dependency cache shared read-write by all executions of a tenant
+#[derive(Debug, Clone, Deserialize)]
+pub struct CacheMount {
+    /// Where the cache is mounted inside the container, e.g. `/root/.cache/pip`
+    pub path: String,
+    /// Languages the cache is mounted for; empty means every language
+    #[serde(default)]
+    pub languages: Vec<String>,
+    /// Serialize executions that share the cache. Can be turned off for tools that
+    /// do their own locking, such as the Go module cache.
+    #[serde(default = "default_cache_lock")]
+    pub lock: bool,
+}
+
+fn default_cache_lock() -> bool {
+    true
+}
+
+impl CacheMount {
+    pub fn applies_to(&self, language: &str) -> bool {
+        self.languages.is_empty() || self.languages.iter().any(|l| l == language)
+    }
+}
+
+/// Dependencies installed from a lockfile into a directory shared read-only by every
+/// execution with the same lockfile
+#[derive(Debug, Clone, Deserialize)]
+pub struct DependencyConfig {
+    /// Workspace file listing the dependencies, e.g. `requirements.txt`
+    pub lockfile: String,
+    /// Command installing them into `path`, run in the language's image with the
+    /// lockfile in its working directory
+    pub install: Vec<String>,
+    /// Where the installed dependencies are mounted, e.g. `/deps`
+    pub path: String,
+    /// Environment variables that let programs find them, e.g. `PYTHONPATH`
+    #[serde(default)]
+    pub env: HashMap<String, String>,
+}
+
+impl DependencyConfig {
+    fn validate(&self, language: &str) -> Result<(), String> {
+        if !is_valid_name(&self.lockfile) {
+            return Err(format!(
+                "The lockfile of {language} dependencies must be a file name, not '{}'",
+                self.lockfile
+            ));
+        }
+        if self.install.is_empty() {
+            return Err(format!("{language} dependencies have no install command"));
+        }
+        if !self.path.starts_with('/') || self.path == "/" || self.path.contains([',', ':']) {
+            return Err(format!(
+                "{language} dependencies must be mounted at an absolute path other than /"
+            ));
+        }
+        if let Some(name) = self
+            .env
+            .keys()
+            .find(|name| name.is_empty() || name.contains('='))
+        {
+            return Err(format!(
+                "Invalid environment variable '{name}' for {language} dependencies"
+            ));
+        }
+        Ok(())
+    }
+}
+
+/// Request labels counted in the execution metrics. Only `key:value` labels with one
+/// of the keys are, and each key keeps at most `max_values` distinct values, so the
+/// metrics stay small however many labels requests send.
+#[derive(Debug, Clone, Deserialize)]
+pub struct MetricLabelsConfig {
+    #[serde(default)]
+    pub keys: Vec<String>,
+    #[serde(default = "default_max_label_values")]
+    pub max_values: usize,
+}
+
+impl Default for MetricLabelsConfig {
+    fn default() -> Self {
+        Self {
+            keys: Vec::new(),
+            max_values: default_max_label_values(),
+        }
+    }
+}
+
+fn default_max_label_values() -> usize {
+    20
+}
+
+/// Prices of the resources an execution reserves, in a unit the operator picks,
+/// e.g. credits or cents
+#[derive(Debug, Clone, Deserialize)]
+pub struct MeteringConfig {
+    #[serde(default = "default_billing_unit")]
+    pub unit: String,
+    #[serde(default)]
+    pub per_execution: f64,
+    /// Per second of CPU time
+    #[serde(default)]
+    pub per_cpu_second: f64,
+    /// Per gigabyte of memory held for a second of wall time
+    #[serde(default)]
+    pub per_gb_second: f64,
+    /// Per second of wall time with the GPUs attached
+    #[serde(default)]
+    pub per_gpu_second: f64,
+}
+
+fn default_billing_unit() -> String {
+    "credits".to_string()
+}
+
+impl MeteringConfig {
+    fn validate(&self) -> Result<(), String> {
+        let prices = [
+            self.per_execution,
+            self.per_cpu_second,
+            self.per_gb_second,
+            self.per_gpu_second,
+        ];
+        if prices
+            .iter()
+            .any(|price| !price.is_finite() || *price < 0.0)
+        {
+            return Err("Metering prices must be non-negative numbers".to_string());
+        }
+        Ok(())
+    }
+}
+
+/// Package indexes that dependency installs and sandboxes with network access use
+/// instead of the public ones, e.g. Artifactory, Verdaccio or Athens
+#[derive(Debug, Clone, Default, Deserialize)]
+pub struct PackageMirrorConfig {
+    /// PyPI simple index, e.g. `https://artifactory.example.com/api/pypi/pypi/simple`
+    pub pip: Option<String>,
+    /// npm registry, e.g. `https://verdaccio.example.com`
+    pub npm: Option<String>,
+    /// Go module proxy, e.g. `https://athens.example.com`
+    pub go: Option<String>,
+    /// URL sandboxes reach this server at, e.g. `http://172.17.0.1:8000`. When set,
+    /// the server mirrors the indexes at `/mirror/{ecosystem}/`, caching what it
+    /// fetches, and installs go through it.
+    pub embedded_url: Option<String>,
+    /// Addresses or CIDR ranges allowed to use the embedded mirror. Empty means
+    /// loopback and private networks, where sandboxes on this host connect from.
+    #[serde(default)]
+    pub clients: Vec<String>,
+}
+
+/// Package ecosystems that can be mirrored, with their public index and the
+/// variable that points their package manager elsewhere
+pub const PACKAGE_ECOSYSTEMS: [(&str, &str, &str); 3] = [
+    ("pip", "https://pypi.org/simple", "PIP_INDEX_URL"),
+    ("npm", "https://registry.npmjs.org", "npm_config_registry"),
+    ("go", "https://proxy.golang.org", "GOPROXY"),
+];
+
+impl PackageMirrorConfig {
+    fn configured(&self, ecosystem: &str) -> Option<&String> {
+        match ecosystem {
+            "pip" => self.pip.as_ref(),
+            "npm" => self.npm.as_ref(),
+            "go" => self.go.as_ref(),
+            _ => None,
+        }
+    }
+
+    /// The index the embedded mirror fetches each ecosystem from: the configured
+    /// one, or the public one
+    pub fn upstreams(&self) -> Vec<(&'static str, String)> {
+        PACKAGE_ECOSYSTEMS
+            .iter()
+            .map(|(ecosystem, public, _)| {
+                let url = self.configured(ecosystem).map_or(*public, String::as_str);
+                (*ecosystem, url.trim_end_matches('/').to_string())
+            })
+            .collect()
+    }
+
+    /// Environment variables pointing package managers at the mirrors
+    pub fn env(&self) -> Vec<(String, String)> {
+        let mut env = Vec::new();
+        for (ecosystem, _, variable) in PACKAGE_ECOSYSTEMS {
+            let url = match &self.embedded_url {
+                Some(embedded) => format!("{}/mirror/{ecosystem}", embedded.trim_end_matches('/')),
+                None => match self.configured(ecosystem) {
+                    Some(url) => url.trim_end_matches('/').to_string(),
+                    None => continue,
+                },
+            };
+            // pip refuses plain HTTP indexes it isn't told to trust
+            if ecosystem == "pip" {
+                if let Some(host) = url.strip_prefix("http://") {
+                    let host = host.split(['/', ':']).next().unwrap_or(host);
+                    env.push(("PIP_TRUSTED_HOST".to_string(), host.to_string()));
+                }
+            }
+            // Go joins paths onto GOPROXY itself; pip and npm expect a directory
+            let url = if ecosystem == "go" {
+                url
+            } else {
+                format!("{url}/")
+            };
+            env.push((variable.to_string(), url));
+        }
+        env
+    }
+
+    fn validate(&self) -> Result<(), String> {
+        for url in [&self.pip, &self.npm, &self.go, &self.embedded_url]
+            .into_iter()
+            .flatten()
+        {
+            if !url.starts_with("https://") && !url.starts_with("http://") {
+                return Err(format!("Package mirror URL '{url}' must be http(s)"));
+            }
+        }
+        for client in &self.clients {
+            IpRange::parse(client)?;
+        }
+        Ok(())
+    }
+}
+
+/// A named dataset requests can mount read-only
+#[derive(Debug, Clone, Deserialize)]
+pub struct DatasetConfig {
+    /// Absolute host directory, or an object-store prefix (`s3://...`, `gs://...`)
+    /// that is downloaded once at startup
+    pub source: String,
+    /// Tenants allowed to mount the dataset; empty means every tenant
+    #[serde(default)]
+    pub tenants: Vec<String>,
+}
+
+impl DatasetConfig {
+    pub fn is_remote(&self) -> bool {
+        self.source.starts_with("s3://") || self.source.starts_with("gs://")
+    }
+
+    pub fn allows_tenant(&self, tenant: &str) -> bool {
+        self.tenants.is_empty() || self.tenants.iter().any(|t| t == tenant)
+    }
+}
+
+impl TenantConfig {
+    pub fn allows_command(&self, command: &[String]) -> bool {
+        self.allowed_commands.iter().any(|allowed| {
+            let prefix: Vec<&str> = allowed.split_whitespace().collect();
+            !prefix.is_empty()
+                && prefix.len() <= command.len()
+                && prefix.iter().zip(command).all(|(p, c)| *p == c.as_str())
+        })
+    }
+}
+
+// Versioned endpoints are served both at `/v1/...` and `/api/v1/...`
+fn unprefixed_route(route: &str) -> &str {
+    route
+        .strip_prefix("/api")
+        .filter(|rest| rest.starts_with("/v"))
+        .unwrap_or(route)
+}
+
+impl IsoboxConfig {
+    pub fn tenant(&self, name: &str) -> Option<&TenantConfig> {
+        self.tenants.get(name)
+    }
+
+    /// Queue weights of the tenants that set one
+    pub fn session_limits(&self) -> HashMap<String, SessionLimits> {
+        self.tenants
+            .iter()
+            .filter_map(|(name, tenant)| Some((name.clone(), tenant.sessions?)))
+            .collect()
+    }
+
+    pub fn queue_weights(&self) -> HashMap<String, u32> {
+        self.tenants
+            .iter()
+            .filter_map(|(name, tenant)| Some((name.clone(), tenant.queue_weight?)))
+            .collect()
+    }
+
+    /// Seccomp preset for a sandbox: the tenant's if it has one, then the
+    /// language's, then the top-level `syscall_policy`
+    pub fn syscall_policy(&self, language: &str, tenant: &str) -> SyscallPolicy {
+        self.tenant(tenant)
+            .and_then(|policy| policy.syscall_policy)
+            .or_else(|| {
+                self.languages
+                    .get(language)
+                    .and_then(|language| language.syscall_policy)
+            })
+            .unwrap_or(self.syscall_policy)
+    }
+
+    /// Root filesystem of a language's sandboxes
+    pub fn filesystem(&self, language: &str) -> &FilesystemConfig {
+        self.languages
+            .get(language)
+            .and_then(|language| language.filesystem.as_ref())
+            .unwrap_or(&self.filesystem)
+    }
+
+    /// Caches mounted for a language, sorted by name
+    pub fn caches_for(&self, language: &str) -> Vec<(&str, &CacheMount)> {
+        let mut caches: Vec<(&str, &CacheMount)> = self
+            .caches
+            .iter()
+            .filter(|(_, cache)| cache.applies_to(language))
+            .map(|(name, cache)| (name.as_str(), cache))
+            .collect();
+        caches.sort_by_key(|(name, _)| *name);
+        caches
+    }
+
+    /// Limit for a tenant's requests to a route, with the scope of the bucket it
+    /// draws from: the route when it has an override, otherwise `*`
+    pub fn rate_limit(&self, tenant: &str, route: &str) -> Option<(&str, RateLimit)> {
+        let limits = self
+            .tenant(tenant)
+            .and_then(|policy| policy.rate_limits.as_ref())
+            .unwrap_or(&self.rate_limits);
+        let route = unprefixed_route(route);
+        match limits
+            .endpoints
+            .iter()
+            .find(|(key, _)| unprefixed_route(key) == route)
+        {
+            Some((route, limit)) => Some((route.as_str(), *limit)),
+            None => limits.default.map(|limit| ("*", limit)),
+        }
+    }
+
+    pub fn tenant_for_api_key(&self, api_key: &str) -> Option<&str> {
+        self.tenants
+            .iter()
+            .find(|(_, tenant)| tenant.api_keys.iter().any(|key| key == api_key))
+            .map(|(name, _)| name.as_str())
+    }
+
+    pub fn load() -> Result<Self, ConfigError> {
+        match std::env::var("ISOBOX_CONFIG") {
+            Ok(path) if !path.is_empty() => Self::from_file(&path),
+            _ => Ok(Self::default()),
+        }
+    }
+
+    pub fn from_file(path: &str) -> Result<Self, ConfigError> {
+        let contents = fs::read_to_string(path)
+            .map_err(|e| ConfigError::Read(path.to_string(), e.to_string()))?;
+        let mut config = Self::from_json(&contents)
+            .map_err(|e| ConfigError::Parse(path.to_string(), e.to_string()))?;
+        config.load_harness_templates()?;
+        config.validate()?;
+        Ok(config)
+    }
+
+    pub fn from_json(contents: &str) -> Result<Self, serde_json::Error> {
+        serde_json::from_str(contents)
+    }
+
+    fn load_harness_templates(&mut self) -> Result<(), ConfigError> {
+        for harness in self.harnesses.values_mut() {
+            if harness.template.is_some() {
+                continue;
+            }
+            if let Some(path) = &harness.template_file {
+                let template = fs::read_to_string(path)
+                    .map_err(|e| ConfigError::Read(path.clone(), e.to_string()))?;
+                harness.template = Some(template);
+            }
+        }
+        Ok(())
+    }
+
+    fn validate(&self) -> Result<(), ConfigError> {
+        self.filesystem
+            .validate("the top-level filesystem")
+            .map_err(ConfigError::InvalidValue)?;
+        for (language, overrides) in &self.languages {
+            overrides
+                .validate(language)
+                .map_err(ConfigError::InvalidValue)?;
+            let images = overrides
+                .image
+                .iter()
+                .chain(overrides.versions.values())
+                .chain(overrides.next.iter().map(|next| &next.image));
+            for image in images {
+                if image.trim().is_empty() {
+                    return Err(ConfigError::InvalidValue(format!(
+                        "Empty image reference for language '{language}'"
+                    )));
+                }
+                if let Some(digest) = pinned_digest(image) {
+                    if !is_valid_digest(digest) {
+                        return Err(ConfigError::InvalidValue(format!(
+                            "Malformed digest '{digest}' for language '{language}'"
+                        )));
+                    }
+                }
+            }
+        }
+        for (language, runtime) in &self.embedded_runtimes {
+            runtime
+                .validate(language)
+                .map_err(ConfigError::InvalidValue)?;
+        }
+        for (tenant, policy) in &self.tenants {
+            if policy
+                .sessions
+                .is_some_and(|sessions| sessions.idle_seconds == Some(0))
+            {
+                return Err(ConfigError::InvalidValue(format!(
+                    "Sessions of tenant '{tenant}' need a positive idle_seconds"
+                )));
+            }
+            for webhook in &policy.webhooks {
+                webhook
+                    .validate(&format!("tenant '{tenant}'"))
+                    .map_err(ConfigError::InvalidValue)?;
+            }
+        }
+        if self.abuse.strikes == 0 {
+            return Err(ConfigError::InvalidValue(
+                "abuse.strikes must be at least 1".to_string(),
+            ));
+        }
+        if self.abuse.throttle.rate <= 0.0 || self.abuse.throttle.burst == 0 {
+            return Err(ConfigError::InvalidValue(
+                "abuse.throttle needs a positive rate and burst".to_string(),
+            ));
+        }
+        for webhook in &self.security_alerts.webhooks {
+            webhook
+                .validate("security alerts")
+                .map_err(ConfigError::InvalidValue)?;
+        }
+        self.log_export
+            .validate()
+            .map_err(ConfigError::InvalidValue)?;
+        for (name, harness) in &self.harnesses {
+            if harness.template.is_some() == harness.template_file.is_some() {
+                return Err(ConfigError::InvalidValue(format!(
+                    "Harness '{name}' needs either a template or a template_file"
+                )));
+            }
+            harness.validate(name).map_err(ConfigError::InvalidValue)?;
+        }
+        for (name, preset) in &self.presets {
+            preset.validate(name).map_err(ConfigError::InvalidValue)?;
+        }
+        for (language, dependencies) in &self.dependencies {
+            dependencies
+                .validate(language)
+                .map_err(ConfigError::InvalidValue)?;
+        }
+        self.package_mirrors
+            .validate()
+            .map_err(ConfigError::InvalidValue)?;
+        if let Some(metering) = &self.metering {
+            metering.validate().map_err(ConfigError::InvalidValue)?;
+        }
+        for key in &self.metric_labels.keys {
+            labels::validate_key(key).map_err(ConfigError::InvalidValue)?;
+        }
+        for hook in &self.hooks {
+            if !hook.url.starts_with("https://") && !hook.url.starts_with("http://") {
+                return Err(ConfigError::InvalidValue(format!(
+                    "Hook URL '{}' must be http(s)",
+                    hook.url
+                )));
+            }
+            if hook.timeout_ms == 0 {
+                return Err(ConfigError::InvalidValue(format!(
+                    "Hook '{}' needs a positive timeout_ms",
+                    hook.url
+                )));
+            }
+        }
+        let tenant_limits = self
+            .tenants
+            .values()
+            .filter_map(|policy| policy.rate_limits.as_ref());
+        let limits = std::iter::once(&self.rate_limits)
+            .chain(tenant_limits)
+            .flat_map(|limits| limits.default.iter().chain(limits.endpoints.values()))
+            .chain(self.client_limits.rate.iter());
+        for limit in limits {
+            if limit.rate <= 0.0 || limit.burst == 0 {
+                return Err(ConfigError::InvalidValue(format!(
+                    "Rate limit {limit:?} needs a positive rate and burst"
+                )));
+            }
+        }
+        if let Some(name) = self
+            .tenants
+            .iter()
+            .find_map(|(name, tenant)| (tenant.queue_weight == Some(0)).then_some(name))
+        {
+            return Err(ConfigError::InvalidValue(format!(
+                "Tenant '{name}' needs a queue_weight of at least 1"
+            )));
+        }
+        if self.client_limits.max_concurrent == Some(0) {
+            return Err(ConfigError::InvalidValue(
+                "client_limits.max_concurrent must be at least 1".to_string(),
+            ));
+        }
+        for proxy in &self.client_limits.trusted_proxies {
+            IpRange::parse(proxy).map_err(ConfigError::InvalidValue)?;
+        }
+        self.replicas
+            .validate()
+            .map_err(ConfigError::InvalidValue)?;
+        Redactor::from_config(&self.redaction).map_err(ConfigError::InvalidValue)?;
+        for (name, cache) in &self.caches {
+            if !is_valid_name(name) {
+                return Err(ConfigError::InvalidValue(format!(
+                    "Invalid cache name '{name}'"
+                )));
+            }
+            if !cache.path.starts_with('/') || cache.path == "/" {
+                return Err(ConfigError::InvalidValue(format!(
+                    "Cache '{name}' must be mounted at an absolute path other than /"
+                )));
+            }
+        }
+        for (name, dataset) in &self.datasets {
+            if !is_valid_name(name) {
+                return Err(ConfigError::InvalidValue(format!(
+                    "Invalid dataset name '{name}'"
+                )));
+            }
+            if !dataset.is_remote() && !dataset.source.starts_with('/') {
+                return Err(ConfigError::InvalidValue(format!(
+                    "Dataset '{name}' must be an absolute directory or an s3:// or gs:// prefix"
+                )));
+            }
+        }
+        Ok(())
+    }
+}
+
+// Names become host directory names, so they must be a single path component
+fn is_valid_name(name: &str) -> bool {
+    !name.is_empty() && !name.contains(['/', '\\']) && !name.starts_with('.')
+}
+
+/// Returns the digest part of an image reference pinned with `@sha256:...`
+pub fn pinned_digest(image: &str) -> Option<&str> {
+    image.split_once('@').map(|(_, digest)| digest)
+}
+
+fn is_valid_digest(digest: &str) -> bool {
+    match digest.strip_prefix("sha256:") {
+        Some(hex) => hex.len() == 64 && hex.chars().all(|c| c.is_ascii_hexdigit()),
+        None => false,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const DIGEST: &str = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef";
+
+    #[test]
+    fn test_empty_config_uses_defaults() {
+        let config = IsoboxConfig::from_json("{}").unwrap();
+        assert!(config.languages.is_empty());
+    }
+
+    #[test]
+    fn test_language_overrides() {
+        let json = format!(
+            r#"{{"languages": {{"python": {{"image": "python:3.11@{DIGEST}", "versions": {{"3.12": "python:3.12"}}}}}}}}"#
+        );
+        let config = IsoboxConfig::from_json(&json).unwrap();
+        let python = &config.languages["python"];
+        assert_eq!(
+            python.image.as_deref(),
+            Some(format!("python:3.11@{DIGEST}").as_str())
+        );
+        assert_eq!(python.versions["3.12"], "python:3.12");
+        assert!(config.validate().is_ok());
+    }
+
+    #[test]
+    fn test_language_definitions() {
+        let config = IsoboxConfig::from_json(
+            r#"{"languages": {"zig": {
+                "image": "ziglang/zig:0.13",
+                "extension": "zig",
+                "compile": ["zig", "build-exe", "{work_dir}/{file}", "-femit-bin={work_dir}/{stem}"],
+                "run": ["{work_dir}/{stem}"],
+                "limits": {"memory_mb": 512}
+            }}}"#,
+        )
+        .unwrap();
+        assert!(config.languages["zig"].is_definition());
+        assert!(config.validate().is_ok());
+
+        let invalid = [
+            // A new language needs an image and a run command
+            r#"{"languages": {"zig": {"extension": "zig", "run": ["./main"]}}}"#,
+            r#"{"languages": {"zig": {"image": "zig", "extension": "zig"}}}"#,
+            r#"{"languages": {"zig": {"image": "zig", "extension": "../zig", "run": ["./main"]}}}"#,
+            r#"{"languages": {"python": {"run": []}}}"#,
+            r#"{"languages": {"python": {"run": ["python", "{source}"]}}}"#,
+            r#"{"languages": {"python": {"compile": ["python", "-m", "py_compile", "{file"]}}}"#,
+            r#"{"languages": {"python": {"limits": {"cpu_time_seconds": 0}}}}"#,
+            r#"{"languages": {"python": {"next": {"image": ""}}}}"#,
+            r#"{"languages": {"python": {"next": {"image": "python:3.13-rc", "percent": 150}}}}"#,
+        ];
+        for json in invalid {
+            let config = IsoboxConfig::from_json(json).unwrap();
+            assert!(config.validate().is_err(), "{json}");
+        }
+    }
+
+    #[test]
+    fn test_embedded_runtimes() {
+        let config = IsoboxConfig::from_json(
+            r#"{"embedded_runtimes": {
+                "python": {"extension": "py", "run": ["/opt/isobox/python/bin/python3", "-I", "{file}"]},
+                "wasm": {"extension": "wat", "run": ["wasmtime", "run", "{file}"], "limits": {"memory_mb": 8192}}
+            }}"#,
+        )
+        .unwrap();
+        assert_eq!(config.embedded_runtimes["wasm"].run[0], "wasmtime");
+        assert!(config.validate().is_ok());
+
+        let invalid = [
+            r#"{"embedded_runtimes": {"python": {"extension": "py", "run": []}}}"#,
+            r#"{"embedded_runtimes": {"python": {"extension": "", "run": ["python3"]}}}"#,
+            r#"{"embedded_runtimes": {"python": {"extension": "py", "run": ["python3", "{source}"]}}}"#,
+            r#"{"embedded_runtimes": {"python": {"extension": "py", "run": ["python3"], "limits": {"memory_mb": 0}}}}"#,
+        ];
+        for json in invalid {
+            let config = IsoboxConfig::from_json(json).unwrap();
+            assert!(config.validate().is_err(), "{json}");
+        }
+    }
+
+    #[test]
+    fn test_webhooks_require_http_url_and_secret() {
+        let config = |webhook: &str| {
+            IsoboxConfig::from_json(&format!(
+                r#"{{"tenants": {{"cs101": {{"webhooks": [{webhook}]}}}}}}"#
+            ))
+            .unwrap()
+        };
+        assert!(
+            config(r#"{"url": "https://example.com/hook", "secret": "s"}"#)
+                .validate()
+                .is_ok()
+        );
+        assert!(
+            config(r#"{"url": "ftp://example.com/hook", "secret": "s"}"#)
+                .validate()
+                .is_err()
+        );
+        assert!(
+            config(r#"{"url": "https://example.com/hook", "secret": ""}"#)
+                .validate()
+                .is_err()
+        );
+        let security_alerts = IsoboxConfig::from_json(
+            r#"{"security_alerts": {"webhooks": [{"url": "soc.example.com", "secret": "s"}]}}"#,
+        )
+        .unwrap();
+        assert!(security_alerts.validate().is_err());
+    }
+
+    #[test]
+    fn test_log_export() {
+        let config = IsoboxConfig::from_json(
+            r#"{"log_export": {"loki": {"url": "http://loki:3100", "labels": {"env": "prod"}}}}"#,
+        )
+        .unwrap();
+        assert!(config.validate().is_ok());
+        assert_eq!(config.log_export.batch_size, 500);
+        assert!(config.log_export.elasticsearch.is_none());
+
+        let config = IsoboxConfig::from_json(
+            r#"{"log_export": {"elasticsearch": {"url": "https://es:9200"}}}"#,
+        )
+        .unwrap();
+        assert_eq!(
+            config.log_export.elasticsearch.unwrap().index,
+            "isobox-events"
+        );
+
+        for invalid in [
+            r#"{"log_export": {"loki": {"url": "loki:3100"}}}"#,
+            r#"{"log_export": {"loki": {"url": "http://loki:3100"}, "buffer": 0}}"#,
+            r#"{"log_export": {"loki": {"url": "http://loki:3100"}, "batch_size": 0}}"#,
+            r#"{"log_export": {"loki": {"url": "http://loki:3100"}, "flush_interval_ms": 0}}"#,
+            r#"{"log_export": {"loki": {"url": "http://loki:3100"}, "buffer": 100}}"#,
+        ] {
+            let config = IsoboxConfig::from_json(invalid).unwrap();
+            assert!(config.validate().is_err(), "{invalid}");
+        }
+    }
+
+    #[test]
+    fn test_harnesses() {
+        let config = IsoboxConfig::from_json(
+            r#"{"harnesses": {"call-function": {
+                "language": "python",
+                "template": "import json, sys\n{{code}}\nprint(json.dumps({{ function }}(*json.load(sys.stdin))))\n",
+                "params": {"function": "solve"}
+            }}}"#,
+        )
+        .unwrap();
+        assert!(config.validate().is_ok());
+
+        let harness = &config.harnesses["call-function"];
+        let code = "def add(a, b):\n    return a + b  # {{function}}";
+        let params = HashMap::from([("function".to_string(), "add".to_string())]);
+        assert_eq!(
+            harness.render(code, &params).unwrap(),
+            "import json, sys\ndef add(a, b):\n    return a + b  # {{function}}\nprint(json.dumps(add(*json.load(sys.stdin))))\n"
+        );
+        // Defaults fill in parameters the request leaves out
+        assert!(harness
+            .render("", &HashMap::new())
+            .unwrap()
+            .contains("solve(*json.load"));
+        let unknown = HashMap::from([("other".to_string(), "x".to_string())]);
+        assert!(harness.render("", &unknown).is_err());
+
+        for json in [
+            r#"{"harnesses": {"h": {"language": "python", "template": "main()"}}}"#,
+            r#"{"harnesses": {"h": {"language": "python", "template": "{{code}} {{entry}}"}}}"#,
+            r#"{"harnesses": {"h": {"language": "python"}}}"#,
+        ] {
+            let config = IsoboxConfig::from_json(json).unwrap();
+            assert!(config.validate().is_err(), "{json}");
+        }
+
+        let required: HarnessConfig = serde_json::from_str(
+            r#"{"language": "python", "template": "{{code}}\n{{function}}()", "params": {"function": null}}"#,
+        )
+        .unwrap();
+        assert!(required.render("", &HashMap::new()).is_err());
+    }
+
+    #[test]
+    fn test_hooks() {
+        let config = IsoboxConfig::from_json(
+            r#"{"hooks": [
+                {"url": "https://policy.example.com/isobox", "phases": ["before"]},
+                {"url": "http://localhost:9000/annotate", "fail_open": true}
+            ]}"#,
+        )
+        .unwrap();
+        assert!(config.validate().is_ok());
+        assert!(config.hooks[0].applies_to(HookPhase::Before));
+        assert!(!config.hooks[0].applies_to(HookPhase::After));
+        assert!(config.hooks[1].applies_to(HookPhase::After));
+        assert_eq!(config.hooks[1].timeout_ms, 2000);
+
+        for json in [
+            r#"{"hooks": [{"url": "ftp://example.com"}]}"#,
+            r#"{"hooks": [{"url": "https://example.com", "timeout_ms": 0}]}"#,
+        ] {
+            let config = IsoboxConfig::from_json(json).unwrap();
+            assert!(config.validate().is_err(), "{json}");
+        }
+    }
+
+    #[test]
+    fn test_rate_limits() {
+        let config = IsoboxConfig::from_json(
+            r#"{
+                "rate_limits": {
+                    "default": {"rate": 1, "burst": 10},
+                    "endpoints": {"/api/v1/execute": {"rate": 0.5, "burst": 3}}
+                },
+                "tenants": {
+                    "cs101": {"rate_limits": {"default": {"rate": 5, "burst": 20}}},
+                    "cs102": {}
+                }
+            }"#,
+        )
+        .unwrap();
+        config.validate().unwrap();
+
+        let execute = RateLimit {
+            rate: 0.5,
+            burst: 3,
+        };
+        let default = RateLimit {
+            rate: 1.0,
+            burst: 10,
+        };
+        assert_eq!(
+            config.rate_limit("cs102", "/api/v1/execute"),
+            Some(("/api/v1/execute", execute))
+        );
+        assert_eq!(
+            config.rate_limit("cs102", "/v1/execute"),
+            Some(("/api/v1/execute", execute))
+        );
+        assert_eq!(
+            config.rate_limit("cs102", "/api/v1/jobs"),
+            Some(("*", default))
+        );
+        // A tenant's own limits replace the top-level ones entirely
+        assert_eq!(
+            config.rate_limit("cs101", "/api/v1/execute"),
+            Some((
+                "*",
+                RateLimit {
+                    rate: 5.0,
+                    burst: 20
+                }
+            ))
+        );
+        assert_eq!(IsoboxConfig::default().rate_limit("cs101", "/"), None);
+
+        let zero_burst =
+            IsoboxConfig::from_json(r#"{"rate_limits": {"default": {"rate": 1, "burst": 0}}}"#)
+                .unwrap();
+        assert!(zero_burst.validate().is_err());
+    }
+
+    #[test]
+    fn test_malformed_digest_is_rejected() {
+        let config = IsoboxConfig::from_json(
+            r#"{"languages": {"python": {"image": "python:3.11@sha256:abc"}}}"#,
+        )
+        .unwrap();
+        assert!(matches!(
+            config.validate(),
+            Err(ConfigError::InvalidValue(_))
+        ));
+    }
+
+    #[test]
+    fn test_tenant_command_allow_list() {
+        let config = IsoboxConfig::from_json(
+            r#"{"tenants": {"cs101": {"api_keys": ["key-1"], "allowed_commands": ["python -m", "node --experimental-vm-modules"]}}}"#,
+        )
+        .unwrap();
+        assert_eq!(config.tenant_for_api_key("key-1"), Some("cs101"));
+        assert_eq!(config.tenant_for_api_key("other"), None);
+
+        let tenant = config.tenant("cs101").unwrap();
+        let command = |args: &[&str]| args.iter().map(|a| a.to_string()).collect::<Vec<_>>();
+        assert!(tenant.allows_command(&command(&["python", "-m", "mypackage"])));
+        assert!(tenant.allows_command(&command(&["node", "--experimental-vm-modules", "main.js"])));
+        assert!(!tenant.allows_command(&command(&["python", "main.py"])));
+        assert!(!tenant.allows_command(&command(&["python"])));
+    }
+
+    #[test]
+    fn test_queue_weights() {
+        let config =
+            IsoboxConfig::from_json(r#"{"tenants": {"staff": {"queue_weight": 4}, "cs101": {}}}"#)
+                .unwrap();
+        assert_eq!(
+            config.queue_weights(),
+            HashMap::from([("staff".to_string(), 4)])
+        );
+
+        assert!(config.validate().is_ok());
+        assert!(
+            IsoboxConfig::from_json(r#"{"tenants": {"cs101": {"queue_weight": 0}}}"#)
+                .unwrap()
+                .validate()
+                .is_err()
+        );
+    }
+
+    #[test]
+    fn test_security_options() {
+        let config = IsoboxConfig::from_json(
+            r#"{"languages": {"python": {"apparmor_profile": "isobox-python", "selinux_label": {"type": "isobox_python_t", "level": "s0:c100,c200"}}}}"#,
+        )
+        .unwrap();
+        assert!(config.validate().is_ok());
+        assert_eq!(
+            config.languages["python"].security_options(),
+            [
+                "apparmor=isobox-python",
+                "label=type:isobox_python_t",
+                "label=level:s0:c100,c200"
+            ]
+        );
+
+        for invalid in [
+            r#"{"languages": {"python": {"apparmor_profile": ""}}}"#,
+            r#"{"languages": {"python": {"apparmor_profile": "isobox python"}}}"#,
+            r#"{"languages": {"python": {"selinux_label": {}}}}"#,
+        ] {
+            let config = IsoboxConfig::from_json(invalid).unwrap();
+            assert!(config.validate().is_err(), "{invalid}");
+        }
+    }
+
+    #[test]
+    fn test_ulimits() {
+        let config = IsoboxConfig::from_json(
+            r#"{"languages": {"c": {"ulimits": {"nofile": 16, "fsize": 0, "stack": 8388608}}}}"#,
+        )
+        .unwrap();
+        assert!(config.validate().is_ok());
+        let ulimits = config.languages["c"].ulimits.unwrap();
+        assert_eq!(ulimits.fsize, Some(0));
+        assert_eq!(ulimits.core, None);
+
+        for invalid in [
+            r#"{"languages": {"c": {"ulimits": {"nofile": 0}}}}"#,
+            r#"{"languages": {"c": {"ulimits": {"stack": 0}}}}"#,
+        ] {
+            let config = IsoboxConfig::from_json(invalid).unwrap();
+            assert!(config.validate().is_err(), "{invalid}");
+        }
+    }
+
+    #[test]
+    fn test_capabilities() {
+        let config = IsoboxConfig::from_json(
+            r#"{"languages": {"c": {"capabilities": ["cap_sys_ptrace", "SYS_PTRACE", "NET_RAW"]}}}"#,
+        )
+        .unwrap();
+        assert!(config.validate().is_ok());
+        assert_eq!(
+            config.languages["c"].capabilities(),
+            ["NET_RAW", "SYS_PTRACE"]
+        );
+
+        for invalid in [
+            r#"{"languages": {"c": {"capabilities": ["ALL"]}}}"#,
+            r#"{"languages": {"c": {"capabilities": ["SYS_PTRAC"]}}}"#,
+            r#"{"languages": {"c": {"capabilities": [""]}}}"#,
+        ] {
+            let config = IsoboxConfig::from_json(invalid).unwrap();
+            assert!(config.validate().is_err(), "{invalid}");
+        }
+    }
+
+    #[test]
+    fn test_filesystem() {
+        let config = IsoboxConfig::from_json(
+            r#"{"filesystem": {"read_only": true}, "languages": {"go": {"filesystem": {"read_only": true, "tmpfs": {"/tmp": 256, "/root/.cache": 512}}}}}"#,
+        )
+        .unwrap();
+        assert!(config.validate().is_ok());
+        let mb = 1024 * 1024;
+        assert_eq!(
+            config.filesystem("python").tmpfs_mounts(),
+            [("/tmp".to_string(), DEFAULT_TMPFS_MB * mb)]
+        );
+        assert_eq!(
+            config.filesystem("go").tmpfs_mounts(),
+            [
+                ("/root/.cache".to_string(), 512 * mb),
+                ("/tmp".to_string(), 256 * mb)
+            ]
+        );
+        assert!(IsoboxConfig::default()
+            .filesystem("go")
+            .tmpfs_mounts()
+            .is_empty());
+
+        for invalid in [
+            r#"{"filesystem": {"tmpfs": {"tmp": 64}}}"#,
+            r#"{"filesystem": {"tmpfs": {"/": 64}}}"#,
+            r#"{"filesystem": {"tmpfs": {"/tmp/../etc": 64}}}"#,
+            r#"{"languages": {"go": {"filesystem": {"tmpfs": {"/tmp": 0}}}}}"#,
+        ] {
+            let config = IsoboxConfig::from_json(invalid).unwrap();
+            assert!(config.validate().is_err(), "{invalid}");
+        }
+    }
+
+    #[test]
+    fn test_syscall_policy() {
+        let config = IsoboxConfig::from_json(
+            r#"{"syscall_policy": "permissive", "languages": {"c": {"syscall_policy": "strict"}}, "tenants": {"ops": {"syscall_policy": "standard"}}}"#,
+        )
+        .unwrap();
+        assert_eq!(
+            config.syscall_policy("python", "default"),
+            SyscallPolicy::Permissive
+        );
+        assert_eq!(config.syscall_policy("c", "default"), SyscallPolicy::Strict);
+        assert_eq!(config.syscall_policy("c", "ops"), SyscallPolicy::Standard);
+        assert_eq!(
+            IsoboxConfig::default().syscall_policy("c", "ops"),
+            SyscallPolicy::Standard
+        );
+        assert!(IsoboxConfig::from_json(r#"{"syscall_policy": "lax"}"#).is_err());
+    }
+
+    #[test]
+    fn test_cache_mounts() {
+        let config = IsoboxConfig::from_json(
+            r#"{"caches": {"pip": {"path": "/root/.cache/pip", "languages": ["python"]}, "gomod": {"path": "/go/pkg/mod", "languages": ["go"], "lock": false}, "ccache": {"path": "/root/.ccache"}}}"#,
+        )
+        .unwrap();
+        assert!(config.validate().is_ok());
+
+        let names = |language| {
+            config
+                .caches_for(language)
+                .into_iter()
+                .map(|(name, _)| name)
+                .collect::<Vec<_>>()
+        };
+        assert_eq!(names("python"), vec!["ccache", "pip"]);
+        assert_eq!(names("go"), vec!["ccache", "gomod"]);
+        assert!(config.caches["pip"].lock);
+        assert!(!config.caches["gomod"].lock);
+
+        let relative =
+            IsoboxConfig::from_json(r#"{"caches": {"npm": {"path": "root/.npm"}}}"#).unwrap();
+        assert!(relative.validate().is_err());
+    }
+
+    #[test]
+    fn test_datasets() {
+        let config = IsoboxConfig::from_json(
+            r#"{"datasets": {"mnist": {"source": "s3://course-data/mnist/", "tenants": ["cs101"]}, "iris": {"source": "/srv/datasets/iris"}}}"#,
+        )
+        .unwrap();
+        assert!(config.validate().is_ok());
+        assert!(config.datasets["mnist"].is_remote());
+        assert!(config.datasets["mnist"].allows_tenant("cs101"));
+        assert!(!config.datasets["mnist"].allows_tenant("default"));
+        assert!(config.datasets["iris"].allows_tenant("default"));
+
+        let invalid = IsoboxConfig::from_json(
+            r#"{"datasets": {"../etc": {"source": "/srv/datasets/iris"}}}"#,
+        )
+        .unwrap();
+        assert!(invalid.validate().is_err());
+    }
+
+    #[test]
+    fn test_presets() {
+        let config = IsoboxConfig::from_json(
+            r#"{"presets": {"python-datasci": {"language": "python", "image": "isobox/python-datasci:1", "packages": ["numpy", "pandas"], "env": {"MPLBACKEND": "Agg"}, "limits": {"memory_mb": 1024}}}}"#,
+        )
+        .unwrap();
+        assert!(config.validate().is_ok());
+        let preset = &config.presets["python-datasci"];
+        assert_eq!(preset.packages, vec!["numpy", "pandas"]);
+        assert_eq!(preset.limits.unwrap().memory_mb, Some(1024));
+
+        for invalid in [
+            r#"{"presets": {"node-web": {"language": "node", "image": " "}}}"#,
+            r#"{"presets": {"node-web": {"language": "node", "image": "node-web", "env": {"A=B": "c"}}}}"#,
+            r#"{"presets": {"../web": {"language": "node", "image": "node-web"}}}"#,
+        ] {
+            assert!(IsoboxConfig::from_json(invalid)
+                .unwrap()
+                .validate()
+                .is_err());
+        }
+    }
+
+    #[test]
+    fn test_dependencies() {
+        let config = IsoboxConfig::from_json(
+            r#"{"dependencies": {"python": {"lockfile": "requirements.txt", "install": ["pip", "install", "--target", "/deps", "-r", "requirements.txt"], "path": "/deps", "env": {"PYTHONPATH": "/deps"}}}}"#,
+        )
+        .unwrap();
+        assert!(config.validate().is_ok());
+        assert_eq!(config.dependencies["python"].lockfile, "requirements.txt");
+
+        for invalid in [
+            r#"{"dependencies": {"python": {"lockfile": "../requirements.txt", "install": ["pip"], "path": "/deps"}}}"#,
+            r#"{"dependencies": {"python": {"lockfile": "requirements.txt", "install": [], "path": "/deps"}}}"#,
+            r#"{"dependencies": {"python": {"lockfile": "requirements.txt", "install": ["pip"], "path": "deps"}}}"#,
+        ] {
+            assert!(IsoboxConfig::from_json(invalid)
+                .unwrap()
+                .validate()
+                .is_err());
+        }
+    }
+
+    #[test]
+    fn test_replicas() {
+        let config = IsoboxConfig::from_json(
+            r#"{"replicas": {"id": "isobox-0", "peers": {"isobox-1": "http://isobox-1.isobox:8000"}}}"#,
+        )
+        .unwrap();
+        assert!(config.validate().is_ok());
+        assert!(IsoboxConfig::default().validate().is_ok());
+
+        for invalid in [
+            r#"{"replicas": {"peers": {"isobox-1": "http://isobox-1.isobox:8000"}}}"#,
+            r#"{"replicas": {"id": "", "peers": {"isobox-1": "http://isobox-1.isobox:8000"}}}"#,
+            r#"{"replicas": {"id": "isobox-0", "peers": {"isobox-1": "isobox-1.isobox:8000"}}}"#,
+            r#"{"replicas": {"id": "isobox-0", "peers": {"": "http://isobox-1.isobox:8000"}}}"#,
+        ] {
+            let config = IsoboxConfig::from_json(invalid).unwrap();
+            assert!(config.validate().is_err(), "{invalid}");
+        }
+    }
+
+    #[test]
+    fn test_package_mirrors() {
+        let config = IsoboxConfig::from_json(
+            r#"{"package_mirrors": {"pip": "http://devpi.internal:3141/root/pypi/+simple/", "go": "https://athens.example.com"}}"#,
+        )
+        .unwrap();
+        assert!(config.validate().is_ok());
+        let env = config.package_mirrors.env();
+        assert_eq!(
+            env,
+            vec![
+                ("PIP_TRUSTED_HOST".to_string(), "devpi.internal".to_string()),
+                (
+                    "PIP_INDEX_URL".to_string(),
+                    "http://devpi.internal:3141/root/pypi/+simple/".to_string()
+                ),
+                (
+                    "GOPROXY".to_string(),
+                    "https://athens.example.com".to_string()
+                ),
+            ]
+        );
+
+        let embedded = PackageMirrorConfig {
+            embedded_url: Some("https://isobox.internal".to_string()),
+            ..config.package_mirrors.clone()
+        };
+        assert!(embedded.env().contains(&(
+            "npm_config_registry".to_string(),
+            "https://isobox.internal/mirror/npm/".to_string()
+        )));
+        assert_eq!(
+            embedded.upstreams()[1],
+            ("npm", "https://registry.npmjs.org".to_string())
+        );
+
+        let invalid = IsoboxConfig::from_json(r#"{"package_mirrors": {"npm": "registry.local"}}"#);
+        assert!(invalid.unwrap().validate().is_err());
+        let invalid =
+            IsoboxConfig::from_json(r#"{"package_mirrors": {"clients": ["10.0.0.0/33"]}}"#);
+        assert!(invalid.unwrap().validate().is_err());
+    }
+
+    #[test]
+    fn test_pinned_digest() {
+        assert_eq!(pinned_digest(&format!("python@{DIGEST}")), Some(DIGEST));
+        assert_eq!(pinned_digest("python:3.11"), None);
+    }
+}
@@ -0,0 +1,130 @@
+use crate::cgroup::Throttling;
+use serde::{Deserialize, Serialize};
+use std::fs;
+
+const PROC_STAT: &str = "/proc/stat";
+
+/// CPU time a sandbox step was kept from, so a program that was starved can be
+/// told apart from one that was too slow when it runs out of time
+#[derive(Debug, Clone, Copy, PartialEq, Serialize, Deserialize)]
+pub struct CpuContention {
+    /// Scheduler periods the step ran in, when its cgroup is managed
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub periods: Option<u64>,
+    /// Periods the step used up its `CGROUP_CPUS` quota in
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub throttled_periods: Option<u64>,
+    /// Seconds its threads waited for the next period
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub throttled_seconds: Option<f64>,
+    /// Seconds the hypervisor ran other guests on the step's core, or on the
+    /// host's cores on average when the step isn't pinned to one
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub steal_seconds: Option<f64>,
+}
+
+impl CpuContention {
+    /// None when neither was measured
+    pub fn new(throttling: Option<Throttling>, steal_seconds: Option<f64>) -> Option<Self> {
+        if throttling.is_none() && steal_seconds.is_none() {
+            return None;
+        }
+        Some(Self {
+            periods: throttling.map(|t| t.periods),
+            throttled_periods: throttling.map(|t| t.throttled_periods),
+            throttled_seconds: throttling.map(|t| t.throttled_usec as f64 / 1_000_000.0),
+            steal_seconds,
+        })
+    }
+}
+
+/// Steal time counted so far by the kernel, for one core or averaged over all
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct StealSample {
+    ticks: f64,
+}
+
+impl StealSample {
+    /// Reads `/proc/stat`; None where the kernel doesn't count steal time
+    pub fn read(cpu: Option<usize>) -> Option<Self> {
+        parse_proc_stat(&fs::read_to_string(PROC_STAT).ok()?, cpu)
+    }
+
+    /// Seconds of steal time between `earlier` and this sample
+    pub fn seconds_since(&self, earlier: &StealSample) -> f64 {
+        (self.ticks - earlier.ticks).max(0.0) / clock_ticks()
+    }
+}
+
+// Lines are a cpu label, "cpu" for the total or "cpuN" for core N, followed by
+// tick counters; steal is the eighth
+fn parse_proc_stat(stat: &str, cpu: Option<usize>) -> Option<StealSample> {
+    let label = cpu.map_or_else(|| "cpu".to_string(), |cpu| format!("cpu{cpu}"));
+    let line = stat
+        .lines()
+        .find(|line| line.split_whitespace().next() == Some(label.as_str()))?;
+    let ticks: f64 = line.split_whitespace().nth(8)?.parse().ok()?;
+    if cpu.is_some() {
+        return Some(StealSample { ticks });
+    }
+    let cores = stat
+        .lines()
+        .filter(|line| {
+            line.strip_prefix("cpu")
+                .is_some_and(|rest| rest.starts_with(|c: char| c.is_ascii_digit()))
+        })
+        .count()
+        .max(1);
+    Some(StealSample {
+        ticks: ticks / cores as f64,
+    })
+}
+
+fn clock_ticks() -> f64 {
+    // Always succeeds on Linux
+    match unsafe { libc::sysconf(libc::_SC_CLK_TCK) } {
+        ticks if ticks > 0 => ticks as f64,
+        _ => 100.0,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const STAT: &str = "cpu  4705 356 584 3699176 23 23 0 300 0 0\n\
+        cpu0 1393 280 260 924768 3 3 0 50 0 0\n\
+        cpu1 3312 76 324 2774408 20 20 0 250 0 0\n\
+        intr 114930548 113199788 3 0 5 263 0 4 [... lots more numbers ...]\n";
+
+    #[test]
+    fn test_parse_proc_stat() {
+        assert_eq!(
+            parse_proc_stat(STAT, Some(1)),
+            Some(StealSample { ticks: 250.0 })
+        );
+        assert_eq!(
+            parse_proc_stat(STAT, None),
+            Some(StealSample { ticks: 150.0 })
+        );
+        assert_eq!(parse_proc_stat(STAT, Some(7)), None);
+
+        let later = StealSample {
+            ticks: 150.0 + clock_ticks() / 2.0,
+        };
+        assert_eq!(later.seconds_since(&StealSample { ticks: 150.0 }), 0.5);
+    }
+
+    #[test]
+    fn test_contention() {
+        assert_eq!(CpuContention::new(None, None), None);
+        let throttling = Throttling {
+            periods: 20,
+            throttled_periods: 4,
+            throttled_usec: 250_000,
+        };
+        let contention = CpuContention::new(Some(throttling), None).unwrap();
+        assert_eq!(contention.throttled_seconds, Some(0.25));
+        assert_eq!(contention.steal_seconds, None);
+    }
+}
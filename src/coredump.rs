@@ -0,0 +1,90 @@
+use std::fs;
+use std::path::Path;
+
+/// Default cap on the size of a core dump, used when `CORE_DUMP_MAX_BYTES` is unset
+pub const DEFAULT_MAX_BYTES: u64 = 32 * 1024 * 1024;
+
+// Prints every thread's backtrace if the sandbox image has gdb, and exits with
+// 127 otherwise. Takes the binary and the core file as arguments.
+const BACKTRACE_SCRIPT: &str = r#"command -v gdb >/dev/null 2>&1 || exit 127
+exec gdb --batch --quiet -ex "thread apply all bt" "$0" "$1" 2>/dev/null"#;
+
+/// Size cap for core dumps of `debug` requests, from `CORE_DUMP_MAX_BYTES`
+pub fn max_bytes_from_env() -> u64 {
+    std::env::var("CORE_DUMP_MAX_BYTES")
+        .ok()
+        .and_then(|s| s.parse().ok())
+        .unwrap_or(DEFAULT_MAX_BYTES)
+}
+
+/// Whether the kernel writes a core dump for a program killed by `signal`
+pub fn dumps_core(signal: &str) -> bool {
+    matches!(
+        signal,
+        "SIGQUIT"
+            | "SIGILL"
+            | "SIGTRAP"
+            | "SIGABRT"
+            | "SIGBUS"
+            | "SIGFPE"
+            | "SIGSEGV"
+            | "SIGSYS"
+            | "SIGXCPU"
+            | "SIGXFSZ"
+    )
+}
+
+/// Name of the core file in the top of a workspace, where the kernel writes it
+/// when the host's `kernel.core_pattern` is a plain file name such as `core` or
+/// `core.%p`. The newest wins if there are several.
+pub fn find(workspace: &Path) -> Option<String> {
+    fs::read_dir(workspace)
+        .ok()?
+        .flatten()
+        .filter(|entry| entry.file_type().is_ok_and(|kind| kind.is_file()))
+        .filter_map(|entry| {
+            let name = entry.file_name().into_string().ok()?;
+            let is_core = name == "core" || name.starts_with("core.");
+            let modified = entry.metadata().ok()?.modified().ok()?;
+            is_core.then_some((modified, name))
+        })
+        .max()
+        .map(|(_, name)| name)
+}
+
+/// Command that prints a symbolized backtrace of `core`, a dump of `binary`
+pub fn backtrace_command(binary: &str, core: &str) -> Vec<String> {
+    vec![
+        "sh".to_string(),
+        "-c".to_string(),
+        BACKTRACE_SCRIPT.to_string(),
+        binary.to_string(),
+        core.to_string(),
+    ]
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_find() {
+        let workspace = std::env::temp_dir().join(format!("isobox-core-{}", uuid::Uuid::new_v4()));
+        fs::create_dir_all(workspace.join("core.d")).unwrap();
+        fs::write(workspace.join("main.c"), "").unwrap();
+        fs::write(workspace.join("corefile"), "").unwrap();
+        assert_eq!(find(&workspace), None);
+
+        fs::write(workspace.join("core.42"), "").unwrap();
+        assert_eq!(find(&workspace), Some("core.42".to_string()));
+        fs::remove_dir_all(&workspace).unwrap();
+    }
+
+    #[test]
+    fn test_dumps_core() {
+        assert!(dumps_core("SIGSEGV"));
+        assert!(dumps_core("SIGABRT"));
+        assert!(!dumps_core("SIGKILL"));
+        assert!(!dumps_core("SIGTERM"));
+    }
+}
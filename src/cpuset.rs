@@ -0,0 +1,422 @@
+use serde::{Deserialize, Serialize};
+use std::collections::{BTreeSet, HashMap};
+use std::fs;
+use std::path::Path;
+use std::sync::{Arc, Mutex};
+use tokio::sync::Notify;
+
+// Where the kernel describes the host's CPUs
+const CPU_SYSFS: &str = "/sys/devices/system/cpu";
+const NODE_SYSFS: &str = "/sys/devices/system/node";
+
+/// How a free core is picked for an execution when several are free
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Deserialize, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum CpuPolicy {
+    /// The lowest-numbered free core
+    #[default]
+    Packed,
+    /// A core on the NUMA node and shared cache with the fewest busy cores,
+    /// preferring physical cores whose hyperthread siblings are idle
+    Spread,
+    /// Like `spread`, but a core's hyperthread siblings are left idle while it's
+    /// in use, so at most one execution runs per physical core
+    Exclusive,
+}
+
+impl CpuPolicy {
+    pub fn as_str(self) -> &'static str {
+        match self {
+            CpuPolicy::Packed => "packed",
+            CpuPolicy::Spread => "spread",
+            CpuPolicy::Exclusive => "exclusive",
+        }
+    }
+}
+
+/// Where a core sits in the host's topology
+#[derive(Debug, Clone, Default, PartialEq)]
+pub struct CpuPlace {
+    pub node: usize,
+    /// First core sharing the core's last-level cache, e.g. its CCX
+    pub cache: usize,
+    /// Hyperthreads of the same physical core, the core itself included
+    pub siblings: Vec<usize>,
+}
+
+/// NUMA nodes, shared caches and hyperthread siblings of the host's cores, read
+/// from sysfs. Cores it doesn't know about count as one node and cache with no
+/// siblings.
+#[derive(Debug, Clone, Default)]
+pub struct Topology {
+    places: HashMap<usize, CpuPlace>,
+}
+
+impl Topology {
+    pub fn new(places: HashMap<usize, CpuPlace>) -> Self {
+        Self { places }
+    }
+
+    /// Reads the places of `cpus`; files a kernel doesn't have are skipped
+    pub fn read(cpus: &[usize]) -> Self {
+        let read_list = |path: &Path| {
+            fs::read_to_string(path)
+                .ok()
+                .and_then(|list| parse_cpu_list(&list).ok())
+        };
+        let mut nodes = HashMap::new();
+        if let Ok(entries) = fs::read_dir(NODE_SYSFS) {
+            for entry in entries.flatten() {
+                let name = entry.file_name().to_string_lossy().into_owned();
+                let Some(node) = name.strip_prefix("node").and_then(|n| n.parse().ok()) else {
+                    continue;
+                };
+                for cpu in read_list(&entry.path().join("cpulist")).unwrap_or_default() {
+                    nodes.insert(cpu, node);
+                }
+            }
+        }
+        let places = cpus
+            .iter()
+            .map(|&cpu| {
+                let dir = Path::new(CPU_SYSFS).join(format!("cpu{cpu}"));
+                let place = CpuPlace {
+                    node: nodes.get(&cpu).copied().unwrap_or(0),
+                    cache: last_level_cache(&dir)
+                        .and_then(|shared| shared.first().copied())
+                        .unwrap_or(0),
+                    siblings: read_list(&dir.join("topology/thread_siblings_list"))
+                        .unwrap_or_else(|| vec![cpu]),
+                };
+                (cpu, place)
+            })
+            .collect();
+        Self { places }
+    }
+
+    fn place(&self, cpu: usize) -> CpuPlace {
+        self.places.get(&cpu).cloned().unwrap_or_else(|| CpuPlace {
+            siblings: vec![cpu],
+            ..CpuPlace::default()
+        })
+    }
+}
+
+// Cores sharing the highest-level cache of a core's `cache/index*` entries
+fn last_level_cache(cpu_dir: &Path) -> Option<Vec<usize>> {
+    let mut best: Option<(u32, Vec<usize>)> = None;
+    for entry in fs::read_dir(cpu_dir.join("cache")).ok()?.flatten() {
+        let level = fs::read_to_string(entry.path().join("level"))
+            .ok()
+            .and_then(|level| level.trim().parse::<u32>().ok());
+        let shared = fs::read_to_string(entry.path().join("shared_cpu_list"))
+            .ok()
+            .and_then(|list| parse_cpu_list(&list).ok());
+        if let (Some(level), Some(shared)) = (level, shared) {
+            if best.as_ref().map_or(true, |(best, _)| level > *best) {
+                best = Some((level, shared));
+            }
+        }
+    }
+    best.map(|(_, shared)| shared)
+}
+
+/// Cores executions are pinned to with `PINNED_CPUS`, one execution per core, so
+/// a program's CPU time doesn't depend on what else the host is running.
+/// Executions wait for a free core once all of them are taken.
+#[derive(Clone, Default)]
+pub struct CpuPool {
+    inner: Option<Arc<PoolInner>>,
+    // Why the environment couldn't be read; reported by `verify`
+    invalid: Option<String>,
+}
+
+struct PoolInner {
+    cpus: Vec<usize>,
+    policy: CpuPolicy,
+    topology: Topology,
+    busy: Mutex<BTreeSet<usize>>,
+    // Woken whenever a core is handed back
+    released: Notify,
+}
+
+impl CpuPool {
+    /// A pool of the given cores; pinning is off when there are none
+    pub fn new(cpus: Vec<usize>) -> Self {
+        Self::with_policy(cpus, CpuPolicy::default(), Topology::default())
+    }
+
+    pub fn with_policy(cpus: Vec<usize>, policy: CpuPolicy, topology: Topology) -> Self {
+        let cpus: Vec<usize> = cpus
+            .into_iter()
+            .collect::<BTreeSet<_>>()
+            .into_iter()
+            .collect();
+        if cpus.is_empty() {
+            return Self::default();
+        }
+        Self {
+            inner: Some(Arc::new(PoolInner {
+                cpus,
+                policy,
+                topology,
+                busy: Mutex::new(BTreeSet::new()),
+                released: Notify::new(),
+            })),
+            invalid: None,
+        }
+    }
+
+    /// Reads `PINNED_CPUS`, a CPU list such as `2-5,8`. An unreadable list is
+    /// kept until startup checks it with `verify`.
+    pub fn from_env() -> Self {
+        match std::env::var("PINNED_CPUS") {
+            Ok(list) if !list.trim().is_empty() => match parse_cpu_list(&list) {
+                Ok(cpus) => Self::new(cpus),
+                Err(e) => Self {
+                    invalid: Some(format!("PINNED_CPUS: {e}")),
+                    ..Self::default()
+                },
+            },
+            _ => Self::default(),
+        }
+    }
+
+    /// The same cores picked by `policy`, with the host's topology read for any
+    /// policy but `packed`. Only for a pool no execution holds a core of yet.
+    pub fn for_policy(&self, policy: CpuPolicy) -> Self {
+        match &self.inner {
+            Some(inner) if policy != inner.policy => {
+                let topology = match policy {
+                    CpuPolicy::Packed => Topology::default(),
+                    _ => Topology::read(&inner.cpus),
+                };
+                Self::with_policy(inner.cpus.clone(), policy, topology)
+            }
+            _ => self.clone(),
+        }
+    }
+
+    pub fn enabled(&self) -> bool {
+        self.inner.is_some()
+    }
+
+    /// Pinned cores, sorted
+    pub fn cpus(&self) -> &[usize] {
+        self.inner.as_ref().map_or(&[], |inner| &inner.cpus)
+    }
+
+    pub fn policy(&self) -> CpuPolicy {
+        self.inner
+            .as_ref()
+            .map_or(CpuPolicy::default(), |inner| inner.policy)
+    }
+
+    /// Checks that every pinned core is online on this host
+    pub fn verify(&self) -> Result<(), String> {
+        if let Some(e) = &self.invalid {
+            return Err(e.clone());
+        }
+        if !self.enabled() {
+            return Ok(());
+        }
+        let online_path = format!("{CPU_SYSFS}/online");
+        let online = fs::read_to_string(&online_path)
+            .map_err(|e| format!("PINNED_CPUS needs Linux to read {online_path}: {e}"))
+            .and_then(|list| parse_cpu_list(&list))?;
+        match self.cpus().iter().find(|cpu| !online.contains(cpu)) {
+            Some(cpu) => Err(format!("PINNED_CPUS has CPU {cpu}, which isn't online")),
+            None => Ok(()),
+        }
+    }
+
+    /// Waits for a core the policy allows and holds it until the returned guard
+    /// is dropped. None when pinning is off.
+    pub async fn acquire(&self) -> Option<PinnedCpu> {
+        let inner = self.inner.as_ref()?;
+        loop {
+            // Registered before the check, so a core handed back in between
+            // still wakes this execution
+            let released = inner.released.notified();
+            if let Some(cpu) = inner.pick() {
+                return Some(PinnedCpu {
+                    cpu,
+                    pool: inner.clone(),
+                });
+            }
+            released.await;
+        }
+    }
+}
+
+impl PoolInner {
+    // Marks the best free core busy and returns it
+    fn pick(&self) -> Option<usize> {
+        let mut busy = self.busy.lock().unwrap();
+        let free = self.cpus.iter().copied().filter(|cpu| !busy.contains(cpu));
+        let cpu = match self.policy {
+            CpuPolicy::Packed => free.min(),
+            CpuPolicy::Spread | CpuPolicy::Exclusive => {
+                let places: Vec<(usize, CpuPlace)> = busy
+                    .iter()
+                    .map(|&cpu| (cpu, self.topology.place(cpu)))
+                    .collect();
+                free.filter_map(|cpu| {
+                    let place = self.topology.place(cpu);
+                    let busy_siblings = place
+                        .siblings
+                        .iter()
+                        .filter(|sibling| busy.contains(sibling))
+                        .count();
+                    if self.policy == CpuPolicy::Exclusive && busy_siblings > 0 {
+                        return None;
+                    }
+                    let on_node = places.iter().filter(|(_, p)| p.node == place.node).count();
+                    let in_cache = places
+                        .iter()
+                        .filter(|(_, p)| p.cache == place.cache)
+                        .count();
+                    Some(((busy_siblings, on_node, in_cache, cpu), cpu))
+                })
+                .min()
+                .map(|(_, cpu)| cpu)
+            }
+        }?;
+        busy.insert(cpu);
+        Some(cpu)
+    }
+}
+
+/// A core held by one execution. Dropping it hands the core to the next.
+pub struct PinnedCpu {
+    cpu: usize,
+    pool: Arc<PoolInner>,
+}
+
+impl PinnedCpu {
+    pub fn cpu(&self) -> usize {
+        self.cpu
+    }
+}
+
+impl Drop for PinnedCpu {
+    fn drop(&mut self) {
+        self.pool.busy.lock().unwrap().remove(&self.cpu);
+        self.pool.released.notify_waiters();
+    }
+}
+
+/// Parses a CPU list in the kernel's format, e.g. "0-3,8,10-11"
+pub fn parse_cpu_list(list: &str) -> Result<Vec<usize>, String> {
+    let mut cpus = Vec::new();
+    for range in list.trim().split(',').map(str::trim) {
+        let parse = |s: &str| {
+            s.trim()
+                .parse::<usize>()
+                .map_err(|_| format!("'{range}' isn't a CPU or range of CPUs, e.g. 2-5"))
+        };
+        match range.split_once('-') {
+            Some((first, last)) => {
+                let (first, last) = (parse(first)?, parse(last)?);
+                if first > last {
+                    return Err(format!("'{range}' is an empty range"));
+                }
+                cpus.extend(first..=last);
+            }
+            None => cpus.push(parse(range)?),
+        }
+    }
+    Ok(cpus)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    // Two nodes of two physical cores, each with two hyperthreads: cores 0-3 on
+    // node 0 and 4-7 on node 1, with 0 and 1 siblings, 2 and 3, and so on
+    fn two_node_topology() -> Topology {
+        Topology::new(
+            (0..8)
+                .map(|cpu| {
+                    let first = cpu - cpu % 2;
+                    let place = CpuPlace {
+                        node: cpu / 4,
+                        cache: cpu / 4 * 4,
+                        siblings: vec![first, first + 1],
+                    };
+                    (cpu, place)
+                })
+                .collect(),
+        )
+    }
+
+    #[test]
+    fn test_parse_cpu_list() {
+        assert_eq!(parse_cpu_list("0-3,8\n").unwrap(), [0, 1, 2, 3, 8]);
+        assert_eq!(parse_cpu_list("5").unwrap(), [5]);
+        assert!(parse_cpu_list("3-1").is_err());
+        assert!(parse_cpu_list("a-b").is_err());
+        assert!(parse_cpu_list("1,,2").is_err());
+    }
+
+    #[test]
+    fn test_policy_serde() {
+        let policy: CpuPolicy = serde_json::from_str(r#""exclusive""#).unwrap();
+        assert_eq!(policy, CpuPolicy::Exclusive);
+        assert!(serde_json::from_str::<CpuPolicy>(r#""numa""#).is_err());
+    }
+
+    #[tokio::test]
+    async fn test_one_execution_per_core() {
+        assert!(CpuPool::default().acquire().await.is_none());
+
+        let pool = CpuPool::new(vec![3, 2, 3]);
+        assert_eq!(pool.cpus(), [2, 3]);
+        let first = pool.acquire().await.unwrap();
+        let second = pool.acquire().await.unwrap();
+        assert_eq!((first.cpu(), second.cpu()), (2, 3));
+
+        // A third execution waits until a core is handed back
+        let waiting = tokio::spawn({
+            let pool = pool.clone();
+            async move { pool.acquire().await.unwrap().cpu() }
+        });
+        tokio::task::yield_now().await;
+        assert!(!waiting.is_finished());
+        drop(second);
+        assert_eq!(waiting.await.unwrap(), 3);
+    }
+
+    #[tokio::test]
+    async fn test_spread_across_nodes_and_cores() {
+        let pool = CpuPool::with_policy((0..8).collect(), CpuPolicy::Spread, two_node_topology());
+        let mut held = Vec::new();
+        for _ in 0..4 {
+            held.push(pool.acquire().await.unwrap());
+        }
+        // One per physical core, alternating between the nodes
+        let cpus: Vec<usize> = held.iter().map(PinnedCpu::cpu).collect();
+        assert_eq!(cpus, [0, 4, 2, 6]);
+        // Siblings are only used once every physical core is busy
+        assert_eq!(pool.acquire().await.unwrap().cpu(), 1);
+    }
+
+    #[tokio::test]
+    async fn test_exclusive_leaves_siblings_idle() {
+        let pool =
+            CpuPool::with_policy(vec![0, 1, 2, 3], CpuPolicy::Exclusive, two_node_topology());
+        let first = pool.acquire().await.unwrap();
+        let second = pool.acquire().await.unwrap();
+        assert_eq!((first.cpu(), second.cpu()), (0, 2));
+
+        let waiting = tokio::spawn({
+            let pool = pool.clone();
+            async move { pool.acquire().await.unwrap().cpu() }
+        });
+        tokio::task::yield_now().await;
+        assert!(!waiting.is_finished());
+        drop(second);
+        assert_eq!(waiting.await.unwrap(), 2);
+    }
+}
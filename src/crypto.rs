@@ -0,0 +1,338 @@
+use base64::engine::general_purpose::STANDARD as BASE64;
+use base64::Engine;
+use ring::aead::{Aad, LessSafeKey, Nonce, UnboundKey, AES_256_GCM, NONCE_LEN};
+use ring::rand::{SecureRandom, SystemRandom};
+use serde::{Deserialize, Serialize};
+use std::io::Write;
+use std::process::{Command, Stdio};
+use thiserror::Error;
+
+const KEY_LEN: usize = 32;
+
+#[derive(Debug, Error)]
+pub enum CryptoError {
+    #[error("Invalid encryption key configuration: {0}")]
+    Config(String),
+    #[error("Unknown encryption key '{0}'")]
+    UnknownKey(String),
+    #[error("Encryption failed: {0}")]
+    Seal(String),
+    #[error("Decryption failed: {0}")]
+    Open(String),
+}
+
+/// Data encrypted under a one-off data key, stored next to that key wrapped by the
+/// master key it was encrypted with
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct SealedData {
+    pub key_id: String,
+    pub wrapped_key: String,
+    pub nonce: String,
+    pub ciphertext: String,
+}
+
+/// Holds the master keys that protect data keys
+pub trait KeyProvider: Send + Sync {
+    /// Key new data keys are wrapped with
+    fn active_key_id(&self) -> &str;
+    fn wrap(&self, data_key: &[u8]) -> Result<Vec<u8>, CryptoError>;
+    fn unwrap(&self, key_id: &str, wrapped: &[u8]) -> Result<Vec<u8>, CryptoError>;
+}
+
+/// Master keys held in memory. The first key wraps new data keys; the others only
+/// unwrap data written before a rotation.
+pub struct LocalKeyring {
+    keys: Vec<(String, Vec<u8>)>,
+    rng: SystemRandom,
+}
+
+impl LocalKeyring {
+    /// Parses `id:base64key` pairs separated by commas, e.g. `2025-10:q83v...,2025-04:Zm9v...`
+    pub fn parse(spec: &str) -> Result<Self, CryptoError> {
+        let keys = spec
+            .split(',')
+            .map(str::trim)
+            .filter(|entry| !entry.is_empty())
+            .map(|entry| {
+                let (id, key) = entry.split_once(':').ok_or_else(|| {
+                    CryptoError::Config(format!("expected id:base64key, got '{entry}'"))
+                })?;
+                let key = BASE64
+                    .decode(key)
+                    .map_err(|e| CryptoError::Config(format!("key '{id}': {e}")))?;
+                if key.len() != KEY_LEN {
+                    return Err(CryptoError::Config(format!(
+                        "key '{id}' must be {KEY_LEN} bytes, got {}",
+                        key.len()
+                    )));
+                }
+                Ok((id.to_string(), key))
+            })
+            .collect::<Result<Vec<_>, _>>()?;
+        if keys.is_empty() {
+            return Err(CryptoError::Config("no keys given".to_string()));
+        }
+        Ok(Self {
+            keys,
+            rng: SystemRandom::new(),
+        })
+    }
+}
+
+impl KeyProvider for LocalKeyring {
+    fn active_key_id(&self) -> &str {
+        &self.keys[0].0
+    }
+
+    // Wrapped keys are the nonce followed by the sealed data key
+    fn wrap(&self, data_key: &[u8]) -> Result<Vec<u8>, CryptoError> {
+        let (id, key) = &self.keys[0];
+        let (nonce, sealed) = seal(&self.rng, key, id, data_key)?;
+        Ok([nonce, sealed].concat())
+    }
+
+    fn unwrap(&self, key_id: &str, wrapped: &[u8]) -> Result<Vec<u8>, CryptoError> {
+        let (_, key) = self
+            .keys
+            .iter()
+            .find(|(id, _)| id == key_id)
+            .ok_or_else(|| CryptoError::UnknownKey(key_id.to_string()))?;
+        if wrapped.len() < NONCE_LEN {
+            return Err(CryptoError::Open("wrapped key is truncated".to_string()));
+        }
+        let (nonce, sealed) = wrapped.split_at(NONCE_LEN);
+        open(key, key_id, nonce, sealed)
+    }
+}
+
+/// AWS KMS key, used through the `aws` CLI. KMS keeps old key material after a
+/// rotation, so data wrapped before it stays readable.
+pub struct AwsKms {
+    key_id: String,
+}
+
+impl AwsKms {
+    pub fn new(key_id: &str) -> Self {
+        Self {
+            key_id: key_id.to_string(),
+        }
+    }
+
+    // Runs an `aws kms` subcommand with binary input on stdin and returns the
+    // base64-decoded output field
+    fn run(&self, args: &[&str], input: &[u8]) -> Result<Vec<u8>, String> {
+        let mut child = Command::new("aws")
+            .arg("kms")
+            .args(args)
+            .args(["--output", "text"])
+            .stdin(Stdio::piped())
+            .stdout(Stdio::piped())
+            .stderr(Stdio::piped())
+            .spawn()
+            .map_err(|e| e.to_string())?;
+        child
+            .stdin
+            .take()
+            .ok_or("failed to open stdin")?
+            .write_all(input)
+            .map_err(|e| e.to_string())?;
+        let output = child.wait_with_output().map_err(|e| e.to_string())?;
+        if !output.status.success() {
+            return Err(String::from_utf8_lossy(&output.stderr).trim().to_string());
+        }
+        BASE64
+            .decode(String::from_utf8_lossy(&output.stdout).trim())
+            .map_err(|e| e.to_string())
+    }
+}
+
+impl KeyProvider for AwsKms {
+    fn active_key_id(&self) -> &str {
+        &self.key_id
+    }
+
+    fn wrap(&self, data_key: &[u8]) -> Result<Vec<u8>, CryptoError> {
+        self.run(
+            &[
+                "encrypt",
+                "--key-id",
+                &self.key_id,
+                "--plaintext",
+                "fileb:///dev/stdin",
+                "--query",
+                "CiphertextBlob",
+            ],
+            data_key,
+        )
+        .map_err(|e| CryptoError::Seal(format!("KMS encrypt: {e}")))
+    }
+
+    fn unwrap(&self, key_id: &str, wrapped: &[u8]) -> Result<Vec<u8>, CryptoError> {
+        self.run(
+            &[
+                "decrypt",
+                "--key-id",
+                key_id,
+                "--ciphertext-blob",
+                "fileb:///dev/stdin",
+                "--query",
+                "Plaintext",
+            ],
+            wrapped,
+        )
+        .map_err(|e| CryptoError::Open(format!("KMS decrypt: {e}")))
+    }
+}
+
+/// Envelope encryption: every call encrypts under a fresh data key, and only the
+/// wrapped data key touches the master key
+pub struct Encryptor {
+    provider: Box<dyn KeyProvider>,
+    rng: SystemRandom,
+}
+
+impl Encryptor {
+    pub fn new(provider: Box<dyn KeyProvider>) -> Self {
+        Self {
+            provider,
+            rng: SystemRandom::new(),
+        }
+    }
+
+    /// Uses `ENCRYPTION_KMS_KEY_ID` if set, otherwise the `ENCRYPTION_KEYS` keyring.
+    /// Returns None when neither is configured.
+    pub fn from_env() -> Result<Option<Self>, CryptoError> {
+        if let Ok(key_id) = std::env::var("ENCRYPTION_KMS_KEY_ID") {
+            return Ok(Some(Self::new(Box::new(AwsKms::new(&key_id)))));
+        }
+        match std::env::var("ENCRYPTION_KEYS") {
+            Ok(spec) => Ok(Some(Self::new(Box::new(LocalKeyring::parse(&spec)?)))),
+            Err(_) => Ok(None),
+        }
+    }
+
+    /// Encrypts `plaintext`, bound to `context` (e.g. the record id) so sealed data
+    /// can't be moved to another record
+    pub fn encrypt(&self, plaintext: &[u8], context: &str) -> Result<SealedData, CryptoError> {
+        let mut data_key = [0u8; KEY_LEN];
+        self.rng
+            .fill(&mut data_key)
+            .map_err(|_| CryptoError::Seal("random number generator failed".to_string()))?;
+        let (nonce, ciphertext) = seal(&self.rng, &data_key, context, plaintext)?;
+        Ok(SealedData {
+            key_id: self.provider.active_key_id().to_string(),
+            wrapped_key: BASE64.encode(self.provider.wrap(&data_key)?),
+            nonce: BASE64.encode(nonce),
+            ciphertext: BASE64.encode(ciphertext),
+        })
+    }
+
+    pub fn decrypt(&self, sealed: &SealedData, context: &str) -> Result<Vec<u8>, CryptoError> {
+        let decode = |field: &str| {
+            BASE64
+                .decode(field)
+                .map_err(|e| CryptoError::Open(e.to_string()))
+        };
+        let data_key = self
+            .provider
+            .unwrap(&sealed.key_id, &decode(&sealed.wrapped_key)?)?;
+        open(
+            &data_key,
+            context,
+            &decode(&sealed.nonce)?,
+            &decode(&sealed.ciphertext)?,
+        )
+    }
+
+    /// Whether the data was sealed under the active master key
+    pub fn is_current(&self, sealed: &SealedData) -> bool {
+        sealed.key_id == self.provider.active_key_id()
+    }
+}
+
+// AES-256-GCM with a random nonce; returns the nonce and the ciphertext with its tag
+fn seal(
+    rng: &SystemRandom,
+    key: &[u8],
+    aad: &str,
+    plaintext: &[u8],
+) -> Result<(Vec<u8>, Vec<u8>), CryptoError> {
+    let key = UnboundKey::new(&AES_256_GCM, key)
+        .map(LessSafeKey::new)
+        .map_err(|_| CryptoError::Seal("invalid key length".to_string()))?;
+    let mut nonce = [0u8; NONCE_LEN];
+    rng.fill(&mut nonce)
+        .map_err(|_| CryptoError::Seal("random number generator failed".to_string()))?;
+    let mut in_out = plaintext.to_vec();
+    key.seal_in_place_append_tag(
+        Nonce::assume_unique_for_key(nonce),
+        Aad::from(aad.as_bytes()),
+        &mut in_out,
+    )
+    .map_err(|_| CryptoError::Seal("AES-GCM failed".to_string()))?;
+    Ok((nonce.to_vec(), in_out))
+}
+
+fn open(key: &[u8], aad: &str, nonce: &[u8], ciphertext: &[u8]) -> Result<Vec<u8>, CryptoError> {
+    let key = UnboundKey::new(&AES_256_GCM, key)
+        .map(LessSafeKey::new)
+        .map_err(|_| CryptoError::Open("invalid key length".to_string()))?;
+    let nonce = Nonce::try_assume_unique_for_key(nonce)
+        .map_err(|_| CryptoError::Open("invalid nonce".to_string()))?;
+    let mut in_out = ciphertext.to_vec();
+    let plaintext = key
+        .open_in_place(nonce, Aad::from(aad.as_bytes()), &mut in_out)
+        .map_err(|_| {
+            CryptoError::Open("ciphertext was tampered with or the key is wrong".to_string())
+        })?;
+    Ok(plaintext.to_vec())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn keyring(spec: &[(&str, u8)]) -> Encryptor {
+        let spec: Vec<String> = spec
+            .iter()
+            .map(|(id, byte)| format!("{id}:{}", BASE64.encode([*byte; KEY_LEN])))
+            .collect();
+        Encryptor::new(Box::new(LocalKeyring::parse(&spec.join(",")).unwrap()))
+    }
+
+    #[test]
+    fn test_round_trip_is_bound_to_context() {
+        let encryptor = keyring(&[("k1", 1)]);
+        let sealed = encryptor.encrypt(b"print('secret')", "exec-1").unwrap();
+        assert_eq!(sealed.key_id, "k1");
+        assert!(!sealed.ciphertext.contains("secret"));
+        assert_eq!(
+            encryptor.decrypt(&sealed, "exec-1").unwrap(),
+            b"print('secret')"
+        );
+        assert!(encryptor.decrypt(&sealed, "exec-2").is_err());
+    }
+
+    #[test]
+    fn test_rotated_keyring_reads_old_data() {
+        let sealed = keyring(&[("k1", 1)]).encrypt(b"data", "exec-1").unwrap();
+
+        let rotated = keyring(&[("k2", 2), ("k1", 1)]);
+        assert!(!rotated.is_current(&sealed));
+        assert_eq!(rotated.decrypt(&sealed, "exec-1").unwrap(), b"data");
+        assert!(rotated.is_current(&rotated.encrypt(b"data", "exec-1").unwrap()));
+
+        let dropped = keyring(&[("k2", 2)]);
+        assert!(matches!(
+            dropped.decrypt(&sealed, "exec-1"),
+            Err(CryptoError::UnknownKey(_))
+        ));
+    }
+
+    #[test]
+    fn test_keyring_rejects_bad_keys() {
+        assert!(LocalKeyring::parse("").is_err());
+        assert!(LocalKeyring::parse("nocolon").is_err());
+        assert!(LocalKeyring::parse(&format!("k1:{}", BASE64.encode([0u8; 16]))).is_err());
+    }
+}
@@ -0,0 +1,144 @@
+use crate::config::{data_dir, DatasetConfig};
+use std::fs;
+use std::path::PathBuf;
+use std::process::Command;
+
+/// Where datasets are mounted inside the container, as `/datasets/<name>`
+pub const DATASETS_MOUNT_ROOT: &str = "/datasets";
+
+/// Local copies of datasets registered in the configuration. Directory datasets are
+/// mounted in place; object-store datasets are synced here once and reused by every run.
+pub struct DatasetStore {
+    root: PathBuf,
+}
+
+impl DatasetStore {
+    pub fn new(root: PathBuf) -> Self {
+        Self { root }
+    }
+
+    pub fn from_env() -> Self {
+        let root = std::env::var("DATASETS_DIR")
+            .map(PathBuf::from)
+            .unwrap_or_else(|_| data_dir().join("datasets"));
+        Self::new(root)
+    }
+
+    /// Host directory that is mounted for the dataset
+    pub fn local_path(&self, name: &str, dataset: &DatasetConfig) -> PathBuf {
+        if dataset.is_remote() {
+            self.root.join(name)
+        } else {
+            PathBuf::from(&dataset.source)
+        }
+    }
+
+    /// Downloads an object-store dataset into its local directory. Directory datasets
+    /// only need to exist.
+    pub fn sync(&self, name: &str, dataset: &DatasetConfig) -> Result<(), String> {
+        let destination = self.local_path(name, dataset);
+        if !dataset.is_remote() {
+            if destination.is_dir() {
+                return Ok(());
+            }
+            return Err(format!("{} is not a directory", destination.display()));
+        }
+
+        fs::create_dir_all(&destination).map_err(|e| e.to_string())?;
+        let destination = destination.to_string_lossy().into_owned();
+        let mut command = if dataset.source.starts_with("gs://") {
+            let mut command = Command::new("gsutil");
+            command.args(["-m", "rsync", "-r", &dataset.source, &destination]);
+            command
+        } else {
+            let mut command = Command::new("aws");
+            command.args(["s3", "sync", &dataset.source, &destination]);
+            command
+        };
+
+        let output = command.output().map_err(|e| e.to_string())?;
+        if !output.status.success() {
+            return Err(String::from_utf8_lossy(&output.stderr).trim().to_string());
+        }
+        Ok(())
+    }
+
+    /// Checks that a dataset is available without downloading anything. Object-store
+    /// datasets need a non-empty local copy, e.g. from an earlier sync.
+    pub fn verify_local(&self, name: &str, dataset: &DatasetConfig) -> Result<(), String> {
+        if !dataset.is_remote() {
+            return self.sync(name, dataset);
+        }
+        let destination = self.local_path(name, dataset);
+        let populated = fs::read_dir(&destination)
+            .map(|mut entries| entries.next().is_some())
+            .unwrap_or(false);
+        if !populated {
+            return Err(format!(
+                "{} can't be downloaded in air-gapped mode and has no local copy in {}",
+                dataset.source,
+                destination.display()
+            ));
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_local_path() {
+        let store = DatasetStore::new(PathBuf::from("/var/lib/isobox/datasets"));
+        let local = DatasetConfig {
+            source: "/srv/data/mnist".to_string(),
+            tenants: Vec::new(),
+        };
+        let remote = DatasetConfig {
+            source: "s3://course-data/mnist/".to_string(),
+            tenants: Vec::new(),
+        };
+
+        assert_eq!(
+            store.local_path("mnist", &local),
+            PathBuf::from("/srv/data/mnist")
+        );
+        assert_eq!(
+            store.local_path("mnist", &remote),
+            PathBuf::from("/var/lib/isobox/datasets/mnist")
+        );
+    }
+
+    #[test]
+    fn test_sync_requires_local_directory() {
+        let existing = DatasetConfig {
+            source: std::env::temp_dir().to_string_lossy().into_owned(),
+            tenants: Vec::new(),
+        };
+        let missing = DatasetConfig {
+            source: "/nonexistent/isobox-dataset".to_string(),
+            tenants: Vec::new(),
+        };
+        let store = DatasetStore::new(std::env::temp_dir());
+        assert!(store.sync("existing", &existing).is_ok());
+        assert!(store.sync("missing", &missing).is_err());
+    }
+
+    #[test]
+    fn test_verify_local() {
+        let root = std::env::temp_dir().join(format!("isobox-datasets-{}", uuid::Uuid::new_v4()));
+        let store = DatasetStore::new(root.clone());
+        let remote = DatasetConfig {
+            source: "s3://course-data/mnist/".to_string(),
+            tenants: Vec::new(),
+        };
+        assert!(store.verify_local("mnist", &remote).is_err());
+
+        fs::create_dir_all(root.join("mnist")).unwrap();
+        assert!(store.verify_local("mnist", &remote).is_err());
+        fs::write(root.join("mnist").join("train.csv"), "1,2").unwrap();
+        assert!(store.verify_local("mnist", &remote).is_ok());
+        fs::remove_dir_all(&root).unwrap();
+    }
+}
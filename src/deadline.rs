@@ -0,0 +1,86 @@
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+/// HTTP header with the Unix time, in seconds, after which the caller no longer
+/// wants the result, e.g. `1718000012.5`
+pub const HEADER: &str = "X-Request-Deadline";
+
+/// Parses an `X-Request-Deadline` value
+pub fn parse_header(value: &str) -> Result<SystemTime, String> {
+    let invalid = || format!("{HEADER} must be a Unix time in seconds, got '{value}'");
+    let seconds: f64 = value.trim().parse().map_err(|_| invalid())?;
+    Duration::try_from_secs_f64(seconds)
+        .ok()
+        .and_then(|since_epoch| UNIX_EPOCH.checked_add(since_epoch))
+        .ok_or_else(invalid)
+}
+
+/// Parses a gRPC `grpc-timeout` value: up to eight digits followed by a unit,
+/// `H`, `M`, `S`, `m`, `u` or `n`, e.g. `250m` for 250 milliseconds
+pub fn parse_grpc_timeout(value: &str) -> Option<Duration> {
+    if !(2..=9).contains(&value.len()) || !value.is_ascii() {
+        return None;
+    }
+    let (digits, unit) = value.split_at(value.len() - 1);
+    if !digits.bytes().all(|b| b.is_ascii_digit()) {
+        return None;
+    }
+    let amount: u64 = digits.parse().ok()?;
+    match unit {
+        "H" => Some(Duration::from_secs(amount * 60 * 60)),
+        "M" => Some(Duration::from_secs(amount * 60)),
+        "S" => Some(Duration::from_secs(amount)),
+        "m" => Some(Duration::from_millis(amount)),
+        "u" => Some(Duration::from_micros(amount)),
+        "n" => Some(Duration::from_nanos(amount)),
+        _ => None,
+    }
+}
+
+/// Time left until the deadline; None once it has passed
+pub fn remaining(deadline: SystemTime) -> Option<Duration> {
+    deadline
+        .duration_since(SystemTime::now())
+        .ok()
+        .filter(|left| !left.is_zero())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_header() {
+        assert_eq!(
+            parse_header("1718000012.5").unwrap(),
+            UNIX_EPOCH + Duration::from_millis(1_718_000_012_500)
+        );
+        assert_eq!(
+            parse_header(" 1718000012 ").unwrap(),
+            UNIX_EPOCH + Duration::from_secs(1_718_000_012)
+        );
+        for invalid in ["", "soon", "-5", "NaN", "inf", "2024-06-10T06:13:32Z"] {
+            assert!(parse_header(invalid).is_err(), "{invalid}");
+        }
+    }
+
+    #[test]
+    fn test_parse_grpc_timeout() {
+        assert_eq!(parse_grpc_timeout("250m"), Some(Duration::from_millis(250)));
+        assert_eq!(parse_grpc_timeout("2H"), Some(Duration::from_secs(7200)));
+        assert_eq!(
+            parse_grpc_timeout("99999999n"),
+            Some(Duration::from_nanos(99_999_999))
+        );
+        for invalid in ["", "m", "10", "10x", "123456789S", "-1S", "1.5S"] {
+            assert_eq!(parse_grpc_timeout(invalid), None, "{invalid}");
+        }
+    }
+
+    #[test]
+    fn test_remaining() {
+        let now = SystemTime::now();
+        assert!(remaining(now - Duration::from_secs(1)).is_none());
+        let left = remaining(now + Duration::from_secs(60)).unwrap();
+        assert!(left > Duration::from_secs(59) && left <= Duration::from_secs(60));
+    }
+}
@@ -0,0 +1,315 @@
+use crate::config::data_dir;
+use crate::session::disk_usage;
+use sha2::{Digest, Sha256};
+use std::collections::HashMap;
+use std::fs;
+use std::future::Future;
+use std::io;
+use std::path::{Path, PathBuf};
+use std::sync::{Arc, Mutex};
+use std::time::{Instant, SystemTime};
+use tokio::sync::Mutex as AsyncMutex;
+use uuid::Uuid;
+
+// Prefix of directories dependencies are installed into before they are complete
+const STAGING_PREFIX: &str = ".staging-";
+
+/// Installed dependency trees, keyed by a hash of the lockfile they were installed
+/// from, so executions with the same lockfile share one install. The least
+/// recently used trees are removed when the cache grows over its size limit.
+pub struct DependencyCache {
+    root: PathBuf,
+    max_bytes: u64,
+    entries: Arc<Mutex<HashMap<String, Entry>>>,
+    // Serializes installs of the same key, so concurrent executions with the same
+    // lockfile wait for one install instead of each running their own
+    installs: Mutex<HashMap<String, Arc<AsyncMutex<()>>>>,
+}
+
+#[derive(Debug)]
+struct Entry {
+    bytes: u64,
+    last_used: SystemTime,
+    // Executions the tree is mounted into; it isn't evicted while they run
+    leases: usize,
+}
+
+/// A dependency tree mounted into an execution. It stays in the cache until the
+/// lease is dropped.
+pub struct DependencyLease {
+    entries: Arc<Mutex<HashMap<String, Entry>>>,
+    key: String,
+    path: PathBuf,
+    /// Whether the tree was already installed
+    pub cached: bool,
+}
+
+impl DependencyLease {
+    pub fn path(&self) -> &Path {
+        &self.path
+    }
+}
+
+impl Drop for DependencyLease {
+    fn drop(&mut self) {
+        if let Some(entry) = self.entries.lock().unwrap().get_mut(&self.key) {
+            entry.leases -= 1;
+        }
+    }
+}
+
+impl DependencyCache {
+    pub fn new(root: PathBuf, max_bytes: u64) -> Self {
+        let entries = load_entries(&root);
+        Self {
+            root,
+            max_bytes,
+            entries: Arc::new(Mutex::new(entries)),
+            installs: Mutex::new(HashMap::new()),
+        }
+    }
+
+    pub fn from_env() -> Self {
+        let root = std::env::var("DEPENDENCY_CACHE_DIR")
+            .map(PathBuf::from)
+            .unwrap_or_else(|_| data_dir().join("dependencies"));
+        let max_bytes = std::env::var("DEPENDENCY_CACHE_MAX_BYTES")
+            .ok()
+            .and_then(|value| value.parse().ok())
+            .unwrap_or(10 * 1024 * 1024 * 1024);
+        Self::new(root, max_bytes)
+    }
+
+    /// The key of the tree a lockfile installs. The image, the install command and
+    /// what else the install sees, such as its environment and mounted bundles, are
+    /// part of it, since the same lockfile installs differently with other ones.
+    pub fn key(image: &str, install: &[String], context: &[String], lockfile: &str) -> String {
+        let mut hasher = Sha256::new();
+        for part in [
+            image,
+            install.join("\0").as_str(),
+            context.join("\0").as_str(),
+            lockfile,
+        ] {
+            hasher.update(part.len().to_le_bytes());
+            hasher.update(part.as_bytes());
+        }
+        hex::encode(hasher.finalize())
+    }
+
+    /// Returns the tree of `key`, installing it first if it isn't cached. `install`
+    /// is given an empty directory to install into, which is only added to the
+    /// cache if it succeeds.
+    pub async fn get_or_install<F, Fut>(
+        &self,
+        key: &str,
+        install: F,
+    ) -> Result<DependencyLease, String>
+    where
+        F: FnOnce(PathBuf) -> Fut,
+        Fut: Future<Output = Result<(), String>>,
+    {
+        let lock = self
+            .installs
+            .lock()
+            .unwrap()
+            .entry(key.to_string())
+            .or_default()
+            .clone();
+        let _install = lock.lock().await;
+        if let Some(lease) = self.lease(key, true) {
+            return Ok(lease);
+        }
+
+        let staging = self
+            .root
+            .join(format!("{STAGING_PREFIX}{}", Uuid::new_v4()));
+        fs::create_dir_all(&staging)
+            .map_err(|e| format!("Failed to create {}: {e}", staging.display()))?;
+        let started = Instant::now();
+        if let Err(e) = install(staging.clone()).await {
+            fs::remove_dir_all(&staging).ok();
+            return Err(e);
+        }
+        let path = self.root.join(key);
+        if let Err(e) = fs::rename(&staging, &path) {
+            fs::remove_dir_all(&staging).ok();
+            return Err(format!("Failed to add dependencies to the cache: {e}"));
+        }
+        let bytes = disk_usage(&path);
+        log::info!(
+            "Installed dependencies {key} ({bytes} bytes) in {:.1}s",
+            started.elapsed().as_secs_f64()
+        );
+        self.entries.lock().unwrap().insert(
+            key.to_string(),
+            Entry {
+                bytes,
+                last_used: SystemTime::now(),
+                leases: 0,
+            },
+        );
+        let lease = self.lease(key, false);
+        self.evict();
+        lease.ok_or_else(|| format!("Dependencies {key} were evicted"))
+    }
+
+    /// Total size of the cached trees
+    pub fn bytes(&self) -> u64 {
+        self.entries.lock().unwrap().values().map(|e| e.bytes).sum()
+    }
+
+    fn lease(&self, key: &str, cached: bool) -> Option<DependencyLease> {
+        let mut entries = self.entries.lock().unwrap();
+        let entry = entries.get_mut(key)?;
+        entry.leases += 1;
+        entry.last_used = SystemTime::now();
+        Some(DependencyLease {
+            entries: self.entries.clone(),
+            key: key.to_string(),
+            path: self.root.join(key),
+            cached,
+        })
+    }
+
+    // Removes the least recently used trees that no execution is using until the
+    // cache fits its limit
+    fn evict(&self) {
+        let mut entries = self.entries.lock().unwrap();
+        let mut total: u64 = entries.values().map(|e| e.bytes).sum();
+        while total > self.max_bytes {
+            let Some(key) = entries
+                .iter()
+                .filter(|(_, entry)| entry.leases == 0)
+                .min_by_key(|(_, entry)| entry.last_used)
+                .map(|(key, _)| key.clone())
+            else {
+                break;
+            };
+            let entry = entries.remove(&key).unwrap();
+            total -= entry.bytes;
+            log::info!("Evicted dependencies {key} ({} bytes)", entry.bytes);
+            if let Err(e) = remove_tree(&self.root.join(&key)) {
+                log::warn!("Failed to remove dependencies {key}: {e}");
+            }
+        }
+    }
+}
+
+// A tree that is already gone counts as removed
+fn remove_tree(path: &Path) -> io::Result<()> {
+    fs::remove_dir_all(path).or_else(|e| match e.kind() {
+        io::ErrorKind::NotFound => Ok(()),
+        _ => Err(e),
+    })
+}
+
+// Trees installed before a restart are kept, ordered by when they were installed.
+// Installs the restart interrupted are removed.
+fn load_entries(root: &Path) -> HashMap<String, Entry> {
+    let Ok(dirs) = fs::read_dir(root) else {
+        return HashMap::new();
+    };
+    dirs.flatten()
+        .filter(|dir| dir.file_type().is_ok_and(|t| t.is_dir()))
+        .filter_map(|dir| {
+            let key = dir.file_name().to_string_lossy().into_owned();
+            if key.starts_with(STAGING_PREFIX) {
+                remove_tree(&dir.path()).ok();
+                return None;
+            }
+            let last_used = dir
+                .metadata()
+                .and_then(|m| m.modified())
+                .unwrap_or(SystemTime::UNIX_EPOCH);
+            let entry = Entry {
+                bytes: disk_usage(&dir.path()),
+                last_used,
+                leases: 0,
+            };
+            Some((key, entry))
+        })
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::sync::atomic::{AtomicUsize, Ordering};
+
+    fn temp_root() -> PathBuf {
+        std::env::temp_dir().join(format!("isobox-dependencies-test-{}", Uuid::new_v4()))
+    }
+
+    async fn install(
+        cache: &DependencyCache,
+        key: &str,
+        installs: &AtomicUsize,
+    ) -> DependencyLease {
+        cache
+            .get_or_install(key, |dir| async move {
+                installs.fetch_add(1, Ordering::SeqCst);
+                fs::write(dir.join("package.py"), [0u8; 100]).map_err(|e| e.to_string())
+            })
+            .await
+            .unwrap()
+    }
+
+    #[tokio::test]
+    async fn test_same_lockfile_installs_once() {
+        let root = temp_root();
+        let cache = DependencyCache::new(root.clone(), 1024);
+        let installs = AtomicUsize::new(0);
+        let pip = ["pip".to_string()];
+        let key = DependencyCache::key("python:3.11", &pip, &[], "requests==2.32.3\n");
+        assert_ne!(
+            key,
+            DependencyCache::key("python:3.12", &pip, &[], "requests==2.32.3\n")
+        );
+
+        let (first, second) = tokio::join!(
+            install(&cache, &key, &installs),
+            install(&cache, &key, &installs)
+        );
+        assert_eq!(installs.load(Ordering::SeqCst), 1);
+        assert!(first.cached != second.cached);
+        assert!(first.path().join("package.py").is_file());
+
+        let failed = cache
+            .get_or_install("broken", |_| async {
+                Err("No matching distribution".to_string())
+            })
+            .await;
+        assert!(failed.is_err());
+        assert_eq!(fs::read_dir(&root).unwrap().count(), 1);
+
+        // Trees survive a restart
+        drop((first, second));
+        let reloaded = DependencyCache::new(root.clone(), 1024);
+        assert!(install(&reloaded, &key, &installs).await.cached);
+        fs::remove_dir_all(&root).ok();
+    }
+
+    #[tokio::test]
+    async fn test_least_recently_used_trees_are_evicted() {
+        let root = temp_root();
+        let cache = DependencyCache::new(root.clone(), 250);
+        let installs = AtomicUsize::new(0);
+
+        drop(install(&cache, "a", &installs).await);
+        let b = install(&cache, "b", &installs).await;
+        tokio::time::sleep(std::time::Duration::from_millis(10)).await;
+        drop(install(&cache, "a", &installs).await);
+        // b is least recently used but still mounted, so a goes
+        drop(install(&cache, "c", &installs).await);
+        assert!(!root.join("a").exists());
+        assert!(root.join("b").exists() && root.join("c").exists());
+        assert_eq!(cache.bytes(), 200);
+
+        drop(b);
+        drop(install(&cache, "a", &installs).await);
+        assert!(!root.join("b").exists());
+        assert_eq!(installs.load(Ordering::SeqCst), 4);
+        fs::remove_dir_all(&root).ok();
+    }
+}
@@ -0,0 +1,107 @@
+use serde::Serialize;
+
+/// A superseded part of the HTTP API. Responses to requests that use it carry a
+/// `Deprecation` header, a `Sunset` header once a removal date is set, and a warning
+/// in their JSON body.
+pub struct Deprecation {
+    /// Requests whose path starts with this use the deprecated part
+    pub path_prefix: &'static str,
+    /// Replaces `path_prefix` in the path of the successor endpoint
+    pub successor_prefix: &'static str,
+    /// Unix timestamp of when the deprecation took effect
+    pub deprecated_at: u64,
+    /// Environment variable holding the Unix timestamp after which the deprecated
+    /// part may be removed. Operators set it once they've scheduled the removal.
+    pub sunset_var: &'static str,
+    pub message: &'static str,
+}
+
+pub const DEPRECATIONS: &[Deprecation] = &[Deprecation {
+    path_prefix: "/api/v1/",
+    successor_prefix: "/v1/",
+    // 2026-10-16, when /v1 became the canonical path
+    deprecated_at: 1792108800,
+    sunset_var: "LEGACY_API_SUNSET",
+    message: "The /api/v1 path prefix is deprecated, use /v1 instead",
+}];
+
+/// Warning added to the `warnings` array of a JSON response
+#[derive(Debug, Serialize, PartialEq)]
+pub struct Warning {
+    pub code: &'static str,
+    pub message: &'static str,
+    pub deprecated_at: u64,
+    pub sunset_at: Option<u64>,
+    pub successor: String,
+}
+
+pub fn find(path: &str) -> Option<&'static Deprecation> {
+    DEPRECATIONS
+        .iter()
+        .find(|deprecation| path.starts_with(deprecation.path_prefix))
+}
+
+impl Deprecation {
+    pub fn sunset_at(&self) -> Option<u64> {
+        std::env::var(self.sunset_var)
+            .ok()
+            .and_then(|s| s.parse::<u64>().ok())
+    }
+
+    /// Path of the endpoint that replaces `path`
+    pub fn successor(&self, path: &str) -> String {
+        match path.strip_prefix(self.path_prefix) {
+            Some(rest) => format!("{}{rest}", self.successor_prefix),
+            None => path.to_string(),
+        }
+    }
+
+    pub fn warning(&self, path: &str) -> Warning {
+        Warning {
+            code: "DEPRECATED",
+            message: self.message,
+            deprecated_at: self.deprecated_at,
+            sunset_at: self.sunset_at(),
+            successor: self.successor(path),
+        }
+    }
+}
+
+/// Appends `warning` to the `warnings` array of a JSON object body. Returns `None` for
+/// bodies that aren't JSON objects, which are left as they are.
+pub fn add_warning(body: &[u8], warning: &Warning) -> Option<Vec<u8>> {
+    let mut value: serde_json::Value = serde_json::from_slice(body).ok()?;
+    let object = value.as_object_mut()?;
+    let warnings = object
+        .entry("warnings")
+        .or_insert_with(|| serde_json::Value::Array(Vec::new()))
+        .as_array_mut()?;
+    warnings.push(serde_json::to_value(warning).ok()?);
+    serde_json::to_vec(&value).ok()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_legacy_prefix_deprecation() {
+        assert!(find("/v1/execute").is_none());
+        assert!(find("/api/v2/execute").is_none());
+        let deprecation = find("/api/v1/executions/abc").unwrap();
+        assert_eq!(
+            deprecation.successor("/api/v1/executions/abc"),
+            "/v1/executions/abc"
+        );
+
+        let warning = deprecation.warning("/api/v1/execute");
+        let body = add_warning(br#"{"stdout":"hi\n"}"#, &warning).unwrap();
+        let body: serde_json::Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(body["stdout"], "hi\n");
+        assert_eq!(body["warnings"][0]["code"], "DEPRECATED");
+        assert_eq!(body["warnings"][0]["successor"], "/v1/execute");
+
+        assert!(add_warning(b"[1, 2]", &warning).is_none());
+        assert!(add_warning(b"not json", &warning).is_none());
+    }
+}
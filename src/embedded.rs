@@ -0,0 +1,271 @@
+use crate::executor::{ExecutionError, ResourceLimits, Stdin};
+use crate::priority::Scheduling;
+use std::ffi::CString;
+use std::os::unix::ffi::OsStringExt;
+use std::path::{Path, PathBuf};
+use std::process::{Output, Stdio};
+use tokio::io::AsyncWriteExt;
+use tokio::process::Command;
+
+/// Whether `EXECUTION_BACKEND` selects embedded runtimes: statically-linked
+/// interpreters run as host processes, for hosts without a container runtime
+pub fn backend_from_env() -> bool {
+    std::env::var("EXECUTION_BACKEND").is_ok_and(|backend| backend == "embedded")
+}
+
+/// Whether the interpreter a run command starts can be found, either at its path
+/// or on `PATH`
+pub fn interpreter_exists(program: &str) -> bool {
+    if program.contains('/') {
+        return Path::new(program).is_file();
+    }
+    std::env::var_os("PATH")
+        .is_some_and(|path| std::env::split_paths(&path).any(|dir| dir.join(program).is_file()))
+}
+
+/// Runs a command in `workspace` as a host process with the limits applied as
+/// rlimits. The process gets an empty environment and its own process group, so
+/// a timeout kills everything it started. Unlike a container it shares the host's
+/// filesystem and network. With a `user`, given as user and group ID, it switches
+/// to that user before the program starts, which needs root. With `scheduling` it
+/// runs at a lower CPU and I/O priority, with a `cpu` it only runs on that core,
+/// and with `cgroup_procs` it moves into the cgroup that file belongs to.
+#[allow(clippy::too_many_arguments)]
+pub async fn run(
+    workspace: &str,
+    command: &[String],
+    limits: &ResourceLimits,
+    user: Option<(u32, u32)>,
+    scheduling: Option<Scheduling>,
+    cpu: Option<usize>,
+    cgroup_procs: Option<PathBuf>,
+    stdin: Stdin<'_>,
+) -> Result<Output, ExecutionError> {
+    let (program, args) = command
+        .split_first()
+        .ok_or_else(|| ExecutionError::Execution("Empty command".to_string()))?;
+    let start_time = std::time::Instant::now();
+    let cpu_seconds = limits.cpu_time_limit.as_secs().max(1);
+    let memory_bytes = limits.memory_limit;
+    let max_files = u64::from(limits.max_files);
+    let core_bytes = limits.core_dump_limit;
+    let file_bytes = limits.file_size_limit;
+    // Allocating isn't allowed between fork and exec, so the path is prepared here
+    let cgroup_procs = cgroup_procs
+        .map(|path| CString::new(path.into_os_string().into_vec()))
+        .transpose()
+        .map_err(|e| ExecutionError::Execution(format!("Invalid cgroup path: {e}")))?;
+
+    let mut process = Command::new(program);
+    process
+        .args(args)
+        .current_dir(workspace)
+        .env_clear()
+        .env("PATH", "/usr/local/bin:/usr/bin:/bin")
+        .env("HOME", workspace)
+        .env("TMPDIR", workspace)
+        .stdin(match stdin {
+            Stdin::Bytes(_) => Stdio::piped(),
+            Stdin::File(path) => std::fs::File::open(path)
+                .map(Stdio::from)
+                .map_err(|e| ExecutionError::Execution(format!("Failed to open the input: {e}")))?,
+        })
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .kill_on_drop(true);
+    // SAFETY: only async-signal-safe calls between fork and exec
+    unsafe {
+        process.pre_exec(move || {
+            if libc::setsid() < 0 {
+                return Err(std::io::Error::last_os_error());
+            }
+            if let Some(procs) = &cgroup_procs {
+                join_cgroup(procs)?;
+            }
+            set_limit(libc::RLIMIT_CPU, cpu_seconds)?;
+            set_limit(libc::RLIMIT_NOFILE, max_files)?;
+            set_limit(libc::RLIMIT_CORE, core_bytes)?;
+            if let Some(bytes) = file_bytes {
+                set_limit(libc::RLIMIT_FSIZE, bytes)?;
+            }
+            // Not enforced everywhere, e.g. on macOS, so a failure isn't fatal
+            let _ = set_limit(libc::RLIMIT_AS, memory_bytes);
+            if let Some(scheduling) = &scheduling {
+                scheduling.lower_current_process()?;
+            }
+            if let Some(cpu) = cpu {
+                pin_to_cpu(cpu)?;
+            }
+            if let Some((uid, gid)) = user {
+                // Supplementary groups first, while still allowed to change them
+                if libc::setgroups(0, std::ptr::null()) < 0
+                    || libc::setgid(gid) < 0
+                    || libc::setuid(uid) < 0
+                {
+                    return Err(std::io::Error::last_os_error());
+                }
+            }
+            Ok(())
+        });
+    }
+
+    let mut child = process
+        .spawn()
+        .map_err(|e| ExecutionError::Execution(format!("Failed to start {program}: {e}")))?;
+    let group = child.id();
+    if let (Some(mut pipe), Stdin::Bytes(bytes)) = (child.stdin.take(), stdin) {
+        // A program that exits without reading its input closes the pipe early
+        let _ = pipe.write_all(bytes).await;
+    }
+
+    match tokio::time::timeout(limits.wall_time_limit, child.wait_with_output()).await {
+        Ok(output) => output.map_err(|e| ExecutionError::Execution(e.to_string())),
+        Err(_) => {
+            if let Some(group) = group {
+                // SAFETY: signals the process group the child leads
+                unsafe {
+                    libc::kill(-(group as libc::pid_t), libc::SIGKILL);
+                }
+            }
+            Err(ExecutionError::Timeout(start_time.elapsed().as_secs_f64()))
+        }
+    }
+}
+
+// Moves the calling process into the cgroup whose `cgroup.procs` is at `procs`.
+// Only makes syscalls, so it can run between fork and exec.
+fn join_cgroup(procs: &CString) -> std::io::Result<()> {
+    // SAFETY: `procs` is a valid C string and the buffer outlives the write
+    unsafe {
+        let fd = libc::open(procs.as_ptr(), libc::O_WRONLY | libc::O_CLOEXEC);
+        if fd < 0 {
+            return Err(std::io::Error::last_os_error());
+        }
+        let written = libc::write(fd, b"0".as_ptr().cast(), 1);
+        let error = std::io::Error::last_os_error();
+        libc::close(fd);
+        if written < 0 {
+            return Err(error);
+        }
+    }
+    Ok(())
+}
+
+// Restricts the calling process to one core. Only makes syscalls, so it can run
+// between fork and exec.
+#[cfg(target_os = "linux")]
+fn pin_to_cpu(cpu: usize) -> std::io::Result<()> {
+    // SAFETY: the set is a plain bitmask on the stack, sized for the call
+    unsafe {
+        let mut set: libc::cpu_set_t = std::mem::zeroed();
+        libc::CPU_SET(cpu, &mut set);
+        if libc::sched_setaffinity(0, std::mem::size_of::<libc::cpu_set_t>(), &set) < 0 {
+            return Err(std::io::Error::last_os_error());
+        }
+    }
+    Ok(())
+}
+
+// Startup refuses to pin executions elsewhere, since the cores can't be checked
+#[cfg(not(target_os = "linux"))]
+fn pin_to_cpu(_cpu: usize) -> std::io::Result<()> {
+    Err(std::io::Error::from(std::io::ErrorKind::Unsupported))
+}
+
+// glibc declares the resource argument of setrlimit as its own type
+#[cfg(all(target_os = "linux", target_env = "gnu"))]
+type Resource = libc::__rlimit_resource_t;
+#[cfg(not(all(target_os = "linux", target_env = "gnu")))]
+type Resource = libc::c_int;
+
+fn set_limit(resource: Resource, value: u64) -> std::io::Result<()> {
+    let limit = libc::rlimit {
+        rlim_cur: value as libc::rlim_t,
+        rlim_max: value as libc::rlim_t,
+    };
+    if unsafe { libc::setrlimit(resource, &limit) } < 0 {
+        return Err(std::io::Error::last_os_error());
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::time::Duration;
+
+    #[test]
+    fn test_interpreter_exists() {
+        assert!(interpreter_exists("sh"));
+        assert!(interpreter_exists("/bin/sh"));
+        assert!(!interpreter_exists("/nonexistent/python3"));
+    }
+
+    #[tokio::test]
+    async fn test_run() {
+        let workspace = std::env::temp_dir().to_string_lossy().into_owned();
+        let limits = ResourceLimits::default();
+        let command = [
+            "sh".to_string(),
+            "-c".to_string(),
+            "cat; echo $HOME".to_string(),
+        ];
+        let output = run(
+            &workspace,
+            &command,
+            &limits,
+            None,
+            None,
+            None,
+            None,
+            Stdin::Bytes(b"input\n"),
+        )
+        .await
+        .unwrap();
+        assert!(output.status.success());
+        assert_eq!(
+            String::from_utf8_lossy(&output.stdout),
+            format!("input\n{workspace}\n")
+        );
+
+        // Inputs in files are read straight from them
+        let input = std::env::temp_dir().join(format!("isobox-stdin-{}", std::process::id()));
+        std::fs::write(&input, "from a file\n").unwrap();
+        let command = ["cat".to_string()];
+        let output = run(
+            &workspace,
+            &command,
+            &limits,
+            None,
+            None,
+            None,
+            None,
+            Stdin::File(&input),
+        )
+        .await
+        .unwrap();
+        std::fs::remove_file(&input).unwrap();
+        assert_eq!(String::from_utf8_lossy(&output.stdout), "from a file\n");
+
+        let limits = ResourceLimits {
+            wall_time_limit: Duration::from_millis(200),
+            ..ResourceLimits::default()
+        };
+        let command = ["sh".to_string(), "-c".to_string(), "sleep 5".to_string()];
+        match run(
+            &workspace,
+            &command,
+            &limits,
+            None,
+            None,
+            None,
+            None,
+            Stdin::Bytes(b""),
+        )
+        .await
+        {
+            Err(ExecutionError::Timeout(_)) => {}
+            other => panic!("Expected a timeout, got {other:?}"),
+        }
+    }
+}
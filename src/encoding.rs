@@ -0,0 +1,268 @@
+use crate::api_error::{ApiError, ErrorCode};
+use crate::contention::CpuContention;
+use crate::executor::ExecuteResponse;
+use crate::generated::isobox as proto;
+use actix_web::http::{header, StatusCode};
+use actix_web::{HttpRequest, HttpResponse};
+use prost::Message;
+use serde::Serialize;
+
+/// Response body encodings a client can ask for with its `Accept` header
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum Encoding {
+    Json,
+    MessagePack,
+    Protobuf,
+}
+
+impl Encoding {
+    fn from_media_type(media_type: &str) -> Option<Self> {
+        match media_type {
+            "*/*" | "application/*" | "application/json" => Some(Encoding::Json),
+            "application/msgpack" | "application/x-msgpack" | "application/vnd.msgpack" => {
+                Some(Encoding::MessagePack)
+            }
+            "application/x-protobuf" | "application/protobuf" => Some(Encoding::Protobuf),
+            _ => None,
+        }
+    }
+
+    pub fn content_type(self) -> &'static str {
+        match self {
+            Encoding::Json => "application/json",
+            Encoding::MessagePack => "application/msgpack",
+            Encoding::Protobuf => "application/x-protobuf",
+        }
+    }
+
+    /// Picks the encoding in `available` that the `Accept` header rates highest, the
+    /// earliest listed on a tie. Falls back to JSON when the header is missing or
+    /// accepts none of them, so clients that don't negotiate keep getting JSON.
+    pub fn negotiate(accept: Option<&str>, available: &[Encoding]) -> Encoding {
+        let mut best: Option<(Encoding, f32)> = None;
+        for entry in accept.unwrap_or_default().split(',') {
+            let mut parts = entry.split(';');
+            let media_type = parts.next().unwrap_or_default().trim().to_ascii_lowercase();
+            let quality = parts
+                .filter_map(|param| param.trim().strip_prefix("q="))
+                .find_map(|q| q.parse::<f32>().ok())
+                .unwrap_or(1.0);
+            let Some(encoding) = Self::from_media_type(&media_type) else {
+                continue;
+            };
+            if quality > 0.0
+                && available.contains(&encoding)
+                && best.map_or(true, |(_, best_quality)| quality > best_quality)
+            {
+                best = Some((encoding, quality));
+            }
+        }
+        best.map_or(Encoding::Json, |(encoding, _)| encoding)
+    }
+}
+
+fn negotiate(request: &HttpRequest, available: &[Encoding]) -> Encoding {
+    let accept = request
+        .headers()
+        .get(header::ACCEPT)
+        .and_then(|value| value.to_str().ok());
+    Encoding::negotiate(accept, available)
+}
+
+fn encoded(status: StatusCode, encoding: Encoding, body: Vec<u8>) -> HttpResponse {
+    HttpResponse::build(status)
+        .content_type(encoding.content_type())
+        .insert_header((header::VARY, "Accept"))
+        .body(body)
+}
+
+fn msgpack<T: Serialize>(status: StatusCode, value: &T) -> HttpResponse {
+    // Named fields keep the same map keys as the JSON encoding
+    match rmp_serde::to_vec_named(value) {
+        Ok(body) => encoded(status, Encoding::MessagePack, body),
+        Err(e) => ApiError::new(
+            ErrorCode::Internal,
+            format!("Failed to encode response: {e}"),
+        )
+        .response(),
+    }
+}
+
+/// Responds with `value` as JSON or MessagePack, whichever the client prefers
+pub fn respond<T: Serialize>(request: &HttpRequest, status: StatusCode, value: &T) -> HttpResponse {
+    match negotiate(request, &[Encoding::Json, Encoding::MessagePack]) {
+        Encoding::MessagePack => msgpack(status, value),
+        _ => HttpResponse::build(status)
+            .insert_header((header::VARY, "Accept"))
+            .json(value),
+    }
+}
+
+/// Responds with an execution result as JSON, MessagePack, or protobuf
+pub fn respond_execution(request: &HttpRequest, response: &ExecuteResponse) -> HttpResponse {
+    let available = [Encoding::Json, Encoding::MessagePack, Encoding::Protobuf];
+    match negotiate(request, &available) {
+        Encoding::Protobuf => encoded(
+            StatusCode::OK,
+            Encoding::Protobuf,
+            proto::ExecutionResult::from(response).encode_to_vec(),
+        ),
+        _ => respond(request, StatusCode::OK, response),
+    }
+}
+
+impl From<&ExecuteResponse> for proto::ExecutionResult {
+    fn from(response: &ExecuteResponse) -> Self {
+        Self {
+            stdout: response.stdout.clone(),
+            stderr: response.stderr.clone(),
+            exit_code: response.exit_code,
+            time_taken: response.time_taken,
+            memory_used: response.memory_used,
+            swap_used: response.swap_used,
+            test_results: response
+                .test_results
+                .iter()
+                .flatten()
+                .map(|result| proto::TestCaseResult {
+                    name: result.name.clone(),
+                    passed: result.passed,
+                    stdout: result.stdout.clone(),
+                    stderr: result.stderr.clone(),
+                    exit_code: result.exit_code,
+                    time_taken: result.time_taken,
+                    memory_used: result.memory_used,
+                    swap_used: result.swap_used,
+                    error_message: result.error_message.clone(),
+                    input: result.input.clone(),
+                    expected_output: result.expected_output.clone(),
+                    actual_output: result.actual_output.clone(),
+                    term_signal: result.term_signal.clone(),
+                    term_reason: result.term_reason.clone(),
+                    group: result.group.clone(),
+                    hidden: result.hidden,
+                    skipped: result.skipped,
+                    judge_message: result.judge_message.clone(),
+                    verdict: result.verdict.map(|verdict| verdict.as_str().to_string()),
+                    cpu_contention: result.cpu_contention.map(proto::CpuContention::from),
+                })
+                .collect(),
+            execution_id: response.execution_id.clone(),
+            artifacts: response
+                .artifacts
+                .iter()
+                .flatten()
+                .map(|artifact| proto::Artifact {
+                    path: artifact.path.clone(),
+                    size: artifact.size,
+                })
+                .collect(),
+            workdir_archive: response.workdir_archive.as_ref().map(|archive| {
+                proto::WorkdirArchive {
+                    size: archive.size,
+                    truncated: archive.truncated,
+                }
+            }),
+            gpu_seconds: response.gpu_seconds,
+            emulated: response.emulated,
+            return_value: response
+                .return_value
+                .as_ref()
+                .map(|value| value.to_string()),
+            channel: response.channel.map(|channel| channel.as_str().to_string()),
+            term_signal: response.term_signal.clone(),
+            term_reason: response.term_reason.clone(),
+            backtrace: response.backtrace.clone(),
+            dependencies_cached: response.dependencies_cached,
+            cached: response.cached,
+            verdict: response.verdict.map(|verdict| verdict.as_str().to_string()),
+            failed_test: response.failed_test.map(|index| index as u32),
+            cpu_contention: response.cpu_contention.map(proto::CpuContention::from),
+            trace_id: response.trace_id.clone(),
+            score: response.score.as_ref().map(|score| proto::TestScore {
+                points: score.points,
+                max_points: score.max_points,
+                groups: score
+                    .groups
+                    .iter()
+                    .map(|group| proto::GroupScore {
+                        name: group.name.clone(),
+                        points: group.points,
+                        max_points: group.max_points,
+                        passed: group.passed,
+                    })
+                    .collect(),
+            }),
+        }
+    }
+}
+
+impl From<CpuContention> for proto::CpuContention {
+    fn from(contention: CpuContention) -> Self {
+        Self {
+            periods: contention.periods,
+            throttled_periods: contention.throttled_periods,
+            throttled_seconds: contention.throttled_seconds,
+            steal_seconds: contention.steal_seconds,
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_negotiate() {
+        let all = [Encoding::Json, Encoding::MessagePack, Encoding::Protobuf];
+        assert_eq!(Encoding::negotiate(None, &all), Encoding::Json);
+        assert_eq!(
+            Encoding::negotiate(Some("application/msgpack"), &all),
+            Encoding::MessagePack
+        );
+        assert_eq!(
+            Encoding::negotiate(Some("application/json;q=0.5, application/x-protobuf"), &all),
+            Encoding::Protobuf
+        );
+        // Equal quality goes to the first listed
+        assert_eq!(
+            Encoding::negotiate(Some("application/json, application/msgpack"), &all),
+            Encoding::Json
+        );
+        // Protobuf isn't offered for every response
+        assert_eq!(
+            Encoding::negotiate(
+                Some("application/x-protobuf, application/msgpack;q=0.8"),
+                &[Encoding::Json, Encoding::MessagePack]
+            ),
+            Encoding::MessagePack
+        );
+        assert_eq!(
+            Encoding::negotiate(Some("text/html, application/msgpack;q=0"), &all),
+            Encoding::Json
+        );
+    }
+
+    #[test]
+    fn test_execution_result_round_trip() {
+        let response = ExecuteResponse {
+            stdout: "hi\n".to_string(),
+            exit_code: 0,
+            time_taken: Some(0.25),
+            execution_id: Some("abc".to_string()),
+            ..Default::default()
+        };
+
+        let bytes = proto::ExecutionResult::from(&response).encode_to_vec();
+        let decoded = proto::ExecutionResult::decode(bytes.as_slice()).unwrap();
+        assert_eq!(decoded.stdout, "hi\n");
+        assert_eq!(decoded.time_taken, Some(0.25));
+        assert_eq!(decoded.execution_id.as_deref(), Some("abc"));
+        assert!(decoded.test_results.is_empty());
+
+        let packed = rmp_serde::to_vec_named(&response).unwrap();
+        let unpacked: ExecuteResponse = rmp_serde::from_slice(&packed).unwrap();
+        assert_eq!(unpacked.stdout, "hi\n");
+        assert_eq!(unpacked.execution_id.as_deref(), Some("abc"));
+    }
+}
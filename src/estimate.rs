@@ -0,0 +1,110 @@
+use crate::config::{LanguageLimits, MeteringConfig};
+use crate::executor::ExecutionPlan;
+use serde::Serialize;
+
+/// The most an execution can consume under its limits
+#[derive(Debug, Clone, Serialize, PartialEq)]
+pub struct Reservation {
+    pub cpu_seconds: u64,
+    pub wall_seconds: u64,
+    pub memory_mb: u64,
+    /// Wall time with the GPUs attached; 0 without a GPU
+    pub gpu_seconds: u64,
+}
+
+impl Reservation {
+    pub fn new(limits: &LanguageLimits, gpu: bool) -> Self {
+        let wall_seconds = limits.wall_time_seconds.unwrap_or_default();
+        Self {
+            cpu_seconds: limits.cpu_time_seconds.unwrap_or_default(),
+            wall_seconds,
+            memory_mb: limits.memory_mb.unwrap_or_default(),
+            gpu_seconds: if gpu { wall_seconds } else { 0 },
+        }
+    }
+}
+
+/// Billable units of a reservation, per resource and in total
+#[derive(Debug, Clone, Serialize)]
+pub struct BillableUnits {
+    pub unit: String,
+    pub execution: f64,
+    pub cpu: f64,
+    pub memory: f64,
+    pub gpu: f64,
+    pub total: f64,
+}
+
+impl BillableUnits {
+    pub fn new(reservation: &Reservation, metering: &MeteringConfig) -> Self {
+        let memory_gb = reservation.memory_mb as f64 / 1024.0;
+        let execution = metering.per_execution;
+        let cpu = reservation.cpu_seconds as f64 * metering.per_cpu_second;
+        let memory = memory_gb * reservation.wall_seconds as f64 * metering.per_gb_second;
+        let gpu = reservation.gpu_seconds as f64 * metering.per_gpu_second;
+        Self {
+            unit: metering.unit.clone(),
+            execution,
+            cpu,
+            memory,
+            gpu,
+            total: execution + cpu + memory + gpu,
+        }
+    }
+}
+
+/// What a request would reserve and, with metering configured, cost at most
+#[derive(Debug, Serialize)]
+pub struct Estimate {
+    pub language: String,
+    pub backend: &'static str,
+    pub limits: LanguageLimits,
+    pub reservation: Reservation,
+    pub billable: Option<BillableUnits>,
+}
+
+impl Estimate {
+    pub fn new(plan: ExecutionPlan, metering: Option<&MeteringConfig>) -> Self {
+        let reservation = Reservation::new(&plan.limits, plan.gpu);
+        Self {
+            billable: metering.map(|metering| BillableUnits::new(&reservation, metering)),
+            language: plan.language,
+            backend: plan.backend,
+            limits: plan.limits,
+            reservation,
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_billable_units_of_a_reservation() {
+        let limits = LanguageLimits {
+            cpu_time_seconds: Some(10),
+            wall_time_seconds: Some(20),
+            memory_mb: Some(512),
+            ..Default::default()
+        };
+        let reservation = Reservation::new(&limits, true);
+        assert_eq!(reservation.gpu_seconds, 20);
+        assert_eq!(Reservation::new(&limits, false).gpu_seconds, 0);
+
+        let metering = MeteringConfig {
+            unit: "cents".to_string(),
+            per_execution: 0.5,
+            per_cpu_second: 0.1,
+            per_gb_second: 0.05,
+            per_gpu_second: 1.0,
+        };
+        let billable = BillableUnits::new(&reservation, &metering);
+        assert_eq!(billable.unit, "cents");
+        assert_eq!(
+            (billable.cpu, billable.memory, billable.gpu),
+            (1.0, 0.5, 20.0)
+        );
+        assert_eq!(billable.total, 22.0);
+    }
+}
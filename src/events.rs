@@ -0,0 +1,310 @@
+use crate::executor::{ExecuteResponse, ExecutionError};
+use crate::security::SecurityAlert;
+use crate::session::{Session, SessionNotice};
+use crate::store::unix_timestamp;
+use serde::{Deserialize, Serialize};
+use std::sync::Arc;
+use tokio::sync::broadcast;
+
+#[cfg(feature = "kafka")]
+mod kafka;
+
+#[derive(Debug, Clone, Copy, PartialEq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum EventKind {
+    Queued,
+    Started,
+    Finished,
+    /// A session will be closed soon, unless it's used again before an idle timeout
+    SessionExpiring,
+    SessionClosed,
+    /// An execution showed signs of trying to escape its sandbox
+    SecurityAlert,
+}
+
+impl EventKind {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            EventKind::Queued => "queued",
+            EventKind::Started => "started",
+            EventKind::Finished => "finished",
+            EventKind::SessionExpiring => "session_expiring",
+            EventKind::SessionClosed => "session_closed",
+            EventKind::SecurityAlert => "security_alert",
+        }
+    }
+}
+
+/// Outcome of a finished execution, without its output
+#[derive(Debug, Clone, Serialize)]
+pub struct ResultSummary {
+    pub exit_code: i32,
+    pub time_taken: Option<f64>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub tests_passed: Option<usize>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub tests_total: Option<usize>,
+}
+
+/// A step in an execution's lifecycle. Queued executions keep their job id, so all
+/// events of one execution share the same `id`. Session events carry the session's
+/// id instead.
+#[derive(Debug, Clone, Serialize)]
+pub struct ExecutionEvent {
+    pub id: String,
+    pub event: EventKind,
+    pub tenant: String,
+    pub language: String,
+    pub timestamp: u64,
+    // Set on finished events for executions that ran
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub result: Option<ResultSummary>,
+    // Set on finished events for executions that failed before producing a result
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub error: Option<String>,
+    // Set on session events
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub session: Option<SessionNotice>,
+    // Set on security alert events
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub alerts: Option<Vec<SecurityAlert>>,
+}
+
+impl ExecutionEvent {
+    fn new(event: EventKind, id: &str, tenant: &str, language: &str) -> Self {
+        Self {
+            id: id.to_string(),
+            event,
+            tenant: tenant.to_string(),
+            language: language.to_string(),
+            timestamp: unix_timestamp(),
+            result: None,
+            error: None,
+            session: None,
+            alerts: None,
+        }
+    }
+
+    pub fn queued(id: &str, tenant: &str, language: &str) -> Self {
+        Self::new(EventKind::Queued, id, tenant, language)
+    }
+
+    pub fn started(id: &str, tenant: &str, language: &str) -> Self {
+        Self::new(EventKind::Started, id, tenant, language)
+    }
+
+    pub fn session(event: EventKind, session: &Session, notice: SessionNotice) -> Self {
+        let mut event = Self::new(event, &session.id, &session.tenant, &session.language);
+        event.session = Some(notice);
+        event
+    }
+
+    pub fn security_alert(
+        id: &str,
+        tenant: &str,
+        language: &str,
+        alerts: Vec<SecurityAlert>,
+    ) -> Self {
+        let mut event = Self::new(EventKind::SecurityAlert, id, tenant, language);
+        event.alerts = Some(alerts);
+        event
+    }
+
+    /// Formats the event as a Server-Sent Events message
+    pub fn to_sse(&self) -> String {
+        let data = serde_json::to_string(self).unwrap_or_default();
+        format!("event: {}\ndata: {data}\n\n", self.event.as_str())
+    }
+
+    pub fn finished(
+        id: &str,
+        tenant: &str,
+        language: &str,
+        result: &Result<ExecuteResponse, ExecutionError>,
+    ) -> Self {
+        let mut event = Self::new(EventKind::Finished, id, tenant, language);
+        match result {
+            Ok(response) => {
+                let tests = response.test_results.as_ref();
+                event.result = Some(ResultSummary {
+                    exit_code: response.exit_code,
+                    time_taken: response.time_taken,
+                    tests_passed: tests.map(|tests| tests.iter().filter(|t| t.passed).count()),
+                    tests_total: tests.map(|tests| tests.len()),
+                });
+            }
+            Err(e) => event.error = Some(e.to_string()),
+        }
+        event
+    }
+}
+
+/// Destination for execution events. Publishing must not block the execution.
+pub trait EventSink: Send + Sync {
+    fn publish(&self, event: &ExecutionEvent);
+}
+
+// Lets a sink be registered on the bus while its owner keeps reading from it
+impl<T: EventSink + ?Sized> EventSink for Arc<T> {
+    fn publish(&self, event: &ExecutionEvent) {
+        (**self).publish(event);
+    }
+}
+
+// Events buffered per live subscriber before it starts missing events
+const SUBSCRIBER_BUFFER: usize = 1024;
+
+/// Fans execution events out to every configured sink and to live subscribers
+pub struct EventBus {
+    sinks: Vec<Box<dyn EventSink>>,
+    live: broadcast::Sender<ExecutionEvent>,
+}
+
+impl Default for EventBus {
+    fn default() -> Self {
+        Self::new()
+    }
+}
+
+impl EventBus {
+    pub fn new() -> Self {
+        Self {
+            sinks: Vec::new(),
+            live: broadcast::channel(SUBSCRIBER_BUFFER).0,
+        }
+    }
+
+    /// Adds a Kafka sink when `KAFKA_BROKERS` is set
+    pub fn from_env() -> Result<Self, String> {
+        let mut bus = Self::new();
+        if let Ok(brokers) = std::env::var("KAFKA_BROKERS") {
+            let topic = std::env::var("KAFKA_EVENTS_TOPIC")
+                .unwrap_or_else(|_| "isobox-executions".to_string());
+            bus = bus.with_sink(kafka_sink(&brokers, &topic)?);
+        }
+        Ok(bus)
+    }
+
+    pub fn with_sink(mut self, sink: Box<dyn EventSink>) -> Self {
+        self.sinks.push(sink);
+        self
+    }
+
+    pub fn publish(&self, event: &ExecutionEvent) {
+        for sink in &self.sinks {
+            sink.publish(event);
+        }
+        // Fails only when nobody is subscribed
+        let _ = self.live.send(event.clone());
+    }
+
+    /// Receives every event published from now on, for all tenants
+    pub fn subscribe(&self) -> broadcast::Receiver<ExecutionEvent> {
+        self.live.subscribe()
+    }
+}
+
+#[cfg(feature = "kafka")]
+fn kafka_sink(brokers: &str, topic: &str) -> Result<Box<dyn EventSink>, String> {
+    Ok(Box::new(kafka::KafkaSink::new(brokers, topic)?))
+}
+
+#[cfg(not(feature = "kafka"))]
+fn kafka_sink(_brokers: &str, _topic: &str) -> Result<Box<dyn EventSink>, String> {
+    Err("KAFKA_BROKERS is set but this build does not include the kafka feature".to_string())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::executor::TestCaseResult;
+    use std::sync::{Arc, Mutex};
+
+    struct RecordingSink(Arc<Mutex<Vec<ExecutionEvent>>>);
+
+    impl EventSink for RecordingSink {
+        fn publish(&self, event: &ExecutionEvent) {
+            self.0.lock().unwrap().push(event.clone());
+        }
+    }
+
+    fn test_result(name: &str, passed: bool) -> TestCaseResult {
+        TestCaseResult {
+            name: name.to_string(),
+            passed,
+            stdout: String::new(),
+            stderr: String::new(),
+            exit_code: 0,
+            time_taken: None,
+            memory_used: None,
+            swap_used: None,
+            error_message: None,
+            input: String::new(),
+            expected_output: None,
+            actual_output: String::new(),
+            term_signal: None,
+            term_reason: None,
+            group: None,
+            hidden: None,
+            skipped: None,
+            judge_message: None,
+            verdict: None,
+            cpu_contention: None,
+        }
+    }
+
+    #[test]
+    fn test_finished_event_summarizes_result() {
+        let events = Arc::new(Mutex::new(Vec::new()));
+        let bus = EventBus::new().with_sink(Box::new(RecordingSink(events.clone())));
+
+        let response = ExecuteResponse {
+            stdout: "secret output".to_string(),
+            exit_code: 1,
+            test_results: Some(vec![test_result("a", true), test_result("b", false)]),
+            ..Default::default()
+        };
+        bus.publish(&ExecutionEvent::started("job-1", "cs101", "python"));
+        bus.publish(&ExecutionEvent::finished(
+            "job-1",
+            "cs101",
+            "python",
+            &Ok(response),
+        ));
+        bus.publish(&ExecutionEvent::finished(
+            "job-2",
+            "cs101",
+            "cobol",
+            &Err(ExecutionError::UnsupportedLanguage("cobol".to_string())),
+        ));
+
+        let events = events.lock().unwrap();
+        assert_eq!(events.len(), 3);
+        assert_eq!(events[0].event, EventKind::Started);
+        let summary = events[1].result.as_ref().unwrap();
+        assert_eq!(summary.exit_code, 1);
+        assert_eq!(summary.tests_passed, Some(1));
+        assert_eq!(summary.tests_total, Some(2));
+        assert!(!serde_json::to_string(&events[1])
+            .unwrap()
+            .contains("secret output"));
+        assert!(events[2].result.is_none());
+        assert!(events[2].error.as_ref().unwrap().contains("cobol"));
+    }
+
+    #[test]
+    fn test_subscribers_receive_events_as_sse() {
+        let bus = EventBus::new();
+        bus.publish(&ExecutionEvent::queued("job-0", "cs101", "python"));
+
+        let mut receiver = bus.subscribe();
+        bus.publish(&ExecutionEvent::queued("job-1", "cs101", "python"));
+        let event = receiver.try_recv().unwrap();
+        assert_eq!(event.id, "job-1");
+        assert!(receiver.try_recv().is_err());
+
+        let sse = event.to_sse();
+        assert!(sse.starts_with("event: queued\ndata: {"));
+        assert!(sse.ends_with("}\n\n"));
+    }
+}
@@ -0,0 +1,56 @@
+use super::{EventSink, ExecutionEvent};
+use rdkafka::config::ClientConfig;
+use rdkafka::producer::{FutureProducer, FutureRecord};
+
+/// Publishes events as JSON keyed by execution id, so the events of one execution
+/// land on the same partition in order
+pub struct KafkaSink {
+    producer: FutureProducer,
+    topic: String,
+}
+
+impl KafkaSink {
+    pub fn new(brokers: &str, topic: &str) -> Result<Self, String> {
+        let producer = ClientConfig::new()
+            .set("bootstrap.servers", brokers)
+            .set("message.timeout.ms", "30000")
+            .create()
+            .map_err(|e| format!("Failed to create Kafka producer: {e}"))?;
+        log::info!("Publishing execution events to Kafka topic {topic} on {brokers}");
+        Ok(Self {
+            producer,
+            topic: topic.to_string(),
+        })
+    }
+}
+
+impl EventSink for KafkaSink {
+    fn publish(&self, event: &ExecutionEvent) {
+        let payload = match serde_json::to_string(event) {
+            Ok(payload) => payload,
+            Err(e) => {
+                log::warn!("Failed to encode execution event: {e}");
+                return;
+            }
+        };
+        // Enqueue synchronously to keep per-execution order; only the delivery
+        // report is awaited in the background
+        let record = FutureRecord::to(&self.topic)
+            .key(&event.id)
+            .payload(&payload);
+        let delivery = match self.producer.send_result(record) {
+            Ok(delivery) => delivery,
+            Err((e, _)) => {
+                log::warn!("Failed to queue execution event for Kafka: {e}");
+                return;
+            }
+        };
+        tokio::spawn(async move {
+            match delivery.await {
+                Ok(Ok(_)) => {}
+                Ok(Err((e, _))) => log::warn!("Failed to deliver execution event to Kafka: {e}"),
+                Err(_) => log::warn!("Kafka producer dropped an execution event"),
+            }
+        });
+    }
+}
@@ -1,25 +1,173 @@
+use crate::abuse::AbuseMonitor;
+use crate::ansi::AnsiMode;
+use crate::bundle::{BundleLayout, BundleStore};
+use crate::cache::CacheManager;
+use crate::cgroup::{CgroupManager, PeakUsage};
+use crate::concurrency::LanguageSlots;
+use crate::config::{
+    pinned_digest, AbuseConfig, Channel, DependencyConfig, EmbeddedRuntimeConfig, IsoboxConfig,
+    LanguageLimits, MetricLabelsConfig, PresetConfig, Ulimits, DEFAULT_TENANT, DEFAULT_TMPFS_MB,
+};
+use crate::contention::{CpuContention, StealSample};
+use crate::coredump;
+use crate::cpuset::CpuPool;
+use crate::dataset::{DatasetStore, DATASETS_MOUNT_ROOT};
+use crate::deadline;
+use crate::dependencies::{DependencyCache, DependencyLease};
+use crate::embedded;
+use crate::events::{EventBus, ExecutionEvent};
+use crate::function_call::{self, FunctionCall};
+use crate::hooks::{ExecutionHook, HookChain, HookError};
+use crate::interactor;
+use crate::judge::{self, JudgeProgram, TestGroup, TestScore, Verdict};
+use crate::labels::{self, LabelMetrics};
+use crate::latency::{LatencyMonitor, PhaseTimings};
+use crate::preset::PresetRegistry;
+use crate::priority::{Priority, Scheduling};
+use crate::redact::Redactor;
+use crate::result_cache::ResultCache;
+use crate::scan::ImageScanner;
+use crate::seccomp::{self, SyscallFilter, SyscallPolicy};
+use crate::security;
+use crate::stats;
+use crate::store::{
+    unix_timestamp, ArchiveInfo, ArtifactInfo, ExecutionRecord, ExecutionStatus, ExecutionStore,
+    RecordedInput,
+};
+use crate::syntax::{self, Diagnostic, Severity};
+use crate::terminal::Terminal;
+use crate::termination;
+use crate::trace::{self, Tracer};
+use crate::trace_context::TraceContext;
+use crate::usage::UsageMeter;
+use crate::userns::{self, UserMapping};
+use crate::worker::{JobFailure, WorkerRegistry};
 use serde::{Deserialize, Serialize};
-use std::collections::HashMap;
+use std::collections::{HashMap, HashSet};
 use std::fs;
+use std::path::{Component, Path, PathBuf};
 use std::process::Command;
-use std::time::Duration;
+use std::sync::Arc;
+use std::time::{Duration, SystemTime};
 use tokio::time::timeout;
 use uuid::Uuid;
 
-#[derive(Debug, Deserialize)]
+#[derive(Debug, Default, Clone, Serialize, Deserialize)]
 pub struct ExecuteRequest {
     pub language: String,
     pub code: String,
     pub test_cases: Option<Vec<TestCase>>,
+    // Points awarded per group of test cases, like contest subtasks
+    pub test_groups: Option<Vec<TestGroup>>,
+    // Skips the rest of a test case's group once it fails; test cases without a
+    // group form one group
+    pub stop_on_failure: Option<bool>,
+    // Judge's program the submission talks to instead of reading a test case's
+    // input, for interactive problems
+    pub interactor: Option<JudgeProgram>,
+    // Judge's program that decides whether a test case's output is right, for
+    // problems with more than one right answer
+    pub checker: Option<JudgeProgram>,
+    // Selects one of the configured image versions for the language
+    pub version: Option<String>,
+    // Configured environment with packages preinstalled, e.g. "python-datasci"
+    pub preset: Option<String>,
+    // Replaces the language's run command; must be allow-listed for the tenant
+    pub command: Option<Vec<String>>,
+    // Absolute path the workspace is mounted at inside the sandbox (default /workspace)
+    pub workdir: Option<String>,
+    // Workspace-relative path the code is written to and run from
+    pub entrypoint: Option<String>,
+    // Additional files placed in the workspace next to the entrypoint
+    pub files: Option<Vec<WorkspaceFile>>,
+    // Capture the final workdir as a tarball artifact
+    pub archive_workdir: Option<bool>,
+    // Registered datasets mounted read-only under /datasets
+    pub datasets: Option<Vec<String>>,
+    // Run with the NVIDIA runtime on a GPU-capable worker
+    pub gpu: Option<bool>,
+    // Target CPU architecture, "amd64" or "arm64"
+    pub arch: Option<String>,
+    // Free-form tags for finding the execution in the history later; a map of
+    // key-value labels is accepted too and stored as `key:value` tags
+    #[serde(default, deserialize_with = "labels::deserialize")]
+    pub labels: Option<Vec<String>>,
+    // Configured harness template the code is wrapped in before it runs
+    pub harness: Option<String>,
+    // Values for the harness template's parameters
+    pub harness_params: Option<HashMap<String, String>>,
+    // Calls a function the code defines with JSON arguments instead of running it
+    pub function: Option<FunctionCall>,
+    // Tighter ulimits than the language's, e.g. a small `fsize` for an exercise
+    // about output files
+    pub ulimits: Option<Ulimits>,
+    // `batch` runs get fewer CPU shares and a lower I/O priority than interactive
+    // ones on the same worker
+    pub priority: Option<Priority>,
+    // Runtime channel for languages with a staged next runtime; picked by the server
+    // when unset
+    pub channel: Option<Channel>,
+    // Lets a crashing program write a core dump, returned as an artifact with a
+    // backtrace
+    pub debug: Option<bool>,
+    // Runs the program under strace and returns the syscall trace as an artifact;
+    // admin tenants only
+    pub trace: Option<bool>,
+    // Size of the client's terminal, passed to the program as `COLUMNS` and `LINES`
+    pub terminal: Option<Terminal>,
+    // Whether ANSI escape sequences are stripped from the output; by default they
+    // are, unless the request describes a terminal
+    pub ansi: Option<AnsiMode>,
+    // Whether the result may come from, and is stored in, the result cache; the
+    // server's DEDUP_ENABLED decides when unset
+    pub cache: Option<bool>,
+    // Set by the server from the authenticated caller, never by the client
+    #[serde(skip)]
+    pub tenant: Option<String>,
+    // Set by the server to reuse an existing id, e.g. a queued job's
+    #[serde(skip)]
+    pub execution_id: Option<String>,
+    // Set by the job consumer to how long the job waited in the queue
+    #[serde(skip)]
+    pub queue_wait: Option<Duration>,
+    // Set by the server from the caller's deadline; the execution doesn't start
+    // after it, and its wall time ends at it
+    #[serde(skip)]
+    pub deadline: Option<SystemTime>,
+    // Set by the server from the caller's traceparent and tracestate headers, and
+    // serialized so it reaches queue consumers and worker agents
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub trace_context: Option<TraceContext>,
+    // Set by the upload endpoint: test case inputs streamed to files on this host,
+    // by test case name, which the program reads instead of `input`
+    #[serde(skip)]
+    pub uploaded_inputs: HashMap<String, PathBuf>,
 }
 
 #[derive(Debug, Deserialize, Serialize, Clone)]
+pub struct WorkspaceFile {
+    // Path relative to the workspace root, e.g. "data/input.csv"
+    pub path: String,
+    pub content: String,
+    // Octal permission bits, e.g. "0755"
+    pub mode: Option<String>,
+}
+
+#[derive(Debug, Default, Deserialize, Serialize, Clone)]
 pub struct TestCase {
     pub name: String,
+    // May be left out when the input is uploaded as a part of its own
+    #[serde(default)]
     pub input: String,
     pub expected_output: Option<String>,
     pub timeout_seconds: Option<u32>,
     pub memory_limit_mb: Option<u64>,
+    // One of the request's test groups
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub group: Option<String>,
+    // Hidden test cases only report whether they passed, never their data or output
+    #[serde(default)]
+    pub hidden: bool,
 }
 
 #[derive(Debug, Serialize, Deserialize, Clone)]
@@ -31,20 +179,110 @@ pub struct TestCaseResult {
     pub exit_code: i32,
     pub time_taken: Option<f64>,
     pub memory_used: Option<u64>,
+    // Most swap the program used at once, when its cgroup is managed
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub swap_used: Option<u64>,
     pub error_message: Option<String>,
     pub input: String,
     pub expected_output: Option<String>,
     pub actual_output: String,
+    // Signal that killed the program, e.g. "SIGSEGV", and why it was sent
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub term_signal: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub term_reason: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub group: Option<String>,
+    // Set for hidden test cases, whose data and output are left out
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub hidden: Option<bool>,
+    // Set when the test case wasn't run because an earlier one in its group failed
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub skipped: Option<bool>,
+    // What the request's interactor or checker reported about the test case
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub judge_message: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub verdict: Option<Verdict>,
+    // CPU time the run lost to its cgroup's quota or to steal time
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub cpu_contention: Option<CpuContention>,
 }
 
-#[derive(Debug, Serialize, Deserialize, Clone)]
+#[derive(Debug, Default, Serialize, Deserialize, Clone)]
 pub struct ExecuteResponse {
     pub stdout: String,
     pub stderr: String,
     pub exit_code: i32,
     pub time_taken: Option<f64>,
     pub memory_used: Option<u64>,
+    // Most swap the program used at once, when its cgroup is managed
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub swap_used: Option<u64>,
     pub test_results: Option<Vec<TestCaseResult>>,
+    // Identifies the stored execution, e.g. for downloading its artifacts
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub execution_id: Option<String>,
+    // Files the program created in its workspace
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub artifacts: Option<Vec<ArtifactInfo>>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub workdir_archive: Option<ArchiveInfo>,
+    // Wall-clock seconds the run held a GPU, for requests with `gpu: true`
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub gpu_seconds: Option<f64>,
+    // Set when the requested architecture was emulated rather than run natively,
+    // so timing and some low-level behavior may differ from real hardware
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub emulated: Option<bool>,
+    // What the function returned, for requests with `function`; absent when it didn't
+    // return, e.g. because it raised an error
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub return_value: Option<serde_json::Value>,
+    // Runtime channel the execution ran on, for languages with a next channel
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub channel: Option<Channel>,
+    // Signal that killed the program, e.g. "SIGKILL", and why it was sent, e.g.
+    // "killed by memory limit"
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub term_signal: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub term_reason: Option<String>,
+    // Backtrace from the core dump of a crashed `debug` run, if the image has gdb
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub backtrace: Option<String>,
+    // Whether the dependencies of the request's lockfile were already installed;
+    // absent for requests without one
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub dependencies_cached: Option<bool>,
+    // Set when the result is a stored one of an identical earlier request
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub cached: Option<bool>,
+    // Points per test group, for requests with `test_groups`
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub score: Option<TestScore>,
+    // The first failed test case's verdict, or accepted, for requests with test cases
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub verdict: Option<Verdict>,
+    // Index of the first failed test case
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub failed_test: Option<usize>,
+    // CPU time the run lost to its cgroup's quota or to steal time
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub cpu_contention: Option<CpuContention>,
+    // Trace ID from the caller's traceparent header
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub trace_id: Option<String>,
+}
+
+impl ExecuteResponse {
+    fn with_termination(mut self, termination: Option<termination::Termination>) -> Self {
+        if let Some(termination) = termination {
+            self.term_signal = Some(termination.signal.to_string());
+            self.term_reason = Some(termination.reason.to_string());
+        }
+        self
+    }
 }
 
 // Resource limits configuration inspired by Judge0
@@ -57,6 +295,9 @@ pub struct ResourceLimits {
     pub max_processes: u32,
     pub max_files: u32,
     pub enable_network: bool,
+    pub core_dump_limit: u64,         // in bytes; 0 disables core dumps
+    pub file_size_limit: Option<u64>, // in bytes; None leaves file sizes unlimited
+    pub swap_limit: u64,              // in bytes, on top of memory_limit; 0 disables swap
 }
 
 impl Default for ResourceLimits {
@@ -70,10 +311,266 @@ impl Default for ResourceLimits {
             max_processes: 50,                      // Max 50 processes
             max_files: 100,                         // Max 100 open files
             enable_network: false,                  // No network access
+            core_dump_limit: 0,                     // No core dumps
+            file_size_limit: None,                  // No file size limit
+            swap_limit: 0,                          // No swap
+        }
+    }
+}
+
+// Longest a dependency install may take before it is killed
+const DEPENDENCY_INSTALL_TIMEOUT: Duration = Duration::from_secs(600);
+// Where the lockfile is mounted during an install
+const LOCKFILE_MOUNT: &str = "/isobox-lockfile";
+// Lines of a failed install's stderr returned in the error
+const INSTALL_ERROR_LINES: usize = 20;
+
+// Mounts an install may read, such as bundles and datasets; writable caches are
+// left out so installs can't change them
+fn read_only_mounts(config: &LanguageConfig) -> impl Iterator<Item = &VolumeMount> {
+    config.extra_mounts.iter().filter(|mount| mount.read_only)
+}
+
+// Package managers need the network, and more processes, files and CPU time than
+// the programs they install for
+fn dependency_install_limits() -> ResourceLimits {
+    ResourceLimits {
+        cpu_time_limit: DEPENDENCY_INSTALL_TIMEOUT,
+        wall_time_limit: DEPENDENCY_INSTALL_TIMEOUT,
+        memory_limit: 1024 * 1024 * 1024,
+        max_processes: 256,
+        max_files: 4096,
+        enable_network: true,
+        ..Default::default()
+    }
+}
+
+impl ResourceLimits {
+    // Replaces the limits a language's configuration sets
+    fn with_overrides(mut self, limits: &LanguageLimits) -> Self {
+        if let Some(seconds) = limits.cpu_time_seconds {
+            self.cpu_time_limit = Duration::from_secs(seconds);
+        }
+        if let Some(seconds) = limits.wall_time_seconds {
+            self.wall_time_limit = Duration::from_secs(seconds);
+        }
+        if let Some(mb) = limits.memory_mb {
+            self.memory_limit = mb * 1024 * 1024;
+        }
+        if let Some(processes) = limits.max_processes {
+            self.max_processes = processes;
+        }
+        if let Some(files) = limits.max_files {
+            self.max_files = files;
+        }
+        if let Some(mb) = limits.swap_mb {
+            self.swap_limit = mb * 1024 * 1024;
+        }
+        self
+    }
+
+    // Replaces the limits set by ulimits. `core` only applies to debug runs, so it
+    // is kept on the language config instead.
+    fn with_ulimits(mut self, ulimits: &Ulimits) -> Self {
+        if let Some(files) = ulimits.nofile {
+            self.max_files = files;
+        }
+        if let Some(bytes) = ulimits.fsize {
+            self.file_size_limit = Some(bytes);
+        }
+        if let Some(bytes) = ulimits.stack {
+            self.stack_limit = bytes;
+        }
+        self
+    }
+}
+
+impl From<&ResourceLimits> for LanguageLimits {
+    fn from(limits: &ResourceLimits) -> Self {
+        Self {
+            cpu_time_seconds: Some(limits.cpu_time_limit.as_secs()),
+            wall_time_seconds: Some(limits.wall_time_limit.as_secs()),
+            memory_mb: Some(limits.memory_limit / (1024 * 1024)),
+            max_processes: Some(limits.max_processes),
+            max_files: Some(limits.max_files),
+            swap_mb: Some(limits.swap_limit / (1024 * 1024)),
+        }
+    }
+}
+
+/// A supported language as listed by the `/languages` endpoint
+#[derive(Debug, Serialize)]
+pub struct LanguageDescription {
+    pub name: String,
+    pub image: String,
+    /// Versions a request can select besides the default image
+    pub versions: Vec<String>,
+    pub file_name: String,
+    pub compile: Option<Vec<String>>,
+    pub run: Vec<String>,
+    pub limits: LanguageLimits,
+    /// Whether the language was defined in the server configuration
+    pub custom: bool,
+    /// Image of the staged next channel, if the language has one
+    pub next_image: Option<String>,
+    /// Whether the language runs on an embedded runtime rather than in a container
+    pub embedded: bool,
+    /// Linux capabilities its sandboxes are granted; they run with none otherwise
+    pub capabilities: Vec<String>,
+}
+
+/// What a request would run with, returned by a dry run instead of running it
+#[derive(Debug, Serialize)]
+pub struct ExecutionPlan {
+    pub language: String,
+    /// `docker`, `embedded`, or `worker` when a connected agent would take it
+    pub backend: &'static str,
+    /// Empty for embedded runtimes
+    pub image: String,
+    /// Limits after the preset's, the request's ulimits and its deadline
+    pub limits: LanguageLimits,
+    pub work_dir: String,
+    /// Workspace-relative path the code is written to
+    pub file_name: String,
+    pub compile: Option<Vec<String>>,
+    pub run: Vec<String>,
+    pub channel: Option<Channel>,
+    pub platform: Option<String>,
+    pub emulated: bool,
+    pub gpu: bool,
+    /// Where caches, datasets and bundles are mounted
+    pub mounts: Vec<String>,
+    pub syscall_policy: Option<SyscallPolicy>,
+}
+
+/// Code to parse without compiling or running it
+#[derive(Debug, Clone, Deserialize)]
+pub struct CheckRequest {
+    pub language: String,
+    pub code: String,
+    pub version: Option<String>,
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct CheckResponse {
+    /// Whether the code parsed without errors; warnings don't count
+    pub valid: bool,
+    pub diagnostics: Vec<Diagnostic>,
+    pub time_taken: f64,
+}
+
+/// Size limits on request contents, checked before anything is written to disk
+#[derive(Clone, Debug)]
+pub struct RequestLimits {
+    pub max_code_bytes: usize,
+    /// Per test case input, which is passed to the program on stdin
+    pub max_stdin_bytes: usize,
+    pub max_files: usize,
+    /// Each workspace file's content
+    pub max_file_bytes: usize,
+    /// Combined content of all workspace files
+    pub max_files_bytes: usize,
+    /// Combined size of the test case inputs of a streamed upload, which are
+    /// written to disk rather than held in memory
+    pub max_upload_bytes: u64,
+}
+
+impl Default for RequestLimits {
+    fn default() -> Self {
+        Self {
+            max_code_bytes: 1024 * 1024,
+            max_stdin_bytes: 1024 * 1024,
+            max_files: 100,
+            max_file_bytes: 1024 * 1024,
+            max_files_bytes: 5 * 1024 * 1024,
+            max_upload_bytes: 1024 * 1024 * 1024,
+        }
+    }
+}
+
+impl RequestLimits {
+    pub fn from_env() -> Self {
+        let env_or = |name: &str, default: usize| {
+            std::env::var(name)
+                .ok()
+                .and_then(|s| s.parse::<usize>().ok())
+                .unwrap_or(default)
+        };
+        let defaults = Self::default();
+        Self {
+            max_code_bytes: env_or("MAX_CODE_BYTES", defaults.max_code_bytes),
+            max_stdin_bytes: env_or("MAX_STDIN_BYTES", defaults.max_stdin_bytes),
+            max_files: env_or("MAX_FILES", defaults.max_files),
+            max_file_bytes: env_or("MAX_FILE_BYTES", defaults.max_file_bytes),
+            max_files_bytes: env_or("MAX_FILES_BYTES", defaults.max_files_bytes),
+            max_upload_bytes: std::env::var("MAX_UPLOAD_BYTES")
+                .ok()
+                .and_then(|s| s.parse::<u64>().ok())
+                .unwrap_or(defaults.max_upload_bytes),
+        }
+    }
+
+    pub fn check(&self, request: &ExecuteRequest) -> Result<(), ExecutionError> {
+        let too_large = |field: &str, size: usize, limit: usize| {
+            ExecutionError::PayloadTooLarge(
+                field.to_string(),
+                format!("{field} is {size} bytes, the limit is {limit} bytes"),
+            )
+        };
+        if request.code.len() > self.max_code_bytes {
+            return Err(ExecutionError::CodeTooLarge(
+                "code".to_string(),
+                request.code.len(),
+                self.max_code_bytes,
+            ));
+        }
+        for (i, test_case) in request.test_cases.iter().flatten().enumerate() {
+            if test_case.input.len() > self.max_stdin_bytes {
+                return Err(too_large(
+                    &format!("test_cases[{i}].input"),
+                    test_case.input.len(),
+                    self.max_stdin_bytes,
+                ));
+            }
+        }
+        let files = request.files.as_deref().unwrap_or_default();
+        if files.len() > self.max_files {
+            return Err(ExecutionError::PayloadTooLarge(
+                "files".to_string(),
+                format!(
+                    "files has {} entries, the limit is {}",
+                    files.len(),
+                    self.max_files
+                ),
+            ));
+        }
+        if let Some((i, file)) = files
+            .iter()
+            .enumerate()
+            .find(|(_, file)| file.content.len() > self.max_file_bytes)
+        {
+            return Err(ExecutionError::CodeTooLarge(
+                format!("files[{i}]"),
+                file.content.len(),
+                self.max_file_bytes,
+            ));
+        }
+        let files_bytes: usize = files.iter().map(|file| file.content.len()).sum();
+        if files_bytes > self.max_files_bytes {
+            return Err(too_large("files", files_bytes, self.max_files_bytes));
         }
+        Ok(())
     }
 }
 
+/// What a program reads on stdin
+#[derive(Debug, Clone, Copy)]
+pub enum Stdin<'a> {
+    Bytes(&'a [u8]),
+    /// A file on this host, e.g. an uploaded input too large to hold in memory
+    File(&'a Path),
+}
+
 // Docker command builder for consistent container execution
 #[derive(Debug)]
 struct DockerCommandBuilder {
@@ -87,6 +584,19 @@ impl DockerCommandBuilder {
         }
     }
 
+    // A container that keeps running in the background under `name`
+    fn detached(name: &str) -> Self {
+        Self {
+            args: vec![
+                "run".to_string(),
+                "--rm".to_string(),
+                "-d".to_string(),
+                "--name".to_string(),
+                name.to_string(),
+            ],
+        }
+    }
+
     fn with_volume_mount(mut self, host_path: &str, container_path: &str) -> Self {
         self.args.extend(vec![
             "-v".to_string(),
@@ -95,6 +605,52 @@ impl DockerCommandBuilder {
         self
     }
 
+    fn with_volume_mounts(mut self, mounts: &[VolumeMount]) -> Self {
+        for mount in mounts {
+            let container_path = if mount.read_only {
+                format!("{}:ro", mount.container_path)
+            } else {
+                mount.container_path.clone()
+            };
+            self = self.with_volume_mount(&mount.host_path, &container_path);
+        }
+        self
+    }
+
+    // Everything a sandbox is started with but its image and command, the same
+    // whether it runs one command or idles as a warm instance
+    fn with_sandbox(
+        self,
+        workspace: &str,
+        config: &LanguageConfig,
+        limits: &ResourceLimits,
+    ) -> Self {
+        self.with_volume_mount(workspace, &config.work_dir)
+            .with_volume_mounts(&config.extra_mounts)
+            .with_gpus(config.gpu_devices.as_deref())
+            .with_platform(config.platform.as_deref())
+            .with_tmp(&config.tmpfs)
+            .with_root_filesystem(config.read_only_root, &config.tmpfs)
+            .with_working_directory(&config.work_dir)
+            .with_env("TMPDIR", "/tmp") // Set temp directory to writable location
+            .with_envs(&config.env)
+            .with_user("0:0") // run as root inside the container
+            .with_pull_disabled(config.pull_disabled)
+            .with_label(stats::JOB_LABEL, config.job_id.as_deref())
+            .with_seccomp_profile(config.seccomp_profile.as_deref())
+            .with_security_options(&config.security_options)
+            .with_capabilities(&config.capabilities)
+            .with_scheduling(config.scheduling.as_ref())
+            .with_cpuset(config.cpu)
+            .with_resource_limits(limits)
+    }
+
+    fn with_name(mut self, name: &str) -> Self {
+        self.args
+            .extend(vec!["--name".to_string(), name.to_string()]);
+        self
+    }
+
     fn with_working_directory(mut self, work_dir: &str) -> Self {
         self.args
             .extend(vec!["-w".to_string(), work_dir.to_string()]);
@@ -102,10 +658,13 @@ impl DockerCommandBuilder {
     }
 
     fn with_resource_limits(mut self, limits: &ResourceLimits) -> Self {
-        // Memory limit
+        // Memory limit, and swap on top of it; without `--memory-swap` Docker allows
+        // as much swap as memory on hosts that have swap
         self.args.extend(vec![
             "--memory".to_string(),
             format!("{}b", limits.memory_limit),
+            "--memory-swap".to_string(),
+            format!("{}b", limits.memory_limit + limits.swap_limit),
         ]);
 
         // CPU time limit (using ulimit)
@@ -136,6 +695,20 @@ impl DockerCommandBuilder {
             format!("nofile={}:{}", limits.max_files, limits.max_files),
         ]);
 
+        // Core dump size limit
+        self.args.extend(vec![
+            "--ulimit".to_string(),
+            format!("core={}:{}", limits.core_dump_limit, limits.core_dump_limit),
+        ]);
+
+        // File size limit
+        if let Some(bytes) = limits.file_size_limit {
+            self.args.extend(vec![
+                "--ulimit".to_string(),
+                format!("fsize={bytes}:{bytes}"),
+            ]);
+        }
+
         // Network access control
         if !limits.enable_network {
             self.args.push("--network".to_string());
@@ -169,6 +742,124 @@ impl DockerCommandBuilder {
         self
     }
 
+    fn with_envs(mut self, env: &[(String, String)]) -> Self {
+        for (key, value) in env {
+            self = self.with_env(key, value);
+        }
+        self
+    }
+
+    fn with_terminal(mut self, terminal: Option<&Terminal>) -> Self {
+        for (key, value) in terminal.map(Terminal::env).unwrap_or_default() {
+            self = self.with_env(key, &value);
+        }
+        self
+    }
+
+    fn with_gpus(mut self, devices: Option<&str>) -> Self {
+        if let Some(devices) = devices {
+            self.args
+                .extend(vec!["--gpus".to_string(), devices.to_string()]);
+        }
+        self
+    }
+
+    fn with_platform(mut self, platform: Option<&str>) -> Self {
+        if let Some(platform) = platform {
+            self.args
+                .extend(vec!["--platform".to_string(), platform.to_string()]);
+        }
+        self
+    }
+
+    // Keeps Docker from pulling a missing image from its registry
+    fn with_pull_disabled(mut self, disabled: bool) -> Self {
+        if disabled {
+            self.args
+                .extend(vec!["--pull".to_string(), "never".to_string()]);
+        }
+        self
+    }
+
+    fn with_label(mut self, key: &str, value: Option<&str>) -> Self {
+        if let Some(value) = value {
+            self.args
+                .extend(vec!["--label".to_string(), format!("{key}={value}")]);
+        }
+        self
+    }
+
+    // Every sandbox gets a /tmp of its own, so nothing written there by one run, or
+    // kept there by the server, is visible to another
+    fn with_tmp(mut self, tmpfs: &[(String, u64)]) -> Self {
+        if !tmpfs.iter().any(|(path, _)| path == "/tmp") {
+            self.args.extend(vec![
+                "--tmpfs".to_string(),
+                format!(
+                    "/tmp:rw,nosuid,nodev,size={},mode=1777",
+                    DEFAULT_TMPFS_MB * 1024 * 1024
+                ),
+            ]);
+        }
+        self
+    }
+
+    fn with_root_filesystem(mut self, read_only: bool, tmpfs: &[(String, u64)]) -> Self {
+        if read_only {
+            self.args.push("--read-only".to_string());
+        }
+        for (path, size) in tmpfs {
+            self.args.extend(vec![
+                "--tmpfs".to_string(),
+                format!("{path}:rw,nosuid,nodev,size={size},mode=1777"),
+            ]);
+        }
+        self
+    }
+
+    fn with_security_options(mut self, options: &[String]) -> Self {
+        for option in options {
+            self.args
+                .extend(vec!["--security-opt".to_string(), option.clone()]);
+        }
+        self
+    }
+
+    // Adds back capabilities the language was granted; `with_resource_limits` drops
+    // all of them
+    fn with_capabilities(mut self, capabilities: &[String]) -> Self {
+        for capability in capabilities {
+            self.args
+                .extend(vec!["--cap-add".to_string(), capability.clone()]);
+        }
+        self
+    }
+
+    fn with_scheduling(mut self, scheduling: Option<&Scheduling>) -> Self {
+        if let Some(scheduling) = scheduling {
+            self.args.extend(scheduling.docker_args());
+        }
+        self
+    }
+
+    fn with_cpuset(mut self, cpu: Option<usize>) -> Self {
+        if let Some(cpu) = cpu {
+            self.args
+                .extend(vec!["--cpuset-cpus".to_string(), cpu.to_string()]);
+        }
+        self
+    }
+
+    fn with_seccomp_profile(mut self, profile: Option<&str>) -> Self {
+        if let Some(profile) = profile {
+            self.args.extend(vec![
+                "--security-opt".to_string(),
+                format!("seccomp={profile}"),
+            ]);
+        }
+        self
+    }
+
     fn with_user(mut self, user: &str) -> Self {
         self.args
             .extend(vec!["--user".to_string(), user.to_string()]);
@@ -185,8 +876,54 @@ impl DockerCommandBuilder {
 pub enum ExecutionError {
     #[error("Unsupported language: {0}")]
     UnsupportedLanguage(String),
+    #[error("Unsupported version '{1}' for language {0}")]
+    UnsupportedVersion(String, String),
+    #[error("Failed to resolve image {0}: {1}")]
+    ImageResolution(String, String),
+    #[error("Air-gapped mode requires preloaded images, but these are missing: {}", .0.join(", "))]
+    MissingImages(Vec<String>),
+    #[error("Embedded runtime interpreters not found: {}", .0.join(", "))]
+    MissingInterpreters(Vec<String>),
+    #[error("Sandbox user mapping: {0}")]
+    UserMapping(String),
+    #[error("Execution cgroup: {0}")]
+    Cgroup(String),
+    #[error("CPU pinning: {0}")]
+    CpuPinning(String),
+    #[error("Request rejected by policy: {0}")]
+    PolicyViolation(String),
+    #[error("Invalid request: {0}")]
+    InvalidRequest(String),
+    /// The field that is over its limit, and a description of the limit
+    #[error("Request too large: {1}")]
+    PayloadTooLarge(String, String),
+    /// Source code over its limit: the field, e.g. `code` or `files[2]`, its size
+    /// and the limit, in bytes
+    #[error("{0} is {1} bytes, the limit is {2} bytes")]
+    CodeTooLarge(String, usize, usize),
     #[error("Failed to create temp directory: {0}")]
     TempDirectoryCreation(String),
+    #[error("Failed to prepare cache {0}: {1}")]
+    CacheMount(String, String),
+    #[error("Failed to sync dataset {0}: {1}")]
+    DatasetSync(String, String),
+    /// The install command of the request's lockfile failed, with the end of its
+    /// output
+    #[error("Failed to install dependencies: {0}")]
+    DependencyInstall(String),
+    #[error("No worker available: {0}")]
+    Unavailable(String),
+    /// Every sandbox is busy; the duration says when a retry is likely to succeed
+    #[error("All sandboxes are busy: {0}")]
+    Busy(String, Duration),
+    /// A batch job gave up its worker to an interactive request; the duration says
+    /// when a retry is likely to succeed
+    #[error("Preempted by an interactive execution")]
+    Preempted(Duration),
+    #[error("The caller's deadline passed before the execution started")]
+    DeadlineExceeded,
+    #[error("The caller went away before the execution finished")]
+    Cancelled,
     #[error("Failed to write code file: {0}")]
     FileWrite(String),
     #[error("Failed to execute code: {0}")]
@@ -195,6 +932,28 @@ pub enum ExecutionError {
     TaskJoin(String),
     #[error("Execution timed out after {0:.3} seconds")]
     Timeout(f64),
+    #[error("Execution hook failed: {0}")]
+    Hook(String),
+    /// The language's image failed its vulnerability scan
+    #[error("Language {0} is unavailable: {1}")]
+    ImageBlocked(String, String),
+}
+
+impl From<HookError> for ExecutionError {
+    fn from(error: HookError) -> Self {
+        match error {
+            HookError::Rejected(reason) => ExecutionError::PolicyViolation(reason),
+            HookError::Failed(message) => ExecutionError::Hook(message),
+        }
+    }
+}
+
+// A host directory mounted into the container next to the workspace
+#[derive(Clone, Debug, PartialEq)]
+struct VolumeMount {
+    host_path: String,
+    container_path: String,
+    read_only: bool,
 }
 
 // Language configuration
@@ -204,8 +963,313 @@ struct LanguageConfig {
     file_name: String,
     run_command: Vec<String>,
     compile_command: Option<Vec<String>>,
+    // Parses the source without running it, for syntax checks
+    check_command: Option<Vec<String>>,
     // Language-specific resource limits (can override defaults)
     resource_limits: Option<ResourceLimits>,
+    // Alternative images keyed by the version a request can select
+    image_versions: HashMap<String, String>,
+    // Where the workspace is mounted inside the container
+    work_dir: String,
+    // Host directories mounted next to the workspace, e.g. shared caches and datasets
+    extra_mounts: Vec<VolumeMount>,
+    // Value for `docker run --gpus` when the request asked for a GPU
+    gpu_devices: Option<String>,
+    // `docker run --platform` value when the request targets an architecture
+    platform: Option<String>,
+    // Whether the platform differs from the host and runs under emulation
+    emulated: bool,
+    // Defined in the server configuration rather than built in
+    custom: bool,
+    // Image of the staged next channel
+    next_image: Option<String>,
+    // Channel the request selected, for tagging its result
+    channel: Option<Channel>,
+    // Set in air-gapped mode, where Docker may only use local images
+    pull_disabled: bool,
+    // Runs as a host process with an embedded runtime; `docker_image` is empty
+    embedded: bool,
+    // Execution the sandbox runs for, labelled on its containers
+    job_id: Option<String>,
+    // The run command is wrapped in strace
+    traced: bool,
+    // Seccomp preset of the sandbox and the profile file passed to Docker; None for
+    // embedded runtimes, which run unfiltered
+    syscall_policy: Option<SyscallPolicy>,
+    seccomp_profile: Option<String>,
+    // AppArmor and SELinux `--security-opt` values from the server configuration
+    security_options: Vec<String>,
+    // Linux capabilities granted on top of none, from the server configuration
+    capabilities: Vec<String>,
+    // Lowered CPU and I/O weights for batch requests
+    scheduling: Option<Scheduling>,
+    // Core the execution holds for itself while it runs, with `PINNED_CPUS`
+    cpu: Option<usize>,
+    // Largest core dump a debug run may write, below the server's cap, from the
+    // language's or the request's ulimits
+    core_dump_limit: Option<u64>,
+    // Host user and group the sandbox's root maps to, which the workspace is handed
+    // to before anything runs in it
+    sandbox_owner: Option<(u32, u32)>,
+    // Mount the image read-only, with tmpfs mounts given as path and size in bytes
+    read_only_root: bool,
+    tmpfs: Vec<(String, u64)>,
+    // The client's terminal, described to the program in its environment
+    terminal: Option<Terminal>,
+    // Environment variables of the request's preset
+    env: Vec<(String, String)>,
+    // The commands derive other names from the source file's, e.g. the class `java`
+    // runs or the binary `ghc` writes, so they can't be rewritten for another
+    // entrypoint
+    fixed_entrypoint: bool,
+}
+
+impl LanguageConfig {
+    fn new(
+        docker_image: &str,
+        file_name: &str,
+        run_command: Vec<String>,
+        compile_command: Option<Vec<String>>,
+    ) -> Self {
+        Self {
+            docker_image: docker_image.to_string(),
+            file_name: file_name.to_string(),
+            run_command,
+            compile_command,
+            check_command: None,
+            resource_limits: None,
+            image_versions: HashMap::new(),
+            work_dir: DEFAULT_WORK_DIR.to_string(),
+            extra_mounts: Vec::new(),
+            gpu_devices: None,
+            platform: None,
+            emulated: false,
+            custom: false,
+            next_image: None,
+            channel: None,
+            pull_disabled: false,
+            embedded: false,
+            job_id: None,
+            traced: false,
+            syscall_policy: None,
+            seccomp_profile: None,
+            security_options: Vec::new(),
+            capabilities: Vec::new(),
+            scheduling: None,
+            cpu: None,
+            core_dump_limit: None,
+            sandbox_owner: None,
+            read_only_root: false,
+            tmpfs: Vec::new(),
+            terminal: None,
+            env: Vec::new(),
+            fixed_entrypoint: false,
+        }
+    }
+
+    // Checks that the request's layout can run with this configuration: another
+    // entrypoint only where the commands can be rewritten for it, and no file in
+    // place of the code
+    fn check_layout(&self, request: &ExecuteRequest) -> Result<(), ExecutionError> {
+        let file_name = request.entrypoint.as_deref().unwrap_or(&self.file_name);
+        if file_name != self.file_name && self.fixed_entrypoint {
+            return Err(ExecutionError::InvalidRequest(format!(
+                "Language {} always runs {}, so it can't take entrypoint {file_name}",
+                request.language, self.file_name
+            )));
+        }
+        // Both end up in shell commands, which they must not break out of
+        let shell = self
+            .run_command
+            .iter()
+            .chain(self.compile_command.iter().flatten())
+            .any(|arg| arg.contains(' '));
+        let shell_safe = |value: &str| {
+            value
+                .chars()
+                .all(|c| c.is_ascii_alphanumeric() || matches!(c, '.' | '_' | '-' | '/'))
+        };
+        let unsafe_path = std::iter::once(file_name)
+            .chain(request.workdir.as_deref())
+            .find(|path| shell && !shell_safe(path));
+        if let Some(path) = unsafe_path {
+            return Err(ExecutionError::InvalidRequest(format!(
+                "Language {} needs {path} to be made of letters, digits, '.', '_', '-' and '/'",
+                request.language
+            )));
+        }
+        if let Some(file) = request
+            .files
+            .iter()
+            .flatten()
+            .find(|file| file.path == file_name)
+        {
+            return Err(ExecutionError::InvalidRequest(format!(
+                "File {} conflicts with the entrypoint",
+                file.path
+            )));
+        }
+        Ok(())
+    }
+
+    // Rewrites the file name and mount point in the compile/run commands for a custom layout.
+    // The process always starts in the workspace root, so relative paths resolve the same
+    // way they would when running the entrypoint from the project root locally. Shell
+    // command strings are rewritten word by word, so the source file is replaced where
+    // it appears bare or under the workspace, but not copies of it elsewhere.
+    fn with_layout(mut self, work_dir: Option<&str>, entrypoint: Option<&str>) -> Self {
+        let rewrite = |args: &[String], work_dir: &str, file_name: &str, entrypoint: &str| {
+            let source = format!("{DEFAULT_WORK_DIR}/{file_name}");
+            args.iter()
+                .map(|arg| {
+                    arg.split(' ')
+                        .map(|word| {
+                            if word == file_name {
+                                entrypoint.to_string()
+                            } else if word == source {
+                                format!("{work_dir}/{entrypoint}")
+                            } else {
+                                word.replace(
+                                    &format!("{DEFAULT_WORK_DIR}/"),
+                                    &format!("{work_dir}/"),
+                                )
+                            }
+                        })
+                        .collect::<Vec<_>>()
+                        .join(" ")
+                })
+                .collect::<Vec<_>>()
+        };
+
+        let work_dir = work_dir.unwrap_or(DEFAULT_WORK_DIR).to_string();
+        let entrypoint = entrypoint.unwrap_or(&self.file_name).to_string();
+        self.run_command = rewrite(&self.run_command, &work_dir, &self.file_name, &entrypoint);
+        self.compile_command = self
+            .compile_command
+            .as_ref()
+            .map(|cmd| rewrite(cmd, &work_dir, &self.file_name, &entrypoint));
+        self.file_name = entrypoint;
+        self.work_dir = work_dir;
+        self
+    }
+
+    // Returns a copy of this configuration using the image registered for `version`
+    fn for_version(&self, language: &str, version: Option<&str>) -> Result<Self, ExecutionError> {
+        let mut config = self.clone();
+        if let Some(version) = version {
+            let image = self.image_versions.get(version).ok_or_else(|| {
+                ExecutionError::UnsupportedVersion(language.to_string(), version.to_string())
+            })?;
+            config.docker_image = image.clone();
+        }
+        Ok(config)
+    }
+
+    // Switches this configuration to the channel's image and tags it with the channel
+    fn for_channel(
+        mut self,
+        language: &str,
+        channel: Option<Channel>,
+    ) -> Result<Self, ExecutionError> {
+        if let Some(channel) = channel {
+            if channel == Channel::Next {
+                self.docker_image = self.next_image.clone().ok_or_else(|| {
+                    ExecutionError::InvalidRequest(format!(
+                        "Language {language} has no next channel"
+                    ))
+                })?;
+            }
+            self.channel = Some(channel);
+        }
+        Ok(self)
+    }
+}
+
+const DEFAULT_WORK_DIR: &str = "/workspace";
+
+// True for `percent` percent of calls
+fn sample(percent: f64) -> bool {
+    // Random bits of a UUIDv4; its few fixed bits don't bias the remainder
+    ((Uuid::new_v4().as_u128() % 10_000) as f64) < percent * 100.0
+}
+
+// Fills in the placeholders of a command template from the server configuration
+fn expand_command(template: &[String], file_name: &str) -> Vec<String> {
+    let stem = Path::new(file_name)
+        .file_stem()
+        .and_then(|stem| stem.to_str())
+        .unwrap_or(file_name);
+    template
+        .iter()
+        .map(|arg| {
+            arg.replace("{file}", file_name)
+                .replace("{stem}", stem)
+                .replace("{work_dir}", DEFAULT_WORK_DIR)
+        })
+        .collect()
+}
+
+// Maps architecture names to Docker's platform names
+fn normalize_arch(arch: &str) -> Option<&'static str> {
+    match arch {
+        "amd64" | "x86_64" => Some("amd64"),
+        "arm64" | "aarch64" => Some("arm64"),
+        _ => None,
+    }
+}
+
+// Validates a workspace-relative path: no absolute paths and no parent traversal
+fn validate_relative_path(path: &str) -> Result<(), ExecutionError> {
+    let components: Vec<Component> = Path::new(path).components().collect();
+    if components.is_empty() || !components.iter().all(|c| matches!(c, Component::Normal(_))) {
+        return Err(ExecutionError::InvalidRequest(format!(
+            "File path must be relative to the workspace: {path}"
+        )));
+    }
+    Ok(())
+}
+
+fn validate_work_dir(work_dir: &str) -> Result<(), ExecutionError> {
+    let path = Path::new(work_dir);
+    let mut components = path.components();
+    let valid = components.next() == Some(Component::RootDir)
+        && components.clone().count() > 0
+        && components.all(|c| matches!(c, Component::Normal(_)))
+        && !path.starts_with("/tmp");
+    if !valid {
+        return Err(ExecutionError::InvalidRequest(format!(
+            "Working directory must be an absolute path outside /tmp: {work_dir}"
+        )));
+    }
+    Ok(())
+}
+
+fn parse_file_mode(mode: &str) -> Result<u32, ExecutionError> {
+    let digits = mode.trim_start_matches("0o");
+    match u32::from_str_radix(digits, 8) {
+        Ok(bits) if bits <= 0o7777 => Ok(bits),
+        _ => Err(ExecutionError::InvalidRequest(format!(
+            "Invalid file mode: {mode}"
+        ))),
+    }
+}
+
+// The stdin kept in an execution's record. Hidden test cases are left out, since
+// the record is visible to whoever can read the execution, and so are uploaded
+// inputs, which are only kept on disk while the request runs.
+fn recorded_inputs(request: &ExecuteRequest) -> Vec<RecordedInput> {
+    request
+        .test_cases
+        .iter()
+        .flatten()
+        .filter(|test_case| {
+            !test_case.hidden && !request.uploaded_inputs.contains_key(&test_case.name)
+        })
+        .map(|test_case| RecordedInput {
+            test_case: test_case.name.clone(),
+            input: test_case.input.clone(),
+        })
+        .collect()
 }
 
 // Trait for language configuration
@@ -253,6 +1317,10 @@ impl LanguageRegistry {
         Self::register_compiled_languages(&mut languages);
         Self::register_functional_languages(&mut languages);
         Self::register_other_languages(&mut languages);
+        for (name, config) in languages.iter_mut() {
+            config.check_command = syntax::builtin_checker(name)
+                .map(|check| expand_command(&check, &config.file_name));
+        }
 
         Self { languages }
     }
@@ -352,13 +1420,7 @@ impl LanguageRegistry {
         for (name, image, file, run_cmd) in scripting_languages {
             languages.insert(
                 name.to_string(),
-                LanguageConfig {
-                    docker_image: image.to_string(),
-                    file_name: file.to_string(),
-                    run_command: run_cmd,
-                    compile_command: None,
-                    resource_limits: None,
-                },
+                LanguageConfig::new(image, file, run_cmd, None),
             );
         }
     }
@@ -369,11 +1431,13 @@ impl LanguageRegistry {
                 "rust",
                 "rust:alpine", // Use alpine version for better CI performance
                 "main.rs",
-                vec!["/tmp/main".to_string()],
+                vec!["./main".to_string()],
+                // Built into the workspace, since the program runs in another container
                 Some(vec![
-                    "sh".to_string(),
-                    "-lc".to_string(),
-                    "cp /workspace/main.rs /tmp/ && /usr/local/cargo/bin/rustc /tmp/main.rs -o /tmp/main".to_string(),
+                    "/usr/local/cargo/bin/rustc".to_string(),
+                    "main.rs".to_string(),
+                    "-o".to_string(),
+                    "main".to_string(),
                 ]),
             ),
             (
@@ -492,17 +1556,14 @@ impl LanguageRegistry {
             ),
         ];
 
+        // They run a class or binary named after the source file
+        let fixed_entrypoint = [
+            "java", "kotlin", "scala", "swift", "haskell", "d", "pascal", "assembly", "cobol",
+        ];
         for (name, image, file, run_cmd, compile_cmd) in compiled_languages {
-            languages.insert(
-                name.to_string(),
-                LanguageConfig {
-                    docker_image: image.to_string(),
-                    file_name: file.to_string(),
-                    run_command: run_cmd,
-                    compile_command: compile_cmd,
-                    resource_limits: None,
-                },
-            );
+            let mut config = LanguageConfig::new(image, file, run_cmd, compile_cmd);
+            config.fixed_entrypoint = fixed_entrypoint.contains(&name);
+            languages.insert(name.to_string(), config);
         }
     }
 
@@ -541,13 +1602,7 @@ impl LanguageRegistry {
         for (name, image, file, run_cmd) in functional_languages {
             languages.insert(
                 name.to_string(),
-                LanguageConfig {
-                    docker_image: image.to_string(),
-                    file_name: file.to_string(),
-                    run_command: run_cmd,
-                    compile_command: None,
-                    resource_limits: None,
-                },
+                LanguageConfig::new(image, file, run_cmd, None),
             );
         }
     }
@@ -618,37 +1673,150 @@ impl LanguageRegistry {
                     max_processes: 100,                      // Max 100 processes
                     max_files: 200,                          // Max 200 open files
                     enable_network: false,                   // No network access
+                    core_dump_limit: 0,                      // No core dumps
+                    file_size_limit: None,                   // No file size limit
+                    swap_limit: 0,                           // No swap
                 })
             } else {
                 None
             };
 
-            languages.insert(
-                name.to_string(),
-                LanguageConfig {
-                    docker_image: image.to_string(),
-                    file_name: file.to_string(),
-                    run_command: run_cmd,
-                    compile_command: compile_cmd,
-                    resource_limits,
-                },
-            );
+            let mut config = LanguageConfig::new(image, file, run_cmd, compile_cmd);
+            config.resource_limits = resource_limits;
+            // Runs the JavaScript tsc writes next to the source
+            config.fixed_entrypoint = name == "typescript";
+            languages.insert(name.to_string(), config);
         }
     }
 
-    fn get_language_config(&self, language: &str) -> Option<&LanguageConfig> {
-        self.languages.get(language)
+    // Applies language definitions and overrides from the server configuration
+    fn apply_overrides(&mut self, config: &IsoboxConfig) {
+        for (name, overrides) in &config.languages {
+            // Definitions replace a built-in language of the same name entirely
+            if let (Some(extension), Some(image), Some(run)) =
+                (&overrides.extension, &overrides.image, &overrides.run)
+            {
+                let file_name = format!("main.{extension}");
+                let mut language =
+                    LanguageConfig::new(image, &file_name, expand_command(run, &file_name), None);
+                language.custom = true;
+                self.languages.insert(name.clone(), language);
+            }
+            let Some(language) = self.languages.get_mut(name) else {
+                log::warn!("Ignoring overrides for unknown language: {name}");
+                continue;
+            };
+            if let Some(image) = &overrides.image {
+                language.docker_image = image.clone();
+            }
+            language.image_versions.extend(overrides.versions.clone());
+            if let Some(run) = &overrides.run {
+                language.run_command = expand_command(run, &language.file_name);
+            }
+            if let Some(compile) = &overrides.compile {
+                language.compile_command = Some(expand_command(compile, &language.file_name));
+            }
+            if let Some(check) = &overrides.check {
+                language.check_command = Some(expand_command(check, &language.file_name));
+            }
+            if let Some(limits) = &overrides.limits {
+                let base = language.resource_limits.clone().unwrap_or_default();
+                language.resource_limits = Some(base.with_overrides(limits));
+            }
+            if let Some(ulimits) = &overrides.ulimits {
+                let base = language.resource_limits.clone().unwrap_or_default();
+                language.resource_limits = Some(base.with_ulimits(ulimits));
+                language.core_dump_limit = ulimits.core;
+            }
+            if let Some(next) = &overrides.next {
+                language.next_image = Some(next.image.clone());
+            }
+            language.security_options = overrides.security_options();
+            language.capabilities = overrides.capabilities();
+        }
     }
-}
 
-// File manager for handling temporary files
-struct FileManager;
+    // Registry of the embedded runtimes only, for hosts without a container runtime.
+    // Commands run in the workspace, so `{work_dir}` is the current directory.
+    fn embedded(runtimes: &HashMap<String, EmbeddedRuntimeConfig>) -> Self {
+        let expand = |template: &[String], file_name: &str| {
+            let template: Vec<String> = template
+                .iter()
+                .map(|arg| arg.replace("{work_dir}", "."))
+                .collect();
+            expand_command(&template, file_name)
+        };
+        let languages = runtimes
+            .iter()
+            .map(|(name, runtime)| {
+                let file_name = format!("main.{}", runtime.extension);
+                let mut language = LanguageConfig::new(
+                    "",
+                    &file_name,
+                    expand(&runtime.run, &file_name),
+                    runtime
+                        .compile
+                        .as_ref()
+                        .map(|compile| expand(compile, &file_name)),
+                );
+                language.check_command = runtime
+                    .check
+                    .as_ref()
+                    .map(|check| expand(check, &file_name));
+                language.resource_limits = runtime
+                    .limits
+                    .as_ref()
+                    .map(|limits| ResourceLimits::default().with_overrides(limits));
+                language.custom = true;
+                language.embedded = true;
+                (name.clone(), language)
+            })
+            .collect();
+        Self { languages }
+    }
+
+    // Every image a request can run on, deduplicated
+    fn images(&self) -> Vec<String> {
+        let mut images: Vec<String> = self
+            .languages
+            .values()
+            .filter(|config| !config.embedded)
+            .flat_map(|config| {
+                std::iter::once(&config.docker_image)
+                    .chain(config.image_versions.values())
+                    .chain(config.next_image.iter())
+            })
+            .cloned()
+            .collect();
+        images.sort();
+        images.dedup();
+        images
+    }
+
+    // All image references pinned to a digest, deduplicated
+    fn pinned_images(&self) -> Vec<String> {
+        self.images()
+            .into_iter()
+            .filter(|image| pinned_digest(image).is_some())
+            .collect()
+    }
+
+    fn get_language_config(&self, language: &str) -> Option<&LanguageConfig> {
+        self.languages.get(language)
+    }
+}
+
+// File manager for handling temporary files
+struct FileManager;
+
+impl FileManager {
+    fn temp_directory(job_id: &str) -> std::path::PathBuf {
+        std::env::temp_dir().join(format!("isobox-{job_id}"))
+    }
 
-impl FileManager {
     fn create_temp_directory(job_id: &str) -> Result<String, ExecutionError> {
         // Create temp directory on host system with proper permissions
-        let base = std::env::temp_dir();
-        let temp_dir = base.join(format!("isobox-{job_id}"));
+        let temp_dir = Self::temp_directory(job_id);
 
         log::info!("Creating temp directory: {}", temp_dir.display());
 
@@ -662,8 +1830,36 @@ impl FileManager {
         Ok(temp_dir.to_string_lossy().into_owned())
     }
 
+    fn write_workspace_files(
+        temp_dir: &str,
+        files: &[WorkspaceFile],
+    ) -> Result<(), ExecutionError> {
+        for file in files {
+            let file_path = Path::new(temp_dir).join(&file.path);
+            if let Some(parent) = file_path.parent() {
+                fs::create_dir_all(parent).map_err(|e| ExecutionError::FileWrite(e.to_string()))?;
+            }
+            fs::write(&file_path, &file.content)
+                .map_err(|e| ExecutionError::FileWrite(e.to_string()))?;
+
+            if let Some(mode) = &file.mode {
+                use std::os::unix::fs::PermissionsExt;
+                fs::set_permissions(
+                    &file_path,
+                    fs::Permissions::from_mode(parse_file_mode(mode)?),
+                )
+                .map_err(|e| ExecutionError::FileWrite(e.to_string()))?;
+            }
+            log::info!("Wrote workspace file: {}", file.path);
+        }
+        Ok(())
+    }
+
     fn write_code_file(temp_dir: &str, file_name: &str, code: &str) -> Result<(), ExecutionError> {
         let file_path = format!("{temp_dir}/{file_name}");
+        if let Some(parent) = Path::new(&file_path).parent() {
+            fs::create_dir_all(parent).map_err(|e| ExecutionError::FileWrite(e.to_string()))?;
+        }
 
         log::info!("Writing code to file: {file_path}");
         log::info!("Code content length: {} bytes", code.len());
@@ -730,10 +1926,140 @@ impl FileManager {
     }
 }
 
+// How long after killing an abandoned execution's containers to look again, for a
+// container that was still being created
+const ABANDONED_RECHECK: Duration = Duration::from_secs(2);
+
+// Cleans up after an execution whose future is dropped before it finishes, e.g.
+// because the HTTP client disconnected. Dropping the future stops the waiting but
+// not the sandbox container, so the container is killed here.
+struct AbandonGuard<'a> {
+    events: &'a EventBus,
+    job_id: &'a str,
+    tenant: &'a str,
+    language: &'a str,
+    finished: bool,
+}
+
+impl Drop for AbandonGuard<'_> {
+    fn drop(&mut self) {
+        if self.finished {
+            return;
+        }
+        log::info!(
+            "Execution {} was abandoned by its caller, stopping its sandbox",
+            self.job_id
+        );
+        self.events.publish(&ExecutionEvent::finished(
+            self.job_id,
+            self.tenant,
+            self.language,
+            &Err(ExecutionError::Cancelled),
+        ));
+        // Drop can't wait for docker
+        let job_id = self.job_id.to_string();
+        std::thread::spawn(move || {
+            for delay in [Duration::ZERO, ABANDONED_RECHECK] {
+                std::thread::sleep(delay);
+                if let Err(e) = stats::kill_job_containers(&job_id) {
+                    log::warn!("Failed to stop abandoned execution {job_id}: {e}");
+                }
+            }
+            let temp_dir = FileManager::temp_directory(&job_id);
+            if temp_dir.exists() {
+                FileManager::cleanup_temp_directory(&temp_dir.to_string_lossy());
+            }
+        });
+    }
+}
+
+// A judge's program in a workspace of its own, compiled if the language needs it,
+// for the test cases of one execution. The workspace is removed when it's dropped.
+struct PreparedProgram {
+    workspace: String,
+    config: LanguageConfig,
+    limits: ResourceLimits,
+}
+
+impl Drop for PreparedProgram {
+    fn drop(&mut self) {
+        FileManager::cleanup_temp_directory(&self.workspace);
+    }
+}
+
+/// What a checker made of a test case's output
+struct CheckerVerdict {
+    verdict: Verdict,
+    // How the checker ended, for a verdict other than accepted
+    summary: String,
+    // What the checker reported
+    message: Option<String>,
+}
+
+// Where a test case's verdict comes from when it isn't a comparison of the output
+// with the expected output
+enum Judge {
+    Interactor(PreparedProgram),
+    Checker(PreparedProgram),
+}
+
+// A running container with a function's code in its workspace, compiled if the
+/// language needs it, that takes one invocation at a time
+pub struct WarmInstance {
+    container: String,
+    workspace: String,
+    config: LanguageConfig,
+    limits: ResourceLimits,
+    // Whether the output carries a function's return value
+    function_call: bool,
+    tenant: String,
+}
+
+impl WarmInstance {
+    pub fn container(&self) -> &str {
+        &self.container
+    }
+}
+
+// Keeps a warm container alive without depending on anything but a shell
+const IDLE_COMMAND: &str = "trap 'exit 0' TERM; while :; do sleep 3600; done";
+
+// Longest a syntax check may take; checkers normally answer in milliseconds
+const CHECK_TIMEOUT: Duration = Duration::from_secs(10);
+
 // Docker executor for running containers
 struct DockerExecutor;
 
 impl DockerExecutor {
+    // Whether an image is available locally
+    fn image_present(image: &str) -> Result<bool, ExecutionError> {
+        let inspect = Command::new("docker")
+            .args(["image", "inspect", image])
+            .output()
+            .map_err(|e| ExecutionError::ImageResolution(image.to_string(), e.to_string()))?;
+        Ok(inspect.status.success())
+    }
+
+    // Makes sure a digest-pinned image is available locally, pulling it if needed
+    fn resolve_image(image: &str) -> Result<(), ExecutionError> {
+        if Self::image_present(image)? {
+            return Ok(());
+        }
+
+        log::info!("Pulling pinned image: {image}");
+        let pull = Command::new("docker")
+            .args(["pull", image])
+            .output()
+            .map_err(|e| ExecutionError::ImageResolution(image.to_string(), e.to_string()))?;
+        if !pull.status.success() {
+            return Err(ExecutionError::ImageResolution(
+                image.to_string(),
+                String::from_utf8_lossy(&pull.stderr).trim().to_string(),
+            ));
+        }
+        Ok(())
+    }
+
     async fn execute_with_timeout(
         docker_args: Vec<String>,
         timeout_duration: Duration,
@@ -761,16 +2087,25 @@ impl DockerExecutor {
     async fn execute_with_timeout_and_stdin(
         docker_args: Vec<String>,
         timeout_duration: Duration,
-        stdin_data: &[u8],
+        stdin: Stdin<'_>,
     ) -> Result<std::process::Output, ExecutionError> {
         let start_time = std::time::Instant::now();
-        let stdin_data = stdin_data.to_vec();
+        // An input file becomes docker's stdin as it is, rather than being read in
+        let (stdin_data, stdin) = match stdin {
+            Stdin::Bytes(bytes) => (bytes.to_vec(), std::process::Stdio::piped()),
+            Stdin::File(path) => {
+                let file = fs::File::open(path).map_err(|e| {
+                    ExecutionError::Execution(format!("Failed to open the input: {e}"))
+                })?;
+                (Vec::new(), std::process::Stdio::from(file))
+            }
+        };
 
         let output_result = timeout(timeout_duration, async {
             tokio::task::spawn_blocking(move || {
                 let mut child = Command::new("docker")
                     .args(&docker_args)
-                    .stdin(std::process::Stdio::piped())
+                    .stdin(stdin)
                     .stdout(std::process::Stdio::piped())
                     .stderr(std::process::Stdio::piped())
                     .spawn()
@@ -811,17 +2146,49 @@ impl DockerExecutor {
         command: &[String],
     ) -> Vec<String> {
         DockerCommandBuilder::new()
-            .with_volume_mount(temp_dir, "/workspace")
-            .with_volume_mount("/tmp", "/tmp") // Mount host /tmp to container /tmp for writable temp files
-            .with_working_directory("/workspace")
-            .with_env("TMPDIR", "/tmp") // Set temp directory to writable location
-            .with_user("0:0") // run as root inside the container
-            .with_resource_limits(limits)
+            .with_sandbox(temp_dir, config, limits)
+            .with_terminal(config.terminal.as_ref())
             .with_image(config.docker_image())
             .with_command(command)
             .build()
     }
 
+    // Starts a warm instance's container, set up like any other sandbox, idling
+    // until commands are run in it
+    fn build_warm_command(instance: &WarmInstance) -> Vec<String> {
+        let config = &instance.config;
+        DockerCommandBuilder::detached(&instance.container)
+            .with_sandbox(&instance.workspace, config, &instance.limits)
+            .with_image(config.docker_image())
+            .with_command(&["sh".to_string(), "-c".to_string(), IDLE_COMMAND.to_string()])
+            .build()
+    }
+
+    // Installs a lockfile's dependencies into `dir`, with network access and limits
+    // meant for package managers rather than programs
+    fn build_docker_install_command(
+        container: &str,
+        lock_dir: &Path,
+        dir: &Path,
+        config: &LanguageConfig,
+        dependencies: &DependencyConfig,
+    ) -> Vec<String> {
+        DockerCommandBuilder::new()
+            .with_name(container)
+            .with_volume_mount(&lock_dir.to_string_lossy(), &format!("{LOCKFILE_MOUNT}:ro"))
+            .with_volume_mount(&dir.to_string_lossy(), &dependencies.path)
+            .with_volume_mounts(&read_only_mounts(config).cloned().collect::<Vec<_>>())
+            .with_platform(config.platform.as_deref())
+            .with_working_directory(LOCKFILE_MOUNT)
+            .with_envs(&config.env)
+            .with_user("0:0")
+            .with_pull_disabled(config.pull_disabled)
+            .with_resource_limits(&dependency_install_limits())
+            .with_image(config.docker_image())
+            .with_command(&dependencies.install)
+            .build()
+    }
+
     fn build_docker_compile_command(
         temp_dir: &str,
         config: &LanguageConfig,
@@ -829,12 +2196,7 @@ impl DockerExecutor {
         command: &[String],
     ) -> Vec<String> {
         DockerCommandBuilder::new()
-            .with_volume_mount(temp_dir, "/workspace")
-            .with_volume_mount("/tmp", "/tmp") // Mount host /tmp to container /tmp for writable temp files
-            .with_working_directory("/tmp") // Use /tmp for compilation to avoid permission issues
-            .with_env("TMPDIR", "/tmp") // Set temp directory to writable location
-            .with_user("0:0") // run as root inside the container
-            .with_resource_limits(limits)
+            .with_sandbox(temp_dir, config, limits)
             .with_image(config.docker_image())
             .with_command(command)
             .build()
@@ -845,6 +2207,63 @@ impl DockerExecutor {
 pub struct CodeExecutor {
     language_registry: LanguageRegistry,
     resource_limits: ResourceLimits,
+    request_limits: RequestLimits,
+    config: IsoboxConfig,
+    store: Arc<ExecutionStore>,
+    caches: CacheManager,
+    datasets: DatasetStore,
+    usage: UsageMeter,
+    // `--gpus` value for this host; None when it has no NVIDIA runtime
+    gpu_devices: Option<String>,
+    // Architecture containers run on natively, e.g. "amd64"
+    host_arch: String,
+    // Whether other architectures may run through QEMU user-mode emulation
+    arch_emulation: bool,
+    // Never pull images or download datasets; everything has to be present locally
+    air_gapped: bool,
+    // Run the embedded runtimes from the configuration instead of containers
+    embedded_backend: bool,
+    // Largest core dump a `debug` request may write
+    core_dump_limit: u64,
+    // Weights of `batch` requests' sandboxes
+    batch_scheduling: Scheduling,
+    // Per-step cgroups, when the server manages them itself
+    cgroups: CgroupManager,
+    // Cores executions are pinned to, one at a time each
+    cpu_pool: CpuPool,
+    // Caps on concurrent executions per language
+    language_slots: LanguageSlots,
+    tracer: Tracer,
+    syscall_filter: SyscallFilter,
+    // Flags executions that look like cryptomining or botnets
+    abuse: AbuseMonitor,
+    user_mapping: UserMapping,
+    // Remote agents that take jobs before they are run on this host
+    workers: Arc<WorkerRegistry>,
+    // Whether this host runs jobs itself when no remote worker can take them
+    local_execution: bool,
+    // Whether remote jobs with the same lockfile or program go to the same worker
+    cache_affinity: bool,
+    events: EventBus,
+    // Masks secrets in output before it is logged or stored
+    redactor: Redactor,
+    latency: LatencyMonitor,
+    // Run before and after every execution
+    hooks: HookChain,
+    image_scanner: ImageScanner,
+    // Dependency trees installed from lockfiles, shared by executions
+    dependencies: DependencyCache,
+    // Vendored dependencies tenants uploaded for presets
+    bundles: BundleStore,
+    // Results returned again for identical requests
+    results: ResultCache,
+    // Executions counted by the values of configured label keys
+    label_metrics: LabelMetrics,
+    // Configured presets and those built through the API
+    presets: Arc<PresetRegistry>,
+    // Warm containers syntax checks run in, by language and image, started on the
+    // first check and kept until shutdown
+    checkers: tokio::sync::Mutex<HashMap<String, WarmInstance>>,
 }
 
 impl CodeExecutor {
@@ -853,404 +2272,3897 @@ impl CodeExecutor {
     }
 
     pub fn with_resource_limits(resource_limits: ResourceLimits) -> Self {
+        let cpu_pool = CpuPool::from_env();
         Self {
             language_registry: LanguageRegistry::new(),
             resource_limits,
+            request_limits: RequestLimits::from_env(),
+            config: IsoboxConfig::default(),
+            store: Arc::new(ExecutionStore::from_env()),
+            caches: CacheManager::from_env(),
+            datasets: DatasetStore::from_env(),
+            usage: UsageMeter::new(),
+            gpu_devices: std::env::var("GPU_DEVICES").ok().filter(|d| !d.is_empty()),
+            host_arch: normalize_arch(std::env::consts::ARCH)
+                .unwrap_or(std::env::consts::ARCH)
+                .to_string(),
+            arch_emulation: std::env::var("ARCH_EMULATION")
+                .unwrap_or_else(|_| "false".to_string())
+                .parse::<bool>()
+                .unwrap_or(false),
+            air_gapped: std::env::var("AIR_GAPPED")
+                .unwrap_or_else(|_| "false".to_string())
+                .parse::<bool>()
+                .unwrap_or(false),
+            embedded_backend: embedded::backend_from_env(),
+            core_dump_limit: coredump::max_bytes_from_env(),
+            batch_scheduling: Scheduling::from_env(),
+            cgroups: CgroupManager::from_env().with_cpuset(cpu_pool.enabled()),
+            cpu_pool,
+            language_slots: LanguageSlots::default(),
+            tracer: Tracer::from_env(),
+            syscall_filter: SyscallFilter::from_env(),
+            abuse: AbuseMonitor::new(AbuseConfig::default()),
+            user_mapping: UserMapping::from_env(),
+            workers: Arc::new(WorkerRegistry::new()),
+            local_execution: std::env::var("LOCAL_EXECUTION")
+                .unwrap_or_else(|_| "true".to_string())
+                .parse::<bool>()
+                .unwrap_or(true),
+            cache_affinity: std::env::var("WORKER_CACHE_AFFINITY")
+                .unwrap_or_else(|_| "true".to_string())
+                .parse::<bool>()
+                .unwrap_or(true),
+            events: EventBus::new(),
+            redactor: Redactor::default(),
+            latency: LatencyMonitor::from_env(),
+            hooks: HookChain::default(),
+            image_scanner: ImageScanner::default(),
+            dependencies: DependencyCache::from_env(),
+            bundles: BundleStore::from_env(),
+            results: ResultCache::from_env(),
+            label_metrics: LabelMetrics::new(&MetricLabelsConfig::default()),
+            presets: Arc::new(PresetRegistry::from_env(HashMap::new())),
+            checkers: tokio::sync::Mutex::new(HashMap::new()),
         }
     }
 
-    pub async fn execute(
-        &self,
-        request: ExecuteRequest,
-    ) -> Result<ExecuteResponse, ExecutionError> {
-        let config = self
-            .language_registry
-            .get_language_config(&request.language)
-            .ok_or_else(|| ExecutionError::UnsupportedLanguage(request.language.clone()))?;
+    pub fn with_config(config: &IsoboxConfig) -> Self {
+        let mut executor = Self::new();
+        if executor.embedded_backend {
+            executor.language_registry = LanguageRegistry::embedded(&config.embedded_runtimes);
+        } else {
+            executor.language_registry.apply_overrides(config);
+        }
+        executor.config = config.clone();
+        // Rules are checked when the configuration is loaded
+        executor.redactor = Redactor::from_config(&config.redaction).unwrap_or_else(|e| {
+            log::error!("Output redaction disabled: {e}");
+            Redactor::default()
+        });
+        executor.hooks = HookChain::from_config(config);
+        executor.cpu_pool = executor.cpu_pool.for_policy(config.cpu_policy);
+        executor.language_slots = LanguageSlots::from_config(config);
+        executor.image_scanner =
+            ImageScanner::new(config.image_scan.clone()).offline(executor.air_gapped);
+        executor.presets = Arc::new(PresetRegistry::from_env(config.presets.clone()));
+        executor.label_metrics = LabelMetrics::new(&config.metric_labels);
+        executor.abuse = AbuseMonitor::new(config.abuse.clone());
+        executor
+    }
 
-        // Generate unique job ID
-        let job_id = Uuid::new_v4().to_string();
+    /// Adds a hook that runs after those from the server configuration
+    pub fn with_hook(mut self, hook: Arc<dyn ExecutionHook>) -> Self {
+        self.hooks.push(hook);
+        self
+    }
 
-        // Create temp directory
-        let temp_dir = FileManager::create_temp_directory(&job_id)?;
+    pub fn with_store(mut self, store: ExecutionStore) -> Self {
+        self.store = Arc::new(store);
+        self
+    }
 
-        // Ensure cleanup happens even if execution fails
-        let result = if let Some(test_cases) = request.test_cases {
-            let result = self
-                .execute_with_test_cases(&temp_dir, config, &request.code, test_cases)
-                .await;
-            // Clean up temp directory after execution
-            FileManager::cleanup_temp_directory(&temp_dir);
-            result
-        } else {
-            let result = self
-                .execute_in_container(&temp_dir, config, &request.code)
-                .await;
-            // Clean up temp directory after execution
-            FileManager::cleanup_temp_directory(&temp_dir);
-            result
-        };
+    pub fn with_events(mut self, events: EventBus) -> Self {
+        self.events = events;
+        self
+    }
 
-        result
+    pub fn config(&self) -> &IsoboxConfig {
+        &self.config
     }
 
-    async fn execute_with_test_cases(
-        &self,
-        temp_dir: &str,
-        config: &LanguageConfig,
-        code: &str,
-        test_cases: Vec<TestCase>,
-    ) -> Result<ExecuteResponse, ExecutionError> {
-        // Write code to file
-        FileManager::write_code_file(temp_dir, config.file_name(), code)?;
+    pub fn presets(&self) -> &Arc<PresetRegistry> {
+        &self.presets
+    }
 
-        // Get resource limits for this language (use language-specific or default)
-        let limits = config.resource_limits().unwrap_or(&self.resource_limits);
+    pub fn bundles(&self) -> &BundleStore {
+        &self.bundles
+    }
 
-        // If compilation is needed, compile first
-        if let Some(compile_cmd) = config.compile_command() {
-            log::info!("Compiling with: {}", compile_cmd.join(" "));
+    pub fn label_metrics(&self) -> &LabelMetrics {
+        &self.label_metrics
+    }
 
-            let docker_compile_args =
-                DockerExecutor::build_docker_compile_command(temp_dir, config, limits, compile_cmd);
+    pub fn results(&self) -> &ResultCache {
+        &self.results
+    }
 
-            let compile_output =
-                DockerExecutor::execute_with_timeout(docker_compile_args, limits.wall_time_limit)
-                    .await?;
+    pub fn request_limits(&self) -> &RequestLimits {
+        &self.request_limits
+    }
 
-            if !compile_output.status.success() {
-                let stderr = String::from_utf8_lossy(&compile_output.stderr);
-                return Ok(ExecuteResponse {
-                    stdout: String::new(),
-                    stderr: stderr.to_string(),
-                    exit_code: compile_output.status.code().unwrap_or(1),
-                    time_taken: None,
-                    memory_used: None,
-                    test_results: None,
-                });
-            }
-        }
+    pub fn latency(&self) -> &LatencyMonitor {
+        &self.latency
+    }
 
-        // Execute each test case
-        let mut test_results = Vec::new();
-        let mut overall_stdout = String::new();
-        let mut overall_stderr = String::new();
-        let mut overall_exit_code = 0;
+    pub fn store(&self) -> &ExecutionStore {
+        &self.store
+    }
 
-        println!("Starting execution of {} test cases", test_cases.len());
+    /// Deletes executions past their tenant's retention period
+    pub fn purge_expired_executions(&self) -> Vec<String> {
+        let default = self.store.retention_seconds();
+        self.store.purge_expired(unix_timestamp(), |tenant| {
+            let ttl = self
+                .config
+                .tenant(tenant)
+                .and_then(|policy| policy.retention_seconds)
+                .or(default)?;
+            (ttl > 0).then_some(ttl)
+        })
+    }
 
-        for (i, test_case) in test_cases.iter().enumerate() {
-            println!(
-                "Executing test case {}/{}: {}",
-                i + 1,
-                test_cases.len(),
-                test_case.name
-            );
+    pub fn usage(&self) -> &UsageMeter {
+        &self.usage
+    }
 
-            let test_result = self
-                .execute_single_test_case(temp_dir, config, limits, test_case)
-                .await?;
+    pub fn events(&self) -> &EventBus {
+        &self.events
+    }
 
-            println!(
-                "Test case {} completed: passed={}",
-                test_case.name, test_result.passed
-            );
+    pub fn workers(&self) -> Arc<WorkerRegistry> {
+        self.workers.clone()
+    }
 
-            // Update overall results
-            if !test_result.passed {
-                overall_exit_code = 1;
-            }
-            overall_stdout.push_str(&format!("=== Test Case: {} ===\n", test_case.name));
-            overall_stdout.push_str(&test_result.stdout);
-            overall_stdout.push('\n');
+    pub fn languages(&self) -> Vec<String> {
+        let mut languages: Vec<String> = self.language_registry.languages.keys().cloned().collect();
+        languages.sort();
+        languages
+    }
 
-            if !test_result.stderr.is_empty() {
-                overall_stderr
-                    .push_str(&format!("=== Test Case: {} (stderr) ===\n", test_case.name));
-                overall_stderr.push_str(&test_result.stderr);
-                overall_stderr.push('\n');
-            }
+    /// Every supported language with its image, commands and effective limits
+    pub fn language_descriptions(&self) -> Vec<LanguageDescription> {
+        let mut descriptions: Vec<LanguageDescription> = self
+            .language_registry
+            .languages
+            .iter()
+            .map(|(name, config)| {
+                let mut versions: Vec<String> = config.image_versions.keys().cloned().collect();
+                versions.sort();
+                LanguageDescription {
+                    name: name.clone(),
+                    image: config.docker_image.clone(),
+                    versions,
+                    file_name: config.file_name.clone(),
+                    compile: config.compile_command.clone(),
+                    run: config.run_command.clone(),
+                    limits: config
+                        .resource_limits()
+                        .unwrap_or(&self.resource_limits)
+                        .into(),
+                    custom: config.custom,
+                    next_image: config.next_image.clone(),
+                    embedded: config.embedded,
+                    capabilities: config.capabilities.clone(),
+                }
+            })
+            .collect();
+        descriptions.sort_by(|a, b| a.name.cmp(&b.name));
+        descriptions
+    }
 
-            test_results.push(test_result);
-        }
+    /// Image a request for `language` with the given version or channel runs in
+    pub fn language_image(
+        &self,
+        language: &str,
+        version: Option<&str>,
+        channel: Option<Channel>,
+    ) -> Result<String, ExecutionError> {
+        Ok(self
+            .language_registry
+            .get_language_config(language)
+            .ok_or_else(|| ExecutionError::UnsupportedLanguage(language.to_string()))?
+            .for_version(language, version)?
+            .for_channel(language, channel)?
+            .docker_image)
+    }
 
-        println!(
-            "All test cases completed. Total results: {}",
-            test_results.len()
-        );
+    pub fn host_arch(&self) -> &str {
+        &self.host_arch
+    }
 
-        Ok(ExecuteResponse {
-            stdout: overall_stdout,
-            stderr: overall_stderr,
-            exit_code: overall_exit_code,
-            time_taken: None, // TODO: Calculate total time
-            memory_used: None,
-            test_results: Some(test_results),
-        })
+    pub fn gpu_available(&self) -> bool {
+        self.gpu_devices.is_some()
     }
 
-    async fn execute_single_test_case(
-        &self,
-        temp_dir: &str,
-        config: &LanguageConfig,
-        limits: &ResourceLimits,
-        test_case: &TestCase,
-    ) -> Result<TestCaseResult, ExecutionError> {
-        // Create custom limits for this test case if specified
-        let mut test_limits = limits.clone();
-        if let Some(timeout) = test_case.timeout_seconds {
-            test_limits.wall_time_limit = Duration::from_secs(timeout as u64);
-            // Also update CPU time limit to match wall time limit for consistency
-            test_limits.cpu_time_limit = Duration::from_secs(timeout as u64);
+    pub fn supports_language(&self, language: &str) -> bool {
+        self.language_registry
+            .get_language_config(language)
+            .is_some()
+    }
+
+    fn validate_layout(request: &ExecuteRequest) -> Result<(), ExecutionError> {
+        if let Some(work_dir) = &request.workdir {
+            validate_work_dir(work_dir)?;
         }
-        if let Some(memory_mb) = test_case.memory_limit_mb {
-            test_limits.memory_limit = memory_mb * 1024 * 1024;
+        if let Some(entrypoint) = &request.entrypoint {
+            validate_relative_path(entrypoint)?;
         }
+        for file in request.files.iter().flatten() {
+            validate_relative_path(&file.path)?;
+            if let Some(mode) = &file.mode {
+                parse_file_mode(mode)?;
+            }
+        }
+        Ok(())
+    }
 
-        // Build docker command for execution with stdin input
-        let docker_args = DockerExecutor::build_docker_command(
-            temp_dir,
-            config,
-            &test_limits,
-            config.run_command(),
-        );
-
-        // Debug: Print Docker command in CI
-        if std::env::var("CI").is_ok() {
-            println!("CI: Docker command: docker {}", docker_args.join(" "));
-            println!(
-                "CI: Test case: {} (timeout: {}s, memory: {}MB)",
-                test_case.name,
-                test_limits.wall_time_limit.as_secs(),
-                test_limits.memory_limit / (1024 * 1024)
-            );
+    fn check_command_allowed(
+        &self,
+        tenant: Option<&str>,
+        command: &[String],
+    ) -> Result<(), ExecutionError> {
+        let tenant = tenant.unwrap_or(DEFAULT_TENANT);
+        if command.is_empty() {
+            return Err(ExecutionError::PolicyViolation(
+                "Command override must not be empty".to_string(),
+            ));
+        }
+        match self.config.tenant(tenant) {
+            Some(policy) if policy.allows_command(command) => Ok(()),
+            _ => Err(ExecutionError::PolicyViolation(format!(
+                "Command '{}' is not allowed for tenant '{tenant}'",
+                command.join(" ")
+            ))),
         }
+    }
 
-        // Add stdin input
-        let input_data = test_case.input.as_bytes();
+    pub fn air_gapped(&self) -> bool {
+        self.air_gapped
+    }
 
-        log::info!(
-            "Executing test case '{}' with input: {}",
-            test_case.name,
-            test_case.input
-        );
+    pub fn embedded_backend(&self) -> bool {
+        self.embedded_backend
+    }
 
-        // Execute docker command with timeout and stdin
-        let start_time = std::time::Instant::now();
+    /// Checks that the interpreter of every embedded runtime exists, listing all
+    /// the missing ones at once
+    pub fn verify_embedded_runtimes(&self) -> Result<(), ExecutionError> {
+        let mut missing: Vec<String> = self
+            .language_registry
+            .languages
+            .values()
+            .filter(|config| config.embedded)
+            .flat_map(|config| {
+                config
+                    .compile_command
+                    .iter()
+                    .chain(std::iter::once(&config.run_command))
+                    .filter_map(|command| command.first())
+            })
+            .filter(|program| !embedded::interpreter_exists(program))
+            .cloned()
+            .collect();
+        missing.sort();
+        missing.dedup();
+        if !missing.is_empty() {
+            return Err(ExecutionError::MissingInterpreters(missing));
+        }
+        Ok(())
+    }
 
-        let output = DockerExecutor::execute_with_timeout_and_stdin(
-            docker_args,
-            test_limits.wall_time_limit,
-            input_data,
-        )
-        .await?;
+    /// In air-gapped mode, checks that every language image is already present,
+    /// listing all the missing ones at once. Does nothing otherwise.
+    pub fn verify_air_gapped(&self) -> Result<(), ExecutionError> {
+        if !self.air_gapped {
+            return Ok(());
+        }
+        let mut missing = Vec::new();
+        for image in self.language_registry.images() {
+            if !DockerExecutor::image_present(&image)? {
+                missing.push(image);
+            }
+        }
+        if !missing.is_empty() {
+            return Err(ExecutionError::MissingImages(missing));
+        }
+        log::info!("Air-gapped mode: all language images are preloaded");
+        Ok(())
+    }
 
-        let time_taken = start_time.elapsed().as_secs_f64();
+    /// Checks that sandboxes won't run as host root when `SANDBOX_USERNS` is
+    /// `remap`. Does nothing otherwise.
+    pub fn verify_user_mapping(&self) -> Result<(), ExecutionError> {
+        self.user_mapping
+            .verify(self.embedded_backend)
+            .map_err(ExecutionError::UserMapping)?;
+        if let Some((uid, gid)) = self.user_mapping.owner() {
+            log::info!("Sandboxes run as host user {uid}:{gid}");
+        } else if self.user_mapping.mode() == userns::UsernsMode::Remap {
+            log::info!("Sandboxes run as the rootless daemon's user");
+        }
+        Ok(())
+    }
 
-        let stdout = String::from_utf8_lossy(&output.stdout).to_string();
-        let stderr = String::from_utf8_lossy(&output.stderr).to_string();
-        let exit_code = output.status.code().unwrap_or(1);
+    /// Checks that the cgroups of executions can be created, when `CGROUP_PARENT`
+    /// asks the server to manage them
+    pub fn verify_cgroups(&self) -> Result<(), ExecutionError> {
+        self.cgroups
+            .verify(self.embedded_backend)
+            .map_err(ExecutionError::Cgroup)?;
+        if self.cgroups.enabled() {
+            log::info!("Sandbox steps run in their own cgroups");
+        }
+        Ok(())
+    }
 
-        // Determine if test passed
-        let passed = if let Some(expected) = &test_case.expected_output {
-            stdout.trim() == expected.trim() && exit_code == 0
-        } else {
-            exit_code == 0
+    /// Checks that the cores of `PINNED_CPUS` exist, when executions are pinned
+    pub fn verify_cpu_pinning(&self) -> Result<(), ExecutionError> {
+        self.cpu_pool.verify().map_err(ExecutionError::CpuPinning)?;
+        if self.cpu_pool.enabled() {
+            log::info!(
+                "Executions are pinned to CPUs {:?}, one per CPU, with the {} policy",
+                self.cpu_pool.cpus(),
+                self.cpu_pool.policy().as_str()
+            );
+        }
+        Ok(())
+    }
+
+    /// Resolves every digest-pinned image so a missing pin fails at startup
+    /// rather than on the first request that needs it
+    pub fn verify_pinned_images(&self) -> Result<(), ExecutionError> {
+        for image in self.language_registry.pinned_images() {
+            DockerExecutor::resolve_image(&image)?;
+            log::info!("Pinned image resolved: {image}");
+        }
+        Ok(())
+    }
+
+    pub fn image_scanner(&self) -> &ImageScanner {
+        &self.image_scanner
+    }
+
+    pub fn syscall_filter(&self) -> &SyscallFilter {
+        &self.syscall_filter
+    }
+
+    pub fn abuse(&self) -> &AbuseMonitor {
+        &self.abuse
+    }
+
+    pub fn language_slots(&self) -> &LanguageSlots {
+        &self.language_slots
+    }
+
+    /// Scans every language image for vulnerabilities, one after the other.
+    /// Blocks until the last scan finishes.
+    pub fn scan_images(&self) {
+        for image in self.language_registry.images() {
+            self.image_scanner.scan(&image);
+        }
+    }
+
+    /// Scans the language images now and again every `rescan_seconds`, off the
+    /// async runtime. Returns right away when scanning is disabled.
+    pub async fn scan_images_periodically(self: Arc<Self>) {
+        if !self.image_scanner.is_enabled() {
+            return;
+        }
+        loop {
+            let executor = self.clone();
+            if let Err(e) = tokio::task::spawn_blocking(move || executor.scan_images()).await {
+                log::error!("Image scan failed: {e}");
+            }
+            let Some(seconds) = self.image_scanner.rescan_seconds() else {
+                break;
+            };
+            tokio::time::sleep(Duration::from_secs(seconds)).await;
+        }
+    }
+
+    /// Makes every registered dataset available locally, downloading object-store
+    /// datasets so runs don't fetch them again. In air-gapped mode they have to be
+    /// present already.
+    pub fn prepare_datasets(&self) -> Result<(), ExecutionError> {
+        for (name, dataset) in &self.config.datasets {
+            let result = if self.air_gapped {
+                self.datasets.verify_local(name, dataset)
+            } else {
+                self.datasets.sync(name, dataset)
+            };
+            result.map_err(|e| ExecutionError::DatasetSync(name.clone(), e))?;
+            log::info!("Dataset ready: {name}");
+        }
+        Ok(())
+    }
+
+    pub async fn execute(
+        &self,
+        request: ExecuteRequest,
+    ) -> Result<ExecuteResponse, ExecutionError> {
+        let job_id = request
+            .execution_id
+            .clone()
+            .unwrap_or_else(|| Uuid::new_v4().to_string());
+        let tenant = request
+            .tenant
+            .as_deref()
+            .unwrap_or(DEFAULT_TENANT)
+            .to_string();
+        let language = request.language.clone();
+        let trace_id = Self::trace_id(&job_id, &request);
+
+        self.events
+            .publish(&ExecutionEvent::started(&job_id, &tenant, &language));
+        let mut abandoned = AbandonGuard {
+            events: &self.events,
+            job_id: &job_id,
+            tenant: &tenant,
+            language: &language,
+            finished: false,
         };
+        let result = self
+            .with_hooks(request, |request| self.execute_job(&job_id, request))
+            .await
+            .map(|response| ExecuteResponse {
+                trace_id,
+                ..response
+            });
+        abandoned.finished = true;
+        self.events.publish(&ExecutionEvent::finished(
+            &job_id, &tenant, &language, &result,
+        ));
+        result
+    }
 
-        let error_message = if !passed {
-            if let Some(expected) = &test_case.expected_output {
-                Some(format!(
-                    "Expected: '{}', Got: '{}'",
-                    expected.trim(),
-                    stdout.trim()
+    async fn execute_job(
+        &self,
+        job_id: &str,
+        request: ExecuteRequest,
+    ) -> Result<ExecuteResponse, ExecutionError> {
+        self.request_limits.check(&request)?;
+        let (request, function_call) = self.prepare_code(request)?;
+        let cache_key = self.result_cache_key(&request);
+        if let Some(response) = cache_key.as_ref().and_then(|key| self.results.get(key)) {
+            return Ok(response);
+        }
+        let started = std::time::Instant::now();
+        let mut response = self.dispatch_job(job_id, request).await?;
+        self.latency.record_execution(started.elapsed());
+        if function_call {
+            response.return_value = function_call::extract_return_value(&mut response.stdout);
+        }
+        if let Some(key) = cache_key {
+            self.results.insert(key, &response);
+        }
+        Ok(response)
+    }
+
+    // A preset's image and the tenant's bundle for it can change under the same
+    // request, so their versions are part of the key
+    fn result_cache_key(&self, request: &ExecuteRequest) -> Option<String> {
+        let tenant = request.tenant.as_deref().unwrap_or(DEFAULT_TENANT);
+        let context: Vec<String> = match &request.preset {
+            Some(preset) => [
+                self.presets.resolve(preset).ok().map(|p| p.image),
+                self.bundles.info(tenant, preset).map(|b| b.id),
+            ]
+            .into_iter()
+            .map(Option::unwrap_or_default)
+            .collect(),
+            None => Vec::new(),
+        };
+        self.results.key(tenant, request, &context)
+    }
+
+    // Runs a prepared request on an agent or on this host
+    async fn dispatch_job(
+        &self,
+        job_id: &str,
+        request: ExecuteRequest,
+    ) -> Result<ExecuteResponse, ExecutionError> {
+        if request
+            .deadline
+            .is_some_and(|deadline| deadline::remaining(deadline).is_none())
+        {
+            return Err(ExecutionError::DeadlineExceeded);
+        }
+        if let Some(result) = self.execute_remote(&request).await {
+            return result;
+        }
+        if !self.local_execution {
+            return Err(ExecutionError::Unavailable(format!(
+                "no connected worker runs {}",
+                request.language
+            )));
+        }
+
+        let mut config = self.resolve_config(&request)?;
+        config.job_id = Some(job_id.to_string());
+
+        // Create temp directory
+        let temp_dir = FileManager::create_temp_directory(job_id)?;
+
+        let result = self
+            .run_in_workspace(job_id, &temp_dir, config, request)
+            .await;
+
+        // Clean up temp directory after execution, even if execution failed
+        FileManager::cleanup_temp_directory(&temp_dir);
+        result
+    }
+
+    /// Hands the request to a connected agent that supports it. Returns None when no
+    /// agent can take it, in which case it runs on this host, or is rejected as busy
+    /// when this host doesn't run jobs.
+    async fn execute_remote(
+        &self,
+        request: &ExecuteRequest,
+    ) -> Option<Result<ExecuteResponse, ExecutionError>> {
+        let gpu = request.gpu.unwrap_or(false);
+        let arch = match &request.arch {
+            // Unknown architectures are rejected by the local validation
+            Some(arch) => Some(normalize_arch(arch)?),
+            None => None,
+        };
+        if !self.workers.has_candidate(&request.language, arch, gpu) {
+            return None;
+        }
+        // Uploaded inputs are files on this host, which agents can't read
+        if !request.uploaded_inputs.is_empty() {
+            return (!self.local_execution).then(|| {
+                Err(ExecutionError::Unavailable(
+                    "uploads run on the server that received them, which doesn't run jobs"
+                        .to_string(),
                 ))
-            } else {
-                Some(format!("Exit code: {exit_code}"))
+            });
+        }
+
+        if let Err(e) = self.check_remote_policy(request) {
+            return Some(Err(e));
+        }
+
+        let tenant = request.tenant.as_deref().unwrap_or(DEFAULT_TENANT);
+        let affinity = self.affinity_key(request);
+        let Some(reply) = self.workers.dispatch(request, tenant, arch, affinity) else {
+            return (!self.local_execution).then(|| {
+                Err(ExecutionError::Busy(
+                    format!("no worker for {} has free capacity", request.language),
+                    self.latency.retry_after(),
+                ))
+            });
+        };
+        let result = match reply.await {
+            Ok(Ok(response)) => {
+                self.usage
+                    .record_execution(tenant, response.gpu_seconds.unwrap_or(0.0));
+                // Artifacts stay on the agent that produced them
+                Ok(ExecuteResponse {
+                    execution_id: None,
+                    artifacts: None,
+                    workdir_archive: None,
+                    ..response
+                })
             }
-        } else {
-            None
+            Ok(Err(JobFailure::Failed(message))) => Err(ExecutionError::Execution(message)),
+            Ok(Err(JobFailure::Preempted)) => {
+                Err(ExecutionError::Preempted(self.latency.retry_after()))
+            }
+            Err(_) => Err(ExecutionError::Execution(
+                "worker disconnected before finishing the job".to_string(),
+            )),
         };
+        Some(result)
+    }
 
-        log::info!(
-            "Test case '{}' completed: passed={}, exit_code={}, time_taken={:.3}s",
-            test_case.name,
-            passed,
-            exit_code,
-            time_taken
-        );
+    // What a remote run builds and caches: the dependencies of the request's
+    // lockfile when it has one, otherwise the program. Requests with the same key
+    // go to the same agent.
+    fn affinity_key<'a>(&self, request: &'a ExecuteRequest) -> Option<&'a str> {
+        if !self.cache_affinity {
+            return None;
+        }
+        let lockfile = self
+            .config
+            .dependencies
+            .get(&request.language)
+            .and_then(|dependencies| {
+                request
+                    .files
+                    .iter()
+                    .flatten()
+                    .find(|file| file.path == dependencies.lockfile)
+            });
+        Some(lockfile.map_or(request.code.as_str(), |file| file.content.as_str()))
+    }
 
-        let actual_output = stdout.clone();
-        Ok(TestCaseResult {
-            name: test_case.name.clone(),
-            passed,
-            stdout,
-            stderr,
-            exit_code,
-            time_taken: Some(time_taken),
-            memory_used: None,
-            error_message,
-            input: test_case.input.clone(),
-            expected_output: test_case.expected_output.clone(),
-            actual_output,
+    // Policy is enforced here for requests run by agents; agents only apply their own
+    // host-level checks
+    fn check_remote_policy(&self, request: &ExecuteRequest) -> Result<(), ExecutionError> {
+        let tenant = request.tenant.as_deref().unwrap_or(DEFAULT_TENANT);
+        Self::validate_layout(request)?;
+        // The agent checks again against its own configuration of the language
+        if let Some(config) = self
+            .language_registry
+            .get_language_config(&request.language)
+        {
+            config.check_layout(request)?;
+        }
+        if let Some(command) = &request.command {
+            self.check_command_allowed(Some(tenant), command)?;
+        }
+        if request.gpu.unwrap_or(false) {
+            self.check_gpu_quota(Some(tenant))?;
+        }
+        Ok(())
+    }
+
+    /// Validates a request the way executing it would, without creating a sandbox,
+    /// and returns what it would run with. Requests a connected agent would take are
+    /// described with this server's configuration of their language.
+    pub fn plan(&self, request: ExecuteRequest) -> Result<ExecutionPlan, ExecutionError> {
+        self.request_limits.check(&request)?;
+        let (request, _) = self.prepare_code(request)?;
+        let arch = request.arch.as_deref().map(normalize_arch);
+        let remote = !matches!(arch, Some(None))
+            && self.workers.has_candidate(
+                &request.language,
+                arch.flatten(),
+                request.gpu.unwrap_or(false),
+            );
+        let (config, backend) = if remote {
+            self.check_remote_policy(&request)?;
+            let mut config = self
+                .language_registry
+                .get_language_config(&request.language)
+                .ok_or_else(|| ExecutionError::UnsupportedLanguage(request.language.clone()))?
+                .for_version(&request.language, request.version.as_deref())?
+                .for_channel(&request.language, request.channel)?;
+            self.apply_preset(&request, &mut config)?;
+            if let Some(command) = &request.command {
+                config.run_command = command.clone();
+            }
+            self.apply_deadline(&request, &mut config);
+            let config =
+                config.with_layout(request.workdir.as_deref(), request.entrypoint.as_deref());
+            (config, "worker")
+        } else if !self.local_execution {
+            return Err(ExecutionError::Unavailable(format!(
+                "no connected worker runs {}",
+                request.language
+            )));
+        } else {
+            let config = self.resolve_config(&request)?;
+            let backend = if config.embedded {
+                "embedded"
+            } else {
+                "docker"
+            };
+            (config, backend)
+        };
+
+        Ok(ExecutionPlan {
+            language: request.language.clone(),
+            backend,
+            limits: config
+                .resource_limits
+                .as_ref()
+                .unwrap_or(&self.resource_limits)
+                .into(),
+            work_dir: config.work_dir.clone(),
+            compile: config.compile_command.clone(),
+            run: config.run_command.clone(),
+            channel: config.channel,
+            platform: config.platform.clone(),
+            emulated: config.emulated,
+            gpu: request.gpu.unwrap_or(false),
+            mounts: config
+                .extra_mounts
+                .iter()
+                .map(|mount| mount.container_path.clone())
+                .collect(),
+            syscall_policy: config.syscall_policy,
+            file_name: config.file_name,
+            image: config.docker_image,
         })
     }
 
-    async fn execute_in_container(
+    /// Runs a request in an existing workspace that outlives the execution,
+    /// e.g. a session volume. Files from earlier executions stay visible.
+    pub async fn execute_in_workspace(
         &self,
-        temp_dir: &str,
-        config: &LanguageConfig,
-        code: &str,
+        request: ExecuteRequest,
+        workspace: &str,
     ) -> Result<ExecuteResponse, ExecutionError> {
-        // Write code to file
-        FileManager::write_code_file(temp_dir, config.file_name(), code)?;
+        let job_id = Uuid::new_v4().to_string();
+        let tenant = request
+            .tenant
+            .as_deref()
+            .unwrap_or(DEFAULT_TENANT)
+            .to_string();
+        let language = request.language.clone();
+        let trace_id = Self::trace_id(&job_id, &request);
+
+        self.events
+            .publish(&ExecutionEvent::started(&job_id, &tenant, &language));
+        let id = job_id.as_str();
+        let result = self
+            .with_hooks(request, |request| async move {
+                self.request_limits.check(&request)?;
+                let (request, function_call) = self.prepare_code(request)?;
+                let mut config = self.resolve_config(&request)?;
+                config.job_id = Some(id.to_string());
+                let mut response = self
+                    .run_in_workspace(id, workspace, config, request)
+                    .await?;
+                if function_call {
+                    response.return_value =
+                        function_call::extract_return_value(&mut response.stdout);
+                }
+                Ok(response)
+            })
+            .await
+            .map(|response| ExecuteResponse {
+                trace_id,
+                ..response
+            });
+        self.events.publish(&ExecutionEvent::finished(
+            &job_id, &tenant, &language, &result,
+        ));
+        result
+    }
 
-        // Verify file exists before running Docker
-        let file_path = format!("{temp_dir}/{}", config.file_name());
-        if !std::path::Path::new(&file_path).exists() {
-            return Err(ExecutionError::FileWrite(format!(
-                "File does not exist after creation: {file_path}",
+    // The ID of the caller's trace, which the execution's ID is logged with so
+    // isobox's logs can be joined with the caller's
+    fn trace_id(job_id: &str, request: &ExecuteRequest) -> Option<String> {
+        let trace_id = request.trace_context.as_ref()?.trace_id().to_string();
+        log::info!("Execution {job_id} is part of trace {trace_id}");
+        Some(trace_id)
+    }
+
+    // Runs an execution between the before and after hooks
+    async fn with_hooks<F, Fut>(
+        &self,
+        mut request: ExecuteRequest,
+        run: F,
+    ) -> Result<ExecuteResponse, ExecutionError>
+    where
+        F: FnOnce(ExecuteRequest) -> Fut,
+        Fut: std::future::Future<Output = Result<ExecuteResponse, ExecutionError>>,
+    {
+        if self.hooks.is_empty() {
+            return run(request).await;
+        }
+        self.hooks.before(&mut request).await?;
+        let mut response = run(request.clone()).await?;
+        self.hooks.after(&request, &mut response).await?;
+        Ok(response)
+    }
+
+    /// Starts a warm instance for a request, running its compile step once so
+    /// invocations only pay for the run command
+    pub async fn start_instance(
+        &self,
+        mut request: ExecuteRequest,
+    ) -> Result<WarmInstance, ExecutionError> {
+        self.request_limits.check(&request)?;
+        if !self.local_execution {
+            return Err(ExecutionError::Unavailable(
+                "warm instances run on the server, which doesn't execute jobs itself".to_string(),
+            ));
+        }
+        if request.gpu.unwrap_or(false) {
+            return Err(ExecutionError::InvalidRequest(
+                "Warm instances can't hold a GPU".to_string(),
+            ));
+        }
+        if !self.hooks.is_empty() {
+            self.hooks.before(&mut request).await?;
+        }
+        let (request, function_call) = self.prepare_code(request)?;
+        let mut config = self.resolve_config(&request)?;
+        if config.embedded {
+            return Err(ExecutionError::InvalidRequest(format!(
+                "Warm instances need a container runtime, but {} runs on an embedded runtime",
+                request.language
             )));
         }
+        let limits = config
+            .resource_limits()
+            .unwrap_or(&self.resource_limits)
+            .clone();
+
+        let id = Uuid::new_v4().to_string();
+        config.job_id = Some(id.clone());
+        let workspace = FileManager::create_temp_directory(&format!("fn-{id}"))?;
+        let instance = WarmInstance {
+            container: format!("isobox-fn-{id}"),
+            workspace,
+            config,
+            limits,
+            function_call,
+            tenant: request
+                .tenant
+                .clone()
+                .unwrap_or_else(|| DEFAULT_TENANT.to_string()),
+        };
+        if let Err(e) = self.boot_instance(&instance, &request).await {
+            self.stop_instance(instance).await;
+            return Err(e);
+        }
+        Ok(instance)
+    }
 
-        // Small delay to ensure file is properly synced
-        tokio::time::sleep(tokio::time::Duration::from_millis(100)).await;
+    async fn boot_instance(
+        &self,
+        instance: &WarmInstance,
+        request: &ExecuteRequest,
+    ) -> Result<(), ExecutionError> {
+        let config = &instance.config;
+        if let Some(files) = &request.files {
+            FileManager::write_workspace_files(&instance.workspace, files)?;
+        }
+        FileManager::write_code_file(&instance.workspace, config.file_name(), &request.code)?;
+        if let Some(owner) = config.sandbox_owner {
+            userns::hand_over(Path::new(&instance.workspace), owner).map_err(|e| {
+                ExecutionError::FileWrite(format!(
+                    "Failed to hand the workspace to the sandbox user: {e}"
+                ))
+            })?;
+        }
 
-        // Get resource limits for this language (use language-specific or default)
-        let limits = config.resource_limits().unwrap_or(&self.resource_limits);
+        Self::start_container(instance).await?;
 
-        // If compilation is needed, compile first
         if let Some(compile_cmd) = config.compile_command() {
-            log::info!("Compiling with: {}", compile_cmd.join(" "));
+            let output = DockerExecutor::execute_with_timeout(
+                Self::exec_args(&instance.container, &config.work_dir, compile_cmd),
+                instance.limits.wall_time_limit,
+            )
+            .await?;
+            if !output.status.success() {
+                return Err(ExecutionError::InvalidRequest(format!(
+                    "Compilation failed:\n{}",
+                    String::from_utf8_lossy(&output.stderr)
+                )));
+            }
+        }
+        Ok(())
+    }
 
-            let docker_compile_args =
-                DockerExecutor::build_docker_command(temp_dir, config, limits, compile_cmd);
+    // Starts an instance's container, which idles until commands are run in it
+    async fn start_container(instance: &WarmInstance) -> Result<(), ExecutionError> {
+        let docker_args = DockerExecutor::build_warm_command(instance);
+        let output =
+            DockerExecutor::execute_with_timeout(docker_args, instance.limits.wall_time_limit)
+                .await?;
+        if !output.status.success() {
+            return Err(ExecutionError::Execution(
+                String::from_utf8_lossy(&output.stderr).trim().to_string(),
+            ));
+        }
+        Ok(())
+    }
 
-            let compile_output =
-                DockerExecutor::execute_with_timeout(docker_compile_args, limits.wall_time_limit)
-                    .await?;
+    fn exec_args(container: &str, work_dir: &str, command: &[String]) -> Vec<String> {
+        let mut args = vec![
+            "exec".to_string(),
+            "-i".to_string(),
+            "-w".to_string(),
+            work_dir.to_string(),
+            container.to_string(),
+        ];
+        args.extend(command.iter().cloned());
+        args
+    }
 
-            if !compile_output.status.success() {
-                let stderr = String::from_utf8_lossy(&compile_output.stderr);
-                return Ok(ExecuteResponse {
-                    stdout: String::new(),
-                    stderr: stderr.to_string(),
-                    exit_code: compile_output.status.code().unwrap_or(1),
-                    time_taken: None,
-                    memory_used: None,
-                    test_results: None,
-                });
-            }
+    /// Runs an instance's program with `input` on stdin and, for function calls,
+    /// `args` as the JSON arguments. After an error the instance's state is unknown,
+    /// so callers should stop it rather than reuse it.
+    pub async fn invoke_instance(
+        &self,
+        instance: &WarmInstance,
+        input: &str,
+        args: Option<&[serde_json::Value]>,
+    ) -> Result<ExecuteResponse, ExecutionError> {
+        if input.len() > self.request_limits.max_stdin_bytes {
+            return Err(ExecutionError::PayloadTooLarge(
+                "input".to_string(),
+                format!(
+                    "input is {} bytes, the limit is {} bytes",
+                    input.len(),
+                    self.request_limits.max_stdin_bytes
+                ),
+            ));
+        }
+        if let Some(args) = args {
+            let args = serde_json::Value::Array(args.to_vec()).to_string();
+            FileManager::write_code_file(&instance.workspace, function_call::ARGS_FILE, &args)?;
         }
 
-        // Build docker command for execution
-        let docker_args =
-            DockerExecutor::build_docker_command(temp_dir, config, limits, config.run_command());
+        let start_time = std::time::Instant::now();
+        let output = DockerExecutor::execute_with_timeout_and_stdin(
+            Self::exec_args(
+                &instance.container,
+                &instance.config.work_dir,
+                instance.config.run_command(),
+            ),
+            instance.limits.wall_time_limit,
+            Stdin::Bytes(input.as_bytes()),
+        )
+        .await?;
+        self.usage.record_execution(&instance.tenant, 0.0);
 
-        log::info!("Executing: docker {}", docker_args.join(" "));
+        let exit_code = termination::exit_code(&output.status);
+        let termination = termination::from_exit_code(
+            exit_code,
+            start_time.elapsed(),
+            instance.limits.cpu_time_limit,
+        );
+        let mut response = ExecuteResponse {
+            stdout: String::from_utf8_lossy(&output.stdout).to_string(),
+            stderr: String::from_utf8_lossy(&output.stderr).to_string(),
+            exit_code,
+            time_taken: Some(start_time.elapsed().as_secs_f64()),
+            emulated: instance
+                .config
+                .platform
+                .is_some()
+                .then_some(instance.config.emulated),
+            channel: instance.config.channel,
+            ..Default::default()
+        }
+        .with_termination(termination);
+        if instance.function_call {
+            response.return_value = function_call::extract_return_value(&mut response.stdout);
+        }
+        Ok(response)
+    }
 
-        // Execute docker command with timeout
-        let start_time = std::time::Instant::now();
+    /// Removes an instance's container and workspace
+    pub async fn stop_instance(&self, instance: WarmInstance) {
+        let args = vec![
+            "rm".to_string(),
+            "-f".to_string(),
+            instance.container.clone(),
+        ];
+        if let Err(e) = DockerExecutor::execute_with_timeout(args, Duration::from_secs(30)).await {
+            log::warn!("Failed to stop warm instance {}: {e}", instance.container);
+        }
+        FileManager::cleanup_temp_directory(&instance.workspace);
+    }
 
-        let output =
-            DockerExecutor::execute_with_timeout(docker_args, limits.wall_time_limit).await?;
+    /// Parses code with its language's syntax checker, without compiling or running
+    /// it. Checks run in a warm container per tenant and language, so after the first
+    /// one they take about as long as the checker itself.
+    pub async fn check_syntax(
+        &self,
+        request: CheckRequest,
+        tenant: &str,
+    ) -> Result<CheckResponse, ExecutionError> {
+        let request = ExecuteRequest {
+            language: request.language,
+            code: request.code,
+            version: request.version,
+            tenant: Some(tenant.to_string()),
+            ..Default::default()
+        };
+        self.request_limits.check(&request)?;
+        let config = self.resolve_config(&request)?;
+        let command = config.check_command.clone().ok_or_else(|| {
+            ExecutionError::InvalidRequest(format!(
+                "Language {} has no syntax checker",
+                request.language
+            ))
+        })?;
 
+        let start_time = std::time::Instant::now();
+        let output = if config.embedded {
+            self.check_embedded(&config, &command, &request.code)
+                .await?
+        } else {
+            self.check_in_container(tenant, &request.language, &config, &command, &request.code)
+                .await?
+        };
         let time_taken = start_time.elapsed().as_secs_f64();
 
-        let stdout = String::from_utf8_lossy(&output.stdout).to_string();
-        let stderr = String::from_utf8_lossy(&output.stderr).to_string();
-        let exit_code = output.status.code().unwrap_or(1);
+        let output_text = format!(
+            "{}{}",
+            String::from_utf8_lossy(&output.stdout),
+            String::from_utf8_lossy(&output.stderr)
+        );
+        let mut diagnostics = syntax::parse_diagnostics(&output_text, config.file_name());
+        if !output.status.success() && diagnostics.is_empty() {
+            // The checker failed without saying where
+            diagnostics.push(Diagnostic {
+                line: None,
+                column: None,
+                severity: Severity::Error,
+                message: output_text.trim().to_string(),
+            });
+        }
+        let valid = output.status.success()
+            && !diagnostics
+                .iter()
+                .any(|diagnostic| diagnostic.severity == Severity::Error);
+        Ok(CheckResponse {
+            valid,
+            diagnostics,
+            time_taken,
+        })
+    }
+
+    // Runs a check in the tenant's warm checker for the language, in a directory of
+    // its own so concurrent checks don't see each other's code. Tenants never share a
+    // checker, so code can't reach another tenant's checks.
+    async fn check_in_container(
+        &self,
+        tenant: &str,
+        language: &str,
+        config: &LanguageConfig,
+        command: &[String],
+        code: &str,
+    ) -> Result<std::process::Output, ExecutionError> {
+        let key = format!("{tenant}/{language}@{}", config.docker_image());
+        let directory = format!("check-{}", Uuid::new_v4());
+        let work_dir = format!("{}/{directory}", config.work_dir);
+        let mut replaced = false;
+        loop {
+            let (container, workspace) = self.checker(&key, tenant, config).await?;
+            let check_dir = format!("{workspace}/{directory}");
+            let output = async {
+                FileManager::write_code_file(
+                    &workspace,
+                    &format!("{directory}/{}", config.file_name()),
+                    code,
+                )?;
+                Self::hand_over_workspace(config, &check_dir)?;
+                DockerExecutor::execute_with_timeout(
+                    Self::exec_args(&container, &work_dir, command),
+                    CHECK_TIMEOUT,
+                )
+                .await
+            }
+            .await;
+            FileManager::cleanup_temp_directory(&check_dir);
+
+            // A checker whose container went away is replaced, once
+            let gone = output.as_ref().is_ok_and(|output| {
+                let stderr = String::from_utf8_lossy(&output.stderr);
+                stderr.contains("No such container") || stderr.contains("is not running")
+            });
+            if !gone || replaced {
+                return output;
+            }
+            log::warn!("Syntax checker {container} for {key} is gone, starting another");
+            if let Some(checker) = self.checkers.lock().await.remove(&key) {
+                self.stop_instance(checker).await;
+            }
+            replaced = true;
+        }
+    }
+
+    // The tenant's warm checker container for `key`, started if there is none yet.
+    // Returns its name and workspace.
+    async fn checker(
+        &self,
+        key: &str,
+        tenant: &str,
+        config: &LanguageConfig,
+    ) -> Result<(String, String), ExecutionError> {
+        let mut checkers = self.checkers.lock().await;
+        if let Some(checker) = checkers.get(key) {
+            return Ok((checker.container.clone(), checker.workspace.clone()));
+        }
+        let id = Uuid::new_v4().to_string();
+        let instance = WarmInstance {
+            container: format!("isobox-check-{id}"),
+            workspace: FileManager::create_temp_directory(&format!("check-{id}"))?,
+            config: LanguageConfig {
+                job_id: Some(id.clone()),
+                ..config.clone()
+            },
+            limits: config
+                .resource_limits()
+                .unwrap_or(&self.resource_limits)
+                .clone(),
+            function_call: false,
+            tenant: tenant.to_string(),
+        };
+        let started = match Self::hand_over_workspace(config, &instance.workspace) {
+            Ok(()) => Self::start_container(&instance).await,
+            Err(e) => Err(e),
+        };
+        if let Err(e) = started {
+            self.stop_instance(instance).await;
+            return Err(e);
+        }
+        log::info!("Started syntax checker {} for {key}", instance.container);
+        let names = (instance.container.clone(), instance.workspace.clone());
+        checkers.insert(key.to_string(), instance);
+        Ok(names)
+    }
+
+    // Runs a check as a host process for embedded runtimes
+    async fn check_embedded(
+        &self,
+        config: &LanguageConfig,
+        command: &[String],
+        code: &str,
+    ) -> Result<std::process::Output, ExecutionError> {
+        let mut limits = config
+            .resource_limits()
+            .unwrap_or(&self.resource_limits)
+            .clone();
+        limits.wall_time_limit = limits.wall_time_limit.min(CHECK_TIMEOUT);
+        let temp_dir = FileManager::create_temp_directory(&format!("check-{}", Uuid::new_v4()))?;
+        let output = async {
+            FileManager::write_code_file(&temp_dir, config.file_name(), code)?;
+            Self::hand_over_workspace(config, &temp_dir)?;
+            embedded::run(
+                &temp_dir,
+                command,
+                &limits,
+                config.sandbox_owner,
+                None,
+                None,
+                None,
+                Stdin::Bytes(&[]),
+            )
+            .await
+        }
+        .await;
+        FileManager::cleanup_temp_directory(&temp_dir);
+        output
+    }
+
+    fn hand_over_workspace(config: &LanguageConfig, path: &str) -> Result<(), ExecutionError> {
+        let Some(owner) = config.sandbox_owner else {
+            return Ok(());
+        };
+        userns::hand_over(Path::new(path), owner).map_err(|e| {
+            ExecutionError::FileWrite(format!(
+                "Failed to hand the workspace to the sandbox user: {e}"
+            ))
+        })
+    }
+
+    /// Removes the syntax checkers' containers, e.g. when the server shuts down
+    pub async fn stop_checkers(&self) {
+        let checkers: Vec<WarmInstance> = self
+            .checkers
+            .lock()
+            .await
+            .drain()
+            .map(|(_, checker)| checker)
+            .collect();
+        for checker in checkers {
+            self.stop_instance(checker).await;
+        }
+    }
+
+    // Applies the harness and function call glue to the request's code and picks its
+    // runtime channel. Returns whether the output carries a function's return value.
+    fn prepare_code(
+        &self,
+        request: ExecuteRequest,
+    ) -> Result<(ExecuteRequest, bool), ExecutionError> {
+        let mut request = self.apply_harness(request)?;
+        self.assign_channel(&mut request)?;
+        let Some(call) = request.function.take() else {
+            return Ok((request, false));
+        };
+        call.validate(&request.language)
+            .map_err(ExecutionError::InvalidRequest)?;
+        if request.test_cases.is_some() {
+            return Err(ExecutionError::InvalidRequest(
+                "Function calls can't be combined with test cases".to_string(),
+            ));
+        }
+        let glue = call.glue(&request.language, &request.code);
+        request.code.push_str(&glue);
+        request
+            .files
+            .get_or_insert_with(Vec::new)
+            .push(WorkspaceFile {
+                path: function_call::ARGS_FILE.to_string(),
+                content: call.args_json(),
+                mode: None,
+            });
+        Ok((request, true))
+    }
+
+    // Picks the channel of a language with a staged next runtime: opted-in tenants
+    // always get the next runtime, other requests get it at the configured rate.
+    // Channels are picked before dispatch, so an agent runs the channel the server
+    // picked. Requests that pin a version or select a preset run its image, outside
+    // any channel.
+    fn assign_channel(&self, request: &mut ExecuteRequest) -> Result<(), ExecutionError> {
+        if request.version.is_some() || request.preset.is_some() {
+            if request.channel.is_some() {
+                return Err(ExecutionError::InvalidRequest(
+                    "channel can't be combined with version or preset".to_string(),
+                ));
+            }
+            return Ok(());
+        }
+        if request.channel.is_some() {
+            return Ok(());
+        }
+        let Some(next) = self
+            .config
+            .languages
+            .get(&request.language)
+            .and_then(|language| language.next.as_ref())
+        else {
+            return Ok(());
+        };
+        let tenant = request.tenant.as_deref().unwrap_or(DEFAULT_TENANT);
+        let opted_in = next.tenants.iter().any(|t| t == tenant);
+        request.channel = Some(if opted_in || sample(next.percent) {
+            Channel::Next
+        } else {
+            Channel::Stable
+        });
+        Ok(())
+    }
+
+    // Wraps the request's code in the harness it selected. Size limits are checked
+    // against the submitted code, since the template is the operator's.
+    fn apply_harness(&self, mut request: ExecuteRequest) -> Result<ExecuteRequest, ExecutionError> {
+        let Some(name) = request.harness.take() else {
+            return Ok(request);
+        };
+        let harness =
+            self.config.harnesses.get(&name).ok_or_else(|| {
+                ExecutionError::InvalidRequest(format!("Unknown harness '{name}'"))
+            })?;
+        if harness.language != request.language {
+            return Err(ExecutionError::InvalidRequest(format!(
+                "Harness '{name}' is for {}, not {}",
+                harness.language, request.language
+            )));
+        }
+        let params = request.harness_params.take().unwrap_or_default();
+        request.code = harness
+            .render(&request.code, &params)
+            .map_err(ExecutionError::InvalidRequest)?;
+        Ok(request)
+    }
+
+    fn resolve_config(&self, request: &ExecuteRequest) -> Result<LanguageConfig, ExecutionError> {
+        let mut config = self
+            .language_registry
+            .get_language_config(&request.language)
+            .ok_or_else(|| ExecutionError::UnsupportedLanguage(request.language.clone()))?
+            .for_version(&request.language, request.version.as_deref())?
+            .for_channel(&request.language, request.channel)?;
+        self.apply_preset(request, &mut config)?;
+        config.env.extend(self.config.package_mirrors.env());
+        config.pull_disabled = self.air_gapped;
+        config.sandbox_owner = self.user_mapping.owner();
+        if let Some(terminal) = request.terminal {
+            terminal
+                .validate()
+                .map_err(ExecutionError::InvalidRequest)?;
+            config.terminal = Some(terminal);
+        }
+        if request.priority == Some(Priority::Batch) {
+            config.scheduling = Some(self.batch_scheduling);
+        }
+        if let Some(reason) = self.image_scanner.blocked(&config.docker_image) {
+            return Err(ExecutionError::ImageBlocked(
+                request.language.clone(),
+                reason,
+            ));
+        }
+        if let Some(command) = &request.command {
+            self.check_command_allowed(request.tenant.as_deref(), command)?;
+            config.run_command = command.clone();
+        }
+        Self::validate_layout(request)?;
+        config.check_layout(request)?;
+        if request.debug.unwrap_or(false) && request.test_cases.is_some() {
+            return Err(ExecutionError::InvalidRequest(
+                "debug can't be combined with test cases".to_string(),
+            ));
+        }
+        judge::validate(
+            request.test_cases.as_deref(),
+            request.test_groups.as_deref(),
+        )
+        .map_err(ExecutionError::InvalidRequest)?;
+        match (&request.interactor, &request.checker) {
+            (Some(_), Some(_)) => {
+                return Err(ExecutionError::InvalidRequest(
+                    "A request can have an interactor or a checker, not both".to_string(),
+                ));
+            }
+            (Some(program), None) | (None, Some(program)) => {
+                if request.test_cases.is_none() {
+                    return Err(ExecutionError::InvalidRequest(
+                        "An interactor or checker needs test cases".to_string(),
+                    ));
+                }
+                self.judge_program_config(program, &config)?;
+            }
+            (None, None) => {}
+        }
+        self.apply_ulimits(request, &mut config)?;
+        self.apply_deadline(request, &mut config);
+        if config.embedded {
+            // Embedded runtimes run in the workspace itself, without mounts or devices
+            let unsupported = request.workdir.is_some()
+                || request.preset.is_some()
+                || request.gpu.unwrap_or(false)
+                || request.arch.is_some()
+                || request.datasets.iter().flatten().next().is_some();
+            if unsupported {
+                return Err(ExecutionError::InvalidRequest(format!(
+                    "Language {} runs on an embedded runtime, which doesn't support workdir, presets, gpu, arch or datasets",
+                    request.language
+                )));
+            }
+            let mut config = config.with_layout(None, request.entrypoint.as_deref());
+            self.apply_trace(request, &mut config)?;
+            return Ok(config);
+        }
+        let mut config =
+            config.with_layout(request.workdir.as_deref(), request.entrypoint.as_deref());
+        let filesystem = self.config.filesystem(&request.language);
+        config.read_only_root = filesystem.read_only;
+        config.tmpfs = filesystem.tmpfs_mounts();
+        if config
+            .tmpfs
+            .iter()
+            .any(|(path, _)| *path == config.work_dir)
+        {
+            return Err(ExecutionError::InvalidRequest(format!(
+                "workdir {} is a tmpfs mount of language {}",
+                config.work_dir, request.language
+            )));
+        }
+        config.extra_mounts = self.cache_mounts(request)?;
+        config.extra_mounts.extend(self.dataset_mounts(request)?);
+        self.apply_bundle(request, &mut config);
+        if request.gpu.unwrap_or(false) {
+            config.gpu_devices = Some(self.check_gpu_allowed(request.tenant.as_deref())?);
+        }
+        if let Some(arch) = &request.arch {
+            let arch = normalize_arch(arch).ok_or_else(|| {
+                ExecutionError::InvalidRequest(format!(
+                    "Unsupported architecture '{arch}', expected amd64 or arm64"
+                ))
+            })?;
+            config.emulated = arch != self.host_arch;
+            if config.emulated && !self.arch_emulation {
+                return Err(ExecutionError::Unavailable(format!(
+                    "no {arch} worker is available and emulation is disabled"
+                )));
+            }
+            config.platform = Some(format!("linux/{arch}"));
+        }
+        self.apply_syscall_policy(request, &mut config)?;
+        self.apply_trace(request, &mut config)?;
+        Ok(config)
+    }
+
+    // The language config of an interactor or checker, with the submission's job so
+    // its containers are stopped with the submission's
+    fn judge_program_config(
+        &self,
+        program: &JudgeProgram,
+        submission: &LanguageConfig,
+    ) -> Result<LanguageConfig, ExecutionError> {
+        let mut config = self
+            .language_registry
+            .get_language_config(&program.language)
+            .ok_or_else(|| ExecutionError::UnsupportedLanguage(program.language.clone()))?
+            .clone();
+        if config.embedded || submission.embedded {
+            return Err(ExecutionError::InvalidRequest(
+                "Interactors and checkers need containers, so they don't run on embedded runtimes"
+                    .to_string(),
+            ));
+        }
+        if let Some(reason) = self.image_scanner.blocked(&config.docker_image) {
+            return Err(ExecutionError::ImageBlocked(
+                program.language.clone(),
+                reason,
+            ));
+        }
+        config.pull_disabled = self.air_gapped;
+        config.sandbox_owner = submission.sandbox_owner;
+        config.job_id = submission.job_id.clone();
+        Ok(config)
+    }
+
+    // Writes an interactor's or checker's code to a workspace of its own and compiles
+    // it. Test cases can't be judged without it, so a compile error fails the
+    // execution.
+    async fn prepare_judge_program(
+        &self,
+        program: &JudgeProgram,
+        role: &str,
+        submission: &LanguageConfig,
+    ) -> Result<PreparedProgram, ExecutionError> {
+        let config = self.judge_program_config(program, submission)?;
+        let limits = config
+            .resource_limits()
+            .unwrap_or(&self.resource_limits)
+            .clone();
+        let prepared = PreparedProgram {
+            workspace: FileManager::create_temp_directory(&format!("{role}-{}", Uuid::new_v4()))?,
+            config,
+            limits,
+        };
+        FileManager::write_code_file(
+            &prepared.workspace,
+            prepared.config.file_name(),
+            &program.code,
+        )?;
+        Self::hand_over_workspace(&prepared.config, &prepared.workspace)?;
+        if let Some(compile_cmd) = prepared.config.compile_command() {
+            let output = DockerExecutor::execute_with_timeout(
+                DockerExecutor::build_docker_compile_command(
+                    &prepared.workspace,
+                    &prepared.config,
+                    &prepared.limits,
+                    compile_cmd,
+                ),
+                prepared.limits.wall_time_limit,
+            )
+            .await?;
+            if !output.status.success() {
+                return Err(ExecutionError::Execution(format!(
+                    "The {role} failed to compile: {}",
+                    String::from_utf8_lossy(&output.stderr).trim()
+                )));
+            }
+        }
+        Ok(prepared)
+    }
+
+    // Ends the run's wall time at the caller's deadline, since nobody is waiting for
+    // the result after it
+    fn apply_deadline(&self, request: &ExecuteRequest, config: &mut LanguageConfig) {
+        let Some(left) = request.deadline.and_then(deadline::remaining) else {
+            return;
+        };
+        let mut limits = config
+            .resource_limits
+            .clone()
+            .unwrap_or_else(|| self.resource_limits.clone());
+        limits.wall_time_limit = limits.wall_time_limit.min(left);
+        config.resource_limits = Some(limits);
+    }
+
+    // Tightens the sandbox's ulimits to the request's. The language's limits are the
+    // ceiling, so a request can't raise them.
+    // Runs the request in its preset's image, with the preset's environment and limits
+    fn apply_preset(
+        &self,
+        request: &ExecuteRequest,
+        config: &mut LanguageConfig,
+    ) -> Result<(), ExecutionError> {
+        let Some(name) = &request.preset else {
+            return Ok(());
+        };
+        let preset = self
+            .presets
+            .resolve(name)
+            .map_err(ExecutionError::InvalidRequest)?;
+        Self::check_preset(name, &preset, request)?;
+        config.docker_image = preset.image.clone();
+        let mut env: Vec<(String, String)> = preset
+            .env
+            .iter()
+            .map(|(key, value)| (key.clone(), value.clone()))
+            .collect();
+        env.sort();
+        config.env = env;
+        if let Some(limits) = &preset.limits {
+            let base = config
+                .resource_limits
+                .clone()
+                .unwrap_or_else(|| self.resource_limits.clone());
+            config.resource_limits = Some(base.with_overrides(limits));
+        }
+        Ok(())
+    }
+
+    fn check_preset(
+        name: &str,
+        preset: &PresetConfig,
+        request: &ExecuteRequest,
+    ) -> Result<(), ExecutionError> {
+        if preset.language != request.language {
+            return Err(ExecutionError::InvalidRequest(format!(
+                "Preset '{name}' is for {}, not {}",
+                preset.language, request.language
+            )));
+        }
+        // The preset's image replaces the one a version or channel would pick
+        if request.version.is_some() || request.channel.is_some() {
+            return Err(ExecutionError::InvalidRequest(format!(
+                "Preset '{name}' can't be combined with a version or channel"
+            )));
+        }
+        Ok(())
+    }
+
+    fn apply_ulimits(
+        &self,
+        request: &ExecuteRequest,
+        config: &mut LanguageConfig,
+    ) -> Result<(), ExecutionError> {
+        let Some(ulimits) = &request.ulimits else {
+            return Ok(());
+        };
+        ulimits
+            .validate("the request")
+            .map_err(ExecutionError::InvalidRequest)?;
+        if ulimits.core.is_some() && !request.debug.unwrap_or(false) {
+            return Err(ExecutionError::InvalidRequest(
+                "The core ulimit needs debug; other runs never dump core".to_string(),
+            ));
+        }
+        let limits = config
+            .resource_limits
+            .clone()
+            .unwrap_or_else(|| self.resource_limits.clone());
+        let ceilings = [
+            (
+                "nofile",
+                ulimits.nofile.map(u64::from),
+                Some(u64::from(limits.max_files)),
+            ),
+            ("fsize", ulimits.fsize, limits.file_size_limit),
+            ("core", ulimits.core, Some(self.debug_core_limit(config))),
+            ("stack", ulimits.stack, Some(limits.stack_limit)),
+        ];
+        for (name, value, ceiling) in ceilings {
+            if let (Some(value), Some(ceiling)) = (value, ceiling) {
+                if value > ceiling {
+                    return Err(ExecutionError::InvalidRequest(format!(
+                        "The {name} ulimit is {value}, above language {}'s limit of {ceiling}",
+                        request.language
+                    )));
+                }
+            }
+        }
+        config.resource_limits = Some(limits.with_ulimits(ulimits));
+        if ulimits.core.is_some() {
+            config.core_dump_limit = ulimits.core;
+        }
+        Ok(())
+    }
+
+    // Largest core dump a debug run of the language may write
+    fn debug_core_limit(&self, config: &LanguageConfig) -> u64 {
+        config
+            .core_dump_limit
+            .map_or(self.core_dump_limit, |bytes| {
+                bytes.min(self.core_dump_limit)
+            })
+    }
+
+    fn apply_syscall_policy(
+        &self,
+        request: &ExecuteRequest,
+        config: &mut LanguageConfig,
+    ) -> Result<(), ExecutionError> {
+        let policy = self.config.syscall_policy(
+            &request.language,
+            request.tenant.as_deref().unwrap_or(DEFAULT_TENANT),
+        );
+        let profile = self.syscall_filter.profile_path(policy).map_err(|e| {
+            ExecutionError::Unavailable(format!(
+                "the {} syscall policy profile could not be written: {e}",
+                policy.as_str()
+            ))
+        })?;
+        config.syscall_policy = Some(policy);
+        config.seccomp_profile = Some(profile);
+        Ok(())
+    }
+
+    // Wraps the run command in strace for `trace` requests, which only admins may make
+    fn apply_trace(
+        &self,
+        request: &ExecuteRequest,
+        config: &mut LanguageConfig,
+    ) -> Result<(), ExecutionError> {
+        if !request.trace.unwrap_or(false) {
+            return Ok(());
+        }
+        let tenant = request.tenant.as_deref().unwrap_or(DEFAULT_TENANT);
+        if !self
+            .config
+            .tenant(tenant)
+            .is_some_and(|policy| policy.admin)
+        {
+            return Err(ExecutionError::PolicyViolation(format!(
+                "Syscall tracing is not allowed for tenant '{tenant}'"
+            )));
+        }
+        if request.test_cases.is_some() {
+            return Err(ExecutionError::InvalidRequest(
+                "trace can't be combined with test cases".to_string(),
+            ));
+        }
+        if let Some(policy) = config
+            .syscall_policy
+            .filter(|policy| policy.denies("ptrace"))
+        {
+            return Err(ExecutionError::PolicyViolation(format!(
+                "Syscall tracing needs ptrace, which the {} syscall policy denies",
+                policy.as_str()
+            )));
+        }
+        let binary = self.tracer.binary().ok_or_else(|| {
+            ExecutionError::Unavailable("syscall tracing is not configured".to_string())
+        })?;
+        // Embedded runtimes run on the host, in the workspace itself
+        let (strace, work_dir) = if config.embedded {
+            (binary.to_string(), ".".to_string())
+        } else {
+            config.extra_mounts.push(VolumeMount {
+                host_path: binary.to_string(),
+                container_path: trace::SANDBOX_PATH.to_string(),
+                read_only: true,
+            });
+            (trace::SANDBOX_PATH.to_string(), config.work_dir.clone())
+        };
+        config.run_command = trace::wrap(&strace, &work_dir, &config.run_command);
+        config.traced = true;
+        Ok(())
+    }
+
+    // Returns the `--gpus` value if this host has GPUs and the tenant has quota left today
+    fn check_gpu_allowed(&self, tenant: Option<&str>) -> Result<String, ExecutionError> {
+        let devices = self.gpu_devices.clone().ok_or_else(|| {
+            ExecutionError::Unavailable("no GPU-capable worker is configured".to_string())
+        })?;
+        self.check_gpu_quota(tenant)?;
+        Ok(devices)
+    }
+
+    /// GPU seconds the tenant has left today; None when it has no quota
+    pub fn gpu_seconds_remaining(&self, tenant: &str) -> Option<f64> {
+        let quota = self.config.tenant(tenant)?.gpu_seconds_per_day?;
+        Some((quota as f64 - self.usage.today(tenant).gpu_seconds).max(0.0))
+    }
+
+    fn check_gpu_quota(&self, tenant: Option<&str>) -> Result<(), ExecutionError> {
+        let tenant = tenant.unwrap_or(DEFAULT_TENANT);
+        let quota = self
+            .config
+            .tenant(tenant)
+            .and_then(|policy| policy.gpu_seconds_per_day);
+        if let Some(quota) = quota {
+            let used = self.usage.today(tenant).gpu_seconds;
+            if used >= quota as f64 {
+                return Err(ExecutionError::PolicyViolation(format!(
+                    "Tenant '{tenant}' has used {used:.1} of its {quota} GPU seconds for today"
+                )));
+            }
+        }
+        Ok(())
+    }
+
+    fn dataset_mounts(&self, request: &ExecuteRequest) -> Result<Vec<VolumeMount>, ExecutionError> {
+        let tenant = request.tenant.as_deref().unwrap_or(DEFAULT_TENANT);
+        let mut names: Vec<&String> = request.datasets.iter().flatten().collect();
+        names.sort();
+        names.dedup();
+        names
+            .into_iter()
+            .map(|name| {
+                let dataset = self.config.datasets.get(name).ok_or_else(|| {
+                    ExecutionError::InvalidRequest(format!("Unknown dataset '{name}'"))
+                })?;
+                if !dataset.allows_tenant(tenant) {
+                    return Err(ExecutionError::PolicyViolation(format!(
+                        "Dataset '{name}' is not available to tenant '{tenant}'"
+                    )));
+                }
+                Ok(VolumeMount {
+                    host_path: self
+                        .datasets
+                        .local_path(name, dataset)
+                        .to_string_lossy()
+                        .into_owned(),
+                    container_path: format!("{DATASETS_MOUNT_ROOT}/{name}"),
+                    read_only: true,
+                })
+            })
+            .collect()
+    }
+
+    // Mounts the tenant's bundle for the request's preset, with the environment that
+    // makes the language use it
+    fn apply_bundle(&self, request: &ExecuteRequest, config: &mut LanguageConfig) {
+        let Some(preset) = &request.preset else {
+            return;
+        };
+        let tenant = request.tenant.as_deref().unwrap_or(DEFAULT_TENANT);
+        let Some(path) = self.bundles.path(tenant, preset) else {
+            return;
+        };
+        let Some(layout) = BundleLayout::for_language(&request.language, &config.work_dir) else {
+            return;
+        };
+        config.extra_mounts.push(VolumeMount {
+            host_path: path.to_string_lossy().into_owned(),
+            container_path: layout.path,
+            read_only: true,
+        });
+        config.env.extend(layout.env);
+    }
+
+    fn cache_mounts(&self, request: &ExecuteRequest) -> Result<Vec<VolumeMount>, ExecutionError> {
+        let tenant = request.tenant.as_deref().unwrap_or(DEFAULT_TENANT);
+        self.config
+            .caches_for(&request.language)
+            .into_iter()
+            .map(|(name, cache)| {
+                let host_path = self
+                    .caches
+                    .host_path(tenant, name)
+                    .map_err(|e| ExecutionError::CacheMount(name.to_string(), e.to_string()))?;
+                Ok(VolumeMount {
+                    host_path: host_path.to_string_lossy().into_owned(),
+                    container_path: cache.path.clone(),
+                    read_only: false,
+                })
+            })
+            .collect()
+    }
+
+    // Mounts the dependencies listed by the request's lockfile, installing them the
+    // first time the lockfile is seen. Embedded runtimes have no mounts, so their
+    // lockfiles are left to the program.
+    async fn mount_dependencies(
+        &self,
+        config: &mut LanguageConfig,
+        request: &ExecuteRequest,
+    ) -> Result<Option<DependencyLease>, ExecutionError> {
+        let Some(dependencies) = self.config.dependencies.get(&request.language) else {
+            return Ok(None);
+        };
+        let Some(lockfile) = request
+            .files
+            .iter()
+            .flatten()
+            .find(|file| file.path == dependencies.lockfile)
+        else {
+            return Ok(None);
+        };
+        if config.embedded {
+            return Ok(None);
+        }
+        let context: Vec<String> = config
+            .env
+            .iter()
+            .map(|(key, value)| format!("{key}={value}"))
+            .chain(
+                read_only_mounts(config).map(|m| format!("{}:{}", m.host_path, m.container_path)),
+            )
+            .collect();
+        let key = DependencyCache::key(
+            config.docker_image(),
+            &dependencies.install,
+            &context,
+            &lockfile.content,
+        );
+        let installing = &*config;
+        let lease = self
+            .dependencies
+            .get_or_install(&key, |dir| {
+                Self::install_dependencies(installing, dependencies, &lockfile.content, dir)
+            })
+            .await
+            .map_err(ExecutionError::DependencyInstall)?;
+        config.extra_mounts.push(VolumeMount {
+            host_path: lease.path().to_string_lossy().into_owned(),
+            container_path: dependencies.path.clone(),
+            read_only: true,
+        });
+        let mut env: Vec<(String, String)> = dependencies
+            .env
+            .iter()
+            .map(|(key, value)| (key.clone(), value.clone()))
+            .collect();
+        env.sort();
+        config.env.extend(env);
+        Ok(Some(lease))
+    }
+
+    // Runs the install command with only the lockfile in its working directory, so
+    // nothing but the lockfile decides what gets installed
+    async fn install_dependencies(
+        config: &LanguageConfig,
+        dependencies: &DependencyConfig,
+        lockfile: &str,
+        dir: PathBuf,
+    ) -> Result<(), String> {
+        let lock_dir = std::env::temp_dir().join(format!("isobox-lockfile-{}", Uuid::new_v4()));
+        fs::create_dir_all(&lock_dir)
+            .and_then(|_| fs::write(lock_dir.join(&dependencies.lockfile), lockfile))
+            .map_err(|e| format!("Failed to write {}: {e}", dependencies.lockfile))?;
+        let container = format!("isobox-dependencies-{}", Uuid::new_v4());
+        let args = DockerExecutor::build_docker_install_command(
+            &container,
+            &lock_dir,
+            &dir,
+            config,
+            dependencies,
+        );
+        let output = DockerExecutor::execute_with_timeout(args, DEPENDENCY_INSTALL_TIMEOUT).await;
+        fs::remove_dir_all(&lock_dir).ok();
+        match output {
+            Ok(output) if output.status.success() => Ok(()),
+            Ok(output) => {
+                let stderr = String::from_utf8_lossy(&output.stderr);
+                let lines: Vec<&str> = stderr.lines().collect();
+                Err(format!(
+                    "{} exited with {}:\n{}",
+                    dependencies.install.join(" "),
+                    termination::exit_code(&output.status),
+                    lines[lines.len().saturating_sub(INSTALL_ERROR_LINES)..].join("\n")
+                ))
+            }
+            Err(e) => {
+                // The client timing out leaves the container running
+                let remove = vec!["rm".to_string(), "-f".to_string(), container];
+                DockerExecutor::execute_with_timeout(remove, Duration::from_secs(30))
+                    .await
+                    .ok();
+                Err(e.to_string())
+            }
+        }
+    }
+
+    async fn run_in_workspace(
+        &self,
+        job_id: &str,
+        temp_dir: &str,
+        mut config: LanguageConfig,
+        mut request: ExecuteRequest,
+    ) -> Result<ExecuteResponse, ExecutionError> {
+        if let Some(files) = &request.files {
+            FileManager::write_workspace_files(temp_dir, files)?;
+        }
+
+        // Capped languages wait in their own queue, before anything is locked or
+        // mounted for the run. The wait ends at the caller's deadline.
+        let slot = self.language_slots.acquire(&request.language);
+        let _language_slot = match request.deadline {
+            Some(deadline) => {
+                let left = deadline::remaining(deadline).ok_or(ExecutionError::DeadlineExceeded)?;
+                tokio::time::timeout(left, slot)
+                    .await
+                    .map_err(|_| ExecutionError::DeadlineExceeded)?
+            }
+            None => slot.await,
+        };
+
+        // Executions sharing a writable cache run one at a time per tenant
+        let locked_caches: Vec<&str> = self
+            .config
+            .caches_for(&request.language)
+            .into_iter()
+            .filter(|(_, cache)| cache.lock)
+            .map(|(name, _)| name)
+            .collect();
+        let _cache_guards = self
+            .caches
+            .lock(
+                request.tenant.as_deref().unwrap_or(DEFAULT_TENANT),
+                &locked_caches,
+            )
+            .await;
+        // Held until the run is over, so the tree isn't evicted while it's mounted
+        let dependencies = self.mount_dependencies(&mut config, &request).await?;
+
+        // Pinned executions wait for a core of their own, so none of their steps
+        // shares it and CPU times are comparable between runs
+        let pinned_cpu = self.cpu_pool.acquire().await;
+        config.cpu = pinned_cpu.as_ref().map(|cpu| cpu.cpu());
+        // The waits above used up part of the time left before the deadline
+        if request
+            .deadline
+            .is_some_and(|deadline| deadline::remaining(deadline).is_none())
+        {
+            return Err(ExecutionError::DeadlineExceeded);
+        }
+        self.apply_deadline(&request, &mut config);
+        let config = &config;
+
+        let start_time = std::time::Instant::now();
+        let mut timings = PhaseTimings {
+            queue_wait: request.queue_wait,
+            ..Default::default()
+        };
+        // Before the test cases are handed over to run
+        let stdin = recorded_inputs(&request);
+        let result = if let Some(test_cases) = request.test_cases.take() {
+            self.execute_with_test_cases(temp_dir, config, &request, test_cases, &mut timings)
+                .await
+                .map(|mut response| {
+                    response.score = request.test_groups.as_deref().map(|groups| {
+                        judge::score(groups, response.test_results.as_deref().unwrap_or_default())
+                    });
+                    let (verdict, failed_test) = judge::outcome(response.test_results.as_deref());
+                    response.verdict = Some(verdict);
+                    response.failed_test = failed_test;
+                    response
+                })
+        } else {
+            let debug = request.debug.unwrap_or(false);
+            self.execute_in_container(temp_dir, config, &request.code, debug, &mut timings)
+                .await
+        };
+        timings.run = start_time
+            .elapsed()
+            .saturating_sub(timings.compile.unwrap_or_default());
+        self.latency.observe(job_id, &request.language, &timings);
+        let trace = config
+            .traced
+            .then(|| fs::read_to_string(Path::new(temp_dir).join(trace::TRACE_FILE)).ok())
+            .flatten();
+        self.raise_security_alerts(job_id, &request, trace.as_deref());
+        self.abuse.inspect(
+            job_id,
+            request.tenant.as_deref().unwrap_or(DEFAULT_TENANT),
+            &request.language,
+            &request.code,
+            result.as_ref().ok(),
+            trace.as_deref(),
+        );
+        let result = result.map(|response| {
+            self.record_syscall_denials(job_id, &request.language, temp_dir, config, response)
+        });
+        // Before the result is stored, so stored output has no escape codes either
+        let ansi = AnsiMode::for_request(request.ansi, request.terminal.is_some());
+        let result = result.map(|mut response| {
+            ansi.apply(&mut response);
+            response
+        });
+
+        // GPU time is metered whether or not the run succeeded
+        let gpu_seconds = config
+            .gpu_devices
+            .is_some()
+            .then(|| start_time.elapsed().as_secs_f64());
+        self.usage.record_execution(
+            request.tenant.as_deref().unwrap_or(DEFAULT_TENANT),
+            gpu_seconds.unwrap_or(0.0),
+        );
+        let result = result.map(|response| ExecuteResponse {
+            gpu_seconds,
+            emulated: config.platform.is_some().then_some(config.emulated),
+            channel: config.channel,
+            dependencies_cached: dependencies.as_ref().map(|lease| lease.cached),
+            ..response
+        });
+
+        // Keep what the program produced before the workspace is removed
+        result.map(|response| {
+            self.record_execution(job_id, &request, temp_dir, config, stdin, response)
+        })
+    }
+
+    // Counts programs the seccomp filter stopped and says so in their results. The
+    // denied syscall is only known for traced runs, from the trace.
+    fn record_syscall_denials(
+        &self,
+        job_id: &str,
+        language: &str,
+        temp_dir: &str,
+        config: &LanguageConfig,
+        mut response: ExecuteResponse,
+    ) -> ExecuteResponse {
+        let Some(policy) = config.syscall_policy else {
+            return response;
+        };
+        let syscall = config
+            .traced
+            .then(|| fs::read_to_string(Path::new(temp_dir).join(trace::TRACE_FILE)).ok())
+            .flatten()
+            .and_then(|trace| seccomp::denied_syscall(&trace));
+        let denied = |signal: &Option<String>| signal.as_deref() == Some("SIGSYS");
+        let reason = || Some(format!("denied by the {} syscall policy", policy.as_str()));
+        if denied(&response.term_signal) {
+            self.syscall_filter
+                .record_denial(job_id, policy, language, syscall.as_deref());
+            response.term_reason = reason();
+        }
+        for result in response.test_results.iter_mut().flatten() {
+            if denied(&result.term_signal) {
+                self.syscall_filter
+                    .record_denial(job_id, policy, language, None);
+                result.term_reason = reason();
+            }
+        }
+        response
+    }
+
+    // Logs and publishes signs of the program trying to leave its sandbox: the code
+    // mentioning a container runtime socket, a metadata service or ptrace, and for
+    // traced runs, the attempts themselves, including outbound connections.
+    fn raise_security_alerts(&self, job_id: &str, request: &ExecuteRequest, trace: Option<&str>) {
+        let mut alerts = security::scan_code(&request.code);
+        alerts.extend(trace.map(security::scan_trace).into_iter().flatten());
+        if alerts.is_empty() {
+            return;
+        }
+        let tenant = request.tenant.as_deref().unwrap_or(DEFAULT_TENANT);
+        let event = ExecutionEvent::security_alert(job_id, tenant, &request.language, alerts);
+        log::warn!(
+            "Security alert for execution {job_id}: {}",
+            serde_json::to_string(&event).unwrap_or_default()
+        );
+        self.events.publish(&event);
+    }
+
+    fn record_execution(
+        &self,
+        job_id: &str,
+        request: &ExecuteRequest,
+        temp_dir: &str,
+        config: &LanguageConfig,
+        stdin: Vec<RecordedInput>,
+        mut response: ExecuteResponse,
+    ) -> ExecuteResponse {
+        let inputs: HashSet<String> = std::iter::once(config.file_name().to_string())
+            .chain(request.files.iter().flatten().map(|f| f.path.clone()))
+            .collect();
+        let artifacts = self
+            .store
+            .capture_artifacts(job_id, Path::new(temp_dir), &inputs);
+        let archive = request
+            .archive_workdir
+            .unwrap_or(false)
+            .then(|| self.store.capture_archive(job_id, Path::new(temp_dir)))
+            .flatten();
+        let passed = response.exit_code == 0
+            && response
+                .test_results
+                .iter()
+                .flatten()
+                .all(|result| result.passed);
+        let labels = request.labels.clone().unwrap_or_default();
+        self.label_metrics.record(&labels, !passed);
+        self.store.insert(ExecutionRecord {
+            id: job_id.to_string(),
+            tenant: request
+                .tenant
+                .as_deref()
+                .unwrap_or(DEFAULT_TENANT)
+                .to_string(),
+            language: request.language.clone(),
+            exit_code: response.exit_code,
+            status: if passed {
+                ExecutionStatus::Succeeded
+            } else {
+                ExecutionStatus::Failed
+            },
+            labels,
+            created_at: unix_timestamp(),
+            artifacts: artifacts.clone(),
+            archive: archive.clone(),
+            channel: response.channel,
+            capabilities: config.capabilities.clone(),
+            trace_context: request.trace_context.clone(),
+            code: Some(request.code.clone()),
+            stdin: Some(stdin),
+            stdout: Some(self.redactor.redact(&response.stdout).into_owned()),
+            stderr: Some(self.redactor.redact(&response.stderr).into_owned()),
+        });
+        response.execution_id = Some(job_id.to_string());
+        response.artifacts = Some(artifacts);
+        response.workdir_archive = archive;
+        response
+    }
+
+    async fn execute_with_test_cases(
+        &self,
+        temp_dir: &str,
+        config: &LanguageConfig,
+        request: &ExecuteRequest,
+        test_cases: Vec<TestCase>,
+        timings: &mut PhaseTimings,
+    ) -> Result<ExecuteResponse, ExecutionError> {
+        // Write code to file
+        FileManager::write_code_file(temp_dir, config.file_name(), &request.code)?;
+
+        // Get resource limits for this language (use language-specific or default)
+        let limits = config.resource_limits().unwrap_or(&self.resource_limits);
+
+        // If compilation is needed, compile first
+        if let Some(compile_cmd) = config.compile_command() {
+            log::info!("Compiling with: {}", compile_cmd.join(" "));
+
+            let docker_compile_args =
+                DockerExecutor::build_docker_compile_command(temp_dir, config, limits, compile_cmd);
+
+            let compile_start = std::time::Instant::now();
+            let compile_output = self
+                .run_command(
+                    temp_dir,
+                    config,
+                    limits,
+                    compile_cmd,
+                    docker_compile_args,
+                    None,
+                )
+                .await;
+            timings.compile = Some(compile_start.elapsed());
+            let (compile_output, _, _) = compile_output?;
+
+            if !compile_output.status.success() {
+                let stderr = String::from_utf8_lossy(&compile_output.stderr);
+                let exit_code = termination::exit_code(&compile_output.status);
+                return Ok(ExecuteResponse {
+                    stdout: String::new(),
+                    stderr: stderr.to_string(),
+                    exit_code,
+                    time_taken: None,
+                    memory_used: None,
+                    test_results: None,
+                    ..Default::default()
+                }
+                .with_termination(termination::from_exit_code(
+                    exit_code,
+                    compile_start.elapsed(),
+                    limits.cpu_time_limit,
+                )));
+            }
+        }
+
+        let judge = match (&request.interactor, &request.checker) {
+            (Some(interactor), _) => Some(Judge::Interactor(
+                self.prepare_judge_program(interactor, "interactor", config)
+                    .await?,
+            )),
+            (None, Some(checker)) => Some(Judge::Checker(
+                self.prepare_judge_program(checker, "checker", config)
+                    .await?,
+            )),
+            (None, None) => None,
+        };
+        let stop_on_failure = request.stop_on_failure.unwrap_or(false);
+
+        // Execute each test case
+        let mut test_results = Vec::new();
+        let mut overall_stdout = String::new();
+        let mut overall_stderr = String::new();
+        let mut overall_exit_code = 0;
+        // Groups with a failed test case; ungrouped test cases count as one group
+        let mut failed_groups = HashSet::new();
+
+        println!("Starting execution of {} test cases", test_cases.len());
+
+        for (i, test_case) in test_cases.iter().enumerate() {
+            if stop_on_failure && failed_groups.contains(&test_case.group) {
+                overall_exit_code = 1;
+                test_results.push(judge::skipped(test_case));
+                continue;
+            }
+
+            println!(
+                "Executing test case {}/{}: {}",
+                i + 1,
+                test_cases.len(),
+                test_case.name
+            );
+
+            let input_file = request
+                .uploaded_inputs
+                .get(&test_case.name)
+                .map(PathBuf::as_path);
+            let test_result = self
+                .execute_single_test_case(
+                    temp_dir,
+                    config,
+                    limits,
+                    test_case,
+                    input_file,
+                    judge.as_ref(),
+                )
+                .await;
+            // A test case that runs out of wall time fails on its own, so the rest
+            // still run
+            let mut test_result = match test_result {
+                Err(ExecutionError::Timeout(seconds)) => {
+                    Self::stop_timed_out(config, "test case").await;
+                    judge::timed_out(test_case, seconds)
+                }
+                test_result => test_result?,
+            };
+
+            println!(
+                "Test case {} completed: passed={}",
+                test_case.name, test_result.passed
+            );
+
+            // Update overall results
+            if !test_result.passed {
+                overall_exit_code = 1;
+                failed_groups.insert(test_case.group.clone());
+            }
+            if test_case.hidden {
+                judge::hide(&mut test_result);
+                test_results.push(test_result);
+                continue;
+            }
+            overall_stdout.push_str(&format!("=== Test Case: {} ===\n", test_case.name));
+            overall_stdout.push_str(&test_result.stdout);
+            overall_stdout.push('\n');
+
+            if !test_result.stderr.is_empty() {
+                overall_stderr
+                    .push_str(&format!("=== Test Case: {} (stderr) ===\n", test_case.name));
+                overall_stderr.push_str(&test_result.stderr);
+                overall_stderr.push('\n');
+            }
+
+            test_results.push(test_result);
+        }
+
+        println!(
+            "All test cases completed. Total results: {}",
+            test_results.len()
+        );
+
+        Ok(ExecuteResponse {
+            stdout: overall_stdout,
+            stderr: overall_stderr,
+            exit_code: overall_exit_code,
+            time_taken: None, // TODO: Calculate total time
+            memory_used: None,
+            test_results: Some(test_results),
+            ..Default::default()
+        })
+    }
+
+    async fn execute_single_test_case(
+        &self,
+        temp_dir: &str,
+        config: &LanguageConfig,
+        limits: &ResourceLimits,
+        test_case: &TestCase,
+        input_file: Option<&Path>,
+        judge: Option<&Judge>,
+    ) -> Result<TestCaseResult, ExecutionError> {
+        // Create custom limits for this test case if specified
+        let mut test_limits = limits.clone();
+        if let Some(timeout) = test_case.timeout_seconds {
+            test_limits.wall_time_limit = Duration::from_secs(timeout as u64);
+            // Also update CPU time limit to match wall time limit for consistency
+            test_limits.cpu_time_limit = Duration::from_secs(timeout as u64);
+        }
+        if let Some(memory_mb) = test_case.memory_limit_mb {
+            test_limits.memory_limit = memory_mb * 1024 * 1024;
+        }
+        if let Some(Judge::Interactor(interactor)) = judge {
+            return self
+                .execute_interactive_test_case(
+                    temp_dir,
+                    config,
+                    &test_limits,
+                    test_case,
+                    input_file,
+                    interactor,
+                )
+                .await;
+        }
+
+        // Build docker command for execution with stdin input
+        let docker_args = DockerExecutor::build_docker_command(
+            temp_dir,
+            config,
+            &test_limits,
+            config.run_command(),
+        );
+
+        // Debug: Print Docker command in CI
+        if std::env::var("CI").is_ok() {
+            println!("CI: Docker command: docker {}", docker_args.join(" "));
+            println!(
+                "CI: Test case: {} (timeout: {}s, memory: {}MB)",
+                test_case.name,
+                test_limits.wall_time_limit.as_secs(),
+                test_limits.memory_limit / (1024 * 1024)
+            );
+        }
+
+        // Add stdin input
+        let input_data = match input_file {
+            Some(path) => {
+                log::info!(
+                    "Executing test case '{}' with uploaded input {}",
+                    test_case.name,
+                    path.display()
+                );
+                Stdin::File(path)
+            }
+            None => {
+                log::info!(
+                    "Executing test case '{}' with input: {}",
+                    test_case.name,
+                    self.redactor.redact(&test_case.input)
+                );
+                Stdin::Bytes(test_case.input.as_bytes())
+            }
+        };
+
+        // Execute docker command with timeout and stdin
+        let start_time = std::time::Instant::now();
+
+        let (output, peak, cpu_contention) = self
+            .run_command(
+                temp_dir,
+                config,
+                &test_limits,
+                config.run_command(),
+                docker_args,
+                Some(input_data),
+            )
+            .await?;
+
+        let time_taken = start_time.elapsed().as_secs_f64();
+
+        let stdout = String::from_utf8_lossy(&output.stdout).to_string();
+        let stderr = String::from_utf8_lossy(&output.stderr).to_string();
+        let exit_code = termination::exit_code(&output.status);
+        let termination = termination::from_exit_code(
+            exit_code,
+            start_time.elapsed(),
+            test_limits.cpu_time_limit,
+        );
+
+        // A checker only judges output of a program that exited normally
+        let checked = match judge {
+            Some(Judge::Checker(checker)) if exit_code == 0 => Some(
+                self.run_checker(checker, test_case, input_file, &output.stdout)
+                    .await?,
+            ),
+            _ => None,
+        };
+
+        // Determine if test passed
+        let verdict = if exit_code != 0 {
+            Verdict::of_failed_run(termination.as_ref())
+        } else if let Some(checked) = &checked {
+            checked.verdict
+        } else if let Some(expected) = &test_case.expected_output {
+            if stdout.trim() == expected.trim() {
+                Verdict::Accepted
+            } else {
+                Verdict::WrongAnswer
+            }
+        } else {
+            Verdict::Accepted
+        };
+        let passed = verdict == Verdict::Accepted;
+
+        let error_message = if !passed {
+            if let Some(checked) = &checked {
+                Some(checked.summary.clone())
+            } else if let Some(expected) = &test_case.expected_output {
+                Some(format!(
+                    "Expected: '{}', Got: '{}'",
+                    expected.trim(),
+                    stdout.trim()
+                ))
+            } else if let Some(termination) = &termination {
+                Some(format!(
+                    "Exit code: {exit_code} ({}, {})",
+                    termination.signal, termination.reason
+                ))
+            } else {
+                Some(format!("Exit code: {exit_code}"))
+            }
+        } else {
+            None
+        };
+
+        log::info!(
+            "Test case '{}' completed: passed={}, exit_code={}, time_taken={:.3}s",
+            test_case.name,
+            passed,
+            exit_code,
+            time_taken
+        );
+
+        let actual_output = stdout.clone();
+        Ok(TestCaseResult {
+            name: test_case.name.clone(),
+            passed,
+            stdout,
+            stderr,
+            exit_code,
+            time_taken: Some(time_taken),
+            memory_used: peak.memory,
+            swap_used: peak.swap,
+            error_message,
+            input: test_case.input.clone(),
+            expected_output: test_case.expected_output.clone(),
+            actual_output,
+            term_signal: termination.as_ref().map(|t| t.signal.to_string()),
+            term_reason: termination.map(|t| t.reason.to_string()),
+            group: test_case.group.clone(),
+            hidden: None,
+            skipped: None,
+            judge_message: checked.and_then(|checked| checked.message),
+            verdict: Some(verdict),
+            cpu_contention,
+        })
+    }
+
+    // Runs the checker on a test case's output. It gets the input, the output and
+    // the expected output as files, and accepts the output by exiting with 0.
+    async fn run_checker(
+        &self,
+        checker: &PreparedProgram,
+        test_case: &TestCase,
+        input_file: Option<&Path>,
+        output: &[u8],
+    ) -> Result<CheckerVerdict, ExecutionError> {
+        Self::write_judge_files(checker, test_case, input_file)?;
+        fs::write(
+            Path::new(&checker.workspace).join(judge::OUTPUT_FILE),
+            output,
+        )
+        .map_err(|e| ExecutionError::FileWrite(e.to_string()))?;
+        Self::hand_over_workspace(&checker.config, &checker.workspace)?;
+        let command = judge::checker_command(checker.config.run_command());
+        let output = DockerExecutor::execute_with_timeout(
+            DockerExecutor::build_docker_command(
+                &checker.workspace,
+                &checker.config,
+                &checker.limits,
+                &command,
+            ),
+            checker.limits.wall_time_limit,
+        )
+        .await;
+        let output = match output {
+            Err(ExecutionError::Timeout(seconds)) => {
+                Self::stop_timed_out(&checker.config, "checker").await;
+                return Ok(CheckerVerdict {
+                    verdict: Verdict::CheckerFailure,
+                    summary: format!("The checker timed out after {seconds:.3} seconds"),
+                    message: None,
+                });
+            }
+            output => output?,
+        };
+        let exit_code = termination::exit_code(&output.status);
+        let verdict = Verdict::from_judge_exit_code(exit_code);
+        let summary = match verdict {
+            Verdict::CheckerFailure => format!("The checker failed with exit code {exit_code}"),
+            _ => format!("The checker rejected the output with exit code {exit_code}"),
+        };
+        Ok(CheckerVerdict {
+            verdict,
+            summary,
+            message: judge::message(&output),
+        })
+    }
+
+    // Stops the containers of a run that timed out, since killing the docker client
+    // leaves them running
+    async fn stop_timed_out(config: &LanguageConfig, what: &str) {
+        let Some(job_id) = config.job_id.clone() else {
+            return;
+        };
+        let killed = tokio::task::spawn_blocking(move || stats::kill_job_containers(&job_id)).await;
+        if let Ok(Err(e)) = killed {
+            log::warn!("Failed to stop a timed out {what}: {e}");
+        }
+    }
+
+    // Writes a test case's input and expected output where an interactor or checker
+    // reads them
+    fn write_judge_files(
+        program: &PreparedProgram,
+        test_case: &TestCase,
+        input_file: Option<&Path>,
+    ) -> Result<(), ExecutionError> {
+        let workspace = Path::new(&program.workspace);
+        let input_path = workspace.join(judge::INPUT_FILE);
+        match input_file {
+            Some(path) => fs::copy(path, &input_path).map(drop),
+            None => fs::write(&input_path, &test_case.input),
+        }
+        .and_then(|()| {
+            fs::write(
+                workspace.join(judge::ANSWER_FILE),
+                test_case.expected_output.as_deref().unwrap_or_default(),
+            )
+        })
+        .map_err(|e| ExecutionError::FileWrite(e.to_string()))
+    }
+
+    // Runs a test case with the interactor between it and the submission: the
+    // interactor reads the test case's input and expected output from its files and
+    // talks to the submission, which passes if both exit with 0. The submission's
+    // output is what it sent the interactor.
+    async fn execute_interactive_test_case(
+        &self,
+        temp_dir: &str,
+        config: &LanguageConfig,
+        limits: &ResourceLimits,
+        test_case: &TestCase,
+        input_file: Option<&Path>,
+        interactor: &PreparedProgram,
+    ) -> Result<TestCaseResult, ExecutionError> {
+        Self::write_judge_files(interactor, test_case, input_file)?;
+        Self::hand_over_workspace(&interactor.config, &interactor.workspace)?;
+
+        // Neither side may outlive the submission's wall time
+        let interactor_limits = ResourceLimits {
+            wall_time_limit: interactor
+                .limits
+                .wall_time_limit
+                .min(limits.wall_time_limit),
+            ..interactor.limits.clone()
+        };
+        log::info!(
+            "Executing test case '{}' with an interactor",
+            test_case.name
+        );
+        let start_time = std::time::Instant::now();
+        let interaction = interactor::run(
+            DockerExecutor::build_docker_command(temp_dir, config, limits, config.run_command()),
+            DockerExecutor::build_docker_command(
+                &interactor.workspace,
+                &interactor.config,
+                &interactor_limits,
+                interactor.config.run_command(),
+            ),
+            limits.wall_time_limit,
+        )
+        .await?;
+        let time_taken = start_time.elapsed().as_secs_f64();
+
+        let stdout = String::from_utf8_lossy(&interaction.submission.stdout).to_string();
+        let stderr = String::from_utf8_lossy(&interaction.submission.stderr).to_string();
+        let exit_code = termination::exit_code(&interaction.submission.status);
+        let termination =
+            termination::from_exit_code(exit_code, start_time.elapsed(), limits.cpu_time_limit);
+        let interactor_exit_code = termination::exit_code(&interaction.interactor.status);
+        let verdict = if exit_code != 0 {
+            Verdict::of_failed_run(termination.as_ref())
+        } else {
+            Verdict::from_judge_exit_code(interactor_exit_code)
+        };
+        let passed = verdict == Verdict::Accepted;
+        let error_message = if passed {
+            None
+        } else if let Some(termination) = &termination {
+            Some(format!(
+                "Exit code: {exit_code} ({}, {})",
+                termination.signal, termination.reason
+            ))
+        } else if exit_code != 0 {
+            Some(format!("Exit code: {exit_code}"))
+        } else if verdict == Verdict::CheckerFailure {
+            Some(format!(
+                "The interactor failed with exit code {interactor_exit_code}"
+            ))
+        } else {
+            Some(format!(
+                "The interactor rejected the answer with exit code {interactor_exit_code}"
+            ))
+        };
+
+        log::info!(
+            "Test case '{}' completed: passed={}, exit_code={}, time_taken={:.3}s",
+            test_case.name,
+            passed,
+            exit_code,
+            time_taken
+        );
+
+        Ok(TestCaseResult {
+            name: test_case.name.clone(),
+            passed,
+            stdout: stdout.clone(),
+            stderr,
+            exit_code,
+            time_taken: Some(time_taken),
+            memory_used: None,
+            swap_used: None,
+            error_message,
+            input: test_case.input.clone(),
+            expected_output: test_case.expected_output.clone(),
+            actual_output: stdout,
+            term_signal: termination.as_ref().map(|t| t.signal.to_string()),
+            term_reason: termination.map(|t| t.reason.to_string()),
+            group: test_case.group.clone(),
+            hidden: None,
+            skipped: None,
+            judge_message: interaction.message(),
+            verdict: Some(verdict),
+            cpu_contention: None,
+        })
+    }
+
+    // Runs a compile or run command: in the container `docker_args` describe, or as
+    // a host process in the workspace for embedded runtimes. Returns the step's peak
+    // usage too, which is only known when it ran in a managed cgroup, and the CPU
+    // time it was kept from.
+    async fn run_command(
+        &self,
+        temp_dir: &str,
+        config: &LanguageConfig,
+        limits: &ResourceLimits,
+        command: &[String],
+        mut docker_args: Vec<String>,
+        stdin: Option<Stdin<'_>>,
+    ) -> Result<(std::process::Output, PeakUsage, Option<CpuContention>), ExecutionError> {
+        if let Some(owner) = config.sandbox_owner {
+            userns::hand_over(Path::new(temp_dir), owner).map_err(|e| {
+                ExecutionError::FileWrite(format!(
+                    "Failed to hand the workspace to the sandbox user: {e}"
+                ))
+            })?;
+        }
+        let cgroup = self
+            .cgroups
+            .create(
+                config.job_id.as_deref(),
+                limits,
+                config.scheduling.as_ref(),
+                config.cpu,
+            )
+            .map_err(|e| ExecutionError::Cgroup(e.to_string()))?;
+        if let Some(cgroup) = &cgroup {
+            // Right after `run`, before the image and command
+            docker_args.splice(
+                1..1,
+                [
+                    "--cgroup-parent".to_string(),
+                    cgroup.docker_parent().to_string(),
+                ],
+            );
+        }
+        let steal_before = StealSample::read(config.cpu);
+        let output = match stdin {
+            _ if config.embedded => {
+                embedded::run(
+                    temp_dir,
+                    command,
+                    limits,
+                    config.sandbox_owner,
+                    config.scheduling,
+                    config.cpu,
+                    cgroup.as_ref().map(|cgroup| cgroup.procs_path()),
+                    stdin.unwrap_or(Stdin::Bytes(&[])),
+                )
+                .await
+            }
+            Some(stdin) => {
+                DockerExecutor::execute_with_timeout_and_stdin(
+                    docker_args,
+                    limits.wall_time_limit,
+                    stdin,
+                )
+                .await
+            }
+            None => DockerExecutor::execute_with_timeout(docker_args, limits.wall_time_limit).await,
+        };
+        let peak = cgroup
+            .as_ref()
+            .map(|cgroup| cgroup.peak_usage())
+            .unwrap_or_default();
+        let steal_seconds = steal_before.and_then(|before| {
+            StealSample::read(config.cpu).map(|after| after.seconds_since(&before))
+        });
+        let contention = CpuContention::new(
+            cgroup.as_ref().and_then(|cgroup| cgroup.throttling()),
+            steal_seconds,
+        );
+        // Removing the group can wait for killed processes to exit
+        if let Some(cgroup) = cgroup {
+            tokio::task::spawn_blocking(move || drop(cgroup));
+        }
+        output.map(|output| (output, peak, contention))
+    }
+
+    async fn execute_in_container(
+        &self,
+        temp_dir: &str,
+        config: &LanguageConfig,
+        code: &str,
+        debug: bool,
+        timings: &mut PhaseTimings,
+    ) -> Result<ExecuteResponse, ExecutionError> {
+        // Write code to file
+        FileManager::write_code_file(temp_dir, config.file_name(), code)?;
+
+        // Verify file exists before running Docker
+        let file_path = format!("{temp_dir}/{}", config.file_name());
+        if !std::path::Path::new(&file_path).exists() {
+            return Err(ExecutionError::FileWrite(format!(
+                "File does not exist after creation: {file_path}",
+            )));
+        }
+
+        // Small delay to ensure file is properly synced
+        tokio::time::sleep(tokio::time::Duration::from_millis(100)).await;
+
+        // Get resource limits for this language (use language-specific or default)
+        let limits = config.resource_limits().unwrap_or(&self.resource_limits);
+
+        // If compilation is needed, compile first
+        if let Some(compile_cmd) = config.compile_command() {
+            log::info!("Compiling with: {}", compile_cmd.join(" "));
+
+            let docker_compile_args =
+                DockerExecutor::build_docker_command(temp_dir, config, limits, compile_cmd);
+
+            let compile_start = std::time::Instant::now();
+            let compile_output = self
+                .run_command(
+                    temp_dir,
+                    config,
+                    limits,
+                    compile_cmd,
+                    docker_compile_args,
+                    None,
+                )
+                .await;
+            timings.compile = Some(compile_start.elapsed());
+            let (compile_output, _, _) = compile_output?;
+
+            if !compile_output.status.success() {
+                let stderr = String::from_utf8_lossy(&compile_output.stderr);
+                let exit_code = termination::exit_code(&compile_output.status);
+                return Ok(ExecuteResponse {
+                    stdout: String::new(),
+                    stderr: stderr.to_string(),
+                    exit_code,
+                    time_taken: None,
+                    memory_used: None,
+                    test_results: None,
+                    ..Default::default()
+                }
+                .with_termination(termination::from_exit_code(
+                    exit_code,
+                    compile_start.elapsed(),
+                    limits.cpu_time_limit,
+                )));
+            }
+        }
+
+        // Only the program itself may dump core, not its compiler
+        let run_limits = ResourceLimits {
+            core_dump_limit: if debug {
+                self.debug_core_limit(config)
+            } else {
+                0
+            },
+            ..limits.clone()
+        };
+
+        // Build docker command for execution
+        let docker_args = DockerExecutor::build_docker_command(
+            temp_dir,
+            config,
+            &run_limits,
+            config.run_command(),
+        );
+
+        log::info!("Executing: docker {}", docker_args.join(" "));
+
+        // Execute docker command with timeout
+        let start_time = std::time::Instant::now();
+
+        let output = self
+            .run_command(
+                temp_dir,
+                config,
+                &run_limits,
+                config.run_command(),
+                docker_args,
+                None,
+            )
+            .await;
+        let output = match output {
+            // A traced run that hangs still returns its trace, which shows where
+            Err(ExecutionError::Timeout(seconds)) if config.traced => {
+                Self::stop_timed_out(config, "traced run").await;
+                self.tracer.truncate(Path::new(temp_dir));
+                return Ok(ExecuteResponse {
+                    stderr: format!("Execution timed out after {seconds:.3} seconds"),
+                    exit_code: 124,
+                    time_taken: Some(seconds),
+                    term_signal: Some("SIGKILL".to_string()),
+                    term_reason: Some("killed by timeout".to_string()),
+                    ..Default::default()
+                });
+            }
+            output => output?,
+        };
+        if config.traced {
+            self.tracer.truncate(Path::new(temp_dir));
+        }
+
+        let time_taken = start_time.elapsed().as_secs_f64();
+
+        let (output, peak, cpu_contention) = output;
+        let stdout = String::from_utf8_lossy(&output.stdout).to_string();
+        let stderr = String::from_utf8_lossy(&output.stderr).to_string();
+        let exit_code = termination::exit_code(&output.status);
+
+        log::info!(
+            "Execution completed: exit_code={}, stdout_len={}, stderr_len={}, time_taken={:.3}s",
+            exit_code,
+            stdout.len(),
+            stderr.len(),
+            time_taken
+        );
+
+        let mut response = ExecuteResponse {
+            stdout,
+            stderr,
+            exit_code,
+            time_taken: Some(time_taken),
+            memory_used: peak.memory,
+            swap_used: peak.swap,
+            test_results: None,
+            cpu_contention,
+            ..Default::default()
+        }
+        .with_termination(termination::from_exit_code(
+            exit_code,
+            start_time.elapsed(),
+            limits.cpu_time_limit,
+        ));
+        if debug
+            && response
+                .term_signal
+                .as_deref()
+                .is_some_and(coredump::dumps_core)
+        {
+            response.backtrace = self.backtrace(temp_dir, config, limits).await;
+        }
+        Ok(response)
+    }
+
+    // Symbolizes the core dump a crashed program left in its workspace with gdb,
+    // run in the same image so it sees the same binary and libraries
+    async fn backtrace(
+        &self,
+        temp_dir: &str,
+        config: &LanguageConfig,
+        limits: &ResourceLimits,
+    ) -> Option<String> {
+        let Some(core) = coredump::find(Path::new(temp_dir)) else {
+            log::warn!(
+                "No core dump in the workspace of a crashed debug run; check the host's kernel.core_pattern"
+            );
+            return None;
+        };
+        let binary = config.run_command().first()?;
+        let command = coredump::backtrace_command(binary, &core);
+        let docker_args = DockerExecutor::build_docker_command(temp_dir, config, limits, &command);
+        let (output, _) = self
+            .run_command(temp_dir, config, limits, &command, docker_args, None)
+            .await
+            .ok()?;
+        let backtrace = String::from_utf8_lossy(&output.stdout).trim().to_string();
+        (output.status.success() && !backtrace.is_empty()).then_some(backtrace)
+    }
+}
+
+impl Default for CodeExecutor {
+    fn default() -> Self {
+        Self::new()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_executor_creation() {
+        let executor = CodeExecutor::new();
+
+        // Verify that major languages are supported
+        assert!(executor
+            .language_registry
+            .get_language_config("python")
+            .is_some());
+        assert!(executor
+            .language_registry
+            .get_language_config("node")
+            .is_some());
+        assert!(executor
+            .language_registry
+            .get_language_config("go")
+            .is_some());
+        assert!(executor
+            .language_registry
+            .get_language_config("rust")
+            .is_some());
+        assert!(executor
+            .language_registry
+            .get_language_config("c")
+            .is_some());
+        assert!(executor
+            .language_registry
+            .get_language_config("cpp")
+            .is_some());
+        assert!(executor
+            .language_registry
+            .get_language_config("java")
+            .is_some());
+        assert!(executor
+            .language_registry
+            .get_language_config("csharp")
+            .is_some());
+        assert!(executor
+            .language_registry
+            .get_language_config("php")
+            .is_some());
+        assert!(executor
+            .language_registry
+            .get_language_config("ruby")
+            .is_some());
+
+        // Verify configuration details for a few languages
+        let python_config = executor
+            .language_registry
+            .get_language_config("python")
+            .unwrap();
+        assert_eq!(python_config.docker_image(), "python:3.11");
+        assert_eq!(python_config.file_name(), "main.py");
+
+        let rust_config = executor
+            .language_registry
+            .get_language_config("rust")
+            .unwrap();
+        assert_eq!(rust_config.docker_image(), "rust:alpine");
+        assert_eq!(rust_config.file_name(), "main.rs");
+        assert!(rust_config.compile_command().is_some());
+    }
+
+    #[test]
+    fn test_language_image_overrides() {
+        let config = IsoboxConfig::from_json(
+            r#"{"languages": {"python": {"image": "python:3.12", "versions": {"3.13": "python:3.13"}}}}"#,
+        )
+        .unwrap();
+        let executor = CodeExecutor::with_config(&config);
+        let python = executor
+            .language_registry
+            .get_language_config("python")
+            .unwrap();
+        assert_eq!(python.docker_image(), "python:3.12");
+
+        let versioned = python.for_version("python", Some("3.13")).unwrap();
+        assert_eq!(versioned.docker_image(), "python:3.13");
+
+        match python.for_version("python", Some("2.0")) {
+            Err(ExecutionError::UnsupportedVersion(lang, version)) => {
+                assert_eq!(lang, "python");
+                assert_eq!(version, "2.0");
+            }
+            _ => panic!("Expected UnsupportedVersion error"),
+        }
+    }
+
+    #[test]
+    fn test_read_only_root_filesystem() {
+        let config = IsoboxConfig::from_json(
+            r#"{"languages": {"go": {"filesystem": {"read_only": true, "tmpfs": {"/root/.cache": 512}}}}}"#,
+        )
+        .unwrap();
+        let executor = CodeExecutor::with_config(&config);
+        let request = |language: &str, workdir: Option<&str>| ExecuteRequest {
+            language: language.to_string(),
+            code: String::new(),
+            workdir: workdir.map(str::to_string),
+            ..Default::default()
+        };
+
+        let go = executor.resolve_config(&request("go", None)).unwrap();
+        let docker_args = DockerExecutor::build_docker_command(
+            "/tmp/test",
+            &go,
+            &ResourceLimits::default(),
+            go.run_command(),
+        );
+        assert!(docker_args.contains(&"--read-only".to_string()));
+        assert!(docker_args
+            .contains(&"/root/.cache:rw,nosuid,nodev,size=536870912,mode=1777".to_string()));
+        assert!(docker_args.contains(&"/tmp:rw,nosuid,nodev,size=67108864,mode=1777".to_string()));
+
+        let python = executor.resolve_config(&request("python", None)).unwrap();
+        let docker_args = DockerExecutor::build_docker_command(
+            "/tmp/test",
+            &python,
+            &ResourceLimits::default(),
+            python.run_command(),
+        );
+        assert!(!docker_args.contains(&"--read-only".to_string()));
+        // The host's /tmp is never shared; each sandbox has a tmpfs there
+        assert!(!docker_args.iter().any(|arg| arg.starts_with("/tmp:/tmp")));
+        let tmp: Vec<&String> = docker_args
+            .iter()
+            .filter(|arg| arg.starts_with("/tmp:"))
+            .collect();
+        assert_eq!(tmp, ["/tmp:rw,nosuid,nodev,size=67108864,mode=1777"]);
+
+        assert!(matches!(
+            executor.resolve_config(&request("go", Some("/root/.cache"))),
+            Err(ExecutionError::InvalidRequest(_))
+        ));
+    }
+
+    #[test]
+    fn test_terminal_size_in_environment() {
+        let executor = CodeExecutor::new();
+        let request = |rows: u16| ExecuteRequest {
+            language: "python".to_string(),
+            code: String::new(),
+            terminal: Some(Terminal {
+                rows,
+                cols: 120,
+                echo: true,
+            }),
+            ..Default::default()
+        };
+
+        let python = executor.resolve_config(&request(40)).unwrap();
+        let docker_args = DockerExecutor::build_docker_command(
+            "/tmp/test",
+            &python,
+            &ResourceLimits::default(),
+            python.run_command(),
+        );
+        for env in ["TERM=xterm-256color", "COLUMNS=120", "LINES=40"] {
+            assert!(docker_args.contains(&env.to_string()));
+        }
+
+        assert!(matches!(
+            executor.resolve_config(&request(0)),
+            Err(ExecutionError::InvalidRequest(_))
+        ));
+    }
+
+    #[test]
+    fn test_language_security_options() {
+        let config = IsoboxConfig::from_json(
+            r#"{"languages": {"python": {"apparmor_profile": "isobox-python", "selinux_label": {"type": "isobox_python_t"}}}}"#,
+        )
+        .unwrap();
+        let executor = CodeExecutor::with_config(&config);
+        let python = executor
+            .language_registry
+            .get_language_config("python")
+            .unwrap();
+        let docker_args = DockerExecutor::build_docker_command(
+            "/tmp/test",
+            python,
+            &ResourceLimits::default(),
+            python.run_command(),
+        );
+        let options: Vec<&str> = docker_args
+            .windows(2)
+            .filter(|pair| pair[0] == "--security-opt")
+            .map(|pair| pair[1].as_str())
+            .collect();
+        assert!(options.contains(&"apparmor=isobox-python"));
+        assert!(options.contains(&"label=type:isobox_python_t"));
+
+        let node = executor
+            .language_registry
+            .get_language_config("node")
+            .unwrap();
+        assert!(node.security_options.is_empty());
+    }
+
+    #[test]
+    fn test_language_capabilities() {
+        let config = IsoboxConfig::from_json(
+            r#"{"languages": {"c": {"capabilities": ["cap_sys_ptrace"]}}}"#,
+        )
+        .unwrap();
+        let executor = CodeExecutor::with_config(&config);
+        let added = |language: &str| {
+            let config = executor
+                .language_registry
+                .get_language_config(language)
+                .unwrap();
+            let docker_args = DockerExecutor::build_docker_command(
+                "/tmp/test",
+                config,
+                &ResourceLimits::default(),
+                config.run_command(),
+            );
+            assert!(docker_args
+                .windows(2)
+                .any(|pair| pair[0] == "--cap-drop" && pair[1] == "ALL"));
+            docker_args
+                .windows(2)
+                .filter(|pair| pair[0] == "--cap-add")
+                .map(|pair| pair[1].clone())
+                .collect::<Vec<_>>()
+        };
+        assert_eq!(added("c"), ["SYS_PTRACE"]);
+        assert!(added("python").is_empty());
+
+        let c = executor
+            .language_descriptions()
+            .into_iter()
+            .find(|language| language.name == "c")
+            .unwrap();
+        assert_eq!(c.capabilities, ["SYS_PTRACE"]);
+    }
+
+    #[test]
+    fn test_language_definitions() {
+        let config = IsoboxConfig::from_json(
+            r#"{"languages": {
+                "zig": {
+                    "image": "ziglang/zig:0.13",
+                    "extension": "zig",
+                    "compile": ["zig", "build-exe", "{work_dir}/{file}", "-femit-bin={work_dir}/{stem}"],
+                    "run": ["{work_dir}/{stem}"],
+                    "limits": {"memory_mb": 512, "wall_time_seconds": 20}
+                },
+                "python": {"run": ["python", "-u", "{file}"]}
+            }}"#,
+        )
+        .unwrap();
+        let executor = CodeExecutor::with_config(&config);
+        assert!(executor.supports_language("zig"));
+
+        let zig = executor
+            .language_registry
+            .get_language_config("zig")
+            .unwrap();
+        assert_eq!(zig.docker_image(), "ziglang/zig:0.13");
+        assert_eq!(zig.file_name(), "main.zig");
+        assert_eq!(
+            zig.compile_command().unwrap(),
+            [
+                "zig",
+                "build-exe",
+                "/workspace/main.zig",
+                "-femit-bin=/workspace/main"
+            ]
+        );
+        assert_eq!(zig.run_command(), ["/workspace/main"]);
+        let limits = zig.resource_limits().unwrap();
+        assert_eq!(limits.memory_limit, 512 * 1024 * 1024);
+        assert_eq!(limits.wall_time_limit, Duration::from_secs(20));
+        assert_eq!(
+            limits.cpu_time_limit,
+            ResourceLimits::default().cpu_time_limit
+        );
+
+        // Custom layouts rewrite the expanded commands like the built-in ones
+        let laid_out = zig.clone().with_layout(Some("/home/student/project"), None);
+        assert_eq!(laid_out.run_command(), ["/home/student/project/main"]);
+
+        let python = executor
+            .language_registry
+            .get_language_config("python")
+            .unwrap();
+        assert_eq!(python.run_command(), ["python", "-u", "main.py"]);
+
+        let descriptions = executor.language_descriptions();
+        let zig = descriptions.iter().find(|l| l.name == "zig").unwrap();
+        assert!(zig.custom);
+        assert_eq!(zig.limits.memory_mb, Some(512));
+        let python = descriptions.iter().find(|l| l.name == "python").unwrap();
+        assert!(!python.custom);
+        assert_eq!(python.limits.memory_mb, Some(128));
+    }
+
+    #[test]
+    fn test_harness() {
+        let config = IsoboxConfig::from_json(
+            r#"{"harnesses": {"call-function": {
+                "language": "python",
+                "template": "{{code}}\nprint({{function}}(input()))\n",
+                "params": {"function": "solve"}
+            }}}"#,
+        )
+        .unwrap();
+        let executor = CodeExecutor::with_config(&config);
+        let request = ExecuteRequest {
+            language: "python".to_string(),
+            code: "def double(x):\n    return 2 * int(x)".to_string(),
+            harness: Some("call-function".to_string()),
+            harness_params: Some(HashMap::from([(
+                "function".to_string(),
+                "double".to_string(),
+            )])),
+            ..Default::default()
+        };
+
+        let wrapped = executor.apply_harness(request.clone()).unwrap();
+        assert_eq!(
+            wrapped.code,
+            "def double(x):\n    return 2 * int(x)\nprint(double(input()))\n"
+        );
+        // Remote workers get the wrapped code and must not wrap it again
+        assert!(wrapped.harness.is_none());
+
+        let node = ExecuteRequest {
+            language: "node".to_string(),
+            ..request.clone()
+        };
+        assert!(matches!(
+            executor.apply_harness(node),
+            Err(ExecutionError::InvalidRequest(_))
+        ));
+        let unknown = ExecuteRequest {
+            harness: Some("missing".to_string()),
+            ..request
+        };
+        assert!(matches!(
+            executor.apply_harness(unknown),
+            Err(ExecutionError::InvalidRequest(_))
+        ));
+    }
+
+    #[test]
+    fn test_preset() {
+        let config = IsoboxConfig::from_json(
+            r#"{"presets": {"python-datasci": {
+                "language": "python",
+                "image": "isobox/python-datasci:1",
+                "packages": ["numpy", "pandas"],
+                "env": {"MPLBACKEND": "Agg"},
+                "limits": {"memory_mb": 1024}
+            }}}"#,
+        )
+        .unwrap();
+        let executor = CodeExecutor::with_config(&config);
+        let request = ExecuteRequest {
+            language: "python".to_string(),
+            preset: Some("python-datasci".to_string()),
+            ..Default::default()
+        };
+
+        let datasci = executor.resolve_config(&request).unwrap();
+        assert_eq!(datasci.docker_image(), "isobox/python-datasci:1");
+        assert_eq!(
+            datasci.resource_limits().unwrap().memory_limit,
+            1024 * 1024 * 1024
+        );
+        let docker_args = DockerExecutor::build_docker_command(
+            "/tmp/test",
+            &datasci,
+            &ResourceLimits::default(),
+            datasci.run_command(),
+        );
+        assert!(docker_args.contains(&"MPLBACKEND=Agg".to_string()));
+
+        let datasci = executor.presets().get("python-datasci").unwrap();
+        assert_eq!(datasci.packages, vec!["numpy", "pandas"]);
+
+        for invalid in [
+            ExecuteRequest {
+                language: "node".to_string(),
+                ..request.clone()
+            },
+            ExecuteRequest {
+                channel: Some(Channel::Stable),
+                ..request.clone()
+            },
+            ExecuteRequest {
+                preset: Some("missing".to_string()),
+                ..request
+            },
+        ] {
+            assert!(matches!(
+                executor.resolve_config(&invalid),
+                Err(ExecutionError::InvalidRequest(_))
+            ));
+        }
+    }
+
+    #[test]
+    fn test_function_call_preparation() {
+        let executor = CodeExecutor::new();
+        let request = ExecuteRequest {
+            language: "python".to_string(),
+            code: "def add(a, b):\n    return a + b\n".to_string(),
+            function: Some(FunctionCall {
+                name: "add".to_string(),
+                args: vec![serde_json::json!(1), serde_json::json!(2)],
+            }),
+            ..Default::default()
+        };
+
+        let (prepared, function_call) = executor.prepare_code(request.clone()).unwrap();
+        assert!(function_call);
+        assert!(prepared.function.is_none());
+        assert!(prepared.code.starts_with("def add(a, b):"));
+        assert!(prepared.code.contains("add(*_isobox_args)"));
+        let files = prepared.files.unwrap();
+        assert_eq!(files[0].path, function_call::ARGS_FILE);
+        assert_eq!(files[0].content, "[1,2]");
+
+        let with_tests = ExecuteRequest {
+            test_cases: Some(Vec::new()),
+            ..request.clone()
+        };
+        assert!(executor.prepare_code(with_tests).is_err());
+        let rust = ExecuteRequest {
+            language: "rust".to_string(),
+            ..request
+        };
+        assert!(executor.prepare_code(rust).is_err());
+    }
+
+    #[test]
+    fn test_cache_mounts() {
+        let config = IsoboxConfig::from_json(
+            r#"{"caches": {"pip": {"path": "/root/.cache/pip", "languages": ["python"]}}}"#,
+        )
+        .unwrap();
+        let executor = CodeExecutor::with_config(&config);
+        let request = ExecuteRequest {
+            language: "python".to_string(),
+            code: "print('hi')".to_string(),
+            tenant: Some("cs101".to_string()),
+            ..Default::default()
+        };
+
+        let python = executor.resolve_config(&request).unwrap();
+        assert_eq!(python.extra_mounts.len(), 1);
+        let host_path = &python.extra_mounts[0].host_path;
+        assert!(host_path.ends_with("cs101/pip"));
+        assert_eq!(python.extra_mounts[0].container_path, "/root/.cache/pip");
+
+        let args = DockerExecutor::build_docker_command(
+            "/tmp/job",
+            &python,
+            &ResourceLimits::default(),
+            python.run_command(),
+        );
+        assert!(args.contains(&format!("{host_path}:/root/.cache/pip")));
+
+        let node = ExecuteRequest {
+            language: "node".to_string(),
+            ..request
+        };
+        assert!(executor
+            .resolve_config(&node)
+            .unwrap()
+            .extra_mounts
+            .is_empty());
+    }
+
+    #[test]
+    fn test_dependency_install_command() {
+        let config = IsoboxConfig::from_json(
+            r#"{"dependencies": {"python": {"lockfile": "requirements.txt", "install": ["pip", "install", "--target", "/deps", "-r", "requirements.txt"], "path": "/deps", "env": {"PYTHONPATH": "/deps"}}}}"#,
+        )
+        .unwrap();
+        let executor = CodeExecutor::with_config(&config);
+        let request = ExecuteRequest {
+            language: "python".to_string(),
+            ..Default::default()
+        };
+        let python = executor.resolve_config(&request).unwrap();
+        let dependencies = &config.dependencies["python"];
+
+        let args = DockerExecutor::build_docker_install_command(
+            "isobox-dependencies-1",
+            Path::new("/tmp/lockfile"),
+            Path::new("/var/cache/isobox/abc"),
+            &python,
+            dependencies,
+        );
+        assert!(args.contains(&"/tmp/lockfile:/isobox-lockfile:ro".to_string()));
+        assert!(args.contains(&"/var/cache/isobox/abc:/deps".to_string()));
+        assert!(!args.contains(&"none".to_string()));
+        assert!(args.ends_with(&dependencies.install));
+    }
+
+    #[test]
+    fn test_dataset_mounts() {
+        let config = IsoboxConfig::from_json(
+            r#"{"datasets": {"iris": {"source": "/srv/datasets/iris"}, "mnist": {"source": "s3://course-data/mnist/", "tenants": ["cs101"]}}}"#,
+        )
+        .unwrap();
+        let executor = CodeExecutor::with_config(&config);
+        let request = ExecuteRequest {
+            language: "python".to_string(),
+            code: "print('hi')".to_string(),
+            datasets: Some(vec!["iris".to_string()]),
+            ..Default::default()
+        };
+
+        let python = executor.resolve_config(&request).unwrap();
+        assert_eq!(
+            python.extra_mounts,
+            vec![VolumeMount {
+                host_path: "/srv/datasets/iris".to_string(),
+                container_path: "/datasets/iris".to_string(),
+                read_only: true,
+            }]
+        );
+        let args = DockerExecutor::build_docker_command(
+            "/tmp/job",
+            &python,
+            &ResourceLimits::default(),
+            python.run_command(),
+        );
+        assert!(args.contains(&"/srv/datasets/iris:/datasets/iris:ro".to_string()));
+
+        let restricted = ExecuteRequest {
+            language: "python".to_string(),
+            datasets: Some(vec!["mnist".to_string()]),
+            ..Default::default()
+        };
+        assert!(matches!(
+            executor.resolve_config(&restricted),
+            Err(ExecutionError::PolicyViolation(_))
+        ));
+
+        let unknown = ExecuteRequest {
+            language: "python".to_string(),
+            datasets: Some(vec!["cifar".to_string()]),
+            ..Default::default()
+        };
+        assert!(matches!(
+            executor.resolve_config(&unknown),
+            Err(ExecutionError::InvalidRequest(_))
+        ));
+    }
+
+    #[test]
+    fn test_gpu_requests() {
+        let config =
+            IsoboxConfig::from_json(r#"{"tenants": {"cs101": {"gpu_seconds_per_day": 10}}}"#)
+                .unwrap();
+        let mut executor = CodeExecutor::with_config(&config);
+        let request = ExecuteRequest {
+            language: "python".to_string(),
+            code: "print('hi')".to_string(),
+            tenant: Some("cs101".to_string()),
+            gpu: Some(true),
+            ..Default::default()
+        };
+
+        executor.gpu_devices = None;
+        assert!(matches!(
+            executor.resolve_config(&request),
+            Err(ExecutionError::Unavailable(_))
+        ));
+
+        executor.gpu_devices = Some("all".to_string());
+        let python = executor.resolve_config(&request).unwrap();
+        let args = DockerExecutor::build_docker_command(
+            "/tmp/job",
+            &python,
+            &ResourceLimits::default(),
+            python.run_command(),
+        );
+        assert!(args.windows(2).any(|w| w == ["--gpus", "all"]));
+
+        executor.usage.record_execution("cs101", 10.0);
+        assert!(matches!(
+            executor.resolve_config(&request),
+            Err(ExecutionError::PolicyViolation(_))
+        ));
+    }
+
+    #[test]
+    fn test_arch_selection() {
+        let mut executor = CodeExecutor::new();
+        executor.host_arch = "amd64".to_string();
+        executor.arch_emulation = false;
+        let request = |arch: &str| ExecuteRequest {
+            language: "python".to_string(),
+            code: "print('hi')".to_string(),
+            arch: Some(arch.to_string()),
+            ..Default::default()
+        };
+
+        let native = executor.resolve_config(&request("x86_64")).unwrap();
+        assert_eq!(native.platform.as_deref(), Some("linux/amd64"));
+        assert!(!native.emulated);
+
+        assert!(matches!(
+            executor.resolve_config(&request("arm64")),
+            Err(ExecutionError::Unavailable(_))
+        ));
+        assert!(matches!(
+            executor.resolve_config(&request("riscv64")),
+            Err(ExecutionError::InvalidRequest(_))
+        ));
+
+        executor.arch_emulation = true;
+        let emulated = executor.resolve_config(&request("arm64")).unwrap();
+        assert!(emulated.emulated);
+        let args = DockerExecutor::build_docker_command(
+            "/tmp/job",
+            &emulated,
+            &ResourceLimits::default(),
+            emulated.run_command(),
+        );
+        assert!(args.windows(2).any(|w| w == ["--platform", "linux/arm64"]));
+    }
+
+    #[test]
+    fn test_runtime_channels() {
+        let config = IsoboxConfig::from_json(
+            r#"{"languages": {"python": {
+                "image": "python:3.12",
+                "versions": {"3.11": "python:3.11"},
+                "next": {"image": "python:3.13-rc", "percent": 0, "tenants": ["beta"]}
+            }}}"#,
+        )
+        .unwrap();
+        let executor = CodeExecutor::with_config(&config);
+        let request = |tenant: &str| ExecuteRequest {
+            language: "python".to_string(),
+            code: "print('hi')".to_string(),
+            tenant: Some(tenant.to_string()),
+            ..Default::default()
+        };
+        let prepare = |request: ExecuteRequest| {
+            let (request, _) = executor.prepare_code(request)?;
+            executor.resolve_config(&request)
+        };
+
+        let stable = prepare(request("cs101")).unwrap();
+        assert_eq!(stable.docker_image, "python:3.12");
+        assert_eq!(stable.channel, Some(Channel::Stable));
+
+        let next = prepare(request("beta")).unwrap();
+        assert_eq!(next.docker_image, "python:3.13-rc");
+        assert_eq!(next.channel, Some(Channel::Next));
+
+        // Requests can opt in themselves
+        let opted_in = prepare(ExecuteRequest {
+            channel: Some(Channel::Next),
+            ..request("cs101")
+        })
+        .unwrap();
+        assert_eq!(opted_in.docker_image, "python:3.13-rc");
+
+        // Pinned versions run outside the channels
+        let pinned = prepare(ExecuteRequest {
+            version: Some("3.11".to_string()),
+            ..request("beta")
+        })
+        .unwrap();
+        assert_eq!(pinned.docker_image, "python:3.11");
+        assert_eq!(pinned.channel, None);
+        assert!(prepare(ExecuteRequest {
+            version: Some("3.11".to_string()),
+            channel: Some(Channel::Next),
+            ..request("beta")
+        })
+        .is_err());
+
+        // Languages without a next channel can't be asked for one
+        let node = ExecuteRequest {
+            language: "node".to_string(),
+            ..request("beta")
+        };
+        assert_eq!(prepare(node.clone()).unwrap().channel, None);
+        assert!(matches!(
+            prepare(ExecuteRequest {
+                channel: Some(Channel::Next),
+                ..node
+            }),
+            Err(ExecutionError::InvalidRequest(_))
+        ));
+
+        assert!(sample(100.0));
+        assert!(!sample(0.0));
+    }
+
+    #[test]
+    fn test_command_override_requires_allow_list() {
+        let config = IsoboxConfig::from_json(
+            r#"{"tenants": {"cs101": {"allowed_commands": ["python -m"]}}}"#,
+        )
+        .unwrap();
+        let executor = CodeExecutor::with_config(&config);
+        let command = vec!["python".to_string(), "-m".to_string(), "pkg".to_string()];
+
+        assert!(executor
+            .check_command_allowed(Some("cs101"), &command)
+            .is_ok());
+        assert!(matches!(
+            executor.check_command_allowed(None, &command),
+            Err(ExecutionError::PolicyViolation(_))
+        ));
+        assert!(matches!(
+            executor.check_command_allowed(Some("cs101"), &[]),
+            Err(ExecutionError::PolicyViolation(_))
+        ));
+    }
+
+    #[test]
+    fn test_trace_requires_admin() {
+        let config =
+            IsoboxConfig::from_json(r#"{"tenants": {"ops": {"admin": true}, "cs101": {}}}"#)
+                .unwrap();
+        let mut executor = CodeExecutor::with_config(&config);
+        let request = |tenant: &str| ExecuteRequest {
+            language: "c".to_string(),
+            code: "int main() { return 0; }".to_string(),
+            trace: Some(true),
+            tenant: Some(tenant.to_string()),
+            ..Default::default()
+        };
+
+        executor.tracer = Tracer::default();
+        assert!(matches!(
+            executor.resolve_config(&request("ops")),
+            Err(ExecutionError::Unavailable(_))
+        ));
+
+        executor.tracer = Tracer::new(Some("/usr/local/bin/strace".to_string()), 1024);
+        assert!(matches!(
+            executor.resolve_config(&request("cs101")),
+            Err(ExecutionError::PolicyViolation(_))
+        ));
+        let traced = executor.resolve_config(&request("ops")).unwrap();
+        assert!(traced.traced);
+        assert_eq!(traced.run_command()[0], trace::SANDBOX_PATH);
+        assert_eq!(traced.run_command().last().unwrap(), "./a.out");
+        let docker_args = DockerExecutor::build_docker_command(
+            "/tmp/test",
+            &traced,
+            &ResourceLimits::default(),
+            traced.run_command(),
+        );
+        assert!(docker_args.contains(&"/usr/local/bin/strace:/opt/isobox/strace:ro".to_string()));
+    }
+
+    #[test]
+    fn test_syscall_policy() {
+        let config = IsoboxConfig::from_json(
+            r#"{"languages": {"c": {"syscall_policy": "strict"}}, "tenants": {"ops": {"admin": true}}}"#,
+        )
+        .unwrap();
+        let mut executor = CodeExecutor::with_config(&config);
+        let profiles = std::env::temp_dir().join(format!("isobox-seccomp-{}", Uuid::new_v4()));
+        executor.syscall_filter = SyscallFilter::new(profiles.clone());
+        executor.tracer = Tracer::new(Some("/usr/local/bin/strace".to_string()), 1024);
+        let request = |language: &str| ExecuteRequest {
+            language: language.to_string(),
+            code: String::new(),
+            tenant: Some("ops".to_string()),
+            ..Default::default()
+        };
+
+        let c = executor.resolve_config(&request("c")).unwrap();
+        assert_eq!(c.syscall_policy, Some(SyscallPolicy::Strict));
+        let profile = c.seccomp_profile.clone().unwrap();
+        assert!(profile.ends_with("strict.json"));
+        let docker_args = DockerExecutor::build_docker_command(
+            "/tmp/test",
+            &c,
+            &ResourceLimits::default(),
+            c.run_command(),
+        );
+        assert!(docker_args.contains(&format!("seccomp={profile}")));
+        let python = executor.resolve_config(&request("python")).unwrap();
+        assert_eq!(python.syscall_policy, Some(SyscallPolicy::Standard));
+
+        // strace can't run where ptrace is denied
+        let traced = |language: &str| ExecuteRequest {
+            trace: Some(true),
+            ..request(language)
+        };
+        assert!(matches!(
+            executor.resolve_config(&traced("c")),
+            Err(ExecutionError::PolicyViolation(_))
+        ));
+        assert!(executor.resolve_config(&traced("python")).is_ok());
+
+        let response = executor.record_syscall_denials(
+            "job",
+            "c",
+            "/nonexistent",
+            &c,
+            ExecuteResponse {
+                exit_code: 128 + libc::SIGSYS,
+                term_signal: Some("SIGSYS".to_string()),
+                term_reason: Some("bad system call".to_string()),
+                ..Default::default()
+            },
+        );
+        assert_eq!(
+            response.term_reason.as_deref(),
+            Some("denied by the strict syscall policy")
+        );
+        assert_eq!(executor.syscall_filter.denials()[0].count, 1);
+        fs::remove_dir_all(&profiles).unwrap();
+    }
+
+    #[test]
+    fn test_workspace_layout() {
+        let config = LanguageConfig::new(
+            "python:3.11",
+            "main.py",
+            vec!["python".to_string(), "main.py".to_string()],
+            None,
+        )
+        .with_layout(Some("/home/student/project"), Some("src/app.py"));
+        assert_eq!(config.file_name(), "src/app.py");
+        assert_eq!(config.run_command(), ["python", "src/app.py"]);
 
-        log::info!(
-            "Execution completed: exit_code={}, stdout_len={}, stderr_len={}, time_taken={:.3}s",
-            exit_code,
-            stdout.len(),
-            stderr.len(),
-            time_taken
+        let docker_args = DockerExecutor::build_docker_command(
+            "/tmp/test",
+            &config,
+            &ResourceLimits::default(),
+            config.run_command(),
         );
+        assert!(docker_args.contains(&"/tmp/test:/home/student/project".to_string()));
+        assert!(docker_args.contains(&"/home/student/project".to_string()));
 
-        Ok(ExecuteResponse {
-            stdout,
-            stderr,
-            exit_code,
-            time_taken: Some(time_taken),
-            memory_used: None, // TODO: Implement memory tracking
-            test_results: None,
-        })
+        let rust = CodeExecutor::new()
+            .language_registry
+            .get_language_config("rust")
+            .unwrap()
+            .clone()
+            .with_layout(Some("/src"), None);
+        assert!(rust.compile_command().unwrap()[2].contains("cp /src/main.rs"));
     }
-}
 
-impl Default for CodeExecutor {
-    fn default() -> Self {
-        Self::new()
+    #[test]
+    fn test_dry_run_plan() {
+        let executor = CodeExecutor::new();
+        let plan = executor
+            .plan(ExecuteRequest {
+                language: "python".to_string(),
+                code: "print(1)".to_string(),
+                workdir: Some("/home/student".to_string()),
+                entrypoint: Some("src/app.py".to_string()),
+                ..Default::default()
+            })
+            .unwrap();
+        assert_eq!(plan.backend, "docker");
+        assert_eq!(plan.work_dir, "/home/student");
+        assert_eq!(plan.run, ["python", "src/app.py"]);
+        assert_eq!(plan.limits.wall_time_seconds, Some(10));
+
+        let escaping = executor.plan(ExecuteRequest {
+            language: "python".to_string(),
+            entrypoint: Some("../app.py".to_string()),
+            ..Default::default()
+        });
+        assert!(matches!(escaping, Err(ExecutionError::InvalidRequest(_))));
+        let unknown = executor.plan(ExecuteRequest {
+            language: "cobol".to_string(),
+            ..Default::default()
+        });
+        assert!(matches!(
+            unknown,
+            Err(ExecutionError::UnsupportedLanguage(_))
+        ));
     }
-}
 
-#[cfg(test)]
-mod tests {
-    use super::*;
+    #[test]
+    fn test_workspace_layout_validation() {
+        assert!(validate_relative_path("data/input.csv").is_ok());
+        assert!(validate_relative_path("../escape").is_err());
+        assert!(validate_relative_path("/etc/passwd").is_err());
+        assert!(validate_relative_path("").is_err());
+
+        assert!(validate_work_dir("/home/student").is_ok());
+        assert!(validate_work_dir("/").is_err());
+        assert!(validate_work_dir("relative").is_err());
+        assert!(validate_work_dir("/tmp/work").is_err());
+        assert!(validate_work_dir("/home/../etc").is_err());
+
+        assert_eq!(parse_file_mode("0755").unwrap(), 0o755);
+        assert_eq!(parse_file_mode("644").unwrap(), 0o644);
+        assert!(parse_file_mode("999").is_err());
+    }
 
     #[test]
-    fn test_executor_creation() {
+    fn test_custom_entrypoint_of_compiled_languages() {
         let executor = CodeExecutor::new();
+        let language = |name: &str| {
+            executor
+                .language_registry
+                .get_language_config(name)
+                .unwrap()
+                .clone()
+        };
+        let request = |language: &str, entrypoint: &str| ExecuteRequest {
+            language: language.to_string(),
+            entrypoint: Some(entrypoint.to_string()),
+            ..Default::default()
+        };
 
-        // Verify that major languages are supported
-        assert!(executor
-            .language_registry
-            .get_language_config("python")
-            .is_some());
-        assert!(executor
-            .language_registry
-            .get_language_config("node")
-            .is_some());
-        assert!(executor
-            .language_registry
-            .get_language_config("go")
-            .is_some());
-        assert!(executor
-            .language_registry
-            .get_language_config("rust")
-            .is_some());
-        assert!(executor
-            .language_registry
-            .get_language_config("c")
-            .is_some());
-        assert!(executor
-            .language_registry
-            .get_language_config("cpp")
-            .is_some());
-        assert!(executor
-            .language_registry
-            .get_language_config("java")
-            .is_some());
-        assert!(executor
-            .language_registry
-            .get_language_config("csharp")
-            .is_some());
-        assert!(executor
-            .language_registry
-            .get_language_config("php")
-            .is_some());
-        assert!(executor
-            .language_registry
-            .get_language_config("ruby")
-            .is_some());
-
-        // Verify configuration details for a few languages
-        let python_config = executor
-            .language_registry
-            .get_language_config("python")
-            .unwrap();
-        assert_eq!(python_config.docker_image(), "python:3.11");
-        assert_eq!(python_config.file_name(), "main.py");
+        let rust = language("rust");
+        assert!(rust
+            .check_layout(&request("rust", "src/bin/app.rs"))
+            .is_ok());
+        let rust = rust.with_layout(Some("/home/student"), Some("src/bin/app.rs"));
+        assert_eq!(
+            rust.compile_command().unwrap(),
+            ["/usr/local/cargo/bin/rustc", "src/bin/app.rs", "-o", "main"]
+        );
+        assert_eq!(rust.run_command(), ["./main"]);
+
+        let c = language("c").with_layout(None, Some("src/prog.c"));
+        assert_eq!(c.compile_command().unwrap(), ["gcc", "src/prog.c"]);
+        assert_eq!(c.run_command(), ["./a.out"]);
+
+        // Java runs the class named after the file
+        let java = language("java");
+        assert!(java.check_layout(&request("java", "Main.java")).is_ok());
+        assert!(matches!(
+            java.check_layout(&request("java", "src/App.java")),
+            Err(ExecutionError::InvalidRequest(_))
+        ));
+        assert!(language("scala")
+            .check_layout(&request("scala", "App.scala"))
+            .is_err());
+
+        // Paths that would change the meaning of a shell command
+        assert!(rust.check_layout(&request("rust", "a.rs;id")).is_err());
+
+        // Files can't replace the code, whether or not the entrypoint is set
+        let python = language("python");
+        let with_file = |entrypoint: Option<&str>, path: &str| ExecuteRequest {
+            language: "python".to_string(),
+            entrypoint: entrypoint.map(str::to_string),
+            files: Some(vec![WorkspaceFile {
+                path: path.to_string(),
+                content: String::new(),
+                mode: None,
+            }]),
+            ..Default::default()
+        };
+        assert!(python.check_layout(&with_file(None, "main.py")).is_err());
+        assert!(python
+            .check_layout(&with_file(Some("src/app.py"), "src/app.py"))
+            .is_err());
+        assert!(python
+            .check_layout(&with_file(Some("src/app.py"), "main.py"))
+            .is_ok());
+    }
 
-        let rust_config = executor
-            .language_registry
-            .get_language_config("rust")
-            .unwrap();
-        assert_eq!(rust_config.docker_image(), "rust:alpine");
-        assert_eq!(rust_config.file_name(), "main.rs");
-        assert!(rust_config.compile_command().is_some());
+    #[test]
+    fn test_pinned_images() {
+        let digest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef";
+        let config = IsoboxConfig::from_json(&format!(
+            r#"{{"languages": {{"python": {{"image": "python:3.11@{digest}"}}, "node": {{"image": "node:20"}}}}}}"#
+        ))
+        .unwrap();
+        let executor = CodeExecutor::with_config(&config);
+        assert_eq!(
+            executor.language_registry.pinned_images(),
+            vec![format!("python:3.11@{digest}")]
+        );
     }
 
     #[test]
@@ -1264,16 +6176,95 @@ mod tests {
         assert!(!limits.enable_network);
     }
 
+    #[test]
+    fn test_request_limits() {
+        let limits = RequestLimits {
+            max_code_bytes: 10,
+            max_stdin_bytes: 4,
+            max_files: 2,
+            max_file_bytes: 5,
+            max_files_bytes: 8,
+            max_upload_bytes: 16,
+        };
+        let file = |content: &str| WorkspaceFile {
+            path: "data.txt".to_string(),
+            content: content.to_string(),
+            mode: None,
+        };
+        let field = |request: ExecuteRequest| match limits.check(&request) {
+            Err(ExecutionError::PayloadTooLarge(field, _))
+            | Err(ExecutionError::CodeTooLarge(field, ..)) => Some(field),
+            _ => None,
+        };
+
+        let request = ExecuteRequest {
+            code: "print(1)".to_string(),
+            ..Default::default()
+        };
+        assert!(limits.check(&request).is_ok());
+        match limits.check(&ExecuteRequest {
+            code: "x".repeat(11),
+            ..Default::default()
+        }) {
+            Err(ExecutionError::CodeTooLarge(field, 11, 10)) => assert_eq!(field, "code"),
+            other => panic!("Expected the code to be too large, got {other:?}"),
+        }
+        assert_eq!(
+            field(ExecuteRequest {
+                test_cases: Some(vec![
+                    TestCase {
+                        name: "small".to_string(),
+                        input: "1".to_string(),
+                        expected_output: None,
+                        timeout_seconds: None,
+                        memory_limit_mb: None,
+                        ..Default::default()
+                    },
+                    TestCase {
+                        name: "large".to_string(),
+                        input: "12345".to_string(),
+                        expected_output: None,
+                        timeout_seconds: None,
+                        memory_limit_mb: None,
+                        ..Default::default()
+                    },
+                ]),
+                ..Default::default()
+            }),
+            Some("test_cases[1].input".to_string())
+        );
+        assert_eq!(
+            field(ExecuteRequest {
+                files: Some(vec![file("a"), file("b"), file("c")]),
+                ..Default::default()
+            }),
+            Some("files".to_string())
+        );
+        assert_eq!(
+            field(ExecuteRequest {
+                files: Some(vec![file("1"), file("123456")]),
+                ..Default::default()
+            }),
+            Some("files[1]".to_string())
+        );
+        assert_eq!(
+            field(ExecuteRequest {
+                files: Some(vec![file("12345"), file("6789")]),
+                ..Default::default()
+            }),
+            Some("files".to_string())
+        );
+    }
+
     #[test]
     fn test_docker_command_builder() {
         let limits = ResourceLimits::default();
-        let config = LanguageConfig {
-            docker_image: "python:3.11".to_string(),
-            file_name: "main.py".to_string(),
-            run_command: vec!["python".to_string(), "main.py".to_string()],
-            compile_command: None,
-            resource_limits: None,
-        };
+        let config = LanguageConfig::new(
+            "python:3.11",
+            "main.py",
+            vec!["python".to_string(), "main.py".to_string()],
+            None,
+        );
 
         let docker_args = DockerExecutor::build_docker_command(
             "/tmp/test",
@@ -1291,6 +6282,409 @@ mod tests {
         assert!(docker_args.contains(&"--cap-drop".to_string()));
         assert!(docker_args.contains(&"ALL".to_string()));
         assert!(docker_args.contains(&"python:3.11".to_string()));
+        assert!(!docker_args.contains(&"--pull".to_string()));
+    }
+
+    #[test]
+    fn test_embedded_runtime() {
+        let config = IsoboxConfig::from_json(
+            r#"{"embedded_runtimes": {
+                "shell": {"extension": "sh", "run": ["sh", "{work_dir}/{file}"]},
+                "missing": {"extension": "py", "run": ["/nonexistent/python3", "{file}"]}
+            }}"#,
+        )
+        .unwrap();
+        let mut executor = CodeExecutor::new();
+        executor.language_registry = LanguageRegistry::embedded(&config.embedded_runtimes);
+        assert!(executor.language_registry.images().is_empty());
+        match executor.verify_embedded_runtimes() {
+            Err(ExecutionError::MissingInterpreters(missing)) => {
+                assert_eq!(missing, ["/nonexistent/python3"])
+            }
+            other => panic!("Expected a missing interpreter, got {other:?}"),
+        }
+
+        let request = ExecuteRequest {
+            language: "shell".to_string(),
+            code: "read name; echo \"hello $name\"".to_string(),
+            test_cases: Some(vec![TestCase {
+                name: "greeting".to_string(),
+                input: "isobox".to_string(),
+                expected_output: Some("hello isobox".to_string()),
+                timeout_seconds: None,
+                memory_limit_mb: None,
+                ..Default::default()
+            }]),
+            ..Default::default()
+        };
+        let response = tokio::runtime::Runtime::new()
+            .unwrap()
+            .block_on(executor.execute(request.clone()))
+            .unwrap();
+        assert!(response.test_results.unwrap()[0].passed);
+
+        // Container features aren't available on the host
+        let gpu = ExecuteRequest {
+            gpu: Some(true),
+            ..request
+        };
+        assert!(matches!(
+            executor.resolve_config(&gpu),
+            Err(ExecutionError::InvalidRequest(_))
+        ));
+    }
+
+    #[test]
+    fn test_air_gapped_disables_pulls() {
+        let mut executor = CodeExecutor::new();
+        executor.air_gapped = true;
+        let request = ExecuteRequest {
+            language: "python".to_string(),
+            code: "print(1)".to_string(),
+            ..Default::default()
+        };
+        let config = executor.resolve_config(&request).unwrap();
+        let docker_args = DockerExecutor::build_docker_command(
+            "/tmp/test",
+            &config,
+            &ResourceLimits::default(),
+            &["python".to_string(), "main.py".to_string()],
+        );
+        let pull = docker_args.iter().position(|arg| arg == "--pull").unwrap();
+        assert_eq!(docker_args[pull + 1], "never");
+        // The flag has to come before the image
+        let image = docker_args
+            .iter()
+            .position(|arg| *arg == config.docker_image)
+            .unwrap();
+        assert!(pull < image);
+    }
+
+    #[test]
+    fn test_core_dumps_only_for_debug() {
+        let executor = CodeExecutor::new();
+        let request = ExecuteRequest {
+            language: "c".to_string(),
+            code: "int main() { return 0; }".to_string(),
+            ..Default::default()
+        };
+        let config = executor.resolve_config(&request).unwrap();
+        let limits = ResourceLimits {
+            core_dump_limit: 1024,
+            ..ResourceLimits::default()
+        };
+        let command = ["./a.out".to_string()];
+        let docker_args =
+            DockerExecutor::build_docker_command("/tmp/test", &config, &limits, &command);
+        assert!(docker_args.contains(&"core=1024:1024".to_string()));
+        let docker_args = DockerExecutor::build_docker_command(
+            "/tmp/test",
+            &config,
+            &ResourceLimits::default(),
+            &command,
+        );
+        assert!(docker_args.contains(&"core=0:0".to_string()));
+
+        let request = ExecuteRequest {
+            debug: Some(true),
+            test_cases: Some(Vec::new()),
+            ..request
+        };
+        assert!(matches!(
+            executor.resolve_config(&request),
+            Err(ExecutionError::InvalidRequest(_))
+        ));
+    }
+
+    #[test]
+    fn test_request_ulimits() {
+        let config =
+            IsoboxConfig::from_json(r#"{"languages": {"c": {"ulimits": {"nofile": 32}}}}"#)
+                .unwrap();
+        let executor = CodeExecutor::with_config(&config);
+        let request = |ulimits: Ulimits, debug: bool| ExecuteRequest {
+            language: "c".to_string(),
+            code: "int main() { return 0; }".to_string(),
+            ulimits: Some(ulimits),
+            debug: Some(debug),
+            ..Default::default()
+        };
+
+        let config = executor
+            .resolve_config(&request(
+                Ulimits {
+                    nofile: Some(8),
+                    fsize: Some(4096),
+                    ..Default::default()
+                },
+                false,
+            ))
+            .unwrap();
+        let limits = config.resource_limits().unwrap();
+        let docker_args = DockerExecutor::build_docker_command("/tmp/test", &config, limits, &[]);
+        assert!(docker_args.contains(&"nofile=8:8".to_string()));
+        assert!(docker_args.contains(&"fsize=4096:4096".to_string()));
+
+        // Requests can lower the language's limits but not raise them
+        for (ulimits, debug) in [
+            (
+                Ulimits {
+                    nofile: Some(64),
+                    ..Default::default()
+                },
+                false,
+            ),
+            (
+                Ulimits {
+                    core: Some(1024),
+                    ..Default::default()
+                },
+                false,
+            ),
+            (
+                Ulimits {
+                    core: Some(executor.core_dump_limit + 1),
+                    ..Default::default()
+                },
+                true,
+            ),
+        ] {
+            assert!(matches!(
+                executor.resolve_config(&request(ulimits, debug)),
+                Err(ExecutionError::InvalidRequest(_))
+            ));
+        }
+
+        let config = executor
+            .resolve_config(&request(
+                Ulimits {
+                    core: Some(1024),
+                    ..Default::default()
+                },
+                true,
+            ))
+            .unwrap();
+        assert_eq!(executor.debug_core_limit(&config), 1024);
+    }
+
+    #[test]
+    fn test_abandoned_execution_is_reported() {
+        let events = EventBus::new();
+        let mut received = events.subscribe();
+        let guard = |finished| AbandonGuard {
+            events: &events,
+            job_id: "job-1",
+            tenant: "default",
+            language: "python",
+            finished,
+        };
+
+        drop(guard(true));
+        assert!(received.try_recv().is_err());
+
+        drop(guard(false));
+        let event = received.try_recv().unwrap();
+        assert_eq!(event.id, "job-1");
+        assert_eq!(
+            event.error.as_deref(),
+            Some("The caller went away before the execution finished")
+        );
+    }
+
+    #[tokio::test]
+    async fn test_request_deadline() {
+        let executor = CodeExecutor::new();
+        let request = |deadline: SystemTime| ExecuteRequest {
+            language: "python".to_string(),
+            code: "print('hi')".to_string(),
+            deadline: Some(deadline),
+            ..Default::default()
+        };
+
+        // The wall time ends at the deadline
+        let config = executor
+            .resolve_config(&request(SystemTime::now() + Duration::from_secs(3)))
+            .unwrap();
+        let wall_time = config.resource_limits().unwrap().wall_time_limit;
+        assert!(wall_time > Duration::from_secs(2) && wall_time <= Duration::from_secs(3));
+        let config = executor
+            .resolve_config(&request(SystemTime::now() + Duration::from_secs(3600)))
+            .unwrap();
+        assert_eq!(
+            config.resource_limits().unwrap().wall_time_limit,
+            executor.resource_limits.wall_time_limit
+        );
+
+        // Nothing starts once it has passed
+        let result = executor
+            .execute(request(SystemTime::now() - Duration::from_secs(1)))
+            .await;
+        assert!(matches!(result, Err(ExecutionError::DeadlineExceeded)));
+
+        // Nor after it passes while waiting for a language slot
+        let mut executor = CodeExecutor::new();
+        executor.language_slots = LanguageSlots::new(HashMap::from([("python".to_string(), 1)]));
+        let _busy = executor.language_slots.acquire("python").await;
+        let started = std::time::Instant::now();
+        let result = executor
+            .execute(request(SystemTime::now() + Duration::from_millis(200)))
+            .await;
+        assert!(matches!(result, Err(ExecutionError::DeadlineExceeded)));
+        assert!(started.elapsed() < Duration::from_secs(5));
+    }
+
+    #[test]
+    fn test_swap_limit() {
+        let swap_arg = |executor: &CodeExecutor| {
+            let config = executor
+                .resolve_config(&ExecuteRequest {
+                    language: "python".to_string(),
+                    code: "print(1)".to_string(),
+                    ..Default::default()
+                })
+                .unwrap();
+            let limits = config
+                .resource_limits()
+                .unwrap_or(&executor.resource_limits);
+            let docker_args =
+                DockerExecutor::build_docker_command("/tmp/test", &config, limits, &[]);
+            let index = docker_args.iter().position(|arg| arg == "--memory-swap");
+            (limits.memory_limit, docker_args[index.unwrap() + 1].clone())
+        };
+
+        // Swap is off unless a language allows some
+        let (memory, swap) = swap_arg(&CodeExecutor::new());
+        assert_eq!(swap, format!("{memory}b"));
+
+        let config = IsoboxConfig::from_json(
+            r#"{"languages": {"python": {"limits": {"memory_mb": 128, "swap_mb": 64}}}}"#,
+        )
+        .unwrap();
+        let (_, swap) = swap_arg(&CodeExecutor::with_config(&config));
+        assert_eq!(swap, format!("{}b", 192 * 1024 * 1024));
+    }
+
+    #[test]
+    fn test_pinned_cpu() {
+        let executor = CodeExecutor::new();
+        let mut config = executor
+            .language_registry
+            .get_language_config("c")
+            .unwrap()
+            .clone();
+        let limits = ResourceLimits::default();
+        let args = DockerExecutor::build_docker_command("/tmp/test", &config, &limits, &[]);
+        assert!(!args.contains(&"--cpuset-cpus".to_string()));
+
+        config.cpu = Some(3);
+        for args in [
+            DockerExecutor::build_docker_command("/tmp/test", &config, &limits, &[]),
+            DockerExecutor::build_docker_compile_command("/tmp/test", &config, &limits, &[]),
+        ] {
+            let index = args.iter().position(|arg| arg == "--cpuset-cpus").unwrap();
+            assert_eq!(args[index + 1], "3");
+        }
+    }
+
+    #[test]
+    fn test_batch_priority() {
+        let executor = CodeExecutor::new();
+        let docker_args = |priority: Option<Priority>| {
+            let request = ExecuteRequest {
+                language: "python".to_string(),
+                code: "print(1)".to_string(),
+                priority,
+                ..Default::default()
+            };
+            let config = executor.resolve_config(&request).unwrap();
+            DockerExecutor::build_docker_command(
+                "/tmp/test",
+                &config,
+                &ResourceLimits::default(),
+                config.run_command(),
+            )
+        };
+        assert!(!docker_args(None).contains(&"--cpu-shares".to_string()));
+        assert!(!docker_args(Some(Priority::Interactive)).contains(&"--cpu-shares".to_string()));
+        let batch = docker_args(Some(Priority::Batch));
+        let shares = batch.iter().position(|arg| arg == "--cpu-shares").unwrap();
+        assert_eq!(
+            batch[shares + 1],
+            executor.batch_scheduling.cpu_shares.to_string()
+        );
+        assert!(batch.contains(&"--blkio-weight".to_string()));
+    }
+
+    #[test]
+    fn test_containers_labelled_with_job() {
+        let executor = CodeExecutor::new();
+        let request = ExecuteRequest {
+            language: "python".to_string(),
+            code: "print(1)".to_string(),
+            ..Default::default()
+        };
+        let mut config = executor.resolve_config(&request).unwrap();
+        let command = ["python".to_string(), "main.py".to_string()];
+        let docker_args = DockerExecutor::build_docker_command(
+            "/tmp/test",
+            &config,
+            &ResourceLimits::default(),
+            &command,
+        );
+        assert!(!docker_args.contains(&"--label".to_string()));
+
+        config.job_id = Some("job-1".to_string());
+        let docker_args = DockerExecutor::build_docker_compile_command(
+            "/tmp/test",
+            &config,
+            &ResourceLimits::default(),
+            &command,
+        );
+        let label = docker_args.iter().position(|arg| arg == "--label").unwrap();
+        assert_eq!(docker_args[label + 1], "isobox.job=job-1");
+    }
+
+    #[test]
+    fn test_warm_instances_start_like_other_sandboxes() {
+        let executor = CodeExecutor::new();
+        let request = ExecuteRequest {
+            language: "python".to_string(),
+            code: "print(1)".to_string(),
+            priority: Some(Priority::Batch),
+            ..Default::default()
+        };
+        let mut config = executor.resolve_config(&request).unwrap();
+        config.job_id = Some("fn-1".to_string());
+        config.cpu = Some(3);
+        config
+            .env
+            .push(("PIP_INDEX_URL".to_string(), "http://mirror".to_string()));
+        let command = ["python".to_string(), "main.py".to_string()];
+        let run = DockerExecutor::build_docker_command(
+            "/tmp/test",
+            &config,
+            &ResourceLimits::default(),
+            &command,
+        );
+        let warm = DockerExecutor::build_warm_command(&WarmInstance {
+            container: "isobox-fn-1".to_string(),
+            workspace: "/tmp/test".to_string(),
+            config,
+            limits: ResourceLimits::default(),
+            function_call: true,
+            tenant: DEFAULT_TENANT.to_string(),
+        });
+
+        // Only how the container is started and what it runs differ
+        let options = |args: &[String], start: usize, command_len: usize| {
+            args[start..args.len() - command_len].to_vec()
+        };
+        assert_eq!(&warm[..5], ["run", "--rm", "-d", "--name", "isobox-fn-1"]);
+        assert_eq!(options(&warm, 5, 3), options(&run, 3, command.len()));
+        assert!(warm.contains(&"isobox.job=fn-1".to_string()));
+        assert!(warm.contains(&"PIP_INDEX_URL=http://mirror".to_string()));
+        assert!(warm.contains(&"--cpuset-cpus".to_string()));
+        assert!(warm.contains(&"--cpu-shares".to_string()));
     }
 
     #[test]
@@ -1355,6 +6749,7 @@ mod tests {
             language: "unsupported".to_string(),
             code: "print('test')".to_string(),
             test_cases: None,
+            ..Default::default()
         };
 
         // This should fail with an unsupported language error
@@ -1392,6 +6787,7 @@ mod tests {
                 expected_output: Some("8".to_string()),
                 timeout_seconds: Some(5 * timeout_multiplier),
                 memory_limit_mb: Some(128),
+                ..Default::default()
             },
             TestCase {
                 name: "string_reverse_test".to_string(),
@@ -1399,6 +6795,7 @@ mod tests {
                 expected_output: Some("dlroW olleH".to_string()),
                 timeout_seconds: Some(5 * timeout_multiplier),
                 memory_limit_mb: Some(128),
+                ..Default::default()
             },
             TestCase {
                 name: "array_sum_test".to_string(),
@@ -1406,6 +6803,7 @@ mod tests {
                 expected_output: Some("15".to_string()),
                 timeout_seconds: Some(5 * timeout_multiplier),
                 memory_limit_mb: Some(128),
+                ..Default::default()
             },
         ];
 
@@ -1428,6 +6826,7 @@ else:
 "#
             .to_string(),
             test_cases: Some(test_cases),
+            ..Default::default()
         };
 
         let result = tokio::runtime::Runtime::new()
@@ -1548,6 +6947,7 @@ else:
                 expected_output: Some("15".to_string()),
                 timeout_seconds: Some(5 * timeout_multiplier),
                 memory_limit_mb: Some(128),
+                ..Default::default()
             },
             TestCase {
                 name: "string_length_test".to_string(),
@@ -1555,6 +6955,7 @@ else:
                 expected_output: Some("11".to_string()),
                 timeout_seconds: Some(5 * timeout_multiplier),
                 memory_limit_mb: Some(128),
+                ..Default::default()
             },
         ];
 
@@ -1590,6 +6991,7 @@ rl.on('close', () => {
 "#
             .to_string(),
             test_cases: Some(test_cases),
+            ..Default::default()
         };
 
         let result = tokio::runtime::Runtime::new()
@@ -1648,6 +7050,7 @@ rl.on('close', () => {
                 expected_output: Some("15".to_string()),
                 timeout_seconds: Some(10 * timeout_multiplier),
                 memory_limit_mb: Some(256),
+                ..Default::default()
             },
             TestCase {
                 name: "string_reverse_test".to_string(),
@@ -1655,6 +7058,7 @@ rl.on('close', () => {
                 expected_output: Some("olleH".to_string()),
                 timeout_seconds: Some(10 * timeout_multiplier),
                 memory_limit_mb: Some(256),
+                ..Default::default()
             },
         ];
 
@@ -1683,6 +7087,7 @@ fn main() {
 "#
             .to_string(),
             test_cases: Some(test_cases),
+            ..Default::default()
         };
 
         let result = tokio::runtime::Runtime::new()
@@ -1763,6 +7168,7 @@ fn main() {
                 expected_output: Some("15".to_string()),
                 timeout_seconds: Some(15 * timeout_multiplier), // Increased timeout
                 memory_limit_mb: Some(256),
+                ..Default::default()
             },
             TestCase {
                 name: "string_uppercase_test".to_string(),
@@ -1770,6 +7176,7 @@ fn main() {
                 expected_output: Some("HELLO WORLD".to_string()),
                 timeout_seconds: Some(15 * timeout_multiplier), // Increased timeout
                 memory_limit_mb: Some(256),
+                ..Default::default()
             },
         ];
 
@@ -1820,6 +7227,7 @@ func main() {
 "#
             .to_string(),
             test_cases: Some(test_cases),
+            ..Default::default()
         };
 
         let result = tokio::runtime::Runtime::new()
@@ -1877,12 +7285,14 @@ func main() {
             expected_output: None, // No expected output
             timeout_seconds: Some(5),
             memory_limit_mb: Some(128),
+            ..Default::default()
         }];
 
         let request = ExecuteRequest {
             language: "python".to_string(),
             code: "import sys\nprint('Hello from Python!')\nprint('Input was:', sys.stdin.read().strip())".to_string(),
             test_cases: Some(test_cases),
+            ..Default::default()
         };
 
         let result = tokio::runtime::Runtime::new()
@@ -1912,12 +7322,14 @@ func main() {
             expected_output: Some("10".to_string()), // Expect 10, but code will output 5
             timeout_seconds: Some(5),
             memory_limit_mb: Some(128),
+            ..Default::default()
         }];
 
         let request = ExecuteRequest {
             language: "python".to_string(),
             code: "import sys\nprint(sys.stdin.read().strip())".to_string(),
             test_cases: Some(test_cases),
+            ..Default::default()
         };
 
         let result = tokio::runtime::Runtime::new()
@@ -1952,6 +7364,7 @@ func main() {
             expected_output: Some("test".to_string()),
             timeout_seconds: Some(1), // Very short timeout
             memory_limit_mb: Some(128),
+            ..Default::default()
         }];
 
         let request = ExecuteRequest {
@@ -1971,6 +7384,7 @@ print(data)
 "#
             .to_string(),
             test_cases: Some(test_cases),
+            ..Default::default()
         };
 
         let result = tokio::runtime::Runtime::new()
@@ -2035,12 +7449,14 @@ print(data)
                 })),
                 timeout_seconds: Some(10 * timeout_multiplier),
                 memory_limit_mb: Some(256),
+                ..Default::default()
             }];
 
             let request = ExecuteRequest {
                 language: language.to_string(),
                 code: code.to_string(),
                 test_cases: Some(test_cases),
+                ..Default::default()
             };
 
             let result = tokio::runtime::Runtime::new()
@@ -0,0 +1,189 @@
+use std::collections::{BTreeMap, HashMap, VecDeque};
+
+/// Weighted round robin across tenants, so a tenant that queues thousands of jobs
+/// takes its share of the consumers rather than all of them.
+///
+/// Uses smooth weighted round robin: on every turn each tenant with jobs waiting
+/// gains its weight in credit, the tenant with the most credit goes next and pays
+/// back the sum of the weights. Tenants get turns in proportion to their weights,
+/// interleaved rather than in bursts. Tenants without a weight have weight 1.
+#[derive(Debug, Clone, Default)]
+pub struct FairScheduler {
+    weights: HashMap<String, u32>,
+    credit: HashMap<String, i64>,
+}
+
+impl FairScheduler {
+    pub fn new(weights: HashMap<String, u32>) -> Self {
+        Self {
+            weights,
+            credit: HashMap::new(),
+        }
+    }
+
+    pub fn weight(&self, tenant: &str) -> u32 {
+        self.weights.get(tenant).copied().unwrap_or(1).max(1)
+    }
+
+    /// Picks the tenant whose job starts next among those with jobs waiting.
+    /// Tenants are visited in sorted order so ties always go the same way.
+    pub fn next<'a>(&mut self, waiting: impl IntoIterator<Item = &'a str>) -> Option<&'a str> {
+        let mut waiting: Vec<&str> = waiting.into_iter().collect();
+        waiting.sort_unstable();
+        waiting.dedup();
+        // A tenant with nothing waiting starts over, rather than saving up turns
+        self.credit
+            .retain(|tenant, _| waiting.binary_search(&tenant.as_str()).is_ok());
+
+        let mut total = 0;
+        let mut chosen: Option<(&str, i64)> = None;
+        for tenant in waiting {
+            let weight = i64::from(self.weight(tenant));
+            total += weight;
+            let credit = self.credit.entry(tenant.to_string()).or_insert(0);
+            *credit += weight;
+            if chosen.map_or(true, |(_, best)| *credit > best) {
+                chosen = Some((tenant, *credit));
+            }
+        }
+        let (tenant, _) = chosen?;
+        *self.credit.get_mut(tenant).unwrap() -= total;
+        Some(tenant)
+    }
+
+    /// How many jobs start before the job at `index` in `tenant`'s queue, given
+    /// how many jobs each tenant has waiting. Assumes no more jobs arrive.
+    pub fn jobs_ahead(&self, waiting: &BTreeMap<String, u64>, tenant: &str, index: u64) -> u64 {
+        let mut scheduler = self.clone();
+        let mut waiting = waiting.clone();
+        let own = waiting.entry(tenant.to_string()).or_insert(0);
+        *own = (*own).max(index + 1);
+
+        let mut ahead = 0;
+        let mut index = index;
+        loop {
+            let active = waiting
+                .iter()
+                .filter(|(_, &count)| count > 0)
+                .map(|(name, _)| name.as_str());
+            let Some(next) = scheduler.next(active).map(str::to_string) else {
+                return ahead;
+            };
+            if next == tenant {
+                if index == 0 {
+                    return ahead;
+                }
+                index -= 1;
+            }
+            *waiting.get_mut(&next).unwrap() -= 1;
+            ahead += 1;
+        }
+    }
+}
+
+/// Per-tenant FIFO queues drained by a `FairScheduler`
+#[derive(Debug)]
+pub struct FairQueue<T> {
+    scheduler: FairScheduler,
+    queues: BTreeMap<String, VecDeque<T>>,
+}
+
+impl<T> FairQueue<T> {
+    pub fn new(scheduler: FairScheduler) -> Self {
+        Self {
+            scheduler,
+            queues: BTreeMap::new(),
+        }
+    }
+
+    pub fn push(&mut self, tenant: &str, item: T) {
+        self.queues
+            .entry(tenant.to_string())
+            .or_default()
+            .push_back(item);
+    }
+
+    /// Takes the oldest job of the tenant whose turn it is
+    pub fn pop(&mut self) -> Option<T> {
+        let tenant = self
+            .scheduler
+            .next(self.queues.keys().map(String::as_str))?
+            .to_string();
+        let queue = self.queues.get_mut(&tenant)?;
+        let item = queue.pop_front();
+        if queue.is_empty() {
+            self.queues.remove(&tenant);
+        }
+        item
+    }
+
+    pub fn len(&self) -> usize {
+        self.queues.values().map(VecDeque::len).sum()
+    }
+
+    /// Jobs waiting per tenant
+    pub fn waiting(&self) -> BTreeMap<String, u64> {
+        self.queues
+            .iter()
+            .map(|(tenant, queue)| (tenant.clone(), queue.len() as u64))
+            .collect()
+    }
+
+    /// How many jobs start before the first of `tenant`'s jobs that matches;
+    /// None when none does
+    pub fn position(&self, tenant: &str, matches: impl Fn(&T) -> bool) -> Option<u64> {
+        let index = self.queues.get(tenant)?.iter().position(matches)?;
+        Some(
+            self.scheduler
+                .jobs_ahead(&self.waiting(), tenant, index as u64),
+        )
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_tenants_share_by_weight() {
+        let weights = HashMap::from([("staff".to_string(), 2)]);
+        let mut queue = FairQueue::new(FairScheduler::new(weights));
+        for i in 0..100 {
+            queue.push("bulk", format!("bulk-{i}"));
+        }
+        queue.push("cs101", "cs101-0".to_string());
+        queue.push("cs101", "cs101-1".to_string());
+        for i in 0..4 {
+            queue.push("staff", format!("staff-{i}"));
+        }
+
+        // One flooding tenant doesn't hold up the others
+        assert_eq!(queue.position("cs101", |job| job == "cs101-1"), Some(6));
+        assert_eq!(queue.position("bulk", |job| job == "bulk-5"), Some(11));
+        assert_eq!(queue.position("cs101", |job| job == "missing"), None);
+
+        let order: Vec<String> = std::iter::from_fn(|| queue.pop()).take(10).collect();
+        assert_eq!(
+            order,
+            [
+                "staff-0", "bulk-0", "cs101-0", "staff-1", "staff-2", "bulk-1", "cs101-1",
+                "staff-3", "bulk-2", "bulk-3"
+            ]
+        );
+        assert_eq!(queue.len(), 96);
+        assert_eq!(queue.waiting(), BTreeMap::from([("bulk".to_string(), 96)]));
+    }
+
+    #[test]
+    fn test_idle_tenants_bank_no_credit() {
+        let mut scheduler = FairScheduler::default();
+        for _ in 0..10 {
+            assert_eq!(scheduler.next(["a"]), Some("a"));
+        }
+        // Having had the consumers to itself, "a" now shares them evenly
+        assert_eq!(scheduler.next(["a", "b"]), Some("a"));
+        assert_eq!(scheduler.next(["a", "b"]), Some("b"));
+        assert_eq!(scheduler.next(["a", "b"]), Some("a"));
+        assert_eq!(scheduler.next(Vec::<&str>::new()), None);
+    }
+}
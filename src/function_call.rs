@@ -0,0 +1,173 @@
+use serde::{Deserialize, Serialize};
+
+/// Workspace file the arguments are passed in, so they never have to be escaped
+/// into source code
+pub const ARGS_FILE: &str = ".isobox_args.json";
+
+// Starts the line the glue prints the return value on
+const RETURN_MARKER: &str = "__ISOBOX_RETURN__ ";
+
+/// Calls a function defined by the request's code instead of running it as a
+/// program. The glue that reads the arguments, calls the function and prints the
+/// return value is generated per language.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct FunctionCall {
+    pub name: String,
+    /// Positional arguments, decoded into the language's native values
+    #[serde(default)]
+    pub args: Vec<serde_json::Value>,
+}
+
+pub const LANGUAGES: &[&str] = &["node", "php", "python", "python2", "ruby"];
+
+impl FunctionCall {
+    pub fn validate(&self, language: &str) -> Result<(), String> {
+        if !LANGUAGES.contains(&language) {
+            return Err(format!(
+                "Function calls are not supported for {language}, only for {}",
+                LANGUAGES.join(", ")
+            ));
+        }
+        let mut chars = self.name.chars();
+        let valid = chars
+            .next()
+            .is_some_and(|c| c.is_ascii_alphabetic() || c == '_')
+            && chars.all(|c| c.is_ascii_alphanumeric() || c == '_');
+        if !valid {
+            return Err(format!("Invalid function name '{}'", self.name));
+        }
+        Ok(())
+    }
+
+    /// JSON content of the arguments file
+    pub fn args_json(&self) -> String {
+        serde_json::Value::Array(self.args.clone()).to_string()
+    }
+
+    /// Source that runs the call when appended to the code defining the function
+    pub fn glue(&self, language: &str, code: &str) -> String {
+        let name = &self.name;
+        match language {
+            "python" | "python2" => format!(
+                r#"
+
+import json as _isobox_json, sys as _isobox_sys
+with open("{ARGS_FILE}") as _isobox_file:
+    _isobox_args = _isobox_json.load(_isobox_file)
+_isobox_result = {name}(*_isobox_args)
+_isobox_sys.stdout.write("\n{RETURN_MARKER}" + _isobox_json.dumps(_isobox_result) + "\n")
+"#
+            ),
+            "node" => format!(
+                r#"
+;(() => {{
+  const args = JSON.parse(require("fs").readFileSync("{ARGS_FILE}", "utf8"));
+  Promise.resolve({name}(...args)).then(
+    (result) => process.stdout.write("\n{RETURN_MARKER}" + JSON.stringify(result === undefined ? null : result) + "\n"),
+    (error) => {{
+      console.error(error);
+      process.exitCode = 1;
+    }},
+  );
+}})();
+"#
+            ),
+            "ruby" => format!(
+                r#"
+
+require "json"
+__isobox_result = {name}(*JSON.parse(File.read("{ARGS_FILE}")))
+$stdout.write("\n{RETURN_MARKER}" + __isobox_result.to_json + "\n")
+"#
+            ),
+            "php" => {
+                // Code that ends by leaving PHP mode needs to enter it again
+                let open_tag = if code.trim_end().ends_with("?>") {
+                    "<?php"
+                } else {
+                    ""
+                };
+                format!(
+                    r#"
+{open_tag}
+$__isobox_result = {name}(...json_decode(file_get_contents("{ARGS_FILE}"), true));
+echo "\n{RETURN_MARKER}" . json_encode($__isobox_result) . "\n";
+"#
+                )
+            }
+            _ => String::new(),
+        }
+    }
+}
+
+/// Removes the line the glue printed from `stdout` and returns the value on it.
+/// Returns None when the function didn't return, e.g. because it raised an error.
+pub fn extract_return_value(stdout: &mut String) -> Option<serde_json::Value> {
+    let start = stdout.rfind(&format!("\n{RETURN_MARKER}"))?;
+    let line = stdout[start + 1 + RETURN_MARKER.len()..].lines().next()?;
+    let value = serde_json::from_str(line).ok()?;
+    stdout.truncate(start);
+    Some(value)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_validate() {
+        let call = FunctionCall {
+            name: "add_numbers".to_string(),
+            args: vec![1.into(), 2.into()],
+        };
+        assert!(call.validate("python").is_ok());
+        assert!(call.validate("rust").is_err());
+        assert_eq!(call.args_json(), "[1,2]");
+
+        for name in ["", "1add", "add()", "os.system"] {
+            let call = FunctionCall {
+                name: name.to_string(),
+                args: Vec::new(),
+            };
+            assert!(call.validate("python").is_err(), "{name}");
+        }
+    }
+
+    #[test]
+    fn test_glue() {
+        let call = FunctionCall {
+            name: "add".to_string(),
+            args: Vec::new(),
+        };
+        assert!(call
+            .glue("python", "def add(a, b): return a + b")
+            .contains("_isobox_result = add(*_isobox_args)"));
+        assert!(call.glue("node", "").contains("add(...args)"));
+        assert!(!call
+            .glue("php", "<?php function add($a, $b) { return $a + $b; }")
+            .contains("<?php"));
+        assert!(call
+            .glue("php", "<?php function add($a, $b) { return $a + $b; } ?>")
+            .contains("<?php"));
+    }
+
+    #[test]
+    fn test_extract_return_value() {
+        let mut stdout = format!("debug output\n\n{RETURN_MARKER}{{\"sum\": 3}}\n");
+        let value = extract_return_value(&mut stdout).unwrap();
+        assert_eq!(value, serde_json::json!({"sum": 3}));
+        assert_eq!(stdout, "debug output\n");
+
+        // Output without a trailing newline is kept as it was printed
+        let mut stdout = format!("partial\n{RETURN_MARKER}null\n");
+        assert_eq!(
+            extract_return_value(&mut stdout),
+            Some(serde_json::Value::Null)
+        );
+        assert_eq!(stdout, "partial");
+
+        let mut stdout = "Traceback (most recent call last):\n".to_string();
+        assert!(extract_return_value(&mut stdout).is_none());
+        assert_eq!(stdout, "Traceback (most recent call last):\n");
+    }
+}
@@ -0,0 +1,691 @@
+use crate::coldstart::ColdStartMetrics;
+use crate::executor::{
+    CodeExecutor, ExecuteRequest, ExecuteResponse, ExecutionError, WarmInstance,
+};
+use crate::function_call::FunctionCall;
+use crate::store::unix_timestamp;
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::sync::atomic::{AtomicU64, AtomicUsize, Ordering};
+use std::sync::{Arc, Mutex};
+use std::time::Instant;
+use thiserror::Error;
+
+#[derive(Debug, Error)]
+pub enum FunctionError {
+    #[error("No function named {0}")]
+    NotFound(String),
+    /// The function is running its maximum number of concurrent invocations
+    #[error("Function {0} already has {1} invocations in progress")]
+    Busy(String, usize),
+    #[error(transparent)]
+    Execution(#[from] ExecutionError),
+}
+
+/// How many instances a function keeps and how many invocations it runs at once
+#[derive(Debug, Clone, Copy, PartialEq, Serialize, Deserialize)]
+pub struct Scaling {
+    /// Instances kept running even without invocations. With 0 the function
+    /// scales to zero once its instances have been idle for `idle_seconds`.
+    pub min_instances: usize,
+    /// Idle instances kept for reuse. Instances beyond this are stopped as soon
+    /// as their invocation finishes.
+    pub max_instances: usize,
+    /// Invocations that may run at once; further ones are rejected. None means no
+    /// limit.
+    pub max_concurrency: Option<usize>,
+    /// Idle instances above the minimum are stopped after this long
+    pub idle_seconds: u64,
+}
+
+/// Changes to a function's scaling. Fields that are left out keep their value.
+#[derive(Debug, Clone, Copy, Default, Deserialize)]
+pub struct ScalingUpdate {
+    pub min_instances: Option<usize>,
+    pub max_instances: Option<usize>,
+    /// Null removes the limit
+    #[serde(default, deserialize_with = "deserialize_present")]
+    pub max_concurrency: Option<Option<usize>>,
+    pub idle_seconds: Option<u64>,
+}
+
+// Tells a field set to null apart from a missing one
+fn deserialize_present<'de, D, T>(deserializer: D) -> Result<Option<T>, D::Error>
+where
+    D: serde::Deserializer<'de>,
+    T: Deserialize<'de>,
+{
+    T::deserialize(deserializer).map(Some)
+}
+
+impl Scaling {
+    pub fn apply(mut self, update: ScalingUpdate) -> Result<Self, ExecutionError> {
+        if let Some(min_instances) = update.min_instances {
+            self.min_instances = min_instances;
+        }
+        if let Some(max_instances) = update.max_instances {
+            self.max_instances = max_instances;
+        }
+        if let Some(max_concurrency) = update.max_concurrency {
+            self.max_concurrency = max_concurrency;
+        }
+        if let Some(idle_seconds) = update.idle_seconds {
+            self.idle_seconds = idle_seconds;
+        }
+        self.validate()?;
+        Ok(self)
+    }
+
+    fn validate(&self) -> Result<(), ExecutionError> {
+        if self.min_instances > self.max_instances {
+            return Err(ExecutionError::InvalidRequest(format!(
+                "min_instances ({}) is larger than max_instances ({})",
+                self.min_instances, self.max_instances
+            )));
+        }
+        if self.max_concurrency == Some(0) {
+            return Err(ExecutionError::InvalidRequest(
+                "max_concurrency must be at least 1".to_string(),
+            ));
+        }
+        Ok(())
+    }
+}
+
+/// Code a tenant deployed under a name
+#[derive(Debug, Clone, Deserialize)]
+pub struct FunctionSpec {
+    pub language: String,
+    pub code: String,
+    pub version: Option<String>,
+    /// Function the code defines that invocations call with JSON arguments. Without
+    /// one, each invocation runs the code as a program with its input on stdin.
+    pub entry: Option<String>,
+    /// Applied to the function's current scaling, or the server defaults for a new
+    /// function
+    #[serde(default)]
+    pub scaling: ScalingUpdate,
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct FunctionDefinition {
+    pub name: String,
+    pub tenant: String,
+    pub language: String,
+    pub version: Option<String>,
+    pub entry: Option<String>,
+    pub code: String,
+    pub deployed_at: u64,
+    pub scaling: Scaling,
+}
+
+#[derive(Debug, Default, Deserialize)]
+pub struct Invocation {
+    /// Passed to the program on stdin
+    #[serde(default)]
+    pub input: String,
+    /// Arguments for the entry function
+    pub args: Option<Vec<serde_json::Value>>,
+}
+
+#[derive(Debug, Serialize)]
+pub struct InvocationResult {
+    #[serde(flatten)]
+    pub result: ExecuteResponse,
+    /// Whether the invocation had to start an instance because none was idle
+    pub cold_start: bool,
+}
+
+struct Deployment {
+    definition: FunctionDefinition,
+    // Changes with every deploy, so instances of replaced code aren't reused
+    generation: u64,
+    // Idle instances with the time they were last used, most recently used last
+    idle: Vec<(WarmInstance, u64)>,
+    // Invocations in progress. Shared with their guards and kept across deploys, so
+    // invocations of replaced code still count towards the limit.
+    running: Arc<AtomicUsize>,
+}
+
+impl Deployment {
+    // Instances that are running, busy or idle
+    fn instances(&self) -> usize {
+        self.idle.len() + self.running.load(Ordering::Relaxed)
+    }
+}
+
+// Counts an invocation as running until it is dropped
+struct RunningGuard(Arc<AtomicUsize>);
+
+impl Drop for RunningGuard {
+    fn drop(&mut self) {
+        self.0.fetch_sub(1, Ordering::Relaxed);
+    }
+}
+
+/// Deployed functions and their warm instances. Functions live in memory, so they
+/// have to be deployed again after a restart.
+pub struct FunctionRegistry {
+    executor: Arc<CodeExecutor>,
+    // Scaling of functions deployed without settings of their own
+    default_scaling: Scaling,
+    generations: AtomicU64,
+    deployments: Mutex<HashMap<(String, String), Deployment>>,
+    metrics: ColdStartMetrics,
+}
+
+impl FunctionRegistry {
+    pub fn new(executor: Arc<CodeExecutor>, default_scaling: Scaling) -> Self {
+        Self {
+            executor,
+            default_scaling,
+            generations: AtomicU64::new(0),
+            deployments: Mutex::new(HashMap::new()),
+            metrics: ColdStartMetrics::new(),
+        }
+    }
+
+    pub fn from_env(executor: Arc<CodeExecutor>) -> Self {
+        let warm_instances = std::env::var("FUNCTION_WARM_INSTANCES")
+            .ok()
+            .and_then(|s| s.parse::<usize>().ok())
+            .unwrap_or(2);
+        let idle_seconds = std::env::var("FUNCTION_IDLE_SECONDS")
+            .ok()
+            .and_then(|s| s.parse::<u64>().ok())
+            .unwrap_or(600);
+        let default_scaling = Scaling {
+            min_instances: 0,
+            max_instances: warm_instances,
+            max_concurrency: None,
+            idle_seconds,
+        };
+        Self::new(executor, default_scaling)
+    }
+
+    /// Deploys code under `name`, replacing what was deployed there before. The
+    /// first instance is started right away, so code that doesn't compile is
+    /// rejected here rather than on the first invocation. Scaling settings the spec
+    /// leaves out are kept from the previous deploy.
+    pub async fn deploy(
+        &self,
+        tenant: &str,
+        name: &str,
+        spec: FunctionSpec,
+    ) -> Result<FunctionDefinition, ExecutionError> {
+        if !is_valid_function_name(name) {
+            return Err(ExecutionError::InvalidRequest(format!(
+                "Invalid function name '{name}'"
+            )));
+        }
+        let scaling = self
+            .get(tenant, name)
+            .map_or(self.default_scaling, |current| current.scaling)
+            .apply(spec.scaling)?;
+        let definition = FunctionDefinition {
+            name: name.to_string(),
+            tenant: tenant.to_string(),
+            language: spec.language,
+            version: spec.version,
+            entry: spec.entry,
+            code: spec.code,
+            deployed_at: unix_timestamp(),
+            scaling,
+        };
+        let instance = self
+            .executor
+            .start_instance(instance_request(&definition))
+            .await?;
+
+        let generation = self.generations.fetch_add(1, Ordering::Relaxed);
+        let replaced = {
+            let mut deployments = self.deployments.lock().unwrap();
+            let running = deployments
+                .get(&key(tenant, name))
+                .map_or_else(Default::default, |current| current.running.clone());
+            deployments.insert(
+                key(tenant, name),
+                Deployment {
+                    definition: definition.clone(),
+                    generation,
+                    idle: vec![(instance, unix_timestamp())],
+                    running,
+                },
+            )
+        };
+        if let Some(replaced) = replaced {
+            self.stop_all(replaced.idle).await;
+        }
+        self.fill(tenant, name).await;
+        Ok(definition)
+    }
+
+    /// Changes a function's scaling, stopping idle instances above a lowered
+    /// maximum and starting instances up to a raised minimum
+    pub async fn update_scaling(
+        &self,
+        tenant: &str,
+        name: &str,
+        update: ScalingUpdate,
+    ) -> Result<FunctionDefinition, FunctionError> {
+        let (definition, surplus) = {
+            let mut deployments = self.deployments.lock().unwrap();
+            let deployment = deployments
+                .get_mut(&key(tenant, name))
+                .ok_or_else(|| FunctionError::NotFound(name.to_string()))?;
+            let scaling = deployment.definition.scaling.apply(update)?;
+            deployment.definition.scaling = scaling;
+            // The least recently used instances go first
+            let surplus_count = deployment.idle.len().saturating_sub(scaling.max_instances);
+            let surplus: Vec<(WarmInstance, u64)> =
+                deployment.idle.drain(..surplus_count).collect();
+            (deployment.definition.clone(), surplus)
+        };
+        self.stop_all(surplus).await;
+        self.fill(tenant, name).await;
+        Ok(definition)
+    }
+
+    /// Runs an invocation on an idle instance, starting one if none is idle
+    pub async fn invoke(
+        &self,
+        tenant: &str,
+        name: &str,
+        invocation: Invocation,
+    ) -> Result<InvocationResult, FunctionError> {
+        let (definition, generation, idle, _running) = {
+            let mut deployments = self.deployments.lock().unwrap();
+            let deployment = deployments
+                .get_mut(&key(tenant, name))
+                .ok_or_else(|| FunctionError::NotFound(name.to_string()))?;
+            // Invocations are only admitted under the lock, so checking and counting
+            // them can't race
+            let running = deployment.running.load(Ordering::Relaxed);
+            if let Some(max) = deployment
+                .definition
+                .scaling
+                .max_concurrency
+                .filter(|max| running >= *max)
+            {
+                return Err(FunctionError::Busy(name.to_string(), max));
+            }
+            deployment.running.fetch_add(1, Ordering::Relaxed);
+            let guard = RunningGuard(deployment.running.clone());
+            let idle = deployment.idle.pop().map(|(instance, _)| instance);
+            (
+                deployment.definition.clone(),
+                deployment.generation,
+                idle,
+                guard,
+            )
+        };
+        Ok(self
+            .invoke_deployment(&definition, generation, idle, invocation)
+            .await?)
+    }
+
+    async fn invoke_deployment(
+        &self,
+        definition: &FunctionDefinition,
+        generation: u64,
+        idle: Option<WarmInstance>,
+        invocation: Invocation,
+    ) -> Result<InvocationResult, ExecutionError> {
+        let args = match (&definition.entry, invocation.args) {
+            (Some(_), args) => Some(args.unwrap_or_default()),
+            (None, Some(_)) => {
+                return Err(ExecutionError::InvalidRequest(format!(
+                    "Function {} has no entry to call with args",
+                    definition.name
+                )))
+            }
+            (None, None) => None,
+        };
+        let started = Instant::now();
+        let cold_start = idle.is_none();
+        let instance = match idle {
+            Some(instance) => instance,
+            None => {
+                self.executor
+                    .start_instance(instance_request(definition))
+                    .await?
+            }
+        };
+
+        let result = self
+            .executor
+            .invoke_instance(&instance, &invocation.input, args.as_deref())
+            .await;
+        match result {
+            Ok(_) => {
+                // Measured before the instance goes back to the pool, so the latency
+                // is what the caller waited for
+                self.metrics.observe(
+                    &definition.tenant,
+                    &definition.name,
+                    &definition.language,
+                    cold_start,
+                    started.elapsed(),
+                );
+                self.release(definition, generation, instance).await
+            }
+            Err(_) => self.executor.stop_instance(instance).await,
+        }
+        result.map(|result| InvocationResult { result, cold_start })
+    }
+
+    // Returns an instance to its function's pool, or stops it if the pool is full
+    // or the function was redeployed or deleted in the meantime
+    async fn release(
+        &self,
+        definition: &FunctionDefinition,
+        generation: u64,
+        instance: WarmInstance,
+    ) {
+        let rejected = {
+            let mut deployments = self.deployments.lock().unwrap();
+            match deployments.get_mut(&key(&definition.tenant, &definition.name)) {
+                Some(deployment)
+                    if deployment.generation == generation
+                        && deployment.idle.len() < deployment.definition.scaling.max_instances =>
+                {
+                    deployment.idle.push((instance, unix_timestamp()));
+                    None
+                }
+                _ => Some(instance),
+            }
+        };
+        if let Some(instance) = rejected {
+            self.executor.stop_instance(instance).await;
+        }
+    }
+
+    pub fn metrics(&self) -> &ColdStartMetrics {
+        &self.metrics
+    }
+
+    pub fn get(&self, tenant: &str, name: &str) -> Option<FunctionDefinition> {
+        self.deployments
+            .lock()
+            .unwrap()
+            .get(&key(tenant, name))
+            .map(|deployment| deployment.definition.clone())
+    }
+
+    /// The tenant's functions, sorted by name
+    pub fn list(&self, tenant: &str) -> Vec<FunctionDefinition> {
+        let mut functions: Vec<FunctionDefinition> = self
+            .deployments
+            .lock()
+            .unwrap()
+            .values()
+            .filter(|deployment| deployment.definition.tenant == tenant)
+            .map(|deployment| deployment.definition.clone())
+            .collect();
+        functions.sort_by(|a, b| a.name.cmp(&b.name));
+        functions
+    }
+
+    pub async fn remove(&self, tenant: &str, name: &str) -> bool {
+        let removed = self.deployments.lock().unwrap().remove(&key(tenant, name));
+        self.metrics.remove_function(tenant, name);
+        match removed {
+            Some(deployment) => {
+                self.stop_all(deployment.idle).await;
+                true
+            }
+            None => false,
+        }
+    }
+
+    /// Removes all of a tenant's functions, returning how many there were
+    pub async fn remove_tenant(&self, tenant: &str) -> usize {
+        let removed: Vec<Deployment> = {
+            let mut deployments = self.deployments.lock().unwrap();
+            let keys: Vec<(String, String)> = deployments
+                .keys()
+                .filter(|(owner, _)| owner == tenant)
+                .cloned()
+                .collect();
+            keys.iter()
+                .filter_map(|key| deployments.remove(key))
+                .collect()
+        };
+        self.metrics.remove_tenant(tenant);
+        let count = removed.len();
+        for deployment in removed {
+            self.stop_all(deployment.idle).await;
+        }
+        count
+    }
+
+    /// Stops instances that have been idle longer than their function's idle
+    /// timeout, down to its minimum, and starts instances for functions below their
+    /// minimum. Functions scaled to zero start an instance on their next invocation.
+    pub async fn scale(&self, now: u64) {
+        let (expired, below_minimum) = {
+            let mut deployments = self.deployments.lock().unwrap();
+            let mut expired = Vec::new();
+            let mut below_minimum = Vec::new();
+            for deployment in deployments.values_mut() {
+                expired.extend(reap(deployment, now));
+                if deployment.instances() < deployment.definition.scaling.min_instances {
+                    below_minimum.push(key(
+                        &deployment.definition.tenant,
+                        &deployment.definition.name,
+                    ));
+                }
+            }
+            (expired, below_minimum)
+        };
+        self.stop_all(expired).await;
+        for (tenant, name) in below_minimum {
+            self.fill(&tenant, &name).await;
+        }
+    }
+
+    // Starts instances until the function has its minimum number
+    async fn fill(&self, tenant: &str, name: &str) {
+        let (definition, generation, missing) = {
+            let deployments = self.deployments.lock().unwrap();
+            let Some(deployment) = deployments.get(&key(tenant, name)) else {
+                return;
+            };
+            let missing = deployment
+                .definition
+                .scaling
+                .min_instances
+                .saturating_sub(deployment.instances());
+            (
+                deployment.definition.clone(),
+                deployment.generation,
+                missing,
+            )
+        };
+        for _ in 0..missing {
+            match self
+                .executor
+                .start_instance(instance_request(&definition))
+                .await
+            {
+                Ok(instance) => self.release(&definition, generation, instance).await,
+                Err(e) => {
+                    log::warn!("Failed to start an instance of function {name}: {e}");
+                    return;
+                }
+            }
+        }
+    }
+
+    /// Stops every idle instance, e.g. when the server shuts down
+    pub async fn shutdown(&self) {
+        let instances: Vec<(WarmInstance, u64)> = self
+            .deployments
+            .lock()
+            .unwrap()
+            .values_mut()
+            .flat_map(|deployment| std::mem::take(&mut deployment.idle))
+            .collect();
+        self.stop_all(instances).await;
+    }
+
+    async fn stop_all(&self, instances: Vec<(WarmInstance, u64)>) {
+        for (instance, _) in instances {
+            self.executor.stop_instance(instance).await;
+        }
+    }
+}
+
+// Takes the instances that have been idle too long off a deployment, keeping enough
+// for its minimum
+fn reap(deployment: &mut Deployment, now: u64) -> Vec<(WarmInstance, u64)> {
+    let scaling = deployment.definition.scaling;
+    let (mut expired, mut idle): (Vec<_>, Vec<_>) = std::mem::take(&mut deployment.idle)
+        .into_iter()
+        .partition(|(_, since)| now.saturating_sub(*since) >= scaling.idle_seconds);
+    let running = deployment.running.load(Ordering::Relaxed);
+    while idle.len() + running < scaling.min_instances {
+        // Expired instances are older than the rest, so they go back at the front
+        match expired.pop() {
+            Some(instance) => idle.insert(0, instance),
+            None => break,
+        }
+    }
+    deployment.idle = idle;
+    expired
+}
+
+fn key(tenant: &str, name: &str) -> (String, String) {
+    (tenant.to_string(), name.to_string())
+}
+
+// Names appear in URLs and container names
+fn is_valid_function_name(name: &str) -> bool {
+    !name.is_empty()
+        && name.len() <= 64
+        && name
+            .chars()
+            .all(|c| c.is_ascii_alphanumeric() || c == '-' || c == '_')
+}
+
+fn instance_request(definition: &FunctionDefinition) -> ExecuteRequest {
+    ExecuteRequest {
+        language: definition.language.clone(),
+        code: definition.code.clone(),
+        version: definition.version.clone(),
+        function: definition.entry.as_ref().map(|entry| FunctionCall {
+            name: entry.clone(),
+            args: Vec::new(),
+        }),
+        tenant: Some(definition.tenant.clone()),
+        ..Default::default()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const SCALING: Scaling = Scaling {
+        min_instances: 0,
+        max_instances: 2,
+        max_concurrency: None,
+        idle_seconds: 600,
+    };
+
+    fn definition() -> FunctionDefinition {
+        FunctionDefinition {
+            name: "add".to_string(),
+            tenant: "cs101".to_string(),
+            language: "python".to_string(),
+            version: None,
+            entry: Some("add".to_string()),
+            code: "def add(a, b):\n    return a + b\n".to_string(),
+            deployed_at: 0,
+            scaling: SCALING,
+        }
+    }
+
+    #[test]
+    fn test_function_names() {
+        assert!(is_valid_function_name("word-count_v2"));
+        for name in ["", "../etc", "a b", "a/b", &"x".repeat(65)] {
+            assert!(!is_valid_function_name(name), "{name}");
+        }
+    }
+
+    #[test]
+    fn test_instance_request() {
+        let request = instance_request(&definition());
+        assert_eq!(request.tenant.as_deref(), Some("cs101"));
+        assert_eq!(request.function.unwrap().name, "add");
+    }
+
+    #[tokio::test]
+    async fn test_unknown_function() {
+        let registry = FunctionRegistry::new(Arc::new(CodeExecutor::new()), SCALING);
+        assert!(matches!(
+            registry
+                .invoke("cs101", "missing", Invocation::default())
+                .await,
+            Err(FunctionError::NotFound(_))
+        ));
+        assert!(registry.list("cs101").is_empty());
+        assert!(!registry.remove("cs101", "missing").await);
+
+        let invalid = FunctionSpec {
+            language: "python".to_string(),
+            code: "print(1)".to_string(),
+            version: None,
+            entry: None,
+            scaling: ScalingUpdate::default(),
+        };
+        assert!(matches!(
+            registry.deploy("cs101", "../x", invalid).await,
+            Err(ExecutionError::InvalidRequest(_))
+        ));
+    }
+
+    #[test]
+    fn test_scaling_update() {
+        let update: ScalingUpdate =
+            serde_json::from_str(r#"{"min_instances": 1, "max_concurrency": 4}"#).unwrap();
+        let scaling = SCALING.apply(update).unwrap();
+        assert_eq!(scaling.min_instances, 1);
+        assert_eq!(scaling.max_instances, 2);
+        assert_eq!(scaling.max_concurrency, Some(4));
+
+        // Null removes the limit, while a missing field keeps it
+        let update: ScalingUpdate = serde_json::from_str(r#"{"idle_seconds": 0}"#).unwrap();
+        assert_eq!(scaling.apply(update).unwrap().max_concurrency, Some(4));
+        let update: ScalingUpdate = serde_json::from_str(r#"{"max_concurrency": null}"#).unwrap();
+        assert_eq!(scaling.apply(update).unwrap().max_concurrency, None);
+
+        for invalid in [r#"{"min_instances": 3}"#, r#"{"max_concurrency": 0}"#] {
+            let update: ScalingUpdate = serde_json::from_str(invalid).unwrap();
+            assert!(SCALING.apply(update).is_err(), "{invalid}");
+        }
+    }
+
+    #[tokio::test]
+    async fn test_concurrency_limit() {
+        let registry = FunctionRegistry::new(Arc::new(CodeExecutor::new()), SCALING);
+        let mut definition = definition();
+        definition.scaling.max_concurrency = Some(1);
+        let running = Arc::new(AtomicUsize::new(1));
+        registry.deployments.lock().unwrap().insert(
+            key("cs101", "add"),
+            Deployment {
+                definition,
+                generation: 0,
+                idle: Vec::new(),
+                running: running.clone(),
+            },
+        );
+
+        let result = registry.invoke("cs101", "add", Invocation::default()).await;
+        assert!(matches!(result, Err(FunctionError::Busy(_, 1))));
+        // Rejected invocations don't count as running
+        assert_eq!(running.load(Ordering::Relaxed), 1);
+    }
+}
@@ -1,26 +1,90 @@
+use crate::abuse::Restriction;
+use crate::config::DEFAULT_TENANT;
+use crate::deadline;
 use crate::executor::{CodeExecutor, ExecuteRequest};
 use crate::generated::isobox::code_execution_service_server::CodeExecutionService as CodeExecutionServiceTrait;
+use crate::generated::isobox::worker_service_server::WorkerService as WorkerServiceTrait;
 use crate::generated::isobox::{
-    ExecuteCodeRequest, ExecuteCodeResponse, ExecutionStatus, GetSupportedLanguagesRequest,
-    GetSupportedLanguagesResponse, HealthCheckRequest, HealthCheckResponse, LanguageInfo,
+    agent_message, coordinator_message, AgentMessage, CoordinatorMessage, ExecuteCodeRequest,
+    ExecuteCodeResponse, ExecutionStatus, GetSupportedLanguagesRequest,
+    GetSupportedLanguagesResponse, HealthCheckRequest, HealthCheckResponse, Job, LanguageInfo,
+    StopJob,
 };
+use crate::ratelimit::RateLimiter;
+use crate::trace_context::{self, TraceContext};
+use crate::worker::{JobFailure, WorkerCommand, WorkerRegistry};
+use futures::{Stream, StreamExt};
+use std::pin::Pin;
 use std::sync::Arc;
-use std::time::Instant;
-use tonic::{Request, Response, Status};
+use std::time::{Instant, SystemTime};
+use tokio::sync::mpsc;
+use tokio_stream::wrappers::UnboundedReceiverStream;
+use tonic::{Request, Response, Status, Streaming};
+
+// ExecuteCode takes its tokens from the bucket of the HTTP execute route, so a
+// tenant's execute limit holds whichever API it calls
+const EXECUTE_ROUTE: &str = "/v1/execute";
 
 #[derive(Clone)]
 pub struct CodeExecutionServiceImpl {
     executor: Arc<CodeExecutor>,
+    // Shared with the HTTP API, so a tenant's buckets cover both
+    limiter: Arc<RateLimiter>,
     start_time: Instant,
 }
 
 impl CodeExecutionServiceImpl {
-    pub fn new(executor: Arc<CodeExecutor>, _auth_service: Option<Arc<()>>) -> Self {
+    pub fn new(
+        executor: Arc<CodeExecutor>,
+        limiter: Arc<RateLimiter>,
+        _auth_service: Option<Arc<()>>,
+    ) -> Self {
         Self {
             executor,
+            limiter,
             start_time: Instant::now(),
         }
     }
+
+    // Refuses banned tenants and holds throttled ones to the abuse throttle rate,
+    // as the HTTP API does
+    fn check_abuse_restriction(&self, tenant: &str) -> Result<(), Status> {
+        match self.executor.abuse().restriction(tenant) {
+            None => Ok(()),
+            Some(Restriction::Ban) => Err(Status::permission_denied(format!(
+                "Tenant '{tenant}' is suspended for abuse"
+            ))),
+            Some(Restriction::Throttle) => {
+                let limit = self.executor.abuse().throttle();
+                self.limiter
+                    .check(&format!("{tenant}|abuse"), limit)
+                    .map_err(|retry_after| {
+                        Status::resource_exhausted(format!(
+                            "Tenant '{tenant}' is throttled for abuse to {} requests per second, retry in {:.1}s",
+                            limit.rate,
+                            retry_after.as_secs_f64()
+                        ))
+                    })
+            }
+        }
+    }
+
+    // Takes a token from the tenant's bucket for `route`, if it has a limit
+    fn check_rate_limit(&self, tenant: &str, route: &str) -> Result<(), Status> {
+        let Some((scope, limit)) = self.executor.config().rate_limit(tenant, route) else {
+            return Ok(());
+        };
+        self.limiter
+            .check(&format!("{tenant}|{scope}"), limit)
+            .map_err(|retry_after| {
+                Status::resource_exhausted(format!(
+                    "Limit of {} requests per second (burst {}) exceeded, retry in {:.1}s",
+                    limit.rate,
+                    limit.burst,
+                    retry_after.as_secs_f64()
+                ))
+            })
+    }
 }
 
 #[tonic::async_trait]
@@ -44,9 +108,37 @@ impl CodeExecutionServiceTrait for CodeExecutionServiceImpl {
             .map(|s| s.trim())
             .collect::<Vec<_>>();
 
-        if !valid_keys.contains(&provided_key) {
+        let tenant = self
+            .executor
+            .config()
+            .tenant_for_api_key(provided_key)
+            .map(|tenant| tenant.to_string());
+        if tenant.is_none() && !valid_keys.contains(&provided_key) {
             return Err(Status::unauthenticated("Invalid API Key"));
         }
+        let tenant = tenant.unwrap_or_else(|| DEFAULT_TENANT.to_string());
+        self.check_abuse_restriction(&tenant)?;
+        self.check_rate_limit(&tenant, EXECUTE_ROUTE)?;
+
+        // The client's deadline arrives as the time it is willing to wait
+        let deadline = metadata
+            .get("grpc-timeout")
+            .and_then(|value| value.to_str().ok())
+            .and_then(deadline::parse_grpc_timeout)
+            .and_then(|timeout| SystemTime::now().checked_add(timeout));
+        let trace_context = metadata
+            .get(trace_context::TRACEPARENT)
+            .and_then(|value| value.to_str().ok())
+            .and_then(|traceparent| {
+                let tracestate = metadata
+                    .get(trace_context::TRACESTATE)
+                    .and_then(|value| value.to_str().ok());
+                TraceContext::parse(traceparent, tracestate)
+            });
+        let trace_id = trace_context
+            .as_ref()
+            .map(|context| context.trace_id().to_string())
+            .unwrap_or_default();
 
         let req = request.into_inner();
         log::info!("gRPC: Executing code in language: {}", req.language);
@@ -56,6 +148,10 @@ impl CodeExecutionServiceTrait for CodeExecutionServiceImpl {
             language: req.language,
             code: req.code,
             test_cases: None, // gRPC doesn't support test cases yet
+            tenant: Some(tenant),
+            deadline,
+            trace_context,
+            ..Default::default()
         };
 
         // Execute the code
@@ -73,10 +169,19 @@ impl CodeExecutionServiceTrait for CodeExecutionServiceImpl {
                         ExecutionStatus::RuntimeError as i32
                     },
                     error_message: String::new(),
+                    term_signal: response.term_signal.unwrap_or_default(),
+                    term_reason: response.term_reason.unwrap_or_default(),
+                    trace_id,
                 };
 
                 Ok(Response::new(proto_response))
             }
+            Err(crate::executor::ExecutionError::DeadlineExceeded) => Err(
+                Status::deadline_exceeded("The deadline passed before the execution started"),
+            ),
+            Err(e @ crate::executor::ExecutionError::CodeTooLarge(..)) => {
+                Err(Status::resource_exhausted(e.to_string()))
+            }
             Err(e) => {
                 let status = match e {
                     crate::executor::ExecutionError::UnsupportedLanguage(_) => {
@@ -94,6 +199,9 @@ impl CodeExecutionServiceTrait for CodeExecutionServiceImpl {
                     memory_used: 0,
                     status,
                     error_message: e.to_string(),
+                    term_signal: String::new(),
+                    term_reason: String::new(),
+                    trace_id,
                 };
 
                 Ok(Response::new(proto_response))
@@ -199,3 +307,92 @@ impl CodeExecutionServiceTrait for CodeExecutionServiceImpl {
         Ok(Response::new(response))
     }
 }
+
+// Coordinator side of the agent protocol. Agents connect out to it, so workers
+// behind NAT need no inbound ports; the listener requires client certificates.
+#[derive(Clone)]
+pub struct WorkerServiceImpl {
+    registry: Arc<WorkerRegistry>,
+}
+
+impl WorkerServiceImpl {
+    pub fn new(registry: Arc<WorkerRegistry>) -> Self {
+        Self { registry }
+    }
+}
+
+#[tonic::async_trait]
+impl WorkerServiceTrait for WorkerServiceImpl {
+    type ConnectStream = Pin<Box<dyn Stream<Item = Result<CoordinatorMessage, Status>> + Send>>;
+
+    async fn connect(
+        &self,
+        request: Request<Streaming<AgentMessage>>,
+    ) -> Result<Response<Self::ConnectStream>, Status> {
+        let mut inbound = request.into_inner();
+        let register = match inbound.message().await? {
+            Some(AgentMessage {
+                message: Some(agent_message::Message::Register(register)),
+            }) => register,
+            _ => {
+                return Err(Status::invalid_argument(
+                    "The first message must register the agent",
+                ))
+            }
+        };
+
+        let (commands_tx, commands_rx) = mpsc::unbounded_channel();
+        let worker_id = self.registry.register(
+            &register.name,
+            register.languages,
+            register.capacity as usize,
+            &register.arch,
+            register.gpu,
+            register
+                .language_limits
+                .into_iter()
+                .map(|(language, limit)| (language, limit as usize))
+                .collect(),
+            commands_tx,
+        );
+
+        // Deliver results until the agent goes away, then fail its in-flight jobs
+        let registry = self.registry.clone();
+        tokio::spawn(async move {
+            while let Ok(Some(message)) = inbound.message().await {
+                if let Some(agent_message::Message::Result(result)) = message.message {
+                    let outcome = if result.error.is_empty() {
+                        serde_json::from_str(&result.response_json)
+                            .map_err(|e| JobFailure::Failed(e.to_string()))
+                    } else {
+                        Err(JobFailure::Failed(result.error))
+                    };
+                    registry.complete(&worker_id, &result.job_id, outcome);
+                }
+            }
+            registry.unregister(&worker_id);
+        });
+
+        let outbound = UnboundedReceiverStream::new(commands_rx).map(|command| {
+            let message = match command {
+                WorkerCommand::Run(job) => coordinator_message::Message::Job(Job {
+                    job_id: job.job_id,
+                    tenant: job.tenant,
+                    request_json: job.request_json,
+                    // At least 1, so a deadline that just passed isn't read as none
+                    timeout_ms: job.deadline.map_or(0, |deadline| {
+                        deadline::remaining(deadline)
+                            .map_or(1, |left| left.as_millis().max(1) as u64)
+                    }),
+                }),
+                WorkerCommand::Stop(job_id) => {
+                    coordinator_message::Message::Stop(StopJob { job_id })
+                }
+            };
+            Ok(CoordinatorMessage {
+                message: Some(message),
+            })
+        });
+        Ok(Response::new(Box::pin(outbound)))
+    }
+}
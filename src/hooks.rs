@@ -0,0 +1,315 @@
+use crate::config::{HookConfig, IsoboxConfig};
+use crate::executor::{ExecuteRequest, ExecuteResponse};
+use crate::store::unix_timestamp;
+use crate::webhook::{sign, SIGNATURE_HEADER, TIMESTAMP_HEADER};
+use serde::{Deserialize, Serialize};
+use std::sync::Arc;
+use std::time::Duration;
+use thiserror::Error;
+
+#[derive(Debug, Clone, Copy, PartialEq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum HookPhase {
+    Before,
+    After,
+}
+
+#[derive(Debug, Error)]
+pub enum HookError {
+    /// The hook vetoed the execution
+    #[error("{0}")]
+    Rejected(String),
+    /// The hook could not be run
+    #[error("{0}")]
+    Failed(String),
+}
+
+/// Extension point for organization-specific policy. Hooks run around every
+/// execution and may rewrite or veto the request and rewrite the result.
+#[async_trait::async_trait]
+pub trait ExecutionHook: Send + Sync {
+    fn name(&self) -> &str;
+
+    /// Called before the request runs. Returning `HookError::Rejected` vetoes it.
+    async fn before(&self, _request: &mut ExecuteRequest) -> Result<(), HookError> {
+        Ok(())
+    }
+
+    /// Called with the result of an execution that ran
+    async fn after(
+        &self,
+        _request: &ExecuteRequest,
+        _response: &mut ExecuteResponse,
+    ) -> Result<(), HookError> {
+        Ok(())
+    }
+}
+
+/// Hooks in the order they run
+#[derive(Clone, Default)]
+pub struct HookChain {
+    hooks: Vec<Arc<dyn ExecutionHook>>,
+}
+
+impl HookChain {
+    /// Chain of the HTTP hooks in the server configuration
+    pub fn from_config(config: &IsoboxConfig) -> Self {
+        let mut chain = Self::default();
+        for hook in &config.hooks {
+            match HttpHook::new(hook.clone()) {
+                Ok(hook) => chain.push(Arc::new(hook)),
+                Err(e) => log::error!("Failed to set up hook {}: {e}", hook.url),
+            }
+        }
+        chain
+    }
+
+    pub fn push(&mut self, hook: Arc<dyn ExecutionHook>) {
+        self.hooks.push(hook);
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.hooks.is_empty()
+    }
+
+    pub async fn before(&self, request: &mut ExecuteRequest) -> Result<(), HookError> {
+        let tenant = request.tenant.clone();
+        for hook in &self.hooks {
+            hook.before(request).await?;
+            // The tenant comes from authentication, so hooks can't move a request
+            // to another tenant's quota and policy
+            request.tenant = tenant.clone();
+        }
+        Ok(())
+    }
+
+    pub async fn after(
+        &self,
+        request: &ExecuteRequest,
+        response: &mut ExecuteResponse,
+    ) -> Result<(), HookError> {
+        for hook in &self.hooks {
+            hook.after(request, response).await?;
+        }
+        Ok(())
+    }
+}
+
+/// Body of a call to an HTTP hook
+#[derive(Serialize)]
+struct HookCall<'a> {
+    phase: HookPhase,
+    request: &'a ExecuteRequest,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    result: Option<&'a ExecuteResponse>,
+}
+
+/// What an HTTP hook answers with. Every field is optional, so an empty body lets
+/// the execution go ahead unchanged.
+#[derive(Debug, Deserialize)]
+struct HookReply {
+    #[serde(default = "default_allow")]
+    allow: bool,
+    reason: Option<String>,
+    /// Replaces the request
+    request: Option<ExecuteRequest>,
+    /// Replaces the result
+    result: Option<ExecuteResponse>,
+}
+
+fn default_allow() -> bool {
+    true
+}
+
+impl HookReply {
+    fn parse(body: &str) -> Result<Self, serde_json::Error> {
+        let body = if body.trim().is_empty() { "{}" } else { body };
+        serde_json::from_str(body)
+    }
+}
+
+/// Calls an HTTP endpoint from the server configuration
+pub struct HttpHook {
+    client: reqwest::Client,
+    config: HookConfig,
+}
+
+impl HttpHook {
+    pub fn new(config: HookConfig) -> Result<Self, reqwest::Error> {
+        let client = reqwest::Client::builder()
+            .timeout(Duration::from_millis(config.timeout_ms))
+            .build()?;
+        Ok(Self { client, config })
+    }
+
+    // Returns None when the hook failed and is configured to fail open
+    async fn call(&self, call: &HookCall<'_>) -> Result<Option<HookReply>, HookError> {
+        match self.send(call).await {
+            Ok(reply) => Ok(Some(reply)),
+            Err(e) if self.config.fail_open => {
+                log::warn!("Ignoring failed hook: {e}");
+                Ok(None)
+            }
+            Err(e) => Err(HookError::Failed(e)),
+        }
+    }
+
+    async fn send(&self, call: &HookCall<'_>) -> Result<HookReply, String> {
+        let url = &self.config.url;
+        let body = serde_json::to_string(call).map_err(|e| format!("{url}: {e}"))?;
+        let mut builder = self
+            .client
+            .post(url)
+            .header("Content-Type", "application/json");
+        if let Some(secret) = &self.config.secret {
+            let timestamp = unix_timestamp();
+            builder = builder
+                .header(TIMESTAMP_HEADER, timestamp.to_string())
+                .header(SIGNATURE_HEADER, sign(secret, timestamp, &body));
+        }
+        let response = builder
+            .body(body)
+            .send()
+            .await
+            .map_err(|e| format!("{url}: {e}"))?;
+        let status = response.status();
+        if !status.is_success() {
+            return Err(format!("{url} answered with {status}"));
+        }
+        let body = response.text().await.map_err(|e| format!("{url}: {e}"))?;
+        HookReply::parse(&body).map_err(|e| format!("{url} sent an invalid reply: {e}"))
+    }
+}
+
+#[async_trait::async_trait]
+impl ExecutionHook for HttpHook {
+    fn name(&self) -> &str {
+        &self.config.url
+    }
+
+    async fn before(&self, request: &mut ExecuteRequest) -> Result<(), HookError> {
+        if !self.config.applies_to(HookPhase::Before) {
+            return Ok(());
+        }
+        let call = HookCall {
+            phase: HookPhase::Before,
+            request: &*request,
+            result: None,
+        };
+        let Some(reply) = self.call(&call).await? else {
+            return Ok(());
+        };
+        if !reply.allow {
+            return Err(HookError::Rejected(
+                reply
+                    .reason
+                    .unwrap_or_else(|| format!("vetoed by hook {}", self.name())),
+            ));
+        }
+        if let Some(replacement) = reply.request {
+            *request = replacement;
+        }
+        Ok(())
+    }
+
+    async fn after(
+        &self,
+        request: &ExecuteRequest,
+        response: &mut ExecuteResponse,
+    ) -> Result<(), HookError> {
+        if !self.config.applies_to(HookPhase::After) {
+            return Ok(());
+        }
+        let call = HookCall {
+            phase: HookPhase::After,
+            request,
+            result: Some(&*response),
+        };
+        if let Some(HookReply {
+            result: Some(replacement),
+            ..
+        }) = self.call(&call).await?
+        {
+            *response = replacement;
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    struct Policy;
+
+    #[async_trait::async_trait]
+    impl ExecutionHook for Policy {
+        fn name(&self) -> &str {
+            "policy"
+        }
+
+        async fn before(&self, request: &mut ExecuteRequest) -> Result<(), HookError> {
+            if request.code.contains("import socket") {
+                return Err(HookError::Rejected("sockets are not allowed".to_string()));
+            }
+            request.tenant = Some("admin".to_string());
+            request.code = format!("# checked\n{}", request.code);
+            Ok(())
+        }
+
+        async fn after(
+            &self,
+            _request: &ExecuteRequest,
+            response: &mut ExecuteResponse,
+        ) -> Result<(), HookError> {
+            response.stdout = response.stdout.to_uppercase();
+            Ok(())
+        }
+    }
+
+    #[tokio::test]
+    async fn test_hook_chain() {
+        let mut chain = HookChain::default();
+        chain.push(Arc::new(Policy));
+
+        let mut request = ExecuteRequest {
+            language: "python".to_string(),
+            code: "print('hi')".to_string(),
+            tenant: Some("cs101".to_string()),
+            ..Default::default()
+        };
+        chain.before(&mut request).await.unwrap();
+        assert_eq!(request.code, "# checked\nprint('hi')");
+        // Hooks can't change the tenant
+        assert_eq!(request.tenant.as_deref(), Some("cs101"));
+
+        let mut response = ExecuteResponse {
+            stdout: "hi\n".to_string(),
+            ..Default::default()
+        };
+        chain.after(&request, &mut response).await.unwrap();
+        assert_eq!(response.stdout, "HI\n");
+
+        request.code = "import socket".to_string();
+        match chain.before(&mut request).await {
+            Err(HookError::Rejected(reason)) => assert_eq!(reason, "sockets are not allowed"),
+            other => panic!("Expected a veto, got {other:?}"),
+        }
+    }
+
+    #[test]
+    fn test_hook_reply() {
+        let reply = HookReply::parse("").unwrap();
+        assert!(reply.allow);
+        assert!(reply.request.is_none());
+
+        let reply = HookReply::parse(r#"{"allow": false, "reason": "exam mode"}"#).unwrap();
+        assert!(!reply.allow);
+        assert_eq!(reply.reason.as_deref(), Some("exam mode"));
+
+        let reply =
+            HookReply::parse(r#"{"result": {"stdout": "redacted", "stderr": "", "exit_code": 0}}"#)
+                .unwrap();
+        assert_eq!(reply.result.unwrap().stdout, "redacted");
+    }
+}
@@ -0,0 +1,184 @@
+use crate::executor::ExecutionError;
+use crate::judge;
+use std::process::{ExitStatus, Output, Stdio};
+use std::time::Duration;
+use tokio::io::{AsyncRead, AsyncReadExt, AsyncWrite, AsyncWriteExt};
+use tokio::process::{Child, Command};
+
+// Bytes of the submission's output kept for its result. The rest still reaches
+// the interactor.
+const TRANSCRIPT_LIMIT: usize = 64 * 1024;
+
+/// How both programs of an interaction ended. The submission's stdout holds what
+/// it sent the interactor; the interactor's stdout went to the submission.
+pub struct Interaction {
+    pub submission: Output,
+    pub interactor: Output,
+}
+
+impl Interaction {
+    /// What the interactor wrote to stderr, e.g. why it rejected an answer
+    pub fn message(&self) -> Option<String> {
+        judge::message(&self.interactor)
+    }
+}
+
+/// Runs the submission's and the interactor's `docker` commands with each one's
+/// stdout connected to the other's stdin, for problems whose input depends on the
+/// submission's earlier answers. Both are killed after `timeout`.
+pub async fn run(
+    submission_args: Vec<String>,
+    interactor_args: Vec<String>,
+    timeout: Duration,
+) -> Result<Interaction, ExecutionError> {
+    let mut submission = Command::new("docker");
+    submission.args(submission_args);
+    let mut interactor = Command::new("docker");
+    interactor.args(interactor_args);
+    connect(submission, interactor, timeout).await
+}
+
+async fn connect(
+    mut submission: Command,
+    mut interactor: Command,
+    timeout: Duration,
+) -> Result<Interaction, ExecutionError> {
+    let start_time = std::time::Instant::now();
+    let mut submission = spawn(&mut submission)?;
+    let mut interactor = spawn(&mut interactor)?;
+    let to_interactor = relay(
+        submission.stdout.take(),
+        interactor.stdin.take(),
+        TRANSCRIPT_LIMIT,
+    );
+    let to_submission = relay(interactor.stdout.take(), submission.stdin.take(), 0);
+    let submission_stderr = relay(
+        submission.stderr.take(),
+        None::<tokio::io::Sink>,
+        usize::MAX,
+    );
+    let interactor_stderr = relay(
+        interactor.stderr.take(),
+        None::<tokio::io::Sink>,
+        usize::MAX,
+    );
+
+    let finished = tokio::time::timeout(timeout, async {
+        tokio::join!(
+            submission.wait(),
+            interactor.wait(),
+            to_interactor,
+            to_submission,
+            submission_stderr,
+            interactor_stderr,
+        )
+    })
+    .await;
+    let Ok(finished) = finished else {
+        let _ = submission.start_kill();
+        let _ = interactor.start_kill();
+        return Err(ExecutionError::Timeout(start_time.elapsed().as_secs_f64()));
+    };
+    let (submission_status, interactor_status, transcript, _, submission_stderr, interactor_stderr) =
+        finished;
+    let status = |status: std::io::Result<ExitStatus>| {
+        status.map_err(|e| ExecutionError::Execution(e.to_string()))
+    };
+    Ok(Interaction {
+        submission: Output {
+            status: status(submission_status)?,
+            stdout: transcript,
+            stderr: submission_stderr,
+        },
+        interactor: Output {
+            status: status(interactor_status)?,
+            stdout: Vec::new(),
+            stderr: interactor_stderr,
+        },
+    })
+}
+
+fn spawn(command: &mut Command) -> Result<Child, ExecutionError> {
+    command
+        .stdin(Stdio::piped())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .kill_on_drop(true)
+        .spawn()
+        .map_err(|e| ExecutionError::Execution(format!("Failed to start docker: {e}")))
+}
+
+// Copies `from` to `to` until `from` ends, then closes `to` so the other side
+// sees the end of its input. Returns the first `keep` bytes. Once `to` is closed
+// by its reader, `from` is still drained so its writer doesn't block.
+async fn relay(
+    from: Option<impl AsyncRead + Unpin>,
+    mut to: Option<impl AsyncWrite + Unpin>,
+    keep: usize,
+) -> Vec<u8> {
+    let mut kept = Vec::new();
+    let Some(mut from) = from else {
+        return kept;
+    };
+    let mut buffer = [0; 8192];
+    loop {
+        let read = match from.read(&mut buffer).await {
+            Ok(0) | Err(_) => break,
+            Ok(read) => read,
+        };
+        let chunk = &buffer[..read];
+        kept.extend_from_slice(&chunk[..chunk.len().min(keep - kept.len())]);
+        if let Some(writer) = &mut to {
+            if writer.write_all(chunk).await.is_err() || writer.flush().await.is_err() {
+                to = None;
+            }
+        }
+    }
+    if let Some(mut writer) = to {
+        let _ = writer.shutdown().await;
+    }
+    kept
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn shell(script: &str) -> Command {
+        let mut command = Command::new("sh");
+        command.args(["-c", script]);
+        command
+    }
+
+    #[tokio::test]
+    async fn test_programs_talk_to_each_other() {
+        let interactor = "echo 41; read answer; echo \"got $answer\" >&2; [ \"$answer\" = 42 ]";
+        let interaction = connect(
+            shell("read x; echo $((x + 1))"),
+            shell(interactor),
+            Duration::from_secs(5),
+        )
+        .await
+        .unwrap();
+        assert!(interaction.interactor.status.success());
+        assert!(interaction.submission.status.success());
+        assert_eq!(interaction.submission.stdout, b"42\n");
+        assert_eq!(interaction.message().as_deref(), Some("got 42"));
+
+        let wrong = connect(
+            shell("read x; echo $x"),
+            shell(interactor),
+            Duration::from_secs(5),
+        )
+        .await
+        .unwrap();
+        assert!(!wrong.interactor.status.success());
+    }
+
+    #[tokio::test]
+    async fn test_interaction_times_out() {
+        // Both wait for the other to speak first
+        let result = connect(shell("read x"), shell("read y"), Duration::from_millis(200)).await;
+        assert!(matches!(result, Err(ExecutionError::Timeout(_))));
+    }
+}
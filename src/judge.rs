@@ -0,0 +1,392 @@
+use crate::executor::{TestCase, TestCaseResult};
+use crate::termination::{Limit, Termination};
+use serde::{Deserialize, Serialize};
+use std::collections::HashSet;
+use std::process::Output;
+
+/// The test case's input, in the workspace of an interactor or checker
+pub const INPUT_FILE: &str = "input.txt";
+/// The submission's output, in a checker's workspace
+pub const OUTPUT_FILE: &str = "output.txt";
+/// The test case's expected output, in the workspace of an interactor or checker.
+/// Empty when the test case has none.
+pub const ANSWER_FILE: &str = "answer.txt";
+
+/// Why a test case passed or failed, as contest scoreboards report it
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum Verdict {
+    Accepted,
+    WrongAnswer,
+    RuntimeError,
+    TimeLimitExceeded,
+    MemoryLimitExceeded,
+    OutputLimitExceeded,
+    /// The checker or interactor itself failed, so the output couldn't be judged
+    CheckerFailure,
+    /// Not run, because an earlier test case in its group failed
+    Skipped,
+    /// The code didn't compile, so no test case ran
+    CompilationError,
+}
+
+impl Verdict {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Self::Accepted => "accepted",
+            Self::WrongAnswer => "wrong_answer",
+            Self::RuntimeError => "runtime_error",
+            Self::TimeLimitExceeded => "time_limit_exceeded",
+            Self::MemoryLimitExceeded => "memory_limit_exceeded",
+            Self::OutputLimitExceeded => "output_limit_exceeded",
+            Self::CheckerFailure => "checker_failure",
+            Self::Skipped => "skipped",
+            Self::CompilationError => "compilation_error",
+        }
+    }
+
+    /// The verdict of a run that didn't exit with 0, from how it ended
+    pub fn of_failed_run(termination: Option<&Termination>) -> Self {
+        match termination.and_then(Termination::limit) {
+            Some(Limit::CpuTime) => Self::TimeLimitExceeded,
+            Some(Limit::Memory) => Self::MemoryLimitExceeded,
+            Some(Limit::FileSize) => Self::OutputLimitExceeded,
+            None => Self::RuntimeError,
+        }
+    }
+
+    /// The verdict of a checker's or interactor's exit code, as testlib uses them:
+    /// 0 accepts, 1 and 2 (presentation error) reject the answer, and anything else
+    /// means the checker failed
+    pub fn from_judge_exit_code(exit_code: i32) -> Self {
+        match exit_code {
+            0 => Self::Accepted,
+            1 | 2 => Self::WrongAnswer,
+            _ => Self::CheckerFailure,
+        }
+    }
+}
+
+/// A submission's verdict: the first failed test case's, with its index, or
+/// accepted. Without test results, the code didn't compile.
+pub fn outcome(results: Option<&[TestCaseResult]>) -> (Verdict, Option<usize>) {
+    let Some(results) = results else {
+        return (Verdict::CompilationError, None);
+    };
+    match results.iter().position(|result| !result.passed) {
+        Some(index) => (
+            results[index].verdict.unwrap_or(Verdict::WrongAnswer),
+            Some(index),
+        ),
+        None => (Verdict::Accepted, None),
+    }
+}
+
+/// A program the judge provides with a request, like an interactor or a checker
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct JudgeProgram {
+    pub language: String,
+    pub code: String,
+}
+
+/// A checker's run command: the language's, with the input, output and answer
+/// files as arguments in the order testlib checkers take them
+pub fn checker_command(run_command: &[String]) -> Vec<String> {
+    let mut command = run_command.to_vec();
+    command.extend([INPUT_FILE, OUTPUT_FILE, ANSWER_FILE].map(String::from));
+    command
+}
+
+/// What a judge's program reported on stderr, e.g. why it rejected an answer, or
+/// on stdout if its stderr is empty
+pub fn message(output: &Output) -> Option<String> {
+    [&output.stderr, &output.stdout]
+        .into_iter()
+        .map(|bytes| String::from_utf8_lossy(bytes).trim().to_string())
+        .find(|message| !message.is_empty())
+}
+
+/// Test cases scored together, like a contest subtask: the group's points are only
+/// awarded if every test case in it passes
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct TestGroup {
+    pub name: String,
+    pub points: f64,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize, PartialEq)]
+pub struct GroupScore {
+    pub name: String,
+    pub points: f64,
+    pub max_points: f64,
+    pub passed: bool,
+}
+
+/// Points a submission earned over the request's test groups
+#[derive(Debug, Clone, Default, Serialize, Deserialize, PartialEq)]
+pub struct TestScore {
+    pub points: f64,
+    pub max_points: f64,
+    pub groups: Vec<GroupScore>,
+}
+
+/// Checks that groups are declared once with valid points, and that test cases
+/// only name declared groups that each have a test case
+pub fn validate(
+    test_cases: Option<&[TestCase]>,
+    groups: Option<&[TestGroup]>,
+) -> Result<(), String> {
+    let Some(groups) = groups else {
+        return Ok(());
+    };
+    let Some(test_cases) = test_cases else {
+        return Err("test_groups need test cases".to_string());
+    };
+    let mut names = HashSet::new();
+    for group in groups {
+        if !names.insert(group.name.as_str()) {
+            return Err(format!("Test group '{}' is declared twice", group.name));
+        }
+        if !group.points.is_finite() || group.points < 0.0 {
+            return Err(format!(
+                "Points of test group '{}' must be a non-negative number",
+                group.name
+            ));
+        }
+    }
+    let mut used = HashSet::new();
+    for test_case in test_cases {
+        let Some(group) = &test_case.group else {
+            continue;
+        };
+        if !names.contains(group.as_str()) {
+            return Err(format!(
+                "Test case '{}' is in undeclared group '{group}'",
+                test_case.name
+            ));
+        }
+        used.insert(group.as_str());
+    }
+    if let Some(empty) = names.difference(&used).next() {
+        return Err(format!("Test group '{empty}' has no test cases"));
+    }
+    Ok(())
+}
+
+/// Awards each group's points if all of its test cases passed. Results missing
+/// because the code didn't compile count as failed.
+pub fn score(groups: &[TestGroup], results: &[TestCaseResult]) -> TestScore {
+    let groups: Vec<GroupScore> = groups
+        .iter()
+        .map(|group| {
+            let mut results = results
+                .iter()
+                .filter(|result| result.group.as_ref() == Some(&group.name))
+                .peekable();
+            let passed = results.peek().is_some() && results.all(|result| result.passed);
+            GroupScore {
+                name: group.name.clone(),
+                points: if passed { group.points } else { 0.0 },
+                max_points: group.points,
+                passed,
+            }
+        })
+        .collect();
+    TestScore {
+        points: groups.iter().map(|group| group.points).sum(),
+        max_points: groups.iter().map(|group| group.max_points).sum(),
+        groups,
+    }
+}
+
+/// The result of a test case that wasn't run because an earlier one in its group
+/// failed
+pub fn skipped(test_case: &TestCase) -> TestCaseResult {
+    let mut result = TestCaseResult {
+        name: test_case.name.clone(),
+        passed: false,
+        stdout: String::new(),
+        stderr: String::new(),
+        exit_code: 0,
+        time_taken: None,
+        memory_used: None,
+        swap_used: None,
+        error_message: Some("Skipped after an earlier test case failed".to_string()),
+        input: String::new(),
+        expected_output: None,
+        actual_output: String::new(),
+        term_signal: None,
+        term_reason: None,
+        group: test_case.group.clone(),
+        hidden: None,
+        skipped: Some(true),
+        judge_message: None,
+        verdict: Some(Verdict::Skipped),
+        cpu_contention: None,
+    };
+    if test_case.hidden {
+        hide(&mut result);
+    }
+    result
+}
+
+/// The result of a test case that ran out of wall time
+pub fn timed_out(test_case: &TestCase, seconds: f64) -> TestCaseResult {
+    TestCaseResult {
+        name: test_case.name.clone(),
+        passed: false,
+        stdout: String::new(),
+        stderr: String::new(),
+        exit_code: 124,
+        time_taken: Some(seconds),
+        memory_used: None,
+        swap_used: None,
+        error_message: Some(format!("Timed out after {seconds:.3} seconds")),
+        input: test_case.input.clone(),
+        expected_output: test_case.expected_output.clone(),
+        actual_output: String::new(),
+        term_signal: None,
+        term_reason: Some("killed by wall time limit".to_string()),
+        group: test_case.group.clone(),
+        hidden: None,
+        skipped: None,
+        judge_message: None,
+        verdict: Some(Verdict::TimeLimitExceeded),
+        cpu_contention: None,
+    }
+}
+
+/// Removes a hidden test case's data from its result, keeping whether it passed
+/// and how much time and memory it took
+pub fn hide(result: &mut TestCaseResult) {
+    result.stdout.clear();
+    result.stderr.clear();
+    result.input.clear();
+    result.actual_output.clear();
+    result.expected_output = None;
+    result.error_message = None;
+    result.judge_message = None;
+    result.hidden = Some(true);
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn test_case(name: &str, group: &str) -> TestCase {
+        TestCase {
+            name: name.to_string(),
+            group: Some(group.to_string()),
+            ..Default::default()
+        }
+    }
+
+    fn group(name: &str, points: f64) -> TestGroup {
+        TestGroup {
+            name: name.to_string(),
+            points,
+        }
+    }
+
+    #[test]
+    fn test_groups_score_all_or_nothing() {
+        let groups = [group("small", 30.0), group("large", 70.0)];
+        let mut results: Vec<TestCaseResult> = ["small", "small", "large"]
+            .iter()
+            .map(|name| skipped(&test_case("t", name)))
+            .collect();
+        results[0].passed = true;
+        results[1].passed = true;
+
+        let score = score(&groups, &results);
+        assert_eq!((score.points, score.max_points), (30.0, 100.0));
+        assert!(score.groups[0].passed && !score.groups[1].passed);
+        assert_eq!(super::score(&groups, &[]).points, 0.0);
+    }
+
+    #[test]
+    fn test_invalid_groups() {
+        let cases = [test_case("a", "small"), test_case("b", "large")];
+        let groups = [group("small", 30.0), group("large", 70.0)];
+        assert!(validate(Some(&cases), Some(&groups)).is_ok());
+        assert!(validate(Some(&cases), None).is_ok());
+        assert!(validate(None, Some(&groups)).is_err());
+        assert!(validate(Some(&cases[..1]), Some(&groups)).is_err());
+        assert!(validate(Some(&cases), Some(&groups[..1])).is_err());
+        let negative = [group("small", -1.0), group("large", 1.0)];
+        assert!(validate(Some(&cases), Some(&negative)).is_err());
+    }
+
+    #[test]
+    fn test_verdicts() {
+        let killed = |exit_code, seconds| {
+            crate::termination::from_exit_code(
+                exit_code,
+                std::time::Duration::from_secs(seconds),
+                std::time::Duration::from_secs(2),
+            )
+        };
+        assert_eq!(
+            Verdict::of_failed_run(killed(137, 3).as_ref()),
+            Verdict::TimeLimitExceeded
+        );
+        assert_eq!(
+            Verdict::of_failed_run(killed(137, 1).as_ref()),
+            Verdict::MemoryLimitExceeded
+        );
+        assert_eq!(
+            Verdict::of_failed_run(killed(139, 1).as_ref()),
+            Verdict::RuntimeError
+        );
+        assert_eq!(Verdict::of_failed_run(None), Verdict::RuntimeError);
+        assert_eq!(Verdict::from_judge_exit_code(2), Verdict::WrongAnswer);
+        assert_eq!(Verdict::from_judge_exit_code(3), Verdict::CheckerFailure);
+        assert_eq!(
+            serde_json::to_value(Verdict::TimeLimitExceeded).unwrap(),
+            Verdict::TimeLimitExceeded.as_str()
+        );
+
+        let mut results = vec![
+            skipped(&test_case("a", "small")),
+            timed_out(&test_case("b", "small"), 2.0),
+        ];
+        results[0].passed = true;
+        assert_eq!(
+            outcome(Some(&results)),
+            (Verdict::TimeLimitExceeded, Some(1))
+        );
+        assert_eq!(outcome(Some(&results[..1])), (Verdict::Accepted, None));
+        assert_eq!(outcome(None), (Verdict::CompilationError, None));
+    }
+
+    #[test]
+    fn test_hidden_results_keep_only_the_verdict() {
+        let hidden = TestCase {
+            hidden: true,
+            input: "secret".to_string(),
+            ..test_case("t", "large")
+        };
+        let result = skipped(&hidden);
+        assert_eq!(result.hidden, Some(true));
+        assert!(result.input.is_empty() && result.error_message.is_none());
+    }
+
+    #[test]
+    fn test_checker_command_and_message() {
+        assert_eq!(
+            checker_command(&["./checker".to_string()]),
+            ["./checker", "input.txt", "output.txt", "answer.txt"]
+        );
+        let output = |stdout: &str, stderr: &str| Output {
+            status: Default::default(),
+            stdout: stdout.as_bytes().to_vec(),
+            stderr: stderr.as_bytes().to_vec(),
+        };
+        assert_eq!(
+            message(&output("ignored", "wrong answer 2nd line differs\n")).as_deref(),
+            Some("wrong answer 2nd line differs")
+        );
+        assert_eq!(message(&output("ok\n", " ")).as_deref(), Some("ok"));
+        assert_eq!(message(&output("", "")), None);
+    }
+}
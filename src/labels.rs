@@ -0,0 +1,157 @@
+use crate::config::MetricLabelsConfig;
+use serde::de::Error;
+use serde::{Deserialize, Deserializer, Serialize};
+use std::collections::BTreeMap;
+use std::sync::Mutex;
+
+/// Separates a label's key from its value, e.g. `course:cs101`
+pub const SEPARATOR: char = ':';
+
+// Counts values of a key beyond its `max_values`
+const OTHER_VALUES: &str = "_other";
+
+/// Deserializes request labels given as a list of tags, e.g. `["week-3"]`, or as a
+/// map, e.g. `{"course": "cs101"}`, whose entries become `key:value` labels
+pub fn deserialize<'de, D>(deserializer: D) -> Result<Option<Vec<String>>, D::Error>
+where
+    D: Deserializer<'de>,
+{
+    #[derive(Deserialize)]
+    #[serde(untagged)]
+    enum Labels {
+        Tags(Vec<String>),
+        Map(BTreeMap<String, String>),
+    }
+
+    let map = match Option::<Labels>::deserialize(deserializer)? {
+        None => return Ok(None),
+        Some(Labels::Tags(tags)) => return Ok(Some(tags)),
+        Some(Labels::Map(map)) => map,
+    };
+    map.into_iter()
+        .map(|(key, value)| {
+            validate_key(&key).map_err(D::Error::custom)?;
+            Ok(format!("{key}{SEPARATOR}{value}"))
+        })
+        .collect::<Result<Vec<_>, _>>()
+        .map(Some)
+}
+
+pub fn validate_key(key: &str) -> Result<(), String> {
+    if key.is_empty() || key.contains(SEPARATOR) {
+        return Err(format!(
+            "Label key '{key}' must be non-empty and can't contain '{SEPARATOR}'"
+        ));
+    }
+    Ok(())
+}
+
+#[derive(Debug, Clone, Default, Serialize)]
+pub struct LabelStats {
+    pub executions: u64,
+    pub failures: u64,
+}
+
+/// Executions and failures per value of the configured label keys, e.g. per course
+pub struct LabelMetrics {
+    keys: Vec<String>,
+    max_values: usize,
+    counts: Mutex<BTreeMap<String, BTreeMap<String, LabelStats>>>,
+}
+
+impl LabelMetrics {
+    pub fn new(config: &MetricLabelsConfig) -> Self {
+        Self {
+            keys: config.keys.clone(),
+            max_values: config.max_values,
+            counts: Mutex::new(BTreeMap::new()),
+        }
+    }
+
+    /// Counts an execution under each of its labels with a configured key. Values
+    /// seen after a key already has `max_values` are counted together as `_other`.
+    pub fn record(&self, labels: &[String], failed: bool) {
+        let mut counts = self.counts.lock().unwrap();
+        for (key, value) in labels
+            .iter()
+            .filter_map(|label| label.split_once(SEPARATOR))
+        {
+            if !self.keys.iter().any(|k| k == key) {
+                continue;
+            }
+            let values = counts.entry(key.to_string()).or_default();
+            let value = if values.contains_key(value) || values.len() < self.max_values {
+                value
+            } else {
+                OTHER_VALUES
+            };
+            let stats = values.entry(value.to_string()).or_default();
+            stats.executions += 1;
+            if failed {
+                stats.failures += 1;
+            }
+        }
+    }
+
+    /// Stats by label key and value
+    pub fn snapshot(&self) -> BTreeMap<String, BTreeMap<String, LabelStats>> {
+        self.counts.lock().unwrap().clone()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[derive(Deserialize)]
+    struct Request {
+        #[serde(default, deserialize_with = "deserialize")]
+        labels: Option<Vec<String>>,
+    }
+
+    fn labels(json: &str) -> Result<Option<Vec<String>>, serde_json::Error> {
+        serde_json::from_str::<Request>(json).map(|request| request.labels)
+    }
+
+    #[test]
+    fn test_labels_as_tags_or_map() {
+        assert_eq!(
+            labels(r#"{"labels": ["week-3", "student:1234"]}"#).unwrap(),
+            Some(vec!["week-3".to_string(), "student:1234".to_string()])
+        );
+        assert_eq!(
+            labels(r#"{"labels": {"problem": "42", "course": "cs101"}}"#).unwrap(),
+            Some(vec!["course:cs101".to_string(), "problem:42".to_string()])
+        );
+        assert_eq!(labels("{}").unwrap(), None);
+        assert!(labels(r#"{"labels": {"a:b": "c"}}"#).is_err());
+    }
+
+    #[test]
+    fn test_metric_values_are_bounded() {
+        let metrics = LabelMetrics::new(&MetricLabelsConfig {
+            keys: vec!["course".to_string()],
+            max_values: 2,
+        });
+        for (course, failed) in [("cs101", false), ("cs102", true), ("cs103", false)] {
+            metrics.record(
+                &[format!("course:{course}"), "student:1234".to_string()],
+                failed,
+            );
+        }
+        metrics.record(&["course:cs101".to_string()], true);
+
+        let snapshot = metrics.snapshot();
+        assert_eq!(snapshot.len(), 1);
+        let courses = &snapshot["course"];
+        assert_eq!(
+            courses.keys().collect::<Vec<_>>(),
+            ["_other", "cs101", "cs102"]
+        );
+        assert_eq!(
+            (courses["cs101"].executions, courses["cs101"].failures),
+            (2, 1)
+        );
+        assert_eq!(courses["_other"].executions, 1);
+    }
+}
@@ -0,0 +1,239 @@
+use serde::Serialize;
+use std::collections::VecDeque;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::Mutex;
+use std::time::{Duration, Instant};
+
+/// How far back `LatencyMonitor::recent_queue_wait` looks
+pub const QUEUE_WAIT_WINDOW: Duration = Duration::from_secs(60);
+
+/// Suggested retry delay before any execution has finished
+pub const DEFAULT_RETRY_AFTER: Duration = Duration::from_secs(5);
+
+// Weight of the newest execution in the smoothed execution time
+const EXECUTION_SMOOTHING: f64 = 0.2;
+
+/// How long each phase of an execution took
+#[derive(Debug, Clone, Default)]
+pub struct PhaseTimings {
+    /// Time spent waiting in the job queue; None for requests that weren't queued
+    pub queue_wait: Option<Duration>,
+    /// None for interpreted languages
+    pub compile: Option<Duration>,
+    pub run: Duration,
+}
+
+/// Executions with a phase over its threshold since the server started
+#[derive(Debug, Clone, Default, Serialize)]
+pub struct SlowCounts {
+    pub queue_wait: u64,
+    pub compile: u64,
+    pub run: u64,
+}
+
+/// Logs executions with a slow phase and counts them per phase. A threshold of
+/// None disables the check for that phase.
+pub struct LatencyMonitor {
+    queue_wait: Option<Duration>,
+    compile: Option<Duration>,
+    run: Option<Duration>,
+    slow_queue_wait: AtomicU64,
+    slow_compile: AtomicU64,
+    slow_run: AtomicU64,
+    // When recently started queued jobs started, and how long they had waited
+    recent_waits: Mutex<VecDeque<(Instant, Duration)>>,
+    // Exponentially weighted average of how long executions take, in seconds
+    typical_execution: Mutex<Option<f64>>,
+}
+
+impl LatencyMonitor {
+    pub fn new(
+        queue_wait: Option<Duration>,
+        compile: Option<Duration>,
+        run: Option<Duration>,
+    ) -> Self {
+        Self {
+            queue_wait,
+            compile,
+            run,
+            slow_queue_wait: AtomicU64::new(0),
+            slow_compile: AtomicU64::new(0),
+            slow_run: AtomicU64::new(0),
+            recent_waits: Mutex::new(VecDeque::new()),
+            typical_execution: Mutex::new(None),
+        }
+    }
+
+    pub fn from_env() -> Self {
+        // Milliseconds; 0 turns the check off
+        let threshold = |name: &str, default: u64| {
+            let millis = std::env::var(name)
+                .ok()
+                .and_then(|s| s.parse::<u64>().ok())
+                .unwrap_or(default);
+            (millis > 0).then(|| Duration::from_millis(millis))
+        };
+        Self::new(
+            threshold("SLOW_QUEUE_WAIT_MS", 10_000),
+            threshold("SLOW_COMPILE_MS", 10_000),
+            threshold("SLOW_RUN_MS", 5_000),
+        )
+    }
+
+    /// Records an execution's timings, returning the names of its slow phases
+    pub fn observe(&self, id: &str, language: &str, timings: &PhaseTimings) -> Vec<&'static str> {
+        let phases = [
+            (
+                "queue_wait",
+                timings.queue_wait,
+                self.queue_wait,
+                &self.slow_queue_wait,
+            ),
+            ("compile", timings.compile, self.compile, &self.slow_compile),
+            ("run", Some(timings.run), self.run, &self.slow_run),
+        ];
+        let mut slow = Vec::new();
+        for (phase, took, threshold, count) in phases {
+            if let (Some(took), Some(threshold)) = (took, threshold) {
+                if took > threshold {
+                    count.fetch_add(1, Ordering::Relaxed);
+                    slow.push(phase);
+                }
+            }
+        }
+
+        if !slow.is_empty() {
+            let seconds = |phase: Option<Duration>| {
+                phase.map_or("-".to_string(), |d| format!("{:.3}s", d.as_secs_f64()))
+            };
+            log::warn!(
+                "Slow execution {id} ({language}): {} over threshold; queue_wait={} compile={} run={}",
+                slow.join(", "),
+                seconds(timings.queue_wait),
+                seconds(timings.compile),
+                seconds(Some(timings.run))
+            );
+        }
+        slow
+    }
+
+    /// Records how long a queued job waited before it started, wherever it runs
+    pub fn record_queue_wait(&self, wait: Duration) {
+        self.record_queue_wait_at(Instant::now(), wait);
+    }
+
+    fn record_queue_wait_at(&self, now: Instant, wait: Duration) {
+        let mut waits = self.recent_waits.lock().unwrap();
+        waits.push_back((now, wait));
+        while waits
+            .front()
+            .is_some_and(|(started, _)| now.duration_since(*started) > QUEUE_WAIT_WINDOW)
+        {
+            waits.pop_front();
+        }
+    }
+
+    /// Longest wait of the queued jobs that started within `QUEUE_WAIT_WINDOW`;
+    /// None when none did
+    pub fn recent_queue_wait(&self) -> Option<Duration> {
+        let now = Instant::now();
+        self.recent_waits
+            .lock()
+            .unwrap()
+            .iter()
+            .filter(|(started, _)| now.duration_since(*started) <= QUEUE_WAIT_WINDOW)
+            .map(|(_, wait)| *wait)
+            .max()
+    }
+
+    /// Records how long a finished execution took, wherever it ran
+    pub fn record_execution(&self, took: Duration) {
+        let mut typical = self.typical_execution.lock().unwrap();
+        let took = took.as_secs_f64();
+        *typical = Some(match *typical {
+            Some(average) => average + EXECUTION_SMOOTHING * (took - average),
+            None => took,
+        });
+    }
+
+    /// When a caller turned away because every sandbox is busy should try again:
+    /// about the time one execution takes to free a slot
+    pub fn retry_after(&self) -> Duration {
+        self.typical_execution
+            .lock()
+            .unwrap()
+            .map_or(DEFAULT_RETRY_AFTER, |seconds| {
+                Duration::from_secs_f64(seconds.max(1.0))
+            })
+    }
+
+    pub fn counts(&self) -> SlowCounts {
+        SlowCounts {
+            queue_wait: self.slow_queue_wait.load(Ordering::Relaxed),
+            compile: self.slow_compile.load(Ordering::Relaxed),
+            run: self.slow_run.load(Ordering::Relaxed),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_slow_phases_are_counted() {
+        let monitor = LatencyMonitor::new(
+            Some(Duration::from_secs(1)),
+            None,
+            Some(Duration::from_secs(2)),
+        );
+
+        let fast = PhaseTimings {
+            queue_wait: None,
+            compile: Some(Duration::from_secs(30)),
+            run: Duration::from_secs(1),
+        };
+        assert!(monitor.observe("a", "rust", &fast).is_empty());
+
+        let slow = PhaseTimings {
+            queue_wait: Some(Duration::from_secs(5)),
+            compile: None,
+            run: Duration::from_secs(3),
+        };
+        assert_eq!(
+            monitor.observe("b", "python", &slow),
+            vec!["queue_wait", "run"]
+        );
+
+        let counts = monitor.counts();
+        assert_eq!((counts.queue_wait, counts.compile, counts.run), (1, 0, 1));
+    }
+
+    #[test]
+    fn test_recent_queue_wait() {
+        let monitor = LatencyMonitor::new(None, None, None);
+        assert_eq!(monitor.recent_queue_wait(), None);
+
+        let long_ago = Instant::now().checked_sub(QUEUE_WAIT_WINDOW * 2).unwrap();
+        monitor.record_queue_wait_at(long_ago, Duration::from_secs(90));
+        monitor.record_queue_wait(Duration::from_secs(4));
+        monitor.record_queue_wait(Duration::from_secs(2));
+        assert_eq!(monitor.recent_queue_wait(), Some(Duration::from_secs(4)));
+    }
+
+    #[test]
+    fn test_retry_after_follows_execution_time() {
+        let monitor = LatencyMonitor::new(None, None, None);
+        assert_eq!(monitor.retry_after(), DEFAULT_RETRY_AFTER);
+
+        monitor.record_execution(Duration::from_secs(10));
+        assert_eq!(monitor.retry_after(), Duration::from_secs(10));
+        monitor.record_execution(Duration::from_secs(20));
+        assert_eq!(monitor.retry_after(), Duration::from_secs(12));
+
+        // Never suggests retrying sooner than a second
+        let quick = LatencyMonitor::new(None, None, None);
+        quick.record_execution(Duration::from_millis(30));
+        assert_eq!(quick.retry_after(), Duration::from_secs(1));
+    }
+}
@@ -1,9 +1,67 @@
 // IsoBox library crate
 // This file exports the necessary modules for external use
 
+pub mod abuse;
+pub mod activity;
+pub mod ansi;
+pub mod api_error;
+pub mod assignment;
+pub mod bundle;
+pub mod cache;
+pub mod cgroup;
+pub mod coldstart;
+pub mod concurrency;
+pub mod config;
+pub mod contention;
+pub mod coredump;
+pub mod cpuset;
+pub mod crypto;
+pub mod dataset;
+pub mod deadline;
+pub mod dependencies;
+pub mod deprecation;
+pub mod embedded;
+pub mod encoding;
+pub mod estimate;
+pub mod events;
 pub mod executor;
+pub mod fairshare;
+pub mod function_call;
+pub mod functions;
 pub mod generated;
 pub mod grpc;
+pub mod hooks;
+pub mod interactor;
+pub mod judge;
+pub mod labels;
+pub mod latency;
+pub mod log_export;
+pub mod logs;
+pub mod mirror;
+pub mod preset;
+pub mod priority;
+pub mod queue;
+pub mod ratelimit;
+pub mod redact;
+pub mod result_cache;
+pub mod routing;
+pub mod scan;
+pub mod seccomp;
+pub mod security;
+pub mod session;
+pub mod similarity;
+pub mod stats;
+pub mod store;
+pub mod syntax;
+pub mod terminal;
+pub mod termination;
+pub mod trace;
+pub mod trace_context;
+pub mod upload;
+pub mod usage;
+pub mod userns;
+pub mod webhook;
+pub mod worker;
 
 // Re-export commonly used types
 pub use executor::{CodeExecutor, ExecuteRequest, ExecuteResponse, ExecutionError};
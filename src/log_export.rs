@@ -0,0 +1,363 @@
+use crate::config::{ElasticsearchConfig, IsoboxConfig, LokiConfig};
+use crate::events::{EventSink, ExecutionEvent};
+use serde_json::json;
+use std::collections::{BTreeMap, HashMap, VecDeque};
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::{Arc, Mutex};
+use std::time::Duration;
+use tokio::sync::Notify;
+
+const REQUEST_TIMEOUT: Duration = Duration::from_secs(30);
+const MAX_BACKOFF: Duration = Duration::from_secs(60);
+
+/// A log store entries are shipped to
+enum Store {
+    Loki(LokiConfig),
+    Elasticsearch(ElasticsearchConfig),
+}
+
+impl Store {
+    fn name(&self) -> &'static str {
+        match self {
+            Store::Loki(_) => "Loki",
+            Store::Elasticsearch(_) => "Elasticsearch",
+        }
+    }
+
+    fn headers(&self) -> &HashMap<String, String> {
+        match self {
+            Store::Loki(loki) => &loki.headers,
+            Store::Elasticsearch(es) => &es.headers,
+        }
+    }
+
+    // URL, content type and body of the request writing a batch
+    fn request(&self, batch: &[ExecutionEvent]) -> (String, &'static str, String) {
+        match self {
+            Store::Loki(loki) => (
+                format!("{}/loki/api/v1/push", loki.url.trim_end_matches('/')),
+                "application/json",
+                loki_push(&loki.labels, batch),
+            ),
+            Store::Elasticsearch(es) => (
+                format!("{}/_bulk", es.url.trim_end_matches('/')),
+                "application/x-ndjson",
+                elasticsearch_bulk(&es.index, batch),
+            ),
+        }
+    }
+}
+
+// Entries waiting to be shipped to one store. Publishing never waits for the
+// store: when the buffer is full, the oldest entries make room and are counted
+// as dropped.
+struct Buffer {
+    entries: Mutex<VecDeque<ExecutionEvent>>,
+    capacity: usize,
+    batch_size: usize,
+    dropped: AtomicU64,
+    // Woken once a batch is full
+    ready: Notify,
+}
+
+impl Buffer {
+    fn new(capacity: usize, batch_size: usize) -> Self {
+        Self {
+            entries: Mutex::new(VecDeque::new()),
+            capacity,
+            batch_size,
+            dropped: AtomicU64::new(0),
+            ready: Notify::new(),
+        }
+    }
+
+    fn push(&self, event: ExecutionEvent) {
+        let mut entries = self.entries.lock().unwrap();
+        entries.push_back(event);
+        self.trim(&mut entries);
+        if entries.len() >= self.batch_size {
+            self.ready.notify_one();
+        }
+    }
+
+    fn take(&self) -> Vec<ExecutionEvent> {
+        let mut entries = self.entries.lock().unwrap();
+        let count = entries.len().min(self.batch_size);
+        entries.drain(..count).collect()
+    }
+
+    // Puts back a batch that couldn't be shipped, ahead of the entries published
+    // since
+    fn requeue(&self, batch: Vec<ExecutionEvent>) {
+        let mut entries = self.entries.lock().unwrap();
+        for event in batch.into_iter().rev() {
+            entries.push_front(event);
+        }
+        self.trim(&mut entries);
+    }
+
+    fn trim(&self, entries: &mut VecDeque<ExecutionEvent>) {
+        while entries.len() > self.capacity {
+            entries.pop_front();
+            self.dropped.fetch_add(1, Ordering::Relaxed);
+        }
+    }
+}
+
+/// Writes every execution event to the configured log stores as a log entry, so
+/// executions and security alerts show up in existing observability stacks.
+/// Entries are sent in batches by a task for each store, which retries with
+/// backoff while the store is down.
+pub struct LogShipper {
+    buffers: Vec<Arc<Buffer>>,
+}
+
+impl LogShipper {
+    /// Returns None when no log store is configured. Starts the shipping tasks, so
+    /// it must be called on the Tokio runtime.
+    pub fn from_config(config: &IsoboxConfig) -> Option<Self> {
+        let export = &config.log_export;
+        let stores: Vec<Store> = export
+            .loki
+            .clone()
+            .map(Store::Loki)
+            .into_iter()
+            .chain(export.elasticsearch.clone().map(Store::Elasticsearch))
+            .collect();
+        if stores.is_empty() {
+            return None;
+        }
+        let client = reqwest::Client::builder()
+            .timeout(REQUEST_TIMEOUT)
+            .build()
+            .ok()?;
+        let flush_interval = Duration::from_millis(export.flush_interval_ms);
+        let buffers = stores
+            .into_iter()
+            .map(|store| {
+                let buffer = Arc::new(Buffer::new(export.buffer, export.batch_size));
+                tokio::spawn(ship(client.clone(), store, buffer.clone(), flush_interval));
+                buffer
+            })
+            .collect();
+        Some(Self { buffers })
+    }
+}
+
+impl EventSink for LogShipper {
+    fn publish(&self, event: &ExecutionEvent) {
+        for buffer in &self.buffers {
+            buffer.push(event.clone());
+        }
+    }
+}
+
+async fn ship(
+    client: reqwest::Client,
+    store: Store,
+    buffer: Arc<Buffer>,
+    flush_interval: Duration,
+) {
+    let mut backoff = Duration::from_secs(1);
+    loop {
+        // Times out when the interval passes without a full batch
+        let _ = tokio::time::timeout(flush_interval, buffer.ready.notified()).await;
+        loop {
+            let dropped = buffer.dropped.swap(0, Ordering::Relaxed);
+            if dropped > 0 {
+                log::warn!(
+                    "Dropped {dropped} log entries for {} because its buffer was full",
+                    store.name()
+                );
+            }
+            let batch = buffer.take();
+            if batch.is_empty() {
+                break;
+            }
+            match send(&client, &store, &batch).await {
+                Ok(()) => backoff = Duration::from_secs(1),
+                Err(e) => {
+                    log::warn!(
+                        "Failed to ship {} log entries to {}, retrying in {}s: {e}",
+                        batch.len(),
+                        store.name(),
+                        backoff.as_secs()
+                    );
+                    buffer.requeue(batch);
+                    tokio::time::sleep(backoff).await;
+                    backoff = (backoff * 2).min(MAX_BACKOFF);
+                    break;
+                }
+            }
+        }
+    }
+}
+
+async fn send(
+    client: &reqwest::Client,
+    store: &Store,
+    batch: &[ExecutionEvent],
+) -> Result<(), String> {
+    let (url, content_type, body) = store.request(batch);
+    let mut request = client.post(&url).header("Content-Type", content_type);
+    for (name, value) in store.headers() {
+        request = request.header(name.as_str(), value.as_str());
+    }
+    let response = request
+        .body(body)
+        .send()
+        .await
+        .map_err(|e| format!("{url}: {e}"))?;
+    if !response.status().is_success() {
+        return Err(format!("{url}: {}", response.status()));
+    }
+    if let Store::Elasticsearch(_) = store {
+        // Entries are rejected one by one, e.g. for not matching the index's
+        // mapping. Sending them again wouldn't help, so they're only reported.
+        let result: serde_json::Value = response.json().await.unwrap_or_default();
+        if result["errors"] == true {
+            let error = result["items"]
+                .as_array()
+                .into_iter()
+                .flatten()
+                .find_map(|item| item["create"].get("error"));
+            log::warn!(
+                "Elasticsearch rejected log entries: {}",
+                error.map(|e| e.to_string()).unwrap_or_default()
+            );
+        }
+    }
+    Ok(())
+}
+
+// Loki push API body: one stream per set of labels, with nanosecond timestamps
+fn loki_push(labels: &HashMap<String, String>, batch: &[ExecutionEvent]) -> String {
+    let mut streams: BTreeMap<BTreeMap<&str, &str>, Vec<[String; 2]>> = BTreeMap::new();
+    for event in batch {
+        let mut stream = BTreeMap::from([("job", "isobox")]);
+        stream.extend(labels.iter().map(|(k, v)| (k.as_str(), v.as_str())));
+        stream.insert("event", event.event.as_str());
+        stream.insert("tenant", &event.tenant);
+        stream.insert("language", &event.language);
+        let line = serde_json::to_string(event).unwrap_or_default();
+        streams
+            .entry(stream)
+            .or_default()
+            .push([(event.timestamp as u128 * 1_000_000_000).to_string(), line]);
+    }
+    let streams: Vec<serde_json::Value> = streams
+        .into_iter()
+        .map(|(stream, values)| json!({"stream": stream, "values": values}))
+        .collect();
+    json!({ "streams": streams }).to_string()
+}
+
+// Bulk API body: a create action and the document for each entry, which also
+// works for data streams
+fn elasticsearch_bulk(index: &str, batch: &[ExecutionEvent]) -> String {
+    let action = json!({"create": {"_index": index}}).to_string();
+    let mut body = String::new();
+    for event in batch {
+        let mut document = serde_json::to_value(event).unwrap_or_default();
+        if let Some(document) = document.as_object_mut() {
+            document.insert("@timestamp".to_string(), json!(rfc3339(event.timestamp)));
+        }
+        body.push_str(&action);
+        body.push('\n');
+        body.push_str(&document.to_string());
+        body.push('\n');
+    }
+    body
+}
+
+// UTC date and time of a Unix timestamp, e.g. `2024-06-10T06:13:20Z`
+fn rfc3339(timestamp: u64) -> String {
+    let (days, seconds) = ((timestamp / 86_400) as i64, timestamp % 86_400);
+    // Days to a civil date, from Howard Hinnant's chrono-compatible algorithms
+    let z = days + 719_468;
+    let era = z.div_euclid(146_097);
+    let day_of_era = z - era * 146_097;
+    let year_of_era =
+        (day_of_era - day_of_era / 1460 + day_of_era / 36_524 - day_of_era / 146_096) / 365;
+    let day_of_year = day_of_era - (365 * year_of_era + year_of_era / 4 - year_of_era / 100);
+    let month_index = (5 * day_of_year + 2) / 153;
+    let day = day_of_year - (153 * month_index + 2) / 5 + 1;
+    let month = if month_index < 10 {
+        month_index + 3
+    } else {
+        month_index - 9
+    };
+    let year = year_of_era + era * 400 + i64::from(month <= 2);
+    format!(
+        "{year:04}-{month:02}-{day:02}T{:02}:{:02}:{:02}Z",
+        seconds / 3600,
+        seconds % 3600 / 60,
+        seconds % 60
+    )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn event(id: &str, tenant: &str) -> ExecutionEvent {
+        let mut event = ExecutionEvent::started(id, tenant, "python");
+        event.timestamp = 1718000000;
+        event
+    }
+
+    #[test]
+    fn test_full_buffer_drops_oldest() {
+        let buffer = Buffer::new(3, 2);
+        for id in ["a", "b", "c", "d"] {
+            buffer.push(event(id, "cs101"));
+        }
+        assert_eq!(buffer.dropped.load(Ordering::Relaxed), 1);
+
+        let batch = buffer.take();
+        let ids: Vec<&str> = batch.iter().map(|e| e.id.as_str()).collect();
+        assert_eq!(ids, ["b", "c"]);
+
+        // A failed batch goes back ahead of newer entries, pushing out the oldest
+        buffer.push(event("e", "cs101"));
+        buffer.requeue(batch);
+        assert_eq!(buffer.dropped.load(Ordering::Relaxed), 2);
+        let ids: Vec<String> = buffer
+            .entries
+            .lock()
+            .unwrap()
+            .iter()
+            .map(|e| e.id.clone())
+            .collect();
+        assert_eq!(ids, ["c", "d", "e"]);
+    }
+
+    #[test]
+    fn test_payloads() {
+        let batch = [
+            event("a", "cs101"),
+            event("b", "cs101"),
+            event("c", "cs102"),
+        ];
+        let labels = HashMap::from([("env".to_string(), "prod".to_string())]);
+        let push: serde_json::Value = serde_json::from_str(&loki_push(&labels, &batch)).unwrap();
+        let streams = push["streams"].as_array().unwrap();
+        assert_eq!(streams.len(), 2);
+        assert_eq!(streams[0]["stream"]["tenant"], "cs101");
+        assert_eq!(streams[0]["stream"]["env"], "prod");
+        assert_eq!(streams[0]["stream"]["job"], "isobox");
+        assert_eq!(streams[0]["values"][1][0], "1718000000000000000");
+
+        let bulk = elasticsearch_bulk("isobox-events", &batch[..1]);
+        let lines: Vec<serde_json::Value> = bulk
+            .lines()
+            .map(|line| serde_json::from_str(line).unwrap())
+            .collect();
+        assert_eq!(lines[0]["create"]["_index"], "isobox-events");
+        assert_eq!(lines[1]["@timestamp"], "2024-06-10T06:13:20Z");
+        assert_eq!(lines[1]["event"], "started");
+
+        assert_eq!(rfc3339(0), "1970-01-01T00:00:00Z");
+        assert_eq!(rfc3339(951_825_599), "2000-02-29T11:59:59Z");
+    }
+}
@@ -0,0 +1,276 @@
+use crate::queue::{JobQueue, JobState};
+use crate::stats;
+use futures::Stream;
+use std::collections::{HashSet, VecDeque};
+use std::process::Stdio;
+use std::sync::Arc;
+use std::time::Duration;
+use tokio::io::{AsyncBufRead, AsyncBufReadExt, BufReader};
+use tokio::process::Command;
+use tokio::sync::mpsc;
+
+// Lines buffered per container before its readers wait for the client
+const LOG_BUFFER: usize = 256;
+// How often a job without a running container is checked for one
+const POLL_INTERVAL: Duration = Duration::from_millis(250);
+// Keepalive comments stop proxies from closing idle connections
+const KEEPALIVE: Duration = Duration::from_secs(15);
+
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum LogStream {
+    Stdout,
+    Stderr,
+}
+
+impl LogStream {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Self::Stdout => "stdout",
+            Self::Stderr => "stderr",
+        }
+    }
+}
+
+/// A line of output from a job's sandbox
+#[derive(Debug, Clone, PartialEq)]
+pub struct LogLine {
+    pub stream: LogStream,
+    pub line: String,
+}
+
+impl LogLine {
+    /// Server-Sent Events frame, named after the stream the line was written to
+    pub fn to_sse(&self) -> String {
+        format!("event: {}\ndata: {}\n\n", self.stream.as_str(), self.line)
+    }
+}
+
+/// Reads the output a container has written so far, and with `follow` keeps
+/// reading until the container exits. The channel closes once the output ends.
+pub fn read(container: &str, follow: bool) -> Result<mpsc::Receiver<LogLine>, String> {
+    let mut command = Command::new("docker");
+    command.arg("logs");
+    if follow {
+        command.arg("--follow");
+    }
+    let mut child = command
+        .arg(container)
+        .stdin(Stdio::null())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .spawn()
+        .map_err(|e| format!("Failed to run docker: {e}"))?;
+
+    // `docker logs` replays the container's stdout and stderr on its own
+    let (sender, receiver) = mpsc::channel(LOG_BUFFER);
+    if let Some(stdout) = child.stdout.take() {
+        tokio::spawn(forward(
+            BufReader::new(stdout),
+            LogStream::Stdout,
+            sender.clone(),
+        ));
+    }
+    if let Some(stderr) = child.stderr.take() {
+        tokio::spawn(forward(BufReader::new(stderr), LogStream::Stderr, sender));
+    }
+    tokio::spawn(async move {
+        let _ = child.wait().await;
+    });
+    Ok(receiver)
+}
+
+async fn forward(
+    reader: impl AsyncBufRead + Unpin,
+    stream: LogStream,
+    sender: mpsc::Sender<LogLine>,
+) {
+    let mut lines = reader.lines();
+    while let Ok(Some(line)) = lines.next_line().await {
+        if sender.send(LogLine { stream, line }).await.is_err() {
+            // The client went away
+            break;
+        }
+    }
+}
+
+// Where a job's log tail has got to
+struct Tail {
+    queue: Arc<dyn JobQueue>,
+    job_id: String,
+    follow: bool,
+    // Output of the container being read
+    output: Option<mpsc::Receiver<LogLine>>,
+    // Containers already read, e.g. the compile step's
+    containers: HashSet<String>,
+    // Whether any output came from a container, rather than the job's result
+    streamed: bool,
+    frames: VecDeque<String>,
+    finished: bool,
+    idle: Duration,
+}
+
+/// Tails the combined stdout and stderr of a job as Server-Sent Events frames,
+/// reading its sandbox containers on this host one after another. Without
+/// `follow` the stream ends with the output written so far; with it the stream
+/// waits for more and ends with a `done` event once the job finishes. Output of a
+/// job that ran elsewhere, or finished before any of it could be read, is
+/// replayed from the job's result.
+pub fn tail(queue: Arc<dyn JobQueue>, job_id: String, follow: bool) -> impl Stream<Item = String> {
+    let tail = Tail {
+        queue,
+        job_id,
+        follow,
+        output: None,
+        containers: HashSet::new(),
+        streamed: false,
+        frames: VecDeque::new(),
+        finished: false,
+        idle: Duration::ZERO,
+    };
+    futures::stream::unfold(tail, |mut tail| async move {
+        let frame = tail.next_frame().await?;
+        tail.idle = Duration::ZERO;
+        Some((frame, tail))
+    })
+}
+
+impl Tail {
+    async fn next_frame(&mut self) -> Option<String> {
+        loop {
+            if let Some(frame) = self.frames.pop_front() {
+                return Some(frame);
+            }
+            if self.finished {
+                return None;
+            }
+            if let Some(output) = &mut self.output {
+                match tokio::time::timeout(KEEPALIVE, output.recv()).await {
+                    Ok(Some(line)) => {
+                        self.streamed = true;
+                        return Some(line.to_sse());
+                    }
+                    Ok(None) => self.output = None,
+                    Err(_) => return Some(": keepalive\n\n".to_string()),
+                }
+                continue;
+            }
+
+            let status = self.queue.get_status(&self.job_id).await.ok()??;
+            if matches!(status.state, JobState::Completed | JobState::Failed) {
+                if !self.streamed {
+                    if let Some(result) = &status.result {
+                        self.replay(LogStream::Stdout, &result.stdout);
+                        self.replay(LogStream::Stderr, &result.stderr);
+                    }
+                }
+                self.frames.push_back(format!(
+                    "event: done\ndata: {}\n\n",
+                    serde_json::json!({ "state": status.state })
+                ));
+                self.finished = true;
+                continue;
+            }
+
+            let job_id = self.job_id.clone();
+            let containers = tokio::task::spawn_blocking(move || stats::job_containers(&job_id))
+                .await
+                .ok()
+                .and_then(Result::ok)
+                .unwrap_or_default();
+            if let Some(container) = containers
+                .into_iter()
+                .find(|container| !self.containers.contains(container))
+            {
+                // A container removed before it could be read is skipped
+                self.output = read(&container, self.follow).ok();
+                self.containers.insert(container);
+                continue;
+            }
+            if !self.follow {
+                return None;
+            }
+            tokio::time::sleep(POLL_INTERVAL).await;
+            self.idle += POLL_INTERVAL;
+            if self.idle >= KEEPALIVE {
+                return Some(": keepalive\n\n".to_string());
+            }
+        }
+    }
+
+    fn replay(&mut self, stream: LogStream, output: &str) {
+        self.frames.extend(output.lines().map(|line| {
+            LogLine {
+                stream,
+                line: line.to_string(),
+            }
+            .to_sse()
+        }));
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::executor::ExecuteResponse;
+    use crate::queue::{JobStatus, MemoryQueue};
+    use futures::StreamExt;
+
+    #[tokio::test]
+    async fn test_forward() {
+        let (sender, mut receiver) = mpsc::channel(LOG_BUFFER);
+        forward(&b"first\n\nlast"[..], LogStream::Stderr, sender).await;
+        let mut lines = Vec::new();
+        while let Some(line) = receiver.recv().await {
+            lines.push(line.to_sse());
+        }
+        assert_eq!(
+            lines,
+            [
+                "event: stderr\ndata: first\n\n",
+                "event: stderr\ndata: \n\n",
+                "event: stderr\ndata: last\n\n",
+            ]
+        );
+    }
+
+    #[tokio::test]
+    async fn test_tail_replays_result() {
+        let queue: Arc<dyn JobQueue> = Arc::new(MemoryQueue::new());
+        let status = JobStatus {
+            id: "job-1".to_string(),
+            tenant: "default".to_string(),
+            state: JobState::Completed,
+            created_at: 0,
+            started_at: Some(0),
+            finished_at: Some(1),
+            result: Some(ExecuteResponse {
+                stdout: "1\n2\n".to_string(),
+                stderr: "warning\n".to_string(),
+                ..Default::default()
+            }),
+            error: None,
+            sequence: None,
+            position: None,
+            estimated_start_at: None,
+            preemptions: 0,
+        };
+        queue.put_status(&status).await.unwrap();
+
+        let frames: Vec<String> = tail(queue.clone(), "job-1".to_string(), true)
+            .collect()
+            .await;
+        assert_eq!(
+            frames,
+            [
+                "event: stdout\ndata: 1\n\n",
+                "event: stdout\ndata: 2\n\n",
+                "event: stderr\ndata: warning\n\n",
+                "event: done\ndata: {\"state\":\"completed\"}\n\n",
+            ]
+        );
+
+        // A job this instance doesn't know about has nothing to tail
+        let frames: Vec<String> = tail(queue, "job-2".to_string(), false).collect().await;
+        assert!(frames.is_empty());
+    }
+}
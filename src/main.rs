@@ -1,17 +1,128 @@
+mod abuse;
+mod activity;
+mod ansi;
+mod api_error;
+mod assignment;
+mod bundle;
+mod cache;
+mod cgroup;
+mod coldstart;
+mod concurrency;
+mod config;
+mod contention;
+mod coredump;
+mod cpuset;
+mod crypto;
+mod dataset;
+mod deadline;
+mod dependencies;
+mod deprecation;
+mod embedded;
+mod encoding;
+mod estimate;
+mod events;
 mod executor;
+mod fairshare;
+mod function_call;
+mod functions;
 mod generated;
 mod grpc;
-
-use crate::executor::{CodeExecutor, ExecuteRequest, TestCase};
-use crate::grpc::CodeExecutionServiceImpl;
-use actix_web::middleware::Logger;
-use actix_web::{web, App, HttpRequest, HttpResponse, HttpServer, Result};
+mod hooks;
+mod interactor;
+mod judge;
+mod labels;
+mod latency;
+mod log_export;
+mod logs;
+mod mirror;
+mod preset;
+mod priority;
+mod queue;
+mod ratelimit;
+mod redact;
+mod result_cache;
+mod routing;
+mod scan;
+mod seccomp;
+mod security;
+mod session;
+mod similarity;
+mod stats;
+mod store;
+mod syntax;
+mod terminal;
+mod termination;
+mod trace;
+mod trace_context;
+mod upload;
+mod usage;
+mod userns;
+mod webhook;
+mod worker;
+
+use crate::abuse::{Decision, FlagStatus, Restriction};
+use crate::activity::ActivityTracker;
+use crate::api_error::{with_request_id, ApiError, ErrorCode};
+use crate::assignment::{
+    submission_labels, Assignment, AssignmentError, AssignmentRegistry, AssignmentSpec,
+    SubmissionRequest,
+};
+use crate::bundle::{BundleError, BundleLayout};
+use crate::config::{data_dir, Channel, IsoboxConfig, DEFAULT_TENANT};
+use crate::deadline;
+use crate::estimate::Estimate;
+use crate::events::{EventBus, EventKind};
+use crate::executor::{
+    CheckRequest, CodeExecutor, ExecuteRequest, ExecutionError, RequestLimits, TestCase,
+};
+use crate::functions::{FunctionError, FunctionRegistry, FunctionSpec, Invocation, ScalingUpdate};
+use crate::grpc::{CodeExecutionServiceImpl, WorkerServiceImpl};
+use crate::judge::{JudgeProgram, TestGroup};
+use crate::log_export::LogShipper;
+use crate::mirror::{MirrorError, PackageMirror};
+use crate::preset::{PresetError, PresetSpec};
+use crate::queue::{JobQueue, JobState, QueueError, QueueProgress};
+use crate::ratelimit::{ClientLimiter, ClientRejection, RateLimitStatus, RateLimiter};
+use crate::routing::{ReplicaRouter, Route};
+use crate::seccomp::SyscallPolicy;
+use crate::session::{SessionError, SessionFilter, SessionManager, SessionOutput, WriteControl};
+use crate::store::{unix_timestamp, ExecutionFilter, ExecutionStatus, ExecutionStore};
+use crate::terminal::Terminal;
+use crate::trace_context::TraceContext;
+use crate::upload::{Multipart, UploadError};
+use crate::webhook::WebhookSink;
+use actix_web::body::{self, BodySize, MessageBody};
+use actix_web::dev::{ServiceRequest, ServiceResponse};
+use actix_web::error::{InternalError, JsonPayloadError};
+use actix_web::http::header::{self, HeaderName, HeaderValue, HttpDate};
+use actix_web::http::KeepAlive;
+use actix_web::http::StatusCode;
+use actix_web::middleware::{from_fn, Compress, DefaultHeaders, Logger, Next};
+use actix_web::{web, App, HttpMessage, HttpRequest, HttpResponse, HttpServer, Result};
 use jsonwebtoken::{decode, decode_header, Algorithm, DecodingKey, Validation};
 
+use futures::{FutureExt, StreamExt};
 use serde::Deserialize;
 use serde_json::Value;
-use std::collections::HashMap;
+use std::backtrace::Backtrace;
+use std::cell::RefCell;
+use std::collections::{HashMap, HashSet};
+use std::panic::AssertUnwindSafe;
+use std::path::PathBuf;
 use std::sync::Arc;
+use std::time::{Duration, SystemTime};
+use tokio::sync::broadcast;
+
+// How often an idle event stream sends a keepalive comment
+const SSE_KEEPALIVE: Duration = Duration::from_secs(15);
+// How often `/jobs/{id}/stats` samples a running job
+const STATS_INTERVAL: Duration = Duration::from_secs(1);
+
+// Versions of the HTTP API this server serves. A breaking change ships as a new
+// version while the older ones keep their behavior.
+const API_VERSIONS: &[&str] = &["v1"];
+// Names the API version that handled a request
+const API_VERSION_HEADER: &str = "isobox-api-version";
 
 #[derive(Debug, Deserialize)]
 pub struct TestCaseFile {
@@ -30,6 +141,12 @@ pub struct ExecuteWithTestCasesRequest {
     pub language: String,
     pub code: String,
     pub test_cases: Vec<TestCase>,
+    pub test_groups: Option<Vec<TestGroup>>,
+    pub stop_on_failure: Option<bool>,
+    pub interactor: Option<JudgeProgram>,
+    pub checker: Option<JudgeProgram>,
+    pub harness: Option<String>,
+    pub harness_params: Option<HashMap<String, String>>,
 }
 
 #[derive(Debug, Deserialize)]
@@ -37,6 +154,75 @@ pub struct ExecuteWithTestFilesRequest {
     pub language: String,
     pub code: String,
     pub test_files: Vec<TestCaseFile>,
+    pub harness: Option<String>,
+    pub harness_params: Option<HashMap<String, String>>,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct CreateSessionRequest {
+    #[serde(default)]
+    pub language: Option<String>,
+    /// Snapshot to fork the session from
+    #[serde(default)]
+    pub snapshot: Option<String>,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct ExecutionHistoryQuery {
+    pub language: Option<String>,
+    pub status: Option<ExecutionStatus>,
+    pub tenant: Option<String>,
+    pub label: Option<String>,
+    pub channel: Option<Channel>,
+    pub since: Option<u64>,
+    pub until: Option<u64>,
+    pub q: Option<String>,
+    pub trace_id: Option<String>,
+    pub cursor: Option<String>,
+    pub limit: Option<usize>,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct ShareSessionRequest {
+    /// Tenants that may attach to the session, replacing the current ones
+    pub guests: Vec<String>,
+    #[serde(default)]
+    pub write: WriteControl,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct SimilarityRequest {
+    /// Stored executions whose code is compared, pairwise
+    pub ids: Vec<String>,
+}
+
+// Most executions one similarity request compares, keeping it to ~5000 pairs
+const MAX_SIMILARITY_EXECUTIONS: usize = 100;
+
+#[derive(Debug, Deserialize)]
+pub struct SubmissionListQuery {
+    pub student: Option<String>,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct SessionListQuery {
+    pub tenant: Option<String>,
+    pub language: Option<String>,
+    pub min_age_seconds: Option<u64>,
+    pub min_idle_seconds: Option<u64>,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct ExecuteQuery {
+    /// Validates the request and returns what it would run with, without running it
+    #[serde(default)]
+    pub dry_run: bool,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct TenantDataQuery {
+    /// Limits the deletion to executions with this label, e.g. a student id
+    pub label: Option<String>,
 }
 
 #[derive(Debug, Deserialize)]
@@ -44,10 +230,548 @@ pub struct ExecuteWithTestUrlsRequest {
     pub language: String,
     pub code: String,
     pub test_urls: Vec<TestCaseUrl>,
+    pub harness: Option<String>,
+    pub harness_params: Option<HashMap<String, String>>,
+}
+
+// Authentication function using the new auth system.
+// Returns the tenant the caller authenticated as, once its rate limit allows the request.
+async fn authenticate_request(request: &HttpRequest) -> Result<String, HttpResponse> {
+    let tenant = authenticate_tenant(request).await?;
+    check_abuse_restriction(request, &tenant)?;
+    check_rate_limit(request, &tenant)?;
+    Ok(tenant)
+}
+
+// Refuses banned tenants and holds throttled ones to the abuse throttle rate
+fn check_abuse_restriction(request: &HttpRequest, tenant: &str) -> Result<(), HttpResponse> {
+    let Some(executor) = request.app_data::<web::Data<Arc<CodeExecutor>>>() else {
+        return Ok(());
+    };
+    match executor.abuse().restriction(tenant) {
+        None => Ok(()),
+        Some(Restriction::Ban) => Err(ApiError::new(
+            ErrorCode::Forbidden,
+            format!("Tenant '{tenant}' is suspended for abuse"),
+        )
+        .response()),
+        Some(Restriction::Throttle) => {
+            let Some(limiter) = request.app_data::<web::Data<Arc<RateLimiter>>>() else {
+                return Ok(());
+            };
+            let limit = executor.abuse().throttle();
+            limiter
+                .check(&format!("{tenant}|abuse"), limit)
+                .map_err(|retry_after| {
+                    rate_limited(
+                        retry_after,
+                        format!(
+                            "Tenant '{tenant}' is throttled for abuse to {} requests per second, retry in {:.1}s",
+                            limit.rate,
+                            retry_after.as_secs_f64()
+                        ),
+                    )
+                })
+        }
+    }
+}
+
+// Takes a token from the tenant's bucket for the matched route, if it has a limit
+fn check_rate_limit(request: &HttpRequest, tenant: &str) -> Result<(), HttpResponse> {
+    request.extensions_mut().insert(LimitStatus {
+        tenant: tenant.to_string(),
+        rate: None,
+    });
+    let (Some(executor), Some(limiter)) = (
+        request.app_data::<web::Data<Arc<CodeExecutor>>>(),
+        request.app_data::<web::Data<Arc<RateLimiter>>>(),
+    ) else {
+        return Ok(());
+    };
+    let route = request
+        .match_pattern()
+        .unwrap_or_else(|| request.path().to_string());
+    let Some((scope, limit)) = executor.config().rate_limit(tenant, &route) else {
+        return Ok(());
+    };
+
+    let key = format!("{tenant}|{scope}");
+    let result = limiter.check(&key, limit);
+    if let Some(status) = request.extensions_mut().get_mut::<LimitStatus>() {
+        status.rate = Some(limiter.status(&key, limit));
+    }
+    result.map_err(|retry_after| {
+        rate_limited(
+            retry_after,
+            format!(
+                "Limit of {} requests per second (burst {}) exceeded, retry in {:.1}s",
+                limit.rate,
+                limit.burst,
+                retry_after.as_secs_f64()
+            ),
+        )
+    })
+}
+
+// The caller's limits, left on the request for `report_limits`
+#[derive(Clone)]
+struct LimitStatus {
+    tenant: String,
+    rate: Option<RateLimitStatus>,
+}
+
+// Tells authenticated callers how much of their rate limit and daily GPU quota is
+// left, so clients can slow down before they are rejected
+async fn report_limits(
+    request: ServiceRequest,
+    next: Next<impl MessageBody>,
+) -> Result<ServiceResponse<impl MessageBody>> {
+    let mut response = next.call(request).await?;
+    let status = response
+        .request()
+        .extensions()
+        .get::<LimitStatus>()
+        .cloned();
+    let Some(status) = status else {
+        return Ok(response);
+    };
+    let quota_remaining = response
+        .request()
+        .app_data::<web::Data<Arc<CodeExecutor>>>()
+        .and_then(|executor| executor.gpu_seconds_remaining(&status.tenant));
+
+    let headers = response.headers_mut();
+    let mut insert = |name: &'static str, value: String| {
+        if let Ok(value) = header::HeaderValue::from_str(&value) {
+            headers.insert(header::HeaderName::from_static(name), value);
+        }
+    };
+    if let Some(rate) = status.rate {
+        insert("x-ratelimit-limit", rate.limit.to_string());
+        insert("x-ratelimit-remaining", rate.remaining.to_string());
+        insert(
+            "x-ratelimit-reset",
+            rate.reset.as_secs_f64().ceil().to_string(),
+        );
+    }
+    if let Some(remaining) = quota_remaining {
+        insert("x-quota-remaining", remaining.floor().to_string());
+    }
+    Ok(response)
+}
+
+// 429 with a Retry-After header, shared by the tenant and client IP rate limits
+fn rate_limited(retry_after: Duration, message: String) -> HttpResponse {
+    ApiError::new(ErrorCode::RateLimited, message)
+        .with_retry_after(retry_after)
+        .response()
+}
+
+// Applies the per-client-IP limits to the versioned API, which keep one visitor of a
+// public deployment from monopolizing it. Requests count towards the concurrency limit
+// until their handler returns.
+async fn limit_clients(
+    request: ServiceRequest,
+    next: Next<impl MessageBody>,
+) -> Result<ServiceResponse<impl MessageBody>> {
+    let limiter = request
+        .app_data::<web::Data<Arc<ClientLimiter>>>()
+        .filter(|limiter| limiter.is_enabled())
+        .cloned();
+    let (Some(limiter), Some(peer)) = (limiter, request.peer_addr()) else {
+        return next
+            .call(request)
+            .await
+            .map(ServiceResponse::map_into_left_body);
+    };
+    let forwarded_for = request
+        .headers()
+        .get("X-Forwarded-For")
+        .and_then(|value| value.to_str().ok());
+    let ip = limiter.client_ip(peer.ip(), forwarded_for);
+    // A concurrency slot frees up when one of the client's executions finishes
+    let retry_after = request
+        .app_data::<web::Data<Arc<CodeExecutor>>>()
+        .map_or(latency::DEFAULT_RETRY_AFTER, |executor| {
+            executor.latency().retry_after()
+        });
+
+    let response = match limiter.admit(ip) {
+        Ok(_permit) => {
+            return next
+                .call(request)
+                .await
+                .map(ServiceResponse::map_into_left_body)
+        }
+        Err(ClientRejection::RateLimited(retry_after)) => rate_limited(
+            retry_after,
+            format!(
+                "Too many requests from {ip}, retry in {:.1}s",
+                retry_after.as_secs_f64()
+            ),
+        ),
+        Err(ClientRejection::TooManyConcurrent(max)) => ApiError::new(
+            ErrorCode::LimitExceeded,
+            format!("{ip} already has {max} requests in progress"),
+        )
+        .with_details(serde_json::json!({ "max_concurrent": max }))
+        .with_retry_after(retry_after)
+        .response(),
+    };
+    Ok(request.into_response(response).map_into_right_body())
+}
+
+// Refuses every /admin route to callers that aren't admin tenants, so a route added
+// without its own check isn't public. Handlers still authenticate themselves, which
+// also applies rate limits.
+async fn require_admin(
+    request: ServiceRequest,
+    next: Next<impl MessageBody>,
+) -> Result<ServiceResponse<impl MessageBody>> {
+    let refused = match request.app_data::<web::Data<Arc<CodeExecutor>>>() {
+        Some(executor) => match authenticate_tenant(request.request()).await {
+            Ok(tenant) if is_admin(executor, &tenant) => None,
+            Ok(_) => Some(
+                ApiError::new(
+                    ErrorCode::Forbidden,
+                    "The admin API requires an admin tenant",
+                )
+                .response(),
+            ),
+            Err(response) => Some(response),
+        },
+        None => Some(ApiError::new(ErrorCode::Internal, "Executor is not configured").response()),
+    };
+    match refused {
+        None => next
+            .call(request)
+            .await
+            .map(ServiceResponse::map_into_left_body),
+        Some(response) => Ok(request.into_response(response).map_into_right_body()),
+    }
+}
+
+// Sends session and function calls carrying another replica's routing token to
+// that replica, and gives successful ones handled here this replica's token, so
+// clients and load balancers can send later calls to where the state lives.
+// WebSocket upgrades can't be forwarded and are left to the load balancer.
+async fn route_to_replica(
+    mut request: ServiceRequest,
+    next: Next<impl MessageBody>,
+) -> Result<ServiceResponse<impl MessageBody>> {
+    let router = request
+        .app_data::<web::Data<Arc<ReplicaRouter>>>()
+        .filter(|_| routing::holds_state(request.path()))
+        .cloned();
+    let Some(router) = router else {
+        return next
+            .call(request)
+            .await
+            .map(ServiceResponse::map_into_left_body);
+    };
+    let forwardable = !request.headers().contains_key(routing::FORWARDED_HEADER)
+        && !request.headers().contains_key(header::UPGRADE);
+    let peer = request
+        .headers()
+        .get(routing::ROUTE_HEADER)
+        .and_then(|value| value.to_str().ok())
+        .filter(|_| forwardable)
+        .and_then(|token| match router.route(token) {
+            Route::Peer(url) => Some(url.to_string()),
+            Route::Local => None,
+        });
+
+    let Some(peer) = peer else {
+        let mut response = next.call(request).await?;
+        let token = router
+            .token()
+            .and_then(|token| HeaderValue::from_str(token).ok());
+        if let Some(token) = token.filter(|_| response.status().is_success()) {
+            response
+                .headers_mut()
+                .insert(HeaderName::from_static(routing::ROUTE_HEADER), token);
+        }
+        return Ok(response.map_into_left_body());
+    };
+
+    let max_bytes = request
+        .app_data::<web::Data<MaxRequestBytes>>()
+        .map_or(usize::MAX, |max| max.0);
+    let mut payload = request.take_payload();
+    let mut body = web::BytesMut::new();
+    while let Some(chunk) = payload.next().await {
+        body.extend_from_slice(&chunk?);
+        if body.len() > max_bytes {
+            let response = ApiError::new(
+                ErrorCode::PayloadTooLarge,
+                format!("The request body is over {max_bytes} bytes"),
+            )
+            .response();
+            return Ok(request.into_response(response).map_into_right_body());
+        }
+    }
+    let path_and_query = request
+        .uri()
+        .path_and_query()
+        .map_or(request.path(), |path| path.as_str())
+        .to_string();
+    let client = request.peer_addr().map(|addr| addr.ip());
+    let response = match router
+        .forward(
+            &peer,
+            request.method(),
+            &path_and_query,
+            request.headers(),
+            client,
+            body.freeze(),
+        )
+        .await
+    {
+        Ok(response) => response,
+        Err(e) => {
+            log::warn!("Failed to forward {path_and_query} to its replica: {e}");
+            ApiError::new(
+                ErrorCode::UpstreamFailed,
+                "The replica holding this session or function can't be reached",
+            )
+            .response()
+        }
+    };
+    Ok(request.into_response(response).map_into_right_body())
+}
+
+// Identifies a request in logs and error responses. Taken from the caller's header
+// when it is usable, so ids can be traced across services.
+const REQUEST_ID_HEADER: &str = "x-request-id";
+
+thread_local! {
+    // Message and backtrace of the last panic on this thread, left by the panic hook
+    static LAST_PANIC: RefCell<Option<String>> = const { RefCell::new(None) };
+}
+
+// Records the backtrace of every panic so the recovery middleware can log it with
+// the id of the request that caused it
+fn install_panic_hook() {
+    let default_hook = std::panic::take_hook();
+    std::panic::set_hook(Box::new(move |info| {
+        let report = format!("{info}\n{}", Backtrace::force_capture());
+        LAST_PANIC.with(|last| *last.borrow_mut() = Some(report));
+        default_hook(info);
+    }));
+}
+
+// Assigns every request an id and turns a panicking handler into a JSON 500, so one
+// bad request gets an answer instead of a dropped connection.
+async fn recover_panics(
+    request: ServiceRequest,
+    next: Next<impl MessageBody>,
+) -> Result<ServiceResponse<impl MessageBody>> {
+    let request_id = request
+        .headers()
+        .get(REQUEST_ID_HEADER)
+        .and_then(|value| value.to_str().ok())
+        .filter(|id| !id.is_empty() && id.len() <= 128 && id.chars().all(|c| c.is_ascii_graphic()))
+        .map(str::to_string)
+        .unwrap_or_else(|| uuid::Uuid::new_v4().to_string());
+    let http_request = request.request().clone();
+
+    let handler = with_request_id(request_id.clone(), next.call(request));
+    let mut response = match AssertUnwindSafe(handler).catch_unwind().await {
+        Ok(Ok(response)) => response.map_into_left_body(),
+        Ok(Err(e)) => ServiceResponse::from_err(e, http_request).map_into_right_body(),
+        Err(_) => {
+            let report = LAST_PANIC
+                .with(|last| last.borrow_mut().take())
+                .unwrap_or_else(|| "panic without a report".to_string());
+            log::error!(
+                "Request {request_id} ({} {}) panicked: {report}",
+                http_request.method(),
+                http_request.path()
+            );
+            // The handler's request id scope has ended, so the id is set explicitly
+            let response = ApiError {
+                request_id: Some(request_id.clone()),
+                ..ApiError::new(ErrorCode::Internal, "The request failed unexpectedly")
+            }
+            .response();
+            ServiceResponse::new(http_request, response).map_into_right_body()
+        }
+    };
+    if let Ok(value) = HeaderValue::from_str(&request_id) {
+        response
+            .headers_mut()
+            .insert(HeaderName::from_static(REQUEST_ID_HEADER), value);
+    }
+    Ok(response)
 }
 
-// Authentication function using the new auth system
-async fn authenticate_request(request: &HttpRequest) -> Result<(), HttpResponse> {
+// Marks responses to deprecated endpoints with Deprecation (RFC 9745), Sunset
+// (RFC 8594), and successor Link headers, and adds a warning to JSON bodies so
+// integrators notice without watching headers
+async fn signal_deprecations(
+    request: ServiceRequest,
+    next: Next<impl MessageBody>,
+) -> Result<ServiceResponse<impl MessageBody>> {
+    let Some(deprecation) = deprecation::find(request.path()) else {
+        return next
+            .call(request)
+            .await
+            .map(ServiceResponse::map_into_left_body);
+    };
+    let warning = deprecation.warning(request.path());
+
+    let (http_request, response) = next.call(request).await?.into_parts();
+    let is_json = response
+        .headers()
+        .get(header::CONTENT_TYPE)
+        .and_then(|value| value.to_str().ok())
+        .is_some_and(|value| value.starts_with("application/json"));
+    let (mut response, response_body) = response.into_parts();
+    let response_body = if is_json {
+        let bytes = body::to_bytes(response_body).await.map_err(|e| {
+            let e: Box<dyn std::error::Error> = e.into();
+            actix_web::error::ErrorInternalServerError(e.to_string())
+        })?;
+        deprecation::add_warning(&bytes, &warning)
+            .map(web::Bytes::from)
+            .unwrap_or(bytes)
+            .boxed()
+    } else {
+        response_body.boxed()
+    };
+
+    let headers = response.headers_mut();
+    if let Ok(value) = HeaderValue::from_str(&format!("@{}", warning.deprecated_at)) {
+        headers.insert(HeaderName::from_static("deprecation"), value);
+    }
+    if let Some(sunset_at) = warning.sunset_at {
+        if let Ok(value) = HeaderValue::from_str(
+            &HttpDate::from(SystemTime::UNIX_EPOCH + Duration::from_secs(sunset_at)).to_string(),
+        ) {
+            headers.insert(HeaderName::from_static("sunset"), value);
+        }
+    }
+    if let Ok(value) = HeaderValue::from_str(&format!(
+        "<{}>; rel=\"successor-version\"",
+        warning.successor
+    )) {
+        headers.append(header::LINK, value);
+    }
+
+    let response = response.set_body(response_body);
+    Ok(ServiceResponse::new(http_request, response).map_into_right_body())
+}
+
+// Connection handling of the HTTP server. The timeouts bound how long a client can hold
+// a connection without completing a request, so slow clients can't exhaust the server.
+struct HttpSettings {
+    // Time a client has to send the request head after connecting
+    request_timeout: Duration,
+    // Time a client has to acknowledge the connection being closed
+    disconnect_timeout: Duration,
+    keep_alive: KeepAlive,
+    // Per worker thread
+    max_connections: usize,
+    // New connections per second per worker thread
+    max_connection_rate: usize,
+    max_header_bytes: usize,
+    // Serves HTTP/2 without TLS alongside HTTP/1, for clients and proxies using h2c
+    h2c: bool,
+}
+
+impl HttpSettings {
+    fn from_env() -> Self {
+        let var = |name: &str, default: u64| {
+            std::env::var(name)
+                .ok()
+                .and_then(|s| s.parse::<u64>().ok())
+                .unwrap_or(default)
+        };
+        Self {
+            request_timeout: Duration::from_millis(var("HTTP_REQUEST_TIMEOUT_MS", 5000)),
+            disconnect_timeout: Duration::from_millis(var("HTTP_DISCONNECT_TIMEOUT_MS", 1000)),
+            keep_alive: match var("HTTP_KEEP_ALIVE_SECONDS", 5) {
+                0 => KeepAlive::Disabled,
+                seconds => KeepAlive::Timeout(Duration::from_secs(seconds)),
+            },
+            max_connections: var("HTTP_MAX_CONNECTIONS", 25_000) as usize,
+            max_connection_rate: var("HTTP_MAX_CONNECTION_RATE", 256) as usize,
+            max_header_bytes: var("HTTP_MAX_HEADER_BYTES", 16 * 1024) as usize,
+            h2c: std::env::var("HTTP2_CLEARTEXT").is_ok_and(|s| s == "true"),
+        }
+    }
+}
+
+// Rejects requests whose headers add up to more than HTTP_MAX_HEADER_BYTES
+async fn limit_header_size(
+    request: ServiceRequest,
+    next: Next<impl MessageBody>,
+) -> Result<ServiceResponse<impl MessageBody>> {
+    let max_bytes = request
+        .app_data::<web::Data<HttpSettings>>()
+        .map_or(usize::MAX, |settings| settings.max_header_bytes);
+    let size: usize = request
+        .headers()
+        .iter()
+        .map(|(name, value)| name.as_str().len() + value.len())
+        .sum();
+    if size <= max_bytes {
+        return next
+            .call(request)
+            .await
+            .map(ServiceResponse::map_into_left_body);
+    }
+    let response = ApiError::new(
+        ErrorCode::HeadersTooLarge,
+        format!("Request headers are {size} bytes, the limit is {max_bytes} bytes"),
+    )
+    .response();
+    Ok(request.into_response(response).map_into_right_body())
+}
+
+// Responses smaller than this aren't compressed
+struct CompressionThreshold(u64);
+
+// Largest JSON body, which also bounds the request part of an upload
+struct MaxRequestBytes(usize);
+
+// Opts small and already-compressed responses, and event streams that must reach the
+// client as they are written, out of compression by the Compress middleware
+async fn skip_compression(
+    request: ServiceRequest,
+    next: Next<impl MessageBody>,
+) -> Result<ServiceResponse<impl MessageBody>> {
+    let min_bytes = request
+        .app_data::<web::Data<CompressionThreshold>>()
+        .map_or(0, |threshold| threshold.0);
+    let mut response = next.call(request).await?;
+
+    let small =
+        matches!(response.response().body().size(), BodySize::Sized(size) if size < min_bytes);
+    let incompressible = response
+        .headers()
+        .get(header::CONTENT_TYPE)
+        .and_then(|value| value.to_str().ok())
+        .is_some_and(|content_type| {
+            [
+                "text/event-stream",
+                "application/gzip",
+                "application/zstd",
+                "application/zip",
+            ]
+            .iter()
+            .any(|skipped| content_type.starts_with(skipped))
+        });
+    if small || incompressible {
+        response.headers_mut().insert(
+            header::CONTENT_ENCODING,
+            HeaderValue::from_static("identity"),
+        );
+    }
+    Ok(response)
+}
+
+async fn authenticate_tenant(request: &HttpRequest) -> Result<String, HttpResponse> {
     // Check if authentication is disabled
     let auth_enabled = std::env::var("AUTH_ENABLED")
         .unwrap_or_else(|_| "true".to_string())
@@ -55,14 +779,14 @@ async fn authenticate_request(request: &HttpRequest) -> Result<(), HttpResponse>
         .unwrap_or(true);
 
     if !auth_enabled {
-        return Ok(());
+        return Ok(DEFAULT_TENANT.to_string());
     }
 
     // Check authentication type
     let auth_type = std::env::var("AUTH_TYPE").unwrap_or_else(|_| "apikey".to_string());
 
     match auth_type.as_str() {
-        "none" => Ok(()),
+        "none" => Ok(DEFAULT_TENANT.to_string()),
         "apikey" => authenticate_apikey(request),
         "jwt" => authenticate_jwt(request).await,
         "oauth2" => authenticate_oauth2(request).await,
@@ -70,14 +794,15 @@ async fn authenticate_request(request: &HttpRequest) -> Result<(), HttpResponse>
     }
 }
 
-fn authenticate_apikey(request: &HttpRequest) -> Result<(), HttpResponse> {
+fn authenticate_apikey(request: &HttpRequest) -> Result<String, HttpResponse> {
     // Get API key from header
     let api_key = request.headers().get("X-API-Key");
     if api_key.is_none() {
-        return Err(HttpResponse::Unauthorized().json(serde_json::json!({
-            "error": "API Key not provided",
-            "message": "Please provide an X-API-Key header"
-        })));
+        return Err(ApiError::new(
+            ErrorCode::Unauthenticated,
+            "Please provide an X-API-Key header",
+        )
+        .response());
     }
 
     // Validate API key
@@ -88,32 +813,41 @@ fn authenticate_apikey(request: &HttpRequest) -> Result<(), HttpResponse> {
         .map(|s| s.trim())
         .collect::<Vec<_>>();
 
-    if !valid_keys.contains(&provided_key) {
-        return Err(HttpResponse::Unauthorized().json(serde_json::json!({
-            "error": "Invalid API Key",
-            "message": "The provided API key is not valid"
-        })));
+    // Keys listed under a tenant in the config file authenticate as that tenant
+    let tenant = request
+        .app_data::<web::Data<Arc<CodeExecutor>>>()
+        .and_then(|executor| executor.config().tenant_for_api_key(provided_key))
+        .map(|tenant| tenant.to_string());
+
+    if tenant.is_none() && !valid_keys.contains(&provided_key) {
+        return Err(ApiError::new(
+            ErrorCode::Unauthenticated,
+            "The provided API key is not valid",
+        )
+        .response());
     }
 
-    Ok(())
+    Ok(tenant.unwrap_or_else(|| DEFAULT_TENANT.to_string()))
 }
 
-async fn authenticate_jwt(request: &HttpRequest) -> Result<(), HttpResponse> {
+async fn authenticate_jwt(request: &HttpRequest) -> Result<String, HttpResponse> {
     // Get JWT token from Authorization header
     let auth_header = request.headers().get("Authorization");
     if auth_header.is_none() {
-        return Err(HttpResponse::Unauthorized().json(serde_json::json!({
-            "error": "Authorization header not provided",
-            "message": "Please provide an Authorization header with Bearer token"
-        })));
+        return Err(ApiError::new(
+            ErrorCode::Unauthenticated,
+            "Please provide an Authorization header with Bearer token",
+        )
+        .response());
     }
 
     let auth_value = auth_header.unwrap().to_str().unwrap_or("");
     if !auth_value.starts_with("Bearer ") {
-        return Err(HttpResponse::Unauthorized().json(serde_json::json!({
-            "error": "Invalid Authorization header format",
-            "message": "Authorization header must start with 'Bearer '"
-        })));
+        return Err(ApiError::new(
+            ErrorCode::Unauthenticated,
+            "Authorization header must start with 'Bearer '",
+        )
+        .response());
     }
 
     let token = &auth_value[7..]; // Remove "Bearer " prefix
@@ -124,30 +858,29 @@ async fn authenticate_jwt(request: &HttpRequest) -> Result<(), HttpResponse> {
 
     // Validate JWT token
     match validate_jwt_token(token, &issuer_url, &audience).await {
-        Ok(_) => Ok(()),
-        Err(e) => Err(HttpResponse::Unauthorized().json(serde_json::json!({
-            "error": "Invalid JWT token",
-            "message": e
-        }))),
+        Ok(_) => Ok(DEFAULT_TENANT.to_string()),
+        Err(e) => Err(ApiError::new(ErrorCode::Unauthenticated, e).response()),
     }
 }
 
-async fn authenticate_oauth2(request: &HttpRequest) -> Result<(), HttpResponse> {
+async fn authenticate_oauth2(request: &HttpRequest) -> Result<String, HttpResponse> {
     // Get OAuth2 token from Authorization header
     let auth_header = request.headers().get("Authorization");
     if auth_header.is_none() {
-        return Err(HttpResponse::Unauthorized().json(serde_json::json!({
-            "error": "Authorization header not provided",
-            "message": "Please provide an Authorization header with Bearer token"
-        })));
+        return Err(ApiError::new(
+            ErrorCode::Unauthenticated,
+            "Please provide an Authorization header with Bearer token",
+        )
+        .response());
     }
 
     let auth_value = auth_header.unwrap().to_str().unwrap_or("");
     if !auth_value.starts_with("Bearer ") {
-        return Err(HttpResponse::Unauthorized().json(serde_json::json!({
-            "error": "Invalid Authorization header format",
-            "message": "Authorization header must start with 'Bearer '"
-        })));
+        return Err(ApiError::new(
+            ErrorCode::Unauthenticated,
+            "Authorization header must start with 'Bearer '",
+        )
+        .response());
     }
 
     let token = &auth_value[7..]; // Remove "Bearer " prefix
@@ -162,25 +895,27 @@ async fn authenticate_oauth2(request: &HttpRequest) -> Result<(), HttpResponse>
     if provider == "firebase" {
         // Simple validation - in production, you would verify the token with Firebase
         if token.is_empty() || token == "invalid-firebase-token-123" {
-            return Err(HttpResponse::Unauthorized().json(serde_json::json!({
-                "error": "Invalid OAuth2 token",
-                "message": "The provided Firebase token is not valid"
-            })));
+            return Err(ApiError::new(
+                ErrorCode::Unauthenticated,
+                "The provided Firebase token is not valid",
+            )
+            .response());
         }
 
         // For testing purposes, accept any non-empty token that's not explicitly invalid
         if token.starts_with("mock-firebase-token-")
             || (!token.starts_with("invalid-") && !token.is_empty())
         {
-            return Ok(());
+            return Ok(DEFAULT_TENANT.to_string());
         }
     }
 
     // For other providers, you would implement proper OAuth2 validation
-    Err(HttpResponse::Unauthorized().json(serde_json::json!({
-        "error": "OAuth2 authentication not implemented for provider",
-        "message": format!("OAuth2 provider '{}' not yet implemented", provider)
-    })))
+    Err(ApiError::new(
+        ErrorCode::Unauthenticated,
+        format!("OAuth2 provider '{}' not yet implemented", provider),
+    )
+    .response())
 }
 
 async fn validate_jwt_token(token: &str, issuer_url: &str, audience: &str) -> Result<(), String> {
@@ -232,24 +967,155 @@ async fn validate_jwt_token(token: &str, issuer_url: &str, audience: &str) -> Re
 async fn execute_code(
     executor: web::Data<Arc<CodeExecutor>>,
     request: web::Json<crate::executor::ExecuteRequest>,
+    query: web::Query<ExecuteQuery>,
     http_request: HttpRequest,
 ) -> Result<HttpResponse> {
     // Authenticate request
-    if let Err(response) = authenticate_request(&http_request).await {
-        return Ok(response);
-    }
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    let deadline = match request_deadline(&http_request) {
+        Ok(deadline) => deadline,
+        Err(response) => return Ok(response),
+    };
 
-    let result = executor.execute(request.into_inner()).await;
+    let mut request = request.into_inner();
+    request.tenant = Some(tenant);
+    request.deadline = deadline;
+    request.trace_context = request_trace_context(&http_request);
+    if query.dry_run {
+        return match executor.plan(request) {
+            Ok(plan) => Ok(HttpResponse::Ok().json(plan)),
+            Err(e) => Ok(execution_error_response(e)),
+        };
+    }
+    let result = executor.execute(request).await;
 
     match result {
+        Ok(response) => Ok(encoding::respond_execution(&http_request, &response)),
+        Err(e) => Ok(execution_error_response(e)),
+    }
+}
+
+// The resources a request would reserve and what they'd cost, without running it
+async fn estimate_cost(
+    executor: web::Data<Arc<CodeExecutor>>,
+    request: web::Json<crate::executor::ExecuteRequest>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    let deadline = match request_deadline(&http_request) {
+        Ok(deadline) => deadline,
+        Err(response) => return Ok(response),
+    };
+
+    let mut request = request.into_inner();
+    request.tenant = Some(tenant);
+    request.deadline = deadline;
+    request.trace_context = request_trace_context(&http_request);
+    match executor.plan(request) {
+        Ok(plan) => {
+            Ok(HttpResponse::Ok().json(Estimate::new(plan, executor.config().metering.as_ref())))
+        }
+        Err(e) => Ok(execution_error_response(e)),
+    }
+}
+
+async fn check_code(
+    executor: web::Data<Arc<CodeExecutor>>,
+    request: web::Json<CheckRequest>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    match executor.check_syntax(request.into_inner(), &tenant).await {
         Ok(response) => Ok(HttpResponse::Ok().json(response)),
-        Err(e) => Ok(HttpResponse::InternalServerError().json(serde_json::json!({
-            "error": "Execution failed",
-            "message": e.to_string()
-        }))),
+        Err(e) => Ok(execution_error_response(e)),
     }
 }
 
+// The caller's X-Request-Deadline, if it sent one
+fn request_deadline(http_request: &HttpRequest) -> Result<Option<SystemTime>, HttpResponse> {
+    let Some(value) = http_request.headers().get(deadline::HEADER) else {
+        return Ok(None);
+    };
+    deadline::parse_header(value.to_str().unwrap_or_default())
+        .map(Some)
+        .map_err(|e| ApiError::new(ErrorCode::InvalidRequest, e).response())
+}
+
+// The caller's W3C Trace Context; a malformed traceparent is ignored, as if the
+// request had none
+fn request_trace_context(http_request: &HttpRequest) -> Option<TraceContext> {
+    let header = |name: &str| {
+        http_request
+            .headers()
+            .get(name)
+            .and_then(|value| value.to_str().ok())
+    };
+    TraceContext::parse(
+        header(trace_context::TRACEPARENT)?,
+        header(trace_context::TRACESTATE),
+    )
+}
+
+fn execution_error_response(error: ExecutionError) -> HttpResponse {
+    ApiError::from(&error).response()
+}
+
+fn payload_too_large(field: &str, message: &str) -> HttpResponse {
+    ApiError::new(ErrorCode::PayloadTooLarge, message)
+        .with_details(serde_json::json!({ "field": field }))
+        .response()
+}
+
+// Rejects oversized bodies before they are decoded, and reports malformed JSON in the
+// same shape as other errors
+fn json_error_handler(error: JsonPayloadError, _request: &HttpRequest) -> actix_web::Error {
+    let response = match &error {
+        JsonPayloadError::OverflowKnownLength { length, limit } => payload_too_large(
+            "body",
+            &format!("body is {length} bytes, the limit is {limit} bytes"),
+        ),
+        JsonPayloadError::Overflow { limit } => {
+            payload_too_large("body", &format!("body exceeds the limit of {limit} bytes"))
+        }
+        _ => ApiError::new(ErrorCode::InvalidRequest, error.to_string()).response(),
+    };
+    InternalError::from_response(error, response).into()
+}
+
+async fn list_api_versions() -> Result<HttpResponse> {
+    Ok(HttpResponse::Ok().json(serde_json::json!({
+        "current": API_VERSIONS[API_VERSIONS.len() - 1],
+        "versions": API_VERSIONS
+    })))
+}
+
+// Requests to a version this server doesn't serve, e.g. a client built for a newer
+// server
+async fn unsupported_api_version(path: web::Path<String>) -> Result<HttpResponse> {
+    let requested = format!("v{}", path.into_inner());
+    Ok(ApiError::new(
+        ErrorCode::UnsupportedApiVersion,
+        format!("API version {requested} is not supported"),
+    )
+    .with_details(serde_json::json!({
+        "requested": requested,
+        "supported": API_VERSIONS
+    }))
+    .response())
+}
+
 async fn health_check() -> Result<HttpResponse> {
     Ok(HttpResponse::Ok().json(serde_json::json!({
         "status": "healthy",
@@ -273,89 +1139,431 @@ async fn auth_status(_request: HttpRequest) -> Result<HttpResponse> {
     })))
 }
 
-async fn dedup_stats(_executor: web::Data<Arc<CodeExecutor>>) -> Result<HttpResponse> {
+async fn list_workers(
+    executor: web::Data<Arc<CodeExecutor>>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    if let Err(response) = authenticate_admin(&http_request, &executor, "Listing workers").await {
+        return Ok(response);
+    }
     Ok(HttpResponse::Ok().json(serde_json::json!({
-        "dedup_enabled": false,
-        "message": "Deduplication not implemented in simplified version"
+        "workers": executor.workers().workers()
     })))
 }
 
-async fn execute_with_test_cases(
+async fn drain_worker(
     executor: web::Data<Arc<CodeExecutor>>,
-    request: web::Json<ExecuteWithTestCasesRequest>,
+    path: web::Path<String>,
     http_request: HttpRequest,
 ) -> Result<HttpResponse> {
-    // Authenticate request
-    if let Err(response) = authenticate_request(&http_request).await {
-        return Ok(response);
+    let tenant = match authenticate_admin(&http_request, &executor, "Draining workers").await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+    let name = path.into_inner();
+    let drained = executor.workers().drain(&name);
+    if drained.is_empty() {
+        return Ok(ApiError::new(
+            ErrorCode::NotFound,
+            format!("No connected worker is named {name}"),
+        )
+        .response());
     }
+    log::info!(
+        "Tenant {tenant} drained {} workers named {name}",
+        drained.len()
+    );
+    Ok(HttpResponse::Ok().json(serde_json::json!({ "workers": drained })))
+}
 
-    let execute_request = ExecuteRequest {
-        language: request.language.clone(),
-        code: request.code.clone(),
-        test_cases: Some(request.test_cases.clone()),
+// Load signals for scaling the worker fleet, shaped for KEDA's metrics-api scaler,
+// which reads one value out of the JSON and feeds it to the HPA as an external metric
+async fn autoscaling_metrics(
+    executor: web::Data<Arc<CodeExecutor>>,
+    queue: web::Data<Arc<dyn JobQueue>>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    if let Err(response) =
+        authenticate_admin(&http_request, &executor, "Reading autoscaling metrics").await
+    {
+        return Ok(response);
+    }
+    let depth = match queue.depth().await {
+        Ok(depth) => depth,
+        Err(e) => return Ok(ApiError::new(ErrorCode::BackendUnavailable, e.to_string()).response()),
     };
+    let workers = executor.workers().workers();
+    let draining = workers.iter().filter(|worker| worker.draining).count();
+    let capacity: usize = workers
+        .iter()
+        .filter(|worker| !worker.draining)
+        .map(|worker| worker.capacity)
+        .sum();
+    let in_flight: usize = workers.iter().map(|worker| worker.in_flight).sum();
+    Ok(HttpResponse::Ok().json(serde_json::json!({
+        "queue": {
+            "backend": queue.backend(),
+            "depth": depth,
+            "wait_seconds": executor
+                .latency()
+                .recent_queue_wait()
+                .unwrap_or_default()
+                .as_secs_f64()
+        },
+        "workers": {
+            "connected": workers.len(),
+            "draining": draining,
+            "capacity": capacity,
+            "in_flight": in_flight,
+            "utilization": if capacity == 0 { 0.0 } else { in_flight as f64 / capacity as f64 },
+            "preemptions": executor.workers().preemptions()
+        },
+        "languages": executor.workers().capacity_by_language()
+    })))
+}
 
-    let result = executor.execute(execute_request).await;
-    match result {
-        Ok(response) => Ok(HttpResponse::Ok().json(response)),
-        Err(e) => Ok(HttpResponse::InternalServerError().json(serde_json::json!({
-            "error": "Execution failed",
-            "message": e.to_string()
-        }))),
+async fn image_scans(
+    executor: web::Data<Arc<CodeExecutor>>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    if let Err(response) = authenticate_admin(&http_request, &executor, "Reading image scans").await
+    {
+        return Ok(response);
     }
+    let scanner = executor.image_scanner();
+    Ok(HttpResponse::Ok().json(serde_json::json!({
+        "enabled": scanner.is_enabled(),
+        "images": scanner.summaries()
+    })))
 }
 
-async fn execute_with_test_files(
+async fn syscall_policies(
     executor: web::Data<Arc<CodeExecutor>>,
-    request: web::Json<ExecuteWithTestFilesRequest>,
     http_request: HttpRequest,
 ) -> Result<HttpResponse> {
-    // Authenticate request
-    if let Err(response) = authenticate_request(&http_request).await {
+    if let Err(response) =
+        authenticate_admin(&http_request, &executor, "Reading syscall policies").await
+    {
         return Ok(response);
     }
-
-    // Convert test files to test cases
-    let test_cases: Vec<TestCase> = request
-        .test_files
+    let policies: Vec<serde_json::Value> = SyscallPolicy::ALL
         .iter()
-        .map(|file| TestCase {
-            name: file.name.clone(),
-            input: file.content.clone(),
-            expected_output: None,
-            timeout_seconds: None,
-            memory_limit_mb: None,
+        .map(|policy| {
+            serde_json::json!({
+                "name": policy.as_str(),
+                "denied": policy.denied()
+            })
         })
         .collect();
+    Ok(HttpResponse::Ok().json(serde_json::json!({
+        "default": executor.config().syscall_policy,
+        "policies": policies,
+        "denials": executor.syscall_filter().denials()
+    })))
+}
 
-    let execute_request = ExecuteRequest {
-        language: request.language.clone(),
-        code: request.code.clone(),
-        test_cases: Some(test_cases),
-    };
+#[derive(Debug, Deserialize)]
+struct ImageScanQuery {
+    image: String,
+}
 
-    let result = executor.execute(execute_request).await;
-    match result {
-        Ok(response) => Ok(HttpResponse::Ok().json(response)),
-        Err(e) => Ok(HttpResponse::InternalServerError().json(serde_json::json!({
-            "error": "Execution failed",
-            "message": e.to_string()
-        }))),
+async fn image_scan(
+    executor: web::Data<Arc<CodeExecutor>>,
+    query: web::Query<ImageScanQuery>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    if let Err(response) = authenticate_admin(&http_request, &executor, "Reading image scans").await
+    {
+        return Ok(response);
+    }
+    match executor.image_scanner().report(&query.image) {
+        Some(report) => Ok(HttpResponse::Ok().json(report)),
+        None => Ok(ApiError::new(
+            ErrorCode::NotFound,
+            format!("Image {} has not been scanned", query.image),
+        )
+        .response()),
     }
 }
 
-async fn execute_with_test_urls(
+#[derive(Debug, Deserialize)]
+struct SbomQuery {
+    version: Option<String>,
+    channel: Option<Channel>,
+    /// Only packages whose name contains this
+    package: Option<String>,
+}
+
+async fn language_sbom(
     executor: web::Data<Arc<CodeExecutor>>,
-    request: web::Json<ExecuteWithTestUrlsRequest>,
+    language: web::Path<String>,
+    query: web::Query<SbomQuery>,
     http_request: HttpRequest,
 ) -> Result<HttpResponse> {
-    // Authenticate request
-    if let Err(response) = authenticate_request(&http_request).await {
+    // Each call runs the SBOM generator over the whole image
+    if let Err(response) = authenticate_admin(&http_request, &executor, "Generating SBOMs").await {
         return Ok(response);
     }
-
-    // Download test cases from URLs
+    let image = match executor.language_image(&language, query.version.as_deref(), query.channel) {
+        Ok(image) => image,
+        Err(e) => return Ok(execution_error_response(e)),
+    };
+    let generator = executor.get_ref().clone();
+    let mut sbom =
+        match tokio::task::spawn_blocking(move || generator.image_scanner().sbom(&image)).await {
+            Ok(Ok(sbom)) => sbom,
+            Ok(Err(e)) => {
+                return Ok(ApiError::new(
+                    ErrorCode::Internal,
+                    format!("Failed to generate the SBOM of {language}: {e}"),
+                )
+                .response())
+            }
+            Err(e) => {
+                return Ok(execution_error_response(ExecutionError::TaskJoin(
+                    e.to_string(),
+                )))
+            }
+        };
+    if let Some(package) = &query.package {
+        sbom.packages.retain(|p| p.name.contains(package.as_str()));
+    }
+    Ok(HttpResponse::Ok().json(serde_json::json!({
+        "language": language.as_str(),
+        "image": sbom.image,
+        "generator": sbom.generator,
+        "generated_at": sbom.generated_at,
+        "packages": sbom.packages
+    })))
+}
+
+async fn dashboard() -> HttpResponse {
+    HttpResponse::Ok()
+        .content_type("text/html; charset=utf-8")
+        .body(include_str!("../static/dashboard.html"))
+}
+
+async fn dashboard_stats(
+    executor: web::Data<Arc<CodeExecutor>>,
+    activity: web::Data<Arc<ActivityTracker>>,
+    functions: web::Data<Arc<FunctionRegistry>>,
+    queue: web::Data<Arc<dyn JobQueue>>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    // Activity names the tenants and ids of every tenant's executions
+    if let Err(response) =
+        authenticate_admin(&http_request, &executor, "Reading dashboard statistics").await
+    {
+        return Ok(response);
+    }
+    let queue_depth = match queue.depth().await {
+        Ok(depth) => Some(depth),
+        Err(e) => {
+            log::warn!("{e}");
+            None
+        }
+    };
+    Ok(HttpResponse::Ok().json(serde_json::json!({
+        "queue_depth": queue_depth,
+        "workers": executor.workers().workers().len(),
+        "supported_languages": executor.languages(),
+        "activity": activity.snapshot(),
+        "slow_executions": executor.latency().counts(),
+        "syscall_denials": executor.syscall_filter().denials(),
+        "language_slots": executor.language_slots().usage(),
+        "function_starts": functions.metrics().snapshot(),
+        "labels": executor.label_metrics().snapshot()
+    })))
+}
+
+// Server TLS for the agent listener. Agents must present a certificate signed by
+// WORKER_CA_CERT; returns None when the listener is not configured.
+fn worker_tls_config() -> std::io::Result<Option<tonic::transport::ServerTlsConfig>> {
+    let (Ok(cert), Ok(key), Ok(ca)) = (
+        std::env::var("WORKER_TLS_CERT"),
+        std::env::var("WORKER_TLS_KEY"),
+        std::env::var("WORKER_CA_CERT"),
+    ) else {
+        return Ok(None);
+    };
+    let identity = tonic::transport::Identity::from_pem(std::fs::read(cert)?, std::fs::read(key)?);
+    let client_ca = tonic::transport::Certificate::from_pem(std::fs::read(ca)?);
+    Ok(Some(
+        tonic::transport::ServerTlsConfig::new()
+            .identity(identity)
+            .client_ca_root(client_ca),
+    ))
+}
+
+#[derive(Debug, Deserialize)]
+struct AbuseFlagsQuery {
+    status: Option<FlagStatus>,
+}
+
+// The review queue: flagged executions, newest first, and the tenants restricted so far
+async fn abuse_flags(
+    executor: web::Data<Arc<CodeExecutor>>,
+    query: web::Query<AbuseFlagsQuery>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    if let Err(response) =
+        authenticate_admin(&http_request, &executor, "Reviewing abuse flags").await
+    {
+        return Ok(response);
+    }
+    Ok(HttpResponse::Ok().json(serde_json::json!({
+        "flags": executor.abuse().flags(query.status),
+        "restrictions": executor.abuse().restrictions()
+    })))
+}
+
+#[derive(Debug, Deserialize)]
+struct AbuseReview {
+    decision: Decision,
+}
+
+async fn review_abuse_flag(
+    executor: web::Data<Arc<CodeExecutor>>,
+    path: web::Path<String>,
+    review: web::Json<AbuseReview>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_admin(&http_request, &executor, "Reviewing abuse flags").await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+    let id = path.into_inner();
+    // An admin tenant that was flagged itself could otherwise lift its own restriction
+    let own_flag = executor
+        .abuse()
+        .flags(None)
+        .iter()
+        .any(|flag| flag.id == id && flag.tenant == tenant);
+    if own_flag {
+        return Ok(ApiError::new(
+            ErrorCode::Forbidden,
+            "Tenants can't review their own abuse flags",
+        )
+        .response());
+    }
+    match executor.abuse().review(&id, review.decision) {
+        Some(flag) => {
+            log::info!(
+                "Tenant {tenant} reviewed abuse flag {id}: {:?}",
+                review.decision
+            );
+            Ok(HttpResponse::Ok().json(flag))
+        }
+        None => Ok(ApiError::new(ErrorCode::NotFound, format!("No abuse flag {id}")).response()),
+    }
+}
+
+async fn dedup_stats(executor: web::Data<Arc<CodeExecutor>>) -> Result<HttpResponse> {
+    Ok(HttpResponse::Ok().json(executor.results().stats()))
+}
+
+async fn execute_with_test_cases(
+    executor: web::Data<Arc<CodeExecutor>>,
+    request: web::Json<ExecuteWithTestCasesRequest>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    // Authenticate request
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+    let deadline = match request_deadline(&http_request) {
+        Ok(deadline) => deadline,
+        Err(response) => return Ok(response),
+    };
+
+    let execute_request = ExecuteRequest {
+        language: request.language.clone(),
+        code: request.code.clone(),
+        test_cases: Some(request.test_cases.clone()),
+        test_groups: request.test_groups.clone(),
+        stop_on_failure: request.stop_on_failure,
+        interactor: request.interactor.clone(),
+        checker: request.checker.clone(),
+        tenant: Some(tenant),
+        harness: request.harness.clone(),
+        harness_params: request.harness_params.clone(),
+        deadline,
+        trace_context: request_trace_context(&http_request),
+        ..Default::default()
+    };
+
+    let result = executor.execute(execute_request).await;
+    match result {
+        Ok(response) => Ok(encoding::respond_execution(&http_request, &response)),
+        Err(e) => Ok(execution_error_response(e)),
+    }
+}
+
+async fn execute_with_test_files(
+    executor: web::Data<Arc<CodeExecutor>>,
+    request: web::Json<ExecuteWithTestFilesRequest>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    // Authenticate request
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+    let deadline = match request_deadline(&http_request) {
+        Ok(deadline) => deadline,
+        Err(response) => return Ok(response),
+    };
+
+    // Convert test files to test cases
+    let test_cases: Vec<TestCase> = request
+        .test_files
+        .iter()
+        .map(|file| TestCase {
+            name: file.name.clone(),
+            input: file.content.clone(),
+            expected_output: None,
+            timeout_seconds: None,
+            memory_limit_mb: None,
+            ..Default::default()
+        })
+        .collect();
+
+    let execute_request = ExecuteRequest {
+        language: request.language.clone(),
+        code: request.code.clone(),
+        test_cases: Some(test_cases),
+        tenant: Some(tenant),
+        harness: request.harness.clone(),
+        harness_params: request.harness_params.clone(),
+        deadline,
+        trace_context: request_trace_context(&http_request),
+        ..Default::default()
+    };
+
+    let result = executor.execute(execute_request).await;
+    match result {
+        Ok(response) => Ok(encoding::respond_execution(&http_request, &response)),
+        Err(e) => Ok(execution_error_response(e)),
+    }
+}
+
+async fn execute_with_test_urls(
+    executor: web::Data<Arc<CodeExecutor>>,
+    request: web::Json<ExecuteWithTestUrlsRequest>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    // Authenticate request
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+    let deadline = match request_deadline(&http_request) {
+        Ok(deadline) => deadline,
+        Err(response) => return Ok(response),
+    };
+
+    // Download test cases from URLs
     let mut test_cases = Vec::new();
     for test_url in &request.test_urls {
         match download_test_case(&test_url.url).await {
@@ -366,30 +1574,1778 @@ async fn execute_with_test_urls(
                     expected_output: None,
                     timeout_seconds: None,
                     memory_limit_mb: None,
+                    ..Default::default()
                 });
             }
             Err(e) => {
-                return Ok(HttpResponse::BadRequest().json(serde_json::json!({
-                    "error": "Failed to download test case",
-                    "message": format!("Failed to download {}: {}", test_url.url, e)
-                })));
+                return Ok(ApiError::new(
+                    ErrorCode::UpstreamFailed,
+                    format!("Failed to download {}: {}", test_url.url, e),
+                )
+                .response());
+            }
+        }
+    }
+
+    let execute_request = ExecuteRequest {
+        language: request.language.clone(),
+        code: request.code.clone(),
+        test_cases: Some(test_cases),
+        tenant: Some(tenant),
+        harness: request.harness.clone(),
+        harness_params: request.harness_params.clone(),
+        deadline,
+        trace_context: request_trace_context(&http_request),
+        ..Default::default()
+    };
+
+    let result = executor.execute(execute_request).await;
+    match result {
+        Ok(response) => Ok(encoding::respond_execution(&http_request, &response)),
+        Err(e) => Ok(execution_error_response(e)),
+    }
+}
+
+async fn get_usage(
+    executor: web::Data<Arc<CodeExecutor>>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    let usage = executor.usage().today(&tenant);
+    let gpu_quota = executor
+        .config()
+        .tenant(&tenant)
+        .and_then(|policy| policy.gpu_seconds_per_day);
+    Ok(HttpResponse::Ok().json(serde_json::json!({
+        "tenant": tenant,
+        "day": usage.day,
+        "executions": usage.executions,
+        "gpu_seconds": usage.gpu_seconds,
+        "gpu_seconds_per_day": gpu_quota
+    })))
+}
+
+async fn list_languages(
+    executor: web::Data<Arc<CodeExecutor>>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    if let Err(response) = authenticate_request(&http_request).await {
+        return Ok(response);
+    }
+
+    let languages = serde_json::json!({ "languages": executor.language_descriptions() });
+    Ok(encoding::respond(&http_request, StatusCode::OK, &languages))
+}
+
+async fn list_presets(
+    executor: web::Data<Arc<CodeExecutor>>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    if let Err(response) = authenticate_request(&http_request).await {
+        return Ok(response);
+    }
+
+    let presets = serde_json::json!({ "presets": executor.presets().list() });
+    Ok(encoding::respond(&http_request, StatusCode::OK, &presets))
+}
+
+async fn get_preset(
+    executor: web::Data<Arc<CodeExecutor>>,
+    path: web::Path<String>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    if let Err(response) = authenticate_request(&http_request).await {
+        return Ok(response);
+    }
+
+    let name = path.into_inner();
+    match executor.presets().get(&name) {
+        Some(preset) => Ok(encoding::respond(&http_request, StatusCode::OK, &preset)),
+        None => Ok(preset_error_response(PresetError::NotFound(name))),
+    }
+}
+
+// Creates or replaces a preset and builds its image in the background; requests
+// can select it once the build is ready
+async fn put_preset(
+    executor: web::Data<Arc<CodeExecutor>>,
+    path: web::Path<String>,
+    spec: web::Json<PresetSpec>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    if !is_admin(&executor, &tenant) {
+        return Ok(ApiError::new(
+            ErrorCode::Forbidden,
+            "Managing presets requires an admin tenant",
+        )
+        .response());
+    }
+    if executor.air_gapped() {
+        return Ok(ApiError::new(
+            ErrorCode::BackendUnavailable,
+            "Presets can't be built on an air-gapped server",
+        )
+        .response());
+    }
+    let name = path.into_inner();
+    let spec = spec.into_inner();
+    let base_image = match executor.language_image(&spec.language, None, None) {
+        Ok(image) => image,
+        Err(e) => return Ok(execution_error_response(e)),
+    };
+    let (preset, revision) = match executor.presets().put(&name, spec, &tenant) {
+        Ok(put) => put,
+        Err(e) => return Ok(preset_error_response(e)),
+    };
+    log::info!("Tenant {tenant} updated preset {name} to revision {revision}");
+    tokio::spawn(executor.presets().clone().build(name, revision, base_image));
+    Ok(encoding::respond(
+        &http_request,
+        StatusCode::ACCEPTED,
+        &preset,
+    ))
+}
+
+async fn delete_preset(
+    executor: web::Data<Arc<CodeExecutor>>,
+    path: web::Path<String>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    if !is_admin(&executor, &tenant) {
+        return Ok(ApiError::new(
+            ErrorCode::Forbidden,
+            "Managing presets requires an admin tenant",
+        )
+        .response());
+    }
+    let name = path.into_inner();
+    match executor.presets().remove(&name) {
+        Ok(()) => {
+            log::info!("Tenant {tenant} deleted preset {name}");
+            Ok(HttpResponse::NoContent().finish())
+        }
+        Err(e) => Ok(preset_error_response(e)),
+    }
+}
+
+// Serves the embedded package mirror. Package managers in sandboxes have no
+// credentials, so it's unauthenticated; it only ever fetches from the configured
+// indexes, and only for clients on the sandboxes' networks.
+async fn mirror_package(
+    mirror: web::Data<Option<Arc<PackageMirror>>>,
+    path: web::Path<(String, String)>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let Some(mirror) = mirror.get_ref() else {
+        return Ok(ApiError::new(ErrorCode::NotFound, "The package mirror is disabled").response());
+    };
+    if !http_request
+        .peer_addr()
+        .is_some_and(|peer| mirror.allows(peer.ip()))
+    {
+        return Ok(ApiError::new(
+            ErrorCode::Forbidden,
+            "The package mirror only serves sandboxes",
+        )
+        .response());
+    }
+    let (ecosystem, path) = path.into_inner();
+    match mirror.fetch(&ecosystem, &path).await {
+        Ok(response) => {
+            let cache = if response.cached { "HIT" } else { "MISS" };
+            let content_type = HeaderValue::from_str(&response.content_type)
+                .unwrap_or(HeaderValue::from_static("application/octet-stream"));
+            // Streamed from the cached copy rather than read into memory
+            let file = actix_files::NamedFile::from_file(response.file, response.path)?
+                .disable_content_disposition();
+            let mut http_response = file.into_response(&http_request);
+            let headers = http_response.headers_mut();
+            headers.insert(header::CONTENT_TYPE, content_type);
+            headers.insert(
+                HeaderName::from_static("x-cache"),
+                HeaderValue::from_static(cache),
+            );
+            Ok(http_response)
+        }
+        Err(MirrorError::NotFound) => Ok(ApiError::new(
+            ErrorCode::NotFound,
+            format!("No {ecosystem} package at {path}"),
+        )
+        .response()),
+        Err(e @ MirrorError::Cache(_)) => {
+            log::error!("Package mirror: {e}");
+            Ok(ApiError::new(ErrorCode::Internal, e.to_string()).response())
+        }
+        Err(e) => Ok(ApiError::new(ErrorCode::UpstreamFailed, e.to_string()).response()),
+    }
+}
+
+// Stores the caller's bundle of vendored dependencies for a preset. The body is a
+// gzipped tarball, streamed to disk as it arrives.
+async fn put_preset_bundle(
+    executor: web::Data<Arc<CodeExecutor>>,
+    path: web::Path<String>,
+    payload: web::Payload,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    let name = path.into_inner();
+    let Some(preset) = executor.presets().get(&name) else {
+        return Ok(preset_error_response(PresetError::NotFound(name)));
+    };
+    if BundleLayout::for_language(&preset.language, "/").is_none() {
+        return Ok(ApiError::new(
+            ErrorCode::InvalidRequest,
+            format!(
+                "Bundles aren't supported for {}; only for python, python2, node, typescript and go",
+                preset.language
+            ),
+        )
+        .response());
+    }
+    match executor.bundles().store(&tenant, &name, payload).await {
+        Ok(bundle) => {
+            log::info!(
+                "Tenant {tenant} uploaded a bundle for preset {name}: {} files, {} bytes",
+                bundle.files,
+                bundle.bytes
+            );
+            Ok(HttpResponse::Ok().json(bundle))
+        }
+        Err(e) => Ok(bundle_error_response(e)),
+    }
+}
+
+async fn get_preset_bundle(
+    executor: web::Data<Arc<CodeExecutor>>,
+    path: web::Path<String>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    let name = path.into_inner();
+    match executor.bundles().info(&tenant, &name) {
+        Some(bundle) => Ok(HttpResponse::Ok().json(bundle)),
+        None => Ok(bundle_error_response(BundleError::NotFound(name))),
+    }
+}
+
+async fn delete_preset_bundle(
+    executor: web::Data<Arc<CodeExecutor>>,
+    path: web::Path<String>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    match executor.bundles().remove(&tenant, &path.into_inner()) {
+        Ok(()) => Ok(HttpResponse::NoContent().finish()),
+        Err(e) => Ok(bundle_error_response(e)),
+    }
+}
+
+fn bundle_error_response(error: BundleError) -> HttpResponse {
+    let code = match error {
+        BundleError::NotFound(_) => ErrorCode::NotFound,
+        BundleError::TooLarge(_) => ErrorCode::PayloadTooLarge,
+        BundleError::Invalid(_) => ErrorCode::InvalidRequest,
+        BundleError::Io(_) => ErrorCode::Internal,
+    };
+    ApiError::new(code, error.to_string()).response()
+}
+
+fn preset_error_response(error: PresetError) -> HttpResponse {
+    let code = match error {
+        PresetError::Invalid(_) => ErrorCode::InvalidRequest,
+        PresetError::Configured(_) => ErrorCode::Forbidden,
+        PresetError::NotFound(_) => ErrorCode::NotFound,
+    };
+    ApiError::new(code, error.to_string()).response()
+}
+
+fn execution_not_found(id: &str) -> HttpResponse {
+    ApiError::new(ErrorCode::NotFound, format!("No execution with id {id}")).response()
+}
+
+async fn compare_executions(
+    executor: web::Data<Arc<CodeExecutor>>,
+    request: web::Json<SimilarityRequest>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    let mut ids = request.into_inner().ids;
+    let mut seen = HashSet::new();
+    ids.retain(|id| seen.insert(id.clone()));
+    if !(2..=MAX_SIMILARITY_EXECUTIONS).contains(&ids.len()) {
+        return Ok(ApiError::new(
+            ErrorCode::InvalidRequest,
+            format!("Compare between 2 and {MAX_SIMILARITY_EXECUTIONS} distinct executions"),
+        )
+        .response());
+    }
+    let mut submissions = Vec::with_capacity(ids.len());
+    for id in ids {
+        let code = match executor.store().get(&id) {
+            Some(record) if record.tenant == tenant => record.code,
+            _ => return Ok(execution_not_found(&id)),
+        };
+        let Some(code) = code else {
+            return Ok(ApiError::new(
+                ErrorCode::InvalidRequest,
+                format!("Execution {id} has no stored code"),
+            )
+            .response());
+        };
+        submissions.push((id, code));
+    }
+
+    Ok(HttpResponse::Ok().json(serde_json::json!({
+        "pairs": similarity::compare(&submissions)
+    })))
+}
+
+// Scopes history queries to the caller's tenant unless it is an admin
+fn history_filter(
+    executor: &CodeExecutor,
+    tenant: &str,
+    query: ExecutionHistoryQuery,
+) -> Result<ExecutionFilter, HttpResponse> {
+    let admin = is_admin(executor, tenant);
+    if !admin && (query.q.is_some() || query.tenant.as_ref().is_some_and(|t| t != tenant)) {
+        return Err(ApiError::new(
+            ErrorCode::Forbidden,
+            "Searching code and accessing other tenants' history require an admin tenant",
+        )
+        .response());
+    }
+
+    Ok(ExecutionFilter {
+        tenant: if admin {
+            query.tenant
+        } else {
+            Some(tenant.to_string())
+        },
+        language: query.language,
+        status: query.status,
+        label: query.label,
+        channel: query.channel,
+        since: query.since,
+        until: query.until,
+        q: query.q,
+        trace_id: query.trace_id,
+    })
+}
+
+async fn list_executions(
+    executor: web::Data<Arc<CodeExecutor>>,
+    query: web::Query<ExecutionHistoryQuery>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    let query = query.into_inner();
+    let limit = query.limit.unwrap_or(50).clamp(1, 200);
+    let cursor = query.cursor.clone();
+    let filter = match history_filter(&executor, &tenant, query) {
+        Ok(filter) => filter,
+        Err(response) => return Ok(response),
+    };
+    match executor.store().list(&filter, cursor.as_deref(), limit) {
+        Ok(page) => Ok(encoding::respond(&http_request, StatusCode::OK, &page)),
+        Err(message) => Ok(ApiError::new(ErrorCode::InvalidRequest, message).response()),
+    }
+}
+
+async fn purge_executions(
+    executor: web::Data<Arc<CodeExecutor>>,
+    query: web::Query<ExecutionHistoryQuery>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    let query = query.into_inner();
+    // An empty query would wipe the whole history (every tenant's, for admins)
+    let has_filter = query.tenant.is_some()
+        || query.language.is_some()
+        || query.status.is_some()
+        || query.label.is_some()
+        || query.channel.is_some()
+        || query.since.is_some()
+        || query.until.is_some()
+        || query.q.is_some();
+    if !has_filter {
+        return Ok(ApiError::new(
+            ErrorCode::InvalidRequest,
+            "Specify at least one filter, e.g. until=<timestamp>",
+        )
+        .response());
+    }
+    let filter = match history_filter(&executor, &tenant, query) {
+        Ok(filter) => filter,
+        Err(response) => return Ok(response),
+    };
+
+    let deleted = executor.store().purge(&filter);
+    log::info!("Tenant {tenant} purged {} executions", deleted.len());
+    Ok(HttpResponse::Ok().json(serde_json::json!({ "deleted": deleted.len() })))
+}
+
+async fn delete_execution(
+    executor: web::Data<Arc<CodeExecutor>>,
+    path: web::Path<String>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    let id = path.into_inner();
+    match executor.store().get(&id) {
+        Some(record) if record.tenant == tenant => {
+            executor.store().remove(&id);
+            Ok(HttpResponse::NoContent().finish())
+        }
+        _ => Ok(execution_not_found(&id)),
+    }
+}
+
+async fn get_execution(
+    executor: web::Data<Arc<CodeExecutor>>,
+    path: web::Path<String>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    let id = path.into_inner();
+    match executor.store().get(&id) {
+        Some(record) if record.tenant == tenant => {
+            Ok(encoding::respond(&http_request, StatusCode::OK, &record))
+        }
+        _ => Ok(execution_not_found(&id)),
+    }
+}
+
+async fn download_execution_file(
+    executor: web::Data<Arc<CodeExecutor>>,
+    path: web::Path<(String, String)>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    let (id, file_path) = path.into_inner();
+    let store = executor.store();
+    match store.get(&id) {
+        Some(record) if record.tenant == tenant => {}
+        _ => return Ok(execution_not_found(&id)),
+    }
+
+    let Some(full_path) = store.artifact_path(&id, &file_path) else {
+        return Ok(ApiError::new(
+            ErrorCode::NotFound,
+            format!("Execution {id} has no artifact {file_path}"),
+        )
+        .response());
+    };
+
+    stored_file_response(store, &full_path, &http_request).await
+}
+
+async fn download_execution_archive(
+    executor: web::Data<Arc<CodeExecutor>>,
+    path: web::Path<String>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    let id = path.into_inner();
+    let store = executor.store();
+    match store.get(&id) {
+        Some(record) if record.tenant == tenant => {}
+        _ => return Ok(execution_not_found(&id)),
+    }
+
+    let Some(full_path) = store.archive_path(&id) else {
+        return Ok(ApiError::new(
+            ErrorCode::NotFound,
+            format!("Execution {id} was not run with archive_workdir"),
+        )
+        .response());
+    };
+
+    stored_file_response(store, &full_path, &http_request).await
+}
+
+// Serves an artifact or archive. Sealed files are decrypted in memory; plaintext ones
+// are served by NamedFile, which also handles Range requests.
+async fn stored_file_response(
+    store: &ExecutionStore,
+    path: &std::path::Path,
+    http_request: &HttpRequest,
+) -> Result<HttpResponse> {
+    let content_type = actix_files::file_extension_to_mime(
+        path.extension()
+            .and_then(|extension| extension.to_str())
+            .unwrap_or_default(),
+    );
+    match store.unseal(path) {
+        None => {
+            let file = actix_files::NamedFile::open_async(path).await?;
+            Ok(file.into_response(http_request))
+        }
+        Some(Ok(contents)) => Ok(HttpResponse::Ok().content_type(content_type).body(contents)),
+        Some(Err(e)) => {
+            log::error!("Failed to decrypt {}: {e}", path.display());
+            Ok(ApiError::new(ErrorCode::Internal, "Failed to read the stored file").response())
+        }
+    }
+}
+
+async fn stream_events(
+    executor: web::Data<Arc<CodeExecutor>>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    let receiver = executor.events().subscribe();
+    let stream = futures::stream::unfold(receiver, move |mut receiver| {
+        let tenant = tenant.clone();
+        async move {
+            loop {
+                // Keepalive comments stop proxies from closing idle connections
+                let frame = match tokio::time::timeout(SSE_KEEPALIVE, receiver.recv()).await {
+                    Err(_) => ": keepalive\n\n".to_string(),
+                    // Security alerts are for operators, through the log and webhooks
+                    Ok(Ok(event)) if event.event == EventKind::SecurityAlert => continue,
+                    Ok(Ok(event)) if event.tenant == tenant => event.to_sse(),
+                    Ok(Ok(_)) => continue,
+                    Ok(Err(broadcast::error::RecvError::Lagged(missed))) => {
+                        format!(": {missed} events dropped\n\n")
+                    }
+                    Ok(Err(broadcast::error::RecvError::Closed)) => return None,
+                };
+                return Some((Ok::<_, actix_web::Error>(web::Bytes::from(frame)), receiver));
+            }
+        }
+    });
+
+    Ok(HttpResponse::Ok()
+        .content_type("text/event-stream")
+        .insert_header(("Cache-Control", "no-cache"))
+        .streaming(stream))
+}
+
+async fn submit_job(
+    executor: web::Data<Arc<CodeExecutor>>,
+    queue: web::Data<Arc<dyn JobQueue>>,
+    progress: web::Data<Arc<QueueProgress>>,
+    request: web::Json<ExecuteRequest>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    let deadline = match request_deadline(&http_request) {
+        Ok(deadline) => deadline,
+        Err(response) => return Ok(response),
+    };
+    if deadline.is_some_and(|deadline| deadline::remaining(deadline).is_none()) {
+        return Ok(execution_error_response(ExecutionError::DeadlineExceeded));
+    }
+
+    // Oversized jobs are rejected now rather than failing once a consumer picks them up
+    let mut request = request.into_inner();
+    request.deadline = deadline;
+    request.trace_context = request_trace_context(&http_request);
+    if let Err(e) = executor.request_limits().check(&request) {
+        return Ok(execution_error_response(e));
+    }
+
+    match queue::submit(
+        queue.get_ref().as_ref(),
+        &progress,
+        &executor,
+        &tenant,
+        request,
+    )
+    .await
+    {
+        Ok(status) => Ok(HttpResponse::Accepted().json(status)),
+        Err(e @ QueueError::Full(depth, retry_after)) => {
+            Ok(ApiError::new(ErrorCode::SandboxUnavailable, e.to_string())
+                .with_details(serde_json::json!({ "queue_depth": depth }))
+                .with_retry_after(retry_after)
+                .response())
+        }
+        Err(e) => Ok(ApiError::new(ErrorCode::BackendUnavailable, e.to_string()).response()),
+    }
+}
+
+async fn get_job(
+    queue: web::Data<Arc<dyn JobQueue>>,
+    progress: web::Data<Arc<QueueProgress>>,
+    path: web::Path<String>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    let id = path.into_inner();
+    match queue.get_status(&id).await {
+        Ok(Some(mut status)) if status.tenant == tenant => {
+            // The status is still worth returning without a position
+            if let Err(e) =
+                queue::estimate_start(queue.get_ref().as_ref(), &progress, &mut status).await
+            {
+                log::warn!("Failed to estimate the start of job {id}: {e}");
+            }
+            Ok(encoding::respond(&http_request, StatusCode::OK, &status))
+        }
+        Ok(_) => Ok(ApiError::new(ErrorCode::NotFound, format!("No job with id {id}")).response()),
+        Err(e) => Ok(ApiError::new(ErrorCode::BackendUnavailable, e.to_string()).response()),
+    }
+}
+
+#[derive(Deserialize)]
+struct JobLogsQuery {
+    #[serde(default)]
+    follow: bool,
+}
+
+async fn job_logs(
+    queue: web::Data<Arc<dyn JobQueue>>,
+    path: web::Path<String>,
+    query: web::Query<JobLogsQuery>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    let id = path.into_inner();
+    match queue.get_status(&id).await {
+        Ok(Some(status)) if status.tenant == tenant => {}
+        Ok(_) => {
+            return Ok(
+                ApiError::new(ErrorCode::NotFound, format!("No job with id {id}")).response(),
+            )
+        }
+        Err(e) => return Ok(ApiError::new(ErrorCode::BackendUnavailable, e.to_string()).response()),
+    }
+
+    let stream = logs::tail(queue.get_ref().clone(), id, query.follow)
+        .map(|frame| Ok::<_, actix_web::Error>(web::Bytes::from(frame)));
+    Ok(HttpResponse::Ok()
+        .content_type("text/event-stream")
+        .insert_header(("Cache-Control", "no-cache"))
+        .streaming(stream))
+}
+
+async fn job_stats(
+    queue: web::Data<Arc<dyn JobQueue>>,
+    path: web::Path<String>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    let id = path.into_inner();
+    match queue.get_status(&id).await {
+        Ok(Some(status)) if status.tenant == tenant => {}
+        Ok(_) => {
+            return Ok(
+                ApiError::new(ErrorCode::NotFound, format!("No job with id {id}")).response(),
+            )
+        }
+        Err(e) => return Ok(ApiError::new(ErrorCode::BackendUnavailable, e.to_string()).response()),
+    }
+
+    let queue = queue.get_ref().clone();
+    let stream = futures::stream::unfold(Some(id), move |id| {
+        let queue = queue.clone();
+        async move {
+            let id = id?;
+            tokio::time::sleep(STATS_INTERVAL).await;
+            let state = match queue.get_status(&id).await {
+                Ok(Some(status)) => status.state,
+                _ => return None,
+            };
+            if matches!(state, JobState::Completed | JobState::Failed) {
+                let frame = format!(
+                    "event: done\ndata: {}\n\n",
+                    serde_json::json!({ "state": state })
+                );
+                return Some((Ok::<_, actix_web::Error>(web::Bytes::from(frame)), None));
+            }
+            let job = id.clone();
+            let frame = match tokio::task::spawn_blocking(move || stats::sample(&job)).await {
+                Ok(Ok(Some(sample))) => format!(
+                    "event: stats\ndata: {}\n\n",
+                    serde_json::to_string(&sample).unwrap_or_default()
+                ),
+                // Queued, between steps, or running on another host
+                Ok(Ok(None)) => ": no sandbox running\n\n".to_string(),
+                Ok(Err(e)) => format!(": {}\n\n", e.replace('\n', " ")),
+                Err(e) => format!(": {e}\n\n"),
+            };
+            Some((Ok(web::Bytes::from(frame)), Some(id)))
+        }
+    });
+
+    Ok(HttpResponse::Ok()
+        .content_type("text/event-stream")
+        .insert_header(("Cache-Control", "no-cache"))
+        .streaming(stream))
+}
+
+fn session_not_found(id: &str) -> HttpResponse {
+    ApiError::new(ErrorCode::NotFound, format!("No session with id {id}")).response()
+}
+
+async fn create_session(
+    executor: web::Data<Arc<CodeExecutor>>,
+    sessions: web::Data<Arc<SessionManager>>,
+    request: web::Json<CreateSessionRequest>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    let request = request.into_inner();
+    let language = match (&request.snapshot, request.language) {
+        (Some(id), language) => match sessions.snapshot(id) {
+            Some(snapshot) if snapshot.tenant == tenant => match language {
+                Some(language) if language != snapshot.language => {
+                    return Ok(execution_error_response(ExecutionError::InvalidRequest(
+                        format!("Snapshot {id} is of a {} session", snapshot.language),
+                    )));
+                }
+                _ => snapshot.language,
+            },
+            _ => return Ok(snapshot_not_found(id)),
+        },
+        (None, Some(language)) => language,
+        (None, None) => {
+            return Ok(execution_error_response(ExecutionError::InvalidRequest(
+                "Either language or snapshot is required".to_string(),
+            )));
+        }
+    };
+    if !executor.supports_language(&language) {
+        return Ok(execution_error_response(
+            ExecutionError::UnsupportedLanguage(language),
+        ));
+    }
+
+    let session = match &request.snapshot {
+        Some(id) => sessions.fork(&tenant, id),
+        None => sessions.create(&tenant, &language),
+    };
+    match session {
+        Ok(session) => Ok(HttpResponse::Created().json(session)),
+        Err(SessionError::SnapshotNotFound(id)) => Ok(snapshot_not_found(&id)),
+        Err(e) => Ok(ApiError::new(ErrorCode::Internal, e.to_string()).response()),
+    }
+}
+
+fn snapshot_not_found(id: &str) -> HttpResponse {
+    ApiError::new(ErrorCode::NotFound, format!("No snapshot with id {id}")).response()
+}
+
+async fn snapshot_session(
+    sessions: web::Data<Arc<SessionManager>>,
+    path: web::Path<String>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    let id = path.into_inner();
+    match sessions.get(&id) {
+        Some(session) if session.tenant == tenant => {}
+        _ => return Ok(session_not_found(&id)),
+    }
+    match sessions.snapshot_session(&id) {
+        Ok(snapshot) => Ok(HttpResponse::Created().json(snapshot)),
+        Err(SessionError::NotFound(_)) => Ok(session_not_found(&id)),
+        Err(e) => Ok(ApiError::new(ErrorCode::Internal, e.to_string()).response()),
+    }
+}
+
+async fn list_snapshots(
+    sessions: web::Data<Arc<SessionManager>>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    Ok(HttpResponse::Ok().json(serde_json::json!({
+        "snapshots": sessions.snapshots(&tenant),
+    })))
+}
+
+async fn delete_snapshot(
+    sessions: web::Data<Arc<SessionManager>>,
+    path: web::Path<String>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    let id = path.into_inner();
+    match sessions.snapshot(&id) {
+        Some(snapshot) if snapshot.tenant == tenant => {
+            sessions.remove_snapshot(&id);
+            Ok(HttpResponse::NoContent().finish())
+        }
+        _ => Ok(snapshot_not_found(&id)),
+    }
+}
+
+async fn execute_in_session(
+    executor: web::Data<Arc<CodeExecutor>>,
+    sessions: web::Data<Arc<SessionManager>>,
+    path: web::Path<String>,
+    request: web::Json<ExecuteRequest>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    let deadline = match request_deadline(&http_request) {
+        Ok(deadline) => deadline,
+        Err(response) => return Ok(response),
+    };
+
+    let id = path.into_inner();
+    let session = match sessions.get(&id) {
+        Some(session) if session.can_attach(&tenant) => session,
+        _ => return Ok(session_not_found(&id)),
+    };
+    if !session.can_write(&tenant) {
+        let e = SessionError::ReadOnly(id.clone(), tenant.clone());
+        return Ok(ApiError::new(ErrorCode::Forbidden, e.to_string()).response());
+    }
+
+    let mut request = request.into_inner();
+    request.deadline = deadline;
+    request.trace_context = request_trace_context(&http_request);
+    if request.language != session.language {
+        return Ok(execution_error_response(ExecutionError::InvalidRequest(
+            format!(
+                "Session {id} runs {}, not {}",
+                session.language, request.language
+            ),
+        )));
+    }
+
+    if let Err(e @ SessionError::QuotaExceeded(..)) = sessions.check_quota(&id) {
+        return Ok(ApiError::new(ErrorCode::LimitExceeded, e.to_string()).response());
+    }
+
+    // The session's terminal applies unless the call brings its own
+    request.terminal = request.terminal.or(session.terminal);
+    let echo = request.terminal.map_or(true, |terminal| terminal.echo);
+    sessions.publish(
+        &id,
+        SessionOutput::Started {
+            tenant: tenant.clone(),
+            code: echo.then(|| request.code.clone()),
+        },
+    );
+    request.tenant = Some(tenant.clone());
+    let workspace = sessions.volume_path(&id);
+    let result = executor
+        .execute_in_workspace(request, &workspace.to_string_lossy())
+        .await;
+    sessions.touch(&id);
+    sessions.publish(
+        &id,
+        match &result {
+            Ok(response) => SessionOutput::Finished {
+                tenant,
+                result: response.clone(),
+            },
+            Err(e) => SessionOutput::Failed {
+                tenant,
+                error: e.to_string(),
+            },
+        },
+    );
+
+    match result {
+        Ok(response) => Ok(encoding::respond_execution(&http_request, &response)),
+        Err(e) => Ok(execution_error_response(e)),
+    }
+}
+
+async fn delete_session(
+    executor: web::Data<Arc<CodeExecutor>>,
+    sessions: web::Data<Arc<SessionManager>>,
+    path: web::Path<String>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    let id = path.into_inner();
+    match sessions.get(&id) {
+        Some(session) if session.tenant == tenant || is_admin(&executor, &tenant) => {
+            sessions.remove(&id);
+            Ok(HttpResponse::NoContent().finish())
+        }
+        _ => Ok(session_not_found(&id)),
+    }
+}
+
+fn is_admin(executor: &CodeExecutor, tenant: &str) -> bool {
+    executor
+        .config()
+        .tenant(tenant)
+        .is_some_and(|policy| policy.admin)
+}
+
+// Authenticates the caller and refuses tenants that aren't admins; `action` names
+// what was refused
+async fn authenticate_admin(
+    request: &HttpRequest,
+    executor: &CodeExecutor,
+    action: &str,
+) -> Result<String, HttpResponse> {
+    let tenant = authenticate_request(request).await?;
+    if !is_admin(executor, &tenant) {
+        return Err(ApiError::new(
+            ErrorCode::Forbidden,
+            format!("{action} requires an admin tenant"),
+        )
+        .response());
+    }
+    Ok(tenant)
+}
+
+// Scopes session queries to the caller's tenant unless it is an admin
+fn session_filter(
+    executor: &CodeExecutor,
+    tenant: &str,
+    query: SessionListQuery,
+) -> Result<SessionFilter, HttpResponse> {
+    let admin = is_admin(executor, tenant);
+    if !admin && query.tenant.as_ref().is_some_and(|t| t != tenant) {
+        return Err(ApiError::new(
+            ErrorCode::Forbidden,
+            "Accessing other tenants' sessions requires an admin tenant",
+        )
+        .response());
+    }
+
+    Ok(SessionFilter {
+        tenant: if admin {
+            query.tenant
+        } else {
+            Some(tenant.to_string())
+        },
+        language: query.language,
+        min_age_seconds: query.min_age_seconds,
+        min_idle_seconds: query.min_idle_seconds,
+    })
+}
+
+async fn list_sessions(
+    executor: web::Data<Arc<CodeExecutor>>,
+    sessions: web::Data<Arc<SessionManager>>,
+    query: web::Query<SessionListQuery>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    let filter = match session_filter(&executor, &tenant, query.into_inner()) {
+        Ok(filter) => filter,
+        Err(response) => return Ok(response),
+    };
+    Ok(HttpResponse::Ok().json(serde_json::json!({
+        "sessions": sessions.list(&filter, unix_timestamp()),
+    })))
+}
+
+async fn get_session(
+    executor: web::Data<Arc<CodeExecutor>>,
+    sessions: web::Data<Arc<SessionManager>>,
+    path: web::Path<String>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    let id = path.into_inner();
+    match sessions.usage(&id, unix_timestamp()) {
+        Some(usage) if usage.session.can_attach(&tenant) || is_admin(&executor, &tenant) => {
+            Ok(HttpResponse::Ok().json(usage))
+        }
+        _ => Ok(session_not_found(&id)),
+    }
+}
+
+async fn set_session_terminal(
+    sessions: web::Data<Arc<SessionManager>>,
+    path: web::Path<String>,
+    request: web::Json<Terminal>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    let id = path.into_inner();
+    match sessions.get(&id) {
+        Some(session) if session.can_write(&tenant) => {}
+        Some(session) if session.can_attach(&tenant) => {
+            let e = SessionError::ReadOnly(id, tenant);
+            return Ok(ApiError::new(ErrorCode::Forbidden, e.to_string()).response());
+        }
+        _ => return Ok(session_not_found(&id)),
+    }
+    let terminal = request.into_inner();
+    if let Err(e) = terminal.validate() {
+        return Ok(execution_error_response(ExecutionError::InvalidRequest(e)));
+    }
+    match sessions.set_terminal(&id, &tenant, terminal) {
+        Ok(session) => Ok(HttpResponse::Ok().json(session)),
+        Err(_) => Ok(session_not_found(&id)),
+    }
+}
+
+async fn share_session(
+    sessions: web::Data<Arc<SessionManager>>,
+    path: web::Path<String>,
+    request: web::Json<ShareSessionRequest>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    let id = path.into_inner();
+    match sessions.get(&id) {
+        Some(session) if session.tenant == tenant => {}
+        _ => return Ok(session_not_found(&id)),
+    }
+    let request = request.into_inner();
+    match sessions.share(&id, request.guests, request.write) {
+        Ok(session) => Ok(HttpResponse::Ok().json(session)),
+        Err(_) => Ok(session_not_found(&id)),
+    }
+}
+
+// Streams every exec call made in the session, and its result, to the client.
+// Any number of clients can attach at once: the owner, its guests and admins.
+async fn attach_session(
+    executor: web::Data<Arc<CodeExecutor>>,
+    sessions: web::Data<Arc<SessionManager>>,
+    path: web::Path<String>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    let id = path.into_inner();
+    match sessions.get(&id) {
+        Some(session) if session.can_attach(&tenant) || is_admin(&executor, &tenant) => {}
+        _ => return Ok(session_not_found(&id)),
+    }
+    let Some(receiver) = sessions.attach(&id) else {
+        return Ok(session_not_found(&id));
+    };
+
+    let stream = futures::stream::unfold(receiver, |mut receiver| async move {
+        let frame = match tokio::time::timeout(SSE_KEEPALIVE, receiver.recv()).await {
+            Err(_) => ": keepalive\n\n".to_string(),
+            Ok(Ok(output)) => output.to_sse(),
+            Ok(Err(broadcast::error::RecvError::Lagged(missed))) => {
+                format!(": {missed} events dropped\n\n")
             }
-        }
+            // The session was closed
+            Ok(Err(broadcast::error::RecvError::Closed)) => return None,
+        };
+        Some((Ok::<_, actix_web::Error>(web::Bytes::from(frame)), receiver))
+    });
+
+    Ok(HttpResponse::Ok()
+        .content_type("text/event-stream")
+        .insert_header(("Cache-Control", "no-cache"))
+        .streaming(stream))
+}
+
+// Terminates every session matching the query. Only admins can terminate sessions
+// in bulk, since an empty query matches the whole fleet.
+async fn terminate_sessions(
+    executor: web::Data<Arc<CodeExecutor>>,
+    sessions: web::Data<Arc<SessionManager>>,
+    query: web::Query<SessionListQuery>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    if !is_admin(&executor, &tenant) {
+        return Ok(ApiError::new(
+            ErrorCode::Forbidden,
+            "Terminating sessions in bulk requires an admin tenant",
+        )
+        .response());
     }
+    let filter = match session_filter(&executor, &tenant, query.into_inner()) {
+        Ok(filter) => filter,
+        Err(response) => return Ok(response),
+    };
+    let terminated = sessions.remove_matching(&filter, unix_timestamp());
+    log::info!(
+        "Tenant {tenant} terminated {} sessions matching {filter:?}",
+        terminated.len()
+    );
+    Ok(HttpResponse::Ok().json(serde_json::json!({
+        "terminated": terminated,
+    })))
+}
 
-    let execute_request = ExecuteRequest {
-        language: request.language.clone(),
-        code: request.code.clone(),
-        test_cases: Some(test_cases),
+fn function_not_found(name: &str) -> HttpResponse {
+    function_error_response(FunctionError::NotFound(name.to_string()))
+}
+
+fn function_error_response(error: FunctionError) -> HttpResponse {
+    let error = match error {
+        FunctionError::NotFound(_) => ApiError::new(ErrorCode::NotFound, error.to_string()),
+        FunctionError::Busy(_, max) => ApiError::new(ErrorCode::LimitExceeded, error.to_string())
+            .with_details(serde_json::json!({ "max_concurrency": max })),
+        FunctionError::Execution(e) => ApiError::from(&e),
     };
+    error.response()
+}
 
-    let result = executor.execute(execute_request).await;
-    match result {
-        Ok(response) => Ok(HttpResponse::Ok().json(response)),
-        Err(e) => Ok(HttpResponse::InternalServerError().json(serde_json::json!({
-            "error": "Execution failed",
-            "message": e.to_string()
+async fn deploy_function(
+    functions: web::Data<Arc<FunctionRegistry>>,
+    path: web::Path<String>,
+    request: web::Json<FunctionSpec>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    let name = path.into_inner();
+    match functions.deploy(&tenant, &name, request.into_inner()).await {
+        Ok(definition) => Ok(encoding::respond(
+            &http_request,
+            StatusCode::OK,
+            &definition,
+        )),
+        Err(e) => Ok(execution_error_response(e)),
+    }
+}
+
+async fn list_functions(
+    functions: web::Data<Arc<FunctionRegistry>>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    let list = serde_json::json!({ "functions": functions.list(&tenant) });
+    Ok(encoding::respond(&http_request, StatusCode::OK, &list))
+}
+
+async fn get_function(
+    functions: web::Data<Arc<FunctionRegistry>>,
+    path: web::Path<String>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    let name = path.into_inner();
+    match functions.get(&tenant, &name) {
+        Some(definition) => Ok(encoding::respond(
+            &http_request,
+            StatusCode::OK,
+            &definition,
+        )),
+        None => Ok(function_not_found(&name)),
+    }
+}
+
+async fn delete_function(
+    functions: web::Data<Arc<FunctionRegistry>>,
+    path: web::Path<String>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    let name = path.into_inner();
+    if functions.remove(&tenant, &name).await {
+        Ok(HttpResponse::NoContent().finish())
+    } else {
+        Ok(function_not_found(&name))
+    }
+}
+
+async fn invoke_function(
+    functions: web::Data<Arc<FunctionRegistry>>,
+    path: web::Path<String>,
+    request: web::Json<Invocation>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    let name = path.into_inner();
+    match functions.invoke(&tenant, &name, request.into_inner()).await {
+        Ok(result) => Ok(encoding::respond(&http_request, StatusCode::OK, &result)),
+        Err(e) => Ok(function_error_response(e)),
+    }
+}
+
+async fn function_metrics(
+    functions: web::Data<Arc<FunctionRegistry>>,
+    path: web::Path<String>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    let name = path.into_inner();
+    if functions.get(&tenant, &name).is_none() {
+        return Ok(function_not_found(&name));
+    }
+    let stats = functions.metrics().function(&tenant, &name);
+    Ok(encoding::respond(&http_request, StatusCode::OK, &stats))
+}
+
+async fn update_function_scaling(
+    functions: web::Data<Arc<FunctionRegistry>>,
+    path: web::Path<String>,
+    request: web::Json<ScalingUpdate>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    let name = path.into_inner();
+    match functions
+        .update_scaling(&tenant, &name, request.into_inner())
+        .await
+    {
+        Ok(definition) => Ok(encoding::respond(
+            &http_request,
+            StatusCode::OK,
+            &definition,
+        )),
+        Err(e) => Ok(function_error_response(e)),
+    }
+}
+
+fn assignment_error_response(error: AssignmentError) -> HttpResponse {
+    let code = match error {
+        AssignmentError::Invalid(_) => ErrorCode::InvalidRequest,
+        AssignmentError::NotFound(_) => ErrorCode::NotFound,
+    };
+    ApiError::new(code, error.to_string()).response()
+}
+
+fn assignment_not_found(name: &str) -> HttpResponse {
+    assignment_error_response(AssignmentError::NotFound(name.to_string()))
+}
+
+async fn put_assignment(
+    executor: web::Data<Arc<CodeExecutor>>,
+    assignments: web::Data<Arc<AssignmentRegistry>>,
+    path: web::Path<String>,
+    request: web::Json<AssignmentSpec>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    let assignment = match Assignment::new(&tenant, &path.into_inner(), request.into_inner()) {
+        Ok(assignment) => assignment,
+        Err(e) => return Ok(assignment_error_response(e)),
+    };
+    // The language, preset and harness are checked once here rather than failing
+    // every submission
+    if let Err(e) = executor.plan(assignment.request(String::new())) {
+        return Ok(execution_error_response(e));
+    }
+    Ok(HttpResponse::Ok().json(assignments.put(assignment)))
+}
+
+async fn list_assignments(
+    assignments: web::Data<Arc<AssignmentRegistry>>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    Ok(HttpResponse::Ok().json(serde_json::json!({ "assignments": assignments.list(&tenant) })))
+}
+
+async fn get_assignment(
+    assignments: web::Data<Arc<AssignmentRegistry>>,
+    path: web::Path<String>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    let name = path.into_inner();
+    match assignments.get(&tenant, &name) {
+        Some(assignment) => Ok(HttpResponse::Ok().json(assignment)),
+        None => Ok(assignment_not_found(&name)),
+    }
+}
+
+async fn delete_assignment(
+    assignments: web::Data<Arc<AssignmentRegistry>>,
+    path: web::Path<String>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    let name = path.into_inner();
+    if assignments.remove(&tenant, &name) {
+        Ok(HttpResponse::NoContent().finish())
+    } else {
+        Ok(assignment_not_found(&name))
+    }
+}
+
+// Runs a submission against the assignment's test cases and records its score
+async fn submit_assignment(
+    executor: web::Data<Arc<CodeExecutor>>,
+    assignments: web::Data<Arc<AssignmentRegistry>>,
+    path: web::Path<String>,
+    request: web::Json<SubmissionRequest>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+    let deadline = match request_deadline(&http_request) {
+        Ok(deadline) => deadline,
+        Err(response) => return Ok(response),
+    };
+
+    let name = path.into_inner();
+    let Some(assignment) = assignments.get(&tenant, &name) else {
+        return Ok(assignment_not_found(&name));
+    };
+    let submission = request.into_inner();
+    let labels = submission_labels(&name, &submission);
+    let mut execute_request = assignment.request(submission.code);
+    execute_request.labels = Some(labels.clone());
+    execute_request.deadline = deadline;
+    execute_request.trace_context = request_trace_context(&http_request);
+
+    let response = match executor.execute(execute_request).await {
+        Ok(response) => response,
+        Err(e) => return Ok(execution_error_response(e)),
+    };
+    let graded = assignment.grade(submission.student, labels, &response);
+    if let Err(e) = assignments.record(&tenant, &name, graded.clone()) {
+        return Ok(assignment_error_response(e));
+    }
+    Ok(HttpResponse::Ok().json(serde_json::json!({
+        "submission": graded,
+        "result": response
+    })))
+}
+
+async fn list_submissions(
+    assignments: web::Data<Arc<AssignmentRegistry>>,
+    path: web::Path<String>,
+    query: web::Query<SubmissionListQuery>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    let name = path.into_inner();
+    match assignments.submissions(&tenant, &name, query.student.as_deref()) {
+        Ok(submissions) => Ok(HttpResponse::Ok().json(serde_json::json!({
+            "assignment": name,
+            "submissions": submissions
         }))),
+        Err(e) => Ok(assignment_error_response(e)),
+    }
+}
+
+async fn assignment_results(
+    assignments: web::Data<Arc<AssignmentRegistry>>,
+    path: web::Path<String>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    match assignments.results(&tenant, &path.into_inner()) {
+        Ok(results) => Ok(HttpResponse::Ok().json(results)),
+        Err(e) => Ok(assignment_error_response(e)),
+    }
+}
+
+async fn delete_tenant_data(
+    executor: web::Data<Arc<CodeExecutor>>,
+    sessions: web::Data<Arc<SessionManager>>,
+    functions: web::Data<Arc<FunctionRegistry>>,
+    assignments: web::Data<Arc<AssignmentRegistry>>,
+    queue: web::Data<Arc<dyn JobQueue>>,
+    path: web::Path<String>,
+    query: web::Query<TenantDataQuery>,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+
+    let target = path.into_inner();
+    if target != tenant && !is_admin(&executor, &tenant) {
+        return Ok(ApiError::new(
+            ErrorCode::Forbidden,
+            "Deleting another tenant's data requires an admin tenant",
+        )
+        .response());
+    }
+
+    let label = query.into_inner().label;
+    let executions = executor.store().purge(&ExecutionFilter {
+        tenant: Some(target.clone()),
+        label: label.clone(),
+        ..Default::default()
+    });
+    let submissions = match &label {
+        Some(label) => assignments.remove_submissions(&target, label),
+        None => 0,
+    };
+    // Sessions, job statuses and functions carry no labels, so they are only deleted
+    // with the whole tenant
+    let (sessions_deleted, jobs_deleted, functions_deleted, bundles_deleted, assignments_deleted) =
+        if label.is_none() {
+            let jobs = match queue.remove_statuses(&target).await {
+                Ok(jobs) => jobs,
+                Err(e) => {
+                    return Ok(
+                        ApiError::new(ErrorCode::BackendUnavailable, e.to_string()).response()
+                    )
+                }
+            };
+            (
+                sessions.remove_tenant(&target).len(),
+                jobs,
+                functions.remove_tenant(&target).await,
+                executor.bundles().remove_tenant(&target),
+                assignments.remove_tenant(&target),
+            )
+        } else {
+            (0, 0, 0, 0, 0)
+        };
+
+    log::info!(
+        "Tenant {tenant} deleted data of tenant {target} (label: {}): {} executions, {sessions_deleted} sessions, {jobs_deleted} jobs, {functions_deleted} functions, {bundles_deleted} bundles, {assignments_deleted} assignments, {submissions} submissions",
+        label.as_deref().unwrap_or("-"),
+        executions.len()
+    );
+    Ok(HttpResponse::Ok().json(serde_json::json!({
+        "tenant": target,
+        "label": label,
+        "deleted_at": unix_timestamp(),
+        "deleted": {
+            "executions": executions.len(),
+            "sessions": sessions_deleted,
+            "jobs": jobs_deleted,
+            "functions": functions_deleted,
+            "bundles": bundles_deleted,
+            "assignments": assignments_deleted,
+            "submissions": submissions
+        }
+    })))
+}
+
+// Runs code with test case inputs too large to send as JSON. The body is
+// multipart/form-data: a `request` part with the JSON of an execute request, an
+// optional `code` part replacing its code, and an `input.<test case name>` part per
+// test case whose input is uploaded. Inputs are streamed to disk as they arrive and
+// the program reads them from there.
+async fn execute_upload(
+    executor: web::Data<Arc<CodeExecutor>>,
+    max_request_bytes: web::Data<MaxRequestBytes>,
+    payload: web::Payload,
+    http_request: HttpRequest,
+) -> Result<HttpResponse> {
+    let tenant = match authenticate_request(&http_request).await {
+        Ok(tenant) => tenant,
+        Err(response) => return Ok(response),
+    };
+    let deadline = match request_deadline(&http_request) {
+        Ok(deadline) => deadline,
+        Err(response) => return Ok(response),
+    };
+
+    let content_type = http_request
+        .headers()
+        .get(header::CONTENT_TYPE)
+        .and_then(|value| value.to_str().ok())
+        .unwrap_or_default();
+    let mut multipart = match Multipart::new(content_type, payload) {
+        Ok(multipart) => multipart,
+        Err(e) => return Ok(upload_error_response(e)),
+    };
+    let directory = match UploadDirectory::create() {
+        Ok(directory) => directory,
+        Err(e) => {
+            return Ok(ApiError::new(
+                ErrorCode::Internal,
+                format!("Failed to store the upload: {e}"),
+            )
+            .response())
+        }
+    };
+    let request = read_upload(
+        &mut multipart,
+        executor.request_limits(),
+        max_request_bytes.0,
+        &directory,
+    )
+    .await;
+    let mut request = match request {
+        Ok(request) => request,
+        Err(response) => return Ok(response),
+    };
+    request.tenant = Some(tenant);
+    request.deadline = deadline;
+    request.trace_context = request_trace_context(&http_request);
+
+    let result = executor.execute(request).await;
+    match result {
+        Ok(response) => Ok(encoding::respond_execution(&http_request, &response)),
+        Err(e) => Ok(execution_error_response(e)),
+    }
+}
+
+// Collects the parts of an upload into an execute request, writing test case
+// inputs to `directory`
+async fn read_upload(
+    multipart: &mut Multipart<web::Payload>,
+    limits: &RequestLimits,
+    max_request_bytes: usize,
+    directory: &UploadDirectory,
+) -> Result<ExecuteRequest, HttpResponse> {
+    let invalid = |message: String| ApiError::new(ErrorCode::InvalidRequest, message).response();
+    let mut request: Option<ExecuteRequest> = None;
+    let mut code = None;
+    let mut inputs = HashMap::new();
+    let mut uploaded = 0;
+    while let Some(part) = multipart.next_part().await.map_err(upload_error_response)? {
+        if part.name == "request" {
+            let json = multipart
+                .bytes(max_request_bytes as u64)
+                .await
+                .map_err(upload_error_response)?;
+            request = Some(
+                serde_json::from_slice(&json)
+                    .map_err(|e| invalid(format!("Invalid request part: {e}")))?,
+            );
+        } else if part.name == "code" {
+            let bytes = multipart
+                .bytes(limits.max_code_bytes as u64)
+                .await
+                .map_err(|e| match e {
+                    UploadError::TooLarge(..) => ApiError::new(
+                        ErrorCode::CodeTooLarge,
+                        format!("code exceeds the limit of {} bytes", limits.max_code_bytes),
+                    )
+                    .with_details(serde_json::json!({
+                        "field": "code",
+                        "limit": limits.max_code_bytes
+                    }))
+                    .response(),
+                    e => upload_error_response(e),
+                })?;
+            code = Some(
+                String::from_utf8(bytes)
+                    .map_err(|_| invalid("The code part is not valid UTF-8".to_string()))?,
+            );
+        } else if let Some(name) = part.name.strip_prefix("input.") {
+            if inputs.contains_key(name) {
+                return Err(invalid(format!("Test case '{name}' has two inputs")));
+            }
+            let path = directory.0.join(inputs.len().to_string());
+            uploaded += multipart
+                .save(&path, limits.max_upload_bytes - uploaded)
+                .await
+                .map_err(|e| match e {
+                    UploadError::TooLarge(..) => payload_too_large(
+                        "inputs",
+                        &format!(
+                            "uploaded inputs exceed the limit of {} bytes",
+                            limits.max_upload_bytes
+                        ),
+                    ),
+                    e => upload_error_response(e),
+                })?;
+            inputs.insert(name.to_string(), path);
+        } else {
+            return Err(invalid(format!("Unexpected part '{}'", part.name)));
+        }
+    }
+
+    let mut request = request.ok_or_else(|| invalid("The request part is missing".to_string()))?;
+    if let Some(code) = code {
+        request.code = code;
+    }
+    let test_cases = request.test_cases.as_deref().unwrap_or_default();
+    if let Some(name) = inputs
+        .keys()
+        .find(|name| !test_cases.iter().any(|test_case| &test_case.name == *name))
+    {
+        return Err(invalid(format!("There is no test case named '{name}'")));
+    }
+    request.uploaded_inputs = inputs;
+    Ok(request)
+}
+
+fn upload_error_response(error: UploadError) -> HttpResponse {
+    match &error {
+        UploadError::TooLarge(part, _) => payload_too_large(part, &error.to_string()),
+        UploadError::Io(_) => ApiError::new(ErrorCode::Internal, error.to_string()).response(),
+        UploadError::Malformed(_) | UploadError::Stream(_) => {
+            ApiError::new(ErrorCode::InvalidRequest, error.to_string()).response()
+        }
+    }
+}
+
+// Where an upload's inputs are written, under DATA_DIR rather than the host's /tmp.
+// It's removed when the request is done, including when the caller disconnects.
+struct UploadDirectory(PathBuf);
+
+impl UploadDirectory {
+    fn create() -> std::io::Result<Self> {
+        let root = data_dir().join("uploads");
+        std::fs::create_dir_all(&root)?;
+        let path = root.join(uuid::Uuid::new_v4().to_string());
+        std::fs::create_dir(&path)?;
+        Ok(Self(path))
+    }
+}
+
+impl Drop for UploadDirectory {
+    fn drop(&mut self) {
+        if let Err(e) = std::fs::remove_dir_all(&self.0) {
+            log::warn!(
+                "Failed to remove upload directory {}: {e}",
+                self.0.display()
+            );
+        }
     }
 }
 
@@ -399,9 +3355,104 @@ async fn download_test_case(url: &str) -> Result<String, Box<dyn std::error::Err
     Ok(content)
 }
 
+// Routes of version 1 of the API. They're served at `/v1` and, for integrations
+// written before versioning, at `/api/v1`.
+fn api_v1(config: &mut web::ServiceConfig) {
+    config
+        .route("/check", web::post().to(check_code))
+        .route("/execute", web::post().to(execute_code))
+        .route("/estimate", web::post().to(estimate_cost))
+        .route(
+            "/execute/test-cases",
+            web::post().to(execute_with_test_cases),
+        )
+        .route(
+            "/execute/test-files",
+            web::post().to(execute_with_test_files),
+        )
+        .route("/execute/test-urls", web::post().to(execute_with_test_urls))
+        .route("/execute/upload", web::post().to(execute_upload))
+        .route("/executions", web::get().to(list_executions))
+        .route("/executions", web::delete().to(purge_executions))
+        .route("/executions/similarity", web::post().to(compare_executions))
+        .route("/executions/{id}", web::get().to(get_execution))
+        .route("/executions/{id}", web::delete().to(delete_execution))
+        .route(
+            "/executions/{id}/archive",
+            web::get().to(download_execution_archive),
+        )
+        .route(
+            "/executions/{id}/files/{path:.*}",
+            web::get().to(download_execution_file),
+        )
+        .route("/languages", web::get().to(list_languages))
+        .route("/presets", web::get().to(list_presets))
+        .route("/presets/{name}", web::get().to(get_preset))
+        .route("/presets/{name}", web::put().to(put_preset))
+        .route("/presets/{name}", web::delete().to(delete_preset))
+        .route("/presets/{name}/bundle", web::put().to(put_preset_bundle))
+        .route("/presets/{name}/bundle", web::get().to(get_preset_bundle))
+        .route(
+            "/presets/{name}/bundle",
+            web::delete().to(delete_preset_bundle),
+        )
+        .route("/usage", web::get().to(get_usage))
+        .route("/assignments", web::get().to(list_assignments))
+        .route("/assignments/{name}", web::put().to(put_assignment))
+        .route("/assignments/{name}", web::get().to(get_assignment))
+        .route("/assignments/{name}", web::delete().to(delete_assignment))
+        .route(
+            "/assignments/{name}/submissions",
+            web::post().to(submit_assignment),
+        )
+        .route(
+            "/assignments/{name}/submissions",
+            web::get().to(list_submissions),
+        )
+        .route(
+            "/assignments/{name}/results",
+            web::get().to(assignment_results),
+        )
+        .route("/events", web::get().to(stream_events))
+        .route("/jobs", web::post().to(submit_job))
+        .route("/jobs/{id}", web::get().to(get_job))
+        .route("/jobs/{id}/logs", web::get().to(job_logs))
+        .route("/jobs/{id}/stats", web::get().to(job_stats))
+        .route("/sessions", web::post().to(create_session))
+        .route("/sessions", web::get().to(list_sessions))
+        .route("/sessions", web::delete().to(terminate_sessions))
+        .route("/sessions/{id}", web::get().to(get_session))
+        .route("/sessions/{id}", web::patch().to(share_session))
+        .route("/sessions/{id}", web::delete().to(delete_session))
+        .route("/sessions/{id}/attach", web::get().to(attach_session))
+        .route(
+            "/sessions/{id}/terminal",
+            web::put().to(set_session_terminal),
+        )
+        .route("/sessions/{id}/execute", web::post().to(execute_in_session))
+        .route("/sessions/{id}/snapshots", web::post().to(snapshot_session))
+        .route("/snapshots", web::get().to(list_snapshots))
+        .route("/snapshots/{id}", web::delete().to(delete_snapshot))
+        .route("/functions", web::get().to(list_functions))
+        .route("/functions/{name}", web::put().to(deploy_function))
+        .route("/functions/{name}", web::get().to(get_function))
+        .route("/functions/{name}", web::delete().to(delete_function))
+        .route("/functions/{name}/invoke", web::post().to(invoke_function))
+        .route("/functions/{name}/metrics", web::get().to(function_metrics))
+        .route(
+            "/functions/{name}/scaling",
+            web::patch().to(update_function_scaling),
+        )
+        .route(
+            "/tenants/{tenant}/data",
+            web::delete().to(delete_tenant_data),
+        );
+}
+
 #[actix_web::main]
 async fn main() -> std::io::Result<()> {
     env_logger::init_from_env(env_logger::Env::new().default_filter_or("info"));
+    install_panic_hook();
 
     log::info!("Starting IsoBox server...");
 
@@ -426,80 +3477,332 @@ async fn main() -> std::io::Result<()> {
         log::info!("JWT audience: {audience}");
     }
 
-    // Create executor without deduplication
-    let executor = Arc::new(CodeExecutor::new());
+    let config = match IsoboxConfig::load() {
+        Ok(config) => config,
+        Err(e) => {
+            log::error!("Invalid configuration: {e}");
+            std::process::exit(1);
+        }
+    };
 
-    // Check if Docker is available
-    match std::process::Command::new("docker")
-        .arg("--version")
-        .output()
-    {
-        Ok(output) if output.status.success() => {
-            let version = String::from_utf8_lossy(&output.stdout);
-            log::info!("Docker available: {}", version.trim());
-
-            // Additional Docker health check
-            match std::process::Command::new("docker").arg("info").output() {
-                Ok(info_output) if info_output.status.success() => {
-                    log::info!("Docker daemon is running and accessible");
-                }
-                _ => {
-                    log::warn!("Docker daemon may not be fully accessible");
+    let mut events = match EventBus::from_env() {
+        Ok(events) => events,
+        Err(e) => {
+            log::error!("{e}");
+            std::process::exit(1);
+        }
+    };
+    if let Some(webhooks) = WebhookSink::from_config(&config) {
+        events = events.with_sink(Box::new(webhooks));
+    }
+    if let Some(shipper) = LogShipper::from_config(&config) {
+        events = events.with_sink(Box::new(shipper));
+    }
+    let activity = Arc::new(ActivityTracker::new());
+    events = events.with_sink(Box::new(activity.clone()));
+
+    let store = match ExecutionStore::open_from_env() {
+        Ok(store) => store,
+        Err(e) => {
+            log::error!("{e}");
+            std::process::exit(1);
+        }
+    };
+
+    // Create executor
+    let executor = Arc::new(
+        CodeExecutor::with_config(&config)
+            .with_store(store)
+            .with_events(events),
+    );
+
+    if executor.embedded_backend() {
+        // Embedded runtimes need no container runtime, only their interpreters
+        if executor.languages().is_empty() {
+            log::error!(
+                "EXECUTION_BACKEND=embedded needs embedded_runtimes in the configuration file"
+            );
+            std::process::exit(1);
+        }
+        if let Err(e) = executor.verify_embedded_runtimes() {
+            log::error!("{e}");
+            std::process::exit(1);
+        }
+        log::info!("Embedded runtimes: {}", executor.languages().join(", "));
+    } else {
+        // Check if Docker is available
+        match std::process::Command::new("docker")
+            .arg("--version")
+            .output()
+        {
+            Ok(output) if output.status.success() => {
+                let version = String::from_utf8_lossy(&output.stdout);
+                log::info!("Docker available: {}", version.trim());
+
+                // Additional Docker health check
+                match std::process::Command::new("docker").arg("info").output() {
+                    Ok(info_output) if info_output.status.success() => {
+                        log::info!("Docker daemon is running and accessible");
+                    }
+                    _ => {
+                        log::warn!("Docker daemon may not be fully accessible");
+                    }
                 }
             }
+            _ => {
+                log::error!("Docker is not available or not running!");
+                std::process::exit(1);
+            }
         }
-        _ => {
-            log::error!("Docker is not available or not running!");
+    }
+
+    // Refuse to start if sandboxes would run as host root despite SANDBOX_USERNS,
+    // if CGROUP_PARENT can't hold their cgroups, if a pinned image digest can't be
+    // resolved, or in air-gapped mode if any image would have to be pulled
+    if let Err(e) = executor
+        .verify_user_mapping()
+        .and_then(|_| executor.verify_cgroups())
+        .and_then(|_| executor.verify_cpu_pinning())
+        .and_then(|_| executor.verify_air_gapped())
+        .and_then(|_| executor.verify_pinned_images())
+    {
+        log::error!("{e}");
+        std::process::exit(1);
+    }
+
+    // Download object-store datasets once so executions mount a local copy
+    if let Err(e) = executor.prepare_datasets() {
+        log::error!("{e}");
+        std::process::exit(1);
+    }
+
+    // Scan the language images for vulnerabilities in the background; images run
+    // until their first scan finishes
+    tokio::spawn(executor.clone().scan_images_periodically());
+
+    let queue = match queue::queue_from_env(executor.config().queue_weights()).await {
+        Ok(queue) => queue,
+        Err(e) => {
+            log::error!("{e}");
             std::process::exit(1);
         }
+    };
+    // JOB_CONSUMERS=0 makes this instance accept jobs without running any
+    let consumers = std::env::var("JOB_CONSUMERS")
+        .ok()
+        .and_then(|s| s.parse::<usize>().ok())
+        .unwrap_or(4);
+    log::info!(
+        "Job queue: {} backend, {consumers} consumers",
+        queue.backend()
+    );
+    for _ in 0..consumers {
+        tokio::spawn(queue::run_consumer(queue.clone(), executor.clone()));
+    }
+    let queue_progress = Arc::new(QueueProgress::from_env());
+    if let Some(max_depth) = queue_progress.max_depth() {
+        log::info!("Job queue accepts at most {max_depth} waiting jobs");
     }
 
+    // Remove expired sessions and their volumes in the background, telling tenants
+    // about sessions that are about to close. Checked often, so that warnings arrive
+    // close to the start of the grace period.
+    let sessions =
+        Arc::new(SessionManager::from_env().with_tenant_limits(executor.config().session_limits()));
+    let reaper_sessions = sessions.clone();
+    let reaper_events = executor.clone();
+    tokio::spawn(async move {
+        let mut interval = tokio::time::interval(Duration::from_secs(10));
+        loop {
+            interval.tick().await;
+            for event in reaper_sessions.reap_expired(unix_timestamp()) {
+                reaper_events.events().publish(&event);
+            }
+        }
+    });
+
+    // Stop function instances that have been idle too long, and start instances for
+    // functions below their minimum
+    let functions = Arc::new(FunctionRegistry::from_env(executor.clone()));
+    let assignments = Arc::new(AssignmentRegistry::from_env());
+    let reaper_functions = functions.clone();
+    let shutdown_functions = functions.clone();
+    let shutdown_executor = executor.clone();
+    tokio::spawn(async move {
+        let mut interval = tokio::time::interval(Duration::from_secs(60));
+        loop {
+            interval.tick().await;
+            reaper_functions.scale(unix_timestamp()).await;
+        }
+    });
+
+    // Drop stored executions and their artifacts once their retention has passed
+    let reaper_executor = executor.clone();
+    tokio::spawn(async move {
+        let mut interval = tokio::time::interval(Duration::from_secs(300));
+        loop {
+            interval.tick().await;
+            reaper_executor.purge_expired_executions();
+        }
+    });
+
     let port = std::env::var("PORT").unwrap_or_else(|_| "8000".to_string());
     let grpc_port = std::env::var("GRPC_PORT").unwrap_or_else(|_| "50051".to_string());
     let bind_address = format!("0.0.0.0:{port}");
     let grpc_address = format!("0.0.0.0:{grpc_port}");
+    // Largest request body, on either API
+    let max_request_bytes = std::env::var("MAX_REQUEST_BYTES")
+        .ok()
+        .and_then(|s| s.parse::<usize>().ok())
+        .unwrap_or(10 * 1024 * 1024);
 
     log::info!("HTTP server starting on {bind_address}");
     log::info!("gRPC server starting on {grpc_address}");
 
+    // Shared by every worker thread and the gRPC service so limits hold across the
+    // whole server
+    let limiter = Arc::new(RateLimiter::new());
+
     // Create gRPC service without authentication for now
-    let grpc_service = CodeExecutionServiceImpl::new(executor.clone(), None);
+    let grpc_service = CodeExecutionServiceImpl::new(executor.clone(), limiter.clone(), None);
 
     // Start gRPC server in a separate task
     let grpc_service_clone = grpc_service.clone();
     let grpc_handle = tokio::spawn(async move {
         tonic::transport::Server::builder()
             .add_service(
+                // Large enough for any request the HTTP API takes, so oversized code
+                // gets the same error as there rather than a decoding failure
                 crate::generated::isobox::code_execution_service_server::CodeExecutionServiceServer::new(grpc_service_clone)
+                    .max_decoding_message_size(max_request_bytes)
             )
             .serve(grpc_address.parse().unwrap())
             .await
     });
 
+    // Accept remote worker agents over mTLS when certificates are configured
+    if let Some(tls) = worker_tls_config()? {
+        let worker_port = std::env::var("WORKER_GRPC_PORT").unwrap_or_else(|_| "50052".to_string());
+        let worker_address = format!("0.0.0.0:{worker_port}");
+        log::info!("Worker agent listener starting on {worker_address}");
+        let worker_service = WorkerServiceImpl::new(executor.workers());
+        let server = tonic::transport::Server::builder()
+            .tls_config(tls)
+            .map_err(|e| std::io::Error::new(std::io::ErrorKind::InvalidInput, e))?;
+        tokio::spawn(async move {
+            let result = server
+                .add_service(
+                    crate::generated::isobox::worker_service_server::WorkerServiceServer::new(
+                        worker_service,
+                    ),
+                )
+                .serve(worker_address.parse().unwrap())
+                .await;
+            if let Err(e) = result {
+                log::error!("Worker agent listener error: {e}");
+            }
+        });
+    }
+
+    let client_limiter = Arc::new(ClientLimiter::new(&executor.config().client_limits));
+    let router = Arc::new(ReplicaRouter::new(&executor.config().replicas));
+    let compression_min_bytes = std::env::var("COMPRESSION_MIN_BYTES")
+        .ok()
+        .and_then(|s| s.parse::<u64>().ok())
+        .unwrap_or(1024);
+    let mirror = PackageMirror::from_env(&executor.config().package_mirrors).map(Arc::new);
+    if let Some(url) = &executor.config().package_mirrors.embedded_url {
+        log::info!("Serving the package mirror to sandboxes at {url}/mirror");
+    }
+    let http_settings = web::Data::new(HttpSettings::from_env());
+    let server_settings = http_settings.clone();
+
     // Start HTTP server
-    let http_handle = HttpServer::new(move || {
+    let http_server = HttpServer::new(move || {
         App::new()
             .app_data(web::Data::new(executor.clone()))
-            .wrap(Logger::default())
+            .app_data(web::Data::new(limiter.clone()))
+            .app_data(web::Data::new(client_limiter.clone()))
+            .app_data(web::Data::new(router.clone()))
+            .app_data(
+                web::JsonConfig::default()
+                    .limit(max_request_bytes)
+                    .error_handler(json_error_handler),
+            )
+            .app_data(web::Data::new(sessions.clone()))
+            .app_data(web::Data::new(mirror.clone()))
+            .app_data(web::Data::new(functions.clone()))
+            .app_data(web::Data::new(assignments.clone()))
+            .app_data(web::Data::new(queue.clone()))
+            .app_data(web::Data::new(queue_progress.clone()))
+            .app_data(web::Data::new(activity.clone()))
+            .app_data(web::Data::new(CompressionThreshold(compression_min_bytes)))
+            .app_data(web::Data::new(MaxRequestBytes(max_request_bytes)))
+            .app_data(http_settings.clone())
+            .wrap(from_fn(report_limits))
+            .wrap(from_fn(signal_deprecations))
+            .wrap(from_fn(skip_compression))
+            .wrap(Compress::default())
+            .wrap(from_fn(limit_header_size))
+            .wrap(from_fn(recover_panics))
+            .wrap(Logger::new(
+                r#"%a "%r" %s %b "%{Referer}i" "%{User-Agent}i" %T %{X-Request-Id}o"#,
+            ))
+            .service(
+                web::scope("/v1")
+                    .wrap(from_fn(route_to_replica))
+                    .wrap(from_fn(limit_clients))
+                    .wrap(DefaultHeaders::new().add((API_VERSION_HEADER, "v1")))
+                    .configure(api_v1),
+            )
             .service(
                 web::scope("/api/v1")
-                    .route("/execute", web::post().to(execute_code))
-                    .route(
-                        "/execute/test-cases",
-                        web::post().to(execute_with_test_cases),
-                    )
-                    .route(
-                        "/execute/test-files",
-                        web::post().to(execute_with_test_files),
-                    )
-                    .route("/execute/test-urls", web::post().to(execute_with_test_urls)),
+                    .wrap(from_fn(route_to_replica))
+                    .wrap(from_fn(limit_clients))
+                    .wrap(DefaultHeaders::new().add((API_VERSION_HEADER, "v1")))
+                    .configure(api_v1),
+            )
+            .route("/versions", web::get().to(list_api_versions))
+            .service(
+                web::scope(r"/v{version:\d+}").default_service(web::to(unsupported_api_version)),
+            )
+            .service(
+                web::scope(r"/api/v{version:\d+}")
+                    .default_service(web::to(unsupported_api_version)),
             )
             .service(web::scope("/auth").route("/status", web::get().to(auth_status)))
-            .service(web::scope("/admin").route("/dedup/stats", web::get().to(dedup_stats)))
+            .service(
+                web::scope("/admin")
+                    .wrap(from_fn(require_admin))
+                    .route("/dedup/stats", web::get().to(dedup_stats))
+                    .route("/workers", web::get().to(list_workers))
+                    .route("/workers/{name}/drain", web::post().to(drain_worker))
+                    .route("/autoscaling", web::get().to(autoscaling_metrics))
+                    .route("/images/scans", web::get().to(image_scans))
+                    .route("/images/scan", web::get().to(image_scan))
+                    .route("/syscall-policies", web::get().to(syscall_policies))
+                    .route("/abuse", web::get().to(abuse_flags))
+                    .route("/abuse/{id}", web::post().to(review_abuse_flag))
+                    .route("/languages/{language}/sbom", web::get().to(language_sbom))
+                    .route("/dashboard/stats", web::get().to(dashboard_stats)),
+            )
+            .route("/dashboard", web::get().to(dashboard))
             .route("/health", web::get().to(health_check))
+            .route(
+                "/mirror/{ecosystem}/{path:.*}",
+                web::get().to(mirror_package),
+            )
     })
-    .bind(&bind_address)?
-    .run();
+    .client_request_timeout(server_settings.request_timeout)
+    .client_disconnect_timeout(server_settings.disconnect_timeout)
+    .keep_alive(server_settings.keep_alive)
+    .max_connections(server_settings.max_connections)
+    .max_connection_rate(server_settings.max_connection_rate);
+    let http_handle = if server_settings.h2c {
+        http_server.bind_auto_h2c(&bind_address)?.run()
+    } else {
+        http_server.bind(&bind_address)?.run()
+    };
 
     // Wait for both servers
     tokio::select! {
@@ -514,6 +3817,10 @@ async fn main() -> std::io::Result<()> {
             }
         }
     }
+    // Warm function and syntax checker containers run detached, so they'd outlive the
+    // server
+    shutdown_functions.shutdown().await;
+    shutdown_executor.stop_checkers().await;
 
     Ok(())
 }
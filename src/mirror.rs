@@ -0,0 +1,507 @@
+use crate::config::PackageMirrorConfig;
+use crate::ratelimit::IpRange;
+use crate::store::unix_timestamp;
+use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+use std::collections::HashMap;
+use std::fs;
+use std::io;
+use std::net::IpAddr;
+use std::path::{Path, PathBuf};
+use std::sync::Mutex;
+use std::time::{Duration, SystemTime};
+use thiserror::Error;
+use tokio::io::AsyncWriteExt;
+use uuid::Uuid;
+
+// Hosts the public indexes serve package files from, besides their own. PyPI's
+// index links to files.pythonhosted.org.
+const FILE_HOSTS: [(&str, &str); 1] = [("pip", "https://files.pythonhosted.org")];
+
+// How long a fetch from an index may take, downloads of large packages included
+const FETCH_TIMEOUT: Duration = Duration::from_secs(300);
+
+// Prefix of files downloads are written to before they are complete
+const PARTIAL_PREFIX: &str = ".partial-";
+
+// Clients allowed when none are configured: loopback and the private ranges
+// Docker's networks, and so the sandboxes, get their addresses from
+const SANDBOX_NETWORKS: [&str; 6] = [
+    "127.0.0.0/8",
+    "::1",
+    "10.0.0.0/8",
+    "172.16.0.0/12",
+    "192.168.0.0/16",
+    "fc00::/7",
+];
+
+#[derive(Debug, Error)]
+pub enum MirrorError {
+    #[error("Not found")]
+    NotFound,
+    #[error("Upstream index failed: {0}")]
+    Upstream(String),
+    #[error("Failed to cache the download: {0}")]
+    Cache(String),
+}
+
+/// A response of the mirror, from its cache or fetched from the index. The cached
+/// copy is opened before it can be evicted, so it can always be served whole.
+pub struct MirrorResponse {
+    pub content_type: String,
+    pub file: fs::File,
+    pub path: PathBuf,
+    pub cached: bool,
+}
+
+#[derive(Serialize, Deserialize)]
+struct CachedMeta {
+    content_type: String,
+    fetched_at: u64,
+}
+
+#[derive(Debug)]
+struct Entry {
+    bytes: u64,
+    last_used: SystemTime,
+}
+
+/// A caching mirror of the package indexes, for sandboxes on networks that can't
+/// reach them. Package files never change once published, so they are cached
+/// until the cache grows over its size limit and they are the least recently
+/// used; index pages are refetched once they are older than the index TTL, and
+/// served stale when the index can't be reached.
+pub struct PackageMirror {
+    root: PathBuf,
+    public_url: String,
+    index_ttl: u64,
+    max_bytes: u64,
+    client: reqwest::Client,
+    // Each ecosystem's index first, then the hosts it links package files on
+    origins: HashMap<&'static str, Vec<String>>,
+    clients: Vec<IpRange>,
+    entries: Mutex<HashMap<String, Entry>>,
+}
+
+impl PackageMirror {
+    pub fn new(
+        root: PathBuf,
+        index_ttl: u64,
+        max_bytes: u64,
+        config: &PackageMirrorConfig,
+    ) -> Option<Self> {
+        let public_url = config
+            .embedded_url
+            .as_ref()?
+            .trim_end_matches('/')
+            .to_string();
+        let origins = config
+            .upstreams()
+            .into_iter()
+            .map(|(ecosystem, upstream)| {
+                let hosts = FILE_HOSTS
+                    .iter()
+                    .filter(|(files_ecosystem, _)| *files_ecosystem == ecosystem)
+                    .map(|(_, host)| host.to_string());
+                (ecosystem, std::iter::once(upstream).chain(hosts).collect())
+            })
+            .collect();
+        let clients = if config.clients.is_empty() {
+            SANDBOX_NETWORKS
+                .iter()
+                .map(|range| range.to_string())
+                .collect()
+        } else {
+            config.clients.clone()
+        };
+        let client = reqwest::Client::builder()
+            .timeout(FETCH_TIMEOUT)
+            .build()
+            .ok()?;
+        Some(Self {
+            entries: Mutex::new(load_entries(&root)),
+            root,
+            public_url,
+            index_ttl,
+            max_bytes,
+            client,
+            origins,
+            // Ranges are checked when the configuration is loaded
+            clients: clients
+                .iter()
+                .filter_map(|range| IpRange::parse(range).ok())
+                .collect(),
+        })
+    }
+
+    pub fn from_env(config: &PackageMirrorConfig) -> Option<Self> {
+        let root = std::env::var("MIRROR_DIR")
+            .map(PathBuf::from)
+            .unwrap_or_else(|_| std::env::temp_dir().join("isobox-mirror"));
+        let index_ttl = std::env::var("MIRROR_INDEX_TTL_SECONDS")
+            .ok()
+            .and_then(|value| value.parse().ok())
+            .unwrap_or(600);
+        let max_bytes = std::env::var("MIRROR_MAX_BYTES")
+            .ok()
+            .and_then(|value| value.parse().ok())
+            .unwrap_or(10 * 1024 * 1024 * 1024);
+        Self::new(root, index_ttl, max_bytes, config)
+    }
+
+    /// Whether a client at `ip` may use the mirror
+    pub fn allows(&self, ip: IpAddr) -> bool {
+        self.clients.iter().any(|range| range.contains(ip))
+    }
+
+    /// Serves `path` of an ecosystem's index. Paths under `_/<n>/` are files of the
+    /// index's n-th file host, which links in index pages are rewritten to.
+    pub async fn fetch(&self, ecosystem: &str, path: &str) -> Result<MirrorResponse, MirrorError> {
+        let url = self.upstream_url(ecosystem, path)?;
+        let key = cache_key(ecosystem, path);
+        let cached = self.cached(&key);
+        if let Some(meta) = &cached {
+            let fresh = !is_index(&meta.content_type)
+                || unix_timestamp().saturating_sub(meta.fetched_at) < self.index_ttl;
+            if fresh {
+                // Evicted since its metadata was read, so it's downloaded again
+                if let Ok(response) = self.open(&key, &meta.content_type, true) {
+                    return Ok(response);
+                }
+            }
+        }
+
+        match self.download(ecosystem, &url, &key).await {
+            Ok(content_type) => {
+                let response = self
+                    .open(&key, &content_type, false)
+                    .map_err(|e| MirrorError::Cache(e.to_string()));
+                self.evict();
+                response
+            }
+            Err(MirrorError::Upstream(e)) if cached.is_some() => {
+                log::warn!("Serving a stale copy of {url}: {e}");
+                let meta = cached.unwrap();
+                self.open(&key, &meta.content_type, true)
+                    .map_err(|_| MirrorError::Upstream(e))
+            }
+            Err(e) => Err(e),
+        }
+    }
+
+    fn upstream_url(&self, ecosystem: &str, path: &str) -> Result<String, MirrorError> {
+        let origins = self.origins.get(ecosystem).ok_or(MirrorError::NotFound)?;
+        if path.split('/').any(|part| part == "..") {
+            return Err(MirrorError::NotFound);
+        }
+        let (origin, path) = match path.strip_prefix("_/") {
+            Some(hosted) => {
+                let (host, path) = hosted.split_once('/').ok_or(MirrorError::NotFound)?;
+                let host: usize = host.parse().map_err(|_| MirrorError::NotFound)?;
+                (origins.get(host).ok_or(MirrorError::NotFound)?, path)
+            }
+            None => (&origins[0], path),
+        };
+        Ok(format!("{origin}/{path}"))
+    }
+
+    // Downloads `url` into the cache under `key` and returns its content type.
+    // Package files are streamed to disk as they arrive, so large ones aren't held
+    // in memory; index pages are read whole, since their links are rewritten.
+    async fn download(&self, ecosystem: &str, url: &str, key: &str) -> Result<String, MirrorError> {
+        let upstream = |e: reqwest::Error| MirrorError::Upstream(format!("{url}: {e}"));
+        let cache = |e: io::Error| MirrorError::Cache(e.to_string());
+        let mut response = self.client.get(url).send().await.map_err(upstream)?;
+        let status = response.status();
+        if status == reqwest::StatusCode::NOT_FOUND || status == reqwest::StatusCode::GONE {
+            return Err(MirrorError::NotFound);
+        }
+        if !status.is_success() {
+            return Err(MirrorError::Upstream(format!(
+                "{url} answered with {status}"
+            )));
+        }
+        let content_type = response
+            .headers()
+            .get(reqwest::header::CONTENT_TYPE)
+            .and_then(|value| value.to_str().ok())
+            .unwrap_or("application/octet-stream")
+            .to_string();
+
+        fs::create_dir_all(&self.root).map_err(cache)?;
+        let partial = self
+            .root
+            .join(format!("{PARTIAL_PREFIX}{}", Uuid::new_v4()));
+        let result = async {
+            let mut file = tokio::fs::File::create(&partial).await.map_err(cache)?;
+            if is_index(&content_type) {
+                let body = response.bytes().await.map_err(upstream)?;
+                let page = self.rewrite(ecosystem, &String::from_utf8_lossy(&body));
+                file.write_all(page.as_bytes()).await.map_err(cache)?;
+            } else {
+                while let Some(chunk) = response.chunk().await.map_err(upstream)? {
+                    file.write_all(&chunk).await.map_err(cache)?;
+                }
+            }
+            file.flush().await.map_err(cache)?;
+            self.store(key, &partial, &content_type).map_err(cache)
+        }
+        .await;
+        if let Err(e) = result {
+            fs::remove_file(&partial).ok();
+            return Err(e);
+        }
+        Ok(content_type)
+    }
+
+    // Points the index's links at the mirror, so package files are fetched through
+    // it too
+    fn rewrite(&self, ecosystem: &str, page: &str) -> String {
+        let mut page = page.to_string();
+        for (host, origin) in self.origins[ecosystem].iter().enumerate() {
+            let mirrored = match host {
+                0 => format!("{}/mirror/{ecosystem}", self.public_url),
+                _ => format!("{}/mirror/{ecosystem}/_/{host}", self.public_url),
+            };
+            page = page.replace(origin.as_str(), &mirrored);
+        }
+        page
+    }
+
+    fn cached(&self, key: &str) -> Option<CachedMeta> {
+        let meta = fs::read(self.root.join(format!("{key}.json"))).ok()?;
+        serde_json::from_slice(&meta).ok()
+    }
+
+    fn open(&self, key: &str, content_type: &str, cached: bool) -> io::Result<MirrorResponse> {
+        let path = self.root.join(key);
+        let file = fs::File::open(&path)?;
+        if let Some(entry) = self.entries.lock().unwrap().get_mut(key) {
+            entry.last_used = SystemTime::now();
+        }
+        Ok(MirrorResponse {
+            content_type: content_type.to_string(),
+            file,
+            path,
+            cached,
+        })
+    }
+
+    // Moves a complete download into place. The body is renamed before its
+    // metadata is written, so a reader never sees metadata without the whole body.
+    fn store(&self, key: &str, partial: &Path, content_type: &str) -> io::Result<()> {
+        let path = self.root.join(key);
+        fs::rename(partial, &path)?;
+        let meta = CachedMeta {
+            content_type: content_type.to_string(),
+            fetched_at: unix_timestamp(),
+        };
+        let meta = serde_json::to_vec(&meta).map_err(io::Error::other)?;
+        fs::write(self.root.join(format!("{key}.json")), meta)?;
+        let entry = Entry {
+            bytes: fs::metadata(&path)?.len(),
+            last_used: SystemTime::now(),
+        };
+        self.entries.lock().unwrap().insert(key.to_string(), entry);
+        Ok(())
+    }
+
+    // Removes the least recently used files until the cache fits its limit. Files
+    // being served stay readable, since they are already open.
+    fn evict(&self) {
+        let mut entries = self.entries.lock().unwrap();
+        let mut total: u64 = entries.values().map(|e| e.bytes).sum();
+        while total > self.max_bytes {
+            let Some(key) = entries
+                .iter()
+                .min_by_key(|(_, entry)| entry.last_used)
+                .map(|(key, _)| key.clone())
+            else {
+                break;
+            };
+            let entry = entries.remove(&key).unwrap();
+            total -= entry.bytes;
+            log::info!("Evicted mirrored file {key} ({} bytes)", entry.bytes);
+            // The metadata goes first, so the file isn't served without it
+            for path in [self.root.join(format!("{key}.json")), self.root.join(&key)] {
+                if let Err(e) = fs::remove_file(&path) {
+                    if e.kind() != io::ErrorKind::NotFound {
+                        log::warn!("Failed to remove {}: {e}", path.display());
+                    }
+                }
+            }
+        }
+    }
+}
+
+// Files cached before a restart are kept, ordered by when they were fetched.
+// Downloads the restart interrupted are removed.
+fn load_entries(root: &Path) -> HashMap<String, Entry> {
+    let Ok(files) = fs::read_dir(root) else {
+        return HashMap::new();
+    };
+    files
+        .flatten()
+        .filter_map(|file| {
+            let key = file.file_name().to_string_lossy().into_owned();
+            if key.starts_with('.') {
+                fs::remove_file(file.path()).ok();
+                return None;
+            }
+            if key.ends_with(".json") {
+                return None;
+            }
+            let metadata = file.metadata().ok()?;
+            let entry = Entry {
+                bytes: metadata.len(),
+                last_used: metadata.modified().unwrap_or(SystemTime::UNIX_EPOCH),
+            };
+            Some((key, entry))
+        })
+        .collect()
+}
+
+fn cache_key(ecosystem: &str, path: &str) -> String {
+    hex::encode(Sha256::digest(format!("{ecosystem}/{path}")))
+}
+
+// Index pages list packages and change as they are published; everything else is a
+// package file
+fn is_index(content_type: &str) -> bool {
+    content_type.starts_with("text/")
+        || content_type.contains("json")
+        || content_type.contains("html")
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn mirror() -> PackageMirror {
+        let config = PackageMirrorConfig {
+            npm: Some("https://verdaccio.example.com/".to_string()),
+            embedded_url: Some("http://172.17.0.1:8000".to_string()),
+            ..Default::default()
+        };
+        let root = std::env::temp_dir().join(format!("isobox-mirror-test-{}", Uuid::new_v4()));
+        PackageMirror::new(root, 600, 4, &config).unwrap()
+    }
+
+    fn store(mirror: &PackageMirror, key: &str, body: &[u8]) {
+        fs::create_dir_all(&mirror.root).unwrap();
+        let partial = mirror.root.join(format!("{PARTIAL_PREFIX}{key}"));
+        fs::write(&partial, body).unwrap();
+        mirror.store(key, &partial, "application/zip").unwrap();
+    }
+
+    #[test]
+    fn test_upstream_url() {
+        let mirror = mirror();
+        assert_eq!(
+            mirror.upstream_url("pip", "requests/").unwrap(),
+            "https://pypi.org/simple/requests/"
+        );
+        assert_eq!(
+            mirror
+                .upstream_url("pip", "_/1/packages/ab/requests.whl")
+                .unwrap(),
+            "https://files.pythonhosted.org/packages/ab/requests.whl"
+        );
+        assert_eq!(
+            mirror.upstream_url("npm", "express").unwrap(),
+            "https://verdaccio.example.com/express"
+        );
+        for (ecosystem, path) in [
+            ("cargo", "serde"),
+            ("pip", "_/2/x"),
+            ("go", "../etc/passwd"),
+        ] {
+            assert!(matches!(
+                mirror.upstream_url(ecosystem, path),
+                Err(MirrorError::NotFound)
+            ));
+        }
+    }
+
+    #[test]
+    fn test_index_links_point_at_the_mirror() {
+        let mirror = mirror();
+        assert_eq!(
+            mirror.rewrite(
+                "pip",
+                r#"<a href="https://files.pythonhosted.org/packages/ab/requests.whl">"#
+            ),
+            r#"<a href="http://172.17.0.1:8000/mirror/pip/_/1/packages/ab/requests.whl">"#
+        );
+        assert_eq!(
+            mirror.rewrite(
+                "npm",
+                r#"{"tarball": "https://verdaccio.example.com/express/-/express-4.21.1.tgz"}"#
+            ),
+            r#"{"tarball": "http://172.17.0.1:8000/mirror/npm/express/-/express-4.21.1.tgz"}"#
+        );
+    }
+
+    #[test]
+    fn test_cached_files_are_served() {
+        let mirror = mirror();
+        let key = cache_key("go", "golang.org/x/text/@v/v0.14.0.zip");
+        store(&mirror, &key, b"PK");
+        let meta = mirror.cached(&key).unwrap();
+        let mut response = mirror.open(&key, &meta.content_type, true).unwrap();
+        let mut body = Vec::new();
+        io::Read::read_to_end(&mut response.file, &mut body).unwrap();
+        assert_eq!(
+            (response.content_type.as_str(), body.as_slice()),
+            ("application/zip", &b"PK"[..])
+        );
+        assert!(!is_index(&meta.content_type));
+        assert!(is_index("text/html; charset=utf-8"));
+
+        // Reloaded after a restart, without interrupted downloads
+        fs::write(mirror.root.join(format!("{PARTIAL_PREFIX}x")), b"P").unwrap();
+        let entries = load_entries(&mirror.root);
+        assert_eq!(entries.keys().collect::<Vec<_>>(), vec![&key]);
+        assert!(!mirror.root.join(format!("{PARTIAL_PREFIX}x")).exists());
+        fs::remove_dir_all(&mirror.root).ok();
+    }
+
+    #[test]
+    fn test_least_recently_used_files_are_evicted() {
+        let mirror = mirror();
+        store(&mirror, "a", b"aa");
+        std::thread::sleep(Duration::from_millis(10));
+        store(&mirror, "b", b"bb");
+        std::thread::sleep(Duration::from_millis(10));
+        // An open file is still served after it's evicted
+        let mut served = mirror.open("a", "application/zip", true).unwrap();
+        store(&mirror, "c", b"cc");
+        mirror.evict();
+
+        assert!(mirror.cached("a").is_some() && mirror.cached("c").is_some());
+        assert!(mirror.cached("b").is_none());
+        assert!(!mirror.root.join("b").exists());
+        let mut body = Vec::new();
+        io::Read::read_to_end(&mut served.file, &mut body).unwrap();
+        assert_eq!(body, b"aa");
+        fs::remove_dir_all(&mirror.root).ok();
+    }
+
+    #[test]
+    fn test_clients() {
+        let mirror = mirror();
+        assert!(mirror.allows("172.17.0.5".parse().unwrap()));
+        assert!(mirror.allows("::ffff:10.1.2.3".parse().unwrap()));
+        assert!(!mirror.allows("203.0.113.7".parse().unwrap()));
+
+        let config = PackageMirrorConfig {
+            embedded_url: Some("http://isobox.internal:8000".to_string()),
+            clients: vec!["203.0.113.0/24".to_string()],
+            ..Default::default()
+        };
+        let root = std::env::temp_dir().join(format!("isobox-mirror-test-{}", Uuid::new_v4()));
+        let mirror = PackageMirror::new(root, 600, 4, &config).unwrap();
+        assert!(mirror.allows("203.0.113.7".parse().unwrap()));
+        assert!(!mirror.allows("172.17.0.5".parse().unwrap()));
+    }
+}
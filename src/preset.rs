@@ -0,0 +1,530 @@
+use crate::config::{LanguageLimits, PresetConfig};
+use crate::store::unix_timestamp;
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::process::Stdio;
+use std::sync::{Arc, RwLock};
+use thiserror::Error;
+use tokio::io::AsyncWriteExt;
+use tokio::process::Command;
+
+// Build output kept for failed builds, from the end where the error is
+const BUILD_LOG_BYTES: usize = 8 * 1024;
+
+#[derive(Debug, Error)]
+pub enum PresetError {
+    #[error("{0}")]
+    Invalid(String),
+    #[error("Preset {0} is defined in the server configuration and can't be changed")]
+    Configured(String),
+    #[error("No preset named {0}")]
+    NotFound(String),
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum BuildState {
+    Building,
+    Ready,
+    Failed,
+}
+
+/// The latest image build of a preset
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct BuildStatus {
+    pub state: BuildState,
+    /// Image the build produces
+    pub image: String,
+    pub started_at: u64,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub finished_at: Option<u64>,
+    /// End of the build output, for failed builds
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub log: Option<String>,
+}
+
+/// A preset created through the API. Its packages are installed into an image
+/// built on the language's.
+#[derive(Debug, Clone, Deserialize)]
+pub struct PresetSpec {
+    pub language: String,
+    #[serde(default)]
+    pub packages: Vec<String>,
+    #[serde(default)]
+    pub env: HashMap<String, String>,
+    pub limits: Option<LanguageLimits>,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+struct ManagedPreset {
+    name: String,
+    language: String,
+    packages: Vec<String>,
+    env: HashMap<String, String>,
+    limits: Option<LanguageLimits>,
+    /// Incremented by every update, so a finished build of an older revision is
+    /// ignored
+    revision: u64,
+    updated_by: String,
+    updated_at: u64,
+    /// Image of the last successful build, which requests keep using while a newer
+    /// one builds
+    ready_image: Option<String>,
+    build: BuildStatus,
+}
+
+/// A preset as listed by the `/presets` endpoints. Its environment is left out,
+/// since it may hold credentials.
+#[derive(Debug, Serialize)]
+pub struct PresetDescription {
+    pub name: String,
+    pub language: String,
+    /// Image requests run in; None until the first build finishes
+    pub image: Option<String>,
+    pub packages: Vec<String>,
+    pub limits: LanguageLimits,
+    /// Whether the preset was defined in the server configuration rather than
+    /// through the API
+    pub configured: bool,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub build: Option<BuildStatus>,
+}
+
+/// Presets from the server configuration, and ones admins create through the API,
+/// which are kept under `PRESETS_DIR` across restarts
+pub struct PresetRegistry {
+    dir: PathBuf,
+    configured: HashMap<String, PresetConfig>,
+    managed: RwLock<HashMap<String, ManagedPreset>>,
+}
+
+impl PresetRegistry {
+    pub fn new(dir: PathBuf, configured: HashMap<String, PresetConfig>) -> Self {
+        let managed = load_presets(&dir);
+        Self {
+            dir,
+            configured,
+            managed: RwLock::new(managed),
+        }
+    }
+
+    pub fn from_env(configured: HashMap<String, PresetConfig>) -> Self {
+        let dir = std::env::var("PRESETS_DIR")
+            .map(PathBuf::from)
+            .unwrap_or_else(|_| std::env::temp_dir().join("isobox-presets"));
+        Self::new(dir, configured)
+    }
+
+    /// The preset a request selected, if it has an image to run in
+    pub fn resolve(&self, name: &str) -> Result<PresetConfig, String> {
+        if let Some(preset) = self.configured.get(name) {
+            return Ok(preset.clone());
+        }
+        let managed = self.managed.read().unwrap();
+        let preset = managed
+            .get(name)
+            .ok_or_else(|| format!("Unknown preset '{name}'"))?;
+        let image = preset
+            .ready_image
+            .clone()
+            .ok_or_else(|| match preset.build.state {
+                BuildState::Failed => format!("The image of preset '{name}' failed to build"),
+                _ => format!("The image of preset '{name}' is still building"),
+            })?;
+        Ok(PresetConfig {
+            language: preset.language.clone(),
+            image,
+            packages: preset.packages.clone(),
+            env: preset.env.clone(),
+            limits: preset.limits,
+        })
+    }
+
+    /// Every preset, sorted by name
+    pub fn list(&self) -> Vec<PresetDescription> {
+        let managed = self.managed.read().unwrap();
+        let mut presets: Vec<PresetDescription> = self
+            .configured
+            .iter()
+            .map(|(name, preset)| PresetDescription {
+                name: name.clone(),
+                language: preset.language.clone(),
+                image: Some(preset.image.clone()),
+                packages: preset.packages.clone(),
+                limits: preset.limits.unwrap_or_default(),
+                configured: true,
+                build: None,
+            })
+            .chain(managed.values().map(ManagedPreset::describe))
+            .collect();
+        presets.sort_by(|a, b| a.name.cmp(&b.name));
+        presets
+    }
+
+    pub fn get(&self, name: &str) -> Option<PresetDescription> {
+        self.list().into_iter().find(|preset| preset.name == name)
+    }
+
+    /// Creates or replaces a preset and marks its image as building. The caller
+    /// starts the build with `build` and the returned revision.
+    pub fn put(
+        &self,
+        name: &str,
+        spec: PresetSpec,
+        tenant: &str,
+    ) -> Result<(PresetDescription, u64), PresetError> {
+        if self.configured.contains_key(name) {
+            return Err(PresetError::Configured(name.to_string()));
+        }
+        validate(name, &spec)?;
+        let mut managed = self.managed.write().unwrap();
+        let previous = managed.get(name);
+        let revision = previous.map_or(1, |preset| preset.revision + 1);
+        // A different language can't run in the old image
+        let ready_image = previous
+            .filter(|preset| preset.language == spec.language)
+            .and_then(|preset| preset.ready_image.clone());
+        let now = unix_timestamp();
+        let preset = ManagedPreset {
+            name: name.to_string(),
+            language: spec.language,
+            packages: spec.packages,
+            env: spec.env,
+            limits: spec.limits,
+            revision,
+            updated_by: tenant.to_string(),
+            updated_at: now,
+            ready_image,
+            build: BuildStatus {
+                state: BuildState::Building,
+                image: format!("isobox-preset-{name}:{revision}"),
+                started_at: now,
+                finished_at: None,
+                log: None,
+            },
+        };
+        self.save(&preset);
+        let description = preset.describe();
+        managed.insert(name.to_string(), preset);
+        Ok((description, revision))
+    }
+
+    /// Builds the image of a preset's revision on top of `base_image`, then lets
+    /// requests use it. Builds of revisions replaced in the meantime are discarded.
+    pub async fn build(self: Arc<Self>, name: String, revision: u64, base_image: String) {
+        let Some((image, dockerfile)) = self.managed.read().unwrap().get(&name).map(|preset| {
+            let dockerfile = dockerfile(&base_image, &preset.language, &preset.packages);
+            (preset.build.image.clone(), dockerfile)
+        }) else {
+            return;
+        };
+        log::info!("Building image {image} of preset {name}");
+        let result = docker_build(&image, &dockerfile).await;
+
+        let mut managed = self.managed.write().unwrap();
+        let Some(preset) = managed
+            .get_mut(&name)
+            .filter(|preset| preset.revision == revision)
+        else {
+            return;
+        };
+        preset.build.finished_at = Some(unix_timestamp());
+        match result {
+            Ok(()) => {
+                log::info!("Built image {image} of preset {name}");
+                preset.build.state = BuildState::Ready;
+                preset.ready_image = Some(image);
+            }
+            Err(output) => {
+                log::warn!("Failed to build image {image} of preset {name}");
+                preset.build.state = BuildState::Failed;
+                preset.build.log = Some(tail(&output, BUILD_LOG_BYTES));
+            }
+        }
+        self.save(preset);
+    }
+
+    pub fn remove(&self, name: &str) -> Result<(), PresetError> {
+        if self.configured.contains_key(name) {
+            return Err(PresetError::Configured(name.to_string()));
+        }
+        if self.managed.write().unwrap().remove(name).is_none() {
+            return Err(PresetError::NotFound(name.to_string()));
+        }
+        if let Err(e) = fs::remove_file(self.path(name)) {
+            log::warn!("Failed to remove preset {name}: {e}");
+        }
+        Ok(())
+    }
+
+    fn path(&self, name: &str) -> PathBuf {
+        self.dir.join(format!("{name}.json"))
+    }
+
+    fn save(&self, preset: &ManagedPreset) {
+        let result = fs::create_dir_all(&self.dir).and_then(|_| {
+            let data = serde_json::to_vec_pretty(preset).map_err(std::io::Error::other)?;
+            fs::write(self.path(&preset.name), data)
+        });
+        if let Err(e) = result {
+            log::warn!("Failed to save preset {}: {e}", preset.name);
+        }
+    }
+}
+
+impl ManagedPreset {
+    fn describe(&self) -> PresetDescription {
+        PresetDescription {
+            name: self.name.clone(),
+            language: self.language.clone(),
+            image: self.ready_image.clone(),
+            packages: self.packages.clone(),
+            limits: self.limits.unwrap_or_default(),
+            configured: false,
+            build: Some(self.build.clone()),
+        }
+    }
+}
+
+// Package manager command that installs packages for a language, with its
+// environment so programs find what it installed
+fn installer(language: &str) -> Option<(&'static [&'static str], Option<&'static str>)> {
+    match language {
+        "python" | "python2" => Some((&["pip", "install", "--no-cache-dir"], None)),
+        "node" => Some((
+            &["npm", "install", "--global"],
+            Some("NODE_PATH=/usr/local/lib/node_modules"),
+        )),
+        "ruby" => Some((&["gem", "install", "--no-document"], None)),
+        _ => None,
+    }
+}
+
+fn validate(name: &str, spec: &PresetSpec) -> Result<(), PresetError> {
+    // Names become image names, which Docker wants in lower case
+    let valid_name = !name.is_empty()
+        && name.len() <= 64
+        && name.starts_with(|c: char| c.is_ascii_lowercase() || c.is_ascii_digit())
+        && name
+            .chars()
+            .all(|c| c.is_ascii_lowercase() || c.is_ascii_digit() || "._-".contains(c));
+    if !valid_name {
+        return Err(PresetError::Invalid(format!(
+            "Invalid preset name '{name}': use lower case letters, digits, '.', '_' and '-'"
+        )));
+    }
+    if installer(&spec.language).is_none() {
+        return Err(PresetError::Invalid(format!(
+            "Presets can't install packages for {}; only for python, python2, node and ruby",
+            spec.language
+        )));
+    }
+    // Package names are passed as arguments without a shell, but must not be
+    // taken for options such as --index-url
+    if let Some(package) = spec.packages.iter().find(|package| {
+        package.is_empty()
+            || package.starts_with('-')
+            || package
+                .chars()
+                .any(|c| c.is_whitespace() || c == '"' || c == '\\')
+    }) {
+        return Err(PresetError::Invalid(format!("Invalid package '{package}'")));
+    }
+    PresetConfig {
+        language: spec.language.clone(),
+        image: name.to_string(),
+        packages: spec.packages.clone(),
+        env: spec.env.clone(),
+        limits: spec.limits,
+    }
+    .validate(name)
+    .map_err(PresetError::Invalid)
+}
+
+// The Dockerfile of a preset's image. Arguments are given in exec form, so
+// package names never reach a shell.
+fn dockerfile(base_image: &str, language: &str, packages: &[String]) -> String {
+    let mut dockerfile = format!("FROM {base_image}\n");
+    let Some((command, env)) = installer(language) else {
+        return dockerfile;
+    };
+    if let Some(env) = env {
+        dockerfile.push_str(&format!("ENV {env}\n"));
+    }
+    if !packages.is_empty() {
+        let args: Vec<&str> = command
+            .iter()
+            .copied()
+            .chain(packages.iter().map(String::as_str))
+            .collect();
+        let args = serde_json::to_string(&args).unwrap_or_default();
+        dockerfile.push_str(&format!("RUN {args}\n"));
+    }
+    dockerfile
+}
+
+// Runs `docker build` with the Dockerfile on stdin and no build context. Returns
+// the build output on failure.
+async fn docker_build(image: &str, dockerfile: &str) -> Result<(), String> {
+    let child = Command::new("docker")
+        .args(["build", "--tag", image, "-"])
+        .stdin(Stdio::piped())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .spawn();
+    let mut child = child.map_err(|e| format!("Failed to run docker build: {e}"))?;
+    if let Some(mut stdin) = child.stdin.take() {
+        stdin
+            .write_all(dockerfile.as_bytes())
+            .await
+            .map_err(|e| format!("Failed to send the Dockerfile: {e}"))?;
+    }
+    let output = child
+        .wait_with_output()
+        .await
+        .map_err(|e| format!("docker build failed: {e}"))?;
+    if output.status.success() {
+        return Ok(());
+    }
+    Err(format!(
+        "{}{}",
+        String::from_utf8_lossy(&output.stdout),
+        String::from_utf8_lossy(&output.stderr)
+    ))
+}
+
+fn tail(text: &str, max_bytes: usize) -> String {
+    let mut start = text.len().saturating_sub(max_bytes);
+    while !text.is_char_boundary(start) {
+        start += 1;
+    }
+    text[start..].to_string()
+}
+
+// Builds that were running when the server stopped never finish, so they are
+// marked as failed
+fn load_presets(dir: &Path) -> HashMap<String, ManagedPreset> {
+    let Ok(entries) = fs::read_dir(dir) else {
+        return HashMap::new();
+    };
+    entries
+        .flatten()
+        .filter(|entry| entry.path().extension().is_some_and(|ext| ext == "json"))
+        .filter_map(|entry| {
+            let data = fs::read(entry.path()).ok()?;
+            match serde_json::from_slice::<ManagedPreset>(&data) {
+                Ok(mut preset) => {
+                    if preset.build.state == BuildState::Building {
+                        preset.build.state = BuildState::Failed;
+                        preset.build.log = Some("Interrupted by a server restart".to_string());
+                    }
+                    Some((preset.name.clone(), preset))
+                }
+                Err(e) => {
+                    log::warn!("Ignoring preset {}: {e}", entry.path().display());
+                    None
+                }
+            }
+        })
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use uuid::Uuid;
+
+    fn registry() -> PresetRegistry {
+        let configured = HashMap::from([(
+            "python-datasci".to_string(),
+            PresetConfig {
+                language: "python".to_string(),
+                image: "isobox/python-datasci:1".to_string(),
+                packages: vec!["numpy".to_string()],
+                env: HashMap::new(),
+                limits: None,
+            },
+        )]);
+        let dir = std::env::temp_dir().join(format!("isobox-preset-test-{}", Uuid::new_v4()));
+        PresetRegistry::new(dir, configured)
+    }
+
+    fn spec(language: &str, packages: &[&str]) -> PresetSpec {
+        PresetSpec {
+            language: language.to_string(),
+            packages: packages.iter().map(|p| p.to_string()).collect(),
+            env: HashMap::new(),
+            limits: None,
+        }
+    }
+
+    #[test]
+    fn test_put_and_reload() {
+        let registry = registry();
+        let (preset, revision) = registry
+            .put("node-web", spec("node", &["express"]), "admin")
+            .unwrap();
+        assert_eq!(revision, 1);
+        assert_eq!(preset.build.unwrap().state, BuildState::Building);
+        assert!(registry
+            .resolve("node-web")
+            .unwrap_err()
+            .contains("still building"));
+        assert_eq!(
+            registry.resolve("python-datasci").unwrap().image,
+            "isobox/python-datasci:1"
+        );
+
+        // The build never finished, so after a restart it has failed
+        let reloaded = PresetRegistry::new(registry.dir.clone(), HashMap::new());
+        let build = reloaded.get("node-web").unwrap().build.unwrap();
+        assert_eq!(build.state, BuildState::Failed);
+
+        reloaded.remove("node-web").unwrap();
+        assert!(reloaded.get("node-web").is_none());
+        fs::remove_dir_all(&registry.dir).ok();
+    }
+
+    #[test]
+    fn test_put_rejects_invalid_presets() {
+        let registry = registry();
+        assert!(matches!(
+            registry.put("python-datasci", spec("python", &[]), "admin"),
+            Err(PresetError::Configured(_))
+        ));
+        for (name, spec) in [
+            ("Node-Web", spec("node", &[])),
+            ("node-web", spec("rust", &["serde"])),
+            ("node-web", spec("node", &["--registry=https://evil"])),
+            ("node-web", spec("node", &["express lodash"])),
+        ] {
+            assert!(matches!(
+                registry.put(name, spec, "admin"),
+                Err(PresetError::Invalid(_))
+            ));
+        }
+    }
+
+    #[test]
+    fn test_dockerfile() {
+        assert_eq!(
+            dockerfile("python:3.11", "python", &["numpy".to_string()]),
+            "FROM python:3.11\nRUN [\"pip\",\"install\",\"--no-cache-dir\",\"numpy\"]\n"
+        );
+        assert_eq!(
+            dockerfile("node:20", "node", &[]),
+            "FROM node:20\nENV NODE_PATH=/usr/local/lib/node_modules\n"
+        );
+    }
+
+    #[test]
+    fn test_tail_keeps_the_end() {
+        assert_eq!(
+            tail("step 1\nerror: no such package", 24),
+            "error: no such package"
+        );
+        assert_eq!(tail("short", 24), "short");
+    }
+}
@@ -0,0 +1,120 @@
+use serde::{Deserialize, Serialize};
+
+/// How an execution competes for CPU and disk time with others on the same worker
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Hash, Deserialize, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum Priority {
+    /// Someone is waiting for the result, e.g. in an editor
+    #[default]
+    Interactive,
+    /// Bulk work such as regrading, which yields to interactive runs
+    Batch,
+}
+
+impl Priority {
+    pub fn as_str(self) -> &'static str {
+        match self {
+            Priority::Interactive => "interactive",
+            Priority::Batch => "batch",
+        }
+    }
+}
+
+/// Scheduling weights of batch executions. Interactive ones keep the runtime's
+/// defaults of 1024 CPU shares, a block I/O weight of 500 and nice 0, so a batch
+/// run only loses out while the two compete.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct Scheduling {
+    pub cpu_shares: u32,
+    pub blkio_weight: u16,
+    /// Niceness of embedded runtimes, which have no cgroup of their own
+    pub nice: i32,
+}
+
+impl Default for Scheduling {
+    fn default() -> Self {
+        Self {
+            cpu_shares: 256,
+            blkio_weight: 100,
+            nice: 10,
+        }
+    }
+}
+
+impl Scheduling {
+    /// Reads `BATCH_CPU_SHARES`, `BATCH_BLKIO_WEIGHT` and `BATCH_NICE`, clamped to
+    /// the ranges Docker and the kernel accept
+    pub fn from_env() -> Self {
+        let defaults = Self::default();
+        Self {
+            cpu_shares: env_or("BATCH_CPU_SHARES", defaults.cpu_shares).clamp(2, 262_144),
+            blkio_weight: env_or("BATCH_BLKIO_WEIGHT", defaults.blkio_weight).clamp(10, 1000),
+            nice: env_or("BATCH_NICE", defaults.nice).clamp(0, 19),
+        }
+    }
+
+    /// `docker run` options that give the container these weights
+    pub fn docker_args(&self) -> Vec<String> {
+        vec![
+            "--cpu-shares".to_string(),
+            self.cpu_shares.to_string(),
+            "--blkio-weight".to_string(),
+            self.blkio_weight.to_string(),
+        ]
+    }
+
+    /// Lowers the calling process's CPU priority, and on Linux its I/O priority to
+    /// the lowest best-effort level. Only makes syscalls, so it can run between
+    /// fork and exec.
+    pub fn lower_current_process(&self) -> std::io::Result<()> {
+        // SAFETY: setpriority has no memory safety preconditions
+        if unsafe { libc::setpriority(libc::PRIO_PROCESS, 0, self.nice) } < 0 {
+            return Err(std::io::Error::last_os_error());
+        }
+        #[cfg(target_os = "linux")]
+        {
+            const IOPRIO_WHO_PROCESS: libc::c_int = 1;
+            const IOPRIO_CLASS_BE: libc::c_int = 2;
+            const IOPRIO_CLASS_SHIFT: libc::c_int = 13;
+            // Only a hint for the I/O scheduler, so kernels that ignore it are fine
+            // SAFETY: ioprio_set takes plain integers
+            let _ = unsafe {
+                libc::syscall(
+                    libc::SYS_ioprio_set,
+                    IOPRIO_WHO_PROCESS,
+                    0,
+                    (IOPRIO_CLASS_BE << IOPRIO_CLASS_SHIFT) | 7,
+                )
+            };
+        }
+        Ok(())
+    }
+}
+
+fn env_or<T: std::str::FromStr>(name: &str, default: T) -> T {
+    std::env::var(name)
+        .ok()
+        .and_then(|s| s.parse().ok())
+        .unwrap_or(default)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_priority_serde() {
+        let priority: Priority = serde_json::from_str(r#""batch""#).unwrap();
+        assert_eq!(priority, Priority::Batch);
+        assert_eq!(Priority::default(), Priority::Interactive);
+        assert!(serde_json::from_str::<Priority>(r#""low""#).is_err());
+    }
+
+    #[test]
+    fn test_docker_args() {
+        assert_eq!(
+            Scheduling::default().docker_args(),
+            ["--cpu-shares", "256", "--blkio-weight", "100"]
+        );
+    }
+}
@@ -0,0 +1,869 @@
+use crate::deadline;
+use crate::events::ExecutionEvent;
+use crate::executor::{CodeExecutor, ExecuteRequest, ExecuteResponse, ExecutionError};
+use crate::fairshare::{FairQueue, FairScheduler};
+use crate::store::unix_timestamp;
+use serde::{Deserialize, Serialize};
+use std::collections::{HashMap, VecDeque};
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::Arc;
+use std::time::{Duration, Instant, SystemTime};
+use tokio::sync::{Notify, RwLock};
+
+#[cfg(feature = "nats")]
+mod nats;
+
+#[derive(Debug, thiserror::Error)]
+pub enum QueueError {
+    #[error("Queue connection failed: {0}")]
+    Connection(String),
+    #[error("Failed to publish job: {0}")]
+    Publish(String),
+    #[error("Failed to receive job: {0}")]
+    Receive(String),
+    #[error("Failed to access job status: {0}")]
+    Status(String),
+    /// The queue is at `MAX_QUEUE_DEPTH`; the duration says when to try again
+    #[error("The job queue is full with {0} jobs waiting")]
+    Full(u64, Duration),
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum JobState {
+    Queued,
+    Running,
+    Completed,
+    Failed,
+}
+
+/// Status of an async job as returned by `GET /v1/jobs/{id}`
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct JobStatus {
+    pub id: String,
+    pub tenant: String,
+    pub state: JobState,
+    pub created_at: u64,
+    pub started_at: Option<u64>,
+    pub finished_at: Option<u64>,
+    pub result: Option<ExecuteResponse>,
+    pub error: Option<String>,
+    /// The job's number among its tenant's jobs, recorded when it is published
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub sequence: Option<u64>,
+    /// Jobs, of any tenant, that will start before this one; only while it is queued
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub position: Option<u64>,
+    /// Unix time the job is expected to start, from how fast the queue has been
+    /// moving; only while it is queued and the queue has moved recently
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub estimated_start_at: Option<u64>,
+    /// Times the job was stopped to make room for interactive requests and queued
+    /// again
+    #[serde(default)]
+    pub preemptions: u32,
+}
+
+/// A job as it travels through the queue
+#[derive(Debug, Serialize, Deserialize)]
+pub struct QueuedJob {
+    pub id: String,
+    // Kept next to the request because the request never serializes its tenant
+    // or deadline
+    pub tenant: String,
+    pub request: ExecuteRequest,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub deadline: Option<SystemTime>,
+}
+
+/// A received job that stays owned by this consumer until it is acknowledged
+#[async_trait::async_trait]
+pub trait Delivery: Send {
+    fn job(&self) -> &QueuedJob;
+    async fn ack(self: Box<Self>) -> Result<(), QueueError>;
+    /// Hands the job back, to be delivered again after `delay`
+    async fn nak(self: Box<Self>, delay: Duration) -> Result<(), QueueError>;
+    /// Gives up on the job, so it isn't delivered again
+    async fn terminate(self: Box<Self>) -> Result<(), QueueError>;
+}
+
+/// Job transport plus the status of every job, so any instance can answer for a
+/// job another instance ran. Tenants take turns with their jobs by queue weight
+/// (see `FairScheduler`); each tenant's own jobs start in the order they arrived.
+#[async_trait::async_trait]
+pub trait JobQueue: Send + Sync {
+    fn backend(&self) -> &'static str;
+    /// Publishes a job and records its sequence in the job's status
+    async fn publish(&self, job: &QueuedJob) -> Result<u64, QueueError>;
+    /// Waits for the next job
+    async fn receive(&self) -> Result<Box<dyn Delivery>, QueueError>;
+    async fn put_status(&self, status: &JobStatus) -> Result<(), QueueError>;
+    async fn get_status(&self, id: &str) -> Result<Option<JobStatus>, QueueError>;
+    /// Jobs waiting to be picked up by a consumer
+    async fn depth(&self) -> Result<u64, QueueError>;
+    /// Jobs handed to consumers so far
+    async fn delivered(&self) -> Result<u64, QueueError>;
+    /// Jobs that will start before a queued one if no more arrive; None once it has
+    /// been handed to a consumer
+    async fn position(&self, status: &JobStatus) -> Result<Option<u64>, QueueError>;
+    /// Deletes the statuses, including results, of a tenant's jobs and returns how many
+    async fn remove_statuses(&self, tenant: &str) -> Result<u64, QueueError>;
+}
+
+/// In-process queue. Jobs are lost when the server restarts.
+pub struct MemoryQueue {
+    pending: Arc<std::sync::Mutex<MemoryPending>>,
+    // Wakes a consumer for every published job
+    available: Arc<Notify>,
+    statuses: RwLock<HashMap<String, JobStatus>>,
+    delivered: AtomicU64,
+}
+
+struct MemoryPending {
+    jobs: FairQueue<QueuedJob>,
+    // Jobs published per tenant, for their sequences
+    published: HashMap<String, u64>,
+}
+
+impl MemoryQueue {
+    pub fn new() -> Self {
+        Self {
+            pending: Arc::new(std::sync::Mutex::new(MemoryPending {
+                jobs: FairQueue::new(FairScheduler::default()),
+                published: HashMap::new(),
+            })),
+            available: Arc::new(Notify::new()),
+            statuses: RwLock::new(HashMap::new()),
+            delivered: AtomicU64::new(0),
+        }
+    }
+
+    /// Gives tenants the queue weights from the config file
+    pub fn with_weights(self, weights: HashMap<String, u32>) -> Self {
+        self.pending.lock().unwrap().jobs = FairQueue::new(FairScheduler::new(weights));
+        self
+    }
+}
+
+impl Default for MemoryQueue {
+    fn default() -> Self {
+        Self::new()
+    }
+}
+
+struct MemoryDelivery {
+    job: QueuedJob,
+    // Where a nak puts the job back
+    pending: Arc<std::sync::Mutex<MemoryPending>>,
+    available: Arc<Notify>,
+}
+
+#[async_trait::async_trait]
+impl Delivery for MemoryDelivery {
+    fn job(&self) -> &QueuedJob {
+        &self.job
+    }
+
+    async fn ack(self: Box<Self>) -> Result<(), QueueError> {
+        Ok(())
+    }
+
+    async fn nak(self: Box<Self>, delay: Duration) -> Result<(), QueueError> {
+        let MemoryDelivery {
+            job,
+            pending,
+            available,
+        } = *self;
+        tokio::spawn(async move {
+            tokio::time::sleep(delay).await;
+            let tenant = job.tenant.clone();
+            pending.lock().unwrap().jobs.push(&tenant, job);
+            available.notify_one();
+        });
+        Ok(())
+    }
+
+    async fn terminate(self: Box<Self>) -> Result<(), QueueError> {
+        Ok(())
+    }
+}
+
+#[async_trait::async_trait]
+impl JobQueue for MemoryQueue {
+    fn backend(&self) -> &'static str {
+        "memory"
+    }
+
+    async fn publish(&self, job: &QueuedJob) -> Result<u64, QueueError> {
+        // Round-trip through JSON so the memory queue behaves like a real transport
+        let queued: QueuedJob = serde_json::to_string(job)
+            .and_then(|json| serde_json::from_str(&json))
+            .map_err(|e| QueueError::Publish(e.to_string()))?;
+        let sequence = {
+            let mut pending = self.pending.lock().unwrap();
+            pending.jobs.push(&job.tenant, queued);
+            let published = pending.published.entry(job.tenant.clone()).or_insert(0);
+            *published += 1;
+            *published
+        };
+        self.available.notify_one();
+        // Only the sequence is touched: a consumer may already have started the job
+        if let Some(status) = self.statuses.write().await.get_mut(&job.id) {
+            status.sequence = Some(sequence);
+        }
+        Ok(sequence)
+    }
+
+    async fn receive(&self) -> Result<Box<dyn Delivery>, QueueError> {
+        let job = loop {
+            let job = self.pending.lock().unwrap().jobs.pop();
+            if let Some(job) = job {
+                break job;
+            }
+            // A job published since the check leaves a permit, so none is missed
+            self.available.notified().await;
+        };
+        self.delivered.fetch_add(1, Ordering::SeqCst);
+        Ok(Box::new(MemoryDelivery {
+            job,
+            pending: self.pending.clone(),
+            available: self.available.clone(),
+        }))
+    }
+
+    async fn put_status(&self, status: &JobStatus) -> Result<(), QueueError> {
+        self.statuses
+            .write()
+            .await
+            .insert(status.id.clone(), status.clone());
+        Ok(())
+    }
+
+    async fn get_status(&self, id: &str) -> Result<Option<JobStatus>, QueueError> {
+        Ok(self.statuses.read().await.get(id).cloned())
+    }
+
+    async fn depth(&self) -> Result<u64, QueueError> {
+        let statuses = self.statuses.read().await;
+        Ok(statuses
+            .values()
+            .filter(|status| status.state == JobState::Queued)
+            .count() as u64)
+    }
+
+    async fn delivered(&self) -> Result<u64, QueueError> {
+        Ok(self.delivered.load(Ordering::SeqCst))
+    }
+
+    async fn position(&self, status: &JobStatus) -> Result<Option<u64>, QueueError> {
+        Ok(self
+            .pending
+            .lock()
+            .unwrap()
+            .jobs
+            .position(&status.tenant, |job| job.id == status.id))
+    }
+
+    async fn remove_statuses(&self, tenant: &str) -> Result<u64, QueueError> {
+        let mut statuses = self.statuses.write().await;
+        let before = statuses.len();
+        statuses.retain(|_, status| status.tenant != tenant);
+        Ok((before - statuses.len()) as u64)
+    }
+}
+
+/// How far back `QueueProgress` looks when estimating start times
+pub const PROGRESS_WINDOW: Duration = Duration::from_secs(300);
+
+/// Watches how fast jobs leave the queue, across every instance, to estimate when
+/// queued jobs will start and to turn jobs away when the queue is full
+pub struct QueueProgress {
+    max_depth: Option<u64>,
+    // Delivered sequence seen at each sample, oldest first
+    samples: std::sync::Mutex<VecDeque<(Instant, u64)>>,
+}
+
+impl QueueProgress {
+    pub fn new(max_depth: Option<u64>) -> Self {
+        Self {
+            max_depth,
+            samples: std::sync::Mutex::new(VecDeque::new()),
+        }
+    }
+
+    /// Reads `MAX_QUEUE_DEPTH`; unset or 0 means the queue is unbounded
+    pub fn from_env() -> Self {
+        Self::new(
+            std::env::var("MAX_QUEUE_DEPTH")
+                .ok()
+                .and_then(|s| s.parse::<u64>().ok())
+                .filter(|&max| max > 0),
+        )
+    }
+
+    pub fn max_depth(&self) -> Option<u64> {
+        self.max_depth
+    }
+
+    /// Records the queue's delivered sequence
+    pub fn record(&self, delivered: u64) {
+        self.record_at(Instant::now(), delivered);
+    }
+
+    fn record_at(&self, now: Instant, delivered: u64) {
+        let mut samples = self.samples.lock().unwrap();
+        // A lower sequence means the queue was recreated, so older samples say nothing
+        if samples.back().is_some_and(|&(_, last)| delivered < last) {
+            samples.clear();
+        }
+        samples.push_back((now, delivered));
+        while samples
+            .front()
+            .is_some_and(|(at, _)| now.duration_since(*at) > PROGRESS_WINDOW)
+        {
+            samples.pop_front();
+        }
+    }
+
+    /// Average time between job starts over `PROGRESS_WINDOW`; None when no job
+    /// started in that time, since a stalled queue gives no honest estimate
+    pub fn start_interval(&self) -> Option<Duration> {
+        let samples = self.samples.lock().unwrap();
+        let (&(first_at, first), &(last_at, last)) = (samples.front()?, samples.back()?);
+        let elapsed = last_at.duration_since(first_at);
+        (last > first && elapsed >= Duration::from_secs(1))
+            .then(|| elapsed.div_f64((last - first) as f64))
+    }
+
+    // Fills in a queued job's position and expected start time
+    fn estimate(&self, status: &mut JobStatus, position: Option<u64>) {
+        let Some(position) = position.filter(|_| status.state == JobState::Queued) else {
+            return;
+        };
+        status.position = Some(position);
+        // Every consumer is busy while jobs wait, so even the next job waits one start
+        status.estimated_start_at = self.start_interval().map(|interval| {
+            unix_timestamp() + interval.mul_f64((position + 1) as f64).as_secs_f64().ceil() as u64
+        });
+    }
+
+    /// When a job turned away from a full queue should be resubmitted: once enough
+    /// jobs have started to make room, or `fallback` when the queue hasn't moved
+    fn retry_after(&self, depth: u64, max_depth: u64, fallback: Duration) -> Duration {
+        self.start_interval()
+            .map_or(fallback, |interval| {
+                interval.mul_f64((depth + 1 - max_depth) as f64)
+            })
+            .max(Duration::from_secs(1))
+    }
+}
+
+/// Builds the queue selected by `QUEUE_BACKEND` ("memory" or "nats"), sharing
+/// consumers between tenants by their queue weights
+pub async fn queue_from_env(
+    weights: HashMap<String, u32>,
+) -> Result<Arc<dyn JobQueue>, QueueError> {
+    let backend = std::env::var("QUEUE_BACKEND").unwrap_or_else(|_| "memory".to_string());
+    match backend.as_str() {
+        "memory" => Ok(Arc::new(MemoryQueue::new().with_weights(weights))),
+        #[cfg(feature = "nats")]
+        "nats" => {
+            let url =
+                std::env::var("NATS_URL").unwrap_or_else(|_| "nats://localhost:4222".to_string());
+            Ok(Arc::new(nats::NatsQueue::connect(&url, weights).await?))
+        }
+        #[cfg(not(feature = "nats"))]
+        "nats" => Err(QueueError::Connection(
+            "this build does not include the nats feature".to_string(),
+        )),
+        other => Err(QueueError::Connection(format!(
+            "unknown queue backend '{other}'"
+        ))),
+    }
+}
+
+/// Fills in a queued job's position and expected start, which are worked out on
+/// each request rather than stored
+pub async fn estimate_start(
+    queue: &dyn JobQueue,
+    progress: &QueueProgress,
+    status: &mut JobStatus,
+) -> Result<(), QueueError> {
+    if status.state != JobState::Queued {
+        return Ok(());
+    }
+    progress.record(queue.delivered().await?);
+    let position = queue.position(status).await?;
+    progress.estimate(status, position);
+    Ok(())
+}
+
+/// Records a new job as queued and publishes it. The returned status includes the
+/// job's position and, when known, its expected start.
+pub async fn submit(
+    queue: &dyn JobQueue,
+    progress: &QueueProgress,
+    executor: &CodeExecutor,
+    tenant: &str,
+    request: ExecuteRequest,
+) -> Result<JobStatus, QueueError> {
+    if let Some(max_depth) = progress.max_depth() {
+        let depth = queue.depth().await?;
+        if depth >= max_depth {
+            progress.record(queue.delivered().await?);
+            let retry_after =
+                progress.retry_after(depth, max_depth, executor.latency().retry_after());
+            return Err(QueueError::Full(depth, retry_after));
+        }
+    }
+
+    let mut status = JobStatus {
+        id: uuid::Uuid::new_v4().to_string(),
+        tenant: tenant.to_string(),
+        state: JobState::Queued,
+        created_at: unix_timestamp(),
+        started_at: None,
+        finished_at: None,
+        result: None,
+        error: None,
+        sequence: None,
+        position: None,
+        estimated_start_at: None,
+        preemptions: 0,
+    };
+    queue.put_status(&status).await?;
+    let language = request.language.clone();
+    let sequence = queue
+        .publish(&QueuedJob {
+            id: status.id.clone(),
+            tenant: tenant.to_string(),
+            deadline: request.deadline,
+            request,
+        })
+        .await?;
+    executor
+        .events()
+        .publish(&ExecutionEvent::queued(&status.id, tenant, &language));
+
+    status.sequence = Some(sequence);
+    // The job is queued either way; failing here would only invite a duplicate
+    if let Err(e) = estimate_start(queue, progress, &mut status).await {
+        log::warn!("Failed to estimate the start of job {}: {e}", status.id);
+    }
+    Ok(status)
+}
+
+/// Runs queued jobs one at a time until the queue closes. Jobs are acknowledged only
+/// after their final status is stored, so a consumer that dies mid-job leaves the
+/// job to be redelivered by backends with at-least-once delivery.
+pub async fn run_consumer(queue: Arc<dyn JobQueue>, executor: Arc<CodeExecutor>) {
+    loop {
+        let delivery = match queue.receive().await {
+            Ok(delivery) => delivery,
+            Err(e) => {
+                log::error!("Job consumer stopped: {e}");
+                return;
+            }
+        };
+        handle(queue.as_ref(), &executor, delivery).await;
+    }
+}
+
+// How long a job whose failure couldn't be recorded waits before it's delivered again
+const FAILED_JOB_RETRY: Duration = Duration::from_secs(30);
+
+// Processes a delivery and settles it. A job that can't be processed is marked
+// failed and terminated, rather than left to time out and fail the same way on
+// each redelivery; if not even its status can be stored, it's tried again later.
+async fn handle(queue: &dyn JobQueue, executor: &CodeExecutor, delivery: Box<dyn Delivery>) {
+    let id = delivery.job().id.clone();
+    let settled = match process(queue, executor, delivery.job()).await {
+        Ok(()) => delivery.ack().await,
+        Err(e) => {
+            log::error!("Failed to process job {id}: {e}");
+            match fail(queue, delivery.job(), &e).await {
+                Ok(()) => delivery.terminate().await,
+                Err(e) => {
+                    log::error!("Failed to mark job {id} failed: {e}");
+                    delivery.nak(FAILED_JOB_RETRY).await
+                }
+            }
+        }
+    };
+    if let Err(e) = settled {
+        log::warn!("Failed to settle job {id}: {e}");
+    }
+}
+
+// Records a job that couldn't be processed as failed. A job without a status,
+// e.g. because its tenant's statuses were deleted, gets none.
+async fn fail(queue: &dyn JobQueue, job: &QueuedJob, error: &QueueError) -> Result<(), QueueError> {
+    let Some(mut status) = queue.get_status(&job.id).await? else {
+        return Ok(());
+    };
+    status.state = JobState::Failed;
+    status.error = Some(error.to_string());
+    status.finished_at = Some(unix_timestamp());
+    queue.put_status(&status).await
+}
+
+async fn process(
+    queue: &dyn JobQueue,
+    executor: &CodeExecutor,
+    job: &QueuedJob,
+) -> Result<(), QueueError> {
+    let mut status = match queue.get_status(&job.id).await? {
+        // A redelivered job that already finished is only acknowledged again
+        Some(status) if matches!(status.state, JobState::Completed | JobState::Failed) => {
+            return Ok(())
+        }
+        Some(status) => status,
+        None => return Err(QueueError::Status(format!("no status for job {}", job.id))),
+    };
+    // The caller gave up while the job was queued, so it isn't started
+    if job
+        .deadline
+        .is_some_and(|deadline| deadline::remaining(deadline).is_none())
+    {
+        status.state = JobState::Failed;
+        status.error = Some(ExecutionError::DeadlineExceeded.to_string());
+        status.finished_at = Some(unix_timestamp());
+        return queue.put_status(&status).await;
+    }
+
+    let started_at = unix_timestamp();
+    status.state = JobState::Running;
+    status.started_at = Some(started_at);
+    queue.put_status(&status).await?;
+
+    let mut request = job.request.clone();
+    request.tenant = Some(job.tenant.clone());
+    request.execution_id = Some(job.id.clone());
+    request.deadline = job.deadline;
+    let queue_wait = Duration::from_secs(started_at.saturating_sub(status.created_at));
+    request.queue_wait = Some(queue_wait);
+    executor.latency().record_queue_wait(queue_wait);
+
+    match executor.execute(request).await {
+        Ok(response) => {
+            status.state = JobState::Completed;
+            status.result = Some(response);
+        }
+        // The job didn't get to run, so it waits its turn again rather than failing
+        Err(ExecutionError::Busy(_, retry_after)) => {
+            return requeue(queue, job, status, retry_after).await;
+        }
+        Err(ExecutionError::Preempted(retry_after)) => {
+            status.preemptions += 1;
+            return requeue(queue, job, status, retry_after).await;
+        }
+        Err(e) => {
+            status.state = JobState::Failed;
+            status.error = Some(e.to_string());
+        }
+    }
+    status.finished_at = Some(unix_timestamp());
+    queue.put_status(&status).await
+}
+
+// Publishes a job again once a retry is likely to find a free worker. The caller
+// acknowledges the old delivery.
+async fn requeue(
+    queue: &dyn JobQueue,
+    job: &QueuedJob,
+    mut status: JobStatus,
+    retry_after: Duration,
+) -> Result<(), QueueError> {
+    log::info!(
+        "Job {} queued again, retrying in {:.1}s",
+        job.id,
+        retry_after.as_secs_f64()
+    );
+    status.state = JobState::Queued;
+    status.started_at = None;
+    status.sequence = None;
+    queue.put_status(&status).await?;
+    tokio::time::sleep(retry_after).await;
+    queue.publish(job).await?;
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[tokio::test]
+    async fn test_memory_queue_round_trip() {
+        let queue = MemoryQueue::new();
+        let request = ExecuteRequest {
+            language: "python".to_string(),
+            code: "print('hi')".to_string(),
+            tenant: Some("ignored".to_string()),
+            ..Default::default()
+        };
+
+        let executor = CodeExecutor::new();
+        let progress = QueueProgress::new(None);
+        let status = submit(&queue, &progress, &executor, "cs101", request)
+            .await
+            .unwrap();
+        assert_eq!(status.state, JobState::Queued);
+        assert_eq!((status.sequence, status.position), (Some(1), Some(0)));
+        let stored = queue.get_status(&status.id).await.unwrap().unwrap();
+        assert_eq!(stored.tenant, "cs101");
+        assert_eq!(queue.depth().await.unwrap(), 1);
+
+        let delivery = queue.receive().await.unwrap();
+        assert_eq!(delivery.job().id, status.id);
+        assert_eq!(delivery.job().tenant, "cs101");
+        assert_eq!(delivery.job().request.code, "print('hi')");
+        assert!(delivery.job().request.tenant.is_none());
+        delivery.ack().await.unwrap();
+
+        assert!(queue.get_status("missing").await.unwrap().is_none());
+
+        assert_eq!(queue.remove_statuses("other").await.unwrap(), 0);
+        assert_eq!(queue.remove_statuses("cs101").await.unwrap(), 1);
+        assert!(queue.get_status(&status.id).await.unwrap().is_none());
+    }
+
+    fn job(language: &str) -> ExecuteRequest {
+        ExecuteRequest {
+            language: language.to_string(),
+            code: "1".to_string(),
+            ..Default::default()
+        }
+    }
+
+    #[tokio::test]
+    async fn test_queue_position_and_backpressure() {
+        let queue = MemoryQueue::new();
+        let executor = CodeExecutor::new();
+        let progress = QueueProgress::new(Some(2));
+
+        let first = submit(&queue, &progress, &executor, "cs101", job("python"))
+            .await
+            .unwrap();
+        let second = submit(&queue, &progress, &executor, "cs101", job("node"))
+            .await
+            .unwrap();
+        assert_eq!(second.position, Some(1));
+        // The queue hasn't moved yet, so there is no start time to promise
+        assert!(second.estimated_start_at.is_none());
+        assert_eq!(
+            queue
+                .get_status(&second.id)
+                .await
+                .unwrap()
+                .unwrap()
+                .sequence,
+            Some(2)
+        );
+
+        match submit(&queue, &progress, &executor, "cs101", job("ruby")).await {
+            Err(QueueError::Full(depth, retry_after)) => {
+                assert_eq!(depth, 2);
+                assert_eq!(retry_after, executor.latency().retry_after());
+            }
+            other => panic!("expected a full queue, got {other:?}"),
+        }
+
+        // Taking the first job moves the second to the front
+        let delivery = queue.receive().await.unwrap();
+        assert_eq!(delivery.job().id, first.id);
+        let mut status = queue.get_status(&second.id).await.unwrap().unwrap();
+        estimate_start(&queue, &progress, &mut status)
+            .await
+            .unwrap();
+        assert_eq!(status.position, Some(0));
+
+        let mut running = status.clone();
+        running.state = JobState::Running;
+        running.position = None;
+        estimate_start(&queue, &progress, &mut running)
+            .await
+            .unwrap();
+        assert!(running.position.is_none());
+    }
+
+    #[tokio::test]
+    async fn test_tenants_take_turns() {
+        let weights = HashMap::from([("staff".to_string(), 2)]);
+        let queue = MemoryQueue::new().with_weights(weights);
+        let executor = CodeExecutor::new();
+        let progress = QueueProgress::new(None);
+
+        for _ in 0..50 {
+            submit(&queue, &progress, &executor, "bulk", job("python"))
+                .await
+                .unwrap();
+        }
+        let student = submit(&queue, &progress, &executor, "cs101", job("python"))
+            .await
+            .unwrap();
+        let staff = submit(&queue, &progress, &executor, "staff", job("python"))
+            .await
+            .unwrap();
+        assert_eq!((student.sequence, student.position), (Some(1), Some(1)));
+        assert_eq!((staff.sequence, staff.position), (Some(1), Some(0)));
+
+        let mut started = Vec::new();
+        for _ in 0..3 {
+            let delivery = queue.receive().await.unwrap();
+            started.push(delivery.job().tenant.clone());
+        }
+        assert_eq!(started, ["staff", "bulk", "cs101"]);
+        assert_eq!(queue.delivered().await.unwrap(), 3);
+    }
+
+    #[test]
+    fn test_start_estimates_follow_queue_progress() {
+        let progress = QueueProgress::new(None);
+        assert!(progress.start_interval().is_none());
+
+        let now = Instant::now();
+        let at = |seconds: u64| now.checked_sub(Duration::from_secs(seconds)).unwrap();
+        // Outside the window, so ignored
+        progress.record_at(at(PROGRESS_WINDOW.as_secs() + 100), 0);
+        progress.record_at(at(40), 10);
+        assert!(progress.start_interval().is_none());
+        progress.record_at(at(20), 12);
+        progress.record_at(now, 14);
+        assert_eq!(progress.start_interval(), Some(Duration::from_secs(10)));
+        assert_eq!(
+            progress.retry_after(5, 2, Duration::from_secs(3)),
+            Duration::from_secs(40)
+        );
+
+        let mut status = JobStatus {
+            id: "job-1".to_string(),
+            tenant: "cs101".to_string(),
+            state: JobState::Queued,
+            created_at: 0,
+            started_at: None,
+            finished_at: None,
+            result: None,
+            error: None,
+            sequence: Some(3),
+            position: None,
+            estimated_start_at: None,
+            preemptions: 0,
+        };
+        let before = unix_timestamp();
+        progress.estimate(&mut status, Some(2));
+        assert_eq!(status.position, Some(2));
+        let eta = status.estimated_start_at.unwrap() - before;
+        assert!((30..=31).contains(&eta), "{eta}");
+
+        status.state = JobState::Running;
+        status.position = None;
+        progress.estimate(&mut status, Some(1));
+        assert!(status.position.is_none());
+
+        // A recreated queue starts counting again
+        progress.record(3);
+        assert!(progress.start_interval().is_none());
+    }
+
+    #[tokio::test]
+    async fn test_requeued_job_waits_its_turn_again() {
+        let queue = MemoryQueue::new();
+        let executor = CodeExecutor::new();
+        let progress = QueueProgress::new(None);
+        let request = ExecuteRequest {
+            language: "python".to_string(),
+            code: "print('hi')".to_string(),
+            ..Default::default()
+        };
+        let status = submit(&queue, &progress, &executor, "cs101", request)
+            .await
+            .unwrap();
+
+        let delivery = queue.receive().await.unwrap();
+        let mut running = queue.get_status(&status.id).await.unwrap().unwrap();
+        running.state = JobState::Running;
+        running.started_at = Some(unix_timestamp());
+        running.preemptions = 1;
+        requeue(&queue, delivery.job(), running, Duration::ZERO)
+            .await
+            .unwrap();
+        delivery.ack().await.unwrap();
+
+        let stored = queue.get_status(&status.id).await.unwrap().unwrap();
+        assert_eq!(stored.state, JobState::Queued);
+        assert!(stored.started_at.is_none());
+        assert_eq!((stored.sequence, stored.preemptions), (Some(2), 1));
+        assert_eq!(queue.depth().await.unwrap(), 1);
+        assert_eq!(queue.receive().await.unwrap().job().id, status.id);
+    }
+
+    #[tokio::test]
+    async fn test_unprocessable_job_is_failed_and_not_redelivered() {
+        let queue = MemoryQueue::new();
+        let executor = CodeExecutor::new();
+        let progress = QueueProgress::new(None);
+        let first = submit(&queue, &progress, &executor, "cs101", job("python"))
+            .await
+            .unwrap();
+
+        // A nak hands the job back to be delivered again
+        let delivery = queue.receive().await.unwrap();
+        delivery.nak(Duration::ZERO).await.unwrap();
+        let delivery = queue.receive().await.unwrap();
+        assert_eq!(delivery.job().id, first.id);
+
+        // A job that failed to process, e.g. while the status store was down, is
+        // recorded as failed
+        let mut status = queue.get_status(&first.id).await.unwrap().unwrap();
+        status.state = JobState::Running;
+        queue.put_status(&status).await.unwrap();
+        let error = QueueError::Status("unreachable".to_string());
+        fail(&queue, delivery.job(), &error).await.unwrap();
+        delivery.terminate().await.unwrap();
+        let stored = queue.get_status(&first.id).await.unwrap().unwrap();
+        assert_eq!(stored.state, JobState::Failed);
+        assert_eq!(
+            stored.error.as_deref(),
+            Some("Failed to access job status: unreachable")
+        );
+        assert!(stored.finished_at.is_some());
+
+        // A job whose status is gone fails to process and is dropped
+        let second = submit(&queue, &progress, &executor, "cs102", job("python"))
+            .await
+            .unwrap();
+        queue.remove_statuses("cs102").await.unwrap();
+        let delivery = queue.receive().await.unwrap();
+        handle(&queue, &executor, delivery).await;
+        assert!(queue.get_status(&second.id).await.unwrap().is_none());
+        assert!(queue.pending.lock().unwrap().jobs.pop().is_none());
+    }
+
+    #[tokio::test]
+    async fn test_job_past_its_deadline_is_not_started() {
+        let queue = MemoryQueue::new();
+        let executor = CodeExecutor::new();
+        let progress = QueueProgress::new(None);
+        let deadline = SystemTime::now() - Duration::from_secs(1);
+        let request = ExecuteRequest {
+            language: "python".to_string(),
+            code: "print('hi')".to_string(),
+            deadline: Some(deadline),
+            ..Default::default()
+        };
+        let status = submit(&queue, &progress, &executor, "cs101", request)
+            .await
+            .unwrap();
+
+        let delivery = queue.receive().await.unwrap();
+        assert_eq!(delivery.job().deadline, Some(deadline));
+        process(&queue, &executor, delivery.job()).await.unwrap();
+        let stored = queue.get_status(&status.id).await.unwrap().unwrap();
+        assert_eq!(stored.state, JobState::Failed);
+        assert!(stored.started_at.is_none());
+        assert_eq!(
+            stored.error.as_deref(),
+            Some("The caller's deadline passed before the execution started")
+        );
+    }
+}
@@ -0,0 +1,358 @@
+use super::{Delivery, JobQueue, JobState, JobStatus, QueueError, QueuedJob};
+use crate::fairshare::FairScheduler;
+use async_nats::jetstream::{self, consumer, kv, stream};
+use futures::StreamExt;
+use std::collections::{BTreeMap, HashMap};
+use std::time::Duration;
+use tokio::sync::Mutex;
+
+const STREAM_NAME: &str = "ISOBOX_TENANT_JOBS";
+// Each tenant's jobs go to `isobox.jobs.<hex tenant>`, so tenants can be pulled from
+// separately. Hex keeps any tenant name a valid subject token and consumer name.
+const SUBJECT_PREFIX: &str = "isobox.jobs.";
+const SUBJECTS: &str = "isobox.jobs.*";
+// Every instance binds to the same durable consumer per tenant, so each job goes to
+// one of them
+const CONSUMER_PREFIX: &str = "isobox-workers-";
+const STATUS_BUCKET: &str = "isobox-job-status";
+// How long an idle consumer waits for a publish notification before looking again
+const IDLE_POLL: Duration = Duration::from_secs(5);
+
+/// NATS JetStream queue: a work-queue stream delivers each job to one consumer and
+/// redelivers it if it isn't acknowledged within the ack wait. Each instance picks
+/// the tenant to pull from next with its own `FairScheduler`. Job statuses live in
+/// a key-value bucket shared by all instances.
+pub struct NatsQueue {
+    context: jetstream::Context,
+    stream: stream::Stream,
+    ack_wait: Duration,
+    consumers: Mutex<HashMap<String, consumer::PullConsumer>>,
+    scheduler: std::sync::Mutex<FairScheduler>,
+    // Every published job, so idle consumers wake up without polling JetStream
+    published: Mutex<async_nats::Subscriber>,
+    statuses: kv::Store,
+}
+
+impl NatsQueue {
+    pub async fn connect(url: &str, weights: HashMap<String, u32>) -> Result<Self, QueueError> {
+        let client = async_nats::connect(url).await.map_err(connection_error)?;
+        let published = client
+            .subscribe(SUBJECTS.to_string())
+            .await
+            .map_err(connection_error)?;
+        let context = jetstream::new(client);
+
+        let stream = context
+            .get_or_create_stream(stream::Config {
+                name: STREAM_NAME.to_string(),
+                subjects: vec![SUBJECTS.to_string()],
+                retention: stream::RetentionPolicy::WorkQueue,
+                ..Default::default()
+            })
+            .await
+            .map_err(connection_error)?;
+
+        // Must exceed the longest job, otherwise running jobs are redelivered
+        let ack_wait = std::env::var("NATS_ACK_WAIT_SECONDS")
+            .ok()
+            .and_then(|s| s.parse::<u64>().ok())
+            .unwrap_or(300);
+
+        let statuses = match context.get_key_value(STATUS_BUCKET).await {
+            Ok(statuses) => statuses,
+            Err(_) => context
+                .create_key_value(kv::Config {
+                    bucket: STATUS_BUCKET.to_string(),
+                    history: 1,
+                    max_age: Duration::from_secs(7 * 24 * 60 * 60),
+                    ..Default::default()
+                })
+                .await
+                .map_err(connection_error)?,
+        };
+
+        log::info!("Connected to NATS JetStream at {url}");
+        Ok(Self {
+            context,
+            stream,
+            ack_wait: Duration::from_secs(ack_wait),
+            consumers: Mutex::new(HashMap::new()),
+            scheduler: std::sync::Mutex::new(FairScheduler::new(weights)),
+            published: Mutex::new(published),
+            statuses,
+        })
+    }
+
+    // The tenant's durable consumer, created on first use by any instance
+    async fn consumer(&self, tenant: &str) -> Result<consumer::PullConsumer, QueueError> {
+        let mut consumers = self.consumers.lock().await;
+        if let Some(consumer) = consumers.get(tenant) {
+            return Ok(consumer.clone());
+        }
+        let name = format!("{CONSUMER_PREFIX}{}", hex::encode(tenant));
+        let consumer = self
+            .stream
+            .get_or_create_consumer(
+                &name,
+                consumer::pull::Config {
+                    durable_name: Some(name.clone()),
+                    filter_subject: subject(tenant),
+                    ack_policy: consumer::AckPolicy::Explicit,
+                    ack_wait: self.ack_wait,
+                    ..Default::default()
+                },
+            )
+            .await
+            .map_err(|e| QueueError::Connection(e.to_string()))?;
+        consumers.insert(tenant.to_string(), consumer.clone());
+        Ok(consumer)
+    }
+
+    // Jobs not yet delivered to any instance, per tenant with at least one
+    async fn waiting(&self) -> Result<BTreeMap<String, u64>, QueueError> {
+        let mut infos = self.stream.consumers();
+        let mut waiting = BTreeMap::new();
+        while let Some(info) = infos.next().await {
+            let info = info.map_err(|e| QueueError::Status(e.to_string()))?;
+            let tenant = info
+                .name
+                .strip_prefix(CONSUMER_PREFIX)
+                .and_then(|token| hex::decode(token).ok())
+                .and_then(|bytes| String::from_utf8(bytes).ok());
+            if let (Some(tenant), true) = (tenant, info.num_pending > 0) {
+                waiting.insert(tenant, info.num_pending);
+            }
+        }
+        Ok(waiting)
+    }
+
+    // Stores a published job's sequence in its status. The update is conditional on
+    // the revision read, so a consumer that already started the job doesn't have its
+    // status overwritten; the sequence only matters while queued.
+    async fn record_sequence(&self, id: &str, sequence: u64) -> Result<(), QueueError> {
+        for _ in 0..3 {
+            let Some(entry) = self
+                .statuses
+                .entry(id)
+                .await
+                .map_err(|e| QueueError::Status(e.to_string()))?
+            else {
+                return Ok(());
+            };
+            let mut status: JobStatus = serde_json::from_slice(&entry.value)
+                .map_err(|e| QueueError::Status(e.to_string()))?;
+            if status.state != JobState::Queued {
+                return Ok(());
+            }
+            status.sequence = Some(sequence);
+            let value =
+                serde_json::to_vec(&status).map_err(|e| QueueError::Status(e.to_string()))?;
+            if self
+                .statuses
+                .update(id, value.into(), entry.revision)
+                .await
+                .is_ok()
+            {
+                return Ok(());
+            }
+        }
+        log::warn!("Could not record the queue position of job {id}");
+        Ok(())
+    }
+}
+
+fn subject(tenant: &str) -> String {
+    format!("{SUBJECT_PREFIX}{}", hex::encode(tenant))
+}
+
+fn connection_error(e: impl std::fmt::Display) -> QueueError {
+    QueueError::Connection(e.to_string())
+}
+
+struct NatsDelivery {
+    job: QueuedJob,
+    message: jetstream::Message,
+}
+
+#[async_trait::async_trait]
+impl Delivery for NatsDelivery {
+    fn job(&self) -> &QueuedJob {
+        &self.job
+    }
+
+    async fn ack(self: Box<Self>) -> Result<(), QueueError> {
+        self.message
+            .ack()
+            .await
+            .map_err(|e| QueueError::Receive(e.to_string()))
+    }
+
+    async fn nak(self: Box<Self>, delay: Duration) -> Result<(), QueueError> {
+        self.message
+            .ack_with(jetstream::AckKind::Nak(Some(delay)))
+            .await
+            .map_err(|e| QueueError::Receive(e.to_string()))
+    }
+
+    async fn terminate(self: Box<Self>) -> Result<(), QueueError> {
+        self.message
+            .ack_with(jetstream::AckKind::Term)
+            .await
+            .map_err(|e| QueueError::Receive(e.to_string()))
+    }
+}
+
+#[async_trait::async_trait]
+impl JobQueue for NatsQueue {
+    fn backend(&self) -> &'static str {
+        "nats"
+    }
+
+    async fn publish(&self, job: &QueuedJob) -> Result<u64, QueueError> {
+        // Created before publishing so the job counts towards the tenant's pending jobs
+        let consumer = self.consumer(&job.tenant).await?;
+        let payload = serde_json::to_vec(job).map_err(|e| QueueError::Publish(e.to_string()))?;
+        // The second await waits for JetStream to confirm the job is stored
+        self.context
+            .publish(subject(&job.tenant), payload.into())
+            .await
+            .map_err(|e| QueueError::Publish(e.to_string()))?
+            .await
+            .map_err(|e| QueueError::Publish(e.to_string()))?;
+
+        // Deliveries so far plus jobs waiting, this one included, numbers the job among
+        // its tenant's. Jobs the tenant publishes at the same moment may be counted too.
+        let info = consumer
+            .get_info()
+            .await
+            .map_err(|e| QueueError::Status(e.to_string()))?;
+        let sequence = info.delivered.consumer_sequence + info.num_pending;
+        self.record_sequence(&job.id, sequence).await?;
+        Ok(sequence)
+    }
+
+    async fn receive(&self) -> Result<Box<dyn Delivery>, QueueError> {
+        loop {
+            let waiting = self.waiting().await?;
+            let tenant = self
+                .scheduler
+                .lock()
+                .unwrap()
+                .next(waiting.keys().map(String::as_str))
+                .map(str::to_string);
+            let Some(tenant) = tenant else {
+                let mut published = self.published.lock().await;
+                let _ = tokio::time::timeout(IDLE_POLL, published.next()).await;
+                continue;
+            };
+
+            let mut batch = self
+                .consumer(&tenant)
+                .await?
+                .fetch()
+                .max_messages(1)
+                .messages()
+                .await
+                .map_err(|e| QueueError::Receive(e.to_string()))?;
+            // None when another instance took the job first
+            let Some(message) = batch.next().await else {
+                continue;
+            };
+            let message = message.map_err(|e| QueueError::Receive(e.to_string()))?;
+            match serde_json::from_slice::<QueuedJob>(&message.payload) {
+                Ok(job) => return Ok(Box::new(NatsDelivery { job, message })),
+                Err(e) => {
+                    // Acknowledge malformed jobs so they aren't redelivered forever
+                    log::warn!("Dropping malformed job: {e}");
+                    let _ = message.ack().await;
+                }
+            }
+        }
+    }
+
+    async fn put_status(&self, status: &JobStatus) -> Result<(), QueueError> {
+        let value = serde_json::to_vec(status).map_err(|e| QueueError::Status(e.to_string()))?;
+        self.statuses
+            .put(&status.id, value.into())
+            .await
+            .map_err(|e| QueueError::Status(e.to_string()))?;
+        Ok(())
+    }
+
+    async fn get_status(&self, id: &str) -> Result<Option<JobStatus>, QueueError> {
+        let Some(value) = self
+            .statuses
+            .get(id)
+            .await
+            .map_err(|e| QueueError::Status(e.to_string()))?
+        else {
+            return Ok(None);
+        };
+        serde_json::from_slice(&value)
+            .map(Some)
+            .map_err(|e| QueueError::Status(e.to_string()))
+    }
+
+    async fn depth(&self) -> Result<u64, QueueError> {
+        // Counts jobs not yet delivered to any instance
+        Ok(self.waiting().await?.values().sum())
+    }
+
+    async fn delivered(&self) -> Result<u64, QueueError> {
+        // Looking the stream up fetches its current state
+        let stream = self
+            .context
+            .get_stream(STREAM_NAME)
+            .await
+            .map_err(|e| QueueError::Status(e.to_string()))?;
+        let published = stream.cached_info().state.last_sequence;
+        Ok(published.saturating_sub(self.depth().await?))
+    }
+
+    async fn position(&self, status: &JobStatus) -> Result<Option<u64>, QueueError> {
+        let Some(sequence) = status.sequence else {
+            return Ok(None);
+        };
+        let info = self
+            .consumer(&status.tenant)
+            .await?
+            .get_info()
+            .await
+            .map_err(|e| QueueError::Status(e.to_string()))?;
+        let delivered = info.delivered.consumer_sequence;
+        if sequence <= delivered {
+            return Ok(None);
+        }
+        let waiting = self.waiting().await?;
+        Ok(Some(self.scheduler.lock().unwrap().jobs_ahead(
+            &waiting,
+            &status.tenant,
+            sequence - delivered - 1,
+        )))
+    }
+
+    async fn remove_statuses(&self, tenant: &str) -> Result<u64, QueueError> {
+        let mut keys = self
+            .statuses
+            .keys()
+            .await
+            .map_err(|e| QueueError::Status(e.to_string()))?;
+        let mut removed = 0;
+        while let Some(key) = keys.next().await {
+            let key = key.map_err(|e| QueueError::Status(e.to_string()))?;
+            if self
+                .get_status(&key)
+                .await?
+                .is_some_and(|status| status.tenant == tenant)
+            {
+                // Purge rather than delete so no earlier revision is kept
+                self.statuses
+                    .purge(&key)
+                    .await
+                    .map_err(|e| QueueError::Status(e.to_string()))?;
+                removed += 1;
+            }
+        }
+        Ok(removed)
+    }
+}
@@ -0,0 +1,329 @@
+use crate::config::{ClientLimitConfig, RateLimit};
+use std::collections::HashMap;
+use std::net::IpAddr;
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, Instant};
+
+// Buckets are pruned once there are this many, so per-IP keys can't grow without bound
+const PRUNE_THRESHOLD: usize = 10_000;
+
+struct Bucket {
+    tokens: f64,
+    updated: Instant,
+    // When the bucket will be full again; it can be dropped after that
+    full_at: Instant,
+}
+
+/// A caller's bucket as reported in the `X-RateLimit-*` response headers
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct RateLimitStatus {
+    /// Requests a full bucket holds
+    pub limit: u32,
+    /// Requests that can be made right now
+    pub remaining: u32,
+    /// Until the bucket is full again
+    pub reset: Duration,
+}
+
+/// Token buckets keyed by caller and scope. A bucket starts full, so a caller can
+/// make `burst` requests at once and then `rate` requests per second after that.
+#[derive(Default)]
+pub struct RateLimiter {
+    buckets: Mutex<HashMap<String, Bucket>>,
+}
+
+impl RateLimiter {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Takes a token from the bucket, or returns how long until one is available
+    pub fn check(&self, key: &str, limit: RateLimit) -> Result<(), Duration> {
+        self.check_at(key, limit, Instant::now())
+    }
+
+    fn check_at(&self, key: &str, limit: RateLimit, now: Instant) -> Result<(), Duration> {
+        let burst = f64::from(limit.burst);
+        let mut buckets = self.buckets.lock().unwrap();
+        if buckets.len() >= PRUNE_THRESHOLD {
+            buckets.retain(|_, bucket| bucket.full_at > now);
+        }
+        let bucket = buckets.entry(key.to_string()).or_insert(Bucket {
+            tokens: burst,
+            updated: now,
+            full_at: now,
+        });
+
+        let elapsed = now.saturating_duration_since(bucket.updated).as_secs_f64();
+        bucket.tokens = (bucket.tokens + elapsed * limit.rate).min(burst);
+        bucket.updated = now;
+        if bucket.tokens < 1.0 {
+            return Err(Duration::from_secs_f64((1.0 - bucket.tokens) / limit.rate));
+        }
+        bucket.tokens -= 1.0;
+        bucket.full_at = now + Duration::from_secs_f64((burst - bucket.tokens) / limit.rate);
+        Ok(())
+    }
+
+    /// The bucket's state, without taking a token
+    pub fn status(&self, key: &str, limit: RateLimit) -> RateLimitStatus {
+        self.status_at(key, limit, Instant::now())
+    }
+
+    fn status_at(&self, key: &str, limit: RateLimit, now: Instant) -> RateLimitStatus {
+        let burst = f64::from(limit.burst);
+        let tokens = self
+            .buckets
+            .lock()
+            .unwrap()
+            .get(key)
+            .map_or(burst, |bucket| {
+                let elapsed = now.saturating_duration_since(bucket.updated).as_secs_f64();
+                (bucket.tokens + elapsed * limit.rate).min(burst)
+            });
+        RateLimitStatus {
+            limit: limit.burst,
+            remaining: tokens.floor() as u32,
+            reset: Duration::from_secs_f64((burst - tokens) / limit.rate),
+        }
+    }
+}
+
+/// An IP address or CIDR range, e.g. `10.0.0.0/8`
+#[derive(Debug, Clone, Copy)]
+pub struct IpRange {
+    network: IpAddr,
+    prefix: u8,
+}
+
+impl IpRange {
+    pub fn parse(range: &str) -> Result<Self, String> {
+        let invalid = || format!("Invalid IP address or CIDR range '{range}'");
+        let (address, prefix) = match range.split_once('/') {
+            Some((address, prefix)) => (address, Some(prefix)),
+            None => (range, None),
+        };
+        let network: IpAddr = address.trim().parse().map_err(|_| invalid())?;
+        let max_prefix = if network.is_ipv4() { 32 } else { 128 };
+        let prefix = match prefix {
+            Some(prefix) => prefix.trim().parse::<u8>().map_err(|_| invalid())?,
+            None => max_prefix,
+        };
+        if prefix > max_prefix {
+            return Err(invalid());
+        }
+        Ok(Self { network, prefix })
+    }
+
+    pub fn contains(&self, ip: IpAddr) -> bool {
+        let (network, ip, bits) = match (self.network, ip.to_canonical()) {
+            (IpAddr::V4(network), IpAddr::V4(ip)) => {
+                (u32::from(network) as u128, u32::from(ip) as u128, 32)
+            }
+            (IpAddr::V6(network), IpAddr::V6(ip)) => (u128::from(network), u128::from(ip), 128),
+            _ => return false,
+        };
+        let host_bits = bits - u32::from(self.prefix);
+        host_bits == bits || network >> host_bits == ip >> host_bits
+    }
+}
+
+#[derive(Debug)]
+pub enum ClientRejection {
+    RateLimited(Duration),
+    TooManyConcurrent(usize),
+}
+
+/// Rate and concurrency limits per client IP address
+pub struct ClientLimiter {
+    rate: Option<RateLimit>,
+    max_concurrent: Option<usize>,
+    trusted_proxies: Vec<IpRange>,
+    buckets: RateLimiter,
+    in_flight: Arc<Mutex<HashMap<IpAddr, usize>>>,
+}
+
+impl ClientLimiter {
+    pub fn new(config: &ClientLimitConfig) -> Self {
+        Self {
+            rate: config.rate,
+            max_concurrent: config.max_concurrent,
+            // Ranges are checked when the configuration is loaded
+            trusted_proxies: config
+                .trusted_proxies
+                .iter()
+                .filter_map(|proxy| IpRange::parse(proxy).ok())
+                .collect(),
+            buckets: RateLimiter::new(),
+            in_flight: Arc::new(Mutex::new(HashMap::new())),
+        }
+    }
+
+    pub fn is_enabled(&self) -> bool {
+        self.rate.is_some() || self.max_concurrent.is_some()
+    }
+
+    /// The address of the client behind any trusted proxies. `X-Forwarded-For` is
+    /// read from the right, skipping hops added by trusted proxies, so a client
+    /// can't pick its own address by sending the header itself.
+    pub fn client_ip(&self, peer: IpAddr, forwarded_for: Option<&str>) -> IpAddr {
+        let mut client = peer;
+        for hop in forwarded_for
+            .into_iter()
+            .flat_map(|header| header.rsplit(','))
+        {
+            if !self.is_trusted(client) {
+                break;
+            }
+            match hop.trim().parse() {
+                Ok(ip) => client = ip,
+                Err(_) => break,
+            }
+        }
+        client
+    }
+
+    fn is_trusted(&self, ip: IpAddr) -> bool {
+        self.trusted_proxies.iter().any(|range| range.contains(ip))
+    }
+
+    /// Admits a request from `ip`. It counts towards the client's concurrency limit
+    /// until the returned permit is dropped.
+    pub fn admit(&self, ip: IpAddr) -> Result<ClientPermit, ClientRejection> {
+        let mut in_flight = self.in_flight.lock().unwrap();
+        let running = in_flight.get(&ip).copied().unwrap_or(0);
+        if let Some(max) = self.max_concurrent.filter(|max| running >= *max) {
+            return Err(ClientRejection::TooManyConcurrent(max));
+        }
+        if let Some(rate) = self.rate {
+            self.buckets
+                .check(&ip.to_string(), rate)
+                .map_err(ClientRejection::RateLimited)?;
+        }
+        *in_flight.entry(ip).or_insert(0) += 1;
+        Ok(ClientPermit {
+            ip,
+            in_flight: self.in_flight.clone(),
+        })
+    }
+}
+
+pub struct ClientPermit {
+    ip: IpAddr,
+    in_flight: Arc<Mutex<HashMap<IpAddr, usize>>>,
+}
+
+impl Drop for ClientPermit {
+    fn drop(&mut self) {
+        let mut in_flight = self.in_flight.lock().unwrap();
+        if let Some(running) = in_flight.get_mut(&self.ip) {
+            *running -= 1;
+            if *running == 0 {
+                in_flight.remove(&self.ip);
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_burst_then_refill() {
+        let limiter = RateLimiter::new();
+        let limit = RateLimit {
+            rate: 2.0,
+            burst: 3,
+        };
+        let start = Instant::now();
+
+        for _ in 0..3 {
+            assert!(limiter.check_at("cs101|*", limit, start).is_ok());
+        }
+        let wait = limiter.check_at("cs101|*", limit, start).unwrap_err();
+        assert_eq!(wait, Duration::from_millis(500));
+        // Other callers have their own bucket
+        assert!(limiter.check_at("cs102|*", limit, start).is_ok());
+
+        let later = start + Duration::from_millis(500);
+        assert!(limiter.check_at("cs101|*", limit, later).is_ok());
+        assert!(limiter.check_at("cs101|*", limit, later).is_err());
+
+        assert_eq!(
+            limiter.status_at("cs101|*", limit, later),
+            RateLimitStatus {
+                limit: 3,
+                remaining: 0,
+                reset: Duration::from_millis(1500),
+            }
+        );
+        assert_eq!(limiter.status_at("cs103|*", limit, later).remaining, 3);
+
+        // Refilling never exceeds the burst
+        let much_later = start + Duration::from_secs(60);
+        for _ in 0..3 {
+            assert!(limiter.check_at("cs101|*", limit, much_later).is_ok());
+        }
+        assert!(limiter.check_at("cs101|*", limit, much_later).is_err());
+    }
+
+    #[test]
+    fn test_ip_ranges() {
+        let range = IpRange::parse("10.0.0.0/8").unwrap();
+        assert!(range.contains("10.1.2.3".parse().unwrap()));
+        assert!(range.contains("::ffff:10.1.2.3".parse().unwrap()));
+        assert!(!range.contains("11.0.0.1".parse().unwrap()));
+        assert!(!range.contains("::1".parse().unwrap()));
+
+        assert!(IpRange::parse("0.0.0.0/0")
+            .unwrap()
+            .contains("8.8.8.8".parse().unwrap()));
+        assert!(IpRange::parse("::1")
+            .unwrap()
+            .contains("::1".parse().unwrap()));
+        assert!(IpRange::parse("10.0.0.0/33").is_err());
+        assert!(IpRange::parse("example.com").is_err());
+    }
+
+    #[test]
+    fn test_client_ip_only_trusts_configured_proxies() {
+        let limiter = ClientLimiter::new(&ClientLimitConfig {
+            trusted_proxies: vec!["10.0.0.0/8".to_string()],
+            ..Default::default()
+        });
+        let proxy: IpAddr = "10.0.0.5".parse().unwrap();
+        let client: IpAddr = "203.0.113.7".parse().unwrap();
+
+        assert_eq!(limiter.client_ip(client, None), client);
+        assert_eq!(limiter.client_ip(proxy, Some("203.0.113.7")), client);
+        // Spoofed entries left of the real client are ignored
+        assert_eq!(
+            limiter.client_ip(proxy, Some("1.2.3.4, 203.0.113.7, 10.0.0.9")),
+            client
+        );
+        // Clients connecting directly can't choose their address
+        assert_eq!(limiter.client_ip(client, Some("1.2.3.4")), client);
+        assert_eq!(limiter.client_ip(proxy, Some("garbage")), proxy);
+    }
+
+    #[test]
+    fn test_client_concurrency_is_released_with_permit() {
+        let limiter = ClientLimiter::new(&ClientLimitConfig {
+            max_concurrent: Some(2),
+            ..Default::default()
+        });
+        let ip: IpAddr = "203.0.113.7".parse().unwrap();
+
+        let first = limiter.admit(ip).unwrap();
+        let _second = limiter.admit(ip).unwrap();
+        assert!(matches!(
+            limiter.admit(ip),
+            Err(ClientRejection::TooManyConcurrent(2))
+        ));
+        assert!(limiter.admit("203.0.113.8".parse().unwrap()).is_ok());
+
+        drop(first);
+        assert!(limiter.admit(ip).is_ok());
+    }
+}
@@ -0,0 +1,243 @@
+use crate::executor::{ExecuteRequest, ExecuteResponse};
+use serde::Serialize;
+use sha2::{Digest, Sha256};
+use std::collections::HashMap;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::Mutex;
+use std::time::{Duration, Instant};
+
+struct CachedResult {
+    response: ExecuteResponse,
+    stored_at: Instant,
+}
+
+/// Hit and miss counts of the result cache since the server started
+#[derive(Debug, Serialize)]
+pub struct ResultCacheStats {
+    pub dedup_enabled: bool,
+    pub ttl_seconds: u64,
+    pub entries: usize,
+    pub hits: u64,
+    pub misses: u64,
+}
+
+/// Results of earlier executions, returned for byte-identical requests of the same
+/// tenant within the TTL instead of running them again. Judges run the same
+/// reference solutions over and over; their output doesn't change between runs.
+pub struct ResultCache {
+    // Whether requests that don't say otherwise are cached
+    default_enabled: bool,
+    ttl: Duration,
+    max_entries: usize,
+    entries: Mutex<HashMap<String, CachedResult>>,
+    hits: AtomicU64,
+    misses: AtomicU64,
+}
+
+impl ResultCache {
+    pub fn new(default_enabled: bool, ttl: Duration, max_entries: usize) -> Self {
+        Self {
+            default_enabled,
+            ttl,
+            max_entries,
+            entries: Mutex::new(HashMap::new()),
+            hits: AtomicU64::new(0),
+            misses: AtomicU64::new(0),
+        }
+    }
+
+    pub fn from_env() -> Self {
+        let default_enabled = std::env::var("DEDUP_ENABLED")
+            .unwrap_or_else(|_| "false".to_string())
+            .parse::<bool>()
+            .unwrap_or(false);
+        let ttl = std::env::var("DEDUP_CACHE_TTL")
+            .ok()
+            .and_then(|value| value.parse().ok())
+            .unwrap_or(3600);
+        let max_entries = std::env::var("DEDUP_CACHE_MAX_ENTRIES")
+            .ok()
+            .and_then(|value| value.parse().ok())
+            .unwrap_or(10_000);
+        if std::env::var("DEDUP_CACHE_TYPE").is_ok_and(|kind| kind != "memory") {
+            log::warn!("Only the memory result cache is supported; ignoring DEDUP_CACHE_TYPE");
+        }
+        Self::new(default_enabled, Duration::from_secs(ttl), max_entries)
+    }
+
+    /// The key a request's result is cached under, or None if it can't be cached.
+    /// Requests reading data that can change without the request changing, such as
+    /// datasets and uploaded inputs, aren't cached. `context` holds what else the
+    /// result depends on, such as the version of a mounted bundle.
+    pub fn key(
+        &self,
+        tenant: &str,
+        request: &ExecuteRequest,
+        context: &[String],
+    ) -> Option<String> {
+        if !request.cache.unwrap_or(self.default_enabled) || self.ttl.is_zero() {
+            return None;
+        }
+        if request.datasets.as_ref().is_some_and(|d| !d.is_empty())
+            || !request.uploaded_inputs.is_empty()
+        {
+            return None;
+        }
+        // serde_json's maps are sorted, so equal requests serialize the same way
+        let mut fields = serde_json::to_value(request).ok()?;
+        if let Some(fields) = fields.as_object_mut() {
+            // Labels only tag the stored execution, and the trace context is
+            // different for every call
+            fields.remove("labels");
+            fields.remove("cache");
+            fields.remove("trace_context");
+        }
+
+        let mut hasher = Sha256::new();
+        for part in [
+            tenant,
+            fields.to_string().as_str(),
+            context.join("\0").as_str(),
+        ] {
+            hasher.update(part.len().to_le_bytes());
+            hasher.update(part.as_bytes());
+        }
+        Some(hex::encode(hasher.finalize()))
+    }
+
+    /// The stored result of `key`, marked as cached, if it hasn't expired
+    pub fn get(&self, key: &str) -> Option<ExecuteResponse> {
+        let mut entries = self.entries.lock().unwrap();
+        let response = match entries.get(key) {
+            Some(cached) if cached.stored_at.elapsed() < self.ttl => Some(ExecuteResponse {
+                cached: Some(true),
+                ..cached.response.clone()
+            }),
+            Some(_) => {
+                entries.remove(key);
+                None
+            }
+            None => None,
+        };
+        let counter = match response {
+            Some(_) => &self.hits,
+            None => &self.misses,
+        };
+        counter.fetch_add(1, Ordering::Relaxed);
+        response
+    }
+
+    /// Stores a result, making room by dropping expired and then the oldest ones
+    pub fn insert(&self, key: String, response: &ExecuteResponse) {
+        if self.max_entries == 0 {
+            return;
+        }
+        let mut entries = self.entries.lock().unwrap();
+        if entries.len() >= self.max_entries {
+            entries.retain(|_, cached| cached.stored_at.elapsed() < self.ttl);
+        }
+        while entries.len() >= self.max_entries {
+            let Some(oldest) = entries
+                .iter()
+                .min_by_key(|(_, cached)| cached.stored_at)
+                .map(|(key, _)| key.clone())
+            else {
+                break;
+            };
+            entries.remove(&oldest);
+        }
+        entries.insert(
+            key,
+            CachedResult {
+                response: response.clone(),
+                stored_at: Instant::now(),
+            },
+        );
+    }
+
+    pub fn stats(&self) -> ResultCacheStats {
+        ResultCacheStats {
+            dedup_enabled: self.default_enabled,
+            ttl_seconds: self.ttl.as_secs(),
+            entries: self.entries.lock().unwrap().len(),
+            hits: self.hits.load(Ordering::Relaxed),
+            misses: self.misses.load(Ordering::Relaxed),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::trace_context::TraceContext;
+
+    fn request(code: &str) -> ExecuteRequest {
+        ExecuteRequest {
+            language: "python".to_string(),
+            code: code.to_string(),
+            cache: Some(true),
+            ..Default::default()
+        }
+    }
+
+    #[test]
+    fn test_identical_requests_share_a_key() {
+        let cache = ResultCache::new(false, Duration::from_secs(60), 10);
+        let key = cache.key("cs101", &request("print(1)"), &[]).unwrap();
+        let labeled = ExecuteRequest {
+            labels: Some(vec!["week-3".to_string()]),
+            ..request("print(1)")
+        };
+        assert_eq!(cache.key("cs101", &labeled, &[]).unwrap(), key);
+        let traced = ExecuteRequest {
+            trace_context: TraceContext::parse(
+                "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+                None,
+            ),
+            ..request("print(1)")
+        };
+        assert!(traced.trace_context.is_some());
+        assert_eq!(cache.key("cs101", &traced, &[]).unwrap(), key);
+
+        assert_ne!(cache.key("cs102", &request("print(1)"), &[]).unwrap(), key);
+        assert_ne!(cache.key("cs101", &request("print(2)"), &[]).unwrap(), key);
+        let bundle = ["bundle-2".to_string()];
+        assert_ne!(
+            cache.key("cs101", &request("print(1)"), &bundle).unwrap(),
+            key
+        );
+
+        // Requests opt in unless the server caches them by default
+        let default = ExecuteRequest {
+            cache: None,
+            ..request("print(1)")
+        };
+        assert!(cache.key("cs101", &default, &[]).is_none());
+        let datasets = ExecuteRequest {
+            datasets: Some(vec!["mnist".to_string()]),
+            ..request("print(1)")
+        };
+        assert!(cache.key("cs101", &datasets, &[]).is_none());
+    }
+
+    #[test]
+    fn test_results_expire_and_are_bounded() {
+        let cache = ResultCache::new(true, Duration::from_millis(50), 2);
+        let response = ExecuteResponse {
+            stdout: "1\n".to_string(),
+            ..Default::default()
+        };
+        cache.insert("a".to_string(), &response);
+        let hit = cache.get("a").unwrap();
+        assert_eq!((hit.stdout.as_str(), hit.cached), ("1\n", Some(true)));
+
+        cache.insert("b".to_string(), &response);
+        cache.insert("c".to_string(), &response);
+        assert!(cache.get("a").is_none());
+        std::thread::sleep(Duration::from_millis(60));
+        assert!(cache.get("c").is_none());
+
+        let stats = cache.stats();
+        assert_eq!((stats.hits, stats.misses, stats.entries), (1, 2, 1));
+    }
+}
@@ -0,0 +1,164 @@
+use crate::config::ReplicaConfig;
+use actix_web::http::header::{HeaderMap, HeaderValue};
+use actix_web::http::{Method, StatusCode};
+use actix_web::web::Bytes;
+use actix_web::HttpResponse;
+use std::collections::HashMap;
+use std::net::IpAddr;
+use std::time::Duration;
+
+/// Header carrying the routing token of the replica that holds a session or
+/// function deployment
+pub const ROUTE_HEADER: &str = "x-isobox-route";
+/// Set on requests a replica forwards to a peer, which never forwards them again
+pub const FORWARDED_HEADER: &str = "x-isobox-forwarded-by";
+
+const CONNECT_TIMEOUT: Duration = Duration::from_secs(5);
+
+// Headers about a single connection, which aren't passed on
+const HOP_BY_HOP: &[&str] = &[
+    "connection",
+    "content-length",
+    "host",
+    "keep-alive",
+    "proxy-authenticate",
+    "proxy-authorization",
+    "te",
+    "trailer",
+    "transfer-encoding",
+    "upgrade",
+];
+
+/// Where a request carrying a routing token is handled
+#[derive(Debug, Clone, PartialEq)]
+pub enum Route<'a> {
+    Local,
+    /// The base URL of the peer holding the state
+    Peer(&'a str),
+}
+
+/// This replica's routing token and the peers it can forward to, for deployments
+/// with several API replicas. Sessions and function deployments live on the
+/// replica that created them, so calls about them have to reach that replica again.
+pub struct ReplicaRouter {
+    token: Option<String>,
+    peers: HashMap<String, String>,
+    client: reqwest::Client,
+}
+
+impl ReplicaRouter {
+    pub fn new(config: &ReplicaConfig) -> Self {
+        let client = reqwest::Client::builder()
+            .connect_timeout(CONNECT_TIMEOUT)
+            .build()
+            .unwrap_or_default();
+        Self {
+            token: config.id.clone(),
+            peers: config.peers.clone(),
+            client,
+        }
+    }
+
+    /// The token responses about this replica's state carry
+    pub fn token(&self) -> Option<&str> {
+        self.token.as_deref()
+    }
+
+    /// Tokens of other replicas are sent to them; this replica's own, and those
+    /// of replicas it doesn't know, are handled here
+    pub fn route(&self, token: &str) -> Route<'_> {
+        if self.token.as_deref() == Some(token) {
+            return Route::Local;
+        }
+        match self.peers.get(token) {
+            Some(url) => Route::Peer(url),
+            None => Route::Local,
+        }
+    }
+
+    /// Sends a request to a peer and returns its response, with the body read in
+    /// full. The client's address is appended to `X-Forwarded-For`, so the peer
+    /// can tell clients apart if it trusts this replica as a proxy.
+    pub async fn forward(
+        &self,
+        peer: &str,
+        method: &Method,
+        path_and_query: &str,
+        headers: &HeaderMap,
+        client: Option<IpAddr>,
+        body: Bytes,
+    ) -> Result<HttpResponse, String> {
+        let url = format!("{}{path_and_query}", peer.trim_end_matches('/'));
+        let method = reqwest::Method::from_bytes(method.as_str().as_bytes())
+            .map_err(|e| format!("{url}: {e}"))?;
+        let mut builder = self.client.request(method, &url);
+        for (name, value) in headers {
+            if !HOP_BY_HOP.contains(&name.as_str()) && name.as_str() != "x-forwarded-for" {
+                builder = builder.header(name.as_str(), value.as_bytes());
+            }
+        }
+        let forwarded_for = headers
+            .get("x-forwarded-for")
+            .and_then(|value| value.to_str().ok());
+        let forwarded_for = match (forwarded_for, client) {
+            (Some(hops), Some(client)) => Some(format!("{hops}, {client}")),
+            (None, Some(client)) => Some(client.to_string()),
+            (hops, None) => hops.map(str::to_string),
+        };
+        if let Some(forwarded_for) = forwarded_for {
+            builder = builder.header("x-forwarded-for", forwarded_for);
+        }
+        if let Some(token) = &self.token {
+            builder = builder.header(FORWARDED_HEADER, token.as_str());
+        }
+        let upstream = builder
+            .body(body.to_vec())
+            .send()
+            .await
+            .map_err(|e| format!("{url}: {e}"))?;
+
+        let status =
+            StatusCode::from_u16(upstream.status().as_u16()).unwrap_or(StatusCode::BAD_GATEWAY);
+        let mut response = HttpResponse::build(status);
+        for (name, value) in upstream.headers() {
+            if HOP_BY_HOP.contains(&name.as_str()) {
+                continue;
+            }
+            if let Ok(value) = HeaderValue::from_bytes(value.as_bytes()) {
+                response.append_header((name.as_str(), value));
+            }
+        }
+        let body = upstream.bytes().await.map_err(|e| format!("{url}: {e}"))?;
+        Ok(response.body(body.to_vec()))
+    }
+}
+
+/// Whether the path is about a session or function deployment, whose state lives
+/// on one replica
+pub fn holds_state(path: &str) -> bool {
+    path.split('/')
+        .any(|segment| segment == "sessions" || segment == "functions")
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::config::IsoboxConfig;
+
+    #[test]
+    fn test_route() {
+        let config = IsoboxConfig::from_json(
+            r#"{"replicas": {"id": "api-0", "peers": {"api-0": "http://api-0:8000", "api-1": "http://api-1:8000/"}}}"#,
+        )
+        .unwrap();
+        let router = ReplicaRouter::new(&config.replicas);
+
+        assert_eq!(router.route("api-0"), Route::Local);
+        assert_eq!(router.route("api-1"), Route::Peer("http://api-1:8000/"));
+        assert_eq!(router.route("api-7"), Route::Local);
+
+        assert!(holds_state("/v1/sessions/abc/execute"));
+        assert!(holds_state("/api/v1/functions/add/invoke"));
+        assert!(!holds_state("/v1/execute"));
+    }
+}
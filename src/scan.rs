@@ -0,0 +1,577 @@
+use crate::config::ImageScanConfig;
+use crate::store::unix_timestamp;
+use serde::{Deserialize, Serialize};
+use std::collections::{BTreeMap, HashMap};
+use std::process::Command;
+use std::sync::RwLock;
+
+/// Vulnerability scanners isobox knows how to run and parse
+#[derive(Debug, Clone, Copy, PartialEq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum ScannerKind {
+    Trivy,
+    Grype,
+}
+
+impl ScannerKind {
+    fn command(self, image: &str) -> Vec<String> {
+        let args: &[&str] = match self {
+            ScannerKind::Trivy => &["trivy", "image", "--quiet", "--format", "json", image],
+            ScannerKind::Grype => &["grype", image, "--quiet", "--output", "json"],
+        };
+        args.iter().map(|arg| arg.to_string()).collect()
+    }
+
+    // Arguments and environment that keep the scanner from downloading its
+    // vulnerability database, for air-gapped mode. The database has to be
+    // provisioned some other way.
+    fn offline(self, args: &mut Vec<String>) -> &'static [(&'static str, &'static str)] {
+        match self {
+            ScannerKind::Trivy => {
+                let flags = [
+                    "--skip-db-update",
+                    "--skip-java-db-update",
+                    "--offline-scan",
+                ];
+                // Before the image, which comes last
+                let at = args.len() - 1;
+                args.splice(at..at, flags.iter().map(|flag| flag.to_string()));
+                &[]
+            }
+            ScannerKind::Grype => &[
+                ("GRYPE_DB_AUTO_UPDATE", "false"),
+                ("GRYPE_DB_VALIDATE_AGE", "false"),
+            ],
+        }
+    }
+
+    // Grype has no SBOM output of its own; Syft, its companion, generates them
+    fn sbom_command(self, image: &str) -> Vec<String> {
+        let args: &[&str] = match self {
+            ScannerKind::Trivy => &["trivy", "image", "--quiet", "--format", "cyclonedx", image],
+            ScannerKind::Grype => &["syft", image, "--quiet", "--output", "cyclonedx-json"],
+        };
+        args.iter().map(|arg| arg.to_string()).collect()
+    }
+
+    fn parse(self, output: &str) -> Result<Vec<Finding>, String> {
+        match self {
+            ScannerKind::Trivy => parse_trivy(output),
+            ScannerKind::Grype => parse_grype(output),
+        }
+    }
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord, Hash, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum Severity {
+    Unknown,
+    Negligible,
+    Low,
+    Medium,
+    High,
+    Critical,
+}
+
+impl Severity {
+    // Scanners spell severities differently, e.g. "CRITICAL" and "Critical"
+    fn parse(severity: &str) -> Self {
+        match severity.to_ascii_lowercase().as_str() {
+            "negligible" => Severity::Negligible,
+            "low" => Severity::Low,
+            "medium" => Severity::Medium,
+            "high" => Severity::High,
+            "critical" => Severity::Critical,
+            _ => Severity::Unknown,
+        }
+    }
+
+    pub fn as_str(self) -> &'static str {
+        match self {
+            Severity::Unknown => "unknown",
+            Severity::Negligible => "negligible",
+            Severity::Low => "low",
+            Severity::Medium => "medium",
+            Severity::High => "high",
+            Severity::Critical => "critical",
+        }
+    }
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct Finding {
+    /// CVE or advisory id, e.g. `CVE-2024-3094`
+    pub id: String,
+    pub package: String,
+    pub installed_version: String,
+    /// None when no fixed version has been released
+    pub fixed_version: Option<String>,
+    pub severity: Severity,
+}
+
+/// The latest scan of an image
+#[derive(Debug, Clone, Serialize)]
+pub struct ImageReport {
+    pub image: String,
+    pub scanner: ScannerKind,
+    pub scanned_at: u64,
+    /// Set when the scan failed; the report then has no findings
+    pub error: Option<String>,
+    /// Findings per severity
+    pub counts: BTreeMap<Severity, usize>,
+    pub findings: Vec<Finding>,
+}
+
+impl ImageReport {
+    fn new(image: &str, scanner: ScannerKind, result: Result<Vec<Finding>, String>) -> Self {
+        let (findings, error) = match result {
+            Ok(findings) => (findings, None),
+            Err(e) => (Vec::new(), Some(e)),
+        };
+        let mut counts = BTreeMap::new();
+        for finding in &findings {
+            *counts.entry(finding.severity).or_insert(0) += 1;
+        }
+        Self {
+            image: image.to_string(),
+            scanner,
+            scanned_at: unix_timestamp(),
+            error,
+            counts,
+            findings,
+        }
+    }
+
+    /// Findings at or above `severity`
+    pub fn count_at_least(&self, severity: Severity) -> usize {
+        self.counts.range(severity..).map(|(_, count)| count).sum()
+    }
+}
+
+/// Listing entry without the findings themselves
+#[derive(Debug, Clone, Serialize)]
+pub struct ImageReportSummary {
+    pub image: String,
+    pub scanner: ScannerKind,
+    pub scanned_at: u64,
+    pub error: Option<String>,
+    pub counts: BTreeMap<Severity, usize>,
+    /// Whether languages using the image are refused
+    pub blocked: bool,
+}
+
+/// A package installed in an image
+#[derive(Debug, Clone, Serialize)]
+pub struct Package {
+    pub name: String,
+    pub version: Option<String>,
+    /// CycloneDX component type, e.g. `library` or `operating-system`
+    #[serde(rename = "type")]
+    pub kind: String,
+    /// Package URL, e.g. `pkg:deb/debian/liblzma5@5.4.1-0.2?arch=amd64`
+    pub purl: Option<String>,
+}
+
+/// Package inventory of an image
+#[derive(Debug, Clone, Serialize)]
+pub struct Sbom {
+    pub image: String,
+    pub generator: ScannerKind,
+    pub generated_at: u64,
+    /// Sorted by name and version
+    pub packages: Vec<Package>,
+}
+
+/// Scans the language images with an external scanner and keeps the latest report
+/// of each. Without a configuration nothing is scanned or blocked.
+#[derive(Default)]
+pub struct ImageScanner {
+    config: Option<ImageScanConfig>,
+    reports: RwLock<HashMap<String, ImageReport>>,
+    sboms: RwLock<HashMap<String, Sbom>>,
+    // Whether scanners may update their databases
+    offline: bool,
+}
+
+impl ImageScanner {
+    pub fn new(config: Option<ImageScanConfig>) -> Self {
+        Self {
+            config,
+            reports: RwLock::new(HashMap::new()),
+            sboms: RwLock::new(HashMap::new()),
+            offline: false,
+        }
+    }
+
+    /// Runs the scanners without network access to their databases
+    pub fn offline(mut self, offline: bool) -> Self {
+        self.offline = offline;
+        self
+    }
+
+    /// The configured scanner. SBOMs are generated with Trivy when scanning is
+    /// disabled.
+    fn kind(&self) -> ScannerKind {
+        self.config
+            .as_ref()
+            .map_or(ScannerKind::Trivy, |config| config.scanner)
+    }
+
+    pub fn is_enabled(&self) -> bool {
+        self.config.is_some()
+    }
+
+    /// Seconds between rescans; None when images are only scanned at startup
+    pub fn rescan_seconds(&self) -> Option<u64> {
+        self.config
+            .as_ref()
+            .map(|config| config.rescan_seconds)
+            .filter(|seconds| *seconds > 0)
+    }
+
+    /// Scans an image, pulling it if needed, and keeps the report. Blocks until
+    /// the scanner exits.
+    pub fn scan(&self, image: &str) -> Option<ImageReport> {
+        let scanner = self.config.as_ref()?.scanner;
+        let result = self
+            .run(scanner, scanner.command(image))
+            .and_then(|output| scanner.parse(&output));
+        let report = ImageReport::new(image, scanner, result);
+        match &report.error {
+            Some(e) => log::warn!("Failed to scan image {image}: {e}"),
+            None => log::info!(
+                "Scanned image {image}: {} findings, {} critical",
+                report.findings.len(),
+                report.count_at_least(Severity::Critical)
+            ),
+        }
+        self.insert(report.clone());
+        // The tag may point at a new build, so its inventory is generated again
+        self.sboms.write().unwrap().remove(image);
+        Some(report)
+    }
+
+    /// Package inventory of an image, generated on first use and kept until the
+    /// image is scanned again. Blocks while the generator runs.
+    pub fn sbom(&self, image: &str) -> Result<Sbom, String> {
+        if let Some(sbom) = self.sboms.read().unwrap().get(image) {
+            return Ok(sbom.clone());
+        }
+        let generator = self.kind();
+        let output = self.run(generator, generator.sbom_command(image))?;
+        let sbom = Sbom {
+            image: image.to_string(),
+            generator,
+            generated_at: unix_timestamp(),
+            packages: parse_cyclonedx(&output)?,
+        };
+        self.sboms
+            .write()
+            .unwrap()
+            .insert(image.to_string(), sbom.clone());
+        Ok(sbom)
+    }
+
+    fn insert(&self, report: ImageReport) {
+        self.reports
+            .write()
+            .unwrap()
+            .insert(report.image.clone(), report);
+    }
+
+    pub fn report(&self, image: &str) -> Option<ImageReport> {
+        self.reports.read().unwrap().get(image).cloned()
+    }
+
+    /// Latest reports, sorted by image
+    pub fn summaries(&self) -> Vec<ImageReportSummary> {
+        let mut summaries: Vec<ImageReportSummary> = self
+            .reports
+            .read()
+            .unwrap()
+            .values()
+            .map(|report| ImageReportSummary {
+                image: report.image.clone(),
+                scanner: report.scanner,
+                scanned_at: report.scanned_at,
+                error: report.error.clone(),
+                counts: report.counts.clone(),
+                blocked: self.blocking_findings(report).is_some(),
+            })
+            .collect();
+        summaries.sort_by(|a, b| a.image.cmp(&b.image));
+        summaries
+    }
+
+    /// Why requests may not run on `image`, if they may not. Images that haven't
+    /// been scanned yet, or whose scan failed, are not blocked.
+    pub fn blocked(&self, image: &str) -> Option<String> {
+        let reports = self.reports.read().unwrap();
+        let report = reports.get(image)?;
+        let (count, severity) = self.blocking_findings(report)?;
+        Some(format!(
+            "image {image} has {count} known vulnerabilities of {} severity or higher",
+            severity.as_str()
+        ))
+    }
+
+    // Runs a scanner and returns what it printed
+    fn run(&self, scanner: ScannerKind, mut args: Vec<String>) -> Result<String, String> {
+        let env = if self.offline {
+            scanner.offline(&mut args)
+        } else {
+            &[]
+        };
+        let output = Command::new(&args[0])
+            .args(&args[1..])
+            .envs(env.iter().copied())
+            .output()
+            .map_err(|e| format!("Failed to run {}: {e}", args[0]))?;
+        if !output.status.success() {
+            return Err(String::from_utf8_lossy(&output.stderr).trim().to_string());
+        }
+        Ok(String::from_utf8_lossy(&output.stdout).into_owned())
+    }
+
+    fn blocking_findings(&self, report: &ImageReport) -> Option<(usize, Severity)> {
+        let severity = self.config.as_ref()?.block_severity?;
+        let count = report.count_at_least(severity);
+        (count > 0).then_some((count, severity))
+    }
+}
+
+#[derive(Deserialize)]
+#[serde(rename_all = "PascalCase")]
+struct TrivyReport {
+    #[serde(default)]
+    results: Vec<TrivyResult>,
+}
+
+#[derive(Deserialize)]
+#[serde(rename_all = "PascalCase")]
+struct TrivyResult {
+    // Null when the target has no vulnerabilities
+    #[serde(default)]
+    vulnerabilities: Option<Vec<TrivyVulnerability>>,
+}
+
+#[derive(Deserialize)]
+#[serde(rename_all = "PascalCase")]
+struct TrivyVulnerability {
+    #[serde(rename = "VulnerabilityID")]
+    vulnerability_id: String,
+    pkg_name: String,
+    #[serde(default)]
+    installed_version: String,
+    fixed_version: Option<String>,
+    severity: String,
+}
+
+fn parse_trivy(output: &str) -> Result<Vec<Finding>, String> {
+    let report: TrivyReport =
+        serde_json::from_str(output).map_err(|e| format!("Invalid Trivy report: {e}"))?;
+    Ok(report
+        .results
+        .into_iter()
+        .flat_map(|result| result.vulnerabilities.unwrap_or_default())
+        .map(|vulnerability| Finding {
+            id: vulnerability.vulnerability_id,
+            package: vulnerability.pkg_name,
+            installed_version: vulnerability.installed_version,
+            fixed_version: vulnerability.fixed_version.filter(|v| !v.is_empty()),
+            severity: Severity::parse(&vulnerability.severity),
+        })
+        .collect())
+}
+
+#[derive(Deserialize)]
+struct GrypeReport {
+    #[serde(default)]
+    matches: Vec<GrypeMatch>,
+}
+
+#[derive(Deserialize)]
+struct GrypeMatch {
+    vulnerability: GrypeVulnerability,
+    artifact: GrypeArtifact,
+}
+
+#[derive(Deserialize)]
+struct GrypeVulnerability {
+    id: String,
+    severity: String,
+    #[serde(default)]
+    fix: GrypeFix,
+}
+
+#[derive(Default, Deserialize)]
+struct GrypeFix {
+    #[serde(default)]
+    versions: Vec<String>,
+}
+
+#[derive(Deserialize)]
+struct GrypeArtifact {
+    name: String,
+    #[serde(default)]
+    version: String,
+}
+
+fn parse_grype(output: &str) -> Result<Vec<Finding>, String> {
+    let report: GrypeReport =
+        serde_json::from_str(output).map_err(|e| format!("Invalid Grype report: {e}"))?;
+    Ok(report
+        .matches
+        .into_iter()
+        .map(|m| Finding {
+            id: m.vulnerability.id,
+            package: m.artifact.name,
+            installed_version: m.artifact.version,
+            fixed_version: m.vulnerability.fix.versions.into_iter().next(),
+            severity: Severity::parse(&m.vulnerability.severity),
+        })
+        .collect())
+}
+
+#[derive(Deserialize)]
+struct CycloneDxBom {
+    #[serde(default)]
+    components: Vec<CycloneDxComponent>,
+}
+
+#[derive(Deserialize)]
+struct CycloneDxComponent {
+    #[serde(rename = "type")]
+    kind: String,
+    name: String,
+    version: Option<String>,
+    purl: Option<String>,
+    // Components may nest, e.g. the jars inside a jar
+    #[serde(default)]
+    components: Vec<CycloneDxComponent>,
+}
+
+fn parse_cyclonedx(output: &str) -> Result<Vec<Package>, String> {
+    let bom: CycloneDxBom =
+        serde_json::from_str(output).map_err(|e| format!("Invalid CycloneDX SBOM: {e}"))?;
+    let mut packages = Vec::new();
+    let mut pending = bom.components;
+    while let Some(component) = pending.pop() {
+        pending.extend(component.components);
+        packages.push(Package {
+            name: component.name,
+            version: component.version.filter(|v| !v.is_empty()),
+            kind: component.kind,
+            purl: component.purl,
+        });
+    }
+    packages.sort_by(|a, b| (&a.name, &a.version).cmp(&(&b.name, &b.version)));
+    Ok(packages)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const TRIVY: &str = r#"{
+        "SchemaVersion": 2,
+        "ArtifactName": "python:3.12",
+        "Results": [
+            {"Target": "python:3.12 (debian 12.5)", "Vulnerabilities": [
+                {"VulnerabilityID": "CVE-2024-0001", "PkgName": "openssl", "InstalledVersion": "3.0.11",
+                 "FixedVersion": "3.0.13", "Severity": "CRITICAL"},
+                {"VulnerabilityID": "CVE-2024-0002", "PkgName": "zlib", "InstalledVersion": "1.2.13",
+                 "Severity": "LOW"}
+            ]},
+            {"Target": "Python", "Vulnerabilities": null}
+        ]
+    }"#;
+
+    const GRYPE: &str = r#"{"matches": [
+        {"vulnerability": {"id": "CVE-2024-0003", "severity": "High", "fix": {"versions": ["2.1"], "state": "fixed"}},
+         "artifact": {"name": "requests", "version": "2.0"}}
+    ]}"#;
+
+    fn config(block_severity: Option<Severity>) -> ImageScanConfig {
+        ImageScanConfig {
+            scanner: ScannerKind::Trivy,
+            block_severity,
+            rescan_seconds: 86_400,
+        }
+    }
+
+    #[test]
+    fn test_parse_reports() {
+        let findings = parse_trivy(TRIVY).unwrap();
+        assert_eq!(findings.len(), 2);
+        assert_eq!(findings[0].id, "CVE-2024-0001");
+        assert_eq!(findings[0].severity, Severity::Critical);
+        assert_eq!(findings[1].fixed_version, None);
+
+        let findings = parse_grype(GRYPE).unwrap();
+        assert_eq!(findings[0].package, "requests");
+        assert_eq!(findings[0].severity, Severity::High);
+        assert_eq!(findings[0].fixed_version.as_deref(), Some("2.1"));
+
+        assert!(parse_trivy("not json").is_err());
+    }
+
+    #[test]
+    fn test_offline_commands() {
+        let mut args = ScannerKind::Trivy.command("python:3.12");
+        assert!(ScannerKind::Trivy.offline(&mut args).is_empty());
+        assert!(args.contains(&"--offline-scan".to_string()));
+        assert_eq!(args.last().map(String::as_str), Some("python:3.12"));
+
+        let mut args = ScannerKind::Grype.command("python:3.12");
+        let env = ScannerKind::Grype.offline(&mut args);
+        assert!(env.contains(&("GRYPE_DB_AUTO_UPDATE", "false")));
+        assert_eq!(args, ScannerKind::Grype.command("python:3.12"));
+    }
+
+    #[test]
+    fn test_blocking() {
+        let report = ImageReport::new("python:3.12", ScannerKind::Trivy, parse_trivy(TRIVY));
+        assert_eq!(report.count_at_least(Severity::High), 1);
+        assert_eq!(report.count_at_least(Severity::Unknown), 2);
+
+        let scanner = ImageScanner::new(Some(config(Some(Severity::Critical))));
+        scanner.insert(report.clone());
+        assert!(scanner.blocked("python:3.12").is_some());
+        assert!(scanner.summaries()[0].blocked);
+        // Unscanned images run
+        assert!(scanner.blocked("node:20").is_none());
+
+        // Failed scans don't block
+        scanner.insert(ImageReport::new(
+            "python:3.12",
+            ScannerKind::Trivy,
+            Err("no space left".to_string()),
+        ));
+        assert!(scanner.blocked("python:3.12").is_none());
+
+        // Without a block severity findings are only reported
+        let scanner = ImageScanner::new(Some(config(None)));
+        scanner.insert(report);
+        assert!(scanner.blocked("python:3.12").is_none());
+    }
+
+    #[test]
+    fn test_parse_cyclonedx() {
+        let bom = r#"{"bomFormat": "CycloneDX", "components": [
+            {"type": "operating-system", "name": "debian", "version": "12.5"},
+            {"type": "library", "name": "liblzma5", "version": "5.4.1-0.2",
+             "purl": "pkg:deb/debian/liblzma5@5.4.1-0.2?arch=amd64"},
+            {"type": "library", "name": "app.jar", "version": "",
+             "components": [{"type": "library", "name": "guava", "version": "32.0"}]}
+        ]}"#;
+        let packages = parse_cyclonedx(bom).unwrap();
+        let names: Vec<&str> = packages.iter().map(|p| p.name.as_str()).collect();
+        assert_eq!(names, ["app.jar", "debian", "guava", "liblzma5"]);
+        assert_eq!(packages[0].version, None);
+        assert_eq!(packages[1].kind, "operating-system");
+        assert!(packages[3].purl.as_deref().unwrap().starts_with("pkg:deb/"));
+
+        assert!(parse_cyclonedx("not json").is_err());
+    }
+}
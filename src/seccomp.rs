@@ -0,0 +1,339 @@
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::fs;
+use std::path::PathBuf;
+use std::sync::Mutex;
+
+// Syscalls that change the kernel or the host rather than the process. Most need
+// a capability the sandbox drops anyway, so denying them costs nothing.
+const KERNEL_SYSCALLS: &[&str] = &[
+    "acct",
+    "bpf",
+    "clock_settime",
+    "create_module",
+    "delete_module",
+    "finit_module",
+    "fsconfig",
+    "fsmount",
+    "fsopen",
+    "fspick",
+    "get_kernel_syms",
+    "init_module",
+    "ioperm",
+    "iopl",
+    "kexec_file_load",
+    "kexec_load",
+    "lookup_dcookie",
+    "mount",
+    "mount_setattr",
+    "move_mount",
+    "nfsservctl",
+    "open_by_handle_at",
+    "open_tree",
+    "perf_event_open",
+    "pivot_root",
+    "query_module",
+    "quotactl",
+    "reboot",
+    "settimeofday",
+    "stime",
+    "swapoff",
+    "swapon",
+    "_sysctl",
+    "syslog",
+    "umount",
+    "umount2",
+    "uselib",
+    "userfaultfd",
+    "ustat",
+    "vm86",
+    "vm86old",
+];
+
+// Namespaces and kernel keyrings, which Docker's own profile also keeps from
+// unprivileged containers
+const ISOLATION_SYSCALLS: &[&str] = &[
+    "add_key",
+    "kcmp",
+    "keyctl",
+    "name_to_handle_at",
+    "request_key",
+    "setns",
+    "unshare",
+];
+
+// Reading other processes' memory and newer interfaces with a history of kernel
+// bugs. Some runtimes use io_uring when the kernel has it, so `strict` is meant
+// for languages known not to.
+const STRICT_SYSCALLS: &[&str] = &[
+    "chroot",
+    "io_uring_enter",
+    "io_uring_register",
+    "io_uring_setup",
+    "mknod",
+    "mknodat",
+    "personality",
+    "process_vm_readv",
+    "process_vm_writev",
+    "ptrace",
+];
+
+/// Preset seccomp policy for the sandbox. Every preset allows what it doesn't
+/// list and stops a program making a denied syscall with SIGSYS, so denials
+/// show up in its result and can be counted.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Hash, Deserialize, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum SyscallPolicy {
+    /// `standard` plus debugging interfaces, io_uring and device nodes
+    Strict,
+    /// Kernel administration, namespaces and keyrings
+    #[default]
+    Standard,
+    /// Kernel administration only
+    Permissive,
+}
+
+impl SyscallPolicy {
+    pub const ALL: [SyscallPolicy; 3] = [
+        SyscallPolicy::Strict,
+        SyscallPolicy::Standard,
+        SyscallPolicy::Permissive,
+    ];
+
+    pub fn as_str(self) -> &'static str {
+        match self {
+            SyscallPolicy::Strict => "strict",
+            SyscallPolicy::Standard => "standard",
+            SyscallPolicy::Permissive => "permissive",
+        }
+    }
+
+    /// Syscalls the policy denies, sorted
+    pub fn denied(self) -> Vec<&'static str> {
+        let lists: &[&[&str]] = match self {
+            SyscallPolicy::Strict => &[KERNEL_SYSCALLS, ISOLATION_SYSCALLS, STRICT_SYSCALLS],
+            SyscallPolicy::Standard => &[KERNEL_SYSCALLS, ISOLATION_SYSCALLS],
+            SyscallPolicy::Permissive => &[KERNEL_SYSCALLS],
+        };
+        let mut denied: Vec<&str> = lists.concat();
+        denied.sort_unstable();
+        denied
+    }
+
+    pub fn denies(self, syscall: &str) -> bool {
+        self.denied().contains(&syscall)
+    }
+
+    /// The policy as a Docker seccomp profile. Names a kernel doesn't know are
+    /// skipped when the profile is loaded.
+    pub fn profile(self) -> serde_json::Value {
+        serde_json::json!({
+            "defaultAction": "SCMP_ACT_ALLOW",
+            "architectures": [
+                "SCMP_ARCH_X86_64",
+                "SCMP_ARCH_X86",
+                "SCMP_ARCH_X32",
+                "SCMP_ARCH_AARCH64",
+                "SCMP_ARCH_ARM"
+            ],
+            "syscalls": [{
+                "names": self.denied(),
+                "action": "SCMP_ACT_TRAP"
+            }]
+        })
+    }
+}
+
+/// How often programs were stopped for a denied syscall
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct DenialCount {
+    pub policy: SyscallPolicy,
+    pub language: String,
+    /// None when the run wasn't traced, so the syscall isn't known
+    pub syscall: Option<String>,
+    pub count: u64,
+}
+
+/// Writes the policies' profiles for `docker run --security-opt seccomp=` and
+/// counts the programs they stop, so presets can be tuned from real traffic
+pub struct SyscallFilter {
+    dir: PathBuf,
+    // Profiles written so far, by policy
+    profiles: Mutex<HashMap<SyscallPolicy, String>>,
+    denials: Mutex<HashMap<(SyscallPolicy, String, Option<String>), u64>>,
+}
+
+impl SyscallFilter {
+    pub fn new(dir: PathBuf) -> Self {
+        Self {
+            dir,
+            profiles: Mutex::new(HashMap::new()),
+            denials: Mutex::new(HashMap::new()),
+        }
+    }
+
+    /// Writes profiles to `SECCOMP_PROFILE_DIR`, by default a directory in the
+    /// system's temporary directory
+    pub fn from_env() -> Self {
+        Self::new(
+            std::env::var("SECCOMP_PROFILE_DIR")
+                .ok()
+                .filter(|dir| !dir.is_empty())
+                .map(PathBuf::from)
+                .unwrap_or_else(|| std::env::temp_dir().join("isobox-seccomp")),
+        )
+    }
+
+    /// Path of the policy's profile, written the first time it's needed
+    pub fn profile_path(&self, policy: SyscallPolicy) -> std::io::Result<String> {
+        let mut profiles = self.profiles.lock().unwrap();
+        if let Some(path) = profiles.get(&policy) {
+            return Ok(path.clone());
+        }
+        fs::create_dir_all(&self.dir)?;
+        let path = self.dir.join(format!("{}.json", policy.as_str()));
+        fs::write(&path, policy.profile().to_string())?;
+        let path = path.to_string_lossy().into_owned();
+        profiles.insert(policy, path.clone());
+        Ok(path)
+    }
+
+    /// Logs and counts a program stopped by `policy`
+    pub fn record_denial(
+        &self,
+        job_id: &str,
+        policy: SyscallPolicy,
+        language: &str,
+        syscall: Option<&str>,
+    ) {
+        log::warn!(
+            "Execution {job_id} ({language}) was stopped by the {} syscall policy: {}",
+            policy.as_str(),
+            syscall.unwrap_or("syscall unknown, trace the run to find it")
+        );
+        *self
+            .denials
+            .lock()
+            .unwrap()
+            .entry((policy, language.to_string(), syscall.map(str::to_string)))
+            .or_default() += 1;
+    }
+
+    /// Denials since the server started, most frequent first
+    pub fn denials(&self) -> Vec<DenialCount> {
+        let mut denials: Vec<DenialCount> = self
+            .denials
+            .lock()
+            .unwrap()
+            .iter()
+            .map(|((policy, language, syscall), count)| DenialCount {
+                policy: *policy,
+                language: language.clone(),
+                syscall: syscall.clone(),
+                count: *count,
+            })
+            .collect();
+        denials.sort_by(|a, b| {
+            b.count
+                .cmp(&a.count)
+                .then_with(|| a.language.cmp(&b.language))
+                .then_with(|| a.syscall.cmp(&b.syscall))
+        });
+        denials
+    }
+}
+
+/// The syscall a seccomp filter trapped, from an strace log, e.g. "unshare"
+/// from `--- SIGSYS {si_signo=SIGSYS, si_code=SYS_SECCOMP, ..., si_syscall=__NR_unshare, ...} ---`
+pub fn denied_syscall(trace: &str) -> Option<String> {
+    let line = trace
+        .lines()
+        .rev()
+        .find(|line| line.contains("si_code=SYS_SECCOMP"))?;
+    let start = line.find("si_syscall=")? + "si_syscall=".len();
+    let name: String = line[start..]
+        .trim_start_matches("__NR_")
+        .chars()
+        .take_while(|c| c.is_ascii_alphanumeric() || *c == '_')
+        .collect();
+    (!name.is_empty()).then_some(name)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_presets_are_nested() {
+        let strict = SyscallPolicy::Strict.denied();
+        let standard = SyscallPolicy::Standard.denied();
+        let permissive = SyscallPolicy::Permissive.denied();
+        assert!(permissive.iter().all(|syscall| standard.contains(syscall)));
+        assert!(standard.iter().all(|syscall| strict.contains(syscall)));
+        assert!(SyscallPolicy::Standard.denies("unshare"));
+        assert!(!SyscallPolicy::Permissive.denies("unshare"));
+        // Tracing needs ptrace
+        assert!(!SyscallPolicy::Standard.denies("ptrace"));
+        assert!(SyscallPolicy::Strict.denies("ptrace"));
+    }
+
+    #[test]
+    fn test_profile() {
+        let profile = SyscallPolicy::Permissive.profile();
+        assert_eq!(profile["defaultAction"], "SCMP_ACT_ALLOW");
+        assert_eq!(profile["syscalls"][0]["action"], "SCMP_ACT_TRAP");
+        assert!(profile["syscalls"][0]["names"]
+            .as_array()
+            .unwrap()
+            .contains(&serde_json::json!("kexec_load")));
+    }
+
+    #[test]
+    fn test_profile_path_is_written_once() {
+        let dir = std::env::temp_dir().join(format!("isobox-seccomp-{}", uuid::Uuid::new_v4()));
+        let filter = SyscallFilter::new(dir.clone());
+        let path = filter.profile_path(SyscallPolicy::Strict).unwrap();
+        assert!(path.ends_with("strict.json"));
+        let profile: serde_json::Value =
+            serde_json::from_str(&fs::read_to_string(&path).unwrap()).unwrap();
+        assert_eq!(profile, SyscallPolicy::Strict.profile());
+
+        fs::remove_file(&path).unwrap();
+        assert_eq!(filter.profile_path(SyscallPolicy::Strict).unwrap(), path);
+        fs::remove_dir_all(&dir).unwrap();
+    }
+
+    #[test]
+    fn test_denials_are_counted() {
+        let filter = SyscallFilter::new(std::env::temp_dir());
+        filter.record_denial("a", SyscallPolicy::Strict, "c", Some("ptrace"));
+        filter.record_denial("b", SyscallPolicy::Strict, "c", Some("ptrace"));
+        filter.record_denial("c", SyscallPolicy::Standard, "python", None);
+        assert_eq!(
+            filter.denials(),
+            [
+                DenialCount {
+                    policy: SyscallPolicy::Strict,
+                    language: "c".to_string(),
+                    syscall: Some("ptrace".to_string()),
+                    count: 2,
+                },
+                DenialCount {
+                    policy: SyscallPolicy::Standard,
+                    language: "python".to_string(),
+                    syscall: None,
+                    count: 1,
+                },
+            ]
+        );
+    }
+
+    #[test]
+    fn test_denied_syscall() {
+        let trace = "42 10:00:00.000001 unshare(CLONE_NEWUSER) = ? <0.000010>\n\
+            42 10:00:00.000002 --- SIGSYS {si_signo=SIGSYS, si_code=SYS_SECCOMP, si_call_addr=0x7f, si_syscall=__NR_unshare, si_arch=AUDIT_ARCH_X86_64} ---\n\
+            42 10:00:00.000003 +++ killed by SIGSYS (core dumped) +++\n";
+        assert_eq!(denied_syscall(trace), Some("unshare".to_string()));
+        assert_eq!(denied_syscall("read(0, \"\", 1) = 0\n"), None);
+    }
+}
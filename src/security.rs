@@ -0,0 +1,219 @@
+use serde::Serialize;
+
+// Sockets of container runtimes, which would let a program start containers of
+// its own on the host
+const RUNTIME_SOCKETS: &[&str] = &["docker.sock", "containerd.sock", "podman.sock", "crio.sock"];
+
+// Cloud instance metadata services, which hand out the host's credentials
+const METADATA_ADDRESSES: &[&str] = &[
+    "169.254.169.254",
+    "fd00:ec2::254",
+    "100.100.100.200",
+    "metadata.google.internal",
+];
+
+// Attaching to or reading the memory of another process
+const PTRACE_MARKERS: &[&str] = &[
+    "PTRACE_ATTACH",
+    "PTRACE_SEIZE",
+    "process_vm_readv",
+    "process_vm_writev",
+];
+
+/// What a program tried that it has no business doing in a sandbox
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum Indicator {
+    /// Reaching a container runtime's socket
+    RuntimeSocket,
+    /// Reaching a cloud metadata service
+    MetadataService,
+    /// Tracing or reading the memory of another process
+    Ptrace,
+    /// Connecting to a host other than the sandbox itself
+    OutboundConnection,
+}
+
+/// Where an indicator was found
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum AlertSource {
+    /// The submitted code mentions it, which doesn't mean it was tried
+    Code,
+    /// The syscall trace of a `trace` request shows the attempt
+    Trace,
+}
+
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct SecurityAlert {
+    pub indicator: Indicator,
+    pub source: AlertSource,
+    /// The line of code or trace it was found in
+    pub evidence: String,
+    /// Whether the sandbox stopped the attempt; unknown for code
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub blocked: Option<bool>,
+}
+
+/// Red flags in submitted code, at most one per indicator
+pub fn scan_code(code: &str) -> Vec<SecurityAlert> {
+    let mut alerts = Vec::new();
+    for (number, line) in code.lines().enumerate() {
+        let indicator = if contains_any(line, RUNTIME_SOCKETS) {
+            Indicator::RuntimeSocket
+        } else if contains_any(line, METADATA_ADDRESSES) {
+            Indicator::MetadataService
+        } else if contains_any(line, PTRACE_MARKERS) {
+            Indicator::Ptrace
+        } else {
+            continue;
+        };
+        push(
+            &mut alerts,
+            SecurityAlert {
+                indicator,
+                source: AlertSource::Code,
+                evidence: format!("line {}: {}", number + 1, truncate(line.trim())),
+                blocked: None,
+            },
+        );
+    }
+    alerts
+}
+
+/// Red flags in an strace log, at most one per indicator. An attempt counts as
+/// blocked when its syscall failed.
+pub fn scan_trace(trace: &str) -> Vec<SecurityAlert> {
+    let mut alerts = Vec::new();
+    for line in trace.lines() {
+        let Some(indicator) = trace_indicator(line) else {
+            continue;
+        };
+        push(
+            &mut alerts,
+            SecurityAlert {
+                indicator,
+                source: AlertSource::Trace,
+                evidence: truncate(line.trim()),
+                blocked: Some(failed(line)),
+            },
+        );
+    }
+    alerts
+}
+
+fn trace_indicator(line: &str) -> Option<Indicator> {
+    let call = syscall(line)?;
+    match call {
+        "connect" | "sendto" | "sendmsg" | "open" | "openat" | "stat" | "newfstatat" => {
+            if contains_any(line, RUNTIME_SOCKETS) {
+                Some(Indicator::RuntimeSocket)
+            } else if contains_any(line, METADATA_ADDRESSES) {
+                Some(Indicator::MetadataService)
+            } else if call != "open" && call != "openat" && remote_address(line) {
+                Some(Indicator::OutboundConnection)
+            } else {
+                None
+            }
+        }
+        "ptrace" => contains_any(line, PTRACE_MARKERS).then_some(Indicator::Ptrace),
+        "process_vm_readv" | "process_vm_writev" => Some(Indicator::Ptrace),
+        _ => None,
+    }
+}
+
+// Name of the syscall on an strace line, after its pid and timestamp
+fn syscall(line: &str) -> Option<&str> {
+    let call = line.split_whitespace().find(|word| word.contains('('))?;
+    let name = &call[..call.find('(')?];
+    (!name.is_empty() && name.chars().all(|c| c.is_ascii_alphanumeric() || c == '_'))
+        .then_some(name)
+}
+
+// Whether the line has an internet address other than the loopback one
+fn remote_address(line: &str) -> bool {
+    let ipv4 = quoted_after(line, "inet_addr(");
+    let ipv6 = line
+        .find("inet_pton(AF_INET6, ")
+        .and_then(|start| quoted_after(&line[start..], ", "));
+    [ipv4, ipv6].into_iter().flatten().any(|address| {
+        !address.starts_with("127.") && address != "::1" && address != "0.0.0.0" && address != "::"
+    })
+}
+
+fn quoted_after<'a>(line: &'a str, prefix: &str) -> Option<&'a str> {
+    let start = line.find(prefix)? + prefix.len();
+    let rest = line[start..].strip_prefix('"')?;
+    Some(&rest[..rest.find('"')?])
+}
+
+// Whether the syscall returned an error, or never returned because the program
+// was killed
+fn failed(line: &str) -> bool {
+    let Some(start) = line.rfind(") = ") else {
+        return true;
+    };
+    let result = line[start + ") = ".len()..].trim_start();
+    result.starts_with('-') || result.starts_with('?')
+}
+
+fn contains_any(line: &str, markers: &[&str]) -> bool {
+    markers.iter().any(|marker| line.contains(marker))
+}
+
+fn push(alerts: &mut Vec<SecurityAlert>, alert: SecurityAlert) {
+    if !alerts.iter().any(|seen| seen.indicator == alert.indicator) {
+        alerts.push(alert);
+    }
+}
+
+fn truncate(evidence: &str) -> String {
+    const MAX_CHARS: usize = 200;
+    match evidence.char_indices().nth(MAX_CHARS) {
+        Some((end, _)) => format!("{}...", &evidence[..end]),
+        None => evidence.to_string(),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_scan_code() {
+        let code = "import socket, requests\n\
+            requests.get('http://169.254.169.254/latest/meta-data/')\n\
+            s = socket.socket(socket.AF_UNIX)\n\
+            s.connect('/var/run/docker.sock')\n\
+            requests.get('http://169.254.169.254/other')\n";
+        let alerts = scan_code(code);
+        assert_eq!(alerts.len(), 2);
+        assert_eq!(alerts[0].indicator, Indicator::MetadataService);
+        assert!(alerts[0].evidence.starts_with("line 2: "));
+        assert_eq!(alerts[1].indicator, Indicator::RuntimeSocket);
+        assert_eq!(alerts[1].blocked, None);
+        assert!(scan_code("print(sum(map(int, input().split())))").is_empty());
+    }
+
+    #[test]
+    fn test_scan_trace() {
+        let trace = "7 10:00:00.000001 connect(3, {sa_family=AF_UNIX, sun_path=\"/var/run/docker.sock\"}, 110) = -1 ENOENT (No such file or directory) <0.000010>\n\
+            7 10:00:00.000002 connect(4, {sa_family=AF_INET, sin_port=htons(80), sin_addr=inet_addr(\"127.0.0.1\")}, 16) = 0 <0.000010>\n\
+            7 10:00:00.000003 connect(5, {sa_family=AF_INET6, sin6_port=htons(443), sin6_flowinfo=htonl(0), inet_pton(AF_INET6, \"2606:4700::1111\", &sin6_addr), sin6_scope_id=0}, 28) = 0 <0.000010>\n\
+            7 10:00:00.000004 ptrace(PTRACE_ATTACH, 1) = -1 EPERM (Operation not permitted) <0.000004>\n\
+            7 10:00:00.000005 ptrace(PTRACE_TRACEME) = 0 <0.000004>\n";
+        let alerts = scan_trace(trace);
+        let found: Vec<(Indicator, Option<bool>)> = alerts
+            .iter()
+            .map(|alert| (alert.indicator, alert.blocked))
+            .collect();
+        assert_eq!(
+            found,
+            [
+                (Indicator::RuntimeSocket, Some(true)),
+                (Indicator::OutboundConnection, Some(false)),
+                (Indicator::Ptrace, Some(true)),
+            ]
+        );
+    }
+}
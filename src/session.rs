@@ -0,0 +1,986 @@
+use crate::config::{data_dir, SessionLimits};
+use crate::events::{EventKind, ExecutionEvent};
+use crate::executor::ExecuteResponse;
+use crate::store::unix_timestamp;
+use crate::terminal::Terminal;
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::RwLock;
+use std::time::Instant;
+use thiserror::Error;
+use tokio::sync::broadcast;
+use uuid::Uuid;
+
+// Output events kept for attached clients that fall behind
+const ATTACH_BUFFER: usize = 64;
+
+#[derive(Debug, Error)]
+pub enum SessionError {
+    #[error("Session not found: {0}")]
+    NotFound(String),
+    #[error("Session {0} uses {1} bytes, exceeding its disk quota of {2} bytes")]
+    QuotaExceeded(String, u64, u64),
+    #[error("Failed to create session volume: {0}")]
+    Volume(String),
+    #[error("Snapshot not found: {0}")]
+    SnapshotNotFound(String),
+    #[error("Failed to snapshot session {0}: {1}")]
+    Snapshot(String, String),
+    #[error("Tenant {1} can watch session {0} but not run code in it")]
+    ReadOnly(String, String),
+}
+
+/// Who may run code in a session that other tenants are attached to
+#[derive(Debug, Clone, Copy, Default, PartialEq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum WriteControl {
+    /// Only the tenant that created the session; guests watch
+    #[default]
+    Owner,
+    /// The owner and every guest
+    Guests,
+}
+
+/// A long-lived sandbox whose workspace persists between exec calls
+#[derive(Debug, Clone, Serialize)]
+pub struct Session {
+    pub id: String,
+    pub tenant: String,
+    pub language: String,
+    pub created_at: u64,
+    /// When the session was last used, or created
+    pub last_used_at: u64,
+    /// When the session will be closed: once idle too long, at the end of its
+    /// lifetime, or when evicted
+    pub expires_at: u64,
+    pub disk_quota_bytes: u64,
+    /// Exec calls made in the session
+    pub executions: u64,
+    /// The snapshot the session was forked from
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub snapshot: Option<String>,
+    /// Other tenants that may attach to the session
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    pub guests: Vec<String>,
+    pub write: WriteControl,
+    /// The terminal clients render the session in, which exec calls run with
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub terminal: Option<Terminal>,
+    // Exec calls and their output, for attached clients
+    #[serde(skip)]
+    output: broadcast::Sender<SessionOutput>,
+    #[serde(skip)]
+    idle_timeout_seconds: u64,
+    #[serde(skip)]
+    lifetime_ends_at: Option<u64>,
+    #[serde(skip)]
+    evicted_at: Option<u64>,
+    // Orders sessions used within the same second
+    #[serde(skip)]
+    used: Instant,
+    // Whether the tenant has been told about the current expiry
+    #[serde(skip)]
+    warned: bool,
+}
+
+impl Session {
+    pub fn can_attach(&self, tenant: &str) -> bool {
+        self.tenant == tenant || self.guests.iter().any(|guest| guest == tenant)
+    }
+
+    pub fn can_write(&self, tenant: &str) -> bool {
+        self.tenant == tenant || (self.write == WriteControl::Guests && self.can_attach(tenant))
+    }
+
+    /// Clients currently attached to the session
+    pub fn attached(&self) -> usize {
+        self.output.receiver_count()
+    }
+
+    // When and why the session will be closed
+    fn deadline(&self) -> (u64, CloseReason) {
+        let mut deadline = (
+            self.last_used_at + self.idle_timeout_seconds,
+            CloseReason::Idle,
+        );
+        let limits = [
+            (self.lifetime_ends_at, CloseReason::Lifetime),
+            (self.evicted_at, CloseReason::Evicted),
+        ];
+        for (at, reason) in limits {
+            if let Some(at) = at.filter(|&at| at <= deadline.0) {
+                deadline = (at, reason);
+            }
+        }
+        deadline
+    }
+
+    fn reschedule(&mut self) {
+        let expires_at = self.deadline().0;
+        if expires_at != self.expires_at {
+            self.expires_at = expires_at;
+            self.warned = false;
+        }
+    }
+}
+
+/// Why a session is closed
+#[derive(Debug, Clone, Copy, PartialEq, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum CloseReason {
+    /// Not used for its idle timeout
+    Idle,
+    /// Reached its hard lifetime
+    Lifetime,
+    /// Made room for a newer session of its tenant
+    Evicted,
+}
+
+/// What session events say about the session's end
+#[derive(Debug, Clone, Copy, Serialize)]
+pub struct SessionNotice {
+    pub reason: CloseReason,
+    pub closes_at: u64,
+}
+
+/// Something that happened in a session, sent to every attached client
+#[derive(Debug, Clone, Serialize)]
+#[serde(tag = "event", rename_all = "snake_case")]
+pub enum SessionOutput {
+    /// An exec call started. The code is left out when the terminal's echo is off.
+    Started {
+        tenant: String,
+        #[serde(skip_serializing_if = "Option::is_none")]
+        code: Option<String>,
+    },
+    Finished {
+        tenant: String,
+        result: ExecuteResponse,
+    },
+    /// An exec call failed before producing a result
+    Failed { tenant: String, error: String },
+    /// The session's terminal was resized or its echo changed
+    Terminal { tenant: String, terminal: Terminal },
+}
+
+impl SessionOutput {
+    pub fn to_sse(&self) -> String {
+        let event = match self {
+            SessionOutput::Started { .. } => "started",
+            SessionOutput::Finished { .. } => "finished",
+            SessionOutput::Failed { .. } => "failed",
+            SessionOutput::Terminal { .. } => "terminal",
+        };
+        let data = serde_json::to_string(self).unwrap_or_default();
+        format!("event: {event}\ndata: {data}\n\n")
+    }
+}
+
+/// A session with what it's using, for operators
+#[derive(Debug, Clone, Serialize)]
+pub struct SessionUsage {
+    #[serde(flatten)]
+    pub session: Session,
+    pub age_seconds: u64,
+    /// Seconds since the session was last used
+    pub idle_seconds: u64,
+    pub disk_bytes: u64,
+    /// Clients attached to the session's output
+    pub attached: usize,
+}
+
+/// Selects sessions to list or terminate. Unset fields match every session.
+#[derive(Debug, Clone, Default)]
+pub struct SessionFilter {
+    pub tenant: Option<String>,
+    pub language: Option<String>,
+    /// Sessions created at least this long ago
+    pub min_age_seconds: Option<u64>,
+    /// Sessions unused for at least this long
+    pub min_idle_seconds: Option<u64>,
+}
+
+impl SessionFilter {
+    fn matches(&self, session: &Session, now: u64) -> bool {
+        self.tenant.as_ref().map_or(true, |t| *t == session.tenant)
+            && self
+                .language
+                .as_ref()
+                .map_or(true, |l| *l == session.language)
+            && self
+                .min_age_seconds
+                .map_or(true, |age| now.saturating_sub(session.created_at) >= age)
+            && self.min_idle_seconds.map_or(true, |idle| {
+                now.saturating_sub(session.last_used_at) >= idle
+            })
+    }
+}
+
+/// A copy of a session's volume that new sessions can be forked from. Snapshots
+/// outlive their session and are kept until deleted.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct Snapshot {
+    pub id: String,
+    pub tenant: String,
+    pub language: String,
+    /// The session it was taken of
+    pub session: String,
+    pub created_at: u64,
+    pub size_bytes: u64,
+}
+
+/// Tracks sessions in memory and backs each one with a host directory that is
+/// mounted as the workspace of every execution in the session
+pub struct SessionManager {
+    root: PathBuf,
+    ttl_seconds: u64,
+    disk_quota_bytes: u64,
+    // Server-wide limits; 0 is unlimited
+    max_lifetime_seconds: u64,
+    max_sessions: usize,
+    // How long before a session is closed its tenant is told
+    grace_seconds: u64,
+    tenant_limits: HashMap<String, SessionLimits>,
+    sessions: RwLock<HashMap<String, Session>>,
+    snapshots: RwLock<HashMap<String, Snapshot>>,
+}
+
+impl SessionManager {
+    pub fn new(root: PathBuf, ttl_seconds: u64, disk_quota_bytes: u64) -> Self {
+        let snapshots = load_snapshots(&root.join(SNAPSHOTS_DIR));
+        Self {
+            root,
+            ttl_seconds,
+            disk_quota_bytes,
+            max_lifetime_seconds: 0,
+            max_sessions: 0,
+            grace_seconds: 60,
+            tenant_limits: HashMap::new(),
+            sessions: RwLock::new(HashMap::new()),
+            snapshots: RwLock::new(snapshots),
+        }
+    }
+
+    pub fn from_env() -> Self {
+        let root = std::env::var("SESSIONS_DIR")
+            .map(PathBuf::from)
+            .unwrap_or_else(|_| data_dir().join("sessions"));
+        let ttl_seconds = std::env::var("SESSION_TTL_SECONDS")
+            .ok()
+            .and_then(|s| s.parse::<u64>().ok())
+            .unwrap_or(1800);
+        let disk_quota_bytes = std::env::var("SESSION_DISK_QUOTA_BYTES")
+            .ok()
+            .and_then(|s| s.parse::<u64>().ok())
+            .unwrap_or(100 * 1024 * 1024);
+        let env_or = |name: &str, default: u64| {
+            std::env::var(name)
+                .ok()
+                .and_then(|s| s.parse::<u64>().ok())
+                .unwrap_or(default)
+        };
+        Self {
+            max_lifetime_seconds: env_or("SESSION_MAX_LIFETIME_SECONDS", 0),
+            max_sessions: env_or("SESSION_MAX_PER_TENANT", 0) as usize,
+            grace_seconds: env_or("SESSION_EVICTION_GRACE_SECONDS", 60),
+            ..Self::new(root, ttl_seconds, disk_quota_bytes)
+        }
+    }
+
+    /// Limits replacing the server-wide ones for some tenants
+    pub fn with_tenant_limits(mut self, limits: HashMap<String, SessionLimits>) -> Self {
+        self.tenant_limits = limits;
+        self
+    }
+
+    pub fn create(&self, tenant: &str, language: &str) -> Result<Session, SessionError> {
+        let id = Uuid::new_v4().to_string();
+        fs::create_dir_all(self.volume_path(&id))
+            .map_err(|e| SessionError::Volume(e.to_string()))?;
+        Ok(self.register(id, tenant, language, None))
+    }
+
+    /// Starts a session whose volume is a copy of the snapshot's. The snapshot
+    /// must belong to the tenant.
+    pub fn fork(&self, tenant: &str, snapshot_id: &str) -> Result<Session, SessionError> {
+        let snapshot = self
+            .snapshot(snapshot_id)
+            .filter(|snapshot| snapshot.tenant == tenant)
+            .ok_or_else(|| SessionError::SnapshotNotFound(snapshot_id.to_string()))?;
+        let id = Uuid::new_v4().to_string();
+        let volume = self.volume_path(&id);
+        if let Err(e) = copy_tree(&self.snapshot_files(snapshot_id), &volume) {
+            fs::remove_dir_all(&volume).ok();
+            return Err(SessionError::Volume(e.to_string()));
+        }
+        Ok(self.register(id, tenant, &snapshot.language, Some(snapshot.id)))
+    }
+
+    // Adds the session, evicting the tenant's least recently used session if it
+    // already has as many as it may
+    fn register(
+        &self,
+        id: String,
+        tenant: &str,
+        language: &str,
+        snapshot: Option<String>,
+    ) -> Session {
+        let limits = self.tenant_limits.get(tenant).copied().unwrap_or_default();
+        let lifetime = limits
+            .max_lifetime_seconds
+            .unwrap_or(self.max_lifetime_seconds);
+        let max_sessions = limits.max_sessions.unwrap_or(self.max_sessions);
+        let now = unix_timestamp();
+        let mut session = Session {
+            id: id.clone(),
+            tenant: tenant.to_string(),
+            language: language.to_string(),
+            created_at: now,
+            last_used_at: now,
+            expires_at: 0,
+            disk_quota_bytes: self.disk_quota_bytes,
+            executions: 0,
+            snapshot,
+            guests: Vec::new(),
+            write: WriteControl::Owner,
+            terminal: None,
+            output: broadcast::channel(ATTACH_BUFFER).0,
+            idle_timeout_seconds: limits.idle_seconds.unwrap_or(self.ttl_seconds),
+            lifetime_ends_at: (lifetime > 0).then_some(now + lifetime),
+            evicted_at: None,
+            used: Instant::now(),
+            warned: false,
+        };
+        session.reschedule();
+
+        let mut sessions = self.sessions.write().unwrap();
+        // Sessions already being evicted have made their room
+        let open: Vec<&mut Session> = sessions
+            .values_mut()
+            .filter(|open| open.tenant == tenant && open.evicted_at.is_none())
+            .collect();
+        if max_sessions > 0 && open.len() >= max_sessions {
+            if let Some(lru) = open.into_iter().min_by_key(|open| open.used) {
+                lru.evicted_at = Some(now + self.grace_seconds);
+                lru.reschedule();
+                log::info!(
+                    "Session {} of tenant {tenant} evicted, closing at {}",
+                    lru.id,
+                    lru.expires_at
+                );
+            }
+        }
+        sessions.insert(id, session.clone());
+        session
+    }
+
+    pub fn get(&self, id: &str) -> Option<Session> {
+        self.sessions.read().unwrap().get(id).cloned()
+    }
+
+    /// The session with its age and disk usage
+    pub fn usage(&self, id: &str, now: u64) -> Option<SessionUsage> {
+        let session = self.get(id)?;
+        Some(SessionUsage {
+            age_seconds: now.saturating_sub(session.created_at),
+            idle_seconds: now.saturating_sub(session.last_used_at),
+            disk_bytes: disk_usage(&self.volume_path(id)),
+            attached: session.attached(),
+            session,
+        })
+    }
+
+    /// Sessions matching the filter, oldest first. Measures each volume's disk
+    /// usage, so it's slower than `get`.
+    pub fn list(&self, filter: &SessionFilter, now: u64) -> Vec<SessionUsage> {
+        let mut sessions: Vec<SessionUsage> = self
+            .matching(filter, now)
+            .iter()
+            .filter_map(|id| self.usage(id, now))
+            .collect();
+        sessions.sort_by(|a, b| {
+            (a.session.created_at, &a.session.id).cmp(&(b.session.created_at, &b.session.id))
+        });
+        sessions
+    }
+
+    /// Terminates every session matching the filter, returning their ids
+    pub fn remove_matching(&self, filter: &SessionFilter, now: u64) -> Vec<String> {
+        self.matching(filter, now)
+            .into_iter()
+            .filter(|id| self.remove(id))
+            .collect()
+    }
+
+    fn matching(&self, filter: &SessionFilter, now: u64) -> Vec<String> {
+        self.sessions
+            .read()
+            .unwrap()
+            .values()
+            .filter(|session| filter.matches(session, now))
+            .map(|session| session.id.clone())
+            .collect()
+    }
+
+    pub fn volume_path(&self, id: &str) -> PathBuf {
+        self.root.join(id)
+    }
+
+    /// Restarts the session's idle timeout after it has been used. Its hard
+    /// lifetime and a pending eviction still apply.
+    pub fn touch(&self, id: &str) {
+        if let Some(session) = self.sessions.write().unwrap().get_mut(id) {
+            session.last_used_at = unix_timestamp();
+            session.executions += 1;
+            session.used = Instant::now();
+            session.reschedule();
+        }
+    }
+
+    /// Lets other tenants attach to the session, replacing its guests
+    pub fn share(
+        &self,
+        id: &str,
+        guests: Vec<String>,
+        write: WriteControl,
+    ) -> Result<Session, SessionError> {
+        let mut sessions = self.sessions.write().unwrap();
+        let session = sessions
+            .get_mut(id)
+            .ok_or_else(|| SessionError::NotFound(id.to_string()))?;
+        session.guests = guests;
+        session.write = write;
+        Ok(session.clone())
+    }
+
+    /// Sets the session's terminal and tells attached clients, so that they all
+    /// render it at the same size
+    pub fn set_terminal(
+        &self,
+        id: &str,
+        tenant: &str,
+        terminal: Terminal,
+    ) -> Result<Session, SessionError> {
+        let mut sessions = self.sessions.write().unwrap();
+        let session = sessions
+            .get_mut(id)
+            .ok_or_else(|| SessionError::NotFound(id.to_string()))?;
+        session.terminal = Some(terminal);
+        session
+            .output
+            .send(SessionOutput::Terminal {
+                tenant: tenant.to_string(),
+                terminal,
+            })
+            .ok();
+        Ok(session.clone())
+    }
+
+    /// Receives everything run in the session from now on, until it's closed
+    pub fn attach(&self, id: &str) -> Option<broadcast::Receiver<SessionOutput>> {
+        let sessions = self.sessions.read().unwrap();
+        sessions.get(id).map(|session| session.output.subscribe())
+    }
+
+    /// Sends output to the session's attached clients, if any
+    pub fn publish(&self, id: &str, output: SessionOutput) {
+        if let Some(session) = self.sessions.read().unwrap().get(id) {
+            session.output.send(output).ok();
+        }
+    }
+
+    /// Returns the volume's current usage, or an error if it is already over quota.
+    /// Usage is only measured between exec calls, so a single call can overshoot the quota
+    /// but the session is refused further executions until files are removed.
+    pub fn check_quota(&self, id: &str) -> Result<u64, SessionError> {
+        let session = self
+            .get(id)
+            .ok_or_else(|| SessionError::NotFound(id.to_string()))?;
+        let usage = disk_usage(&self.volume_path(id));
+        if usage > session.disk_quota_bytes {
+            return Err(SessionError::QuotaExceeded(
+                id.to_string(),
+                usage,
+                session.disk_quota_bytes,
+            ));
+        }
+        Ok(usage)
+    }
+
+    /// Drops the session and deletes its volume
+    pub fn remove(&self, id: &str) -> bool {
+        let removed = self.sessions.write().unwrap().remove(id).is_some();
+        if removed {
+            if let Err(e) = fs::remove_dir_all(self.volume_path(id)) {
+                log::warn!("Failed to remove volume of session {id}: {e}");
+            }
+        }
+        removed
+    }
+
+    /// Copies the session's volume into a new snapshot. Files written by an exec
+    /// call still running in the session may or may not be included.
+    pub fn snapshot_session(&self, id: &str) -> Result<Snapshot, SessionError> {
+        let session = self
+            .get(id)
+            .ok_or_else(|| SessionError::NotFound(id.to_string()))?;
+        let snapshot = Snapshot {
+            id: Uuid::new_v4().to_string(),
+            tenant: session.tenant,
+            language: session.language,
+            session: id.to_string(),
+            created_at: unix_timestamp(),
+            size_bytes: disk_usage(&self.volume_path(id)),
+        };
+        let dir = self.snapshot_dir(&snapshot.id);
+        let saved = copy_tree(&self.volume_path(id), &dir.join("files")).and_then(|()| {
+            let metadata = serde_json::to_vec(&snapshot).map_err(std::io::Error::other)?;
+            fs::write(dir.join(SNAPSHOT_METADATA), metadata)
+        });
+        if let Err(e) = saved {
+            fs::remove_dir_all(&dir).ok();
+            return Err(SessionError::Snapshot(id.to_string(), e.to_string()));
+        }
+        self.snapshots
+            .write()
+            .unwrap()
+            .insert(snapshot.id.clone(), snapshot.clone());
+        Ok(snapshot)
+    }
+
+    pub fn snapshot(&self, id: &str) -> Option<Snapshot> {
+        self.snapshots.read().unwrap().get(id).cloned()
+    }
+
+    /// The tenant's snapshots, oldest first
+    pub fn snapshots(&self, tenant: &str) -> Vec<Snapshot> {
+        let mut snapshots: Vec<Snapshot> = self
+            .snapshots
+            .read()
+            .unwrap()
+            .values()
+            .filter(|snapshot| snapshot.tenant == tenant)
+            .cloned()
+            .collect();
+        snapshots.sort_by(|a, b| (a.created_at, &a.id).cmp(&(b.created_at, &b.id)));
+        snapshots
+    }
+
+    /// Deletes the snapshot. Sessions forked from it are unaffected.
+    pub fn remove_snapshot(&self, id: &str) -> bool {
+        let removed = self.snapshots.write().unwrap().remove(id).is_some();
+        if removed {
+            if let Err(e) = fs::remove_dir_all(self.snapshot_dir(id)) {
+                log::warn!("Failed to remove snapshot {id}: {e}");
+            }
+        }
+        removed
+    }
+
+    fn snapshot_dir(&self, id: &str) -> PathBuf {
+        self.root.join(SNAPSHOTS_DIR).join(id)
+    }
+
+    fn snapshot_files(&self, id: &str) -> PathBuf {
+        self.snapshot_dir(id).join("files")
+    }
+
+    /// Removes every session and snapshot of a tenant, returning the ids of the
+    /// sessions
+    pub fn remove_tenant(&self, tenant: &str) -> Vec<String> {
+        for snapshot in self.snapshots(tenant) {
+            self.remove_snapshot(&snapshot.id);
+        }
+        let filter = SessionFilter {
+            tenant: Some(tenant.to_string()),
+            ..Default::default()
+        };
+        self.remove_matching(&filter, unix_timestamp())
+    }
+
+    /// Removes every session that expired by `now`, and warns about sessions closing
+    /// within the grace period. Returns the events to publish: `session_closed` for
+    /// removed sessions, and one `session_expiring` per session and expiry.
+    pub fn reap_expired(&self, now: u64) -> Vec<ExecutionEvent> {
+        let mut events = Vec::new();
+        let mut expired = Vec::new();
+        for session in self.sessions.write().unwrap().values_mut() {
+            let (closes_at, reason) = session.deadline();
+            let notice = SessionNotice { reason, closes_at };
+            if closes_at <= now {
+                expired.push(session.id.clone());
+                events.push(ExecutionEvent::session(
+                    EventKind::SessionClosed,
+                    session,
+                    notice,
+                ));
+            } else if !session.warned && closes_at <= now + self.grace_seconds {
+                session.warned = true;
+                events.push(ExecutionEvent::session(
+                    EventKind::SessionExpiring,
+                    session,
+                    notice,
+                ));
+            }
+        }
+        for id in &expired {
+            self.remove(id);
+            log::info!("Session {id} expired, volume removed");
+        }
+        events
+    }
+}
+
+// Snapshots live next to the session volumes, which are named by UUID
+const SNAPSHOTS_DIR: &str = "snapshots";
+const SNAPSHOT_METADATA: &str = "snapshot.json";
+
+// Picks up the snapshots taken before the server restarted
+fn load_snapshots(dir: &Path) -> HashMap<String, Snapshot> {
+    let Ok(entries) = fs::read_dir(dir) else {
+        return HashMap::new();
+    };
+    entries
+        .flatten()
+        .filter_map(|entry| {
+            let metadata = fs::read(entry.path().join(SNAPSHOT_METADATA)).ok()?;
+            match serde_json::from_slice::<Snapshot>(&metadata) {
+                Ok(snapshot) => Some((snapshot.id.clone(), snapshot)),
+                Err(e) => {
+                    log::warn!("Ignoring snapshot {}: {e}", entry.path().display());
+                    None
+                }
+            }
+        })
+        .collect()
+}
+
+// Copies a directory tree, keeping permissions and copying links rather than
+// what they point to
+fn copy_tree(from: &Path, to: &Path) -> std::io::Result<()> {
+    fs::create_dir_all(to)?;
+    for entry in fs::read_dir(from)? {
+        let entry = entry?;
+        let target = to.join(entry.file_name());
+        let file_type = entry.file_type()?;
+        if file_type.is_dir() {
+            copy_tree(&entry.path(), &target)?;
+        } else if file_type.is_symlink() {
+            std::os::unix::fs::symlink(fs::read_link(entry.path())?, &target)?;
+        } else {
+            fs::copy(entry.path(), &target)?;
+        }
+    }
+    Ok(())
+}
+
+/// Bytes of the files under a directory
+pub fn disk_usage(dir: &Path) -> u64 {
+    let Ok(entries) = fs::read_dir(dir) else {
+        return 0;
+    };
+    entries
+        .flatten()
+        .map(|entry| match entry.file_type() {
+            Ok(file_type) if file_type.is_dir() => disk_usage(&entry.path()),
+            Ok(_) => entry.metadata().map(|m| m.len()).unwrap_or(0),
+            Err(_) => 0,
+        })
+        .sum()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn temp_root() -> PathBuf {
+        std::env::temp_dir().join(format!("isobox-session-test-{}", Uuid::new_v4()))
+    }
+
+    #[test]
+    fn test_volume_persists_and_quota_is_enforced() {
+        let manager = SessionManager::new(temp_root(), 60, 16);
+        let session = manager.create("default", "python").unwrap();
+        let volume = manager.volume_path(&session.id);
+        assert!(volume.is_dir());
+
+        fs::create_dir_all(volume.join("data")).unwrap();
+        fs::write(volume.join("data/small.txt"), "hello").unwrap();
+        assert_eq!(manager.check_quota(&session.id).unwrap(), 5);
+
+        fs::write(volume.join("big.bin"), vec![0u8; 32]).unwrap();
+        assert!(matches!(
+            manager.check_quota(&session.id),
+            Err(SessionError::QuotaExceeded(_, 37, 16))
+        ));
+
+        assert!(manager.remove(&session.id));
+        assert!(!volume.exists());
+        assert!(manager.get(&session.id).is_none());
+        fs::remove_dir_all(&manager.root).ok();
+    }
+
+    fn kinds(events: &[ExecutionEvent]) -> Vec<(EventKind, String)> {
+        events
+            .iter()
+            .map(|event| (event.event, event.id.clone()))
+            .collect()
+    }
+
+    #[test]
+    fn test_reap_expired_removes_volumes() {
+        let manager = SessionManager {
+            grace_seconds: 10,
+            ..SessionManager::new(temp_root(), 60, 1024)
+        };
+        let session = manager.create("default", "python").unwrap();
+
+        assert!(manager.reap_expired(session.expires_at - 11).is_empty());
+        let warning = manager.reap_expired(session.expires_at - 10);
+        assert_eq!(
+            kinds(&warning),
+            vec![(EventKind::SessionExpiring, session.id.clone())]
+        );
+        let notice = warning[0].session.unwrap();
+        assert_eq!(notice.reason, CloseReason::Idle);
+        assert_eq!(notice.closes_at, session.expires_at);
+        // Warned once per expiry
+        assert!(manager.reap_expired(session.expires_at - 1).is_empty());
+
+        assert_eq!(
+            kinds(&manager.reap_expired(session.expires_at)),
+            vec![(EventKind::SessionClosed, session.id.clone())]
+        );
+        assert!(!manager.volume_path(&session.id).exists());
+        fs::remove_dir_all(&manager.root).ok();
+    }
+
+    #[test]
+    fn test_hard_lifetime_outlasts_use() {
+        let mut manager = SessionManager::new(temp_root(), 60, 1024);
+        manager.tenant_limits.insert(
+            "cs101".to_string(),
+            SessionLimits {
+                max_lifetime_seconds: Some(30),
+                ..Default::default()
+            },
+        );
+        let session = manager.create("cs101", "python").unwrap();
+        assert_eq!(session.expires_at, session.created_at + 30);
+
+        manager.touch(&session.id);
+        let events = manager.reap_expired(session.created_at + 30);
+        assert_eq!(events[0].event, EventKind::SessionClosed);
+        assert_eq!(events[0].session.unwrap().reason, CloseReason::Lifetime);
+        fs::remove_dir_all(&manager.root).ok();
+    }
+
+    #[test]
+    fn test_least_recently_used_session_is_evicted() {
+        let manager = SessionManager {
+            max_sessions: 2,
+            grace_seconds: 5,
+            ..SessionManager::new(temp_root(), 60, 1024)
+        };
+        let first = manager.create("cs101", "python").unwrap();
+        let second = manager.create("cs101", "python").unwrap();
+        manager.touch(&first.id);
+        let other = manager.create("cs102", "python").unwrap();
+
+        let third = manager.create("cs101", "python").unwrap();
+        let evicted = manager.get(&second.id).unwrap();
+        assert_eq!(evicted.expires_at, third.created_at + 5);
+        assert_eq!(
+            manager.get(&first.id).unwrap().expires_at,
+            first.created_at + 60
+        );
+
+        // The evicted session is told right away and closed after the grace period
+        let events = manager.reap_expired(third.created_at);
+        assert_eq!(
+            kinds(&events),
+            vec![(EventKind::SessionExpiring, second.id.clone())]
+        );
+        assert_eq!(events[0].session.unwrap().reason, CloseReason::Evicted);
+        manager.touch(&second.id);
+        assert_eq!(
+            kinds(&manager.reap_expired(evicted.expires_at)),
+            vec![(EventKind::SessionClosed, second.id.clone())]
+        );
+        assert!(manager.get(&first.id).is_some());
+        assert!(manager.get(&other.id).is_some());
+        fs::remove_dir_all(&manager.root).ok();
+    }
+
+    #[test]
+    fn test_remove_tenant_keeps_other_tenants() {
+        let manager = SessionManager::new(temp_root(), 60, 1024);
+        let own = manager.create("cs101", "python").unwrap();
+        let other = manager.create("cs102", "python").unwrap();
+
+        assert_eq!(manager.remove_tenant("cs101"), vec![own.id.clone()]);
+        assert!(!manager.volume_path(&own.id).exists());
+        assert!(manager.get(&other.id).is_some());
+        fs::remove_dir_all(&manager.root).ok();
+    }
+
+    #[test]
+    fn test_attached_clients_receive_output() {
+        let manager = SessionManager::new(temp_root(), 600, 1024);
+        let session = manager.create("student", "python").unwrap();
+        assert!(!session.can_attach("instructor"));
+
+        let shared = manager
+            .share(
+                &session.id,
+                vec!["instructor".to_string()],
+                WriteControl::Owner,
+            )
+            .unwrap();
+        assert!(shared.can_attach("instructor") && !shared.can_write("instructor"));
+        assert!(shared.can_write("student"));
+
+        let mut first = manager.attach(&session.id).unwrap();
+        let mut second = manager.attach(&session.id).unwrap();
+        assert_eq!(manager.usage(&session.id, 0).unwrap().attached, 2);
+        manager.publish(
+            &session.id,
+            SessionOutput::Started {
+                tenant: "student".to_string(),
+                code: Some("print(1)".to_string()),
+            },
+        );
+        for receiver in [&mut first, &mut second] {
+            assert!(receiver
+                .try_recv()
+                .unwrap()
+                .to_sse()
+                .starts_with("event: started\n"));
+        }
+
+        let terminal = Terminal {
+            rows: 24,
+            cols: 80,
+            echo: false,
+        };
+        manager
+            .set_terminal(&session.id, "student", terminal)
+            .unwrap();
+        assert!(first
+            .try_recv()
+            .unwrap()
+            .to_sse()
+            .starts_with("event: terminal\n"));
+        assert_eq!(manager.get(&session.id).unwrap().terminal, Some(terminal));
+
+        let shared = manager
+            .share(
+                &session.id,
+                vec!["instructor".to_string()],
+                WriteControl::Guests,
+            )
+            .unwrap();
+        assert!(shared.can_write("instructor") && !shared.can_write("someone"));
+
+        // Closing the session ends the attached streams
+        let id = session.id.clone();
+        drop((session, shared));
+        manager.remove(&id);
+        assert!(matches!(
+            first.try_recv(),
+            Err(broadcast::error::TryRecvError::Closed)
+        ));
+        fs::remove_dir_all(&manager.root).ok();
+    }
+
+    #[test]
+    fn test_list_and_terminate_by_filter() {
+        let manager = SessionManager::new(temp_root(), 600, 1024);
+        let old = manager.create("cs101", "python").unwrap();
+        let rust = manager.create("cs101", "rust").unwrap();
+        let other = manager.create("cs102", "python").unwrap();
+        fs::write(manager.volume_path(&old.id).join("notes.txt"), "hello").unwrap();
+        manager.touch(&rust.id);
+        let now = old.created_at + 120;
+
+        let usage = manager.usage(&old.id, now).unwrap();
+        assert_eq!((usage.age_seconds, usage.disk_bytes), (120, 5));
+        assert_eq!(manager.get(&rust.id).unwrap().executions, 1);
+
+        let python = SessionFilter {
+            language: Some("python".to_string()),
+            ..Default::default()
+        };
+        let listed: Vec<String> = manager
+            .list(&python, now)
+            .into_iter()
+            .map(|usage| usage.session.id)
+            .collect();
+        assert_eq!(listed.len(), 2);
+        assert!(listed.contains(&old.id) && listed.contains(&other.id));
+
+        let stale = SessionFilter {
+            tenant: Some("cs101".to_string()),
+            min_idle_seconds: Some(120),
+            ..Default::default()
+        };
+        // The rust session was used recently, so it isn't stale
+        manager
+            .sessions
+            .write()
+            .unwrap()
+            .get_mut(&rust.id)
+            .unwrap()
+            .last_used_at = now - 10;
+        assert_eq!(manager.remove_matching(&stale, now), vec![old.id.clone()]);
+        assert!(manager.get(&rust.id).is_some());
+        assert!(manager.get(&other.id).is_some());
+        fs::remove_dir_all(&manager.root).ok();
+    }
+
+    #[test]
+    fn test_fork_copies_snapshot() {
+        let root = temp_root();
+        let manager = SessionManager::new(root.clone(), 60, 1024);
+        let session = manager.create("cs101", "python").unwrap();
+        let volume = manager.volume_path(&session.id);
+        fs::create_dir_all(volume.join("data")).unwrap();
+        fs::write(volume.join("data/model.txt"), "prepared").unwrap();
+        std::os::unix::fs::symlink("data/model.txt", volume.join("link")).unwrap();
+
+        let snapshot = manager.snapshot_session(&session.id).unwrap();
+        assert_eq!(snapshot.size_bytes, disk_usage(&volume));
+        // Later changes to the session don't reach the snapshot
+        fs::write(volume.join("data/model.txt"), "changed").unwrap();
+
+        let fork = manager.fork("cs101", &snapshot.id).unwrap();
+        assert_eq!(fork.language, "python");
+        assert_eq!(fork.snapshot.as_deref(), Some(snapshot.id.as_str()));
+        let forked = manager.volume_path(&fork.id);
+        assert_eq!(
+            fs::read_to_string(forked.join("data/model.txt")).unwrap(),
+            "prepared"
+        );
+        assert_eq!(
+            fs::read_link(forked.join("link")).unwrap(),
+            Path::new("data/model.txt")
+        );
+        assert!(matches!(
+            manager.fork("cs102", &snapshot.id),
+            Err(SessionError::SnapshotNotFound(_))
+        ));
+
+        // Snapshots survive their session and a restart
+        manager.remove(&session.id);
+        let restarted = SessionManager::new(root.clone(), 60, 1024);
+        assert_eq!(restarted.snapshots("cs101").len(), 1);
+        assert!(restarted.fork("cs101", &snapshot.id).is_ok());
+
+        assert!(restarted.remove_snapshot(&snapshot.id));
+        assert!(restarted.snapshots("cs101").is_empty());
+        assert!(!restarted.snapshot_dir(&snapshot.id).exists());
+        fs::remove_dir_all(&root).ok();
+    }
+}
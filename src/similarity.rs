@@ -0,0 +1,220 @@
+use serde::Serialize;
+use std::collections::hash_map::DefaultHasher;
+use std::collections::HashSet;
+use std::hash::{Hash, Hasher};
+
+// Tokens per k-gram; shorter matches are ignored
+const K: usize = 5;
+// Consecutive k-grams winnowing picks a fingerprint from, so any match of at
+// least K + WINDOW - 1 tokens shares a fingerprint
+const WINDOW: usize = 4;
+
+// Words kept as they are; every other identifier becomes the same token, so
+// renaming variables doesn't hide a copy
+const KEYWORDS: &[&str] = &[
+    "and", "as", "break", "case", "catch", "class", "const", "continue", "def", "default", "do",
+    "elif", "else", "enum", "except", "false", "finally", "fn", "for", "func", "function", "if",
+    "import", "in", "is", "lambda", "let", "loop", "match", "new", "not", "or", "pass", "public",
+    "private", "return", "static", "struct", "switch", "throw", "true", "try", "var", "void",
+    "while", "with", "yield",
+];
+
+/// How much of two submissions' code matches
+#[derive(Debug, Clone, Serialize)]
+pub struct SimilarityPair {
+    pub a: String,
+    pub b: String,
+    /// Share of `a`'s fingerprints also found in `b`
+    pub a_matched: f64,
+    /// Share of `b`'s fingerprints also found in `a`
+    pub b_matched: f64,
+    /// The larger of the two, so copying a small program into a larger one scores
+    /// as high as copying it whole
+    pub score: f64,
+}
+
+/// Compares every pair of `(id, code)` submissions, most similar first
+pub fn compare(submissions: &[(String, String)]) -> Vec<SimilarityPair> {
+    let fingerprints: Vec<HashSet<u64>> = submissions
+        .iter()
+        .map(|(_, code)| fingerprint(code))
+        .collect();
+    let mut pairs = Vec::new();
+    for i in 0..submissions.len() {
+        for j in i + 1..submissions.len() {
+            let shared = fingerprints[i].intersection(&fingerprints[j]).count();
+            let a_matched = share(shared, fingerprints[i].len());
+            let b_matched = share(shared, fingerprints[j].len());
+            pairs.push(SimilarityPair {
+                a: submissions[i].0.clone(),
+                b: submissions[j].0.clone(),
+                a_matched,
+                b_matched,
+                score: a_matched.max(b_matched),
+            });
+        }
+    }
+    pairs.sort_by(|x, y| y.score.total_cmp(&x.score));
+    pairs
+}
+
+fn share(shared: usize, total: usize) -> f64 {
+    if total == 0 {
+        return 0.0;
+    }
+    shared as f64 / total as f64
+}
+
+/// Winnowed hashes of the code's token k-grams, as in MOSS. Comments, whitespace,
+/// identifier names and literal values don't affect them.
+pub fn fingerprint(code: &str) -> HashSet<u64> {
+    let tokens = tokenize(code);
+    if tokens.is_empty() {
+        return HashSet::new();
+    }
+    let hashes: Vec<u64> = tokens.windows(K.min(tokens.len())).map(hash).collect();
+    if hashes.len() <= WINDOW {
+        return hashes.into_iter().collect();
+    }
+    hashes
+        .windows(WINDOW)
+        .filter_map(|window| window.iter().min().copied())
+        .collect()
+}
+
+fn hash(tokens: &[String]) -> u64 {
+    let mut hasher = DefaultHasher::new();
+    tokens.hash(&mut hasher);
+    hasher.finish()
+}
+
+// Splits code into tokens, dropping comments and normalizing identifiers and
+// literals. It knows no language's grammar, just what most languages share.
+fn tokenize(code: &str) -> Vec<String> {
+    let mut tokens = Vec::new();
+    let mut chars = code.chars().peekable();
+    while let Some(c) = chars.next() {
+        match c {
+            c if c.is_whitespace() => {}
+            '#' => skip_line(&mut chars),
+            '/' if chars.peek() == Some(&'/') => skip_line(&mut chars),
+            '/' if chars.peek() == Some(&'*') => {
+                chars.next();
+                let mut previous = ' ';
+                for c in chars.by_ref() {
+                    if previous == '*' && c == '/' {
+                        break;
+                    }
+                    previous = c;
+                }
+            }
+            '"' | '\'' | '`' => {
+                let mut escaped = false;
+                for next in chars.by_ref() {
+                    if next == c && !escaped {
+                        break;
+                    }
+                    escaped = next == '\\' && !escaped;
+                }
+                tokens.push("\"".to_string());
+            }
+            c if c.is_alphabetic() || c == '_' => {
+                let mut word = c.to_string();
+                while let Some(&next) = chars.peek() {
+                    if !next.is_alphanumeric() && next != '_' {
+                        break;
+                    }
+                    word.push(next);
+                    chars.next();
+                }
+                if KEYWORDS.contains(&word.as_str()) {
+                    tokens.push(word);
+                } else {
+                    tokens.push("v".to_string());
+                }
+            }
+            c if c.is_ascii_digit() => {
+                while chars
+                    .peek()
+                    .is_some_and(|next| next.is_alphanumeric() || *next == '.' || *next == '_')
+                {
+                    chars.next();
+                }
+                tokens.push("0".to_string());
+            }
+            c => tokens.push(c.to_string()),
+        }
+    }
+    tokens
+}
+
+fn skip_line(chars: &mut std::iter::Peekable<std::str::Chars>) {
+    for c in chars.by_ref() {
+        if c == '\n' {
+            break;
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const ORIGINAL: &str = r#"
+def fibonacci(n):
+    # Iterative, to avoid recursion limits
+    a, b = 0, 1
+    for i in range(n):
+        a, b = b, a + b
+    return a
+
+for n in range(10):
+    print(fibonacci(n), "is next")
+"#;
+
+    const RENAMED: &str = r#"
+def fib(count):
+    x, y = 0, 1
+    for step in range(count):
+        x, y = y, x + y
+    return x
+
+for k in range(20): print(fib(k), 'follows')
+"#;
+
+    const DIFFERENT: &str = r#"
+import sys
+words = sys.stdin.read().split()
+counts = {}
+for word in words:
+    counts[word] = counts.get(word, 0) + 1
+print(max(counts, key=counts.get))
+"#;
+
+    #[test]
+    fn test_renamed_copies_match() {
+        let submissions = [
+            ("original".to_string(), ORIGINAL.to_string()),
+            ("renamed".to_string(), RENAMED.to_string()),
+            ("different".to_string(), DIFFERENT.to_string()),
+        ];
+        let pairs = compare(&submissions);
+        assert_eq!(pairs.len(), 3);
+        assert_eq!(
+            (pairs[0].a.as_str(), pairs[0].b.as_str()),
+            ("original", "renamed")
+        );
+        assert_eq!(pairs[0].score, 1.0);
+        assert!(pairs[1].score < 0.3 && pairs[2].score < 0.3);
+    }
+
+    #[test]
+    fn test_comments_and_literals_are_ignored() {
+        assert_eq!(
+            tokenize("x = 42 // answer\ny = \"a \\\" b\" /* note */"),
+            ["v", "=", "0", "v", "=", "\""]
+        );
+        assert!(fingerprint("").is_empty());
+        assert_eq!(fingerprint("return 1").len(), 1);
+    }
+}
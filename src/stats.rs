@@ -0,0 +1,179 @@
+use crate::store::unix_timestamp;
+use serde::{Deserialize, Serialize};
+use std::process::Command;
+
+/// Label carrying the execution id on every sandbox container, so a job's
+/// containers can be found while it runs
+pub const JOB_LABEL: &str = "isobox.job";
+
+/// Resource usage of a job's sandbox at one point in time
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct ResourceSample {
+    pub timestamp: u64,
+    /// Of one CPU, so a program using two cores fully is at 200
+    pub cpu_percent: f64,
+    pub memory_bytes: u64,
+    pub memory_limit_bytes: u64,
+    pub memory_percent: f64,
+    pub pids: u64,
+}
+
+// A line of `docker stats --format '{{json .}}'`
+#[derive(Deserialize)]
+#[serde(rename_all = "PascalCase")]
+struct DockerStats {
+    #[serde(rename = "CPUPerc")]
+    cpu_perc: String,
+    mem_usage: String,
+    #[serde(rename = "PIDs")]
+    pids: String,
+}
+
+/// Samples the containers of a running job. Returns None when the job has no
+/// container on this host, e.g. between its compile and run steps, or because it
+/// runs elsewhere.
+pub fn sample(job_id: &str) -> Result<Option<ResourceSample>, String> {
+    let containers = job_containers(job_id)?;
+    if containers.is_empty() {
+        return Ok(None);
+    }
+    let mut args = vec!["stats", "--no-stream", "--format", "{{json .}}"];
+    args.extend(containers.iter().map(String::as_str));
+    // A container that exited since it was listed is not an error worth reporting
+    let Ok(output) = docker(&args) else {
+        return Ok(None);
+    };
+    parse_stats(&output).map(Some)
+}
+
+/// Ids of the running containers of a job, oldest first
+pub fn job_containers(job_id: &str) -> Result<Vec<String>, String> {
+    let ps = docker(&[
+        "ps",
+        "--quiet",
+        "--filter",
+        &format!("label={JOB_LABEL}={job_id}"),
+    ])?;
+    // `docker ps` lists the newest container first
+    Ok(ps.split_whitespace().rev().map(str::to_string).collect())
+}
+
+/// Kills the running containers of a job, e.g. after it timed out
+pub fn kill_job_containers(job_id: &str) -> Result<(), String> {
+    let containers = job_containers(job_id)?;
+    if containers.is_empty() {
+        return Ok(());
+    }
+    let mut args = vec!["kill"];
+    args.extend(containers.iter().map(String::as_str));
+    docker(&args).map(|_| ())
+}
+
+fn docker(args: &[&str]) -> Result<String, String> {
+    let output = Command::new("docker")
+        .args(args)
+        .output()
+        .map_err(|e| format!("Failed to run docker: {e}"))?;
+    if !output.status.success() {
+        return Err(String::from_utf8_lossy(&output.stderr).trim().to_string());
+    }
+    Ok(String::from_utf8_lossy(&output.stdout).into_owned())
+}
+
+// Adds up the lines of `docker stats`, one per container
+fn parse_stats(output: &str) -> Result<ResourceSample, String> {
+    let mut sample = ResourceSample {
+        timestamp: unix_timestamp(),
+        cpu_percent: 0.0,
+        memory_bytes: 0,
+        memory_limit_bytes: 0,
+        memory_percent: 0.0,
+        pids: 0,
+    };
+    for line in output.lines().filter(|line| !line.trim().is_empty()) {
+        let stats: DockerStats =
+            serde_json::from_str(line).map_err(|e| format!("Invalid docker stats: {e}"))?;
+        let (usage, limit) = stats
+            .mem_usage
+            .split_once(" / ")
+            .ok_or_else(|| format!("Invalid memory usage '{}'", stats.mem_usage))?;
+        sample.cpu_percent += parse_percent(&stats.cpu_perc)?;
+        sample.memory_bytes += parse_size(usage)?;
+        sample.memory_limit_bytes += parse_size(limit)?;
+        // Docker shows "--" for a container that is going away
+        sample.pids += stats.pids.trim().parse::<u64>().unwrap_or(0);
+    }
+    if sample.memory_limit_bytes > 0 {
+        sample.memory_percent =
+            sample.memory_bytes as f64 * 100.0 / sample.memory_limit_bytes as f64;
+    }
+    Ok(sample)
+}
+
+fn parse_percent(value: &str) -> Result<f64, String> {
+    let value = value.trim();
+    if value == "--" {
+        return Ok(0.0);
+    }
+    value
+        .trim_end_matches('%')
+        .parse()
+        .map_err(|_| format!("Invalid percentage '{value}'"))
+}
+
+// Parses sizes as docker prints them, e.g. "12.5MiB" or "1.2GB"
+fn parse_size(value: &str) -> Result<u64, String> {
+    let value = value.trim();
+    let split = value
+        .find(|c: char| c.is_ascii_alphabetic())
+        .unwrap_or(value.len());
+    let (number, unit) = value.split_at(split);
+    let number: f64 = number
+        .trim()
+        .parse()
+        .map_err(|_| format!("Invalid size '{value}'"))?;
+    let multiplier: f64 = match unit {
+        "" | "B" => 1.0,
+        "KiB" => 1024.0,
+        "MiB" => 1024.0 * 1024.0,
+        "GiB" => 1024.0 * 1024.0 * 1024.0,
+        "TiB" => 1024.0 * 1024.0 * 1024.0 * 1024.0,
+        "kB" | "KB" => 1e3,
+        "MB" => 1e6,
+        "GB" => 1e9,
+        "TB" => 1e12,
+        _ => return Err(format!("Invalid size '{value}'")),
+    };
+    Ok((number * multiplier).round() as u64)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_stats() {
+        let output = concat!(
+            r#"{"BlockIO":"0B / 0B","CPUPerc":"97.52%","Container":"3f2a","MemPerc":"39.06%","MemUsage":"50MiB / 128MiB","Name":"x","NetIO":"0B / 0B","PIDs":"3"}"#,
+            "\n",
+            r#"{"CPUPerc":"--","MemUsage":"0B / 0B","PIDs":"--"}"#,
+            "\n"
+        );
+        let sample = parse_stats(output).unwrap();
+        assert_eq!(sample.cpu_percent, 97.52);
+        assert_eq!(sample.memory_bytes, 50 * 1024 * 1024);
+        assert_eq!(sample.memory_limit_bytes, 128 * 1024 * 1024);
+        assert!((sample.memory_percent - 39.0625).abs() < 1e-9);
+        assert_eq!(sample.pids, 3);
+
+        assert!(parse_stats("not json").is_err());
+    }
+
+    #[test]
+    fn test_parse_size() {
+        assert_eq!(parse_size("0B"), Ok(0));
+        assert_eq!(parse_size("1.5KiB"), Ok(1536));
+        assert_eq!(parse_size("2GB"), Ok(2_000_000_000));
+        assert!(parse_size("12 parsecs").is_err());
+    }
+}
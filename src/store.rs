@@ -0,0 +1,1078 @@
+use crate::config::{data_dir, Channel};
+use crate::crypto::{CryptoError, Encryptor, SealedData};
+use crate::trace_context::TraceContext;
+use flate2::write::GzEncoder;
+use flate2::Compression;
+use serde::{Deserialize, Serialize};
+use std::collections::{HashMap, HashSet};
+use std::fs;
+use std::io;
+use std::path::{Component, Path, PathBuf};
+use std::sync::RwLock;
+use std::time::{SystemTime, UNIX_EPOCH};
+
+/// A file produced by an execution and kept after the sandbox is torn down
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct ArtifactInfo {
+    pub path: String,
+    pub size: u64,
+}
+
+/// What a test case gave the program on stdin
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct RecordedInput {
+    pub test_case: String,
+    pub input: String,
+}
+
+/// Tarball of the whole sandbox workdir as it was when the program finished
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct ArchiveInfo {
+    pub size: u64,
+    // Set when files were left out because the archive reached its size cap
+    pub truncated: bool,
+}
+
+// Kept next to the execution's directory rather than in it, where the program's
+// artifacts could have the same name
+const ARCHIVE_SUFFIX: &str = ".archive.tar.gz";
+const RECORD_SUFFIX: &str = ".record.json";
+// Where records were written inside the execution's directory before, moved out on
+// startup
+const LEGACY_RECORD_FILE_NAME: &str = "record.json";
+
+#[derive(Debug, Clone, Copy, PartialEq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum ExecutionStatus {
+    Succeeded,
+    // Exited non-zero or failed a test case
+    Failed,
+}
+
+/// Metadata kept for every completed execution
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct ExecutionRecord {
+    pub id: String,
+    pub tenant: String,
+    pub language: String,
+    pub exit_code: i32,
+    pub status: ExecutionStatus,
+    #[serde(default)]
+    pub labels: Vec<String>,
+    pub created_at: u64,
+    pub artifacts: Vec<ArtifactInfo>,
+    pub archive: Option<ArchiveInfo>,
+    // Runtime channel, for languages with a next channel
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub channel: Option<Channel>,
+    // Linux capabilities the sandbox was granted, empty when it ran with none
+    #[serde(default)]
+    pub capabilities: Vec<String>,
+    // W3C Trace Context of the request the execution was made for
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub trace_context: Option<TraceContext>,
+    // Contents below are left out of history listings to keep pages small
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub code: Option<String>,
+    // Inputs of the test cases, except hidden and uploaded ones
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub stdin: Option<Vec<RecordedInput>>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub stdout: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub stderr: Option<String>,
+}
+
+// The parts of a record that are encrypted when it is written to disk
+#[derive(Serialize, Deserialize)]
+struct RecordContents {
+    code: Option<String>,
+    #[serde(default)]
+    stdin: Option<Vec<RecordedInput>>,
+    stdout: Option<String>,
+    stderr: Option<String>,
+}
+
+// On-disk form of a record. With encryption, the contents live only in `sealed`.
+#[derive(Serialize, Deserialize)]
+struct StoredRecord {
+    #[serde(flatten)]
+    record: ExecutionRecord,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    sealed: Option<SealedData>,
+    // Whether the artifacts and archive are sealed too. Records written before
+    // encryption covered them have plaintext files, which are sealed on startup.
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    files_sealed: bool,
+}
+
+/// History filters; unset fields match every execution
+#[derive(Debug, Default, Deserialize)]
+pub struct ExecutionFilter {
+    pub tenant: Option<String>,
+    pub language: Option<String>,
+    pub status: Option<ExecutionStatus>,
+    pub label: Option<String>,
+    pub channel: Option<Channel>,
+    // Unix seconds, inclusive
+    pub since: Option<u64>,
+    // Unix seconds, exclusive
+    pub until: Option<u64>,
+    // Case-insensitive substring of the source code
+    pub q: Option<String>,
+    pub trace_id: Option<String>,
+}
+
+impl ExecutionFilter {
+    fn matches(&self, record: &ExecutionRecord) -> bool {
+        self.tenant.as_ref().map_or(true, |t| &record.tenant == t)
+            && self
+                .language
+                .as_ref()
+                .map_or(true, |l| &record.language == l)
+            && self.status.map_or(true, |s| record.status == s)
+            && self
+                .label
+                .as_ref()
+                .map_or(true, |label| record.labels.contains(label))
+            && self
+                .channel
+                .map_or(true, |channel| record.channel == Some(channel))
+            && self.since.map_or(true, |since| record.created_at >= since)
+            && self.until.map_or(true, |until| record.created_at < until)
+            && self.trace_id.as_ref().map_or(true, |trace_id| {
+                record
+                    .trace_context
+                    .as_ref()
+                    .is_some_and(|context| context.trace_id() == trace_id)
+            })
+            && self.q.as_ref().map_or(true, |q| {
+                record
+                    .code
+                    .as_ref()
+                    .is_some_and(|code| code.to_lowercase().contains(&q.to_lowercase()))
+            })
+    }
+}
+
+/// One page of history, newest first
+#[derive(Debug, Serialize)]
+pub struct ExecutionPage {
+    pub executions: Vec<ExecutionRecord>,
+    // Pass back as `cursor` to fetch the next page; absent on the last page
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub next_cursor: Option<String>,
+}
+
+/// Stores execution records in memory and their artifacts on disk
+pub struct ExecutionStore {
+    root: PathBuf,
+    max_artifact_bytes: u64,
+    max_archive_bytes: u64,
+    // How long executions are kept by default; None keeps them until purged
+    retention_seconds: Option<u64>,
+    // Whether records are written next to their artifacts and reloaded on startup
+    persist: bool,
+    encryptor: Option<Encryptor>,
+    records: RwLock<HashMap<String, ExecutionRecord>>,
+}
+
+impl ExecutionStore {
+    pub fn new(root: PathBuf, max_artifact_bytes: u64, max_archive_bytes: u64) -> Self {
+        Self {
+            root,
+            max_artifact_bytes,
+            max_archive_bytes,
+            retention_seconds: None,
+            persist: false,
+            encryptor: None,
+            records: RwLock::new(HashMap::new()),
+        }
+    }
+
+    /// `from_env`, plus persistence when `EXECUTION_PERSISTENCE` is true, encrypted
+    /// with the key configured by `ENCRYPTION_KMS_KEY_ID` or `ENCRYPTION_KEYS`
+    pub fn open_from_env() -> Result<Self, CryptoError> {
+        let store = Self::from_env();
+        let persist = std::env::var("EXECUTION_PERSISTENCE")
+            .unwrap_or_else(|_| "false".to_string())
+            .parse::<bool>()
+            .unwrap_or(false);
+        if !persist {
+            return Ok(store);
+        }
+        let encryptor = Encryptor::from_env()?;
+        if encryptor.is_none() {
+            log::warn!("Execution persistence is enabled without encryption; code and output are stored in plaintext");
+        }
+        Ok(store.persistent(encryptor))
+    }
+
+    /// Writes every record to disk from now on and loads the ones already there.
+    /// Records sealed under a rotated-out key, or stored before encryption was
+    /// enabled, are rewritten under the active key, and their files are sealed if
+    /// they were stored in plaintext.
+    pub fn persistent(mut self, encryptor: Option<Encryptor>) -> Self {
+        self.persist = true;
+        self.encryptor = encryptor;
+
+        let mut loaded = 0;
+        for entry in fs::read_dir(&self.root).into_iter().flatten().flatten() {
+            let path = entry.path();
+            let name = entry.file_name().to_string_lossy().into_owned();
+            let legacy = path.join(LEGACY_RECORD_FILE_NAME);
+            let (path, moved) = if name.ends_with(RECORD_SUFFIX) && path.is_file() {
+                (path, false)
+            } else if legacy.is_file() && !self.record_file(&name).exists() {
+                (legacy, true)
+            } else {
+                continue;
+            };
+            match self.read_record(&path) {
+                Ok((record, current, files_sealed)) => {
+                    if self.encryptor.is_some() && !files_sealed {
+                        self.seal_files(&record);
+                    }
+                    if !current || moved {
+                        self.write_record(&record);
+                    }
+                    if moved && self.record_file(&record.id).is_file() {
+                        fs::remove_file(&path).ok();
+                    }
+                    self.records
+                        .write()
+                        .unwrap()
+                        .insert(record.id.clone(), record);
+                    loaded += 1;
+                }
+                Err(e) => log::warn!("Skipping stored execution {}: {e}", path.display()),
+            }
+        }
+        log::info!("Loaded {loaded} stored executions");
+        self
+    }
+
+    // Returns the record, whether it is stored the way it would be written now, and
+    // whether its files are sealed
+    fn read_record(&self, path: &Path) -> Result<(ExecutionRecord, bool, bool), String> {
+        let contents = fs::read(path).map_err(|e| e.to_string())?;
+        let StoredRecord {
+            mut record,
+            sealed,
+            files_sealed,
+        } = serde_json::from_slice(&contents).map_err(|e| e.to_string())?;
+        let Some(sealed) = sealed else {
+            return Ok((record, self.encryptor.is_none(), files_sealed));
+        };
+        let encryptor = self
+            .encryptor
+            .as_ref()
+            .ok_or("record is encrypted but no encryption key is configured")?;
+        let plaintext = encryptor
+            .decrypt(&sealed, &record.id)
+            .map_err(|e| e.to_string())?;
+        let contents: RecordContents =
+            serde_json::from_slice(&plaintext).map_err(|e| e.to_string())?;
+        record.code = contents.code;
+        record.stdin = contents.stdin;
+        record.stdout = contents.stdout;
+        record.stderr = contents.stderr;
+        let current = encryptor.is_current(&sealed) && files_sealed;
+        Ok((record, current, files_sealed))
+    }
+
+    fn write_record(&self, record: &ExecutionRecord) {
+        let stored = match &self.encryptor {
+            None => StoredRecord {
+                record: record.clone(),
+                sealed: None,
+                files_sealed: false,
+            },
+            Some(encryptor) => {
+                let contents = RecordContents {
+                    code: record.code.clone(),
+                    stdin: record.stdin.clone(),
+                    stdout: record.stdout.clone(),
+                    stderr: record.stderr.clone(),
+                };
+                let sealed = serde_json::to_vec(&contents)
+                    .map_err(|e| e.to_string())
+                    .and_then(|json| {
+                        encryptor
+                            .encrypt(&json, &record.id)
+                            .map_err(|e| e.to_string())
+                    });
+                match sealed {
+                    Ok(sealed) => StoredRecord {
+                        record: ExecutionRecord {
+                            code: None,
+                            stdin: None,
+                            stdout: None,
+                            stderr: None,
+                            ..record.clone()
+                        },
+                        sealed: Some(sealed),
+                        files_sealed: true,
+                    },
+                    // Never fall back to writing the contents in plaintext
+                    Err(e) => {
+                        log::error!("Failed to encrypt execution {}: {e}", record.id);
+                        return;
+                    }
+                }
+            }
+        };
+
+        let result = fs::create_dir_all(&self.root).and_then(|_| {
+            let json = serde_json::to_vec(&stored)?;
+            fs::write(self.record_file(&record.id), json)
+        });
+        if let Err(e) = result {
+            log::warn!("Failed to persist execution {}: {e}", record.id);
+        }
+    }
+
+    pub fn from_env() -> Self {
+        let root = std::env::var("ARTIFACTS_DIR")
+            .map(PathBuf::from)
+            .unwrap_or_else(|_| data_dir().join("artifacts"));
+        let max_artifact_bytes = std::env::var("ARTIFACTS_MAX_BYTES")
+            .ok()
+            .and_then(|s| s.parse::<u64>().ok())
+            .unwrap_or(50 * 1024 * 1024);
+        let max_archive_bytes = std::env::var("ARCHIVE_MAX_BYTES")
+            .ok()
+            .and_then(|s| s.parse::<u64>().ok())
+            .unwrap_or(100 * 1024 * 1024);
+        // 0 keeps executions until they are purged explicitly
+        let retention_seconds = std::env::var("EXECUTION_RETENTION_SECONDS")
+            .ok()
+            .and_then(|s| s.parse::<u64>().ok())
+            .unwrap_or(7 * 24 * 60 * 60);
+        Self {
+            retention_seconds: (retention_seconds > 0).then_some(retention_seconds),
+            ..Self::new(root, max_artifact_bytes, max_archive_bytes)
+        }
+    }
+
+    pub fn retention_seconds(&self) -> Option<u64> {
+        self.retention_seconds
+    }
+
+    /// Copies files the program created in its workspace into the artifact store.
+    /// Input files (`inputs`, workspace-relative) are skipped, and files stop being
+    /// captured once the per-execution size cap is reached.
+    pub fn capture_artifacts(
+        &self,
+        id: &str,
+        workspace: &Path,
+        inputs: &HashSet<String>,
+    ) -> Vec<ArtifactInfo> {
+        let mut artifacts = Vec::new();
+        let mut total: u64 = 0;
+
+        for file in collect_files(workspace) {
+            let Ok(relative) = file.strip_prefix(workspace) else {
+                continue;
+            };
+            let relative = relative.to_string_lossy().into_owned();
+            if inputs.contains(&relative) {
+                continue;
+            }
+
+            let size = fs::metadata(&file).map(|m| m.len()).unwrap_or(0);
+            if total + size > self.max_artifact_bytes {
+                log::warn!("Artifact size cap reached for execution {id}, skipping {relative}");
+                continue;
+            }
+
+            let destination = self.root.join(id).join(&relative);
+            if let Some(parent) = destination.parent() {
+                if let Err(e) = fs::create_dir_all(parent) {
+                    log::warn!("Failed to create artifact directory: {e}");
+                    continue;
+                }
+            }
+            if let Err(e) = fs::copy(&file, &destination) {
+                log::warn!("Failed to store artifact {relative}: {e}");
+                continue;
+            }
+            if let Err(e) = self.seal_file(&destination) {
+                log::error!("Failed to encrypt artifact {relative} of execution {id}: {e}");
+                continue;
+            }
+
+            total += size;
+            artifacts.push(ArtifactInfo {
+                path: relative,
+                size,
+            });
+        }
+
+        artifacts.sort_by(|a, b| a.path.cmp(&b.path));
+        artifacts
+    }
+
+    /// Packs the whole workspace into a gzipped tarball. Files that would push the
+    /// uncompressed total past the archive cap are left out and the archive is marked truncated.
+    pub fn capture_archive(&self, id: &str, workspace: &Path) -> Option<ArchiveInfo> {
+        let destination = self.archive_file(id);
+        match self.write_archive(workspace, &destination) {
+            Ok(truncated) => {
+                let size = fs::metadata(&destination).map(|m| m.len()).unwrap_or(0);
+                if let Err(e) = self.seal_file(&destination) {
+                    log::error!("Failed to encrypt the archive of execution {id}: {e}");
+                    return None;
+                }
+                Some(ArchiveInfo { size, truncated })
+            }
+            Err(e) => {
+                log::warn!("Failed to archive workdir for execution {id}: {e}");
+                None
+            }
+        }
+    }
+
+    fn write_archive(&self, workspace: &Path, destination: &Path) -> io::Result<bool> {
+        if let Some(parent) = destination.parent() {
+            fs::create_dir_all(parent)?;
+        }
+        let encoder = GzEncoder::new(fs::File::create(destination)?, Compression::default());
+        let mut builder = tar::Builder::new(encoder);
+        let mut total: u64 = 0;
+        let mut truncated = false;
+
+        for file in collect_files(workspace) {
+            let Ok(relative) = file.strip_prefix(workspace) else {
+                continue;
+            };
+            let size = fs::metadata(&file)?.len();
+            if total + size > self.max_archive_bytes {
+                truncated = true;
+                continue;
+            }
+            builder.append_path_with_name(&file, relative)?;
+            total += size;
+        }
+
+        builder.into_inner()?.finish()?;
+        Ok(truncated)
+    }
+
+    pub fn archive_path(&self, id: &str) -> Option<PathBuf> {
+        self.get(id)?.archive?;
+        let full_path = self.archive_file(id);
+        full_path.is_file().then_some(full_path)
+    }
+
+    fn archive_file(&self, id: &str) -> PathBuf {
+        self.root.join(format!("{id}{ARCHIVE_SUFFIX}"))
+    }
+
+    fn record_file(&self, id: &str) -> PathBuf {
+        self.root.join(format!("{id}{RECORD_SUFFIX}"))
+    }
+
+    // Replaces a stored file with its contents sealed under the record's key, bound
+    // to its path in the store. Does nothing without encryption. A file that can't
+    // be sealed is removed rather than left in plaintext.
+    fn seal_file(&self, path: &Path) -> Result<(), String> {
+        let Some(encryptor) = &self.encryptor else {
+            return Ok(());
+        };
+        let sealed = fs::read(path)
+            .map_err(|e| e.to_string())
+            .and_then(|contents| {
+                encryptor
+                    .encrypt(&contents, &self.file_context(path))
+                    .map_err(|e| e.to_string())
+            })
+            .and_then(|sealed| serde_json::to_vec(&sealed).map_err(|e| e.to_string()))
+            .and_then(|json| fs::write(path, json).map_err(|e| e.to_string()));
+        if sealed.is_err() {
+            fs::remove_file(path).ok();
+        }
+        sealed
+    }
+
+    // Seals the files of a record stored before they were encrypted
+    fn seal_files(&self, record: &ExecutionRecord) {
+        let artifacts = record
+            .artifacts
+            .iter()
+            .filter(|artifact| is_safe_relative(&artifact.path))
+            .map(|artifact| self.root.join(&record.id).join(&artifact.path));
+        let archive = record
+            .archive
+            .as_ref()
+            .map(|_| self.archive_file(&record.id));
+        for path in artifacts.chain(archive).filter(|path| path.is_file()) {
+            if let Err(e) = self.seal_file(&path) {
+                log::error!("Failed to encrypt {}: {e}", path.display());
+            }
+        }
+    }
+
+    /// Decrypted contents of a stored artifact or archive. None when files are kept
+    /// in plaintext and can be served from disk as they are.
+    pub fn unseal(&self, path: &Path) -> Option<Result<Vec<u8>, String>> {
+        let encryptor = self.encryptor.as_ref()?;
+        Some(
+            fs::read(path)
+                .map_err(|e| e.to_string())
+                .and_then(|json| {
+                    serde_json::from_slice::<SealedData>(&json).map_err(|e| e.to_string())
+                })
+                .and_then(|sealed| {
+                    encryptor
+                        .decrypt(&sealed, &self.file_context(path))
+                        .map_err(|e| e.to_string())
+                }),
+        )
+    }
+
+    // What a file's seal is bound to: its path in the store, so sealed files can't be
+    // swapped between executions
+    fn file_context(&self, path: &Path) -> String {
+        path.strip_prefix(&self.root)
+            .unwrap_or(path)
+            .to_string_lossy()
+            .into_owned()
+    }
+
+    pub fn insert(&self, record: ExecutionRecord) {
+        if self.persist {
+            self.write_record(&record);
+        }
+        self.records
+            .write()
+            .unwrap()
+            .insert(record.id.clone(), record);
+    }
+
+    pub fn get(&self, id: &str) -> Option<ExecutionRecord> {
+        self.records.read().unwrap().get(id).cloned()
+    }
+
+    /// Lists matching executions newest first. The cursor is the position of the
+    /// last execution on the previous page, so inserts don't shift later pages.
+    pub fn list(
+        &self,
+        filter: &ExecutionFilter,
+        cursor: Option<&str>,
+        limit: usize,
+    ) -> Result<ExecutionPage, String> {
+        let limit = limit.max(1);
+        let after = cursor.map(parse_cursor).transpose()?;
+        let records = self.records.read().unwrap();
+        let mut matching: Vec<&ExecutionRecord> = records
+            .values()
+            .filter(|record| {
+                after.as_ref().map_or(true, |(created_at, id)| {
+                    (record.created_at, &record.id) < (*created_at, id)
+                })
+            })
+            .filter(|record| filter.matches(record))
+            .collect();
+        matching.sort_by(|a, b| (b.created_at, &b.id).cmp(&(a.created_at, &a.id)));
+
+        let next_cursor = (matching.len() > limit).then(|| {
+            format!(
+                "{}.{}",
+                matching[limit - 1].created_at,
+                matching[limit - 1].id
+            )
+        });
+        let executions = matching
+            .into_iter()
+            .take(limit)
+            .map(|record| ExecutionRecord {
+                code: None,
+                stdin: None,
+                stdout: None,
+                stderr: None,
+                ..record.clone()
+            })
+            .collect();
+        Ok(ExecutionPage {
+            executions,
+            next_cursor,
+        })
+    }
+
+    /// Deletes an execution's record, artifacts, and archive
+    pub fn remove(&self, id: &str) -> bool {
+        let removed = self.records.write().unwrap().remove(id).is_some();
+        if removed {
+            let dir = self.root.join(id);
+            if dir.exists() {
+                if let Err(e) = fs::remove_dir_all(&dir) {
+                    log::warn!("Failed to remove artifacts of execution {id}: {e}");
+                }
+            }
+            let archive = self.archive_file(id);
+            if archive.exists() {
+                if let Err(e) = fs::remove_file(&archive) {
+                    log::warn!("Failed to remove archive of execution {id}: {e}");
+                }
+            }
+            let record = self.record_file(id);
+            if record.exists() {
+                if let Err(e) = fs::remove_file(&record) {
+                    log::warn!("Failed to remove record of execution {id}: {e}");
+                }
+            }
+        }
+        removed
+    }
+
+    /// Deletes every matching execution and returns their ids
+    pub fn purge(&self, filter: &ExecutionFilter) -> Vec<String> {
+        let ids: Vec<String> = self
+            .records
+            .read()
+            .unwrap()
+            .values()
+            .filter(|record| filter.matches(record))
+            .map(|record| record.id.clone())
+            .collect();
+        ids.into_iter().filter(|id| self.remove(id)).collect()
+    }
+
+    /// Deletes executions older than their tenant's retention, as returned by
+    /// `retention` in seconds (None keeps the tenant's executions)
+    pub fn purge_expired(&self, now: u64, retention: impl Fn(&str) -> Option<u64>) -> Vec<String> {
+        let expired: Vec<String> = self
+            .records
+            .read()
+            .unwrap()
+            .values()
+            .filter(|record| {
+                retention(&record.tenant)
+                    .is_some_and(|ttl| record.created_at.saturating_add(ttl) <= now)
+            })
+            .map(|record| record.id.clone())
+            .collect();
+        let removed: Vec<String> = expired.into_iter().filter(|id| self.remove(id)).collect();
+        if !removed.is_empty() {
+            log::info!("Purged {} expired executions", removed.len());
+        }
+        removed
+    }
+
+    /// Resolves a stored artifact on disk, refusing paths that escape the execution's directory
+    pub fn artifact_path(&self, id: &str, path: &str) -> Option<PathBuf> {
+        let record = self.get(id)?;
+        if !record.artifacts.iter().any(|a| a.path == path) || !is_safe_relative(path) {
+            return None;
+        }
+        let full_path = self.root.join(id).join(path);
+        full_path.is_file().then_some(full_path)
+    }
+}
+
+fn parse_cursor(cursor: &str) -> Result<(u64, String), String> {
+    cursor
+        .split_once('.')
+        .and_then(|(created_at, id)| Some((created_at.parse().ok()?, id.to_string())))
+        .ok_or_else(|| format!("Invalid cursor '{cursor}'"))
+}
+
+pub fn unix_timestamp() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|d| d.as_secs())
+        .unwrap_or(0)
+}
+
+fn is_safe_relative(path: &str) -> bool {
+    let components: Vec<Component> = Path::new(path).components().collect();
+    !components.is_empty() && components.iter().all(|c| matches!(c, Component::Normal(_)))
+}
+
+fn collect_files(dir: &Path) -> Vec<PathBuf> {
+    let mut files = Vec::new();
+    let Ok(entries) = fs::read_dir(dir) else {
+        return files;
+    };
+    for entry in entries.flatten() {
+        let path = entry.path();
+        match entry.file_type() {
+            Ok(file_type) if file_type.is_dir() => files.extend(collect_files(&path)),
+            Ok(file_type) if file_type.is_file() => files.push(path),
+            _ => {}
+        }
+    }
+    files
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn temp_path(name: &str) -> PathBuf {
+        std::env::temp_dir().join(format!("isobox-store-test-{name}-{}", uuid::Uuid::new_v4()))
+    }
+
+    #[test]
+    fn test_capture_skips_inputs_and_respects_cap() {
+        let workspace = temp_path("workspace");
+        fs::create_dir_all(workspace.join("out")).unwrap();
+        fs::write(workspace.join("main.py"), "print('hi')").unwrap();
+        fs::write(workspace.join("out/plot.png"), vec![0u8; 10]).unwrap();
+        fs::write(workspace.join("big.bin"), vec![0u8; 100]).unwrap();
+
+        let store = ExecutionStore::new(temp_path("root"), 50, 50);
+        let inputs = HashSet::from(["main.py".to_string()]);
+        let artifacts = store.capture_artifacts("exec-1", &workspace, &inputs);
+
+        assert_eq!(artifacts.len(), 1);
+        assert_eq!(artifacts[0].path, "out/plot.png");
+        assert_eq!(artifacts[0].size, 10);
+
+        store.insert(ExecutionRecord {
+            id: "exec-1".to_string(),
+            tenant: "default".to_string(),
+            language: "python".to_string(),
+            exit_code: 0,
+            status: ExecutionStatus::Succeeded,
+            labels: Vec::new(),
+            created_at: unix_timestamp(),
+            artifacts,
+            archive: None,
+            channel: None,
+            capabilities: Vec::new(),
+            trace_context: None,
+            code: None,
+            stdin: None,
+            stdout: None,
+            stderr: None,
+        });
+        assert!(store.artifact_path("exec-1", "out/plot.png").is_some());
+        assert!(store.artifact_path("exec-1", "main.py").is_none());
+        assert!(store
+            .artifact_path("exec-1", "../exec-2/out/plot.png")
+            .is_none());
+        assert!(store.artifact_path("missing", "out/plot.png").is_none());
+
+        assert!(store.remove("exec-1"));
+        assert!(!store.root.join("exec-1").exists());
+        assert!(!store.remove("exec-1"));
+
+        fs::remove_dir_all(&workspace).ok();
+        fs::remove_dir_all(&store.root).ok();
+    }
+
+    #[test]
+    fn test_list_filters_and_paginates() {
+        let store = ExecutionStore::new(temp_path("history"), 0, 0);
+        for (i, (tenant, language, exit_code)) in [
+            ("cs101", "python", 0),
+            ("cs101", "python", 1),
+            ("cs101", "rust", 0),
+            ("cs102", "python", 0),
+            ("cs101", "python", 0),
+        ]
+        .into_iter()
+        .enumerate()
+        {
+            store.insert(ExecutionRecord {
+                id: format!("exec-{i}"),
+                tenant: tenant.to_string(),
+                language: language.to_string(),
+                exit_code,
+                status: if exit_code == 0 {
+                    ExecutionStatus::Succeeded
+                } else {
+                    ExecutionStatus::Failed
+                },
+                labels: vec![format!("week-{}", i % 2)],
+                // exec-3 and exec-4 share a timestamp, so the id breaks the tie
+                created_at: 100 + i.min(3) as u64,
+                artifacts: Vec::new(),
+                archive: None,
+                channel: None,
+                capabilities: Vec::new(),
+                trace_context: (i == 2).then(|| TraceContext {
+                    traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+                        .to_string(),
+                    tracestate: None,
+                }),
+                code: Some(format!("print({i}) # Homework")),
+                stdin: None,
+                stdout: None,
+                stderr: None,
+            });
+        }
+        let ids = |page: &ExecutionPage| -> Vec<String> {
+            page.executions.iter().map(|e| e.id.clone()).collect()
+        };
+
+        let filter = ExecutionFilter {
+            tenant: Some("cs101".to_string()),
+            language: Some("python".to_string()),
+            ..Default::default()
+        };
+        let first = store.list(&filter, None, 2).unwrap();
+        assert_eq!(ids(&first), ["exec-4", "exec-1"]);
+        assert!(first.executions[0].code.is_none());
+        let second = store
+            .list(&filter, first.next_cursor.as_deref(), 2)
+            .unwrap();
+        assert_eq!(ids(&second), ["exec-0"]);
+        assert!(second.next_cursor.is_none());
+
+        let failed = ExecutionFilter {
+            status: Some(ExecutionStatus::Failed),
+            ..Default::default()
+        };
+        assert_eq!(ids(&store.list(&failed, None, 10).unwrap()), ["exec-1"]);
+
+        let labelled = ExecutionFilter {
+            label: Some("week-0".to_string()),
+            since: Some(101),
+            until: Some(103),
+            ..Default::default()
+        };
+        assert_eq!(ids(&store.list(&labelled, None, 10).unwrap()), ["exec-2"]);
+
+        let search = ExecutionFilter {
+            q: Some("PRINT(3)".to_string()),
+            ..Default::default()
+        };
+        assert_eq!(ids(&store.list(&search, None, 10).unwrap()), ["exec-3"]);
+
+        let traced = ExecutionFilter {
+            trace_id: Some("4bf92f3577b34da6a3ce929d0e0e4736".to_string()),
+            ..Default::default()
+        };
+        assert_eq!(ids(&store.list(&traced, None, 10).unwrap()), ["exec-2"]);
+
+        assert!(store.list(&filter, Some("garbage"), 2).is_err());
+    }
+
+    #[test]
+    fn test_purge_by_filter_and_retention() {
+        let store = ExecutionStore::new(temp_path("purge"), 0, 0);
+        for (id, tenant, created_at) in [
+            ("a", "cs101", 100),
+            ("b", "cs101", 200),
+            ("c", "cs102", 100),
+        ] {
+            store.insert(ExecutionRecord {
+                id: id.to_string(),
+                tenant: tenant.to_string(),
+                language: "python".to_string(),
+                exit_code: 0,
+                status: ExecutionStatus::Succeeded,
+                labels: Vec::new(),
+                created_at,
+                artifacts: Vec::new(),
+                archive: None,
+                channel: None,
+                capabilities: Vec::new(),
+                trace_context: None,
+                code: None,
+                stdin: None,
+                stdout: None,
+                stderr: None,
+            });
+        }
+
+        // cs102 keeps its executions forever
+        let retention = |tenant: &str| (tenant == "cs101").then_some(50);
+        assert_eq!(store.purge_expired(160, retention), ["a"]);
+        assert!(store.get("c").is_some());
+
+        let filter = ExecutionFilter {
+            tenant: Some("cs102".to_string()),
+            ..Default::default()
+        };
+        assert_eq!(store.purge(&filter), ["c"]);
+        assert!(store.get("b").is_some());
+    }
+
+    #[test]
+    fn test_persisted_records_are_encrypted_and_reloaded() {
+        use crate::crypto::LocalKeyring;
+        use base64::Engine;
+
+        let root = temp_path("persist");
+        let key = base64::engine::general_purpose::STANDARD.encode([7u8; 32]);
+        let encryptor = || {
+            Some(Encryptor::new(Box::new(
+                LocalKeyring::parse(&format!("k1:{key}")).unwrap(),
+            )))
+        };
+
+        let workspace = temp_path("persist-workspace");
+        fs::create_dir_all(&workspace).unwrap();
+        fs::write(workspace.join("answer.txt"), "top secret").unwrap();
+
+        let store = ExecutionStore::new(root.clone(), 1024, 1024).persistent(encryptor());
+        let artifacts = store.capture_artifacts("exec-1", &workspace, &HashSet::new());
+        let archive = store.capture_archive("exec-1", &workspace);
+        store.insert(ExecutionRecord {
+            id: "exec-1".to_string(),
+            tenant: "cs101".to_string(),
+            language: "python".to_string(),
+            exit_code: 0,
+            status: ExecutionStatus::Succeeded,
+            labels: vec!["week-1".to_string()],
+            created_at: 100,
+            artifacts,
+            archive,
+            channel: None,
+            capabilities: Vec::new(),
+            trace_context: None,
+            code: Some("print('top secret')".to_string()),
+            stdin: Some(vec![RecordedInput {
+                test_case: "first".to_string(),
+                input: "top secret".to_string(),
+            }]),
+            stdout: Some("top secret\n".to_string()),
+            stderr: Some(String::new()),
+        });
+        let on_disk = fs::read_to_string(store.record_file("exec-1")).unwrap();
+        assert!(!on_disk.contains("top secret"));
+        assert!(on_disk.contains("week-1"));
+        let artifact = store.artifact_path("exec-1", "answer.txt").unwrap();
+        assert!(!fs::read_to_string(&artifact)
+            .unwrap()
+            .contains("top secret"));
+        assert_eq!(
+            store.unseal(&artifact).unwrap().unwrap(),
+            b"top secret".to_vec()
+        );
+        let archive = store.archive_path("exec-1").unwrap();
+        assert!(store.unseal(&archive).unwrap().is_ok());
+
+        let reopened = ExecutionStore::new(root.clone(), 0, 0).persistent(encryptor());
+        let record = reopened.get("exec-1").unwrap();
+        assert_eq!(record.code.as_deref(), Some("print('top secret')"));
+        assert_eq!(record.stdin.unwrap()[0].input, "top secret");
+        assert_eq!(record.stdout.as_deref(), Some("top secret\n"));
+
+        // Without the key the record can't be read, so it isn't loaded
+        let keyless = ExecutionStore::new(root.clone(), 0, 0).persistent(None);
+        assert!(keyless.get("exec-1").is_none());
+
+        fs::remove_dir_all(&workspace).ok();
+        fs::remove_dir_all(&root).ok();
+    }
+
+    #[test]
+    fn test_records_are_kept_beside_artifacts() {
+        let root = temp_path("record-location");
+        let workspace = temp_path("record-location-workspace");
+        fs::create_dir_all(&workspace).unwrap();
+        fs::write(workspace.join("record.json"), "produced by the program").unwrap();
+
+        let store = ExecutionStore::new(root.clone(), 1024, 1024).persistent(None);
+        let record = |id: &str, artifacts| ExecutionRecord {
+            id: id.to_string(),
+            tenant: "cs101".to_string(),
+            language: "python".to_string(),
+            exit_code: 0,
+            status: ExecutionStatus::Succeeded,
+            labels: Vec::new(),
+            created_at: 100,
+            artifacts,
+            archive: None,
+            channel: None,
+            capabilities: Vec::new(),
+            trace_context: None,
+            code: None,
+            stdin: None,
+            stdout: None,
+            stderr: None,
+        };
+        let artifacts = store.capture_artifacts("exec-1", &workspace, &HashSet::new());
+        store.insert(record("exec-1", artifacts));
+        let artifact = store.artifact_path("exec-1", "record.json").unwrap();
+        assert_eq!(
+            fs::read_to_string(&artifact).unwrap(),
+            "produced by the program"
+        );
+
+        // Records written inside the execution's directory are moved out
+        store.insert(record("exec-2", Vec::new()));
+        fs::create_dir_all(root.join("exec-2")).unwrap();
+        fs::rename(
+            store.record_file("exec-2"),
+            root.join("exec-2").join(LEGACY_RECORD_FILE_NAME),
+        )
+        .unwrap();
+
+        let reopened = ExecutionStore::new(root.clone(), 1024, 1024).persistent(None);
+        assert!(reopened.get("exec-1").is_some());
+        assert!(reopened.get("exec-2").is_some());
+        assert!(reopened.record_file("exec-2").is_file());
+        assert!(!root.join("exec-2").join(LEGACY_RECORD_FILE_NAME).exists());
+        assert_eq!(
+            fs::read_to_string(&artifact).unwrap(),
+            "produced by the program"
+        );
+
+        assert!(reopened.remove("exec-1"));
+        assert!(!reopened.record_file("exec-1").exists());
+
+        fs::remove_dir_all(&workspace).ok();
+        fs::remove_dir_all(&root).ok();
+    }
+
+    #[test]
+    fn test_capture_archive_is_size_capped() {
+        let workspace = temp_path("archive-workspace");
+        fs::create_dir_all(workspace.join("build")).unwrap();
+        fs::write(workspace.join("main.c"), "int main() { return 0; }").unwrap();
+        fs::write(workspace.join("build/huge.o"), vec![0u8; 200]).unwrap();
+
+        let store = ExecutionStore::new(temp_path("archive-root"), 1024, 100);
+        let archive = store.capture_archive("exec-2", &workspace).unwrap();
+        assert!(archive.truncated);
+        assert!(archive.size > 0);
+
+        let file = fs::File::open(store.archive_file("exec-2")).unwrap();
+        let mut tarball = tar::Archive::new(flate2::read::GzDecoder::new(file));
+        let names: Vec<String> = tarball
+            .entries()
+            .unwrap()
+            .map(|entry| {
+                entry
+                    .unwrap()
+                    .path()
+                    .unwrap()
+                    .to_string_lossy()
+                    .into_owned()
+            })
+            .collect();
+        assert_eq!(names, vec!["main.c".to_string()]);
+
+        fs::remove_dir_all(&workspace).ok();
+        fs::remove_dir_all(&store.root).ok();
+    }
+
+    #[test]
+    fn test_archive_does_not_overwrite_artifacts() {
+        let workspace = temp_path("archive-artifacts");
+        fs::create_dir_all(&workspace).unwrap();
+        fs::write(workspace.join("workdir.tar.gz"), "produced by the program").unwrap();
+
+        let store = ExecutionStore::new(temp_path("archive-artifacts-root"), 1024, 1024);
+        let artifacts = store.capture_artifacts("exec-3", &workspace, &HashSet::new());
+        assert_eq!(artifacts.len(), 1);
+        let archive = store.capture_archive("exec-3", &workspace);
+        assert!(archive.is_some());
+
+        let artifact = store.root.join("exec-3").join("workdir.tar.gz");
+        assert_eq!(
+            fs::read_to_string(&artifact).unwrap(),
+            "produced by the program"
+        );
+        assert!(store.archive_file("exec-3").is_file());
+
+        fs::remove_dir_all(&workspace).ok();
+        fs::remove_dir_all(&store.root).ok();
+    }
+}
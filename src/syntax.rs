@@ -0,0 +1,245 @@
+use serde::Serialize;
+
+/// A problem a syntax checker found in the code
+#[derive(Debug, Clone, Serialize, PartialEq)]
+pub struct Diagnostic {
+    /// 1-based; None when the checker didn't say where
+    pub line: Option<u32>,
+    /// 1-based; None when the checker only gave a line
+    pub column: Option<u32>,
+    pub severity: Severity,
+    pub message: String,
+}
+
+#[derive(Debug, Clone, Copy, Serialize, PartialEq)]
+#[serde(rename_all = "lowercase")]
+pub enum Severity {
+    Error,
+    Warning,
+}
+
+// Parses the file with the standard library's parser and reports the error in the
+// `file:line:column: error: message` form. Works on Python 2 and 3.
+const PYTHON_CHECKER: &str = "import ast, sys
+path = sys.argv[1]
+try:
+    ast.parse(open(path).read(), path)
+except SyntaxError as e:
+    sys.stderr.write('%s:%d:%d: error: %s\\n' % (path, e.lineno or 1, e.offset or 1, e.msg))
+    sys.exit(1)";
+
+// Compiles the file into a script without running it. V8 reports the position as
+// `file:line` followed by the offending line and a caret under the column.
+const NODE_CHECKER: &str = "const path = process.argv[1];
+try {
+  new (require('vm').Script)(require('fs').readFileSync(path, 'utf8'), { filename: path });
+} catch (e) {
+  const [at, , caret = ''] = String(e.stack).split('\\n');
+  const line = /:(\\d+)$/.exec(at);
+  const column = caret.indexOf('^') + 1;
+  console.error(`${path}:${line ? line[1] : 1}:${column || 1}: error: ${e.message}`);
+  process.exit(1);
+}";
+
+/// Command template that checks the syntax of a built-in language's source file
+/// without running it, with the same placeholders as run commands. None for
+/// languages whose only check is a full compile, or whose checker does more than
+/// parse the file: `perl -c` runs BEGIN blocks, and `-fsyntax-only` still reads
+/// every file the code `#include`s.
+pub fn builtin_checker(language: &str) -> Option<Vec<String>> {
+    let command: &[&str] = match language {
+        "python" | "python2" => &["python", "-c", PYTHON_CHECKER, "{file}"],
+        "node" => &["node", "-e", NODE_CHECKER, "{file}"],
+        "ruby" => &["ruby", "-c", "{file}"],
+        "php" => &["php", "-l", "{file}"],
+        "bash" => &["bash", "-n", "{file}"],
+        "go" => &["gofmt", "-e", "-l", "{file}"],
+        _ => return None,
+    };
+    Some(command.iter().map(|arg| arg.to_string()).collect())
+}
+
+/// Reads the diagnostics about `file_name` out of a checker's output. Understands
+/// the forms compilers commonly use:
+///
+/// - `main.c:3:5: error: expected ';'` (GCC, Clang, gofmt, Ruby, and the Python
+///   and Node checkers); the column and severity are optional
+/// - `main.sh: line 3: syntax error near unexpected token` (Bash)
+/// - `syntax error, unexpected '}' in main.php on line 3` (PHP)
+/// - `syntax error at main.pl line 3, near "}"` (Perl)
+pub fn parse_diagnostics(output: &str, file_name: &str) -> Vec<Diagnostic> {
+    output
+        .lines()
+        .filter_map(|line| parse_line(line.trim_end(), file_name))
+        .collect()
+}
+
+fn parse_line(line: &str, file_name: &str) -> Option<Diagnostic> {
+    // Checkers print the path as given, or prefixed with the working directory
+    let start = line.find(file_name)?;
+    let before = &line[..start];
+    let after = &line[start + file_name.len()..];
+    if before.is_empty() || before.ends_with('/') {
+        if let Some(diagnostic) = located(after) {
+            return Some(diagnostic);
+        }
+    }
+    // PHP and Perl name the file in the middle of the message
+    let message = before
+        .trim_end()
+        .strip_suffix(" in")
+        .or_else(|| before.trim_end().strip_suffix(" at"))?;
+    let line_number = after
+        .strip_prefix(" on line ")
+        .or_else(|| after.strip_prefix(" line "))?;
+    let (line_number, rest) = leading_number(line_number)?;
+    let message = format!("{}{}", strip_prefixes(message), rest.trim_end_matches('.'));
+    Some(error(Some(line_number), None, message.trim()))
+}
+
+// `:3:5: error: message`, `:3: message` or `: line 3: message`
+fn located(after: &str) -> Option<Diagnostic> {
+    let rest = after.strip_prefix(':')?;
+    let rest = rest.strip_prefix(" line ").unwrap_or(rest);
+    let (line, rest) = leading_number(rest)?;
+    let rest = rest.strip_prefix(':')?;
+    let (column, rest) = match leading_number(rest) {
+        Some((column, rest)) => (Some(column), rest.strip_prefix(':')?),
+        None => (None, rest),
+    };
+    let message = rest.trim();
+    for (prefix, severity) in [
+        ("fatal error:", Severity::Error),
+        ("error:", Severity::Error),
+        ("warning:", Severity::Warning),
+    ] {
+        if let Some(message) = message.strip_prefix(prefix) {
+            return Some(Diagnostic {
+                line: Some(line),
+                column,
+                severity,
+                message: message.trim().to_string(),
+            });
+        }
+    }
+    // Notes point at related code rather than at a problem
+    if message.starts_with("note:") {
+        return None;
+    }
+    Some(error(Some(line), column, message))
+}
+
+fn leading_number(text: &str) -> Option<(u32, &str)> {
+    let digits = text.len() - text.trim_start_matches(|c: char| c.is_ascii_digit()).len();
+    let number = text[..digits].parse().ok()?;
+    Some((number, &text[digits..]))
+}
+
+// Drops the tool's own prefix, e.g. `PHP Parse error: `
+fn strip_prefixes(message: &str) -> &str {
+    ["PHP Parse error:", "Parse error:"]
+        .iter()
+        .find_map(|prefix| message.strip_prefix(prefix))
+        .unwrap_or(message)
+        .trim_start()
+}
+
+fn error(line: Option<u32>, column: Option<u32>, message: &str) -> Diagnostic {
+    Diagnostic {
+        line,
+        column,
+        severity: Severity::Error,
+        message: message.to_string(),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn diagnostic(line: u32, column: Option<u32>, message: &str) -> Diagnostic {
+        error(Some(line), column, message)
+    }
+
+    #[test]
+    fn test_parses_compiler_style_diagnostics() {
+        let gcc = "main.c: In function 'main':\n\
+            main.c:3:5: error: expected ';' before 'return'\n\
+            main.c:2:9: warning: unused variable 'x' [-Wunused-variable]\n\
+            main.c:1:1: note: declared here\n\
+                3 |     return 0;\n\
+                  |     ^~~~~~";
+        assert_eq!(
+            parse_diagnostics(gcc, "main.c"),
+            vec![
+                diagnostic(3, Some(5), "expected ';' before 'return'"),
+                Diagnostic {
+                    line: Some(2),
+                    column: Some(9),
+                    severity: Severity::Warning,
+                    message: "unused variable 'x' [-Wunused-variable]".to_string(),
+                },
+            ]
+        );
+        assert_eq!(
+            parse_diagnostics(
+                "/workspace/main.go:4:2: expected '}', found 'EOF'",
+                "main.go"
+            ),
+            vec![diagnostic(4, Some(2), "expected '}', found 'EOF'")]
+        );
+        assert_eq!(
+            parse_diagnostics(
+                "main.rb:2: syntax error, unexpected end-of-input\nmain.rb: compile error (SyntaxError)",
+                "main.rb"
+            ),
+            vec![diagnostic(2, None, "syntax error, unexpected end-of-input")]
+        );
+    }
+
+    #[test]
+    fn test_parses_tool_specific_diagnostics() {
+        assert_eq!(
+            parse_diagnostics(
+                "main.sh: line 3: syntax error near unexpected token `fi'",
+                "main.sh"
+            ),
+            vec![diagnostic(
+                3,
+                None,
+                "syntax error near unexpected token `fi'"
+            )]
+        );
+        assert_eq!(
+            parse_diagnostics(
+                "PHP Parse error:  syntax error, unexpected token \"}\" in main.php on line 4\nErrors parsing main.php",
+                "main.php"
+            ),
+            vec![diagnostic(4, None, "syntax error, unexpected token \"}\"")]
+        );
+        assert_eq!(
+            parse_diagnostics(
+                "syntax error at main.pl line 2, near \"}\"\nmain.pl had compilation errors.",
+                "main.pl"
+            ),
+            vec![diagnostic(2, None, "syntax error, near \"}\"")]
+        );
+    }
+
+    #[test]
+    fn test_ignores_other_output() {
+        assert!(parse_diagnostics("main.py syntax OK\n", "main.py").is_empty());
+        assert!(parse_diagnostics("No syntax errors detected in main.php", "main.php").is_empty());
+        assert!(parse_diagnostics("lib.c:3:5: error: elsewhere", "main.c").is_empty());
+    }
+
+    #[test]
+    fn test_builtin_checkers() {
+        let python = builtin_checker("python").unwrap();
+        assert_eq!(python[0], "python");
+        assert_eq!(python.last().unwrap(), "{file}");
+        assert!(builtin_checker("java").is_none());
+        assert!(builtin_checker("perl").is_none());
+        assert!(builtin_checker("c").is_none());
+    }
+}
@@ -0,0 +1,68 @@
+use serde::{Deserialize, Serialize};
+
+// What full-screen programs are told they're drawing on; xterm.js and most web
+// terminals understand its escape sequences
+const TERM: &str = "xterm-256color";
+
+/// The terminal a client renders output in. Sandboxes have no TTY, so programs learn
+/// the size from `COLUMNS` and `LINES`, which curses and most CLI tools read when
+/// they can't ask the terminal.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Deserialize, Serialize)]
+pub struct Terminal {
+    pub rows: u16,
+    pub cols: u16,
+    /// Whether input sent to the program is shown to everyone watching it
+    #[serde(default = "default_echo")]
+    pub echo: bool,
+}
+
+fn default_echo() -> bool {
+    true
+}
+
+impl Terminal {
+    pub fn validate(&self) -> Result<(), String> {
+        if self.rows == 0 || self.cols == 0 {
+            return Err("Terminal rows and cols must be positive".to_string());
+        }
+        Ok(())
+    }
+
+    /// Environment variables describing the terminal to the program
+    pub fn env(&self) -> Vec<(&'static str, String)> {
+        vec![
+            ("TERM", TERM.to_string()),
+            ("COLUMNS", self.cols.to_string()),
+            ("LINES", self.rows.to_string()),
+        ]
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_env_describes_size() {
+        let terminal: Terminal = serde_json::from_str(r#"{"rows": 24, "cols": 80}"#).unwrap();
+        assert!(terminal.echo);
+        assert_eq!(
+            terminal.env(),
+            vec![
+                ("TERM", "xterm-256color".to_string()),
+                ("COLUMNS", "80".to_string()),
+                ("LINES", "24".to_string()),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_validate_rejects_empty_terminal() {
+        let terminal = Terminal {
+            rows: 0,
+            cols: 80,
+            echo: false,
+        };
+        assert!(terminal.validate().is_err());
+    }
+}
@@ -0,0 +1,122 @@
+use std::os::unix::process::ExitStatusExt;
+use std::process::ExitStatus;
+use std::time::Duration;
+
+const CPU_TIME_LIMIT: &str = "killed by CPU time limit";
+const MEMORY_LIMIT: &str = "killed by memory limit";
+const FILE_SIZE_LIMIT: &str = "killed by file size limit";
+
+/// A resource limit a program can be killed for
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum Limit {
+    CpuTime,
+    Memory,
+    FileSize,
+}
+
+/// How a program that died from a signal was terminated
+#[derive(Debug, Clone, PartialEq)]
+pub struct Termination {
+    /// Name of the signal, e.g. "SIGSEGV"
+    pub signal: &'static str,
+    /// Why the program got it, e.g. "killed by memory limit"
+    pub reason: &'static str,
+}
+
+impl Termination {
+    /// The limit the program was killed for, if it was
+    pub fn limit(&self) -> Option<Limit> {
+        match self.reason {
+            CPU_TIME_LIMIT => Some(Limit::CpuTime),
+            MEMORY_LIMIT => Some(Limit::Memory),
+            FILE_SIZE_LIMIT => Some(Limit::FileSize),
+            _ => None,
+        }
+    }
+}
+
+/// Exit code of a finished process. A signal is reported as 128 plus its number,
+/// as shells and Docker do, so host processes and containers look the same.
+pub fn exit_code(status: &ExitStatus) -> i32 {
+    status
+        .code()
+        .or_else(|| status.signal().map(|signal| 128 + signal))
+        .unwrap_or(1)
+}
+
+/// Works out from its exit code whether a sandboxed program was killed by a
+/// signal, and why. The CPU time limit and the memory limit both kill with
+/// SIGKILL, so a program killed after running at least as long as its CPU time
+/// limit is taken to have hit that limit, and one killed sooner the memory limit.
+/// A program that exits with a code above 128 itself can't be told apart.
+pub fn from_exit_code(
+    exit_code: i32,
+    elapsed: Duration,
+    cpu_time_limit: Duration,
+) -> Option<Termination> {
+    let signal = exit_code.checked_sub(128).filter(|signal| *signal > 0)?;
+    let (name, reason) = match signal {
+        libc::SIGKILL if elapsed >= cpu_time_limit => ("SIGKILL", CPU_TIME_LIMIT),
+        libc::SIGKILL => ("SIGKILL", MEMORY_LIMIT),
+        libc::SIGXCPU => ("SIGXCPU", CPU_TIME_LIMIT),
+        libc::SIGXFSZ => ("SIGXFSZ", FILE_SIZE_LIMIT),
+        libc::SIGSEGV => ("SIGSEGV", "segmentation fault"),
+        libc::SIGBUS => ("SIGBUS", "bus error"),
+        libc::SIGFPE => ("SIGFPE", "floating point exception"),
+        libc::SIGILL => ("SIGILL", "illegal instruction"),
+        libc::SIGABRT => ("SIGABRT", "aborted"),
+        libc::SIGPIPE => ("SIGPIPE", "wrote to a closed pipe"),
+        libc::SIGTERM => ("SIGTERM", "terminated"),
+        libc::SIGINT => ("SIGINT", "interrupted"),
+        libc::SIGHUP => ("SIGHUP", "hung up"),
+        libc::SIGQUIT => ("SIGQUIT", "quit"),
+        libc::SIGTRAP => ("SIGTRAP", "trace trap"),
+        libc::SIGSYS => ("SIGSYS", "bad system call"),
+        libc::SIGALRM => ("SIGALRM", "alarm clock"),
+        libc::SIGUSR1 => ("SIGUSR1", "user-defined signal 1"),
+        libc::SIGUSR2 => ("SIGUSR2", "user-defined signal 2"),
+        _ => return None,
+    };
+    Some(Termination {
+        signal: name,
+        reason,
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_from_exit_code() {
+        let second = Duration::from_secs(1);
+        let limit = Duration::from_secs(5);
+        assert_eq!(from_exit_code(0, second, limit), None);
+        assert_eq!(from_exit_code(1, second, limit), None);
+        assert_eq!(from_exit_code(128, second, limit), None);
+
+        let oom = from_exit_code(137, second, limit).unwrap();
+        assert_eq!(oom.signal, "SIGKILL");
+        assert_eq!(oom.reason, "killed by memory limit");
+        assert_eq!(oom.limit(), Some(Limit::Memory));
+        let cpu = from_exit_code(137, Duration::from_secs(6), limit).unwrap();
+        assert_eq!(cpu.reason, "killed by CPU time limit");
+        assert_eq!(cpu.limit(), Some(Limit::CpuTime));
+
+        let segfault = from_exit_code(128 + libc::SIGSEGV, second, limit).unwrap();
+        assert_eq!(segfault.signal, "SIGSEGV");
+        assert_eq!(segfault.reason, "segmentation fault");
+        assert_eq!(segfault.limit(), None);
+    }
+
+    #[test]
+    fn test_exit_code() {
+        assert_eq!(exit_code(&ExitStatus::from_raw(0)), 0);
+        // Exited with 3
+        assert_eq!(exit_code(&ExitStatus::from_raw(3 << 8)), 3);
+        assert_eq!(
+            exit_code(&ExitStatus::from_raw(libc::SIGKILL)),
+            128 + libc::SIGKILL
+        );
+    }
+}
@@ -0,0 +1,144 @@
+use std::fs;
+use std::io::{Read, Seek, SeekFrom};
+use std::path::Path;
+
+/// Workspace file, and so artifact, the syscall trace of a `trace` request is written to
+pub const TRACE_FILE: &str = "isobox-strace.log";
+
+/// Where the host's strace binary is mounted in the sandbox
+pub const SANDBOX_PATH: &str = "/opt/isobox/strace";
+
+/// Default size a trace is cut down to, used when `TRACE_MAX_BYTES` is unset
+pub const DEFAULT_MAX_BYTES: u64 = 1024 * 1024;
+
+/// Runs programs under strace for `trace` requests. Sandbox images rarely ship
+/// strace, so the operator provides a statically linked binary on the host.
+#[derive(Debug, Default)]
+pub struct Tracer {
+    binary: Option<String>,
+    max_bytes: u64,
+}
+
+impl Tracer {
+    /// Reads `STRACE_BINARY` and `TRACE_MAX_BYTES`; tracing is unavailable
+    /// without a binary
+    pub fn from_env() -> Self {
+        Self::new(
+            std::env::var("STRACE_BINARY")
+                .ok()
+                .filter(|path| !path.is_empty()),
+            std::env::var("TRACE_MAX_BYTES")
+                .ok()
+                .and_then(|s| s.parse().ok())
+                .unwrap_or(DEFAULT_MAX_BYTES),
+        )
+    }
+
+    pub fn new(binary: Option<String>, max_bytes: u64) -> Self {
+        Self { binary, max_bytes }
+    }
+
+    /// Host path of the strace binary, if tracing is configured
+    pub fn binary(&self) -> Option<&str> {
+        self.binary.as_deref()
+    }
+
+    /// Cuts the trace in `workspace` down to its last lines, which show what the
+    /// program was doing when it ended or hung
+    pub fn truncate(&self, workspace: &Path) {
+        if let Err(e) = truncate_to_tail(&workspace.join(TRACE_FILE), self.max_bytes) {
+            log::warn!("Failed to truncate syscall trace: {e}");
+        }
+    }
+}
+
+/// Wraps a run command so it runs under `strace`, following child processes and
+/// writing timestamped syscalls with their durations to `TRACE_FILE` in `work_dir`
+pub fn wrap(strace: &str, work_dir: &str, command: &[String]) -> Vec<String> {
+    let mut wrapped: Vec<String> = [
+        strace,
+        "-f",
+        "-tt",
+        "-T",
+        "-s",
+        "256",
+        "-o",
+        &format!("{work_dir}/{TRACE_FILE}"),
+        "--",
+    ]
+    .iter()
+    .map(|arg| arg.to_string())
+    .collect();
+    wrapped.extend_from_slice(command);
+    wrapped
+}
+
+fn truncate_to_tail(path: &Path, max_bytes: u64) -> std::io::Result<()> {
+    let size = match fs::metadata(path) {
+        Ok(metadata) => metadata.len(),
+        // The program never started, e.g. because it didn't compile
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => return Ok(()),
+        Err(e) => return Err(e),
+    };
+    if size <= max_bytes {
+        return Ok(());
+    }
+
+    let mut file = fs::File::open(path)?;
+    file.seek(SeekFrom::Start(size - max_bytes))?;
+    let mut tail = Vec::new();
+    file.read_to_end(&mut tail)?;
+    // Start at a whole line
+    let start = tail
+        .iter()
+        .position(|byte| *byte == b'\n')
+        .map_or(0, |newline| newline + 1);
+    let omitted = size - max_bytes + start as u64;
+    let mut truncated = format!("[{omitted} bytes of earlier trace left out]\n").into_bytes();
+    truncated.extend_from_slice(&tail[start..]);
+    fs::write(path, truncated)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_wrap() {
+        let command = ["./a.out".to_string(), "input".to_string()];
+        assert_eq!(
+            wrap(SANDBOX_PATH, "/workspace", &command),
+            [
+                SANDBOX_PATH,
+                "-f",
+                "-tt",
+                "-T",
+                "-s",
+                "256",
+                "-o",
+                "/workspace/isobox-strace.log",
+                "--",
+                "./a.out",
+                "input",
+            ]
+        );
+    }
+
+    #[test]
+    fn test_truncate_keeps_last_lines() {
+        let workspace = std::env::temp_dir().join(format!("isobox-trace-{}", uuid::Uuid::new_v4()));
+        fs::create_dir_all(&workspace).unwrap();
+        let tracer = Tracer::new(None, 16);
+        // Nothing to do without a trace
+        tracer.truncate(&workspace);
+
+        let path = workspace.join(TRACE_FILE);
+        fs::write(&path, "read(0, \"\", 1)\nwrite(1, \"x\", 1)\nfutex(...)\n").unwrap();
+        tracer.truncate(&workspace);
+        assert_eq!(
+            fs::read_to_string(&path).unwrap(),
+            "[32 bytes of earlier trace left out]\nfutex(...)\n"
+        );
+        fs::remove_dir_all(&workspace).unwrap();
+    }
+}
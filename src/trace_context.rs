@@ -0,0 +1,100 @@
+use serde::{Deserialize, Serialize};
+
+/// Header with the caller's trace and span, e.g.
+/// `00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01`
+pub const TRACEPARENT: &str = "traceparent";
+/// Header with vendor-specific trace data that goes with `traceparent`
+pub const TRACESTATE: &str = "tracestate";
+
+// Longest tracestate kept; the W3C spec lets it be cut off at 512 characters
+const MAX_TRACESTATE: usize = 512;
+
+/// W3C Trace Context of the request an execution was made for, kept so isobox's
+/// records can be joined with the caller's traces and logs
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct TraceContext {
+    pub traceparent: String,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub tracestate: Option<String>,
+}
+
+impl TraceContext {
+    /// None when `traceparent` is malformed, which the spec says to treat like a
+    /// request without one. An oversized `tracestate` is dropped.
+    pub fn parse(traceparent: &str, tracestate: Option<&str>) -> Option<Self> {
+        let traceparent = traceparent.trim();
+        if !is_valid_traceparent(traceparent) {
+            return None;
+        }
+        let tracestate = tracestate
+            .map(str::trim)
+            .filter(|state| !state.is_empty() && state.len() <= MAX_TRACESTATE)
+            .map(str::to_string);
+        Some(Self {
+            traceparent: traceparent.to_string(),
+            tracestate,
+        })
+    }
+
+    /// The 32 hex digit trace ID
+    pub fn trace_id(&self) -> &str {
+        &self.traceparent[3..35]
+    }
+}
+
+// version-trace_id-parent_id-flags, all lowercase hex. Later versions may append
+// fields, which are ignored.
+fn is_valid_traceparent(value: &str) -> bool {
+    let fields: Vec<&str> = value.split('-').collect();
+    let hex = |field: &str, len: usize| {
+        field.len() == len
+            && field
+                .bytes()
+                .all(|b| b.is_ascii_digit() || (b'a'..=b'f').contains(&b))
+    };
+    let nonzero = |field: &str| field.bytes().any(|b| b != b'0');
+    let [version, trace_id, parent_id, flags, rest @ ..] = fields.as_slice() else {
+        return false;
+    };
+    hex(version, 2)
+        && *version != "ff"
+        && (*version != "00" || rest.is_empty())
+        && hex(trace_id, 32)
+        && nonzero(trace_id)
+        && hex(parent_id, 16)
+        && nonzero(parent_id)
+        && hex(flags, 2)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const TRACEPARENT: &str = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01";
+
+    #[test]
+    fn test_parse() {
+        let context = TraceContext::parse(TRACEPARENT, Some("congo=t61rcWkgMzE")).unwrap();
+        assert_eq!(context.trace_id(), "4bf92f3577b34da6a3ce929d0e0e4736");
+        assert_eq!(context.tracestate.as_deref(), Some("congo=t61rcWkgMzE"));
+
+        let long_state = "a=b,".repeat(200);
+        let context = TraceContext::parse(TRACEPARENT, Some(&long_state)).unwrap();
+        assert_eq!(context.tracestate, None);
+
+        // Later versions may carry more fields
+        assert!(TraceContext::parse(&format!("01{}-extra", &TRACEPARENT[2..]), None).is_some());
+
+        for invalid in [
+            "",
+            "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+            "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+            "00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+            "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+            "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+            "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+        ] {
+            assert_eq!(TraceContext::parse(invalid, None), None, "{invalid}");
+        }
+    }
+}
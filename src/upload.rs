@@ -0,0 +1,369 @@
+use futures::{Stream, StreamExt};
+use std::path::Path;
+use tokio::io::AsyncWriteExt;
+
+// The preamble and a part's headers are small; anything bigger isn't a form upload
+const MAX_HEADER_BYTES: usize = 16 * 1024;
+
+#[derive(Debug, thiserror::Error)]
+pub enum UploadError {
+    #[error("Malformed upload: {0}")]
+    Malformed(String),
+    #[error("Part '{0}' exceeds the limit of {1} bytes")]
+    TooLarge(String, u64),
+    #[error("Failed to read the upload: {0}")]
+    Stream(String),
+    #[error("Failed to store the upload: {0}")]
+    Io(String),
+}
+
+/// Headers of one part of a `multipart/form-data` body
+#[derive(Debug, Clone, PartialEq)]
+pub struct Part {
+    pub name: String,
+    pub filename: Option<String>,
+    pub content_type: Option<String>,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq)]
+enum State {
+    Preamble,
+    Headers,
+    Body,
+    Done,
+}
+
+/// Reads a `multipart/form-data` body part by part as it arrives, so a part can be
+/// written to disk without the whole body being held in memory. Only the current
+/// chunk and the few bytes that could start a boundary are buffered.
+pub struct Multipart<S> {
+    stream: S,
+    // "\r\n--" and the boundary, which ends every part's content
+    delimiter: Vec<u8>,
+    buffer: Vec<u8>,
+    state: State,
+    current: Option<String>,
+}
+
+impl<S, B, E> Multipart<S>
+where
+    S: Stream<Item = Result<B, E>> + Unpin,
+    B: AsRef<[u8]>,
+    E: std::fmt::Display,
+{
+    /// Reads `stream` as the body of a request with the `Content-Type` header
+    /// `content_type`, which must be `multipart/form-data` with a boundary
+    pub fn new(content_type: &str, stream: S) -> Result<Self, UploadError> {
+        let boundary = boundary(content_type)?;
+        Ok(Self {
+            stream,
+            delimiter: format!("\r\n--{boundary}").into_bytes(),
+            // The first boundary may open the body, without a line break before it
+            buffer: b"\r\n".to_vec(),
+            state: State::Preamble,
+            current: None,
+        })
+    }
+
+    /// Moves to the next part, skipping whatever is left of the current one.
+    /// Returns None after the last part.
+    pub async fn next_part(&mut self) -> Result<Option<Part>, UploadError> {
+        loop {
+            match self.state {
+                State::Done => return Ok(None),
+                State::Body => while self.chunk().await?.is_some() {},
+                State::Preamble => {
+                    let start = self.find(&self.delimiter.clone()).await?;
+                    self.buffer.drain(..start + self.delimiter.len());
+                    self.after_delimiter().await?;
+                }
+                State::Headers => {
+                    let part = self.headers().await?;
+                    self.current = Some(part.name.clone());
+                    self.state = State::Body;
+                    return Ok(Some(part));
+                }
+            }
+        }
+    }
+
+    /// The next piece of the current part's content; None at its end
+    pub async fn chunk(&mut self) -> Result<Option<Vec<u8>>, UploadError> {
+        if self.state != State::Body {
+            return Ok(None);
+        }
+        loop {
+            if let Some(end) = position(&self.buffer, &self.delimiter) {
+                if end > 0 {
+                    return Ok(Some(self.buffer.drain(..end).collect()));
+                }
+                self.buffer.drain(..self.delimiter.len());
+                self.after_delimiter().await?;
+                return Ok(None);
+            }
+            // Bytes that can't be the start of a delimiter are content
+            let keep = self.delimiter.len() - 1;
+            if self.buffer.len() > keep {
+                let end = self.buffer.len() - keep;
+                return Ok(Some(self.buffer.drain(..end).collect()));
+            }
+            if !self.fill().await? {
+                return Err(UploadError::Malformed(
+                    "the body ended inside a part".to_string(),
+                ));
+            }
+        }
+    }
+
+    /// The rest of the current part, which may be at most `limit` bytes
+    pub async fn bytes(&mut self, limit: u64) -> Result<Vec<u8>, UploadError> {
+        let mut content = Vec::new();
+        while let Some(chunk) = self.chunk().await? {
+            content.extend_from_slice(&chunk);
+            if content.len() as u64 > limit {
+                return Err(self.too_large(limit));
+            }
+        }
+        Ok(content)
+    }
+
+    /// Writes the rest of the current part, which may be at most `limit` bytes, to a
+    /// new file at `path`. Returns how many bytes were written.
+    pub async fn save(&mut self, path: &Path, limit: u64) -> Result<u64, UploadError> {
+        let mut file = tokio::fs::File::create(path)
+            .await
+            .map_err(|e| UploadError::Io(e.to_string()))?;
+        let mut written = 0;
+        while let Some(chunk) = self.chunk().await? {
+            written += chunk.len() as u64;
+            if written > limit {
+                return Err(self.too_large(limit));
+            }
+            file.write_all(&chunk)
+                .await
+                .map_err(|e| UploadError::Io(e.to_string()))?;
+        }
+        file.flush()
+            .await
+            .map_err(|e| UploadError::Io(e.to_string()))?;
+        Ok(written)
+    }
+
+    fn too_large(&self, limit: u64) -> UploadError {
+        UploadError::TooLarge(self.current.clone().unwrap_or_default(), limit)
+    }
+
+    // Reads more of the body into the buffer; false once it has all been read
+    async fn fill(&mut self) -> Result<bool, UploadError> {
+        match self.stream.next().await {
+            Some(Ok(bytes)) => {
+                self.buffer.extend_from_slice(bytes.as_ref());
+                Ok(true)
+            }
+            Some(Err(e)) => Err(UploadError::Stream(e.to_string())),
+            None => Ok(false),
+        }
+    }
+
+    // Where `needle` starts in the buffer, reading until it turns up
+    async fn find(&mut self, needle: &[u8]) -> Result<usize, UploadError> {
+        loop {
+            if let Some(start) = position(&self.buffer, needle) {
+                return Ok(start);
+            }
+            if self.buffer.len() > MAX_HEADER_BYTES {
+                return Err(UploadError::Malformed(format!(
+                    "no boundary or end of part headers within {MAX_HEADER_BYTES} bytes"
+                )));
+            }
+            if !self.fill().await? {
+                return Err(UploadError::Malformed(
+                    "the body ended before the closing boundary".to_string(),
+                ));
+            }
+        }
+    }
+
+    // A boundary is followed by "--" after the last part, or a line break before
+    // the next part's headers. The line break is left in the buffer so an empty
+    // header block still ends in "\r\n\r\n".
+    async fn after_delimiter(&mut self) -> Result<(), UploadError> {
+        while self.buffer.len() < 2 {
+            if !self.fill().await? {
+                return Err(UploadError::Malformed(
+                    "the body ended after a boundary".to_string(),
+                ));
+            }
+        }
+        self.state = match &self.buffer[..2] {
+            b"--" => State::Done,
+            b"\r\n" => State::Headers,
+            _ => {
+                return Err(UploadError::Malformed(
+                    "a boundary is followed by neither a line break nor \"--\"".to_string(),
+                ))
+            }
+        };
+        Ok(())
+    }
+
+    async fn headers(&mut self) -> Result<Part, UploadError> {
+        let end = self.find(b"\r\n\r\n").await?;
+        let block: Vec<u8> = self.buffer.drain(..end + 4).collect();
+        let block = String::from_utf8_lossy(block.get(2..end).unwrap_or_default());
+
+        let mut name = None;
+        let mut filename = None;
+        let mut content_type = None;
+        for line in block.split("\r\n") {
+            let Some((header, value)) = line.split_once(':') else {
+                continue;
+            };
+            let value = value.trim();
+            if header.trim().eq_ignore_ascii_case("content-disposition") {
+                name = parameter(value, "name");
+                filename = parameter(value, "filename");
+            } else if header.trim().eq_ignore_ascii_case("content-type") {
+                content_type = Some(value.to_string());
+            }
+        }
+        let name = name.ok_or_else(|| {
+            UploadError::Malformed("a part has no Content-Disposition name".to_string())
+        })?;
+        Ok(Part {
+            name,
+            filename,
+            content_type,
+        })
+    }
+}
+
+// The boundary parameter of a multipart/form-data content type
+fn boundary(content_type: &str) -> Result<String, UploadError> {
+    let media_type = content_type.split(';').next().unwrap_or_default().trim();
+    if !media_type.eq_ignore_ascii_case("multipart/form-data") {
+        return Err(UploadError::Malformed(format!(
+            "expected multipart/form-data, got '{media_type}'"
+        )));
+    }
+    match parameter(content_type, "boundary") {
+        Some(boundary) if (1..=70).contains(&boundary.len()) => Ok(boundary),
+        _ => Err(UploadError::Malformed(
+            "the content type has no valid boundary".to_string(),
+        )),
+    }
+}
+
+// A `key=value` or `key="value"` parameter of a header value
+fn parameter(value: &str, key: &str) -> Option<String> {
+    value.split(';').skip(1).find_map(|param| {
+        let (name, value) = param.split_once('=')?;
+        name.trim()
+            .eq_ignore_ascii_case(key)
+            .then(|| value.trim().trim_matches('"').to_string())
+    })
+}
+
+fn position(haystack: &[u8], needle: &[u8]) -> Option<usize> {
+    haystack
+        .windows(needle.len())
+        .position(|window| window == needle)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const CONTENT_TYPE: &str = "multipart/form-data; boundary=\"XyZ\"";
+    const BODY: &str = "preamble\r\n--XyZ\r\n\
+        Content-Disposition: form-data; name=\"request\"\r\n\
+        Content-Type: application/json\r\n\r\n\
+        {\"language\":\"python\"}\r\n--XyZ\r\n\
+        Content-Disposition: form-data; name=\"input.big\"; filename=\"big.txt\"\r\n\r\n\
+        line one\r\n-- XyZ\r\n\r\n--XyZ--\r\nepilogue";
+
+    // The body split into chunks of `size` bytes, as it might arrive
+    fn chunked(body: &str, size: usize) -> Vec<Result<Vec<u8>, String>> {
+        body.as_bytes()
+            .chunks(size)
+            .map(|chunk| Ok(chunk.to_vec()))
+            .collect()
+    }
+
+    async fn parts(size: usize) -> Vec<(Part, Vec<u8>)> {
+        let stream = futures::stream::iter(chunked(BODY, size));
+        let mut multipart = Multipart::new(CONTENT_TYPE, stream).unwrap();
+        let mut parts = Vec::new();
+        while let Some(part) = multipart.next_part().await.unwrap() {
+            let content = multipart.bytes(1024).await.unwrap();
+            parts.push((part, content));
+        }
+        parts
+    }
+
+    #[tokio::test]
+    async fn test_parts_split_across_chunks() {
+        for size in [1, 2, 5, 7, 64, BODY.len()] {
+            let parts = parts(size).await;
+            assert_eq!(parts.len(), 2, "chunk size {size}");
+            assert_eq!(
+                parts[0].0,
+                Part {
+                    name: "request".to_string(),
+                    filename: None,
+                    content_type: Some("application/json".to_string()),
+                }
+            );
+            assert_eq!(parts[0].1, b"{\"language\":\"python\"}");
+            assert_eq!(parts[1].0.name, "input.big");
+            assert_eq!(parts[1].0.filename.as_deref(), Some("big.txt"));
+            assert_eq!(parts[1].1, b"line one\r\n-- XyZ\r\n");
+        }
+    }
+
+    #[tokio::test]
+    async fn test_skipped_and_oversized_parts() {
+        let stream = futures::stream::iter(chunked(BODY, 3));
+        let mut multipart = Multipart::new(CONTENT_TYPE, stream).unwrap();
+        // Moving on without reading the content skips it
+        multipart.next_part().await.unwrap();
+        let part = multipart.next_part().await.unwrap().unwrap();
+        assert_eq!(part.name, "input.big");
+        assert!(matches!(
+            multipart.bytes(10).await,
+            Err(UploadError::TooLarge(name, 10)) if name == "input.big"
+        ));
+    }
+
+    #[tokio::test]
+    async fn test_saves_part_to_file() {
+        let dir = std::env::temp_dir().join(format!("isobox-upload-test-{}", std::process::id()));
+        std::fs::create_dir_all(&dir).unwrap();
+        let path = dir.join("input");
+        let stream = futures::stream::iter(chunked(BODY, 4));
+        let mut multipart = Multipart::new(CONTENT_TYPE, stream).unwrap();
+        multipart.next_part().await.unwrap();
+        multipart.next_part().await.unwrap();
+        assert_eq!(multipart.save(&path, 1024).await.unwrap(), 18);
+        assert_eq!(std::fs::read(&path).unwrap(), b"line one\r\n-- XyZ\r\n");
+        assert!(multipart.next_part().await.unwrap().is_none());
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+
+    #[tokio::test]
+    async fn test_malformed_uploads() {
+        let empty = || futures::stream::iter(chunked("", 1));
+        assert!(Multipart::new("application/json", empty()).is_err());
+        assert!(Multipart::new("multipart/form-data", empty()).is_err());
+
+        // Cut off in the middle of the last part
+        let truncated = futures::stream::iter(chunked(&BODY[..BODY.len() - 25], 8));
+        let mut multipart = Multipart::new(CONTENT_TYPE, truncated).unwrap();
+        multipart.next_part().await.unwrap();
+        multipart.next_part().await.unwrap();
+        assert!(matches!(
+            multipart.bytes(1024).await,
+            Err(UploadError::Malformed(_))
+        ));
+    }
+}
@@ -0,0 +1,84 @@
+use crate::store::unix_timestamp;
+use serde::Serialize;
+use std::collections::HashMap;
+use std::sync::Mutex;
+
+const SECONDS_PER_DAY: u64 = 24 * 60 * 60;
+
+/// Metered resources a tenant consumed during the current UTC day
+#[derive(Debug, Clone, Default, Serialize)]
+pub struct TenantUsage {
+    pub day: u64,
+    pub executions: u64,
+    pub gpu_seconds: f64,
+}
+
+/// Per-tenant usage counters that reset at midnight UTC
+#[derive(Default)]
+pub struct UsageMeter {
+    usage: Mutex<HashMap<String, TenantUsage>>,
+}
+
+impl UsageMeter {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    pub fn today(&self, tenant: &str) -> TenantUsage {
+        self.usage_on(tenant, current_day())
+    }
+
+    pub fn record_execution(&self, tenant: &str, gpu_seconds: f64) {
+        self.record_on(tenant, current_day(), gpu_seconds);
+    }
+
+    fn usage_on(&self, tenant: &str, day: u64) -> TenantUsage {
+        match self.usage.lock().unwrap().get(tenant) {
+            Some(usage) if usage.day == day => usage.clone(),
+            _ => TenantUsage {
+                day,
+                ..Default::default()
+            },
+        }
+    }
+
+    fn record_on(&self, tenant: &str, day: u64, gpu_seconds: f64) {
+        let mut usage = self.usage.lock().unwrap();
+        let entry = usage.entry(tenant.to_string()).or_default();
+        if entry.day != day {
+            *entry = TenantUsage {
+                day,
+                ..Default::default()
+            };
+        }
+        entry.executions += 1;
+        entry.gpu_seconds += gpu_seconds;
+    }
+}
+
+// Days since the Unix epoch
+fn current_day() -> u64 {
+    unix_timestamp() / SECONDS_PER_DAY
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_usage_resets_daily() {
+        let meter = UsageMeter::new();
+        meter.record_on("cs101", 100, 2.5);
+        meter.record_on("cs101", 100, 1.0);
+        meter.record_on("cs102", 100, 0.0);
+
+        let usage = meter.usage_on("cs101", 100);
+        assert_eq!(usage.executions, 2);
+        assert_eq!(usage.gpu_seconds, 3.5);
+        assert_eq!(meter.usage_on("cs102", 100).gpu_seconds, 0.0);
+
+        assert_eq!(meter.usage_on("cs101", 101).executions, 0);
+        meter.record_on("cs101", 101, 4.0);
+        assert_eq!(meter.usage_on("cs101", 101).gpu_seconds, 4.0);
+    }
+}
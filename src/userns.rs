@@ -0,0 +1,238 @@
+use std::fs;
+use std::os::unix::fs::lchown;
+use std::path::Path;
+use std::process::Command;
+
+/// How the sandbox's root user relates to the host's
+#[derive(Debug, Clone, Copy, Default, PartialEq)]
+pub enum UsernsMode {
+    /// Root in the sandbox is root on the host
+    #[default]
+    Host,
+    /// Root in the sandbox is an unprivileged host user, through a rootless
+    /// daemon or Docker's `userns-remap`
+    Remap,
+}
+
+/// What the daemon maps container users to, from `docker info`
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum DaemonIsolation {
+    /// The daemon runs as an unprivileged user, so container root is that user
+    Rootless,
+    /// The daemon remaps container users into a subordinate ID range
+    Remapped,
+}
+
+/// Where sandbox users land on the host, from `SANDBOX_USERNS`, `SANDBOX_UID`
+/// and `SANDBOX_GID`
+#[derive(Debug, Clone, Default)]
+pub struct UserMapping {
+    mode: UsernsMode,
+    // Host user and group the sandbox's root runs as, which workspaces are handed to
+    owner: Option<(u32, u32)>,
+    // Why the environment couldn't be read; reported by `verify`
+    invalid: Option<String>,
+}
+
+impl UserMapping {
+    pub fn new(mode: UsernsMode, owner: Option<(u32, u32)>) -> Self {
+        Self {
+            mode,
+            owner,
+            invalid: None,
+        }
+    }
+
+    /// An unreadable setting is kept until startup checks it with `verify`, so
+    /// the server refuses to start rather than silently running as host root
+    pub fn from_env() -> Self {
+        let read = || -> Result<Self, String> {
+            let mode = match std::env::var("SANDBOX_USERNS").as_deref() {
+                Err(_) | Ok("") | Ok("host") => UsernsMode::Host,
+                Ok("remap") => UsernsMode::Remap,
+                Ok(other) => {
+                    return Err(format!(
+                        "SANDBOX_USERNS is '{other}', expected host or remap"
+                    ))
+                }
+            };
+            let id = |name: &str| -> Result<Option<u32>, String> {
+                match std::env::var(name) {
+                    Ok(value) if !value.is_empty() => value
+                        .parse()
+                        .map(Some)
+                        .map_err(|_| format!("{name} is '{value}', expected a numeric ID")),
+                    _ => Ok(None),
+                }
+            };
+            let owner = match (id("SANDBOX_UID")?, id("SANDBOX_GID")?) {
+                (Some(uid), gid) => Some((uid, gid.unwrap_or(uid))),
+                (None, Some(_)) => return Err("SANDBOX_GID needs SANDBOX_UID".to_string()),
+                (None, None) => None,
+            };
+            Ok(Self::new(mode, owner))
+        };
+        read().unwrap_or_else(|e| Self {
+            invalid: Some(e),
+            ..Self::default()
+        })
+    }
+
+    pub fn mode(&self) -> UsernsMode {
+        self.mode
+    }
+
+    /// Host user and group sandboxes run as in `remap` mode: embedded runtimes
+    /// switch to it, and workspaces are handed to it
+    pub fn owner(&self) -> Option<(u32, u32)> {
+        self.owner.filter(|_| self.mode == UsernsMode::Remap)
+    }
+
+    /// Checks that sandboxes can't run as host root in `remap` mode. Containers
+    /// need a daemon that isolates users, and a `userns-remap` daemon the host
+    /// user its containers' root maps to; embedded runtimes need a user to switch
+    /// to, and root to switch.
+    pub fn verify(&self, embedded: bool) -> Result<(), String> {
+        if let Some(e) = &self.invalid {
+            return Err(e.clone());
+        }
+        if self.mode == UsernsMode::Host {
+            return Ok(());
+        }
+        if embedded {
+            if self.owner.is_none() {
+                return Err(
+                    "SANDBOX_USERNS=remap with embedded runtimes needs SANDBOX_UID".to_string(),
+                );
+            }
+            // SAFETY: geteuid has no preconditions
+            if unsafe { libc::geteuid() } != 0 {
+                return Err(
+                    "SANDBOX_USERNS=remap with embedded runtimes needs isobox to run as root to switch users"
+                        .to_string(),
+                );
+            }
+            return Ok(());
+        }
+        match daemon_isolation(&docker_security_options()?) {
+            Some(DaemonIsolation::Rootless) => Ok(()),
+            Some(DaemonIsolation::Remapped) if self.owner.is_some() => Ok(()),
+            Some(DaemonIsolation::Remapped) => Err(
+                "SANDBOX_USERNS=remap with a userns-remap daemon needs SANDBOX_UID, the first ID of the remap user's range in /etc/subuid"
+                    .to_string(),
+            ),
+            None => Err(
+                "SANDBOX_USERNS=remap needs a rootless Docker or Podman daemon, or one started with userns-remap"
+                    .to_string(),
+            ),
+        }
+    }
+}
+
+/// Hands a workspace and everything in it to the host user sandboxes run as, so
+/// the program can write to it
+pub fn hand_over(path: &Path, (uid, gid): (u32, u32)) -> std::io::Result<()> {
+    // Links are changed themselves, never what they point to
+    lchown(path, Some(uid), Some(gid))?;
+    if fs::symlink_metadata(path)?.is_dir() {
+        for entry in fs::read_dir(path)? {
+            hand_over(&entry?.path(), (uid, gid))?;
+        }
+    }
+    Ok(())
+}
+
+fn docker_security_options() -> Result<Vec<String>, String> {
+    let output = Command::new("docker")
+        .args(["info", "--format", "{{json .SecurityOptions}}"])
+        .output()
+        .map_err(|e| format!("Failed to run docker info: {e}"))?;
+    if !output.status.success() {
+        return Err(format!(
+            "docker info failed: {}",
+            String::from_utf8_lossy(&output.stderr).trim()
+        ));
+    }
+    serde_json::from_slice(&output.stdout)
+        .map_err(|e| format!("Unexpected docker info output: {e}"))
+}
+
+/// How the daemon isolates users, from the security options `docker info`
+/// reports, e.g. `name=rootless` or `name=userns`
+pub fn daemon_isolation(security_options: &[String]) -> Option<DaemonIsolation> {
+    let has = |name: &str| {
+        security_options.iter().any(|option| {
+            option
+                .split(',')
+                .any(|field| field == format!("name={name}"))
+        })
+    };
+    if has("rootless") {
+        Some(DaemonIsolation::Rootless)
+    } else if has("userns") {
+        Some(DaemonIsolation::Remapped)
+    } else {
+        None
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_daemon_isolation() {
+        let options = |list: &[&str]| list.iter().map(|o| o.to_string()).collect::<Vec<_>>();
+        assert_eq!(
+            daemon_isolation(&options(&["name=seccomp,profile=builtin", "name=rootless"])),
+            Some(DaemonIsolation::Rootless)
+        );
+        assert_eq!(
+            daemon_isolation(&options(&["name=apparmor", "name=userns"])),
+            Some(DaemonIsolation::Remapped)
+        );
+        assert_eq!(
+            daemon_isolation(&options(&["name=seccomp,profile=builtin", "name=cgroupns"])),
+            None
+        );
+    }
+
+    #[test]
+    fn test_verify() {
+        assert!(UserMapping::default().verify(false).is_ok());
+        let invalid = UserMapping {
+            invalid: Some("SANDBOX_USERNS is 'on', expected host or remap".to_string()),
+            ..UserMapping::default()
+        };
+        assert!(invalid.verify(false).is_err());
+        assert!(UserMapping::new(UsernsMode::Remap, None)
+            .verify(true)
+            .is_err());
+    }
+
+    #[test]
+    fn test_owner_only_in_remap_mode() {
+        assert_eq!(
+            UserMapping::new(UsernsMode::Host, Some((1000, 1000))).owner(),
+            None
+        );
+        assert_eq!(
+            UserMapping::new(UsernsMode::Remap, Some((100000, 100000))).owner(),
+            Some((100000, 100000))
+        );
+    }
+
+    #[test]
+    fn test_hand_over() {
+        let workspace =
+            std::env::temp_dir().join(format!("isobox-userns-{}", uuid::Uuid::new_v4()));
+        fs::create_dir_all(workspace.join("src")).unwrap();
+        fs::write(workspace.join("src/main.py"), "").unwrap();
+        std::os::unix::fs::symlink("/etc/passwd", workspace.join("passwd")).unwrap();
+
+        // Handing a workspace to the user that already owns it works unprivileged
+        let (uid, gid) = unsafe { (libc::geteuid(), libc::getegid()) };
+        hand_over(&workspace, (uid, gid)).unwrap();
+        fs::remove_dir_all(&workspace).unwrap();
+    }
+}
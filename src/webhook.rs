@@ -0,0 +1,159 @@
+use crate::config::{IsoboxConfig, WebhookConfig};
+use crate::events::{EventKind, EventSink, ExecutionEvent};
+use crate::store::unix_timestamp;
+use ring::hmac;
+use std::collections::HashMap;
+use std::time::Duration;
+
+pub const SIGNATURE_HEADER: &str = "X-Isobox-Signature";
+pub const TIMESTAMP_HEADER: &str = "X-Isobox-Timestamp";
+pub const DELIVERY_HEADER: &str = "X-Isobox-Delivery";
+
+const MAX_ATTEMPTS: u32 = 3;
+
+/// Delivers each tenant's execution events to its configured webhook endpoints,
+/// and every tenant's security alerts to the operator's
+pub struct WebhookSink {
+    client: reqwest::Client,
+    webhooks: HashMap<String, Vec<WebhookConfig>>,
+    security_webhooks: Vec<WebhookConfig>,
+}
+
+impl WebhookSink {
+    /// Returns None when no webhook is configured
+    pub fn from_config(config: &IsoboxConfig) -> Option<Self> {
+        let webhooks: HashMap<String, Vec<WebhookConfig>> = config
+            .tenants
+            .iter()
+            .filter(|(_, policy)| !policy.webhooks.is_empty())
+            .map(|(tenant, policy)| (tenant.clone(), policy.webhooks.clone()))
+            .collect();
+        let security_webhooks = config.security_alerts.webhooks.clone();
+        if webhooks.is_empty() && security_webhooks.is_empty() {
+            return None;
+        }
+        let client = reqwest::Client::builder()
+            .timeout(Duration::from_secs(10))
+            .build()
+            .ok()?;
+        Some(Self {
+            client,
+            webhooks,
+            security_webhooks,
+        })
+    }
+}
+
+impl EventSink for WebhookSink {
+    fn publish(&self, event: &ExecutionEvent) {
+        let tenant_webhooks = self.webhooks.get(&event.tenant).into_iter().flatten();
+        let operator_webhooks = (event.event == EventKind::SecurityAlert)
+            .then_some(&self.security_webhooks)
+            .into_iter()
+            .flatten();
+        let webhooks: Vec<&WebhookConfig> = tenant_webhooks
+            .filter(|webhook| webhook.wants(event.event))
+            .chain(operator_webhooks)
+            .collect();
+        if webhooks.is_empty() {
+            return;
+        }
+        let body = match serde_json::to_string(event) {
+            Ok(body) => body,
+            Err(e) => {
+                log::warn!("Failed to encode execution event: {e}");
+                return;
+            }
+        };
+        for webhook in webhooks {
+            tokio::spawn(deliver(
+                self.client.clone(),
+                webhook.clone(),
+                uuid::Uuid::new_v4().to_string(),
+                body.clone(),
+            ));
+        }
+    }
+}
+
+// Retries keep the delivery id, so receivers can drop duplicates, but are signed
+// with a fresh timestamp
+async fn deliver(client: reqwest::Client, webhook: WebhookConfig, delivery: String, body: String) {
+    for attempt in 1..=MAX_ATTEMPTS {
+        let timestamp = unix_timestamp();
+        let result = client
+            .post(&webhook.url)
+            .header("Content-Type", "application/json")
+            .header(DELIVERY_HEADER, &delivery)
+            .header(TIMESTAMP_HEADER, timestamp.to_string())
+            .header(SIGNATURE_HEADER, sign(&webhook.secret, timestamp, &body))
+            .body(body.clone())
+            .send()
+            .await;
+        match result {
+            Ok(response) if response.status().is_success() => return,
+            Ok(response) => log::warn!(
+                "Webhook {} rejected delivery {delivery}: {}",
+                webhook.url,
+                response.status()
+            ),
+            Err(e) => log::warn!("Webhook {} delivery {delivery} failed: {e}", webhook.url),
+        }
+        if attempt < MAX_ATTEMPTS {
+            tokio::time::sleep(Duration::from_secs(2u64.pow(attempt))).await;
+        }
+    }
+    log::error!(
+        "Giving up on webhook {} delivery {delivery} after {MAX_ATTEMPTS} attempts",
+        webhook.url
+    );
+}
+
+/// Signature header value: `sha256=` followed by the hex HMAC-SHA256 of
+/// `"{timestamp}.{body}"`. Covering the timestamp lets receivers reject replays.
+pub fn sign(secret: &str, timestamp: u64, body: &str) -> String {
+    let key = hmac::Key::new(hmac::HMAC_SHA256, secret.as_bytes());
+    let tag = hmac::sign(&key, format!("{timestamp}.{body}").as_bytes());
+    format!("sha256={}", hex::encode(tag.as_ref()))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_signature_covers_timestamp() {
+        let signature = sign("secret", 1718000000, "{}");
+        assert_eq!(
+            signature,
+            "sha256=5f6f1832e277c162111f38e4396bd167c472115442b8ad0cc8347d5003526fe8"
+        );
+        assert_ne!(signature, sign("secret", 1718000001, "{}"));
+        assert_ne!(signature, sign("other", 1718000000, "{}"));
+    }
+
+    #[test]
+    fn test_sink_only_built_for_configured_webhooks() {
+        let config = IsoboxConfig::from_json(r#"{"tenants": {"cs101": {}}}"#).unwrap();
+        assert!(WebhookSink::from_config(&config).is_none());
+
+        let config = IsoboxConfig::from_json(
+            r#"{"tenants": {"cs101": {"webhooks": [
+                {"url": "https://grader.example.com/hook", "secret": "s3cret", "events": ["finished"]}
+            ]}}}"#,
+        )
+        .unwrap();
+        let sink = WebhookSink::from_config(&config).unwrap();
+        assert_eq!(sink.webhooks["cs101"][0].events.len(), 1);
+
+        let config = IsoboxConfig::from_json(
+            r#"{"security_alerts": {"webhooks": [
+                {"url": "https://soc.example.com/hook", "secret": "s3cret"}
+            ]}}"#,
+        )
+        .unwrap();
+        let sink = WebhookSink::from_config(&config).unwrap();
+        assert!(sink.webhooks.is_empty());
+        assert_eq!(sink.security_webhooks.len(), 1);
+    }
+}
@@ -0,0 +1,781 @@
+use crate::executor::{ExecuteRequest, ExecuteResponse};
+use crate::priority::Priority;
+use serde::Serialize;
+use std::collections::hash_map::DefaultHasher;
+use std::collections::{BTreeMap, HashMap};
+use std::future::Future;
+use std::hash::{Hash, Hasher};
+use std::pin::Pin;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::Mutex;
+use std::task::{ready, Context, Poll};
+use std::time::{Instant, SystemTime};
+use tokio::sync::{mpsc, oneshot};
+use uuid::Uuid;
+
+/// What a remote agent advertised when it connected
+#[derive(Debug, Clone, Serialize)]
+pub struct WorkerInfo {
+    // Unique per connection, so a reconnecting agent never collides with its old stream
+    pub id: String,
+    pub name: String,
+    pub languages: Vec<String>,
+    pub capacity: usize,
+    pub arch: String,
+    pub gpu: bool,
+    /// Most jobs of a language the agent runs at once, for the languages it caps
+    #[serde(skip_serializing_if = "HashMap::is_empty")]
+    pub language_limits: HashMap<String, usize>,
+    pub in_flight: usize,
+    /// Jobs in flight per language
+    #[serde(skip_serializing_if = "HashMap::is_empty")]
+    pub in_flight_by_language: HashMap<String, usize>,
+    /// Takes no new jobs, so it can be removed once `in_flight` reaches 0
+    pub draining: bool,
+    /// Batch jobs stopped here to make room for interactive ones
+    pub preempted: u64,
+}
+
+impl WorkerInfo {
+    // Whether the worker's cap on the language, if any, leaves room for a job
+    fn has_slot_for(&self, language: &str) -> bool {
+        self.language_limits.get(language).map_or(true, |&limit| {
+            self.in_flight_by_language
+                .get(language)
+                .copied()
+                .unwrap_or(0)
+                < limit
+        })
+    }
+
+    fn start(&mut self, language: &str) {
+        self.in_flight += 1;
+        *self
+            .in_flight_by_language
+            .entry(language.to_string())
+            .or_default() += 1;
+    }
+
+    fn finish(&mut self, language: &str) {
+        self.in_flight = self.in_flight.saturating_sub(1);
+        if let Some(count) = self.in_flight_by_language.get_mut(language) {
+            *count -= 1;
+            if *count == 0 {
+                self.in_flight_by_language.remove(language);
+            }
+        }
+    }
+}
+
+/// Connected workers that can run a language, and how busy they are. Draining
+/// workers count towards `in_flight` but not `capacity`.
+#[derive(Debug, Clone, Default, PartialEq, Serialize)]
+pub struct LanguageCapacity {
+    pub workers: usize,
+    pub capacity: usize,
+    pub in_flight: usize,
+}
+
+/// A job sent to an agent; the request is the JSON-encoded `ExecuteRequest`
+#[derive(Debug, Clone)]
+pub struct WorkerJob {
+    pub job_id: String,
+    pub tenant: String,
+    pub request_json: String,
+    /// The caller's deadline, which the request doesn't serialize
+    pub deadline: Option<SystemTime>,
+}
+
+/// What the coordinator tells an agent
+#[derive(Debug, Clone)]
+pub enum WorkerCommand {
+    Run(WorkerJob),
+    /// Stop the job with this ID, which nobody waits for any more, so no result
+    /// is expected
+    Stop(String),
+}
+
+/// Why a job sent to an agent has no response
+#[derive(Debug, Clone, PartialEq)]
+pub enum JobFailure {
+    /// The agent reported this error
+    Failed(String),
+    /// The job was stopped to give its slot to an interactive request
+    Preempted,
+}
+
+/// Outcome of a job sent to an agent
+pub type JobOutcome = Result<ExecuteResponse, JobFailure>;
+
+/// A job sent to an agent, resolving to its outcome, or an error if the agent
+/// disconnected. Dropping it before then, e.g. because the caller disconnected,
+/// stops the job on the agent.
+pub struct Dispatched<'a> {
+    registry: &'a WorkerRegistry,
+    job_id: String,
+    reply: oneshot::Receiver<JobOutcome>,
+    done: bool,
+}
+
+impl Future for Dispatched<'_> {
+    type Output = Result<JobOutcome, oneshot::error::RecvError>;
+
+    fn poll(mut self: Pin<&mut Self>, cx: &mut Context<'_>) -> Poll<Self::Output> {
+        let outcome = ready!(Pin::new(&mut self.reply).poll(cx));
+        self.done = true;
+        Poll::Ready(outcome)
+    }
+}
+
+impl Drop for Dispatched<'_> {
+    fn drop(&mut self) {
+        if !self.done {
+            self.registry.cancel(&self.job_id);
+        }
+    }
+}
+
+struct ConnectedWorker {
+    info: WorkerInfo,
+    commands: mpsc::UnboundedSender<WorkerCommand>,
+}
+
+struct PendingJob {
+    worker_id: String,
+    language: String,
+    batch: bool,
+    dispatched_at: Instant,
+    reply: oneshot::Sender<JobOutcome>,
+}
+
+/// Remote agents connected to this coordinator and the jobs in flight on them
+#[derive(Default)]
+pub struct WorkerRegistry {
+    workers: Mutex<HashMap<String, ConnectedWorker>>,
+    pending: Mutex<HashMap<String, PendingJob>>,
+    // Including those on workers that have since disconnected
+    preemptions: AtomicU64,
+}
+
+impl WorkerRegistry {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    pub fn register(
+        &self,
+        name: &str,
+        languages: Vec<String>,
+        capacity: usize,
+        arch: &str,
+        gpu: bool,
+        language_limits: HashMap<String, usize>,
+        commands: mpsc::UnboundedSender<WorkerCommand>,
+    ) -> String {
+        let id = Uuid::new_v4().to_string();
+        let info = WorkerInfo {
+            id: id.clone(),
+            name: name.to_string(),
+            languages,
+            capacity: capacity.max(1),
+            arch: arch.to_string(),
+            gpu,
+            language_limits,
+            in_flight: 0,
+            in_flight_by_language: HashMap::new(),
+            draining: false,
+            preempted: 0,
+        };
+        log::info!(
+            "Worker {name} connected ({} languages, capacity {}, {arch}{})",
+            info.languages.len(),
+            info.capacity,
+            if gpu { ", gpu" } else { "" }
+        );
+        self.workers
+            .lock()
+            .unwrap()
+            .insert(id.clone(), ConnectedWorker { info, commands });
+        id
+    }
+
+    /// Forgets a disconnected worker. Its in-flight jobs fail because their reply
+    /// channels are dropped.
+    pub fn unregister(&self, id: &str) {
+        if let Some(worker) = self.workers.lock().unwrap().remove(id) {
+            log::warn!("Worker {} disconnected", worker.info.name);
+        }
+        self.pending
+            .lock()
+            .unwrap()
+            .retain(|_, job| job.worker_id != id);
+    }
+
+    pub fn workers(&self) -> Vec<WorkerInfo> {
+        let mut workers: Vec<WorkerInfo> = self
+            .workers
+            .lock()
+            .unwrap()
+            .values()
+            .map(|worker| worker.info.clone())
+            .collect();
+        workers.sort_by(|a, b| a.name.cmp(&b.name));
+        workers
+    }
+
+    /// Stops sending jobs to the workers with this name or connection ID, e.g. before
+    /// an autoscaler removes the machine. Their jobs in flight still complete.
+    /// Returns the workers now draining.
+    pub fn drain(&self, name_or_id: &str) -> Vec<WorkerInfo> {
+        let mut drained: Vec<WorkerInfo> = self
+            .workers
+            .lock()
+            .unwrap()
+            .values_mut()
+            .filter(|worker| worker.info.id == name_or_id || worker.info.name == name_or_id)
+            .map(|worker| {
+                if !worker.info.draining {
+                    log::info!(
+                        "Draining worker {} ({} jobs in flight)",
+                        worker.info.name,
+                        worker.info.in_flight
+                    );
+                }
+                worker.info.draining = true;
+                worker.info.clone()
+            })
+            .collect();
+        drained.sort_by(|a, b| a.name.cmp(&b.name));
+        drained
+    }
+
+    /// Capacity and load of the connected workers per language they advertised. A
+    /// worker's capacity for a language it caps is at most the cap.
+    pub fn capacity_by_language(&self) -> BTreeMap<String, LanguageCapacity> {
+        let mut languages: BTreeMap<String, LanguageCapacity> = BTreeMap::new();
+        for worker in self.workers.lock().unwrap().values() {
+            for language in &worker.info.languages {
+                let entry = languages.entry(language.clone()).or_default();
+                entry.in_flight += worker.info.in_flight;
+                if !worker.info.draining {
+                    entry.workers += 1;
+                    entry.capacity += worker
+                        .info
+                        .language_limits
+                        .get(language)
+                        .map_or(worker.info.capacity, |&limit| {
+                            limit.min(worker.info.capacity)
+                        });
+                }
+            }
+        }
+        languages
+    }
+
+    /// Batch jobs preempted since this coordinator started
+    pub fn preemptions(&self) -> u64 {
+        self.preemptions.load(Ordering::Relaxed)
+    }
+
+    /// Whether some connected worker could run the request if it had free capacity
+    pub fn has_candidate(&self, language: &str, arch: Option<&str>, gpu: bool) -> bool {
+        self.workers
+            .lock()
+            .unwrap()
+            .values()
+            .any(|worker| matches(&worker.info, language, arch, gpu))
+    }
+
+    /// Sends the request to the least loaded matching worker with free capacity,
+    /// and a free slot of the language if the worker caps it. A request with an
+    /// affinity key, e.g. its lockfile, goes to the free worker the key hashes to
+    /// instead, so requests with the same key find that worker's caches warm.
+    /// When every matching
+    /// worker is full, an interactive request takes the slot of the batch job
+    /// dispatched last, which loses the least work; that job's caller
+    /// gets `JobFailure::Preempted`. Returns None when no worker can take it, so the
+    /// caller can run it locally.
+    pub fn dispatch(
+        &self,
+        request: &ExecuteRequest,
+        tenant: &str,
+        arch: Option<&str>,
+        affinity: Option<&str>,
+    ) -> Option<Dispatched<'_>> {
+        let gpu = request.gpu.unwrap_or(false);
+        let batch = request.priority == Some(Priority::Batch);
+        // Results are cached by the server, so agents don't keep copies of their own
+        let request_json = serde_json::to_string(&ExecuteRequest {
+            cache: Some(false),
+            ..request.clone()
+        })
+        .ok()?;
+
+        let mut workers = self.workers.lock().unwrap();
+        let mut pending = self.pending.lock().unwrap();
+        let candidates = workers
+            .values()
+            .filter(|worker| matches(&worker.info, &request.language, arch, gpu))
+            .filter(|worker| worker.info.in_flight < worker.info.capacity)
+            .filter(|worker| worker.info.has_slot_for(&request.language));
+        let free = match affinity {
+            Some(key) => candidates.max_by_key(|worker| affinity_weight(key, &worker.info.name)),
+            None => {
+                candidates.min_by_key(|worker| worker.info.in_flight * 1000 / worker.info.capacity)
+            }
+        }
+        .map(|worker| worker.info.id.clone());
+        let worker_id = match free {
+            Some(worker_id) => worker_id,
+            None if !batch => {
+                let (job_id, _) = pending
+                    .iter()
+                    .filter(|(_, job)| job.batch)
+                    .filter(|(_, job)| {
+                        workers.get(&job.worker_id).is_some_and(|worker| {
+                            matches(&worker.info, &request.language, arch, gpu)
+                                && (job.language == request.language
+                                    || worker.info.has_slot_for(&request.language))
+                        })
+                    })
+                    .max_by_key(|(_, job)| job.dispatched_at)?;
+                let job_id = job_id.clone();
+                let preempted = pending.remove(&job_id)?;
+                let worker = workers.get_mut(&preempted.worker_id)?;
+                log::info!(
+                    "Preempting batch job {job_id} on worker {} for an interactive request",
+                    worker.info.name
+                );
+                // The slot passes to the new job rather than being freed
+                let _ = worker.commands.send(WorkerCommand::Stop(job_id));
+                worker.info.finish(&preempted.language);
+                worker.info.preempted += 1;
+                self.preemptions.fetch_add(1, Ordering::Relaxed);
+                let _ = preempted.reply.send(Err(JobFailure::Preempted));
+                preempted.worker_id
+            }
+            None => return None,
+        };
+        let worker = workers.get_mut(&worker_id)?;
+
+        let job_id = Uuid::new_v4().to_string();
+        let (reply, receiver) = oneshot::channel();
+        let job = WorkerJob {
+            job_id: job_id.clone(),
+            tenant: tenant.to_string(),
+            request_json,
+            deadline: request.deadline,
+        };
+        if worker.commands.send(WorkerCommand::Run(job)).is_err() {
+            return None;
+        }
+        worker.info.start(&request.language);
+        pending.insert(
+            job_id.clone(),
+            PendingJob {
+                worker_id,
+                language: request.language.clone(),
+                batch,
+                dispatched_at: Instant::now(),
+                reply,
+            },
+        );
+        Some(Dispatched {
+            registry: self,
+            job_id,
+            reply: receiver,
+            done: false,
+        })
+    }
+
+    // Stops a job nobody waits for any more and frees its slot
+    fn cancel(&self, job_id: &str) {
+        let Some(job) = self.pending.lock().unwrap().remove(job_id) else {
+            return;
+        };
+        if let Some(worker) = self.workers.lock().unwrap().get_mut(&job.worker_id) {
+            log::info!(
+                "Stopping job {job_id} on worker {}, whose caller went away",
+                worker.info.name
+            );
+            let _ = worker
+                .commands
+                .send(WorkerCommand::Stop(job_id.to_string()));
+            worker.info.finish(&job.language);
+        }
+    }
+
+    /// Delivers an agent's result to the request waiting for it. Only the worker
+    /// the job was sent to can complete it.
+    pub fn complete(&self, worker_id: &str, job_id: &str, outcome: JobOutcome) {
+        let job = {
+            let mut pending = self.pending.lock().unwrap();
+            match pending.get(job_id) {
+                Some(job) if job.worker_id == worker_id => pending.remove(job_id),
+                Some(_) => {
+                    log::warn!("Ignoring result for job {job_id} from worker {worker_id}, which wasn't sent it");
+                    return;
+                }
+                None => None,
+            }
+        };
+        let Some(job) = job else {
+            // Also the case for a preempted job that finished before it was stopped
+            log::warn!("Result for unknown job {job_id}");
+            return;
+        };
+        if let Some(worker) = self.workers.lock().unwrap().get_mut(&job.worker_id) {
+            worker.info.finish(&job.language);
+        }
+        let _ = job.reply.send(outcome);
+    }
+}
+
+// Rendezvous hash of an affinity key for a worker: the key goes to the worker
+// with the highest weight, so a worker joining or leaving only moves the keys it
+// takes or had. Workers are told apart by name, so an agent that reconnects
+// keeps its keys.
+fn affinity_weight(key: &str, worker: &str) -> u64 {
+    let mut hasher = DefaultHasher::new();
+    key.hash(&mut hasher);
+    worker.hash(&mut hasher);
+    hasher.finish()
+}
+
+fn matches(worker: &WorkerInfo, language: &str, arch: Option<&str>, gpu: bool) -> bool {
+    !worker.draining
+        && worker.languages.iter().any(|l| l == language)
+        && arch.map_or(true, |arch| worker.arch == arch)
+        && (!gpu || worker.gpu)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn request(language: &str, gpu: bool) -> ExecuteRequest {
+        ExecuteRequest {
+            language: language.to_string(),
+            code: "print('hi')".to_string(),
+            gpu: Some(gpu),
+            ..Default::default()
+        }
+    }
+
+    async fn next_job(commands: &mut mpsc::UnboundedReceiver<WorkerCommand>) -> WorkerJob {
+        match commands.recv().await {
+            Some(WorkerCommand::Run(job)) => job,
+            other => panic!("Expected a job, got {other:?}"),
+        }
+    }
+
+    #[tokio::test]
+    async fn test_dispatch_routes_by_capability_and_load() {
+        let registry = WorkerRegistry::new();
+        let (cpu_tx, mut cpu_jobs) = mpsc::unbounded_channel();
+        let (gpu_tx, mut gpu_jobs) = mpsc::unbounded_channel();
+        let languages = vec!["python".to_string()];
+        let cpu_id = registry.register(
+            "cpu-1",
+            languages.clone(),
+            1,
+            "amd64",
+            false,
+            HashMap::new(),
+            cpu_tx,
+        );
+        let gpu_id =
+            registry.register("gpu-1", languages, 2, "arm64", true, HashMap::new(), gpu_tx);
+
+        assert!(registry
+            .dispatch(&request("rust", false), "default", None, None)
+            .is_none());
+
+        let gpu_reply = registry
+            .dispatch(&request("python", true), "cs101", None, None)
+            .unwrap();
+        let job = next_job(&mut gpu_jobs).await;
+        assert_eq!(job.tenant, "cs101");
+
+        // cpu-1 is idle, so it is preferred over the half-busy gpu-1
+        let cpu_reply = registry
+            .dispatch(&request("python", false), "default", None, None)
+            .unwrap();
+        assert!(cpu_jobs.recv().await.is_some());
+        assert!(registry
+            .dispatch(&request("python", false), "default", Some("amd64"), None)
+            .is_none());
+
+        // Only the worker the job was sent to can complete it
+        registry.complete(&cpu_id, &job.job_id, Ok(ExecuteResponse::default()));
+        registry.complete(
+            &gpu_id,
+            &job.job_id,
+            Ok(ExecuteResponse {
+                stdout: "hi\n".to_string(),
+                ..Default::default()
+            }),
+        );
+        assert_eq!(gpu_reply.await.unwrap().unwrap().stdout, "hi\n");
+
+        registry.unregister(&gpu_id);
+        let workers = registry.workers();
+        assert_eq!(workers.len(), 1);
+        assert_eq!(workers[0].name, "cpu-1");
+        assert_eq!(workers[0].in_flight, 1);
+        drop(cpu_reply);
+    }
+
+    #[tokio::test]
+    async fn test_drained_workers_take_no_jobs() {
+        let registry = WorkerRegistry::new();
+        let (tx, mut jobs) = mpsc::unbounded_channel();
+        let languages = vec!["python".to_string(), "rust".to_string()];
+        registry.register(
+            "cpu-1",
+            languages.clone(),
+            2,
+            "amd64",
+            false,
+            HashMap::new(),
+            tx.clone(),
+        );
+        registry.register("cpu-2", languages, 4, "amd64", false, HashMap::new(), tx);
+
+        let reply = registry
+            .dispatch(&request("python", false), "default", None, None)
+            .unwrap();
+        let job = next_job(&mut jobs).await;
+        let capacity = registry.capacity_by_language();
+        assert_eq!(
+            capacity["rust"],
+            LanguageCapacity {
+                workers: 2,
+                capacity: 6,
+                in_flight: 1,
+            }
+        );
+
+        assert!(registry.drain("missing").is_empty());
+        let drained = registry.drain("cpu-1");
+        assert_eq!(drained.len(), 1);
+        assert!(drained[0].draining);
+        assert_eq!(registry.capacity_by_language()["python"].capacity, 4);
+
+        // Only cpu-2 is left to take jobs, and once it's drained too nothing is
+        registry.drain("cpu-2");
+        assert!(!registry.has_candidate("python", None, false));
+        assert!(registry
+            .dispatch(&request("python", false), "default", None, None)
+            .is_none());
+
+        // Jobs already in flight still complete
+        let worker = registry
+            .workers()
+            .into_iter()
+            .find(|worker| worker.in_flight == 1)
+            .unwrap();
+        registry.complete(&worker.id, &job.job_id, Ok(ExecuteResponse::default()));
+        assert!(reply.await.unwrap().is_ok());
+        assert_eq!(registry.capacity_by_language()["python"].in_flight, 0);
+    }
+
+    #[tokio::test]
+    async fn test_disconnect_fails_in_flight_jobs() {
+        let registry = WorkerRegistry::new();
+        let (tx, _jobs) = mpsc::unbounded_channel();
+        let id = registry.register(
+            "cpu-1",
+            vec!["python".to_string()],
+            4,
+            "amd64",
+            false,
+            HashMap::new(),
+            tx,
+        );
+
+        let reply = registry
+            .dispatch(&request("python", false), "default", None, None)
+            .unwrap();
+        registry.unregister(&id);
+        assert!(reply.await.is_err());
+    }
+
+    #[tokio::test]
+    async fn test_abandoned_jobs_are_stopped() {
+        let registry = WorkerRegistry::new();
+        let (tx, mut commands) = mpsc::unbounded_channel();
+        let id = registry.register(
+            "cpu-1",
+            vec!["python".to_string()],
+            4,
+            "amd64",
+            false,
+            HashMap::new(),
+            tx,
+        );
+
+        let reply = registry
+            .dispatch(&request("python", false), "default", None, None)
+            .unwrap();
+        let job = next_job(&mut commands).await;
+        assert_eq!(registry.workers()[0].in_flight, 1);
+
+        // The caller stops waiting before the agent reports back
+        drop(reply);
+        match commands.recv().await {
+            Some(WorkerCommand::Stop(job_id)) => assert_eq!(job_id, job.job_id),
+            other => panic!("Expected the job to be stopped, got {other:?}"),
+        }
+        assert_eq!(registry.workers()[0].in_flight, 0);
+
+        // Finished jobs have nothing to stop
+        let reply = registry
+            .dispatch(&request("python", false), "default", None, None)
+            .unwrap();
+        let job = next_job(&mut commands).await;
+        registry.complete(&id, &job.job_id, Ok(ExecuteResponse::default()));
+        assert!(reply.await.unwrap().is_ok());
+        assert!(commands.try_recv().is_err());
+    }
+
+    #[tokio::test]
+    async fn test_interactive_requests_preempt_batch_jobs() {
+        let registry = WorkerRegistry::new();
+        let (tx, mut commands) = mpsc::unbounded_channel();
+        let id = registry.register(
+            "cpu-1",
+            vec!["python".to_string()],
+            2,
+            "amd64",
+            false,
+            HashMap::new(),
+            tx,
+        );
+        let batch = ExecuteRequest {
+            priority: Some(Priority::Batch),
+            ..request("python", false)
+        };
+
+        let first = registry.dispatch(&batch, "default", None, None).unwrap();
+        let first_job = next_job(&mut commands).await;
+        let second = registry.dispatch(&batch, "default", None, None).unwrap();
+        let second_job = next_job(&mut commands).await;
+        // Batch requests never preempt each other
+        assert!(registry.dispatch(&batch, "default", None, None).is_none());
+        assert!(registry
+            .dispatch(&request("rust", false), "default", None, None)
+            .is_none());
+
+        // The batch job dispatched last gives up its slot
+        let interactive = registry
+            .dispatch(&request("python", false), "default", None, None)
+            .unwrap();
+        match commands.recv().await {
+            Some(WorkerCommand::Stop(job_id)) => assert_eq!(job_id, second_job.job_id),
+            other => panic!("Expected a preemption, got {other:?}"),
+        }
+        let job = next_job(&mut commands).await;
+        assert_eq!(second.await.unwrap().unwrap_err(), JobFailure::Preempted);
+        assert_eq!(registry.preemptions(), 1);
+        let workers = registry.workers();
+        assert_eq!(workers[0].in_flight, 2);
+        assert_eq!(workers[0].preempted, 1);
+
+        // A late result from the preempted job is ignored
+        registry.complete(&id, &second_job.job_id, Ok(ExecuteResponse::default()));
+        assert_eq!(registry.workers()[0].in_flight, 2);
+
+        registry.complete(&id, &job.job_id, Ok(ExecuteResponse::default()));
+        assert!(interactive.await.unwrap().is_ok());
+        registry.complete(&id, &first_job.job_id, Ok(ExecuteResponse::default()));
+        assert!(first.await.unwrap().is_ok());
+    }
+
+    #[tokio::test]
+    async fn test_language_limits() {
+        let registry = WorkerRegistry::new();
+        let (tx, mut commands) = mpsc::unbounded_channel();
+        let languages = vec!["java".to_string(), "python".to_string()];
+        let limits = HashMap::from([("java".to_string(), 1)]);
+        let id = registry.register("cpu-1", languages, 4, "amd64", false, limits, tx);
+        assert_eq!(registry.capacity_by_language()["java"].capacity, 1);
+
+        let java = registry
+            .dispatch(&request("java", false), "default", None, None)
+            .unwrap();
+        let job = next_job(&mut commands).await;
+        // The worker has room, but not for another Java job
+        assert!(registry
+            .dispatch(&request("java", false), "default", None, None)
+            .is_none());
+        let _python = registry
+            .dispatch(&request("python", false), "default", None, None)
+            .unwrap();
+        assert_eq!(registry.workers()[0].in_flight_by_language["java"], 1);
+
+        registry.complete(&id, &job.job_id, Ok(ExecuteResponse::default()));
+        assert!(java.await.unwrap().is_ok());
+        assert!(!registry.workers()[0]
+            .in_flight_by_language
+            .contains_key("java"));
+        assert!(registry
+            .dispatch(&request("java", false), "default", None, None)
+            .is_some());
+    }
+
+    #[tokio::test]
+    async fn test_affinity_keys_stick_to_a_worker() {
+        let registry = WorkerRegistry::new();
+        let (tx, _commands) = mpsc::unbounded_channel();
+        let languages = vec!["python".to_string()];
+        registry.register(
+            "cpu-1",
+            languages.clone(),
+            2,
+            "amd64",
+            false,
+            HashMap::new(),
+            tx.clone(),
+        );
+        registry.register("cpu-2", languages, 2, "amd64", false, HashMap::new(), tx);
+        let key = "numpy==2.0.0";
+        let preferred = if affinity_weight(key, "cpu-1") > affinity_weight(key, "cpu-2") {
+            "cpu-1"
+        } else {
+            "cpu-2"
+        };
+        let busy = |name: &str| {
+            registry
+                .workers()
+                .into_iter()
+                .find(|worker| worker.name == name)
+                .unwrap()
+                .in_flight
+        };
+
+        // The key's worker takes it even when the other one is idle
+        let python = request("python", false);
+        let _first = registry
+            .dispatch(&python, "default", None, Some(key))
+            .unwrap();
+        let _second = registry
+            .dispatch(&python, "default", None, Some(key))
+            .unwrap();
+        assert_eq!(busy(preferred), 2);
+
+        // Once it's full, the key overflows to another worker
+        let _third = registry
+            .dispatch(&python, "default", None, Some(key))
+            .unwrap();
+        assert_eq!(
+            registry
+                .workers()
+                .iter()
+                .map(|w| w.in_flight)
+                .sum::<usize>(),
+            3
+        );
+        assert_eq!(busy(preferred), 2);
+    }
+}